@@ -0,0 +1,131 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// The archive formats supported by NewArchiveWriter.
+const (
+	ArchiveTarGz = "tar.gz"
+	ArchiveZip   = "zip"
+)
+
+// ArchiveWriter writes files and directories into an archive.
+type ArchiveWriter interface {
+	// AddFile adds a file named name, a slash separated relative path, with
+	// the size bytes of data read from r.
+	AddFile(name string, size int64, mode os.FileMode, modTime time.Time, r io.Reader) error
+
+	// AddDir adds a directory named name, a slash separated relative path.
+	AddDir(name string, mode os.FileMode, modTime time.Time) error
+
+	// Close finishes the archive. It doesn't close the underlying writer.
+	Close() error
+}
+
+// NewArchiveWriter returns an ArchiveWriter that writes an archive of the
+// format, one of the Archive* constants, to w.
+func NewArchiveWriter(w io.Writer, format string) (ArchiveWriter, error) {
+	switch format {
+	case ArchiveTarGz:
+		gz := gzip.NewWriter(w)
+		return &tarGzWriter{gz: gz, tw: tar.NewWriter(gz)}, nil
+	case ArchiveZip:
+		return &zipWriter{zw: zip.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("unsupported archive format %q; use %s or %s", format, ArchiveTarGz, ArchiveZip)
+}
+
+// archiveFileMode returns the permissions to store for a file, using the
+// defaults if the file has none.
+func archiveFileMode(mode os.FileMode, isDir bool) os.FileMode {
+	switch {
+	case mode.Perm() != 0:
+		return mode.Perm()
+	case isDir:
+		return 0755
+	}
+	return 0644
+}
+
+// archiveName cleans a name for use in an archive, which never has a leading
+// slash.
+func archiveName(name string) string {
+	return strings.TrimLeft(name, "/")
+}
+
+// tarGzWriter writes a gzip compressed tar archive.
+type tarGzWriter struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarGzWriter) AddFile(name string, size int64, mode os.FileMode, modTime time.Time, r io.Reader) error {
+	err := a.tw.WriteHeader(&tar.Header{
+		Name:     archiveName(name),
+		Mode:     int64(archiveFileMode(mode, false)),
+		Size:     size,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(a.tw, r, size)
+	return err
+}
+
+func (a *tarGzWriter) AddDir(name string, mode os.FileMode, modTime time.Time) error {
+	return a.tw.WriteHeader(&tar.Header{
+		Name:     archiveName(name) + "/",
+		Mode:     int64(archiveFileMode(mode, true)),
+		ModTime:  modTime,
+		Typeflag: tar.TypeDir,
+	})
+}
+
+func (a *tarGzWriter) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+// zipWriter writes a zip archive with deflate compression.
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (a *zipWriter) AddFile(name string, size int64, mode os.FileMode, modTime time.Time, r io.Reader) error {
+	header := &zip.FileHeader{Name: archiveName(name), Method: zip.Deflate}
+	header.SetModTime(modTime)
+	header.SetMode(archiveFileMode(mode, false))
+	w, err := a.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(w, r, size)
+	return err
+}
+
+func (a *zipWriter) AddDir(name string, mode os.FileMode, modTime time.Time) error {
+	header := &zip.FileHeader{Name: archiveName(name) + "/"}
+	header.SetModTime(modTime)
+	header.SetMode(os.ModeDir | archiveFileMode(mode, true))
+	_, err := a.zw.CreateHeader(header)
+	return err
+}
+
+func (a *zipWriter) Close() error {
+	return a.zw.Close()
+}
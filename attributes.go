@@ -0,0 +1,88 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const (
+	createFileAttributesTable = `CREATE TABLE IF NOT EXISTS FileAttributes (
+        FileID      INTEGER PRIMARY KEY NOT NULL,
+        Attributes  TEXT                NOT NULL
+	);`
+
+	getFileAttributes    = `SELECT Attributes FROM FileAttributes WHERE FileID = ?;`
+	setFileAttributes    = `INSERT OR REPLACE INTO FileAttributes (FileID, Attributes) VALUES (?, ?);`
+	removeFileAttributes = `DELETE FROM FileAttributes WHERE FileID = ?;`
+)
+
+// MaxAttributesLength is the longest set of platform file attributes, as
+// stored, that can be kept for a file. Attributes are encrypted by the client
+// so this includes the overhead.
+const MaxAttributesLength = 256 * 1024
+
+// SetFileAttributes stores the platform attributes of the file, such as the
+// hidden flag on Windows or the extended attributes on Unix, replacing the
+// ones it already had. Empty attributes remove them from the file. The server
+// stores the attributes as given; clients encrypt them first.
+func (s *Storage) SetFileAttributes(userID, fileID int, attributes string) error {
+	defer s.timeOperation("SetFileAttributes", userID)()
+
+	if len(attributes) > MaxAttributesLength {
+		return fmt.Errorf("the attributes of a file can be at most %d bytes", MaxAttributesLength)
+	}
+
+	return s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return ErrNotOwner
+		}
+
+		if attributes == "" {
+			_, err = tx.Exec(removeFileAttributes, fileID)
+		} else {
+			_, err = tx.Exec(setFileAttributes, fileID, attributes)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set the attributes of the file: %v", err)
+		}
+		return nil
+	})
+}
+
+// GetFileAttributes returns the platform attributes stored for the file or
+// an empty string if the file doesn't have any.
+func (s *Storage) GetFileAttributes(userID, fileID int) (string, error) {
+	defer s.timeOperation("GetFileAttributes", userID)()
+
+	var attributes string
+	err := s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return ErrNotOwner
+		}
+
+		err = tx.QueryRow(getFileAttributes, fileID).Scan(&attributes)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to get the attributes of the file: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return attributes, nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	setUserCaseInsensitive = `UPDATE Users SET CaseInsensitive = ? WHERE UserID = ?;`
+	updateFileNameKey      = `UPDATE FileInfo SET NameKey = ? WHERE FileID = ? AND UserID = ?;`
+	clearUserNameKeys      = `UPDATE FileInfo SET NameKey = '' WHERE UserID = ?;`
+	getFileNameKey         = `SELECT NameKey FROM FileInfo WHERE FileID = ?;`
+	getUserNameKeys        = `SELECT FileID, NameKey FROM FileInfo WHERE UserID = ? AND TrashedAt = 0;`
+	findFileByNameKey      = `SELECT FileID FROM FileInfo WHERE UserID = ? AND NameKey = ? AND TrashedAt = 0 AND FileID != ? LIMIT 1;`
+)
+
+// MaxNameKeyLength is the longest name key that can be given to a file.
+const MaxNameKeyLength = 256
+
+// NormalizeName returns the plaintext file name in Unicode normalization
+// form C, the form names are compared in. macOS file systems hand out names
+// in a decomposed form while most others use the composed one, so the same
+// name can be spelled with different bytes. Names are stored in the form they
+// were given in; only comparisons use this.
+func NormalizeName(name string) string {
+	return norm.NFC.String(name)
+}
+
+// FoldName returns the form of a plaintext file name that is compared when
+// paths are treated case-insensitively. Accounts without a crypto password
+// use it as the name key of their files; the client derives the name keys of
+// encrypted names from it with a key the server doesn't have.
+func FoldName(name string) string {
+	return strings.ToLower(NormalizeName(name))
+}
+
+// SetCaseInsensitive turns case-insensitive paths on or off for the user.
+// When turning them on, nameKeys maps the ids of the user's files to their
+// name keys and must cover every file that isn't in the trash; ErrFileExists
+// is returned if two of those files have the same name key. Turning them off
+// clears the name keys of all of the user's files.
+func (s *Storage) SetCaseInsensitive(userID int, enabled bool, nameKeys map[int]string) error {
+	defer s.timeOperation("SetCaseInsensitive", userID)()
+
+	return s.transact(func(tx *sql.Tx) error {
+		_, err := tx.Exec(clearUserNameKeys, userID)
+		if err != nil {
+			return fmt.Errorf("failed to clear the name keys of the user's files: %v", err)
+		}
+
+		if enabled {
+			for fileID, nameKey := range nameKeys {
+				if nameKey == "" || len(nameKey) > MaxNameKeyLength {
+					return fmt.Errorf("a name key must be between 1 and %d bytes", MaxNameKeyLength)
+				}
+				res, err := tx.Exec(updateFileNameKey, nameKey, fileID, userID)
+				if err != nil {
+					return fmt.Errorf("failed to set the name key of the file: %v", err)
+				}
+				affected, err := res.RowsAffected()
+				if err != nil {
+					return fmt.Errorf("failed to set the name key of the file: %v", err)
+				}
+				if affected != 1 {
+					return ErrNotOwner
+				}
+			}
+
+			// every file has to have a name key and no two can share one
+			rows, err := tx.Query(getUserNameKeys, userID)
+			if err != nil {
+				return fmt.Errorf("failed to get the name keys of the user's files: %v", err)
+			}
+			defer rows.Close()
+			seen := make(map[string]bool)
+			for rows.Next() {
+				var fileID int
+				var nameKey string
+				err = rows.Scan(&fileID, &nameKey)
+				if err != nil {
+					return fmt.Errorf("failed to scan the next row while processing the name keys: %v", err)
+				}
+				if nameKey == "" {
+					return fmt.Errorf("no name key was supplied for the file id %d", fileID)
+				}
+				if seen[nameKey] {
+					return fmt.Errorf("two files have names that differ only by case: %w", ErrFileExists)
+				}
+				seen[nameKey] = true
+			}
+			if err := rows.Err(); err != nil {
+				return fmt.Errorf("failed to scan all of the name keys: %v", err)
+			}
+			rows.Close()
+		}
+
+		_, err = tx.Exec(setUserCaseInsensitive, enabled, userID)
+		if err != nil {
+			return fmt.Errorf("failed to set the case sensitivity of the user: %v", err)
+		}
+		return nil
+	})
+}
+
+// SetFileNameKey sets the name key of the file, which is compared instead
+// of the name for users with case-insensitive paths. ErrFileExists is
+// returned if another of the user's files has the same name key.
+func (s *Storage) SetFileNameKey(userID, fileID int, nameKey string) error {
+	defer s.timeOperation("SetFileNameKey", userID)()
+
+	return s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return ErrNotOwner
+		}
+
+		return setFileNameKey(tx, userID, fileID, nameKey)
+	})
+}
+
+// setFileNameKey sets the name key of the file after making sure no other
+// file of the user that isn't in the trash has it.
+func setFileNameKey(tx *sql.Tx, userID, fileID int, nameKey string) error {
+	if len(nameKey) > MaxNameKeyLength {
+		return fmt.Errorf("a name key can be at most %d bytes", MaxNameKeyLength)
+	}
+	if nameKey != "" {
+		err := checkNameKeyFree(tx, userID, fileID, nameKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.Exec(updateFileNameKey, nameKey, fileID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to set the name key of the file: %v", err)
+	}
+	return nil
+}
+
+// checkNameKeyFree returns ErrFileExists if a file of the user other than
+// fileID that isn't in the trash has the name key.
+func checkNameKeyFree(tx *sql.Tx, userID, fileID int, nameKey string) error {
+	var existingID int
+	err := tx.QueryRow(findFileByNameKey, userID, nameKey, fileID).Scan(&existingID)
+	if err == nil {
+		return fmt.Errorf("file id %d has a name that differs only by case: %w", existingID, ErrFileExists)
+	} else if err != sql.ErrNoRows {
+		return fmt.Errorf("failed to look up the name key in the database: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+)
+
+const (
+	// the data of the chunks of a user is kept once for each chunk hash
+	// and encryption key; the chunks refer to it by ChunkDataID
+	createChunkDataTable = `CREATE TABLE IF NOT EXISTS ChunkData (
+        ChunkDataID INTEGER PRIMARY KEY	NOT NULL,
+        UserID      INTEGER             NOT NULL,
+        KeyHash     TEXT                NOT NULL,
+        ChunkHash	TEXT				NOT NULL,
+        Chunk		BLOB				NOT NULL,
+        ChunkSize	INTEGER				NOT NULL,
+        StoreKey	TEXT				NOT NULL DEFAULT '',
+        RefCount    INTEGER             NOT NULL DEFAULT 0,
+        UNIQUE (UserID, KeyHash, ChunkHash)
+    );`
+
+	// the number of chunks of each user referring to the chunk data; the
+	// chunks of transferred files can refer to data of another user
+	createChunkDataRefsTable = `CREATE TABLE IF NOT EXISTS ChunkDataRefs (
+        ChunkDataID INTEGER             NOT NULL,
+        UserID      INTEGER             NOT NULL,
+        RefCount    INTEGER             NOT NULL,
+        PRIMARY KEY (ChunkDataID, UserID)
+    );`
+
+	getChunkData     = `SELECT ChunkDataID, ChunkSize FROM ChunkData WHERE UserID = ? AND KeyHash = ? AND ChunkHash = ?;`
+	addChunkData     = `INSERT OR IGNORE INTO ChunkData (UserID, KeyHash, ChunkHash, Chunk, ChunkSize, StoreKey, RefCount) VALUES (?, ?, ?, ?, ?, ?, 0);`
+	replaceChunkData = `UPDATE ChunkData SET Chunk = ?, StoreKey = ? WHERE ChunkDataID = ?;`
+	countChunkData   = `UPDATE ChunkData SET RefCount = (SELECT COUNT(*) FROM FileChunks WHERE FileChunks.ChunkDataID = ChunkData.ChunkDataID) WHERE ChunkDataID = ?;`
+	removeChunkData  = `DELETE FROM ChunkData WHERE ChunkDataID = ? AND RefCount = 0;`
+
+	getChunkDataSize     = `SELECT ChunkSize FROM ChunkData WHERE ChunkDataID = ?;`
+	getChunkDataUserRefs = `SELECT UserID, RefCount FROM ChunkDataRefs WHERE ChunkDataID = ?;`
+	countChunkDataUsers  = `SELECT FileInfo.UserID, COUNT(*) FROM FileChunks INNER JOIN FileInfo ON FileChunks.FileID = FileInfo.FileID
+					WHERE FileChunks.ChunkDataID = ? GROUP BY FileInfo.UserID;`
+	removeChunkDataRefs = `DELETE FROM ChunkDataRefs WHERE ChunkDataID = ?;`
+	addChunkDataRefs    = `INSERT INTO ChunkDataRefs (ChunkDataID, UserID, RefCount) VALUES (?, ?, ?);`
+	updateDeduplicated  = `UPDATE UserStats SET Deduplicated = Deduplicated + (?) WHERE UserID = ?;`
+
+	// the chunk data referred to by the chunks that a change removes or
+	// replaces, which is counted again after the change
+	getChunkDataIDsOfChunk    = `SELECT DISTINCT ChunkDataID FROM FileChunks WHERE FileID = ? AND VersionID = ? AND ChunkNum = ? AND ChunkDataID <> 0;`
+	getChunkDataIDsOfVersion  = `SELECT DISTINCT ChunkDataID FROM FileChunks WHERE FileID = ? AND VersionID = ? AND ChunkDataID <> 0;`
+	getChunkDataIDsOfFile     = `SELECT DISTINCT ChunkDataID FROM FileChunks WHERE FileID = ? AND ChunkDataID <> 0;`
+	getChunkDataIDsOfVersions = `SELECT DISTINCT FileChunks.ChunkDataID FROM FileChunks
+					INNER JOIN FileVersion on FileChunks.VersionID = FileVersion.VersionID
+					WHERE FileChunks.FileID = ? AND (VersionNum BETWEEN ? AND ?) AND FileChunks.ChunkDataID <> 0;`
+	getChunkDataIDsOfUser = `SELECT DISTINCT FileChunks.ChunkDataID FROM FileChunks
+					INNER JOIN FileInfo ON FileChunks.FileID = FileInfo.FileID
+					WHERE FileInfo.UserID = ? AND FileChunks.ChunkDataID <> 0;`
+)
+
+// chunkKeyHash returns the value of the KeyHash column for chunks encrypted
+// with the crypto password that has cryptoHash. Chunk hashes are taken
+// before the chunks are encrypted, so the data of a chunk is only shared
+// with chunks of the same hash that were encrypted with the same key.
+func chunkKeyHash(cryptoHash []byte) string {
+	sum := sha256.Sum256(cryptoHash)
+	return hex.EncodeToString(sum[:])
+}
+
+// getUserKeyHash returns the KeyHash of the chunks the user uploads now.
+func getUserKeyHash(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, userID int) (string, error) {
+	var cryptoHash []byte
+	err := q.QueryRow(getUserCryptoByID, userID).Scan(&cryptoHash)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the crypto hash of the user (%d): %v", userID, err)
+	}
+	return chunkKeyHash(cryptoHash), nil
+}
+
+// findChunkData returns the id of the chunk data the user already has for
+// the chunk hash, key and size, or zero if there is none.
+func findChunkData(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, userID int, keyHash string, chunkHash string, size int64) (int64, error) {
+	var id, existingSize int64
+	err := q.QueryRow(getChunkData, userID, keyHash, chunkHash).Scan(&id, &existingSize)
+	if err == sql.ErrNoRows || (err == nil && existingSize != size) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to look up the chunk data: %v", err)
+	}
+	return id, nil
+}
+
+// hasChunkData returns true if the user already has the data of a chunk
+// with the hash and size, which AddFileChunk then doesn't store again.
+func (s *Storage) hasChunkData(userID int, chunkHash string, size int64) bool {
+	keyHash, err := getUserKeyHash(s.db, userID)
+	if err != nil {
+		return false
+	}
+	id, err := findChunkData(s.db, userID, keyHash, chunkHash, size)
+	return err == nil && id != 0
+}
+
+// shareChunkData returns the id of the chunk data of the user for the chunk
+// hash, adding it with the values of the Chunk and StoreKey columns given if
+// the user doesn't have it yet. Zero is returned if the user has data for
+// the hash that is of a different size, which can't be shared.
+func shareChunkData(tx *sql.Tx, userID int, keyHash string, chunkHash string, size int64, data []byte, storeKey string) (int64, error) {
+	_, err := tx.Exec(addChunkData, userID, keyHash, chunkHash, data, size, storeKey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to add the chunk data: %v", err)
+	}
+	var id, existingSize int64
+	err = tx.QueryRow(getChunkData, userID, keyHash, chunkHash).Scan(&id, &existingSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the chunk data: %v", err)
+	}
+	if existingSize != size {
+		return 0, nil
+	}
+	return id, nil
+}
+
+// putSharedChunk adds or replaces the chunk of a file version so that it
+// refers to the user's chunk data for its hash, adding the data if the user
+// doesn't have it yet. data and storeKey are the values of the Chunk and
+// StoreKey columns for the chunk from storeChunk; nil data means the chunk
+// wasn't stored since the user already had its data, and it's stored here
+// if that data was removed in the meantime. With replace set the existing
+// data is replaced, which repairs every chunk sharing it. A chunk whose data
+// can't be shared keeps its own copy.
+func (s *Storage) putSharedChunk(tx *sql.Tx, userID int, fileID int, versionID int, chunkNumber int, chunkHash string, chunk []byte,
+	data []byte, storeKey string, replace bool) (sql.Result, error) {
+	size := int64(len(chunk))
+	keyHash, err := getUserKeyHash(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var dataID int64
+	if data == nil {
+		dataID, err = findChunkData(tx, userID, keyHash, chunkHash, size)
+		if err != nil {
+			return nil, err
+		}
+		if dataID == 0 {
+			data, storeKey, err = s.storeChunk(chunk)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if dataID == 0 {
+		dataID, err = shareChunkData(tx, userID, keyHash, chunkHash, size, data, storeKey)
+		if err != nil {
+			return nil, err
+		}
+		if dataID != 0 && replace {
+			_, err = tx.Exec(replaceChunkData, data, storeKey, dataID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to replace the chunk data (%d): %v", dataID, err)
+			}
+		}
+	}
+
+	// the chunk being replaced may have referred to other data
+	ids, err := chunkDataIDs(tx, getChunkDataIDsOfChunk, fileID, versionID, chunkNumber)
+	if err != nil {
+		return nil, err
+	}
+	if dataID != 0 {
+		data, storeKey = []byte{}, ""
+	}
+
+	// FileChunks has no unique key for the chunk of a version, so the
+	// chunk being replaced is removed rather than left to the insert
+	_, err = tx.Exec(removeFileChunk, fileID, versionID, chunkNumber)
+	if err != nil {
+		return nil, err
+	}
+	res, err := tx.Exec(addFileChunk, fileID, versionID, chunkNumber, chunkHash, data, size, storeKey, dataID)
+	if err != nil {
+		return nil, err
+	}
+	return res, countChunkDataRefs(tx, append(ids, dataID))
+}
+
+// chunkDataIDs returns the ids of the chunk data referred to by the chunks
+// the query selects.
+func chunkDataIDs(tx *sql.Tx, query string, args ...interface{}) ([]int64, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the chunk data of the chunks: %v", err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the chunk data of the chunks: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get the chunk data of the chunks: %v", err)
+	}
+	return ids, nil
+}
+
+// countChunkDataRefs counts the chunks referring to the chunk data with the
+// ids again and removes the data no chunk refers to anymore. The files of
+// removed data in the ChunkStore are left to SweepChunkStore.
+func countChunkDataRefs(tx *sql.Tx, ids []int64) error {
+	for _, id := range ids {
+		if id == 0 {
+			continue
+		}
+		err := countChunkDataUserRefs(tx, id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(countChunkData, id)
+		if err != nil {
+			return fmt.Errorf("failed to count the references to the chunk data (%d): %v", id, err)
+		}
+		_, err = tx.Exec(removeChunkData, id)
+		if err != nil {
+			return fmt.Errorf("failed to remove the unused chunk data (%d): %v", id, err)
+		}
+	}
+	return nil
+}
+
+// countChunkDataUserRefs counts the chunks of each user referring to the
+// chunk data with the id again and updates the bytes the users save by
+// sharing it. Every chunk of a user after the first one referring to the
+// data is stored for free, so it counts towards the user's Deduplicated
+// bytes, which are left out of the allocation the quota is checked against.
+func countChunkDataUserRefs(tx *sql.Tx, id int64) error {
+	var size int64
+	err := tx.QueryRow(getChunkDataSize, id).Scan(&size)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get the size of the chunk data (%d): %v", id, err)
+	}
+
+	oldRefs, err := queryChunkDataUserRefs(tx, getChunkDataUserRefs, id)
+	if err != nil {
+		return err
+	}
+	newRefs, err := queryChunkDataUserRefs(tx, countChunkDataUsers, id)
+	if err != nil {
+		return err
+	}
+
+	// the bytes saved change for the users whose count changed
+	saved := func(refs int64) int64 {
+		if refs <= 1 {
+			return 0
+		}
+		return (refs - 1) * size
+	}
+	deltas := make(map[int64]int64)
+	for userID, refs := range oldRefs {
+		deltas[userID] -= saved(refs)
+	}
+	for userID, refs := range newRefs {
+		deltas[userID] += saved(refs)
+	}
+	for userID, delta := range deltas {
+		if delta == 0 {
+			continue
+		}
+		_, err = tx.Exec(updateDeduplicated, delta, userID)
+		if err != nil {
+			return fmt.Errorf("failed to update the deduplicated bytes of the user (%d): %v", userID, err)
+		}
+	}
+
+	_, err = tx.Exec(removeChunkDataRefs, id)
+	if err != nil {
+		return fmt.Errorf("failed to remove the user references to the chunk data (%d): %v", id, err)
+	}
+	for userID, refs := range newRefs {
+		_, err = tx.Exec(addChunkDataRefs, id, userID, refs)
+		if err != nil {
+			return fmt.Errorf("failed to add the user references to the chunk data (%d): %v", id, err)
+		}
+	}
+	return nil
+}
+
+// queryChunkDataUserRefs returns the number of chunks referring to the chunk
+// data for each user as selected by the query.
+func queryChunkDataUserRefs(tx *sql.Tx, query string, id int64) (map[int64]int64, error) {
+	rows, err := tx.Query(query, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the user references to the chunk data (%d): %v", id, err)
+	}
+	defer rows.Close()
+
+	refs := make(map[int64]int64)
+	for rows.Next() {
+		var userID, count int64
+		err = rows.Scan(&userID, &count)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the user references to the chunk data (%d): %v", id, err)
+		}
+		refs[userID] = count
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get the user references to the chunk data (%d): %v", id, err)
+	}
+	return refs, nil
+}
+
+// execReleasingChunkData runs the statement that removes or replaces the
+// chunks selected by idsQuery, both with args, and then counts the
+// references to the chunk data those chunks referred to.
+func execReleasingChunkData(tx *sql.Tx, stmt string, idsQuery string, args ...interface{}) (sql.Result, error) {
+	ids, err := chunkDataIDs(tx, idsQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := tx.Exec(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	return res, countChunkDataRefs(tx, ids)
+}
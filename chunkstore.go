@@ -0,0 +1,296 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// chunkStoreGracePeriod is how old a chunk file that no chunk refers to has
+// to be before SweepChunkStore removes it, so that the file of a chunk whose
+// row isn't committed yet is kept.
+const chunkStoreGracePeriod = time.Hour
+
+// chunkStoreTempSuffix marks the chunk files that are still being written.
+const chunkStoreTempSuffix = ".tmp"
+
+const (
+	getChunkStoreKeys = `SELECT StoreKey FROM FileChunks WHERE StoreKey <> ''
+					UNION SELECT StoreKey FROM ChunkData WHERE StoreKey <> ''
+					UNION SELECT StoreKey FROM JournalChunks WHERE StoreKey <> '';`
+	scrubGetStoredChunks = `SELECT FileChunks.FileID, FileInfo.UserID, FileChunks.VersionID, FileChunks.ChunkNum, IFNULL(ChunkData.StoreKey, FileChunks.StoreKey) FROM FileChunks
+					INNER JOIN FileInfo ON FileChunks.FileID = FileInfo.FileID
+					LEFT JOIN ChunkData ON FileChunks.ChunkDataID = ChunkData.ChunkDataID
+					WHERE IFNULL(ChunkData.StoreKey, FileChunks.StoreKey) <> '' ORDER BY FileChunks.FileID, FileChunks.VersionID, FileChunks.ChunkNum;`
+)
+
+// ChunkStore keeps the data of chunks outside of the database so that the
+// database only holds their metadata. The chunks are addressed by the key
+// returned by ChunkStoreKey for their data, so chunks with the same data
+// share one copy.
+type ChunkStore interface {
+	// Put writes the chunk data, unless the same data is already kept, and
+	// returns the key that reads it back. Putting data that is already
+	// kept refreshes it so that a sweep running now keeps it.
+	Put(data []byte) (string, error)
+
+	// Get reads the data of the chunk with the key.
+	Get(key string) ([]byte, error)
+
+	// Sweep removes the chunks whose key isn't in referenced, along with
+	// anything left behind by interrupted writes, if they were last written
+	// before the time given. It returns the number of chunks removed and the
+	// number of bytes they took.
+	Sweep(referenced map[string]bool, before time.Time) (int, int64, error)
+}
+
+// ChunkStoreKey returns the key a ChunkStore keeps the chunk data under: the
+// hex encoded SHA-256 hash of the data.
+func ChunkStoreKey(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// IsChunkStoreKey returns true if key is the hex encoded SHA-256 hash that
+// a ChunkStore keeps chunks under.
+func IsChunkStoreKey(key string) bool {
+	if len(key) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
+// verifyStoredChunk reads the chunk with the key from the store and checks
+// that its data still has the hash it's keyed by.
+func verifyStoredChunk(store ChunkStore, key string) error {
+	data, err := store.Get(key)
+	if err != nil {
+		return err
+	}
+	if ChunkStoreKey(data) != key {
+		return fmt.Errorf("the stored chunk %s is damaged", key)
+	}
+	return nil
+}
+
+// DirChunkStore is a ChunkStore that keeps the chunks as files in a
+// directory. Each file is named by the key of its data and sharded into
+// subdirectories by the first bytes of the key.
+type DirChunkStore struct {
+	// Dir is the directory the chunk files are kept in.
+	Dir string
+}
+
+// NewDirChunkStore returns a DirChunkStore for dir, creating the directory
+// if it doesn't exist.
+func NewDirChunkStore(dir string) (*DirChunkStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the chunk directory %s: %v", dir, err)
+	}
+	return &DirChunkStore{Dir: dir}, nil
+}
+
+// path returns the path of the chunk file with the key.
+func (cs *DirChunkStore) path(key string) string {
+	return filepath.Join(cs.Dir, key[:2], key[2:4], key)
+}
+
+// Put writes the chunk data to its file, unless a file with the same data
+// already exists, and returns the key that reads it back.
+func (cs *DirChunkStore) Put(data []byte) (string, error) {
+	key := ChunkStoreKey(data)
+	path := cs.path(key)
+
+	// the existing file is touched so that a sweep running now keeps it
+	if _, err := os.Stat(path); err == nil {
+		now := time.Now()
+		err = os.Chtimes(path, now, now)
+		if err == nil {
+			return key, nil
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return "", fmt.Errorf("failed to create the chunk directory: %v", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), key+".*"+chunkStoreTempSuffix)
+	if err != nil {
+		return "", fmt.Errorf("failed to create the chunk file: %v", err)
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write the chunk file: %v", err)
+	}
+	return key, nil
+}
+
+// Get reads the data of the chunk file with the key.
+func (cs *DirChunkStore) Get(key string) ([]byte, error) {
+	if !IsChunkStoreKey(key) {
+		return nil, fmt.Errorf("invalid chunk store key %q", key)
+	}
+	data, err := ioutil.ReadFile(cs.path(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the chunk file: %v", err)
+	}
+	return data, nil
+}
+
+// Sweep removes the chunk files whose key isn't in referenced, along with
+// the files left behind by interrupted writes, if they were last modified
+// before the time given. It returns the number of files removed and the
+// number of bytes they took.
+func (cs *DirChunkStore) Sweep(referenced map[string]bool, before time.Time) (int, int64, error) {
+	var removed int
+	var freed int64
+	err := filepath.Walk(cs.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !info.ModTime().Before(before) {
+			return nil
+		}
+		name := info.Name()
+		if !strings.HasSuffix(name, chunkStoreTempSuffix) && (!IsChunkStoreKey(name) || referenced[name]) {
+			return nil
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	if err != nil {
+		return removed, freed, fmt.Errorf("failed to sweep the chunk directory %s: %v", cs.Dir, err)
+	}
+	return removed, freed, nil
+}
+
+// storeChunk returns the values of the Chunk and StoreKey columns for the
+// chunk data. With a ChunkStore the data is written to it and the Chunk
+// column is left empty; otherwise the data is kept in the database.
+func (s *Storage) storeChunk(chunk []byte) ([]byte, string, error) {
+	if s.ChunkStore == nil {
+		return chunk, "", nil
+	}
+	key, err := s.ChunkStore.Put(chunk)
+	if err != nil {
+		return nil, "", err
+	}
+	return []byte{}, key, nil
+}
+
+// loadChunk returns the chunk data for the values of the Chunk and StoreKey
+// columns, reading it from the ChunkStore if it's kept there.
+func (s *Storage) loadChunk(data []byte, storeKey string) ([]byte, error) {
+	if storeKey == "" {
+		return data, nil
+	}
+	if s.ChunkStore == nil {
+		return nil, fmt.Errorf("the chunk is kept in a chunk store but none is configured")
+	}
+	return s.ChunkStore.Get(storeKey)
+}
+
+// SweepChunkStore removes the chunks of the ChunkStore that no chunk row
+// refers to anymore, which are left behind when chunks are removed, and
+// returns the number of chunks removed and the number of bytes they took.
+// Chunks written within the last hour are kept since their rows may still be
+// being added. Nothing is done without a ChunkStore.
+func (s *Storage) SweepChunkStore() (int, int64, error) {
+	defer s.timeOperation("SweepChunkStore", NoUserID)()
+
+	if s.ChunkStore == nil {
+		return 0, 0, nil
+	}
+
+	// the time is taken before the keys are read so that the files of
+	// chunks added while sweeping are new enough to be kept
+	before := time.Now().Add(-chunkStoreGracePeriod)
+	rows, err := s.db.Query(getChunkStoreKeys)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get the keys of the stored chunks: %v", err)
+	}
+	defer rows.Close()
+
+	referenced := make(map[string]bool)
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to scan the keys of the stored chunks: %v", err)
+		}
+		referenced[key] = true
+	}
+	if err = rows.Err(); err != nil {
+		return 0, 0, fmt.Errorf("failed to get the keys of the stored chunks: %v", err)
+	}
+	rows.Close()
+
+	return s.ChunkStore.Sweep(referenced, before)
+}
+
+// scrubChunkStore returns the chunks whose data in the ChunkStore is
+// missing or no longer have the data they were written with.
+func (s *Storage) scrubChunkStore() ([]FsckProblem, error) {
+	type storedChunk struct {
+		fileID, userID, versionID, chunkNum int
+		key                                 string
+	}
+	rows, err := s.db.Query(scrubGetStoredChunks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the stored chunks: %v", err)
+	}
+	var chunks []storedChunk
+	for rows.Next() {
+		var c storedChunk
+		err = rows.Scan(&c.fileID, &c.userID, &c.versionID, &c.chunkNum, &c.key)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan the stored chunks: %v", err)
+		}
+		chunks = append(chunks, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get the stored chunks: %v", err)
+	}
+
+	var problems []FsckProblem
+	for _, c := range chunks {
+		var err error
+		if s.ChunkStore == nil {
+			err = fmt.Errorf("no chunk store is configured")
+		} else {
+			err = verifyStoredChunk(s.ChunkStore, c.key)
+		}
+		if err != nil {
+			problems = append(problems, FsckProblem{Kind: FsckBadChunk, FileID: c.fileID, UserID: c.userID, VersionID: c.versionID,
+				Detail: fmt.Sprintf("chunk %d can't be read from the chunk store: %v", c.chunkNum, err)})
+		}
+	}
+	return problems, nil
+}
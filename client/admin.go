@@ -0,0 +1,418 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// adminUsersPageSize is the number of users AdminListUsers gets per request.
+const adminUsersPageSize = 100
+
+// AdminListUsers returns the information, usage statistics and last login
+// time of every user on the server, getting them a page at a time. The
+// authenticated user must have administrator access.
+func (c *Client) AdminListUsers() ([]filefreezer.UserSummary, error) {
+	var users []filefreezer.UserSummary
+	for {
+		page, total, err := c.AdminGetUsers(len(users), adminUsersPageSize)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, page...)
+		if len(page) == 0 || len(users) >= total {
+			return users, nil
+		}
+	}
+}
+
+// AdminGetUsers returns the information, usage statistics and last login
+// time of at most limit users, ordered by user id, starting after the first
+// offset users. The total number of users on the server is returned as well.
+// The server may return fewer users than the limit even if there are more.
+// The authenticated user must have administrator access.
+func (c *Client) AdminGetUsers(offset int, limit int) ([]filefreezer.UserSummary, int, error) {
+	target := fmt.Sprintf("%s/api/admin/users?offset=%d&limit=%d", c.HostURI, offset, limit)
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var r models.AdminUsersGetResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	return r.Users, r.Total, nil
+}
+
+// AdminGetUser returns the information, usage statistics and last login time
+// of the user. The authenticated user must have administrator access.
+func (c *Client) AdminGetUser(username string) (*filefreezer.UserSummary, error) {
+	target := fmt.Sprintf("%s/api/admin/users/%s", c.HostURI, url.PathEscape(username))
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the user %s: %w", username, err)
+	}
+
+	var r models.AdminUserGetResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	return &r.User, nil
+}
+
+// AdminAddUser creates a new user on the server with the login password and
+// either the quota in bytes or the quota of the named tier, granting the user
+// administrator access if isAdmin is set. The server's default quota is used
+// if quota is zero and tier is empty. The id of the new user is returned.
+// The authenticated user must have administrator access.
+func (c *Client) AdminAddUser(username string, password string, quota int, tier string, isAdmin bool) (int, error) {
+	req := models.AdminUserAddRequest{
+		Name:     username,
+		Password: password,
+		Quota:    quota,
+		Tier:     tier,
+		IsAdmin:  isAdmin,
+	}
+
+	target := fmt.Sprintf("%s/api/admin/users", c.HostURI)
+	body, err := c.RunAuthRequest(target, "POST", c.AuthToken, req)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to add the user %s: %w", username, err)
+	}
+
+	var r models.AdminUserAddResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return 0, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	c.Println("User created successfully")
+	return r.UserID, nil
+}
+
+// AdminModUser changes the user on the server. The quota, name and login
+// password are only changed if newQuota is positive or newTier, newUsername
+// and newPassword aren't empty, and administrator access is only changed if
+// isAdmin isn't nil. The authenticated user must have administrator access.
+func (c *Client) AdminModUser(username string, newQuota int, newTier string, newUsername string, newPassword string, isAdmin *bool) error {
+	req := models.AdminUserModRequest{
+		Quota:    newQuota,
+		Tier:     newTier,
+		Name:     newUsername,
+		Password: newPassword,
+		IsAdmin:  isAdmin,
+	}
+
+	target := fmt.Sprintf("%s/api/admin/users/%s", c.HostURI, url.PathEscape(username))
+	body, err := c.RunAuthRequest(target, "PUT", c.AuthToken, req)
+	if err != nil {
+		return fmt.Errorf("Failed to modify the user %s: %w", username, err)
+	}
+
+	var r models.AdminUserModResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+	if !r.Status {
+		return fmt.Errorf("an unknown error occurred while modifying the user %s", username)
+	}
+
+	c.Println("User modified successfully")
+	return nil
+}
+
+// AdminRmUser removes the user and all of the user's files from the server.
+// The authenticated user must have administrator access.
+func (c *Client) AdminRmUser(username string) error {
+	target := fmt.Sprintf("%s/api/admin/users/%s", c.HostURI, url.PathEscape(username))
+	body, err := c.RunAuthRequest(target, "DELETE", c.AuthToken, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to remove the user %s: %w", username, err)
+	}
+
+	var r models.AdminUserRmResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+	if !r.Status {
+		return fmt.Errorf("an unknown error occurred while removing the user %s", username)
+	}
+
+	c.Println("User removed successfully")
+	return nil
+}
+
+// AdminSuspendUser suspends the user on the server so that the user can't
+// log in or use the API while their files are kept. The authenticated user
+// must have administrator access.
+func (c *Client) AdminSuspendUser(username string) error {
+	return c.adminSetUserStatus(username, "suspend")
+}
+
+// AdminReactivateUser lets a suspended user log in and use the API again.
+// The authenticated user must have administrator access.
+func (c *Client) AdminReactivateUser(username string) error {
+	return c.adminSetUserStatus(username, "reactivate")
+}
+
+// adminSetUserStatus makes the request for the status change action of the
+// user.
+func (c *Client) adminSetUserStatus(username string, action string) error {
+	target := fmt.Sprintf("%s/api/admin/users/%s/%s", c.HostURI, url.PathEscape(username), action)
+	body, err := c.RunAuthRequest(target, "POST", c.AuthToken, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to %s the user %s: %w", action, username, err)
+	}
+
+	var r models.AdminUserStatusResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	c.Printf("User %s is now %s\n", username, r.Status)
+	return nil
+}
+
+// AdminGetQuotaTiers returns the server's default quota for new users and
+// its quota tiers, mapping the tier names to their quota in bytes. The
+// authenticated user must have administrator access.
+func (c *Client) AdminGetQuotaTiers() (int, map[string]int, error) {
+	target := fmt.Sprintf("%s/api/admin/tiers", c.HostURI)
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var r models.AdminQuotaTiersResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	return r.DefaultQuota, r.Tiers, nil
+}
+
+// AdminImportUsers creates all of the users on the server at once so that
+// either every user is created or none are. The server generates a random
+// password for the users without one and returns it with the user's id.
+// The authenticated user must have administrator access.
+func (c *Client) AdminImportUsers(users []models.AdminUserImport) ([]models.AdminUserImported, error) {
+	req := models.AdminUsersImportRequest{
+		Users: users,
+	}
+
+	target := fmt.Sprintf("%s/api/admin/users/import", c.HostURI)
+	body, err := c.RunAuthRequest(target, "POST", c.AuthToken, req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to import the users: %w", err)
+	}
+
+	var r models.AdminUsersImportResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	c.Printf("%d users created successfully\n", len(r.Users))
+	return r.Users, nil
+}
+
+// AdminImpersonate gets a read-only token that authenticates as the user for
+// the given number of minutes, or the server's default if minutes is zero.
+// The reason is recorded by the server. The token and the time it expires
+// (seconds since 1/1/1970) are returned. The authenticated user must have
+// administrator access.
+func (c *Client) AdminImpersonate(username string, minutes int, reason string) (string, int64, error) {
+	r, err := c.adminImpersonate(username, minutes, reason)
+	if err != nil {
+		return "", 0, err
+	}
+	return r.Token, r.ExpiresAt, nil
+}
+
+func (c *Client) adminImpersonate(username string, minutes int, reason string) (*models.AdminImpersonateResponse, error) {
+	req := models.AdminImpersonateRequest{
+		Minutes: minutes,
+		Reason:  reason,
+	}
+
+	target := fmt.Sprintf("%s/api/admin/users/%s/impersonate", c.HostURI, url.PathEscape(username))
+	body, err := c.RunAuthRequest(target, "POST", c.AuthToken, req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to impersonate the user %s: %w", username, err)
+	}
+
+	var r models.AdminImpersonateResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	return &r, nil
+}
+
+// AdminGetStorage returns the storage used by each user on the server and
+// the top largest files of each user, identified only by id and size. The
+// authenticated user must have administrator access.
+func (c *Client) AdminGetStorage(top int) (*models.AdminStorageResponse, error) {
+	target := fmt.Sprintf("%s/api/admin/storage?top=%d", c.HostURI, top)
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var r models.AdminStorageResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	return &r, nil
+}
+
+// AdminExportUsage returns the storage and transfer usage of every user on
+// the server between the from and to days, formatted as YYYY-MM-DD, in the
+// json or csv format. Empty days use the server's default of the current
+// month. The authenticated user must have administrator access.
+func (c *Client) AdminExportUsage(from string, to string, format string) ([]byte, error) {
+	query := url.Values{}
+	query.Set("format", format)
+	if from != "" {
+		query.Set("from", from)
+	}
+	if to != "" {
+		query.Set("to", to)
+	}
+	target := fmt.Sprintf("%s/api/admin/usage/export?%s", c.HostURI, query.Encode())
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to export the usage: %w", err)
+	}
+
+	return body, nil
+}
+
+// AdminVacuum rebuilds the server database so that the space freed by removed
+// chunks is returned to the file system. The size of the database in bytes
+// before and after is returned. The authenticated user must have
+// administrator access.
+func (c *Client) AdminVacuum() (int64, int64, error) {
+	target := fmt.Sprintf("%s/api/admin/vacuum", c.HostURI)
+	body, err := c.RunAuthRequest(target, "POST", c.AuthToken, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Failed to vacuum the database: %w", err)
+	}
+
+	var r models.AdminVacuumResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	return r.SizeBefore, r.SizeAfter, nil
+}
+
+// AdminBackup snapshots the live server database, without stopping the
+// server, and writes the snapshot to w. The download is checked against the
+// checksum the server sends along with it. The name the server gave the
+// snapshot and its size in bytes are returned. The authenticated user must
+// have administrator access.
+func (c *Client) AdminBackup(ctx context.Context, w io.Writer) (string, int64, error) {
+	target := fmt.Sprintf("%s/api/admin/backup", c.HostURI)
+	client, err := c.getHTTPClient()
+	if err != nil {
+		return "", 0, err
+	}
+
+	c.Log.Debugf("POST %s", target)
+	resp, target, err := c.doFailover(ctx, client, "POST", target, func(target string) (*http.Request, error) {
+		return newAuthRequest(target, "POST", c.AuthToken, nil)
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("Failed to back up the database: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", 0, fmt.Errorf("Failed to back up the database: %w", newHTTPError("POST", target, resp, body))
+	}
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(w, hasher), resp.Body)
+	if err != nil {
+		return "", size, fmt.Errorf("Failed to download the database backup from %s: %w", target, err)
+	}
+	if sum := resp.Header.Get(models.HeaderBackupChecksum); sum != hex.EncodeToString(hasher.Sum(nil)) {
+		return "", size, fmt.Errorf("The database backup downloaded from %s doesn't match its checksum", target)
+	}
+
+	var name string
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	return name, size, nil
+}
+
+// AdminGetJobs returns the schedules of the server's maintenance jobs and how
+// their last runs went. The authenticated user must have administrator
+// access.
+func (c *Client) AdminGetJobs() ([]models.AdminJob, error) {
+	target := fmt.Sprintf("%s/api/admin/jobs", c.HostURI)
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var r models.AdminJobsResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	return r.Jobs, nil
+}
+
+// AdminSetNamespaceQuota gives the namespace of the user a separate quota, or
+// makes it share the quota of the user's account again if quota is zero. The
+// authenticated user must have administrator access.
+func (c *Client) AdminSetNamespaceQuota(username string, namespace string, quota int) error {
+	req := models.AdminNamespaceQuotaRequest{Quota: quota}
+	target := fmt.Sprintf("%s/api/admin/users/%s/namespaces/%s", c.HostURI, url.PathEscape(username), url.PathEscape(namespace))
+	body, err := c.RunAuthRequest(target, "PUT", c.AuthToken, req)
+	if err != nil {
+		return fmt.Errorf("Failed to set the quota of the namespace %s of the user %s: %w", namespace, username, err)
+	}
+
+	var r models.AdminNamespaceQuotaResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+	if !r.Status {
+		return fmt.Errorf("an unknown error occurred while setting the quota of the namespace %s", namespace)
+	}
+
+	c.Println("Namespace quota set successfully")
+	return nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// FileAttributes are the platform attributes of a file that aren't covered
+// by its permissions and modification time. Only the attributes the local
+// platform supports are read or restored; the rest are kept as they are.
+type FileAttributes struct {
+	// Hidden and ReadOnly are the Windows file attributes of the same name.
+	Hidden   bool
+	ReadOnly bool
+
+	// Xattrs are the extended attributes of the file on Unix systems keyed
+	// by their names.
+	Xattrs map[string][]byte
+}
+
+// IsEmpty returns true if none of the attributes are set.
+func (a FileAttributes) IsEmpty() bool {
+	return !a.Hidden && !a.ReadOnly && len(a.Xattrs) == 0
+}
+
+// ReadFileAttributes returns the platform attributes of the local file.
+func ReadFileAttributes(localFilename string) (FileAttributes, error) {
+	return readLocalAttributes(localFilename)
+}
+
+// WriteFileAttributes restores the platform attributes of the local file.
+// Extended attributes the file has that aren't in attrs are left alone.
+func WriteFileAttributes(localFilename string, attrs FileAttributes) error {
+	return writeLocalAttributes(localFilename, attrs)
+}
+
+// SetFileAttributes stores the platform attributes of the file with the
+// filename on the server, replacing the ones it had. The attributes are
+// encrypted before they are sent so that the server never sees them.
+func (c *Client) SetFileAttributes(filename string, attrs FileAttributes) error {
+	fi, err := c.GetFileInfoByFilename(filename)
+	if err != nil {
+		return err
+	}
+	return c.setFileAttributesByID(fi.FileID, attrs)
+}
+
+// GetFileAttributes returns the decrypted platform attributes stored for the
+// file with the filename, which are empty if none were stored.
+func (c *Client) GetFileAttributes(filename string) (FileAttributes, error) {
+	fi, err := c.GetFileInfoByFilename(filename)
+	if err != nil {
+		return FileAttributes{}, err
+	}
+	return c.getFileAttributesByID(fi.FileID)
+}
+
+// encodeAttributes returns the encrypted form of the attributes as sent to
+// the server, which is empty if no attributes are set.
+func (c *Client) encodeAttributes(attrs FileAttributes) (string, error) {
+	if attrs.IsEmpty() {
+		return "", nil
+	}
+	plain, err := json.Marshal(attrs)
+	if err != nil {
+		return "", err
+	}
+	return c.EncryptString(string(plain))
+}
+
+func (c *Client) setFileAttributesByID(fileID int, attrs FileAttributes) error {
+	var putReq models.FileAttributesPutRequest
+	var err error
+	putReq.Attributes, err = c.encodeAttributes(attrs)
+	if err != nil {
+		return fmt.Errorf("Could not encrypt the file attributes before uploading: %w", err)
+	}
+	target := fmt.Sprintf("%s/api/file/%d/attributes", c.HostURI, fileID)
+	_, err = c.RunAuthRequest(target, "PUT", c.AuthToken, putReq)
+	if err != nil {
+		return fmt.Errorf("Failed to set the attributes of the file by file ID (%d): %w", fileID, err)
+	}
+	return nil
+}
+
+func (c *Client) getFileAttributesByID(fileID int) (FileAttributes, error) {
+	var attrs FileAttributes
+	target := fmt.Sprintf("%s/api/file/%d/attributes", c.HostURI, fileID)
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return attrs, fmt.Errorf("Failed to get the attributes of the file by file ID (%d): %w", fileID, err)
+	}
+
+	var r models.FileAttributesResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return attrs, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+	if r.Attributes == "" {
+		return attrs, nil
+	}
+
+	plain, err := c.DecryptString(r.Attributes)
+	if err != nil {
+		return attrs, fmt.Errorf("failed to decrypt the file attributes: %w", err)
+	}
+	err = json.Unmarshal([]byte(plain), &attrs)
+	if err != nil {
+		return attrs, fmt.Errorf("failed to decode the file attributes: %w", err)
+	}
+	return attrs, nil
+}
+
+// mergeLocalAttributes returns the stored attributes with the ones the local
+// platform supports replaced by the local attributes, so that syncing from
+// one platform doesn't drop the attributes stored from another.
+func mergeLocalAttributes(stored, local FileAttributes) FileAttributes {
+	merged := stored
+	if localWindowsAttributes {
+		merged.Hidden, merged.ReadOnly = local.Hidden, local.ReadOnly
+	}
+	if localXattrs {
+		merged.Xattrs = local.Xattrs
+	}
+	return merged
+}
+
+// syncAttributes brings the attributes of the synced file up to date in the
+// direction the file data went: downloaded files get the stored attributes
+// and the local attributes of other files are sent if they differ from the
+// stored ones.
+func (c *Client) syncAttributes(r *FileReport) error {
+	switch r.Status {
+	case SyncStatusLocalNewer, SyncStatusSame, SyncStatusMissing:
+		local, err := readLocalAttributes(r.LocalFilename)
+		if err != nil {
+			return fmt.Errorf("Failed to read the attributes of %s: %w", r.LocalFilename, err)
+		}
+		stored, err := c.getFileAttributesByID(r.fileID)
+		if err != nil {
+			return err
+		}
+		merged := mergeLocalAttributes(stored, local)
+		mergedJSON, _ := json.Marshal(merged)
+		storedJSON, _ := json.Marshal(stored)
+		if bytes.Equal(mergedJSON, storedJSON) {
+			return nil
+		}
+		err = c.setFileAttributesByID(r.fileID, merged)
+		if err != nil {
+			return err
+		}
+		c.Printf("%s ==> attributes\n", r.RemoteFilepath)
+
+	case SyncStatusRemoteNewer:
+		remote, err := c.getFileAttributesByID(r.fileID)
+		if err != nil {
+			return err
+		}
+		if remote.IsEmpty() {
+			return nil
+		}
+		// the data was restored so a missing privilege, such as the one
+		// needed for some extended attribute namespaces, isn't fatal
+		err = writeLocalAttributes(r.LocalFilename, remote)
+		if err != nil {
+			c.Log.Warnf("Failed to restore the attributes of %s: %v", r.LocalFilename, err)
+			return nil
+		}
+		c.Printf("%s <== attributes\n", r.RemoteFilepath)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package client
+
+const (
+	// localWindowsAttributes is true if the platform has the Windows
+	// hidden and read-only attributes.
+	localWindowsAttributes = false
+
+	// localXattrs is true if the platform has extended attributes.
+	localXattrs = false
+)
+
+// readLocalAttributes returns empty attributes on platforms without
+// attribute support.
+func readLocalAttributes(localFilename string) (FileAttributes, error) {
+	return FileAttributes{}, nil
+}
+
+// writeLocalAttributes does nothing on platforms without attribute support.
+func writeLocalAttributes(localFilename string, attrs FileAttributes) error {
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package client
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// localWindowsAttributes is true if the platform has the Windows
+	// hidden and read-only attributes.
+	localWindowsAttributes = false
+
+	// localXattrs is true if the platform has extended attributes.
+	localXattrs = true
+)
+
+// readLocalAttributes returns the extended attributes of the file. File
+// systems without extended attributes give empty attributes.
+func readLocalAttributes(localFilename string) (FileAttributes, error) {
+	var attrs FileAttributes
+	size, err := unix.Listxattr(localFilename, nil)
+	if err == unix.ENOTSUP {
+		return attrs, nil
+	} else if err != nil {
+		return attrs, err
+	}
+	if size == 0 {
+		return attrs, nil
+	}
+	names := make([]byte, size)
+	size, err = unix.Listxattr(localFilename, names)
+	if err != nil {
+		return attrs, err
+	}
+
+	attrs.Xattrs = make(map[string][]byte)
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		size, err := unix.Getxattr(localFilename, string(name), nil)
+		if err != nil {
+			return attrs, err
+		}
+		value := make([]byte, size)
+		size, err = unix.Getxattr(localFilename, string(name), value)
+		if err != nil {
+			return attrs, err
+		}
+		attrs.Xattrs[string(name)] = value[:size]
+	}
+	return attrs, nil
+}
+
+// writeLocalAttributes sets the extended attributes of the file. The
+// Windows attributes are ignored.
+func writeLocalAttributes(localFilename string, attrs FileAttributes) error {
+	for name, value := range attrs.Xattrs {
+		err := unix.Setxattr(localFilename, name, value, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+//go:build windows
+// +build windows
+
+package client
+
+import (
+	"syscall"
+)
+
+const (
+	// localWindowsAttributes is true if the platform has the Windows
+	// hidden and read-only attributes.
+	localWindowsAttributes = true
+
+	// localXattrs is true if the platform has extended attributes.
+	localXattrs = false
+)
+
+// readLocalAttributes returns the hidden and read-only attributes of the
+// file.
+func readLocalAttributes(localFilename string) (FileAttributes, error) {
+	var attrs FileAttributes
+	p, err := syscall.UTF16PtrFromString(localFilename)
+	if err != nil {
+		return attrs, err
+	}
+	flags, err := syscall.GetFileAttributes(p)
+	if err != nil {
+		return attrs, err
+	}
+	attrs.Hidden = flags&syscall.FILE_ATTRIBUTE_HIDDEN != 0
+	attrs.ReadOnly = flags&syscall.FILE_ATTRIBUTE_READONLY != 0
+	return attrs, nil
+}
+
+// writeLocalAttributes sets the hidden and read-only attributes of the file.
+// Extended attributes are ignored.
+func writeLocalAttributes(localFilename string, attrs FileAttributes) error {
+	p, err := syscall.UTF16PtrFromString(localFilename)
+	if err != nil {
+		return err
+	}
+	flags, err := syscall.GetFileAttributes(p)
+	if err != nil {
+		return err
+	}
+	flags &^= syscall.FILE_ATTRIBUTE_HIDDEN | syscall.FILE_ATTRIBUTE_READONLY
+	if attrs.Hidden {
+		flags |= syscall.FILE_ATTRIBUTE_HIDDEN
+	}
+	if attrs.ReadOnly {
+		flags |= syscall.FILE_ATTRIBUTE_READONLY
+	}
+	return syscall.SetFileAttributes(p, flags)
+}
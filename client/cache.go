@@ -0,0 +1,238 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChunkCache keeps downloaded chunks in a local directory keyed by chunk
+// hash so that chunks shared between versions, or downloaded before, don't
+// have to be downloaded again. Chunks are cached as they are stored on the
+// server, so encrypted chunks stay encrypted on disk. When the cache grows
+// past its size limit the least recently used chunks are removed. A
+// ChunkCache is safe to use from multiple goroutines.
+type ChunkCache struct {
+	sync.Mutex
+	dir      string
+	maxBytes int64
+	size     int64
+
+	// lru holds the cached chunks with the most recently used at the
+	// front; entries maps the chunk hashes to their elements.
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// chunkCacheEntry is the hash and size of a chunk in the ChunkCache.
+type chunkCacheEntry struct {
+	hash string
+	size int64
+}
+
+// chunkCacheTempSuffix is added to the name of a chunk while it's being
+// written so that a partial chunk is never read.
+const chunkCacheTempSuffix = ".tmp"
+
+// NewChunkCache opens the chunk cache in dir, creating the directory if
+// needed, that holds up to maxBytes of chunks. The chunks already in the
+// directory are kept, in the order they were last used.
+func NewChunkCache(dir string, maxBytes int64) (*ChunkCache, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("the chunk cache size must be positive")
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the chunk cache directory %s: %v", dir, err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the chunk cache directory %s: %v", dir, err)
+	}
+
+	cc := &ChunkCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+
+	// the modification time of a chunk is bumped each time it's used; files
+	// that aren't named for a chunk are left alone
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(f.Name(), chunkCacheTempSuffix) {
+			if validChunkHash(strings.TrimSuffix(f.Name(), chunkCacheTempSuffix)) {
+				os.Remove(filepath.Join(dir, f.Name()))
+			}
+			continue
+		}
+		if !validChunkHash(f.Name()) {
+			continue
+		}
+		cc.entries[f.Name()] = cc.lru.PushBack(&chunkCacheEntry{hash: f.Name(), size: f.Size()})
+		cc.size += f.Size()
+	}
+	cc.evict()
+
+	return cc, nil
+}
+
+// Size returns the total bytes of the cached chunks.
+func (cc *ChunkCache) Size() int64 {
+	cc.Lock()
+	defer cc.Unlock()
+	return cc.size
+}
+
+// Get returns the cached chunk with the hash, if there is one.
+func (cc *ChunkCache) Get(hash string) ([]byte, bool) {
+	cc.Lock()
+	defer cc.Unlock()
+
+	e, found := cc.entries[hash]
+	if !found {
+		return nil, false
+	}
+	path := filepath.Join(cc.dir, hash)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		cc.remove(e)
+		return nil, false
+	}
+	cc.lru.MoveToFront(e)
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return data, true
+}
+
+// Put adds the chunk with the hash to the cache, removing the least
+// recently used chunks if the cache grows past its size limit. Chunks
+// larger than the whole cache aren't kept.
+func (cc *ChunkCache) Put(hash string, data []byte) error {
+	if !validChunkHash(hash) {
+		return fmt.Errorf("invalid chunk hash %q", hash)
+	}
+
+	cc.Lock()
+	defer cc.Unlock()
+
+	if e, found := cc.entries[hash]; found {
+		cc.lru.MoveToFront(e)
+		return nil
+	}
+	if int64(len(data)) > cc.maxBytes {
+		return nil
+	}
+
+	path := filepath.Join(cc.dir, hash)
+	err := ioutil.WriteFile(path+chunkCacheTempSuffix, data, 0600)
+	if err != nil {
+		os.Remove(path + chunkCacheTempSuffix)
+		return fmt.Errorf("failed to write the chunk to the cache: %v", err)
+	}
+	err = os.Rename(path+chunkCacheTempSuffix, path)
+	if err != nil {
+		os.Remove(path + chunkCacheTempSuffix)
+		return fmt.Errorf("failed to add the chunk to the cache: %v", err)
+	}
+
+	cc.entries[hash] = cc.lru.PushFront(&chunkCacheEntry{hash: hash, size: int64(len(data))})
+	cc.size += int64(len(data))
+	cc.evict()
+	return nil
+}
+
+// Remove drops the chunk with the hash from the cache.
+func (cc *ChunkCache) Remove(hash string) {
+	cc.Lock()
+	defer cc.Unlock()
+	if e, found := cc.entries[hash]; found {
+		cc.remove(e)
+	}
+}
+
+// evict removes the least recently used chunks until the cache is within
+// its size limit. The lock must be held.
+func (cc *ChunkCache) evict() {
+	for cc.size > cc.maxBytes {
+		cc.remove(cc.lru.Back())
+	}
+}
+
+// remove drops the chunk of the list element from the cache. The lock must
+// be held.
+func (cc *ChunkCache) remove(e *list.Element) {
+	chunk := cc.lru.Remove(e).(*chunkCacheEntry)
+	delete(cc.entries, chunk.hash)
+	cc.size -= chunk.size
+	os.Remove(filepath.Join(cc.dir, chunk.hash))
+}
+
+// validChunkHash returns true if the hash looks like a chunk hash, which is a
+// URL safe base64 encoded SHA1 hash, so that it's safe to use as a file name.
+func validChunkHash(hash string) bool {
+	if len(hash) != base64.URLEncoding.EncodedLen(sha1.Size) {
+		return false
+	}
+	for _, r := range hash {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '=') {
+			return false
+		}
+	}
+	return true
+}
+
+// cachedChunk returns the decrypted chunk with the hash from the Cache if it
+// holds a chunk that decrypts to data with that hash.
+func (c *Client) cachedChunk(hash string) ([]byte, bool) {
+	if c.Cache == nil || hash == "" {
+		return nil, false
+	}
+	data, found := c.Cache.Get(hash)
+	if !found {
+		return nil, false
+	}
+	chunk, err := c.decryptChunk(data)
+	if err != nil || hashChunk(chunk) != hash {
+		// the chunk was damaged or cached with another key
+		c.Cache.Remove(hash)
+		return nil, false
+	}
+	return chunk, true
+}
+
+// downloadChunk downloads and decrypts the chunk number chunkNum of the file
+// version identified by fileID and versionID. If hash is set and matches the
+// decrypted chunk, the chunk is added to the Cache.
+func (c *Client) downloadChunk(ctx context.Context, fileID int, versionID int, chunkNum int, hash string) ([]byte, error) {
+	data, err := c.getChunk(ctx, fileID, versionID, chunkNum)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := c.decryptChunk(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt the the chunk bytes: %w", err)
+	}
+	if c.Cache != nil && hash != "" && hashChunk(chunk) == hash {
+		if err := c.Cache.Put(hash, data); err != nil {
+			c.Log.Warnf("Failed to cache the chunk #%d of file id %d: %v", chunkNum, fileID, err)
+		}
+	}
+	return chunk, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// nameKeySize is the number of bytes of the HMAC kept for a name key.
+const nameKeySize = 16
+
+// nameKeyKey returns the key used to derive name keys, or nil if the client
+// has no crypto key to derive it from.
+func (c *Client) nameKeyKey() []byte {
+	if len(c.CryptoKey) == 0 {
+		return nil
+	}
+	mac := hmac.New(sha256.New, c.CryptoKey)
+	mac.Write([]byte("filefreezer name keys"))
+	return mac.Sum(nil)
+}
+
+// NameKey returns the key the server compares instead of the plaintext file
+// name when the account treats paths case-insensitively. Names that differ
+// only by case have the same key. Without a crypto key the folded name is
+// used as is, which matches the keys made by the server's WebDAV access.
+func (c *Client) NameKey(filename string) string {
+	folded := filefreezer.FoldName(filename)
+	key := c.nameKeyKey()
+	if key == nil {
+		return folded
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(folded))
+	return hex.EncodeToString(mac.Sum(nil)[:nameKeySize])
+}
+
+// foldName returns the form of the plaintext file name that is compared
+// against other names. Names are always normalized so that the composed and
+// decomposed spellings of a name match, and folded if CaseInsensitive is set.
+func (c *Client) foldName(filename string) string {
+	if c.CaseInsensitive {
+		return filefreezer.FoldName(filename)
+	}
+	return filefreezer.NormalizeName(filename)
+}
+
+// sameName returns true if the plaintext file names refer to the same
+// remote file.
+func (c *Client) sameName(a, b string) bool {
+	return c.foldName(a) == c.foldName(b)
+}
+
+// putNameKey returns the name key sent with a new file, which is only
+// needed if CaseInsensitive is set.
+func (c *Client) putNameKey(filename string) string {
+	if c.CaseInsensitive {
+		return c.NameKey(filename)
+	}
+	return ""
+}
+
+// SetCaseInsensitive turns case-insensitive remote paths on or off for the
+// user. Turning them on fails if two of the user's files have names that
+// differ only by case; one of them has to be renamed or removed first.
+func (c *Client) SetCaseInsensitive(enabled bool) error {
+	var req models.UserCaseInsensitiveRequest
+	req.Enabled = enabled
+	if enabled {
+		allFileInfos, err := c.GetAllFileHashes()
+		if err != nil {
+			return fmt.Errorf("Failed to get the file list: %w", err)
+		}
+		seen := make(map[string]string, len(allFileInfos))
+		for _, fi := range allFileInfos {
+			name, err := c.DecryptString(fi.FileName)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt one of the file names: %w", err)
+			}
+			nameKey := c.NameKey(name)
+			if other, found := seen[nameKey]; found {
+				return fmt.Errorf("the files %s and %s have names that differ only by case", other, name)
+			}
+			seen[nameKey] = name
+			req.NameKeys = append(req.NameKeys, models.FileNameKey{FileID: fi.FileID, NameKey: nameKey})
+		}
+
+		// files in the trash get name keys too so that restoring them can
+		// be checked for clashes
+		trash, _, err := c.GetTrash()
+		if err != nil {
+			return err
+		}
+		for _, tf := range trash {
+			name, err := c.DecryptString(tf.FileName)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt one of the file names: %w", err)
+			}
+			req.NameKeys = append(req.NameKeys, models.FileNameKey{FileID: tf.FileID, NameKey: c.NameKey(name)})
+		}
+	}
+
+	target := fmt.Sprintf("%s/api/user/caseinsensitive", c.HostURI)
+	body, err := c.RunAuthRequest(target, "PUT", c.AuthToken, req)
+	if err != nil {
+		return fmt.Errorf("Failed to set the case sensitivity of the remote paths: %w", err)
+	}
+
+	var r models.UserCaseInsensitiveResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	c.CaseInsensitive = enabled
+	return nil
+}
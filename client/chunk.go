@@ -0,0 +1,165 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// hashChunk returns the hash string the server uses to identify a chunk
+// of unencrypted data.
+func hashChunk(chunk []byte) string {
+	hasher := sha1.New()
+	hasher.Write(chunk)
+	return base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+}
+
+// PutChunk encrypts the chunk of file data and uploads it as the chunk number
+// chunkNum of the file version identified by fileID and versionID. The chunk
+// is hashed before it is encrypted and compressed if Compress is set.
+func (c *Client) PutChunk(fileID int, versionID int, chunkNum int, chunk []byte) error {
+	return c.putFileChunk("", fileID, versionID, chunkNum, chunk)
+}
+
+// putFileChunk is PutChunk for a chunk of the file named filename, whose
+// extension tells whether the chunk is worth compressing.
+func (c *Client) putFileChunk(filename string, fileID int, versionID int, chunkNum int, chunk []byte) error {
+	cryptoBytes, err := c.encryptChunk(filename, chunk)
+	if err != nil {
+		return fmt.Errorf("Failed to encrypt chunk before sending to the server: %w", err)
+	}
+	return c.putChunk(context.Background(), fileID, versionID, chunkNum, hashChunk(chunk), cryptoBytes)
+}
+
+// putChunk uploads the chunk bytes as given using chunkHash as the hash.
+func (c *Client) putChunk(ctx context.Context, fileID int, versionID int, chunkNum int, chunkHash string, chunk []byte) error {
+	target := fmt.Sprintf("%s/api/chunk/%d/%d/%d/%s", c.HostURI, fileID, versionID, chunkNum, chunkHash)
+	body, err := c.runAuthRequest(ctx, target, "PUT", c.AuthToken, chunk)
+	if err != nil {
+		return err
+	}
+
+	var resp models.FileChunkPutResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil || resp.Status == false {
+		return fmt.Errorf("Failed to upload the chunk to the server: %v", err)
+	}
+	return nil
+}
+
+// CopyIdenticalChunks asks the server to fill in the chunks of the file
+// version identified by fileID and versionID, which has none yet, from
+// another of the user's files with the same hash. The number of chunks copied
+// is returned, which is zero if the user has no identical file.
+func (c *Client) CopyIdenticalChunks(fileID int, versionID int) (int, error) {
+	target := fmt.Sprintf("%s/api/chunk/%d/%d/copy", c.HostURI, fileID, versionID)
+	body, err := c.RunAuthRequest(target, "POST", c.AuthToken, nil)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to copy the chunks of an identical file: %w", err)
+	}
+
+	var resp models.FileChunksCopyResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return 0, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+	return resp.ChunksCopied, nil
+}
+
+// RepairChunk encrypts the chunk of file data and uploads it in place of the
+// damaged or missing chunk number chunkNum of the file version identified by
+// fileID and versionID. proof is the filefreezer.MerkleProof of the chunk's
+// hash if the version has a Merkle root, or nil to have the server check the
+// chunk against the hashes it has. The server only accepts the chunk if its
+// hash matches the version; otherwise filefreezer.ErrChunkMismatch is returned.
+func (c *Client) RepairChunk(ctx context.Context, fileID int, versionID int, chunkNum int, proof []string, chunk []byte) error {
+	cryptoBytes, err := c.encryptChunk("", chunk)
+	if err != nil {
+		return fmt.Errorf("Failed to encrypt chunk before sending to the server: %w", err)
+	}
+
+	target := fmt.Sprintf("%s/api/chunk/%d/%d/%d/%s/repair", c.HostURI, fileID, versionID, chunkNum, hashChunk(chunk))
+	if proof != nil {
+		target += "?proof=" + url.QueryEscape(strings.Join(proof, ","))
+	}
+	body, err := c.runAuthRequest(ctx, target, "PUT", c.AuthToken, cryptoBytes)
+	if err != nil {
+		return err
+	}
+
+	var resp models.FileChunkPutResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil || resp.Status == false {
+		return fmt.Errorf("Failed to repair the chunk on the server: %v", err)
+	}
+	return nil
+}
+
+// GetChunk downloads the chunk number chunkNum of the file version identified
+// by fileID and versionID and returns the decrypted chunk data.
+func (c *Client) GetChunk(fileID int, versionID int, chunkNum int) ([]byte, error) {
+	chunk, err := c.getChunk(context.Background(), fileID, versionID, chunkNum)
+	if err != nil {
+		return nil, err
+	}
+
+	uncryptoBytes, err := c.decryptChunk(chunk)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt the the chunk bytes: %w", err)
+	}
+	return uncryptoBytes, nil
+}
+
+// getChunk downloads the chunk bytes as they are stored on the server.
+func (c *Client) getChunk(ctx context.Context, fileID int, versionID int, chunkNum int) ([]byte, error) {
+	target := fmt.Sprintf("%s/api/chunk/%d/%d/%d", c.HostURI, fileID, versionID, chunkNum)
+	body, err := c.runAuthRequest(ctx, target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the file chunk #%d for file id %d: %w", chunkNum, fileID, err)
+	}
+	return body, nil
+}
+
+// GetFileChunks returns the chunk numbers and hashes of the chunks that have
+// been uploaded for the file version identified by fileID and versionID.
+func (c *Client) GetFileChunks(fileID int, versionID int) ([]filefreezer.FileChunk, error) {
+	target := fmt.Sprintf("%s/api/chunk/%d/%d", c.HostURI, fileID, versionID)
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the file chunk list for file id %d: %w", fileID, err)
+	}
+
+	var remoteChunks models.FileChunksGetResponse
+	err = json.Unmarshal(body, &remoteChunks)
+	if err != nil {
+		return nil, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+	return remoteChunks.Chunks, nil
+}
+
+// chunksMerkleRoot returns the filefreezer.MerkleRoot of the chunk hashes in
+// the chunk list of a file version with chunkCount chunks. An error is
+// returned if the list doesn't have every chunk of the version exactly once.
+func chunksMerkleRoot(chunks []filefreezer.FileChunk, chunkCount int) (string, error) {
+	if len(chunks) != chunkCount {
+		return "", fmt.Errorf("the chunk list has %d of the %d chunks", len(chunks), chunkCount)
+	}
+	hashes := make([]string, chunkCount)
+	for _, chunk := range chunks {
+		if chunk.ChunkNumber < 0 || chunk.ChunkNumber >= chunkCount || hashes[chunk.ChunkNumber] != "" {
+			return "", fmt.Errorf("the chunk list has an unexpected chunk %d", chunk.ChunkNumber)
+		}
+		hashes[chunk.ChunkNumber] = chunk.ChunkHash
+	}
+	return filefreezer.MerkleRoot(hashes)
+}
@@ -0,0 +1,443 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+// Package client is the Go client for a filefreezer server. It logs in to
+// the server, registers files and transfers their chunks, and synchronizes
+// local files and directories with the server so that other programs can
+// embed filefreezer syncing without running the freezer command.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/logging"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// Client tracks the connection to a filefreezer server.
+type Client struct {
+	// the host URI used for calls
+	HostURI string
+
+	// the authentication token returned after logging in
+	AuthToken string
+
+	// the stored crypto hash for the client that is used
+	// to verify the client-entered plaintext password.
+	CryptoHash []byte
+
+	// the key used to encrypt/decrypt file chunks and names
+	// and is derived from a plaintext password.
+	CryptoKey []byte
+
+	// the cipher used to encrypt/decrypt file chunks and names;
+	// AES-GCM with CryptoKey is used if this is nil.
+	Cipher ChunkCipher
+
+	// the capabilities returned by the authenticated server
+	ServerCapabilities models.ServerCapabilities
+
+	// the quota warning returned by the server at login if the user
+	// has crossed one of the server's quota thresholds; nil otherwise.
+	QuotaWarning *models.QuotaWarning
+
+	// true if the account treats remote paths case-insensitively, in
+	// which case names that differ only by case refer to the same file.
+	CaseInsensitive bool
+
+	// an overridable Println implementation used to report progress;
+	// New sets it to discard the output.
+	Println func(v ...interface{})
+
+	// an overridable Printf implementation used to report progress;
+	// New sets it to discard the output.
+	Printf func(format string, v ...interface{})
+
+	// the HTTPS TLS public crt file
+	TLSCrt string
+
+	// the HTTPS TLS private key file
+	TLSKey string
+
+	// a CA certificate file trusted for HTTPS in addition to the
+	// system roots
+	CACert string
+
+	// skips verifying the server's HTTPS certificate; only meant for
+	// development servers.
+	InsecureSkipVerify bool
+
+	// the time limit for each request, including reading the response
+	// body; zero means no limit.
+	Timeout time.Duration
+
+	// the interval of the TCP keepalive probes sent on the connections to
+	// the server, which keep proxies and NAT gateways from dropping them
+	// while they wait, such as during a long sync; New sets it to
+	// DefaultKeepAlive and a negative interval disables the probes.
+	KeepAlive time.Duration
+
+	// the policy for retrying requests that fail because of a network
+	// error or a temporarily unavailable server.
+	Retry RetryPolicy
+
+	// the http client used for every request if set; the TLS settings,
+	// Timeout and KeepAlive are ignored in that case.
+	HTTPClient *http.Client
+
+	// the transport shared by the requests so that their connections are
+	// reused, along with the settings it was made with; guarded by
+	// transportLock
+	transport         *http.Transport
+	transportSettings transportSettings
+	transportLock     sync.Mutex
+
+	// extra strict file checking during sync operations
+	ExtraStrict bool
+
+	// compresses the chunks encrypted with the default cipher before they
+	// are uploaded, skipping the ones of already compressed file types and
+	// the ones that don't get smaller.
+	Compress bool
+
+	// the base URLs of other clients of the same user on the LAN, such as
+	// those found by DiscoverPeers, that chunks are downloaded from before
+	// falling back to the server.
+	Peers []string
+
+	// the peer tokens presented to Peers, keyed by the host and port of the
+	// peer each was issued for and cached until they expire
+	peerTokens map[string]models.PeerTokenResponse
+
+	// guards Peers and peerTokens while files are synced in parallel
+	peerLock sync.Mutex
+
+	// keeps files synced in parallel from registering the same parent
+	// directories at the same time and guards knownDirs
+	parentLock sync.Mutex
+
+	// the remote directories putParentDirs knows to be registered, so that
+	// it only gets the file list when a parent isn't known yet; it's
+	// cleared at the start of every SyncDirectory
+	knownDirs map[string]bool
+
+	// the local cache of downloaded chunks checked before downloading a
+	// chunk from the server; nil disables caching.
+	Cache *ChunkCache
+
+	// the file name patterns SyncDirectory skips, matched against the base
+	// names of files and directories; New sets it to DefaultExcludes.
+	Excludes []string
+
+	// the revisions of the remote files that the local files were last
+	// synced with, which decide which side of a sync changed; nil to only
+	// compare modification times.
+	Revisions *SyncRevisions
+
+	// the file SyncDirectory records its progress in so that an interrupted
+	// sync resumes where it stopped; empty to not record it.
+	SyncStateFile string
+
+	// propagates deletions in SyncDirectory: the files removed on one side
+	// since the last sync, as recorded in Revisions, are removed on the
+	// other side instead of being synced back.
+	SyncDeletes bool
+
+	// the number of files SyncDirectory syncs at the same time; New sets
+	// it to DefaultSyncWorkers and anything below two syncs one at a time.
+	SyncWorkers int
+
+	// syncs the platform attributes of files, such as extended attributes
+	// or the Windows hidden flag, along with their data.
+	SyncAttributes bool
+
+	// identifies this machine to the server as the device that uploaded
+	// new files and versions; New sets it to the host name.
+	Device string
+
+	// the base URLs of mirrors of the server at HostURI, such as other
+	// instances sharing its database, that reads fail over to when it can't
+	// be reached. Changes are only made on HostURI.
+	Mirrors []string
+
+	// the time until which reads go to the Mirrors first since the server
+	// at HostURI failed to answer, guarded by failoverLock
+	primaryDownUntil time.Time
+	failoverLock     sync.Mutex
+
+	// how far the server's clock is ahead of the local clock, as measured
+	// by Login; zero if they agree within a couple of seconds. The local
+	// modification times of uploaded files are shifted by it so that sync
+	// decisions aren't corrupted by a wrong local clock.
+	ClockSkew time.Duration
+
+	// the namespace of the account Login logs in to, which keeps its own
+	// files apart from the account's and its other namespaces; empty for
+	// the account's own files.
+	Namespace string
+
+	// the structured logger used for diagnostic messages; progress
+	// output still goes through Println and Printf.
+	Log *logging.Logger
+}
+
+// New creates a new Client object that doesn't report progress.
+// Login must be called before making any other requests.
+func New() *Client {
+	c := new(Client)
+	c.SetQuiet(true)
+	c.Log = logging.New(os.Stderr, logging.LevelWarn, false).Component("client")
+	c.Excludes = append([]string(nil), DefaultExcludes...)
+	c.SyncWorkers = DefaultSyncWorkers
+	c.KeepAlive = DefaultKeepAlive
+	c.Device, _ = os.Hostname()
+	if len(c.Device) > filefreezer.MaxDeviceLength {
+		c.Device = c.Device[:filefreezer.MaxDeviceLength]
+	}
+	return c
+}
+
+func defaultPrintln(v ...interface{}) {
+	fmt.Println(v...)
+}
+
+func defaultPrintf(format string, v ...interface{}) {
+	fmt.Printf(format, v...)
+}
+
+// SetQuiet will alter the Printf and Println functions to either
+// write the progress to stdout or suppress it depending on the quiet flag.
+func (c *Client) SetQuiet(quiet bool) {
+	if quiet {
+		c.Printf = func(format string, v ...interface{}) {}
+		c.Println = func(v ...interface{}) {}
+	} else {
+		c.Println = defaultPrintln
+		c.Printf = defaultPrintf
+	}
+}
+
+// Login will use a HTTP call to authenticate the user and set the JWT
+// authentication token string and server capabilities in the Client.
+func (c *Client) Login(hostURI, username, password string) error {
+	// get the http client to use for the connection
+	client, err := c.getHTTPClient()
+	if err != nil {
+		return err
+	}
+
+	// Build and perform the request
+	target := fmt.Sprintf("%s/api/users/login", hostURI)
+	values := url.Values{
+		"user":     {username},
+		"password": {password},
+	}
+	if c.Namespace != "" {
+		values.Set("namespace", c.Namespace)
+	}
+	form := values.Encode()
+
+	// logging in doesn't change any files, so it fails over to the mirrors
+	// like reads do; the mirrors accept the same tokens as the server
+	var sent time.Time
+	var resp *http.Response
+	for i, host := range append([]string{hostURI}, c.Mirrors...) {
+		if i > 0 {
+			discardResponse(resp)
+			target = fmt.Sprintf("%s/api/users/login", strings.TrimRight(host, "/"))
+			c.Log.Warnf("The server %s is unavailable; logging in to %s instead.", hostURI, host)
+		}
+		sent = time.Now()
+		resp, err = c.do(context.Background(), client, true, func() (*http.Request, error) {
+			req, err := http.NewRequest("POST", target, strings.NewReader(form))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return req, nil
+		})
+		if !isUnavailable(context.Background(), resp, err) {
+			break
+		}
+	}
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("Failed to make the HTTP POST request to %s (status: %s): %w", target, resp.Status, err)
+		}
+		return fmt.Errorf("Failed to make the HTTP POST request to %s: %w", target, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("Failed to read the response body from %s: %w", target, err)
+	}
+	received := time.Now()
+
+	// check the status code to ensure the success of the call
+	if resp.StatusCode != http.StatusOK {
+		return newHTTPError("POST", target, resp, body)
+	}
+
+	// get the response by deserializing the JSON
+	var userLogin models.UserLoginResponse
+	err = json.Unmarshal(body, &userLogin)
+	if err != nil {
+		return fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	// authentication was successful so update the client
+	c.HostURI = hostURI
+	c.AuthToken = userLogin.Token
+	c.CryptoHash = userLogin.CryptoHash
+	c.ServerCapabilities = userLogin.Capabilities
+	c.QuotaWarning = userLogin.QuotaWarning
+	c.CaseInsensitive = userLogin.CaseInsensitive
+	if c.QuotaWarning != nil {
+		c.Log.Warnf("Quota warning: %s", c.QuotaWarning.Message)
+	}
+	c.ClockSkew = measureClockSkew(userLogin.ServerTime, sent, received)
+	if c.ClockSkew >= clockSkewWarning || c.ClockSkew <= -clockSkewWarning {
+		c.Log.Warnf("The local clock differs from the server's clock by %v; modification times are adjusted by that much, but the clock should be fixed.", c.ClockSkew)
+	}
+
+	return nil
+}
+
+// newAuthRequest builds a http request with the authorization header and token attached.
+func newAuthRequest(target string, method string, token string, bodyBytes []byte) (*http.Request, error) {
+	var body io.Reader
+	if bodyBytes != nil {
+		body = bytes.NewReader(bodyBytes)
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	return req, nil
+}
+
+// RunAuthRequest will build the http client and request then get the response and read
+// the body into a byte array. If reqBody is a []byte array, no transformation is done,
+// but if it's another type than it gets marshalled to a text JSON object.
+func (c *Client) RunAuthRequest(target string, method string, token string, reqBody interface{}) ([]byte, error) {
+	return c.runAuthRequest(context.Background(), target, method, token, reqBody)
+}
+
+// runAuthRequest is RunAuthRequest with a context that cancels the request.
+func (c *Client) runAuthRequest(ctx context.Context, target string, method string, token string, reqBody interface{}) ([]byte, error) {
+	return c.runAuthRequestIfMatch(ctx, target, method, token, reqBody, 0)
+}
+
+// runAuthRequestIfMatch is runAuthRequest for a change to a file that the
+// server only makes if the file is still at the revision, which is the id of
+// its current version; the request fails with filefreezer.ErrRevisionMismatch
+// otherwise. A zero revision makes the change unconditional.
+func (c *Client) runAuthRequestIfMatch(ctx context.Context, target string, method string, token string, reqBody interface{}, revision int) ([]byte, error) {
+	// serialize the reqBody object if one was passed in
+	var err error
+	var reqBodyIsByteSlice bool
+	var reqBytes []byte
+	if reqBody != nil {
+		reqBytes, reqBodyIsByteSlice = reqBody.([]byte)
+		if !reqBodyIsByteSlice {
+			reqBytes, err = json.Marshal(reqBody)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to JSON serialize the data object passed in: %w", err)
+			}
+		}
+	}
+
+	client, err := c.getHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	// perform the request, retrying it if it can be repeated safely,
+	// and read the response body
+	c.Log.Debugf("%s %s", method, target)
+	resp, target, err := c.doFailover(ctx, client, method, target, func(target string) (*http.Request, error) {
+		req, err := newAuthRequest(target, method, token, reqBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		// set the header if a JSON object is being sent
+		if reqBytes != nil && !reqBodyIsByteSlice {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if revision != 0 {
+			req.Header.Set("If-Match", fmt.Sprintf(`"%d"`, revision))
+		}
+		return req, nil
+	})
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("Failed to make the HTTP %s request to %s (status: %s): %w", method, target, resp.Status, err)
+		}
+		return nil, fmt.Errorf("Failed to make the HTTP %s request to %s: %w", method, target, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the response body from %s: %w", target, err)
+	}
+
+	// check the status code to ensure the success of the call
+	if resp.StatusCode != http.StatusOK {
+		return nil, newHTTPError(method, target, resp, body)
+	}
+
+	return body, nil
+}
+
+type eachChunkFunc func(chunkNumber int, chunk []byte) (bool, error)
+
+func forEachChunk(chunkSize int, filename string, localChunkCount int, eachFunc eachChunkFunc) error {
+	// open the local file and create a chunk sized buffer
+	buffer := make([]byte, chunkSize)
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("Failed to open the file %s: %w", filename, err)
+	}
+	defer f.Close()
+
+	// with the chunk list, lets make sure that each chunk locally has the same hash
+	for i := 0; i < localChunkCount; i++ {
+		readCount, err := io.ReadAtLeast(f, buffer, chunkSize)
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				// if we don't fill the buffer and we're not on the last chunk, the files are different
+				if i+1 != localChunkCount {
+					return fmt.Errorf("nexpeced EOF while reading the file %s", filename)
+				}
+			} else {
+				return fmt.Errorf("an error occured while reading %d bytes from the file %s: %w", readCount, filename, err)
+			}
+		}
+		clampedBuffer := buffer[:readCount]
+
+		// call the supplied callback and break the loop if false is returned
+		contLoop, err := eachFunc(i, clampedBuffer)
+		if err != nil {
+			return err
+		}
+		if !contLoop {
+			break
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"time"
+)
+
+const (
+	// clockSkewTolerance is the clock skew below which the difference
+	// between the server's and the local clock is put down to the latency
+	// of the login request rather than to a wrong clock.
+	clockSkewTolerance = 2 * time.Second
+
+	// clockSkewWarning is the clock skew above which Login warns that one
+	// of the clocks is wrong.
+	clockSkewWarning = time.Minute
+)
+
+// measureClockSkew returns how far the server's clock, which read
+// serverTime while answering a request sent at sent and answered at
+// received by the local clock, is ahead of the local clock. The server is
+// assumed to have answered halfway through the request. Skews within
+// clockSkewTolerance and servers that don't send their time return zero.
+func measureClockSkew(serverTime time.Time, sent time.Time, received time.Time) time.Duration {
+	if serverTime.IsZero() {
+		return 0
+	}
+	skew := serverTime.Sub(sent.Add(received.Sub(sent) / 2))
+	if skew > -clockSkewTolerance && skew < clockSkewTolerance {
+		return 0
+	}
+	return skew.Round(time.Second)
+}
+
+// serverLastMod converts a modification time in unix seconds by the local
+// clock to the server's clock, so that the modification times of files
+// uploaded by clients whose clocks disagree can be compared.
+func (c *Client) serverLastMod(localLastMod int64) int64 {
+	return localLastMod + int64(c.ClockSkew/time.Second)
+}
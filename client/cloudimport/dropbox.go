@@ -0,0 +1,165 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package cloudimport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DropboxAPIURL is the default base URL of the Dropbox API.
+	DropboxAPIURL = "https://api.dropboxapi.com/2"
+
+	// DropboxContentURL is the default base URL of the Dropbox content API
+	// used for downloads.
+	DropboxContentURL = "https://content.dropboxapi.com/2"
+)
+
+// Dropbox imports the files of a Dropbox account through the Dropbox API v2.
+type Dropbox struct {
+	// Token is the OAuth2 access token of the account.
+	Token string
+
+	// Folder is the folder to import, such as "/Photos"; empty imports
+	// every file in the account.
+	Folder string
+
+	// APIURL and ContentURL override the base URLs of the API; empty uses
+	// DropboxAPIURL and DropboxContentURL.
+	APIURL     string
+	ContentURL string
+
+	// HTTPClient is used for the requests; nil uses http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// dropboxListResult is the reply to a list_folder request.
+type dropboxListResult struct {
+	Entries []struct {
+		Tag            string `json:".tag"`
+		ID             string `json:"id"`
+		PathDisplay    string `json:"path_display"`
+		Size           int64  `json:"size"`
+		ClientModified string `json:"client_modified"`
+	} `json:"entries"`
+	Cursor  string `json:"cursor"`
+	HasMore bool   `json:"has_more"`
+}
+
+// Name returns the name of the provider.
+func (d *Dropbox) Name() string {
+	return "dropbox"
+}
+
+// folder returns the folder in the form the API expects, which is an empty
+// string for the root.
+func (d *Dropbox) folder() string {
+	folder := strings.TrimRight(d.Folder, "/")
+	if folder != "" && !strings.HasPrefix(folder, "/") {
+		folder = "/" + folder
+	}
+	return folder
+}
+
+// Walk lists the folder recursively and calls fn for every file in it.
+func (d *Dropbox) Walk(ctx context.Context, fn func(Entry) error) error {
+	folder := d.folder()
+	var result dropboxListResult
+	err := d.call(ctx, "/files/list_folder", map[string]interface{}{"path": folder, "recursive": true}, &result)
+	for err == nil {
+		for _, de := range result.Entries {
+			if de.Tag != "file" {
+				continue
+			}
+			modTime, err := time.Parse(time.RFC3339, de.ClientModified)
+			if err != nil {
+				return fmt.Errorf("failed to parse the modification time of %s: %v", de.PathDisplay, err)
+			}
+
+			// paths are case-insensitive and path_display may use a
+			// different case than the folder, so the folder is removed by
+			// its length
+			if len(de.PathDisplay) <= len(folder) {
+				continue
+			}
+			relPath := strings.TrimPrefix(de.PathDisplay[len(folder):], "/")
+			err = fn(Entry{Path: relPath, ID: de.ID, Size: de.Size, ModTime: modTime})
+			if err != nil {
+				return err
+			}
+		}
+		if !result.HasMore {
+			return nil
+		}
+		cursor := result.Cursor
+		result = dropboxListResult{}
+		err = d.call(ctx, "/files/list_folder/continue", map[string]string{"cursor": cursor}, &result)
+	}
+	return err
+}
+
+// Open downloads the file.
+func (d *Dropbox) Open(ctx context.Context, e Entry) (io.ReadCloser, error) {
+	baseURL := d.ContentURL
+	if baseURL == "" {
+		baseURL = DropboxContentURL
+	}
+	req, err := http.NewRequest("POST", baseURL+"/files/download", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// the file is identified by its ID so that the header doesn't need
+	// to carry a path with non-ASCII characters in it
+	arg, err := json.Marshal(map[string]string{"path": e.ID})
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+d.Token)
+	req.Header.Set("Dropbox-API-Arg", string(arg))
+	resp, err := httpClientOrDefault(d.HTTPClient).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if err = checkResponse(d.Name(), resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// call makes an RPC request to the API with the JSON encoded args and decodes
+// the JSON reply into result.
+func (d *Dropbox) call(ctx context.Context, endpoint string, args interface{}, result interface{}) error {
+	baseURL := d.APIURL
+	if baseURL == "" {
+		baseURL = DropboxAPIURL
+	}
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", baseURL+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+d.Token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClientOrDefault(d.HTTPClient).Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = checkResponse(d.Name(), resp); err != nil {
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
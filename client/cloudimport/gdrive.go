@@ -0,0 +1,167 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package cloudimport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// GoogleDriveAPIURL is the default base URL of the Google Drive API.
+	GoogleDriveAPIURL = "https://www.googleapis.com/drive/v3"
+
+	// googleDriveFolderType is the MIME type of Google Drive folders.
+	googleDriveFolderType = "application/vnd.google-apps.folder"
+
+	// googleDriveAppsPrefix starts the MIME types of Google Docs, Sheets and
+	// the other files that only exist as Google Drive documents.
+	googleDriveAppsPrefix = "application/vnd.google-apps."
+)
+
+// GoogleDrive imports the files of a Google Drive account through the Drive
+// API v3. Google Docs, Sheets and other Google Drive documents have no data
+// to download and are skipped.
+type GoogleDrive struct {
+	// Token is the OAuth2 access token of the account.
+	Token string
+
+	// FolderID is the ID of the folder to import; empty imports the whole
+	// drive starting at "root".
+	FolderID string
+
+	// APIURL overrides the base URL of the API; empty uses GoogleDriveAPIURL.
+	APIURL string
+
+	// HTTPClient is used for the requests; nil uses http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// googleDriveFileList is the reply to a files list request.
+type googleDriveFileList struct {
+	NextPageToken string `json:"nextPageToken"`
+	Files         []struct {
+		ID           string `json:"id"`
+		Name         string `json:"name"`
+		MimeType     string `json:"mimeType"`
+		Size         string `json:"size"`
+		ModifiedTime string `json:"modifiedTime"`
+	} `json:"files"`
+}
+
+// Name returns the name of the provider.
+func (g *GoogleDrive) Name() string {
+	return "gdrive"
+}
+
+func (g *GoogleDrive) apiURL() string {
+	if g.APIURL == "" {
+		return GoogleDriveAPIURL
+	}
+	return g.APIURL
+}
+
+// Walk lists the folder and its subfolders and calls fn for every file.
+func (g *GoogleDrive) Walk(ctx context.Context, fn func(Entry) error) error {
+	folderID := g.FolderID
+	if folderID == "" {
+		folderID = "root"
+	}
+	return g.walkFolder(ctx, folderID, "", fn)
+}
+
+// walkFolder calls fn for the files in the folder with the ID and walks its
+// subfolders, building the paths from dirPath.
+func (g *GoogleDrive) walkFolder(ctx context.Context, folderID string, dirPath string, fn func(Entry) error) error {
+	query := url.Values{}
+	query.Set("q", fmt.Sprintf("'%s' in parents and trashed = false", strings.Replace(folderID, "'", `\'`, -1)))
+	query.Set("fields", "nextPageToken,files(id,name,mimeType,size,modifiedTime)")
+	query.Set("pageSize", "1000")
+	for {
+		var list googleDriveFileList
+		err := g.get(ctx, g.apiURL()+"/files?"+query.Encode(), &list)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range list.Files {
+			filePath := f.Name
+			if dirPath != "" {
+				filePath = dirPath + "/" + f.Name
+			}
+			if f.MimeType == googleDriveFolderType {
+				if err = g.walkFolder(ctx, f.ID, filePath, fn); err != nil {
+					return err
+				}
+				continue
+			}
+
+			e := Entry{Path: filePath, ID: f.ID}
+			e.ModTime, err = time.Parse(time.RFC3339, f.ModifiedTime)
+			if err != nil {
+				return fmt.Errorf("failed to parse the modification time of %s: %v", filePath, err)
+			}
+			if strings.HasPrefix(f.MimeType, googleDriveAppsPrefix) {
+				e.Skip = "Google Drive documents can't be downloaded"
+			} else if f.Size != "" {
+				e.Size, err = strconv.ParseInt(f.Size, 10, 64)
+				if err != nil {
+					return fmt.Errorf("failed to parse the size of %s: %v", filePath, err)
+				}
+			}
+			if err = fn(e); err != nil {
+				return err
+			}
+		}
+
+		if list.NextPageToken == "" {
+			return nil
+		}
+		query.Set("pageToken", list.NextPageToken)
+	}
+}
+
+// Open downloads the file.
+func (g *GoogleDrive) Open(ctx context.Context, e Entry) (io.ReadCloser, error) {
+	resp, err := g.do(ctx, g.apiURL()+"/files/"+url.PathEscape(e.ID)+"?alt=media")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// get makes a GET request and decodes the JSON reply into result.
+func (g *GoogleDrive) get(ctx context.Context, target string, result interface{}) error {
+	resp, err := g.do(ctx, target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// do makes an authenticated GET request and returns the successful response.
+func (g *GoogleDrive) do(ctx context.Context, target string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+g.Token)
+	resp, err := httpClientOrDefault(g.HTTPClient).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if err = checkResponse(g.Name(), resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
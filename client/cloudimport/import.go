@@ -0,0 +1,175 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+// Package cloudimport copies files from external storage providers such as
+// Dropbox, Google Drive and S3 into filefreezer. The files are streamed
+// through a client.Client, so they're encrypted on the client side like any
+// other upload, and they keep their paths and modification times.
+package cloudimport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/tbogdala/filefreezer/client"
+)
+
+// Entry is a file found in an external storage provider.
+type Entry struct {
+	// Path is the slash separated path of the file relative to the folder
+	// being imported.
+	Path string
+
+	// ID identifies the file to the provider when it's opened.
+	ID string
+
+	// Size is the size of the file in bytes.
+	Size int64
+
+	// ModTime is the time the file was last modified.
+	ModTime time.Time
+
+	// Skip is the reason the file can't be imported; empty if it can.
+	Skip string
+}
+
+// Source is an external storage provider that files can be imported from.
+type Source interface {
+	// Name returns the name of the provider used in messages.
+	Name() string
+
+	// Walk calls fn for every file in the folder being imported, including
+	// the files in its subfolders. Walking stops at the first error fn
+	// returns.
+	Walk(ctx context.Context, fn func(Entry) error) error
+
+	// Open returns the data of a file found by Walk.
+	Open(ctx context.Context, e Entry) (io.ReadCloser, error)
+}
+
+// Import copies every file found in src to the server as remoteDir followed
+// by the file's path. Files already on the server with the same modification
+// time are left alone, so an interrupted import can simply be run again.
+// A file that fails to import doesn't stop the others; a report of every
+// file is returned along with an error if any of them failed.
+func Import(ctx context.Context, c *client.Client, src Source, remoteDir string) (*client.SyncReport, error) {
+	start := time.Now()
+	report := new(client.SyncReport)
+	defer func() {
+		report.Duration = time.Since(start)
+	}()
+
+	// get the modification times of the files already on the server
+	remoteFiles, err := c.GetAllFileHashes()
+	if err != nil {
+		return report, fmt.Errorf("Failed to get a list of remote files: %w", err)
+	}
+	remoteModTimes := make(map[string]int64, len(remoteFiles))
+	for _, fi := range remoteFiles {
+		remoteName, err := c.DecryptString(fi.FileName)
+		if err != nil {
+			return report, fmt.Errorf("Failed to decrypt remote file name for file id %d: %w", fi.FileID, err)
+		}
+		remoteModTimes[remoteName] = fi.CurrentVersion.LastMod
+	}
+
+	failed := 0
+	err = src.Walk(ctx, func(e Entry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fileReport := importFile(ctx, c, src, e, remoteDir+"/"+e.Path, remoteModTimes)
+		report.Files = append(report.Files, fileReport)
+		if fileReport.Err != nil {
+			failed++
+			c.Log.Errorf("Failed to import %s from %s: %v", e.Path, src.Name(), fileReport.Err)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("Failed to list the files in %s: %w", src.Name(), err)
+	}
+	if failed > 0 {
+		return report, fmt.Errorf("%d of %d files failed to import from %s", failed, len(report.Files), src.Name())
+	}
+	return report, nil
+}
+
+// importFile copies one file to the server unless it's already there.
+func importFile(ctx context.Context, c *client.Client, src Source, e Entry, remoteFilepath string, remoteModTimes map[string]int64) client.FileReport {
+	start := time.Now()
+	r := client.FileReport{
+		LocalFilename:  src.Name() + ":" + e.Path,
+		RemoteFilepath: remoteFilepath,
+	}
+	defer func() {
+		r.Duration = time.Since(start)
+	}()
+
+	if e.Skip != "" {
+		r.Status = client.SyncStatusUnsupportedFileType
+		r.Action = client.SyncActionSkipped
+		c.Printf("%s ... skipped: %s\n", remoteFilepath, e.Skip)
+		return r
+	}
+	if lastMod, found := remoteModTimes[remoteFilepath]; found && lastMod == e.ModTime.Unix() {
+		r.Status = client.SyncStatusSame
+		r.Action = client.SyncActionUnchanged
+		return r
+	}
+
+	data, err := src.Open(ctx, e)
+	if err != nil {
+		r.Action = client.SyncActionFailed
+		r.Err = err
+		return r
+	}
+	defer data.Close()
+
+	counter := &countingReader{r: data}
+	fi, err := c.UploadReaderModTime(ctx, remoteFilepath, counter, e.ModTime)
+	if err != nil {
+		r.Action = client.SyncActionFailed
+		r.Err = err
+		return r
+	}
+	r.Status = client.SyncStatusLocalNewer
+	r.Action = client.SyncActionUploaded
+	r.Chunks = fi.CurrentVersion.ChunkCount
+	r.Bytes = counter.n
+	return r
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// httpClientOrDefault returns hc or http.DefaultClient if hc is nil.
+func httpClientOrDefault(hc *http.Client) *http.Client {
+	if hc == nil {
+		return http.DefaultClient
+	}
+	return hc
+}
+
+// checkResponse returns an error describing a response that wasn't a
+// success, including the start of the body the provider sent back.
+func checkResponse(provider string, resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s returned %s: %s", provider, resp.Status, body)
+}
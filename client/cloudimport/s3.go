@@ -0,0 +1,329 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package cloudimport
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// s3DefaultRegion is the region used if none is given.
+	s3DefaultRegion = "us-east-1"
+
+	// s3EmptyPayloadHash is the SHA-256 hash of an empty request body.
+	s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// s3UnsignedPayload is signed in place of the hash of a request body
+	// that is streamed without being hashed first.
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// S3 imports the objects in an S3 bucket, or a bucket of an S3 compatible
+// service, through the S3 REST API. It can also upload objects with Put and
+// remove them with Delete, which the server uses to store its database
+// backups and chunks. Requests are signed with AWS Signature Version 4 and
+// the bucket is addressed path-style.
+type S3 struct {
+	// Bucket is the name of the bucket.
+	Bucket string
+
+	// Prefix limits the import to the objects whose keys start with it.
+	// The prefix is removed from the keys to get the paths of the files.
+	Prefix string
+
+	// Region is the region of the bucket; empty uses us-east-1.
+	Region string
+
+	// AccessKey, SecretKey and SessionToken are the credentials used to
+	// sign the requests. SessionToken is only needed for temporary
+	// credentials.
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	// Endpoint overrides the URL of the service, such as the URL of an
+	// S3 compatible server; empty uses the AWS endpoint for the region.
+	Endpoint string
+
+	// HTTPClient is used for the requests; nil uses http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// s3ListResult is the reply to a ListObjectsV2 request.
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// Name returns the name of the provider.
+func (s *S3) Name() string {
+	return "s3"
+}
+
+func (s *S3) region() string {
+	if s.Region == "" {
+		return s3DefaultRegion
+	}
+	return s.Region
+}
+
+func (s *S3) endpoint() string {
+	if s.Endpoint == "" {
+		return "https://s3." + s.region() + ".amazonaws.com"
+	}
+	return strings.TrimRight(s.Endpoint, "/")
+}
+
+// Walk lists the objects under the prefix and calls fn for each of them.
+// Keys ending in a slash are folder markers and aren't files.
+func (s *S3) Walk(ctx context.Context, fn func(Entry) error) error {
+	query := url.Values{}
+	query.Set("list-type", "2")
+	if s.Prefix != "" {
+		query.Set("prefix", s.Prefix)
+	}
+	for {
+		resp, err := s.get(ctx, "", query)
+		if err != nil {
+			return err
+		}
+		var list s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to decode the object list: %v", err)
+		}
+
+		for _, obj := range list.Contents {
+			relPath := strings.TrimLeft(strings.TrimPrefix(obj.Key, s.Prefix), "/")
+			if relPath == "" || strings.HasSuffix(obj.Key, "/") {
+				continue
+			}
+			err = fn(Entry{Path: relPath, ID: obj.Key, Size: obj.Size, ModTime: obj.LastModified})
+			if err != nil {
+				return err
+			}
+		}
+
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", list.NextContinuationToken)
+	}
+}
+
+// Open downloads the object.
+func (s *S3) Open(ctx context.Context, e Entry) (io.ReadCloser, error) {
+	resp, err := s.get(ctx, e.ID, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Put uploads size bytes read from body as the object key, replacing the
+// object if it exists. The body is streamed without being hashed for the
+// signature, so the endpoint should use HTTPS. S3 limits a single upload to
+// 5 GB.
+func (s *S3) Put(ctx context.Context, key string, body io.Reader, size int64) error {
+	target, err := s.objectURL(key, nil)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", target.String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	s3Sign(req, s.AccessKey, s.SecretKey, s.SessionToken, s.region(), s3UnsignedPayload, time.Now())
+
+	resp, err := httpClientOrDefault(s.HTTPClient).Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(s.Name(), resp)
+}
+
+// Delete removes the object key. Removing an object that doesn't exist
+// isn't an error.
+func (s *S3) Delete(ctx context.Context, key string) error {
+	target, err := s.objectURL(key, nil)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("DELETE", target.String(), nil)
+	if err != nil {
+		return err
+	}
+	s3Sign(req, s.AccessKey, s.SecretKey, s.SessionToken, s.region(), s3EmptyPayloadHash, time.Now())
+
+	resp, err := httpClientOrDefault(s.HTTPClient).Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return checkResponse(s.Name(), resp)
+}
+
+// objectURL returns the URL of the object key, or of the bucket if key is
+// empty, with the query. The path and query are encoded the way the
+// signature requires so that they are sent exactly as they were signed.
+func (s *S3) objectURL(key string, query url.Values) (*url.URL, error) {
+	base, err := url.Parse(s.endpoint())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the S3 endpoint: %v", err)
+	}
+	objectPath := strings.TrimRight(base.Path, "/") + "/" + s.Bucket
+	if key != "" {
+		objectPath += "/" + key
+	}
+
+	return &url.URL{
+		Scheme:   base.Scheme,
+		Host:     base.Host,
+		Path:     objectPath,
+		RawPath:  s3Encode(objectPath, false),
+		RawQuery: s3CanonicalQuery(query),
+	}, nil
+}
+
+// get makes a signed GET request for the object key, or for the bucket if
+// key is empty, and returns the successful response.
+func (s *S3) get(ctx context.Context, key string, query url.Values) (*http.Response, error) {
+	target, err := s.objectURL(key, query)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	s3Sign(req, s.AccessKey, s.SecretKey, s.SessionToken, s.region(), s3EmptyPayloadHash, time.Now())
+
+	resp, err := httpClientOrDefault(s.HTTPClient).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if err = checkResponse(s.Name(), resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// s3Sign adds the AWS Signature Version 4 headers to a request whose body has
+// the payloadHash; s3EmptyPayloadHash for a request without a body. Every
+// header already set on the request is signed along with the host.
+func s3Sign(req *http.Request, accessKey string, secretKey string, sessionToken string, region string, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	// the canonical headers are the lower case names, sorted, with trimmed
+	// values
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := s3HMAC([]byte("AWS4"+secretKey), day)
+	key = s3HMAC(key, region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// s3HMAC returns the HMAC-SHA256 of data using key.
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery encodes the query with its keys sorted and every value
+// encoded the way the signature requires.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3Encode(key, true)+"="+s3Encode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Encode percent-encodes every byte of s except the unreserved characters
+// and, unless encodeSlash is set, the slash.
+func s3Encode(s string, encodeSlash bool) string {
+	var encoded bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/' && !encodeSlash:
+			encoded.WriteByte(b)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
@@ -0,0 +1,137 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// compressedChunkMarker starts the stored bytes of a compressed chunk and is
+// followed by the encrypted, deflated chunk data. The marker is outside of
+// the encryption so that the chunk is recorded as compressed without having
+// to decrypt it; chunks without it are stored as they were encrypted. A
+// random nonce can start with the marker too, but only one of the two ways
+// of reading such a chunk passes the authentication of AES-GCM.
+var compressedChunkMarker = []byte("FFZ\x01")
+
+// minCompressionSaving is the fraction of a chunk that compression has to
+// save for the chunk to be stored compressed.
+const minCompressionSaving = 0.05
+
+// incompressibleExtensions are the file name extensions of formats that
+// are already compressed, whose chunks aren't worth compressing again.
+var incompressibleExtensions = map[string]bool{
+	// images
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".heif": true, ".avif": true,
+	// audio and video
+	".mp3": true, ".m4a": true, ".aac": true, ".ogg": true, ".opus": true, ".flac": true,
+	".mp4": true, ".m4v": true, ".mov": true, ".mkv": true, ".webm": true, ".avi": true,
+	// archives and compressed files
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true, ".lz4": true, ".7z": true, ".rar": true,
+	".jar": true, ".apk": true, ".dmg": true,
+	// documents stored as zip archives
+	".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".ods": true, ".odp": true, ".epub": true,
+	// fonts
+	".woff": true, ".woff2": true,
+}
+
+// incompressibleTypePrefixes are the MIME types sniffed from the data of a
+// chunk that mean it's already compressed.
+var incompressibleTypePrefixes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp",
+	"audio/", "video/",
+	"application/zip", "application/x-gzip", "application/x-rar-compressed", "application/x-7z-compressed",
+	"font/woff",
+}
+
+// compressible returns true if a chunk of the file named filename may be
+// worth compressing. Known compressed formats are recognized by the
+// extension of the file name, if there is one, or by sniffing the MIME type
+// of the chunk, which tells for the first chunk of a file.
+func compressible(filename string, chunk []byte) bool {
+	if incompressibleExtensions[strings.ToLower(filepath.Ext(filename))] {
+		return false
+	}
+	contentType := http.DetectContentType(chunk)
+	for _, prefix := range incompressibleTypePrefixes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// compressChunk deflates the chunk and returns the compressed data, or nil
+// if it doesn't save enough to be worth it.
+func compressChunk(chunk []byte) []byte {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil
+	}
+	if _, err = w.Write(chunk); err != nil {
+		return nil
+	}
+	if err = w.Close(); err != nil {
+		return nil
+	}
+	if float64(buf.Len()) > float64(len(chunk))*(1-minCompressionSaving) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// encryptChunk encrypts a chunk of the file named filename for uploading.
+// If Compress is set and the chunk is encrypted with the default AES-GCM
+// cipher, the chunk is compressed first when that's worthwhile; chunks that
+// the server can read, or that a custom Cipher encrypts, are never
+// compressed.
+func (c *Client) encryptChunk(filename string, chunk []byte) ([]byte, error) {
+	if c.Compress && c.Cipher == nil && len(c.CryptoKey) > 0 && compressible(filename, chunk) {
+		if compressed := compressChunk(chunk); compressed != nil {
+			sealed, err := c.encryptBytes(compressed)
+			if err != nil {
+				return nil, err
+			}
+			return append(append([]byte(nil), compressedChunkMarker...), sealed...), nil
+		}
+	}
+	return c.encryptBytes(chunk)
+}
+
+// decryptChunk decrypts a chunk downloaded from the server or a peer,
+// decompressing it if it was stored compressed.
+func (c *Client) decryptChunk(data []byte) ([]byte, error) {
+	chunkCipher, err := c.chunkCipher()
+	if err != nil {
+		return nil, err
+	}
+	return openChunk(chunkCipher, data)
+}
+
+// openChunk decrypts the stored chunk data with the cipher, decompressing
+// it if it starts with compressedChunkMarker and the rest decrypts. Only
+// the AES-GCM cipher compresses chunks, so the data of other ciphers is
+// never taken for a compressed chunk.
+func openChunk(chunkCipher ChunkCipher, data []byte) ([]byte, error) {
+	if _, isGCM := chunkCipher.(*aesGCMCipher); isGCM && bytes.HasPrefix(data, compressedChunkMarker) {
+		compressed, err := chunkCipher.Decrypt(data[len(compressedChunkMarker):])
+		if err == nil {
+			r := flate.NewReader(bytes.NewReader(compressed))
+			defer r.Close()
+			chunk, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to decompress the chunk: %w", err)
+			}
+			return chunk, nil
+		}
+	}
+	return chunkCipher.Decrypt(data)
+}
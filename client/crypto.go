@@ -0,0 +1,148 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+const (
+	cryptoNonceSize = 12
+)
+
+// encryptString will encrypt the source string bytes and then return
+// a base64 encoded string version of the crypto bytes
+func (c *Client) EncryptString(source string) (string, error) {
+	cryptoBytes, err := c.encryptBytes([]byte(source))
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(cryptoBytes)
+	return encoded, nil
+}
+
+// decryptString will decrypt the source base64 encoded string into
+// crypto bytes and then return the result as a string.
+func (c *Client) DecryptString(encoded string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+
+	decrypted, err := c.decryptBytes(decoded)
+	if err != nil {
+		return "", err
+	}
+	return string(decrypted), nil
+}
+
+// ChunkCipher encrypts and decrypts file chunks and file names on the client
+// before they are sent to the server so that the server only stores ciphertext.
+// Set Client.Cipher to use a different cipher, delegate to an external key
+// management service or to disable encryption with PassthroughCipher.
+// Encrypt must not make data more than filefreezer.MaxChunkOverhead bytes
+// larger or the server will reject full sized chunks.
+type ChunkCipher interface {
+	// Encrypt returns the encrypted form of plain.
+	Encrypt(plain []byte) ([]byte, error)
+
+	// Decrypt returns the plain data that was encrypted by Encrypt.
+	Decrypt(sealed []byte) ([]byte, error)
+}
+
+// aesGCMCipher is the default ChunkCipher which seals data with AES-GCM
+// and prefixes it with a random nonce.
+type aesGCMCipher struct {
+	gcm cipher.AEAD
+}
+
+// NewAESGCMCipher returns the ChunkCipher that filefreezer uses by default
+// to encrypt data with AES-GCM using the key. The key is normally derived
+// from the crypto password with filefreezer.VerifyCryptoPassword.
+func NewAESGCMCipher(key []byte) (ChunkCipher, error) {
+	aesCipher, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't initialize the AES cipher: %v", err)
+	}
+
+	gcm, err := cipher.NewGCM(aesCipher)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't initialize the AES-GCM cipher: %v", err)
+	}
+	return &aesGCMCipher{gcm: gcm}, nil
+}
+
+// Encrypt seals the bytes with a random nonce that is prepended to the result.
+func (a *aesGCMCipher) Encrypt(b []byte) ([]byte, error) {
+	nonce := make([]byte, cryptoNonceSize)
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to initialize random data for AES-GCM: %v", err)
+	}
+
+	cipherBytes := a.gcm.Seal(nil, nonce, b, nil)
+	cipherBytes = append(nonce, cipherBytes...)
+	return cipherBytes, nil
+}
+
+// Decrypt opens bytes sealed by Encrypt.
+func (a *aesGCMCipher) Decrypt(b []byte) ([]byte, error) {
+	if len(b) < cryptoNonceSize {
+		return nil, fmt.Errorf("the encrypted data is too short (%d bytes)", len(b))
+	}
+	nonce := make([]byte, cryptoNonceSize)
+	copy(nonce, b[:cryptoNonceSize])
+	return a.gcm.Open(nil, nonce, b[cryptoNonceSize:], nil)
+}
+
+// PassthroughCipher is a ChunkCipher that doesn't encrypt anything. It is
+// meant for testing and for data that is already encrypted; the server can
+// read everything stored with it.
+type PassthroughCipher struct{}
+
+// Encrypt returns a copy of the bytes unchanged.
+func (PassthroughCipher) Encrypt(b []byte) ([]byte, error) {
+	return append([]byte(nil), b...), nil
+}
+
+// Decrypt returns a copy of the bytes unchanged.
+func (PassthroughCipher) Decrypt(b []byte) ([]byte, error) {
+	return append([]byte(nil), b...), nil
+}
+
+// chunkCipher returns Cipher if it's set or the default AES-GCM cipher for
+// CryptoKey otherwise.
+func (c *Client) chunkCipher() (ChunkCipher, error) {
+	if c.Cipher != nil {
+		return c.Cipher, nil
+	}
+	return NewAESGCMCipher(c.CryptoKey)
+}
+
+// hasCipher returns true if a cipher or crypto key has been set.
+func (c *Client) hasCipher() bool {
+	return c.Cipher != nil || len(c.CryptoKey) > 0
+}
+
+func (c *Client) encryptBytes(b []byte) ([]byte, error) {
+	chunkCipher, err := c.chunkCipher()
+	if err != nil {
+		return nil, err
+	}
+	return chunkCipher.Encrypt(b)
+}
+
+func (c *Client) decryptBytes(b []byte) ([]byte, error) {
+	chunkCipher, err := c.chunkCipher()
+	if err != nil {
+		return nil, err
+	}
+	return chunkCipher.Decrypt(b)
+}
@@ -0,0 +1,316 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDaemonTransfers is the number of recent transfers a SyncDaemon keeps.
+const maxDaemonTransfers = 100
+
+// SyncDaemon syncs a local directory with the server over and over, waiting
+// the interval between syncs, until it's closed. Tray apps and GUIs can
+// follow and control it through the local API started by ServeControl.
+type SyncDaemon struct {
+	// BeforeSync is called before each sync, such as to log in again to
+	// renew the authentication token. The sync is skipped if it fails.
+	BeforeSync func() error
+
+	// AfterSync is called with the report of each sync.
+	AfterSync func(report *SyncReport, err error)
+
+	c         *Client
+	localDir  string
+	remoteDir string
+	interval  time.Duration
+
+	listener net.Listener
+	server   *http.Server
+
+	trigger chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+
+	lock      sync.Mutex
+	status    DaemonStatus
+	transfers []DaemonTransfer
+}
+
+// DaemonStatus is the state of a SyncDaemon.
+type DaemonStatus struct {
+	LocalDir  string
+	RemoteDir string
+
+	// Paused is true if the scheduled syncs are paused; a sync can still
+	// be triggered. Syncing is true while a sync runs.
+	Paused  bool
+	Syncing bool
+
+	// Syncs is the number of syncs finished. LastSync is when the last one
+	// finished and LastDuration (in nanoseconds) how long it took;
+	// LastError is empty if it succeeded.
+	Syncs        int
+	LastSync     time.Time
+	LastDuration time.Duration
+	LastSummary  string
+	LastError    string
+
+	// NextSync is when the next scheduled sync starts.
+	NextSync time.Time
+}
+
+// DaemonTransfer is a file that a sync of a SyncDaemon changed or failed on.
+type DaemonTransfer struct {
+	Time           time.Time
+	RemoteFilepath string
+	Action         string // one of the SyncAction constants
+	Chunks         int
+	Bytes          int64
+	Conflict       bool
+	Error          string
+}
+
+// StartSyncDaemon starts syncing localDir with remoteDir on the server
+// right away and then every interval. Close must be called to stop it.
+func (c *Client) StartSyncDaemon(localDir string, remoteDir string, interval time.Duration) *SyncDaemon {
+	d := &SyncDaemon{
+		c:         c,
+		localDir:  localDir,
+		remoteDir: remoteDir,
+		interval:  interval,
+		trigger:   make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	d.status.LocalDir = localDir
+	d.status.RemoteDir = remoteDir
+	d.status.NextSync = time.Now()
+	go d.run()
+	return d
+}
+
+// run syncs on schedule, or when triggered, until the daemon is closed.
+func (d *SyncDaemon) run() {
+	defer close(d.done)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		triggered := false
+		select {
+		case <-d.stop:
+			return
+		case <-timer.C:
+		case <-d.trigger:
+			triggered = true
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+
+		d.lock.Lock()
+		paused := d.status.Paused
+		d.lock.Unlock()
+		if triggered || !paused {
+			d.sync()
+		}
+
+		timer.Reset(d.interval)
+		d.lock.Lock()
+		d.status.NextSync = time.Now().Add(d.interval)
+		d.lock.Unlock()
+	}
+}
+
+// sync syncs the directory once and records the result.
+func (d *SyncDaemon) sync() {
+	d.lock.Lock()
+	d.status.Syncing = true
+	d.lock.Unlock()
+
+	report := &SyncReport{}
+	var err error
+	if d.BeforeSync != nil {
+		err = d.BeforeSync()
+	}
+	if err == nil {
+		report, err = d.c.SyncDirectory(d.localDir, d.remoteDir)
+	}
+
+	d.lock.Lock()
+	now := time.Now()
+	d.status.Syncing = false
+	d.status.Syncs++
+	d.status.LastSync = now
+	d.status.LastDuration = report.Duration
+	d.status.LastSummary = report.Summary()
+	d.status.LastError = ""
+	if err != nil {
+		d.status.LastError = err.Error()
+	}
+	for _, f := range report.Files {
+		if f.Action == SyncActionUnchanged {
+			continue
+		}
+		t := DaemonTransfer{Time: now, RemoteFilepath: f.RemoteFilepath, Action: f.Action,
+			Chunks: f.Chunks, Bytes: f.Bytes, Conflict: f.Conflict}
+		if f.Err != nil {
+			t.Error = f.Err.Error()
+		}
+		d.transfers = append(d.transfers, t)
+	}
+	if len(d.transfers) > maxDaemonTransfers {
+		d.transfers = append([]DaemonTransfer(nil), d.transfers[len(d.transfers)-maxDaemonTransfers:]...)
+	}
+	d.lock.Unlock()
+
+	if d.AfterSync != nil {
+		d.AfterSync(report, err)
+	}
+}
+
+// Status returns the state of the daemon.
+func (d *SyncDaemon) Status() DaemonStatus {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.status
+}
+
+// Transfers returns the files the recent syncs changed or failed on, most
+// recent first.
+func (d *SyncDaemon) Transfers() []DaemonTransfer {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	transfers := make([]DaemonTransfer, len(d.transfers))
+	for i, t := range d.transfers {
+		transfers[len(transfers)-1-i] = t
+	}
+	return transfers
+}
+
+// Pause stops the scheduled syncs until Resume is called. A sync in
+// progress is finished.
+func (d *SyncDaemon) Pause() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.status.Paused = true
+}
+
+// Resume starts the scheduled syncs again with a sync right away.
+func (d *SyncDaemon) Resume() {
+	d.lock.Lock()
+	wasPaused := d.status.Paused
+	d.status.Paused = false
+	d.lock.Unlock()
+	if wasPaused {
+		d.Trigger()
+	}
+}
+
+// Trigger starts a sync right away, even if the daemon is paused, or as
+// soon as the sync in progress finishes.
+func (d *SyncDaemon) Trigger() {
+	select {
+	case d.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// ServeControl serves the local control API on addr, which is either a
+// loopback address such as "127.0.0.1:7172" or "unix:" followed by the path
+// of a unix socket that only the user can use. The API has these routes:
+//
+//	GET  /status     the DaemonStatus
+//	GET  /transfers  the recent DaemonTransfers, most recent first
+//	POST /pause      pauses the scheduled syncs
+//	POST /resume     resumes the scheduled syncs
+//	POST /sync       starts a sync
+//
+// The POST routes respond with the DaemonStatus after the change. Requests
+// from web pages are refused so that a site can't control the daemon
+// through the user's browser.
+func (d *SyncDaemon) ServeControl(addr string) error {
+	var err error
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+		os.Remove(path)
+		d.listener, err = net.Listen("unix", path)
+		if err == nil {
+			err = os.Chmod(path, 0600)
+		}
+	} else {
+		var host string
+		host, _, err = net.SplitHostPort(addr)
+		if err == nil {
+			ip := net.ParseIP(host)
+			if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+				return fmt.Errorf("the control API can only listen on a loopback address or a unix socket, not %s", addr)
+			}
+			d.listener, err = net.Listen("tcp", addr)
+		}
+	}
+	if err != nil {
+		if d.listener != nil {
+			d.listener.Close()
+			d.listener = nil
+		}
+		return fmt.Errorf("Failed to listen for the control API on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", d.handleControl("GET", func() interface{} { return d.Status() }))
+	mux.HandleFunc("/transfers", d.handleControl("GET", func() interface{} { return d.Transfers() }))
+	mux.HandleFunc("/pause", d.handleControl("POST", func() interface{} { d.Pause(); return d.Status() }))
+	mux.HandleFunc("/resume", d.handleControl("POST", func() interface{} { d.Resume(); return d.Status() }))
+	mux.HandleFunc("/sync", d.handleControl("POST", func() interface{} { d.Trigger(); return d.Status() }))
+	d.server = &http.Server{Handler: mux}
+	go d.server.Serve(d.listener)
+	return nil
+}
+
+// handleControl returns the handler of a control API route that only
+// accepts the method and responds with the JSON of what f returns.
+func (d *SyncDaemon) handleControl(method string, f func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			http.Error(w, "Requests from web pages are not allowed.", http.StatusForbidden)
+			return
+		}
+		if r.Method != method {
+			http.Error(w, "Only "+method+" is supported.", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(f())
+	}
+}
+
+// ControlURL returns the base URL of the control API if it listens on a
+// TCP address, or an empty string otherwise.
+func (d *SyncDaemon) ControlURL() string {
+	if d.listener == nil || d.listener.Addr().Network() != "tcp" {
+		return ""
+	}
+	return "http://" + d.listener.Addr().String()
+}
+
+// Close stops the control API and the syncs, waiting for a sync in
+// progress to finish.
+func (d *SyncDaemon) Close() error {
+	var err error
+	if d.server != nil {
+		err = d.server.Close()
+	}
+	close(d.stop)
+	<-d.done
+	return err
+}
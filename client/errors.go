@@ -0,0 +1,115 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// HTTPError is returned when the server responds to a request with a status
+// other than 200 OK. It unwraps to the filefreezer error for the status code,
+// such as filefreezer.ErrQuotaExceeded, so that callers can check for the
+// kind of error with errors.Is.
+type HTTPError struct {
+	// Method is the HTTP method of the request.
+	Method string
+
+	// Target is the URL of the request.
+	Target string
+
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+
+	// Status is the HTTP status line of the response, e.g. "404 Not Found".
+	Status string
+
+	// Body is the response body, which holds the server's error message.
+	Body string
+
+	// Code, Message and Details are the fields of the server's error body,
+	// a models.ErrorResponse; Code is one of the models.ErrorCode values.
+	// They're empty if the body isn't one, such as for servers from before
+	// error codes.
+	Code    string
+	Message string
+	Details map[string]string
+
+	// RequestID is the id the server gave the request, which its logs
+	// include; empty for servers from before request ids.
+	RequestID string
+}
+
+// newHTTPError returns the HTTPError for the response to a request, reading
+// the error code from the body if it has one.
+func newHTTPError(method string, target string, resp *http.Response, body []byte) *HTTPError {
+	e := &HTTPError{Method: method, Target: target, StatusCode: resp.StatusCode, Status: resp.Status, Body: string(body),
+		RequestID: resp.Header.Get(models.HeaderRequestID)}
+	var errResp models.ErrorResponse
+	if json.Unmarshal(body, &errResp) == nil && errResp.Code != "" {
+		e.Code = errResp.Code
+		e.Message = errResp.Message
+		e.Details = errResp.Details
+	}
+	return e
+}
+
+// Error returns the request and the server's error message along with the
+// request id to look the failure up in the server's logs by.
+func (e *HTTPError) Error() string {
+	message := e.Body
+	if e.Code != "" {
+		message = fmt.Sprintf("%s (%s)", e.Message, e.Code)
+	}
+	if e.RequestID != "" {
+		message += fmt.Sprintf(" [request id: %s]", e.RequestID)
+	}
+	return fmt.Sprintf("Failed to make the HTTP %s request to %s (status: %s): %v", e.Method, e.Target, e.Status, message)
+}
+
+// Unwrap returns the filefreezer error for the status code or nil if the
+// status code doesn't identify a specific kind of error. The server's
+// storage cap shares its status code with the quota, so the two are told
+// apart by the error code, or by the error message for servers from before
+// error codes. ErrorCode tells apart the errors that share the other status
+// codes.
+func (e *HTTPError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusForbidden:
+		return filefreezer.ErrNotOwner
+	case http.StatusInsufficientStorage:
+		if e.Code == models.ErrorCodeStorageFull || (e.Code == "" && strings.Contains(e.Body, filefreezer.ErrStorageFull.Error())) {
+			return filefreezer.ErrStorageFull
+		}
+		return filefreezer.ErrQuotaExceeded
+	case http.StatusConflict:
+		return filefreezer.ErrFileExists
+	case http.StatusRequestEntityTooLarge:
+		return filefreezer.ErrChunkTooLarge
+	case http.StatusUnprocessableEntity:
+		return filefreezer.ErrChunkMismatch
+	case models.StatusBandwidthLimitExceeded:
+		return filefreezer.ErrTransferLimit
+	case http.StatusPreconditionFailed:
+		return filefreezer.ErrRevisionMismatch
+	}
+	return nil
+}
+
+// ErrorCode returns the models.ErrorCode value of the server's error response
+// that caused err, such as models.ErrorCodeUnauthorized, or an empty string
+// if err didn't come from an error response with a code.
+func ErrorCode(err error) string {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code
+	}
+	return ""
+}
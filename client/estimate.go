@@ -0,0 +1,274 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tbogdala/filefreezer"
+)
+
+// FileEstimate is what syncing one file would transfer, as worked out by
+// EstimateSync.
+type FileEstimate struct {
+	// LocalFilename is the path of the local file.
+	LocalFilename string
+
+	// RemoteFilepath is the name of the file on the server.
+	RemoteFilepath string
+
+	// Action is the SyncAction value the sync is expected to take:
+	// SyncActionUploaded, SyncActionDownloaded, SyncActionUnchanged or
+	// SyncActionSkipped.
+	Action string
+
+	// Chunks is the number of chunks that would be transferred.
+	Chunks int
+
+	// Bytes is about the number of bytes that would be transferred.
+	Bytes int64
+}
+
+// SyncEstimate is what a sync would transfer, as worked out by EstimateSync.
+// Directories aren't included since syncing them transfers no chunks.
+type SyncEstimate struct {
+	Files []FileEstimate
+}
+
+// Count returns the number of files with the given SyncAction value.
+func (e *SyncEstimate) Count(action string) int {
+	count := 0
+	for _, f := range e.Files {
+		if f.Action == action {
+			count++
+		}
+	}
+	return count
+}
+
+// Chunks returns the number of chunks that would be transferred for the
+// files with the given SyncAction value.
+func (e *SyncEstimate) Chunks(action string) int {
+	count := 0
+	for _, f := range e.Files {
+		if f.Action == action {
+			count += f.Chunks
+		}
+	}
+	return count
+}
+
+// Bytes returns about the number of bytes that would be transferred for the
+// files with the given SyncAction value.
+func (e *SyncEstimate) Bytes(action string) int64 {
+	var total int64
+	for _, f := range e.Files {
+		if f.Action == action {
+			total += f.Bytes
+		}
+	}
+	return total
+}
+
+// TransferTime returns how long transferring the bytes of the estimate would
+// take at bytesPerSecond, not counting the round trips of each request. Zero
+// is returned if bytesPerSecond isn't positive.
+func (e *SyncEstimate) TransferTime(bytesPerSecond int64) time.Duration {
+	if bytesPerSecond <= 0 {
+		return 0
+	}
+	total := e.Bytes(SyncActionUploaded) + e.Bytes(SyncActionDownloaded)
+	return time.Duration(float64(total) / float64(bytesPerSecond) * float64(time.Second))
+}
+
+// EstimateSync works out what syncing the local path, a file or directory,
+// with remotePath would transfer without transferring anything. The local
+// files are hashed and compared with the remote metadata the same way
+// SyncFile and SyncDirectory compare them. Uploads are estimated at the size
+// of the local files and downloads at the stored size of the remote ones, so
+// chunks the server copies from identical files or that are read from the
+// cache or peers make the real sync transfer less.
+func (c *Client) EstimateSync(localPath string, remotePath string) (*SyncEstimate, error) {
+	remotePath = strings.TrimRight(remotePath, "/")
+
+	// a directory is estimated without the paths its ignore file lists
+	var ignore *filefreezer.IgnoreRules
+	if info, err := os.Stat(localPath); err == nil && info.IsDir() {
+		ignore, err = readIgnoreFile(localPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the local files by their remote names
+	localFiles := make(map[string]string)
+	localNames := make(map[string]string)
+	err := filepath.Walk(localPath, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == localPath {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localPath, path)
+		if err != nil {
+			return err
+		}
+		if path != localPath {
+			if strings.HasSuffix(path, SyncPartialSuffix) || strings.HasSuffix(path, SyncQuarantineSuffix) ||
+				c.excluded(info.Name()) || c.isStateFile(path) || ignore.Match(filepath.ToSlash(rel), info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if info.IsDir() {
+			return nil
+		}
+		remoteName := remotePath
+		if rel != "." {
+			remoteName += "/" + filepath.ToSlash(rel)
+		}
+		localFiles[c.foldName(remoteName)] = path
+		localNames[c.foldName(remoteName)] = remoteName
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to walk the local path %s: %w", localPath, err)
+	}
+
+	// the remote files that the sync would cover
+	remoteFileHashes, err := c.GetAllFileHashes()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get a list of remote file hashes: %w", err)
+	}
+	remoteFiles := make(map[string]filefreezer.FileInfo)
+	for _, fi := range remoteFileHashes {
+		if fi.IsDir {
+			continue
+		}
+		remoteName, err := c.DecryptString(fi.FileName)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decrypt remote file name for file id %d: %w", fi.FileID, err)
+		}
+		if !c.sameName(remoteName, remotePath) {
+			if !strings.HasPrefix(c.foldName(remoteName), c.foldName(remotePath+"/")) ||
+				c.excludedPath(remoteName[len(remotePath):]) || ignore.Match(remoteName[len(remotePath):], false) {
+				continue
+			}
+		}
+		remoteFiles[c.foldName(remoteName)] = fi
+		if _, found := localNames[c.foldName(remoteName)]; !found {
+			localNames[c.foldName(remoteName)] = remoteName
+			localFiles[c.foldName(remoteName)] = localPath + filepath.FromSlash(remoteName[len(remotePath):])
+		}
+	}
+
+	estimate := new(SyncEstimate)
+	for key, remoteName := range localNames {
+		var remote *filefreezer.FileInfo
+		if fi, found := remoteFiles[key]; found {
+			remote = &fi
+		}
+		f, err := c.estimateFile(localFiles[key], remoteName, remote)
+		if err != nil {
+			return estimate, err
+		}
+		estimate.Files = append(estimate.Files, f)
+	}
+	sort.Slice(estimate.Files, func(i, j int) bool {
+		return estimate.Files[i].RemoteFilepath < estimate.Files[j].RemoteFilepath
+	})
+	return estimate, nil
+}
+
+// estimateFile works out what syncing the local file with the remote file
+// would transfer. remote is nil if the file isn't on the server.
+func (c *Client) estimateFile(localFilename string, remoteFilepath string, remote *filefreezer.FileInfo) (FileEstimate, error) {
+	f := FileEstimate{LocalFilename: localFilename, RemoteFilepath: remoteFilepath}
+	localFileStat, err := os.Stat(localFilename)
+	if os.IsNotExist(err) {
+		f.Action = SyncActionDownloaded
+		f.Chunks = remote.CurrentVersion.ChunkCount
+		f.Bytes = c.remoteFileSize(remote)
+		return f, nil
+	} else if err != nil {
+		return f, fmt.Errorf("Failed to stat the local file %s: %w", localFilename, err)
+	}
+	localMode := localFileStat.Mode()
+	if (localMode & (os.ModeCharDevice | os.ModeDevice | os.ModeNamedPipe | os.ModeSocket | os.ModeSymlink)) != 0 {
+		f.Action = SyncActionSkipped
+		return f, nil
+	}
+
+	localStats, err := filefreezer.CalcFileHashInfo(c.ServerCapabilities.ChunkSize, localFilename)
+	if err != nil {
+		return f, fmt.Errorf("Failed to calculate the local file hash data for %s: %w", localFilename, err)
+	}
+	upload := func() (FileEstimate, error) {
+		f.Action = SyncActionUploaded
+		f.Chunks = localStats.ChunkCount
+		f.Bytes = localFileStat.Size()
+		return f, nil
+	}
+	if remote == nil {
+		return upload()
+	}
+
+	// the same file only needs the chunks the server is missing
+	if localStats.HashString == remote.CurrentVersion.FileHash && localStats.ChunkCount == remote.CurrentVersion.ChunkCount {
+		missing, err := c.GetMissingChunksForFile(remote.FileID)
+		if err != nil {
+			return f, err
+		}
+		if len(missing) == 0 {
+			f.Action = SyncActionUnchanged
+			return f, nil
+		}
+		f.Action = SyncActionUploaded
+		f.Chunks = len(missing)
+		f.Bytes = int64(len(missing)) * c.ServerCapabilities.ChunkSize
+		if f.Bytes > localFileStat.Size() {
+			f.Bytes = localFileStat.Size()
+		}
+		return f, nil
+	}
+
+	// otherwise whichever side changed since the last sync wins, or the
+	// newer one by the server's clock; ties are uploaded
+	localNewer := c.serverLastMod(localStats.LastMod) >= remote.CurrentVersion.LastMod
+	if base, found := c.Revisions.get(c.HostURI, localFilename); found && base.FileID == remote.FileID {
+		if localStats.HashString != base.Hash {
+			localNewer = true
+		} else if remote.CurrentVersion.VersionID != base.Revision {
+			localNewer = false
+		}
+	}
+	if localNewer {
+		return upload()
+	}
+	f.Action = SyncActionDownloaded
+	f.Chunks = remote.CurrentVersion.ChunkCount
+	f.Bytes = c.remoteFileSize(remote)
+	return f, nil
+}
+
+// remoteFileSize returns the stored size of the current version of the
+// remote file, which is about what downloading it transfers. If the server
+// doesn't say, the size of its chunks is assumed to be the chunk size.
+func (c *Client) remoteFileSize(remote *filefreezer.FileInfo) int64 {
+	r, err := c.getFileVersionsResponse(remote.FileID)
+	if err == nil {
+		if size, found := r.StoredSizes[remote.CurrentVersion.VersionID]; found {
+			return size
+		}
+	}
+	return int64(remote.CurrentVersion.ChunkCount) * c.ServerCapabilities.ChunkSize
+}
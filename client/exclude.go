@@ -0,0 +1,86 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tbogdala/filefreezer"
+)
+
+// DefaultExcludes are the file name patterns that New sets as the Excludes
+// of a Client: operating system metadata files, editor temporary and swap
+// files and the lock files of office suites and editors.
+var DefaultExcludes = []string{
+	".DS_Store",   // macOS Finder settings
+	"._*",         // macOS resource forks on foreign file systems
+	"Thumbs.db",   // Windows thumbnail caches
+	"ehthumbs.db", // Windows Media Center thumbnail caches
+	"desktop.ini", // Windows folder settings
+	"*~",          // editor backups
+	".*.swp",      // vim swap files
+	".*.swo",      // vim swap files
+	"#*#",         // emacs auto-saves
+	".#*",         // emacs lock files
+	"~$*",         // Microsoft Office lock files
+	".~lock.*#",   // LibreOffice lock files
+	"*.tmp",       // temporary files
+}
+
+// excluded returns true if SyncDirectory skips files with the base name,
+// either because it matches one of the Excludes or because the server
+// doesn't accept it.
+func (c *Client) excluded(name string) bool {
+	return filefreezer.MatchName(name, c.Excludes) || filefreezer.MatchName(name, c.ServerCapabilities.DeniedNames)
+}
+
+// excludedPath returns true if any element of the slash separated path is
+// excluded, so that the contents of an excluded directory are skipped too.
+func (c *Client) excludedPath(p string) bool {
+	for _, name := range strings.Split(p, "/") {
+		if name != "" && c.excluded(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// IgnoreFileName is the name of the file in the root of a synced directory
+// that lists the paths SyncDirectory skips, in the syntax of .gitignore
+// files. The file itself is synced like any other so that the account's
+// other clients skip the same paths.
+const IgnoreFileName = ".freezerignore"
+
+// readIgnoreFile reads the ignore file in the root of localDir. A directory
+// without one ignores nothing.
+func readIgnoreFile(localDir string) (*filefreezer.IgnoreRules, error) {
+	f, err := os.Open(filepath.Join(localDir, IgnoreFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to open the ignore file: %w", err)
+	}
+	defer f.Close()
+
+	rules, err := filefreezer.ParseIgnoreRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the ignore file %s: %w", f.Name(), err)
+	}
+	return rules, nil
+}
+
+// checkDeniedName returns an error if the server doesn't accept one of the
+// elements of the remote path. The server can't read encrypted names so the
+// client enforces its denylist.
+func (c *Client) checkDeniedName(remoteFilepath string) error {
+	for _, name := range strings.Split(remoteFilepath, "/") {
+		if name != "" && filefreezer.MatchName(name, c.ServerCapabilities.DeniedNames) {
+			return fmt.Errorf("the server doesn't accept files named %s", name)
+		}
+	}
+	return nil
+}
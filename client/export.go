@@ -0,0 +1,102 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tbogdala/filefreezer"
+)
+
+// ExportArchive writes the current version of every file in the remote
+// directory remoteDir and its subdirectories to w as a single archive of the
+// format, which is one of the filefreezer.Archive* constants. The names in
+// the archive are relative to remoteDir and an empty remoteDir exports every
+// file. Files that are still being uploaded are left out. The number of files
+// written to the archive is returned.
+//
+// Every file is decrypted into a temporary file before it's added since the
+// archive needs to know the size of a file before its data.
+func (c *Client) ExportArchive(ctx context.Context, remoteDir string, format string, w io.Writer) (int, error) {
+	archive, err := filefreezer.NewArchiveWriter(w, format)
+	if err != nil {
+		return 0, err
+	}
+
+	remoteFiles, err := c.GetAllFileHashes()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get a list of remote files: %w", err)
+	}
+
+	// find the files in the directory by their decrypted names
+	remoteDir = strings.TrimRight(remoteDir, "/")
+	exported := make(map[string]filefreezer.FileInfo)
+	for _, fi := range remoteFiles {
+		remoteName, err := c.DecryptString(fi.FileName)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to decrypt remote file name for file id %d: %w", fi.FileID, err)
+		}
+		if remoteDir != "" && !strings.HasPrefix(remoteName, remoteDir+"/") {
+			continue
+		}
+		if fi.CurrentVersion.LastMod == streamPlaceholderLastMod {
+			continue
+		}
+		exported[remoteName] = fi
+	}
+	names := make([]string, 0, len(exported))
+	for name := range exported {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	count := 0
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		fi := exported[name]
+		archiveName := name[len(remoteDir):]
+		modTime := time.Unix(fi.CurrentVersion.LastMod, 0)
+		mode := os.FileMode(fi.CurrentVersion.Permissions)
+		if fi.IsDir {
+			err = archive.AddDir(archiveName, mode, modTime)
+		} else {
+			err = c.exportFile(ctx, archive, name, archiveName, fi, mode, modTime)
+			count++
+		}
+		if err != nil {
+			return count, fmt.Errorf("Failed to add %s to the archive: %w", name, err)
+		}
+	}
+
+	return count, archive.Close()
+}
+
+// exportFile downloads a file into a temporary file and adds it to the
+// archive as archiveName.
+func (c *Client) exportFile(ctx context.Context, archive filefreezer.ArchiveWriter, remoteName string, archiveName string, fi filefreezer.FileInfo, mode os.FileMode, modTime time.Time) error {
+	tmp, err := ioutil.TempFile("", "freezer-export-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := c.downloadVersion(ctx, remoteName, fi, tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return archive.AddFile(archiveName, size, mode, modTime, tmp)
+}
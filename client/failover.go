@@ -0,0 +1,132 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrPrimaryUnavailable is returned for a change to the server that couldn't
+// be made because the server at HostURI, the primary, can't be reached.
+// Reads fail over to the Mirrors, but changes are only made on the primary,
+// so syncs report the files they couldn't upload as queued for the next
+// sync instead of failing.
+var ErrPrimaryUnavailable = errors.New("the primary server is unavailable")
+
+// failoverCooldown is how long reads go to the Mirrors first after the
+// primary failed to answer one, so that every read doesn't wait for the
+// primary's retries.
+const failoverCooldown = 30 * time.Second
+
+// isUnavailable returns true if the response or error from a request means
+// the server couldn't be reached or can't serve requests right now. A
+// request that was canceled says nothing about the server.
+func isUnavailable(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// discardResponse drains and closes the body of a response that won't be
+// read so that its connection can be reused.
+func discardResponse(resp *http.Response) {
+	if resp != nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// primaryDown returns true if the primary failed recently enough that reads
+// should go to the Mirrors first.
+func (c *Client) primaryDown() bool {
+	c.failoverLock.Lock()
+	defer c.failoverLock.Unlock()
+	return time.Now().Before(c.primaryDownUntil)
+}
+
+// markPrimaryDown records that the primary failed to answer a request.
+func (c *Client) markPrimaryDown(reason string) {
+	c.failoverLock.Lock()
+	defer c.failoverLock.Unlock()
+	if time.Now().After(c.primaryDownUntil) {
+		c.Log.Warnf("The server %s is unavailable (%s); reading from its mirrors for %v.", c.HostURI, reason, failoverCooldown)
+	}
+	c.primaryDownUntil = time.Now().Add(failoverCooldown)
+}
+
+// doFailover sends the request that newRequest makes for target, a URL on
+// the primary, and returns the response along with the URL that answered
+// it. Without Mirrors this is just do. With Mirrors, reads that the primary
+// can't answer are sent to each mirror in turn, and changes that it can't
+// answer fail with ErrPrimaryUnavailable.
+func (c *Client) doFailover(ctx context.Context, client *http.Client, method string, target string, newRequest func(target string) (*http.Request, error)) (*http.Response, string, error) {
+	retry := isIdempotent(method)
+	send := func(target string) (*http.Response, error) {
+		return c.do(ctx, client, retry, func() (*http.Request, error) {
+			return newRequest(target)
+		})
+	}
+	if len(c.Mirrors) == 0 || c.HostURI == "" || !strings.HasPrefix(target, c.HostURI) {
+		resp, err := send(target)
+		return resp, target, err
+	}
+
+	if method != "GET" {
+		resp, err := send(target)
+		if !isUnavailable(ctx, resp, err) {
+			return resp, target, err
+		}
+		if err == nil {
+			err = errors.New(resp.Status)
+			discardResponse(resp)
+		}
+		return nil, target, fmt.Errorf("%w: %v", ErrPrimaryUnavailable, err)
+	}
+
+	// reads try the primary first unless it failed recently, in which case
+	// it's tried last
+	path := strings.TrimPrefix(target, c.HostURI)
+	hosts := append([]string{c.HostURI}, c.Mirrors...)
+	if c.primaryDown() {
+		hosts = append(append([]string(nil), c.Mirrors...), c.HostURI)
+	}
+	var resp *http.Response
+	var err error
+	for i, host := range hosts {
+		if resp != nil {
+			discardResponse(resp)
+		}
+		hostTarget := strings.TrimRight(host, "/") + path
+		resp, err = send(hostTarget)
+		if !isUnavailable(ctx, resp, err) {
+			return resp, hostTarget, err
+		}
+		if host == c.HostURI {
+			reason := fmt.Sprintf("%v", err)
+			if err == nil {
+				reason = resp.Status
+			}
+			c.markPrimaryDown(reason)
+		}
+		if i < len(hosts)-1 {
+			c.Log.Infof("Reading %s from %s instead", path, strings.TrimRight(hosts[i+1], "/"))
+		}
+	}
+	return resp, target, err
+}
@@ -0,0 +1,526 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// GetFileInfoByFilename takes the long way of finding a FileInfo object
+// by scanning all FileInfo objects registered for a given user. If a matching
+// file is found it is returned and the error value will be null; otherwise
+// an error will be set.
+// NOTE: implemented like this to support encrypted filenames.
+func (c *Client) GetFileInfoByFilename(filename string) (foundFile filefreezer.FileInfo, e error) {
+	// get the entire file info list so that we can go through each file info
+	// and find the right one for a given filename.
+	allFileInfos, err := c.GetAllFileHashes()
+	if err != nil {
+		return foundFile, fmt.Errorf("failed to getall of the file hashes: %w", err)
+	}
+
+	// iterate through all of the files
+	for _, fi := range allFileInfos {
+		decryptedFilename, err := c.DecryptString(fi.FileName)
+		if err != nil {
+			return foundFile, err
+		}
+
+		if c.sameName(decryptedFilename, filename) {
+			return fi, nil
+		}
+	}
+
+	return foundFile, fmt.Errorf("could not find the file: %s", filename)
+}
+
+// PutFile registers a new file named remoteFilepath on the server with the
+// file information provided and returns the new FileInfo. The file name is
+// encrypted before it is sent so that the server never sees the plaintext
+// name. merkleRoot is the filefreezer.MerkleRoot of the chunk hashes and can
+// be left empty if it isn't known. The chunks for the file can then be
+// uploaded with PutChunk. The search tokens for the name are sent along so
+// that SearchFiles can find the file. Any parent directories of
+// remoteFilepath that aren't registered yet are registered first. Names the
+// server has denied are refused.
+func (c *Client) PutFile(remoteFilepath string, isDir bool, permissions uint32, lastMod int64, chunkCount int, fileHash string, merkleRoot string) (filefreezer.FileInfo, error) {
+	err := c.checkDeniedName(remoteFilepath)
+	if err != nil {
+		return filefreezer.FileInfo{}, err
+	}
+
+	err = c.putParentDirs(remoteFilepath)
+	if err != nil {
+		return filefreezer.FileInfo{}, err
+	}
+
+	cryptoRemoteName, err := c.EncryptString(remoteFilepath)
+	if err != nil {
+		return filefreezer.FileInfo{}, fmt.Errorf("Could not encrypt the remote file name before uploading: %w", err)
+	}
+	fi, err := c.putFile(cryptoRemoteName, c.putNameKey(remoteFilepath), isDir, permissions, lastMod, chunkCount, fileHash, merkleRoot, c.SearchTokens(remoteFilepath))
+	if err == nil && isDir {
+		c.parentLock.Lock()
+		if c.knownDirs != nil {
+			c.knownDirs[c.foldName(remoteFilepath)] = true
+		}
+		c.parentLock.Unlock()
+	}
+	return fi, err
+}
+
+// implicitDirPermissions are the permissions of the parent directories
+// registered by PutFile.
+const implicitDirPermissions = uint32(os.ModeDir | 0755)
+
+// putParentDirs registers the parent directories of remoteFilepath that
+// aren't registered on the server yet, from the top down, so that a file
+// can be put anywhere without creating each directory first. The file list
+// is only checked when one of the parents isn't known to be registered.
+func (c *Client) putParentDirs(remoteFilepath string) error {
+	parents := parentDirs(remoteFilepath)
+	if len(parents) == 0 {
+		return nil
+	}
+	c.parentLock.Lock()
+	defer c.parentLock.Unlock()
+
+	if c.knownDirs == nil {
+		c.knownDirs = make(map[string]bool)
+	}
+	allKnown := true
+	for _, dir := range parents {
+		if !c.knownDirs[c.foldName(dir)] {
+			allKnown = false
+			break
+		}
+	}
+	if allKnown {
+		return nil
+	}
+
+	allFileInfos, err := c.GetAllFileHashes()
+	if err != nil {
+		return fmt.Errorf("Failed to get the file list: %w", err)
+	}
+	registered := make(map[string]bool, len(allFileInfos))
+	for _, fi := range allFileInfos {
+		name, err := c.DecryptString(fi.FileName)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt one of the file names: %w", err)
+		}
+		registered[c.foldName(name)] = true
+		if fi.IsDir {
+			c.knownDirs[c.foldName(name)] = true
+		}
+	}
+
+	now := time.Now().Unix()
+	for _, dir := range parents {
+		if registered[c.foldName(dir)] {
+			continue
+		}
+		cryptoDirName, err := c.EncryptString(dir)
+		if err != nil {
+			return fmt.Errorf("Could not encrypt the remote directory name before uploading: %w", err)
+		}
+		_, err = c.putFile(cryptoDirName, c.putNameKey(dir), true, implicitDirPermissions, now, 0, "", "", c.SearchTokens(dir))
+		if err != nil {
+			return fmt.Errorf("Failed to register the remote directory %s: %w", dir, err)
+		}
+		c.knownDirs[c.foldName(dir)] = true
+		c.Printf("%s ==> directory created\n", dir)
+	}
+	return nil
+}
+
+// forgetKnownDirs clears the directories putParentDirs knows to be
+// registered, which another client may have removed since.
+func (c *Client) forgetKnownDirs() {
+	c.parentLock.Lock()
+	c.knownDirs = nil
+	c.parentLock.Unlock()
+}
+
+// parentDirs returns the parent directories of the slash separated path
+// from the top down, leaving out the root and any '.' or '..' elements.
+func parentDirs(remoteFilepath string) []string {
+	var dirs []string
+	for i := 1; i < len(remoteFilepath); i++ {
+		if remoteFilepath[i] != '/' || remoteFilepath[i-1] == '/' {
+			continue
+		}
+		dir := remoteFilepath[:i]
+		if base := path.Base(dir); base != "." && base != ".." {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// putFile registers a new file on the server using the file name as given,
+// the name key, which can be empty, and the search tokens, which can be nil,
+// for the file name.
+func (c *Client) putFile(remoteName string, nameKey string, isDir bool, permissions uint32, lastMod int64, chunkCount int, fileHash string, merkleRoot string, searchTokens []string) (filefreezer.FileInfo, error) {
+	var putReq models.FilePutRequest
+	putReq.FileName = remoteName
+	putReq.IsDir = isDir
+	putReq.Permissions = permissions
+	putReq.LastMod = lastMod
+	putReq.ChunkCount = chunkCount
+	putReq.FileHash = fileHash
+	putReq.MerkleRoot = merkleRoot
+	putReq.SearchTokens = searchTokens
+	putReq.Device = c.Device
+	putReq.NameKey = nameKey
+	target := fmt.Sprintf("%s/api/files", c.HostURI)
+	body, err := c.RunAuthRequest(target, "POST", c.AuthToken, putReq)
+	if err != nil {
+		return filefreezer.FileInfo{}, err
+	}
+
+	var putResp models.FilePutResponse
+	err = json.Unmarshal(body, &putResp)
+	if err != nil {
+		return filefreezer.FileInfo{}, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	return putResp.FileInfo, nil
+}
+
+// AddFileVersion tags a new version for the file identified by fileID with
+// the file information provided and returns the updated FileInfo whose
+// current version is the new one. merkleRoot can be left empty if it isn't
+// known. The chunks for the new version can then be uploaded with PutChunk.
+func (c *Client) AddFileVersion(fileID int, permissions uint32, lastMod int64, chunkCount int, fileHash string, merkleRoot string) (filefreezer.FileInfo, error) {
+	return c.AddFileVersionAtRevision(fileID, 0, permissions, lastMod, chunkCount, fileHash, merkleRoot)
+}
+
+// AddFileVersionAtRevision works like AddFileVersion but the new version is
+// only tagged if the file is still at the revision, which is the VersionID of
+// its current version when the caller looked at it. If another client has
+// changed the file since, the error matches filefreezer.ErrRevisionMismatch.
+// A zero revision tags the new version unconditionally.
+func (c *Client) AddFileVersionAtRevision(fileID int, revision int, permissions uint32, lastMod int64, chunkCount int, fileHash string, merkleRoot string) (filefreezer.FileInfo, error) {
+	var postReq models.NewFileVersionRequest
+	postReq.LastMod = lastMod
+	postReq.Permissions = permissions
+	postReq.ChunkCount = chunkCount
+	postReq.FileHash = fileHash
+	postReq.MerkleRoot = merkleRoot
+	postReq.Device = c.Device
+	target := fmt.Sprintf("%s/api/file/%d/version", c.HostURI, fileID)
+	body, err := c.runAuthRequestIfMatch(context.Background(), target, "POST", c.AuthToken, postReq, revision)
+	if err != nil {
+		return filefreezer.FileInfo{}, fmt.Errorf("Failed to tag a new version for the file %d: %w", fileID, err)
+	}
+
+	var postResp models.NewFileVersionResponse
+	err = json.Unmarshal(body, &postResp)
+	if err != nil {
+		return filefreezer.FileInfo{}, fmt.Errorf("Failed to read the response for tagging a new version for the file %d: %w", fileID, err)
+	}
+
+	return postResp.FileInfo, nil
+}
+
+// UpdateFileVersion sets the last modified time, chunk count, whole-file
+// hash and Merkle root of the file version identified by fileID and
+// versionID. It is used to complete a version that was registered before its
+// data was known.
+func (c *Client) UpdateFileVersion(fileID int, versionID int, lastMod int64, chunkCount int, fileHash string, merkleRoot string) error {
+	var putReq models.FileVersionUpdateRequest
+	putReq.LastMod = lastMod
+	putReq.ChunkCount = chunkCount
+	putReq.FileHash = fileHash
+	putReq.MerkleRoot = merkleRoot
+	target := fmt.Sprintf("%s/api/file/%d/version/%d", c.HostURI, fileID, versionID)
+	body, err := c.RunAuthRequest(target, "PUT", c.AuthToken, putReq)
+	if err != nil {
+		return fmt.Errorf("Failed to update the version %d for the file %d: %w", versionID, fileID, err)
+	}
+
+	var putResp models.FileVersionUpdateResponse
+	err = json.Unmarshal(body, &putResp)
+	if err != nil || !putResp.Status {
+		return fmt.Errorf("Failed to update the version %d for the file %d: %v", versionID, fileID, err)
+	}
+	return nil
+}
+
+// RmFile takes the filename and attempts to find it in the list of filenames
+// registered on the storage server for the user. If it does find it, an
+// API method is called to delete the object. If dryRun is set to true
+// the file removal command is never executed. A non-nil error is returned on failure.
+func (c *Client) RmFile(filename string, dryRun bool) error {
+	fi, err := c.GetFileInfoByFilename(filename)
+	if err != nil {
+		return err
+	}
+
+	// the file isn't removed if another client changed it after it was looked up
+	if !dryRun {
+		target := fmt.Sprintf("%s/api/file/%d", c.HostURI, fi.FileID)
+		_, err = c.runAuthRequestIfMatch(context.Background(), target, "DELETE", c.AuthToken, nil, fi.CurrentVersion.VersionID)
+		if err != nil {
+			return fmt.Errorf("Failed to remove the file %s: %w", filename, err)
+		}
+	}
+
+	c.Printf("Removed file: %s\n", filename)
+
+	return nil
+}
+
+// RmRxFiles removes files by regular expression matching against the filenames.
+// The dryRun argument controls whether or not the actual removeal request is
+// sent to the server allowing the user to preview the result of the regex match.
+// A non-nil error is returned on failure.
+func (c *Client) RmRxFiles(pattern string, dryRun bool) error {
+	allFiles, err := c.GetAllFileHashes()
+	if err != nil {
+		return fmt.Errorf("could not get all of the files from the server: %w", err)
+	}
+
+	compiledFilter, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("failed to compile the regular expression: %w", err)
+	}
+
+	for _, fi := range allFiles {
+		plaintextFilename, err := c.DecryptString(fi.FileName)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt one of the file names: %w", err)
+		}
+
+		if compiledFilter.MatchString(plaintextFilename) {
+			// only attempt to actually delete when not on a dryRun
+			if !dryRun {
+				target := fmt.Sprintf("%s/api/file/%d", c.HostURI, fi.FileID)
+				_, err = c.runAuthRequestIfMatch(context.Background(), target, "DELETE", c.AuthToken, nil, fi.CurrentVersion.VersionID)
+				if err != nil {
+					return fmt.Errorf("Failed to remove the file %s: %w", plaintextFilename, err)
+				}
+			}
+
+			c.Printf("Removed file: %s\n", plaintextFilename)
+		}
+	}
+
+	return nil
+}
+
+// RmFileByID takes the file id directly and an API method is called to
+// delete the object. A non-nil error is returned on failure.
+func (c *Client) RmFileByID(fileID int) error {
+	target := fmt.Sprintf("%s/api/file/%d", c.HostURI, fileID)
+	_, err := c.RunAuthRequest(target, "DELETE", c.AuthToken, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to remove the file by file ID (%d): %w", fileID, err)
+	}
+
+	c.Printf("Removed file by ID: %d\n", fileID)
+
+	return nil
+}
+
+// SetFileExpiry sets the time after which the server removes the file with
+// the filename. A zero expiresAt means the file doesn't expire. A non-nil
+// error is returned on failure.
+func (c *Client) SetFileExpiry(filename string, expiresAt time.Time) error {
+	fi, err := c.GetFileInfoByFilename(filename)
+	if err != nil {
+		return err
+	}
+
+	var putReq models.FileExpiryPutRequest
+	if !expiresAt.IsZero() {
+		putReq.ExpiresAt = expiresAt.Unix()
+	}
+	target := fmt.Sprintf("%s/api/file/%d/expiry", c.HostURI, fi.FileID)
+	_, err = c.RunAuthRequest(target, "PUT", c.AuthToken, putReq)
+	if err != nil {
+		return fmt.Errorf("Failed to set the expiry time of the file %s: %w", filename, err)
+	}
+
+	if expiresAt.IsZero() {
+		c.Printf("File no longer expires: %s\n", filename)
+	} else {
+		c.Printf("File expires at %s: %s\n", expiresAt.Local().Format(time.RFC1123), filename)
+	}
+
+	return nil
+}
+
+// GetFileVersions will return a slice of global version IDs and a matching
+// slice of version numbers for the filename provided. A non-nil error is returned on error.
+func (c *Client) GetFileVersions(filename string) (versions []filefreezer.FileVersionInfo, err error) {
+	fi, err := c.GetFileInfoByFilename(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.getFileVersionsByID(fi.FileID)
+}
+
+func (c *Client) getFileVersionsByID(fileID int) ([]filefreezer.FileVersionInfo, error) {
+	r, err := c.getFileVersionsResponse(fileID)
+	if err != nil {
+		return nil, err
+	}
+	return r.Versions, nil
+}
+
+// getFileVersionsResponse returns the versions of the file id along with
+// their stored sizes.
+func (c *Client) getFileVersionsResponse(fileID int) (*models.FileGetAllVersionsResponse, error) {
+	target := fmt.Sprintf("%s/api/file/%d/versions", c.HostURI, fileID)
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the file versions for %s: %w", target, err)
+	}
+
+	var r models.FileGetAllVersionsResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the file versions: %w", err)
+	}
+
+	return &r, nil
+}
+
+// RmFileVersions removes a range of versions (inclusive) from minVersion to
+// maxVersion from storage. A non-nil error is returned on failure.
+func (c *Client) RmFileVersions(filename string, minVersion int, maxVersion int, dryRun bool) error {
+	fi, err := c.GetFileInfoByFilename(filename)
+	if err != nil {
+		return err
+	}
+
+	var putReq models.FileDeleteVersionsRequest
+	putReq.MinVersion = minVersion
+	putReq.MaxVersion = maxVersion
+
+	if maxVersion >= fi.CurrentVersion.VersionNumber {
+		return fmt.Errorf("the maxiumum version number cannot be equal or greater than the current version number")
+	}
+
+	// get the file id for the filename provided
+	if !dryRun {
+		target := fmt.Sprintf("%s/api/file/%d/versions", c.HostURI, fi.FileID)
+		body, err := c.RunAuthRequest(target, "DELETE", c.AuthToken, putReq)
+		if err != nil {
+			return fmt.Errorf("Failed to delete the file versions for %s: %w", target, err)
+		}
+
+		var r models.FileDeleteVersionsResponse
+		err = json.Unmarshal(body, &r)
+		if err != nil {
+			return fmt.Errorf("Failed to delete the file versions: %w", err)
+		}
+
+		if !r.Status {
+			return fmt.Errorf("an unknown error caused a failed status to be returned while deleting file versions")
+		}
+	}
+	return nil
+}
+
+// RmRxFileVersions removes a range of versions (inclusive) from minVersion to
+// maxVersion from storage for all files matching a regexp pattern.
+// A non-nil error is returned on failure.
+func (c *Client) RmRxFileVersions(pattern string, minVersion int, maxVersionStr string, dryRun bool) error {
+	allFiles, err := c.GetAllFileHashes()
+	if err != nil {
+		return fmt.Errorf("could not get all of the files from the server: %w", err)
+	}
+
+	compiledFilter, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("failed to compile the regular expression: %w", err)
+	}
+
+	for _, fi := range allFiles {
+		plaintextFilename, err := c.DecryptString(fi.FileName)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt one of the file names: %w", err)
+		}
+
+		if compiledFilter.MatchString(plaintextFilename) {
+			var maxVersion int
+			if maxVersionStr == "H~" {
+				maxVersion = fi.CurrentVersion.VersionNumber - 1
+			} else {
+				maxVersion, err = strconv.Atoi(maxVersionStr)
+				if err != nil {
+					return fmt.Errorf("failed to parse the supplied max version as a number: %w", err)
+				}
+			}
+
+			// silently ignore any file where the max version is >= the current version.
+			// a case where this applies is regex matching a file with only one version and
+			// supplying "H~" which will then evaluate to 0.
+			if maxVersion >= fi.CurrentVersion.VersionNumber {
+				continue
+			}
+
+			// only attempt to actually delete when not on a dryRun
+			if !dryRun {
+				var putReq models.FileDeleteVersionsRequest
+				putReq.MinVersion = minVersion
+				putReq.MaxVersion = maxVersion
+
+				target := fmt.Sprintf("%s/api/file/%d/versions", c.HostURI, fi.FileID)
+				body, err := c.RunAuthRequest(target, "DELETE", c.AuthToken, putReq)
+				if err != nil {
+					return fmt.Errorf("Failed to delete the file versions for %s: %w", plaintextFilename, err)
+				}
+
+				var r models.FileDeleteVersionsResponse
+				err = json.Unmarshal(body, &r)
+				if err != nil {
+					return fmt.Errorf("Failed to delete the file versions for %s: %w", plaintextFilename, err)
+				}
+
+				if !r.Status {
+					return fmt.Errorf("an unknown error caused a failed status to be returned while deleting file versions")
+				}
+			}
+
+			c.Printf("%s -- successfully removed versions %d to %d.\n", plaintextFilename, minVersion, maxVersion)
+		}
+	}
+
+	return nil
+}
+
+// GetMissingChunksForFile will return a slice of chunk numbers (index starts at zero and
+// is local to the specific file) for a given file located by file ID. A non-nil
+// error is returned on error.
+func (c *Client) GetMissingChunksForFile(fileID int) ([]int, error) {
+	// get the file id for the filename provided
+	target := fmt.Sprintf("%s/api/file/%d", c.HostURI, fileID)
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the file's missing chunk list: %w", err)
+	}
+
+	var r models.FileGetResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the file's missing chunk list: %w", err)
+	}
+
+	return r.MissingChunks, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"sort"
+
+	"github.com/tbogdala/filefreezer"
+)
+
+// FileHistory is the timeline of a remote file's versions together with
+// the tags of the file, as returned by GetFileHistory.
+type FileHistory struct {
+	FileID   int
+	Filename string
+	Tags     []string
+
+	// Versions are ordered from the oldest to the newest.
+	Versions []FileHistoryVersion
+}
+
+// FileHistoryVersion is one version of a file in its history.
+type FileHistoryVersion struct {
+	filefreezer.FileVersionInfo
+
+	// StoredSize is the number of bytes stored in the chunks of the
+	// version, which is the size of the encrypted data; -1 if unknown.
+	StoredSize int64
+
+	// Current is set for the file's current version.
+	Current bool
+}
+
+// GetFileHistory combines the file information, versions, version sizes
+// and tags of the remote file filename into one timeline of its versions.
+func (c *Client) GetFileHistory(filename string) (*FileHistory, error) {
+	fi, err := c.GetFileInfoByFilename(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := c.getFileVersionsResponse(fi.FileID)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := c.getFileTagsByID(fi.FileID, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	history := &FileHistory{
+		FileID:   fi.FileID,
+		Filename: filename,
+		Tags:     tags,
+		Versions: make([]FileHistoryVersion, 0, len(r.Versions)),
+	}
+	for _, v := range r.Versions {
+		size, found := r.StoredSizes[v.VersionID]
+		if !found {
+			size = -1
+		}
+		history.Versions = append(history.Versions, FileHistoryVersion{
+			FileVersionInfo: v,
+			StoredSize:      size,
+			Current:         v.VersionID == fi.CurrentVersion.VersionID,
+		})
+	}
+	sort.Slice(history.Versions, func(i, j int) bool {
+		return history.Versions[i].VersionNumber < history.Versions[j].VersionNumber
+	})
+	return history, nil
+}
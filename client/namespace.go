@@ -0,0 +1,72 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// GetNamespaces returns the namespaces of the account. The client must be
+// logged in to the account itself rather than one of its namespaces.
+func (c *Client) GetNamespaces() ([]filefreezer.Namespace, error) {
+	target := fmt.Sprintf("%s/api/namespaces", c.HostURI)
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the namespaces: %w", err)
+	}
+
+	var r models.NamespacesGetResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	return r.Namespaces, nil
+}
+
+// AddNamespace adds the namespace to the account. Setting Namespace to its
+// name before logging in then syncs files with the namespace.
+func (c *Client) AddNamespace(name string) (*filefreezer.Namespace, error) {
+	target := fmt.Sprintf("%s/api/namespaces", c.HostURI)
+	body, err := c.RunAuthRequest(target, "POST", c.AuthToken, models.NamespaceAddRequest{Name: name})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to add the namespace %s: %w", name, err)
+	}
+
+	var r models.NamespaceAddResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	c.Printf("Added namespace: %s\n", name)
+	return &r.Namespace, nil
+}
+
+// RemoveNamespace removes the namespace and all of its files from the
+// account.
+func (c *Client) RemoveNamespace(name string) error {
+	target := fmt.Sprintf("%s/api/namespace/%s", c.HostURI, url.PathEscape(name))
+	body, err := c.RunAuthRequest(target, "DELETE", c.AuthToken, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to remove the namespace %s: %w", name, err)
+	}
+
+	var r models.NamespaceRmResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+	if !r.Status {
+		return fmt.Errorf("an unknown error occurred while removing the namespace %s", name)
+	}
+
+	c.Printf("Removed namespace: %s\n", name)
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// SetFileNote attaches the note to the file with the filename, replacing
+// any note it already had. The note is encrypted before it is sent so that
+// the server never sees the plaintext. An empty note removes the note.
+func (c *Client) SetFileNote(filename string, note string) error {
+	fi, err := c.GetFileInfoByFilename(filename)
+	if err != nil {
+		return err
+	}
+
+	err = c.setFileNoteByID(fi.FileID, note)
+	if err != nil {
+		return fmt.Errorf("Failed to set the note of the file %s: %w", filename, err)
+	}
+
+	if note == "" {
+		c.Printf("Removed the note from file: %s\n", filename)
+	} else {
+		c.Printf("Set the note of file: %s\n", filename)
+	}
+
+	return nil
+}
+
+func (c *Client) setFileNoteByID(fileID int, note string) error {
+	var putReq models.FileNotePutRequest
+	if note != "" {
+		var err error
+		putReq.Note, err = c.EncryptString(note)
+		if err != nil {
+			return fmt.Errorf("Could not encrypt the note before uploading: %w", err)
+		}
+	}
+	target := fmt.Sprintf("%s/api/file/%d/note", c.HostURI, fileID)
+	_, err := c.RunAuthRequest(target, "PUT", c.AuthToken, putReq)
+	return err
+}
+
+// GetFileNote returns the decrypted note attached to the file with the
+// filename or an empty string if it doesn't have one.
+func (c *Client) GetFileNote(filename string) (string, error) {
+	fi, err := c.GetFileInfoByFilename(filename)
+	if err != nil {
+		return "", err
+	}
+
+	target := fmt.Sprintf("%s/api/file/%d/note", c.HostURI, fi.FileID)
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get the note of the file %s: %w", filename, err)
+	}
+
+	var r models.FileNoteResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return "", fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+	if r.Note == "" {
+		return "", nil
+	}
+
+	note, err := c.DecryptString(r.Note)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt the note: %w", err)
+	}
+	return note, nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// RemotePath returns the remote file name to use for the local path. Remote
+// names always use forward slashes so that a file synced from one OS is
+// found from another; on Windows the local path is converted with
+// WindowsRemotePath and elsewhere it's returned unchanged.
+func RemotePath(localPath string) string {
+	if filepath.Separator != '\\' {
+		return localPath
+	}
+	return WindowsRemotePath(localPath)
+}
+
+// WindowsRemotePath converts a Windows path to the form used for remote file
+// names. The long path prefix (\\?\) is dropped, backslashes become forward
+// slashes and a drive letter becomes the first directory in lower case, so
+// C:\Users\me\a.txt is stored as /c/Users/me/a.txt and a UNC path such as
+// \\server\share\a.txt as //server/share/a.txt.
+func WindowsRemotePath(localPath string) string {
+	p := localPath
+	if strings.HasPrefix(p, `\\?\UNC\`) {
+		p = `\\` + p[len(`\\?\UNC\`):]
+	} else if strings.HasPrefix(p, `\\?\`) {
+		p = p[len(`\\?\`):]
+	}
+	p = strings.Replace(p, `\`, "/", -1)
+
+	if len(p) >= 2 && p[1] == ':' && isDriveLetter(p[0]) {
+		rest := p[2:]
+		if !strings.HasPrefix(rest, "/") {
+			rest = "/" + rest
+		}
+		p = "/" + strings.ToLower(p[:1]) + strings.TrimSuffix(rest, "/")
+	}
+	return p
+}
+
+// isDriveLetter returns true if b can be a Windows drive letter.
+func isDriveLetter(b byte) bool {
+	return ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z')
+}
@@ -0,0 +1,498 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/mdns"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+const (
+	// PeerServiceName is the mDNS service that clients serving chunks on
+	// the LAN announce themselves as.
+	PeerServiceName = "_freezer-peer._tcp"
+
+	// peerAccountField is the TXT record field holding the account tag.
+	peerAccountField = "account="
+
+	// peerTimeout limits each request to a peer so that an unreachable peer
+	// doesn't hold up a download for long.
+	peerTimeout = 10 * time.Second
+
+	// peerTokenMargin is how long before its expiry a peer token is renewed.
+	peerTokenMargin = time.Minute
+)
+
+// errPeerChunkNotFound is returned by a peer that doesn't have the chunk.
+var errPeerChunkNotFound = errors.New("the peer doesn't have the chunk")
+
+// PeerServer serves the chunks of the files in a local directory to the
+// other clients of the same user on the LAN so that a file synced by one
+// client doesn't have to be downloaded from the server again by the others.
+//
+// Chunks are looked up by their hash and sent encrypted with the user's
+// cipher, the same way they're stored on the server, to clients presenting
+// a peer token that the server confirms was issued to the same user for
+// this peer. Tokens are bound to the host and port the client connects to,
+// which must be an address of this machine, so a token sent to another
+// host announcing the user's account tag can't be replayed here.
+type PeerServer struct {
+	c        *Client
+	listener net.Listener
+	server   *http.Server
+	mdns     *mdns.Server
+
+	lock     sync.RWMutex
+	chunks   map[string]peerChunk
+	verified map[string]models.PeerVerifyResponse
+
+	served int64
+}
+
+// peerChunk locates a chunk in a local file.
+type peerChunk struct {
+	filename string
+	offset   int64
+	size     int
+}
+
+// ServePeers indexes the chunks of the files in localDir and serves them to
+// the other clients of the user on listenAddr, such as ":7171". If announce
+// is set, the server is announced on the LAN with mDNS so that DiscoverPeers
+// finds it. Close must be called to stop the server.
+func (c *Client) ServePeers(localDir string, listenAddr string, announce bool) (*PeerServer, error) {
+	// getting a token checks that the server supports peers and returns
+	// the account tag to announce
+	token, err := c.getPeerToken("")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &PeerServer{c: c, verified: make(map[string]models.PeerVerifyResponse)}
+	if err = p.Index(localDir); err != nil {
+		return nil, err
+	}
+
+	p.listener, err = net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen for peers on %s: %w", listenAddr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chunk/", p.handleChunk)
+	p.server = &http.Server{Handler: mux}
+	go p.server.Serve(p.listener)
+
+	if announce {
+		if err = p.announce(token.AccountTag); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// announce registers the server with mDNS under the account tag.
+func (p *PeerServer) announce(accountTag string) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("Failed to get the hostname to announce: %w", err)
+	}
+	port := p.listener.Addr().(*net.TCPAddr).Port
+	instance := fmt.Sprintf("%s-%d", hostname, port)
+	service, err := mdns.NewMDNSService(instance, PeerServiceName, "", "", port, nil, []string{peerAccountField + accountTag})
+	if err != nil {
+		return fmt.Errorf("Failed to create the mDNS service: %w", err)
+	}
+	p.mdns, err = mdns.NewServer(&mdns.Config{Zone: service})
+	if err != nil {
+		return fmt.Errorf("Failed to start the mDNS server: %w", err)
+	}
+	return nil
+}
+
+// URL returns the base URL of the server on the local host.
+func (p *PeerServer) URL() string {
+	return "http://" + p.listener.Addr().String()
+}
+
+// Served returns the number of chunks sent to peers.
+func (p *PeerServer) Served() int {
+	return int(atomic.LoadInt64(&p.served))
+}
+
+// Close stops announcing and serving chunks.
+func (p *PeerServer) Close() error {
+	if p.mdns != nil {
+		p.mdns.Shutdown()
+	}
+	return p.server.Close()
+}
+
+// Login logs the client in again to renew its authentication token, which
+// the server checks peer tokens with. A server running for longer than
+// the server's token lifetime has to call it periodically.
+func (p *PeerServer) Login(hostURI, username, password string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.c.Login(hostURI, username, password)
+}
+
+// Index replaces the chunks served with the chunks of the regular files in
+// localDir and its subdirectories. It should be called again after the
+// files change, such as after syncing the directory.
+func (p *PeerServer) Index(localDir string) error {
+	chunkSize := p.c.ServerCapabilities.ChunkSize
+	if chunkSize <= 0 {
+		return fmt.Errorf("The server's chunk size isn't known; log in before serving peers")
+	}
+
+	chunks := make(map[string]peerChunk)
+	err := filepath.Walk(localDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		chunkCount := int((info.Size() + chunkSize - 1) / chunkSize)
+		return forEachChunk(int(chunkSize), path, chunkCount, func(i int, chunk []byte) (bool, error) {
+			chunks[hashChunk(chunk)] = peerChunk{filename: path, offset: int64(i) * chunkSize, size: len(chunk)}
+			return true, nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to index the chunks in %s: %w", localDir, err)
+	}
+
+	p.lock.Lock()
+	p.chunks = chunks
+	p.lock.Unlock()
+	return nil
+}
+
+// handleChunk handles GET /chunk/{hash} by sending the encrypted chunk with
+// the hash to a peer of the same user that connected to this server.
+func (p *PeerServer) handleChunk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Only GET is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !p.isOwnAddress(r.Host) || !p.authorized(token, r.Host) {
+		http.Error(w, "The peer token is not valid.", http.StatusForbidden)
+		return
+	}
+
+	hash := strings.TrimPrefix(r.URL.Path, "/chunk/")
+	chunk, err := p.readChunk(hash)
+	if err != nil {
+		http.Error(w, "The chunk was not found.", http.StatusNotFound)
+		return
+	}
+	cryptoBytes, err := p.c.encryptBytes(chunk)
+	if err != nil {
+		http.Error(w, "Failed to encrypt the chunk.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(cryptoBytes)))
+	w.Write(cryptoBytes)
+	atomic.AddInt64(&p.served, 1)
+}
+
+// isOwnAddress returns true if hostPort, the host and port a peer connected
+// to, names this server: the port must be the one it listens on and the
+// host must be, or resolve to, an address of this machine.
+func (p *PeerServer) isOwnAddress(hostPort string) bool {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil || port != strconv.Itoa(p.listener.Addr().(*net.TCPAddr).Port) {
+		return false
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		for _, ip := range ips {
+			if ipNet.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authorized returns true if the server confirms that the peer token was
+// issued to the same user for the audience, which is the host and port the
+// peer connected to. Confirmed tokens are remembered until they expire.
+func (p *PeerServer) authorized(token string, audience string) bool {
+	if token == "" || audience == "" {
+		return false
+	}
+	now := time.Now().Unix()
+	p.lock.RLock()
+	verified, found := p.verified[token]
+	p.lock.RUnlock()
+	if found && now < verified.ExpiresAt {
+		return verified.Audience == audience
+	}
+
+	p.lock.RLock()
+	target := fmt.Sprintf("%s/api/peer/verify", p.c.HostURI)
+	authToken := p.c.AuthToken
+	p.lock.RUnlock()
+	body, err := p.c.RunAuthRequest(target, "POST", authToken, &models.PeerVerifyRequest{Token: token})
+	if err != nil {
+		p.c.Log.Warnf("Refused a peer chunk request: %v", err)
+		return false
+	}
+	var resp models.PeerVerifyResponse
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return false
+	}
+
+	p.lock.Lock()
+	for t, v := range p.verified {
+		if now >= v.ExpiresAt {
+			delete(p.verified, t)
+		}
+	}
+	p.verified[token] = resp
+	p.lock.Unlock()
+	if resp.Audience != audience {
+		p.c.Log.Warnf("Refused a peer chunk request with a token issued for %q", resp.Audience)
+		return false
+	}
+	return now < resp.ExpiresAt
+}
+
+// readChunk reads the chunk with the hash from the local file it was indexed
+// in, making sure the file hasn't changed since.
+func (p *PeerServer) readChunk(hash string) ([]byte, error) {
+	p.lock.RLock()
+	loc, found := p.chunks[hash]
+	p.lock.RUnlock()
+	if !found {
+		return nil, errPeerChunkNotFound
+	}
+
+	f, err := os.Open(loc.filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	chunk := make([]byte, loc.size)
+	if _, err = f.ReadAt(chunk, loc.offset); err != nil {
+		return nil, err
+	}
+	if hashChunk(chunk) != hash {
+		return nil, errPeerChunkNotFound
+	}
+	return chunk, nil
+}
+
+// DiscoverPeers looks for the other clients of the user serving chunks on
+// the LAN for up to timeout and returns their base URLs, which can be used
+// as Peers.
+func (c *Client) DiscoverPeers(timeout time.Duration) ([]string, error) {
+	token, err := c.getPeerToken("")
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(chan *mdns.ServiceEntry, 16)
+	var peers []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for entry := range entries {
+			if !peerEntryMatches(entry, token.AccountTag) || entry.AddrV4 == nil {
+				continue
+			}
+			peer := "http://" + net.JoinHostPort(entry.AddrV4.String(), strconv.Itoa(entry.Port))
+			if !containsString(peers, peer) {
+				peers = append(peers, peer)
+			}
+		}
+	}()
+
+	err = mdns.Query(&mdns.QueryParam{
+		Service:     PeerServiceName,
+		Timeout:     timeout,
+		Entries:     entries,
+		DisableIPv6: true,
+	})
+	close(entries)
+	<-done
+	if err != nil {
+		return nil, fmt.Errorf("Failed to look for peers on the LAN: %w", err)
+	}
+	return peers, nil
+}
+
+// peerEntryMatches returns true if the announcement is for the account tag.
+func peerEntryMatches(entry *mdns.ServiceEntry, accountTag string) bool {
+	for _, field := range entry.InfoFields {
+		if field == peerAccountField+accountTag {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// peerAudience returns the audience of the peer tokens presented to the
+// peer with the base URL, which is the host and port it's reached at.
+func peerAudience(peer string) string {
+	u, err := url.Parse(peer)
+	if err != nil {
+		return peer
+	}
+	return u.Host
+}
+
+// getPeerToken returns the cached peer token for the audience, getting a
+// new one from the server if it's missing or about to expire. A token for
+// an empty audience isn't accepted by any peer but carries the account tag.
+func (c *Client) getPeerToken(audience string) (models.PeerTokenResponse, error) {
+	c.peerLock.Lock()
+	defer c.peerLock.Unlock()
+	cached := c.peerTokens[audience]
+	if cached.Token != "" && time.Now().Add(peerTokenMargin).Unix() < cached.ExpiresAt {
+		return cached, nil
+	}
+
+	target := fmt.Sprintf("%s/api/peer/token", c.HostURI)
+	body, err := c.RunAuthRequest(target, "POST", c.AuthToken, &models.PeerTokenRequest{Audience: audience})
+	if err != nil {
+		return models.PeerTokenResponse{}, fmt.Errorf("Failed to get a peer token: %w", err)
+	}
+	var token models.PeerTokenResponse
+	if err = json.Unmarshal(body, &token); err != nil {
+		return models.PeerTokenResponse{}, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+	if c.peerTokens == nil {
+		c.peerTokens = make(map[string]models.PeerTokenResponse)
+	}
+	c.peerTokens[audience] = token
+	return token, nil
+}
+
+// getPeerChunk tries to download the chunk with the hash from each of the
+// peers and returns the decrypted chunk data from the first one that has
+// it. The data is checked against the hash so a peer can't substitute a
+// different chunk. Each peer is sent a token issued for it alone. Peers
+// that can't be reached are dropped from Peers.
+func (c *Client) getPeerChunk(hash string) ([]byte, bool) {
+	c.peerLock.Lock()
+	peers := append([]string(nil), c.Peers...)
+	c.peerLock.Unlock()
+
+	client := &http.Client{Timeout: peerTimeout}
+	var unreachable []string
+	var chunk []byte
+	for _, peer := range peers {
+		token, err := c.getPeerToken(peerAudience(peer))
+		if err != nil {
+			c.Log.Warnf("Not using peers: %v", err)
+			c.peerLock.Lock()
+			c.Peers = nil
+			c.peerLock.Unlock()
+			return nil, false
+		}
+		data, err := c.fetchPeerChunk(client, peer, token.Token, hash)
+		if err != nil && err != errPeerChunkNotFound {
+			c.Log.Warnf("Not using peer %s: %v", peer, err)
+			unreachable = append(unreachable, peer)
+			continue
+		}
+		if data != nil {
+			chunk = data
+			break
+		}
+	}
+
+	// drop the unreachable peers, which other files being synced at the
+	// same time may have done already
+	if len(unreachable) > 0 {
+		c.peerLock.Lock()
+		reachable := c.Peers[:0]
+		for _, peer := range c.Peers {
+			if !containsString(unreachable, peer) {
+				reachable = append(reachable, peer)
+			}
+		}
+		c.Peers = reachable
+		c.peerLock.Unlock()
+	}
+	return chunk, chunk != nil
+}
+
+// hasPeers returns true if there are any peers left to download chunks from.
+func (c *Client) hasPeers() bool {
+	c.peerLock.Lock()
+	defer c.peerLock.Unlock()
+	return len(c.Peers) > 0
+}
+
+// fetchPeerChunk downloads the chunk with the hash from a peer and returns
+// the decrypted chunk data.
+func (c *Client) fetchPeerChunk(client *http.Client, peer string, token string, hash string) ([]byte, error) {
+	req, err := newAuthRequest(strings.TrimRight(peer, "/")+"/chunk/"+hash, "GET", token, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, errPeerChunkNotFound
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	chunk, err := c.decryptChunk(body)
+	if err != nil || hashChunk(chunk) != hash {
+		return nil, fmt.Errorf("the chunk sent doesn't match the hash %s", hash)
+	}
+	return chunk, nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"fmt"
+	"time"
+)
+
+// The actions a sync can take for a file, as reported in FileReport.Action.
+const (
+	SyncActionUploaded   = "uploaded"   // the local file was sent to the server
+	SyncActionDownloaded = "downloaded" // the remote file was written locally
+	SyncActionUnchanged  = "unchanged"  // the local and remote files are the same
+	SyncActionSkipped    = "skipped"    // the local file type can't be synced
+	SyncActionFailed     = "failed"     // the sync returned an error
+	SyncActionQueued     = "queued"     // the primary server was unavailable to upload to; left for the next sync
+	SyncActionDeleted    = "deleted"    // the file was removed on the other side since the last sync
+)
+
+// FileReport describes the result of syncing one file.
+type FileReport struct {
+	// LocalFilename is the path of the local file.
+	LocalFilename string
+
+	// RemoteFilepath is the name of the file on the server.
+	RemoteFilepath string
+
+	// Status is the SyncStatus value describing what the sync found.
+	Status int
+
+	// Action is the SyncAction value describing what the sync did.
+	Action string
+
+	// Chunks is the number of chunks transferred.
+	Chunks int
+
+	// Bytes is the number of bytes of file data transferred.
+	Bytes int64
+
+	// PeerChunks is the number of the transferred chunks that were
+	// downloaded from other clients on the LAN instead of the server.
+	PeerChunks int
+
+	// CachedChunks is the number of the chunks that were read from the
+	// local chunk cache instead of being downloaded; they aren't counted
+	// in Chunks.
+	CachedChunks int
+
+	// CopiedChunks is the number of chunks the server copied from an
+	// identical file the user already has instead of them being uploaded;
+	// they aren't counted in Chunks.
+	CopiedChunks int
+
+	// Duration is how long the sync of the file took.
+	Duration time.Duration
+
+	// Conflict is true if both the local and remote file had changed in a
+	// way that couldn't be ordered by modification time, or had both
+	// changed since the revision recorded in Client.Revisions. The local
+	// file is uploaded as the newer version in that case.
+	Conflict bool
+
+	// Err is the error that stopped the sync; nil on success.
+	Err error
+
+	// fileID is the id of the remote file once it's known.
+	fileID int
+
+	// synced is the revision of the remote file the local file matches
+	// once the sync finishes, recorded in Client.Revisions; zero if the
+	// sync doesn't tell.
+	synced syncRevision
+
+	// state is the progress of the SyncDirectory call syncing the file,
+	// if it's recorded.
+	state *syncState
+}
+
+// actionForStatus returns the SyncAction value for a successful sync that
+// finished with the SyncStatus value.
+func actionForStatus(status int) string {
+	switch status {
+	case SyncStatusLocalNewer, SyncStatusMissing:
+		return SyncActionUploaded
+	case SyncStatusRemoteNewer:
+		return SyncActionDownloaded
+	case SyncStatusUnsupportedFileType:
+		return SyncActionSkipped
+	}
+	return SyncActionUnchanged
+}
+
+// SyncReport describes the result of syncing a set of files.
+type SyncReport struct {
+	// Files has a report for each file synced, in the order they were synced.
+	Files []FileReport
+
+	// Duration is how long the whole sync took.
+	Duration time.Duration
+}
+
+// ChangeCount returns the total number of chunks transferred.
+func (r *SyncReport) ChangeCount() int {
+	count := 0
+	for _, f := range r.Files {
+		count += f.Chunks
+	}
+	return count
+}
+
+// BytesTransferred returns the total number of bytes of file data transferred.
+func (r *SyncReport) BytesTransferred() int64 {
+	var total int64
+	for _, f := range r.Files {
+		total += f.Bytes
+	}
+	return total
+}
+
+// CachedCount returns the total number of chunks read from the chunk cache.
+func (r *SyncReport) CachedCount() int {
+	count := 0
+	for _, f := range r.Files {
+		count += f.CachedChunks
+	}
+	return count
+}
+
+// Count returns the number of files that the SyncAction value was taken for.
+func (r *SyncReport) Count(action string) int {
+	count := 0
+	for _, f := range r.Files {
+		if f.Action == action {
+			count++
+		}
+	}
+	return count
+}
+
+// Conflicts returns the number of files that had conflicting changes.
+func (r *SyncReport) Conflicts() int {
+	count := 0
+	for _, f := range r.Files {
+		if f.Conflict {
+			count++
+		}
+	}
+	return count
+}
+
+// Summary returns a one line summary of the report.
+func (r *SyncReport) Summary() string {
+	summary := fmt.Sprintf("%d uploaded, %d downloaded, %d unchanged, %d skipped, %d failed, %d conflicts; "+
+		"%d chunks (%d bytes) transferred in %v",
+		r.Count(SyncActionUploaded), r.Count(SyncActionDownloaded), r.Count(SyncActionUnchanged),
+		r.Count(SyncActionSkipped), r.Count(SyncActionFailed), r.Conflicts(),
+		r.ChangeCount(), r.BytesTransferred(), r.Duration)
+	if cached := r.CachedCount(); cached > 0 {
+		summary += fmt.Sprintf("; %d chunks read from the cache", cached)
+	}
+	if queued := r.Count(SyncActionQueued); queued > 0 {
+		summary += fmt.Sprintf("; %d files queued for the primary server", queued)
+	}
+	if deleted := r.Count(SyncActionDeleted); deleted > 0 {
+		summary += fmt.Sprintf("; %d files deleted", deleted)
+	}
+	return summary
+}
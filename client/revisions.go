@@ -0,0 +1,137 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SyncRevisions remembers, for each local file, the revision of the remote
+// file it was last synced with and the hash the two had in common then. A
+// revision is the id of the file's current version, which the server only
+// ever increases, so comparing the revisions and hashes with the ones
+// remembered tells which side changed since the last sync without trusting
+// the modification times of machines whose clocks may disagree. The
+// revisions are kept in a JSON file that Save writes. A SyncRevisions is safe
+// to use from multiple goroutines.
+type SyncRevisions struct {
+	lock     sync.Mutex
+	filename string
+	dirty    bool
+	files    map[string]syncRevision
+}
+
+// syncRevision is the remote file and revision a local file was last synced
+// with and the file hash both had at the time.
+type syncRevision struct {
+	FileID   int
+	Revision int
+	Hash     string
+}
+
+// OpenSyncRevisions loads the revisions kept in filename. The file is
+// created by Save if it doesn't exist yet.
+func OpenSyncRevisions(filename string) (*SyncRevisions, error) {
+	r := &SyncRevisions{filename: filename, files: make(map[string]syncRevision)}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read the sync revisions file %s: %w", filename, err)
+	}
+	err = json.Unmarshal(data, &r.files)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the sync revisions file %s: %w", filename, err)
+	}
+	return r, nil
+}
+
+// revisionKey returns the key of the local file synced with hostURI. The
+// file ids of a server are unique across its users and namespaces, so the
+// host and local path are enough to tell the syncs apart.
+func revisionKey(hostURI string, localFilename string) string {
+	if abs, err := filepath.Abs(localFilename); err == nil {
+		localFilename = abs
+	}
+	return hostURI + " " + localFilename
+}
+
+// get returns the revision the local file was last synced with on hostURI.
+func (r *SyncRevisions) get(hostURI string, localFilename string) (syncRevision, bool) {
+	if r == nil {
+		return syncRevision{}, false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rev, found := r.files[revisionKey(hostURI, localFilename)]
+	return rev, found
+}
+
+// set remembers the revision the local file was just synced with on hostURI.
+func (r *SyncRevisions) set(hostURI string, localFilename string, rev syncRevision) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key := revisionKey(hostURI, localFilename)
+	if old, found := r.files[key]; !found || old != rev {
+		r.files[key] = rev
+		r.dirty = true
+	}
+}
+
+// forget drops the revision of the local file, such as once a sync has
+// removed it, so that a new file at the same path isn't taken for it.
+func (r *SyncRevisions) forget(hostURI string, localFilename string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key := revisionKey(hostURI, localFilename)
+	if _, found := r.files[key]; found {
+		delete(r.files, key)
+		r.dirty = true
+	}
+}
+
+// Save writes the revisions to their file if they changed since they were
+// loaded or last saved. The file is replaced atomically so that a crash
+// can't leave it half written.
+func (r *SyncRevisions) Save() error {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(r.files)
+	if err != nil {
+		return fmt.Errorf("Failed to serialize the sync revisions: %w", err)
+	}
+	err = os.MkdirAll(filepath.Dir(r.filename), 0700)
+	if err != nil {
+		return fmt.Errorf("Failed to create the directory of the sync revisions file %s: %w", r.filename, err)
+	}
+	tempFilename := r.filename + ".tmp"
+	err = ioutil.WriteFile(tempFilename, data, 0600)
+	if err == nil {
+		err = os.Rename(tempFilename, r.filename)
+	}
+	if err != nil {
+		os.Remove(tempFilename)
+		return fmt.Errorf("Failed to write the sync revisions file %s: %w", r.filename, err)
+	}
+	r.dirty = false
+	return nil
+}
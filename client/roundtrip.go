@@ -0,0 +1,86 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/tbogdala/filefreezer"
+)
+
+const (
+	// roundTripChunkSize is the number of random bytes uploaded by ChunkRoundTrip.
+	roundTripChunkSize = 1024
+)
+
+// ChunkRoundTrip registers a small temporary file on the server, uploads a chunk
+// of random data for it, downloads the chunk again and verifies that the data
+// is unchanged. The temporary file is removed afterwards even if the round
+// trip fails. The file name and chunk are encrypted if a cipher or crypto key is set.
+func (c *Client) ChunkRoundTrip() (e error) {
+	chunk := make([]byte, roundTripChunkSize)
+	_, err := rand.Read(chunk)
+	if err != nil {
+		return fmt.Errorf("Failed to generate the random chunk data: %w", err)
+	}
+	chunkHash := hashChunk(chunk)
+
+	remoteName := fmt.Sprintf(".freezer-doctor-%d", time.Now().UnixNano())
+	sentChunk := chunk
+	if c.hasCipher() {
+		remoteName, err = c.EncryptString(remoteName)
+		if err != nil {
+			return fmt.Errorf("Failed to encrypt the file name: %w", err)
+		}
+		sentChunk, err = c.encryptBytes(chunk)
+		if err != nil {
+			return fmt.Errorf("Failed to encrypt the chunk: %w", err)
+		}
+	}
+
+	// register the temporary file
+	merkleRoot, err := filefreezer.MerkleRoot([]string{chunkHash})
+	if err != nil {
+		return err
+	}
+	fi, err := c.putFile(remoteName, "", false, 0600, time.Now().Unix(), 1, chunkHash, merkleRoot, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to register the temporary file: %w", err)
+	}
+
+	// always clean up the temporary file
+	defer func() {
+		target := fmt.Sprintf("%s/api/file/%d", c.HostURI, fi.FileID)
+		_, err := c.RunAuthRequest(target, "DELETE", c.AuthToken, nil)
+		if err != nil && e == nil {
+			e = fmt.Errorf("Failed to remove the temporary file (%d): %w", fi.FileID, err)
+		}
+	}()
+
+	versionID := fi.CurrentVersion.VersionID
+	err = c.putChunk(context.Background(), fi.FileID, versionID, 0, chunkHash, sentChunk)
+	if err != nil {
+		return fmt.Errorf("Failed to upload the chunk: %w", err)
+	}
+
+	receivedChunk, err := c.getChunk(context.Background(), fi.FileID, versionID, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to download the chunk: %w", err)
+	}
+	if c.hasCipher() {
+		receivedChunk, err = c.decryptBytes(receivedChunk)
+		if err != nil {
+			return fmt.Errorf("Failed to decrypt the downloaded chunk: %w", err)
+		}
+	}
+	if !bytes.Equal(chunk, receivedChunk) {
+		return fmt.Errorf("The downloaded chunk (%d bytes) does not match the uploaded chunk (%d bytes)", len(receivedChunk), len(chunk))
+	}
+
+	return nil
+}
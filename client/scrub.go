@@ -0,0 +1,304 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/tbogdala/filefreezer"
+)
+
+// ScrubFile describes what a scrub found for the current version of one
+// remote file.
+type ScrubFile struct {
+	// RemoteFilepath is the name of the file on the server.
+	RemoteFilepath string
+
+	// FileID and VersionID identify the file version that was checked.
+	FileID    int
+	VersionID int
+
+	// ChunksChecked is the number of chunks that were downloaded and
+	// checked against their hashes.
+	ChunksChecked int
+
+	// DamagedChunks has the numbers of the chunks that are missing, have
+	// no hash or didn't match their hash when they were downloaded.
+	DamagedChunks []int
+
+	// Problems describes each inconsistency found; empty if the file
+	// version is intact.
+	Problems []string
+}
+
+// NeedsUpload returns true if the file has to be uploaded again to repair
+// the problems found.
+func (f *ScrubFile) NeedsUpload() bool {
+	return len(f.Problems) > 0
+}
+
+// ScrubReport describes the result of scrubbing a set of remote files.
+type ScrubReport struct {
+	// Files has a report for each file scrubbed, ordered by name.
+	Files []ScrubFile
+}
+
+// NeedsUpload returns the reports of the files that have to be uploaded
+// again.
+func (r *ScrubReport) NeedsUpload() []ScrubFile {
+	var damaged []ScrubFile
+	for _, f := range r.Files {
+		if f.NeedsUpload() {
+			damaged = append(damaged, f)
+		}
+	}
+	return damaged
+}
+
+// Scrub checks the current version of each remote file named target, or in
+// the remote directory target and its subdirectories, for consistency. An
+// empty target scrubs every file. The chunk list of every file is checked
+// against the chunk count of the file version. The sample most chunks of
+// each file are also downloaded and checked against their hashes; if full is
+// set, every chunk is downloaded and the whole file is checked against the
+// file hash as well. Files that are still being uploaded are left out.
+func (c *Client) Scrub(ctx context.Context, target string, sample int, full bool) (*ScrubReport, error) {
+	remoteFiles, err := c.GetAllFileHashes()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get a list of remote files: %w", err)
+	}
+
+	// find the files by their decrypted names
+	target = strings.TrimRight(target, "/")
+	scrubbed := make(map[string]filefreezer.FileInfo)
+	for _, fi := range remoteFiles {
+		remoteName, err := c.DecryptString(fi.FileName)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decrypt remote file name for file id %d: %w", fi.FileID, err)
+		}
+		if target != "" && remoteName != target && !strings.HasPrefix(remoteName, target+"/") {
+			continue
+		}
+		if fi.IsDir || fi.CurrentVersion.LastMod == streamPlaceholderLastMod {
+			continue
+		}
+		scrubbed[remoteName] = fi
+	}
+	names := make([]string, 0, len(scrubbed))
+	for name := range scrubbed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	report := new(ScrubReport)
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		f, err := c.scrubFile(ctx, name, scrubbed[name], sample, full)
+		if err != nil {
+			return report, fmt.Errorf("Failed to scrub %s: %w", name, err)
+		}
+		report.Files = append(report.Files, f)
+	}
+
+	return report, nil
+}
+
+// scrubFile checks the current version of one remote file. Errors talking
+// to the server are returned; the inconsistencies found are in the report.
+func (c *Client) scrubFile(ctx context.Context, remoteName string, fi filefreezer.FileInfo, sample int, full bool) (ScrubFile, error) {
+	f := ScrubFile{
+		RemoteFilepath: remoteName,
+		FileID:         fi.FileID,
+		VersionID:      fi.CurrentVersion.VersionID,
+	}
+	chunkCount := fi.CurrentVersion.ChunkCount
+
+	chunks, err := c.GetFileChunks(fi.FileID, fi.CurrentVersion.VersionID)
+	if err != nil {
+		return f, err
+	}
+
+	// every chunk number of the version should be there exactly once
+	hashes := make(map[int]string)
+	for _, chunk := range chunks {
+		switch {
+		case chunk.ChunkNumber < 0 || chunk.ChunkNumber >= chunkCount:
+			f.Problems = append(f.Problems, fmt.Sprintf("chunk %d is outside of the %d chunks of the version", chunk.ChunkNumber, chunkCount))
+		case hashes[chunk.ChunkNumber] != "":
+			f.Problems = append(f.Problems, fmt.Sprintf("chunk %d is stored more than once", chunk.ChunkNumber))
+		case chunk.ChunkHash == "":
+			f.Problems = append(f.Problems, fmt.Sprintf("chunk %d has no hash", chunk.ChunkNumber))
+			f.DamagedChunks = append(f.DamagedChunks, chunk.ChunkNumber)
+		default:
+			hashes[chunk.ChunkNumber] = chunk.ChunkHash
+		}
+	}
+	var missing []int
+	for i := 0; i < chunkCount; i++ {
+		if _, found := hashes[i]; !found {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) > 0 {
+		f.Problems = append(f.Problems, fmt.Sprintf("%d of %d chunks are missing: %v", len(missing), chunkCount, missing))
+		f.DamagedChunks = append(f.DamagedChunks, missing...)
+	}
+
+	// the chunk hashes should match the Merkle root recorded when the
+	// version was uploaded, which makes every sampled chunk check count
+	// for the whole file
+	if len(f.Problems) == 0 && fi.CurrentVersion.MerkleRoot != "" {
+		root, err := chunksMerkleRoot(chunks, chunkCount)
+		if err != nil || root != fi.CurrentVersion.MerkleRoot {
+			f.Problems = append(f.Problems, "the chunk hashes don't match the Merkle root of the version")
+		}
+	}
+
+	// pick the chunks to download; all of them in order for a full scrub
+	var checked []int
+	if full {
+		for i := 0; i < chunkCount; i++ {
+			if _, found := hashes[i]; found {
+				checked = append(checked, i)
+			}
+		}
+	} else if sample > 0 {
+		for i := range hashes {
+			checked = append(checked, i)
+		}
+		sort.Ints(checked)
+		rand.Shuffle(len(checked), func(i, j int) { checked[i], checked[j] = checked[j], checked[i] })
+		if len(checked) > sample {
+			checked = checked[:sample]
+		}
+		sort.Ints(checked)
+	}
+
+	hasher := sha1.New()
+	for _, chunkNum := range checked {
+		if err := ctx.Err(); err != nil {
+			return f, err
+		}
+		chunk, err := c.getChunk(ctx, fi.FileID, fi.CurrentVersion.VersionID, chunkNum)
+		if err != nil {
+			return f, err
+		}
+		f.ChunksChecked++
+
+		chunk, err = c.decryptChunk(chunk)
+		if err != nil {
+			f.Problems = append(f.Problems, fmt.Sprintf("chunk %d can't be decrypted: %v", chunkNum, err))
+			f.DamagedChunks = append(f.DamagedChunks, chunkNum)
+			full = false
+			continue
+		}
+		if hashChunk(chunk) != hashes[chunkNum] {
+			f.Problems = append(f.Problems, fmt.Sprintf("chunk %d doesn't match its hash", chunkNum))
+			f.DamagedChunks = append(f.DamagedChunks, chunkNum)
+			full = false
+			continue
+		}
+		hasher.Write(chunk)
+	}
+
+	// the file hash only covers the file if every chunk was intact
+	if full && len(missing) == 0 && len(f.Problems) == 0 {
+		fileHash := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+		if fileHash != fi.CurrentVersion.FileHash {
+			f.Problems = append(f.Problems, "the chunks don't match the file hash")
+		}
+	}
+
+	return f, nil
+}
+
+// RepairFile uploads the damaged chunks of a scrubbed remote file again from
+// localFilepath, a local copy of the same file version, instead of uploading
+// the whole file. Besides the damaged chunks found by the scrub, every chunk
+// whose remote hash doesn't match the local copy is repaired, which covers
+// chunks whose stored hash was damaged. The server checks each chunk against
+// the hashes recorded for the version, using a Merkle proof made from the
+// local copy if the version has a Merkle root. The number of chunks repaired
+// is returned; an error wrapping filefreezer.ErrHashMismatch is returned if
+// the local file isn't a copy of the remote version, in which case the file
+// has to be uploaded again.
+func (c *Client) RepairFile(ctx context.Context, localFilepath string, f ScrubFile) (int, error) {
+	fi, err := c.GetFileInfoByFilename(f.RemoteFilepath)
+	if err != nil {
+		return 0, err
+	}
+	if fi.FileID != f.FileID || fi.CurrentVersion.VersionID != f.VersionID {
+		return 0, fmt.Errorf("the remote file %s has changed since it was scrubbed", f.RemoteFilepath)
+	}
+
+	chunkSize := int(c.ServerCapabilities.ChunkSize)
+	localStats, err := filefreezer.CalcFileHashInfo(int64(chunkSize), localFilepath)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to calculate the file hash for %s: %w", localFilepath, err)
+	}
+	chunkCount := fi.CurrentVersion.ChunkCount
+	if localStats.HashString != fi.CurrentVersion.FileHash || localStats.ChunkCount != chunkCount {
+		return 0, fmt.Errorf("%w: %s is not a copy of the remote file %s", filefreezer.ErrHashMismatch, localFilepath, f.RemoteFilepath)
+	}
+
+	// find the chunks to repair by comparing the hashes of the local copy
+	remoteHashes, err := c.getChunkHashes(f.FileID, f.VersionID)
+	if err != nil {
+		return 0, err
+	}
+	damaged := make(map[int]bool, len(f.DamagedChunks))
+	for _, chunkNum := range f.DamagedChunks {
+		damaged[chunkNum] = true
+	}
+	localHashes := make([]string, chunkCount)
+	err = forEachChunk(chunkSize, localFilepath, chunkCount, func(i int, b []byte) (bool, error) {
+		localHashes[i] = hashChunk(b)
+		if remoteHashes[i] != localHashes[i] {
+			damaged[i] = true
+		}
+		return true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	repaired := 0
+	err = forEachChunk(chunkSize, localFilepath, chunkCount, func(i int, b []byte) (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		if !damaged[i] {
+			return true, nil
+		}
+
+		var proof []string
+		if fi.CurrentVersion.MerkleRoot != "" {
+			proof, err = filefreezer.MerkleProof(localHashes, i)
+			if err != nil {
+				return false, err
+			}
+		}
+		err := c.RepairChunk(ctx, f.FileID, f.VersionID, i, proof, b)
+		if err != nil {
+			return false, err
+		}
+
+		c.Printf("%s *** %d / %d\n", f.RemoteFilepath, i+1, chunkCount)
+		repaired++
+		return true, nil
+	})
+	if err != nil {
+		return repaired, fmt.Errorf("Failed to repair the chunks of %s: %w", f.RemoteFilepath, err)
+	}
+
+	return repaired, nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+const (
+	// searchMinPrefix is the shortest word prefix indexed for a file name so
+	// that a search for the start of a word finds it.
+	searchMinPrefix = 3
+
+	// searchMaxWord is the length that words are cut to before their
+	// prefixes are indexed.
+	searchMaxWord = 32
+
+	// searchTokenSize is the number of bytes of the HMAC kept for a token.
+	searchTokenSize = 16
+)
+
+// searchKey returns the key used to derive search tokens, or nil if the
+// client has no crypto key to derive it from. The key is kept separate from
+// the crypto key so that a token reveals nothing about it.
+func (c *Client) searchKey() []byte {
+	if len(c.CryptoKey) == 0 {
+		return nil
+	}
+	mac := hmac.New(sha256.New, c.CryptoKey)
+	mac.Write([]byte("filefreezer search index"))
+	return mac.Sum(nil)
+}
+
+// searchToken returns the opaque token for a lower case word or prefix.
+func searchToken(key []byte, word string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(word))
+	return hex.EncodeToString(mac.Sum(nil)[:searchTokenSize])
+}
+
+// searchWords splits s into its lower case runs of letters and digits.
+func searchWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// SearchTokens returns the search tokens for the plaintext file name, or nil
+// if the client has no crypto key. Each word of the name is indexed along
+// with its prefixes so that a search can match the start of a word.
+func (c *Client) SearchTokens(filename string) []string {
+	key := c.searchKey()
+	if key == nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var tokens []string
+	for _, word := range searchWords(filename) {
+		runes := []rune(word)
+		if len(runes) > searchMaxWord {
+			runes = runes[:searchMaxWord]
+		}
+		for n := len(runes); n > 0; n-- {
+			if n < searchMinPrefix && n < len(runes) {
+				break
+			}
+			prefix := string(runes[:n])
+			if !seen[prefix] {
+				seen[prefix] = true
+				tokens = append(tokens, searchToken(key, prefix))
+			}
+		}
+	}
+	if len(tokens) > filefreezer.MaxSearchTokens {
+		tokens = tokens[:filefreezer.MaxSearchTokens]
+	}
+	return tokens
+}
+
+// patternTokens returns the search tokens that every file name matching the
+// pattern must have. Words that follow a wildcard can't be used because they
+// may be the end of a longer word, and a word followed by a wildcard is only
+// used if it's long enough to have been indexed as a prefix. The last word of
+// a literal pattern is treated as a prefix too.
+func (c *Client) patternTokens(pattern string, literal bool) []string {
+	key := c.searchKey()
+	if key == nil {
+		return nil
+	}
+
+	var tokens []string
+	runes := []rune(strings.ToLower(pattern))
+	isWord := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+	isWild := func(r rune) bool { return r == '*' || r == '?' || r == '[' || r == ']' || r == '\\' }
+	for i := 0; i < len(runes); {
+		if !isWord(runes[i]) {
+			i++
+			continue
+		}
+		start := i
+		for i < len(runes) && isWord(runes[i]) {
+			i++
+		}
+		word := runes[start:i]
+		if start > 0 && isWild(runes[start-1]) {
+			continue
+		}
+		isPrefix := i < len(runes) && isWild(runes[i]) || literal && i == len(runes)
+		if isPrefix && len(word) < searchMinPrefix {
+			continue
+		}
+		if len(word) > searchMaxWord {
+			word = word[:searchMaxWord]
+		}
+		tokens = append(tokens, searchToken(key, string(word)))
+	}
+	if len(tokens) > filefreezer.MaxSearchTokens {
+		tokens = tokens[:filefreezer.MaxSearchTokens]
+	}
+	return tokens
+}
+
+// SearchFiles returns the files whose plaintext name, or the last element of
+// it, matches the path.Match pattern along with the plaintext names. A
+// pattern without any wildcards matches the names that contain it, ignoring
+// case, starting at the beginning of a word. The server narrows down the
+// files with the search index so that the whole file list doesn't have to be
+// downloaded and decrypted; if the pattern has no words that can be looked
+// up, the whole file list is used instead. Files that haven't been indexed
+// are only found by the latter, so Reindex should be run after uploading
+// files with other tools.
+func (c *Client) SearchFiles(pattern string) ([]filefreezer.FileInfo, []string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, nil, fmt.Errorf("invalid search pattern %q: %w", pattern, err)
+	}
+
+	literal := !strings.ContainsAny(pattern, `*?[\`)
+	var candidates []filefreezer.FileInfo
+	tokens := c.patternTokens(pattern, literal)
+	if len(tokens) > 0 {
+		query := url.Values{"token": tokens}
+		target := fmt.Sprintf("%s/api/search?%s", c.HostURI, query.Encode())
+		body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to search the files: %w", err)
+		}
+
+		var r models.SearchGetResponse
+		err = json.Unmarshal(body, &r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+		}
+		candidates = r.Files
+	} else {
+		var err error
+		candidates, err = c.GetAllFileHashes()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to get the file list: %w", err)
+		}
+	}
+
+	var found []filefreezer.FileInfo
+	var names []string
+	for _, fi := range candidates {
+		name, err := c.DecryptString(fi.FileName)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt one of the file names: %w", err)
+		}
+		var matched bool
+		if literal {
+			matched = containsAtWordStart(strings.ToLower(name), strings.ToLower(pattern))
+		} else {
+			matched, _ = path.Match(pattern, name)
+			if !matched {
+				matched, _ = path.Match(pattern, path.Base(name))
+			}
+		}
+		if matched {
+			found = append(found, fi)
+			names = append(names, name)
+		}
+	}
+
+	return found, names, nil
+}
+
+// Reindex replaces the search tokens of all of the user's files with ones
+// made from their current names and returns the number of files indexed.
+func (c *Client) Reindex() (int, error) {
+	if c.searchKey() == nil {
+		return 0, fmt.Errorf("a crypto key is needed to index the file names")
+	}
+
+	allFileInfos, err := c.GetAllFileHashes()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get the file list: %w", err)
+	}
+
+	var req models.SearchIndexPutRequest
+	for _, fi := range allFileInfos {
+		name, err := c.DecryptString(fi.FileName)
+		if err != nil {
+			return 0, fmt.Errorf("failed to decrypt one of the file names: %w", err)
+		}
+		req.Files = append(req.Files, models.SearchIndexEntry{FileID: fi.FileID, Tokens: c.SearchTokens(name)})
+	}
+
+	target := fmt.Sprintf("%s/api/search/index", c.HostURI)
+	body, err := c.RunAuthRequest(target, "PUT", c.AuthToken, req)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to update the search index: %w", err)
+	}
+
+	var r models.SearchIndexPutResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return 0, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	return r.Indexed, nil
+}
+
+// containsAtWordStart returns true if s contains substr starting at the
+// beginning of s or after a character that isn't a letter or digit. Any
+// match counts if substr doesn't start with a letter or digit.
+func containsAtWordStart(s, substr string) bool {
+	if r, _ := utf8.DecodeRuneInString(substr); !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+		return strings.Contains(s, substr)
+	}
+	for offset := 0; offset <= len(s); {
+		i := strings.Index(s[offset:], substr)
+		if i < 0 {
+			return false
+		}
+		i += offset
+		if i == 0 {
+			return true
+		}
+		r, _ := utf8.DecodeLastRuneInString(s[:i])
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return true
+		}
+		_, size := utf8.DecodeRuneInString(s[i:])
+		offset = i + size
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// StarFile stars the file with the filename so that it's listed by
+// GetStarredFiles, or unstars it if starred is false.
+func (c *Client) StarFile(filename string, starred bool) error {
+	fi, err := c.GetFileInfoByFilename(filename)
+	if err != nil {
+		return err
+	}
+
+	method, verb := "PUT", "Starred"
+	if !starred {
+		method, verb = "DELETE", "Unstarred"
+	}
+	target := fmt.Sprintf("%s/api/file/%d/star", c.HostURI, fi.FileID)
+	_, err = c.RunAuthRequest(target, method, c.AuthToken, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to set the starred flag of the file %s: %w", filename, err)
+	}
+
+	c.Printf("%s file: %s\n", verb, filename)
+
+	return nil
+}
+
+// GetStarredFiles returns the user's starred files. The file names are still
+// encrypted.
+func (c *Client) GetStarredFiles() ([]filefreezer.FileInfo, error) {
+	target := fmt.Sprintf("%s/api/starred", c.HostURI)
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the starred files: %w", err)
+	}
+
+	var r models.StarredFilesGetResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	return r.Files, nil
+}
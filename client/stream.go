@@ -0,0 +1,295 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/tbogdala/filefreezer"
+)
+
+const (
+	// streamFilePermissions are the permissions given to files created by
+	// UploadReader since a reader has none of its own.
+	streamFilePermissions = 0644
+
+	// streamPlaceholderLastMod is the last modified time given to a version
+	// while its data is being streamed; it's older than any real file.
+	streamPlaceholderLastMod = 1
+)
+
+// UploadReader reads r until EOF and stores the data on the server as the file
+// remoteFilepath, splitting it into chunks and encrypting them along the way
+// so that the data never needs to be written to a local file. A new version
+// is added if the file already exists. The FileInfo for the uploaded version
+// is returned.
+//
+// The size and hash of the data aren't known until the end of r is reached,
+// so the version is registered with a placeholder last modified time from
+// 1970 and completed once every chunk has been sent. If the upload fails, a
+// newly registered file is removed; a new version of an existing file is left
+// with the placeholder time so that syncing considers any local copy newer.
+func (c *Client) UploadReader(ctx context.Context, remoteFilepath string, r io.Reader) (filefreezer.FileInfo, error) {
+	return c.UploadReaderModTime(ctx, remoteFilepath, r, time.Time{})
+}
+
+// UploadReaderModTime works like UploadReader but gives the uploaded version
+// the last modified time modTime instead of the time the upload finished,
+// which keeps the time of a file copied from somewhere else. A zero modTime
+// uses the time the upload finished.
+func (c *Client) UploadReaderModTime(ctx context.Context, remoteFilepath string, r io.Reader, modTime time.Time) (filefreezer.FileInfo, error) {
+	chunkSize := int(c.ServerCapabilities.ChunkSize)
+	if chunkSize <= 0 {
+		return filefreezer.FileInfo{}, fmt.Errorf("the server chunk size is unknown; Login must be called first")
+	}
+	if err := ctx.Err(); err != nil {
+		return filefreezer.FileInfo{}, err
+	}
+
+	// register the file or a new version of it with placeholder data
+	var fi filefreezer.FileInfo
+	created := false
+	emptyHash := hashChunk(nil)
+	remote, err := c.GetFileInfoByFilename(remoteFilepath)
+	if err != nil {
+		fi, err = c.PutFile(remoteFilepath, false, streamFilePermissions, streamPlaceholderLastMod, 0, emptyHash, "")
+		created = true
+	} else if remote.IsDir {
+		return filefreezer.FileInfo{}, fmt.Errorf("%s is a directory on the server", remoteFilepath)
+	} else {
+		fi, err = c.AddFileVersion(remote.FileID, remote.CurrentVersion.Permissions, streamPlaceholderLastMod, 0, emptyHash, "")
+	}
+	if err != nil {
+		return filefreezer.FileInfo{}, fmt.Errorf("Failed to register %s on the server: %w", remoteFilepath, err)
+	}
+
+	fi, err = c.uploadChunks(ctx, remoteFilepath, fi, r, chunkSize, modTime)
+	if err != nil {
+		if created {
+			target := fmt.Sprintf("%s/api/file/%d", c.HostURI, fi.FileID)
+			if _, rmErr := c.RunAuthRequest(target, "DELETE", c.AuthToken, nil); rmErr != nil {
+				c.Log.Warnf("Failed to remove the incomplete file %s (%d): %v", remoteFilepath, fi.FileID, rmErr)
+			}
+		}
+		return filefreezer.FileInfo{}, fmt.Errorf("Failed to upload %s: %w", remoteFilepath, err)
+	}
+
+	c.Printf("%s ==> uploaded\n", remoteFilepath)
+	return fi, nil
+}
+
+// uploadChunks sends the data read from r as the chunks of the current version
+// of fi and then completes the version with the chunk count, hash and modTime,
+// or the current time if modTime is zero.
+func (c *Client) uploadChunks(ctx context.Context, remoteFilepath string, fi filefreezer.FileInfo, r io.Reader, chunkSize int, modTime time.Time) (filefreezer.FileInfo, error) {
+	versionID := fi.CurrentVersion.VersionID
+	hasher := sha1.New()
+	buffer := make([]byte, chunkSize)
+	chunkCount := 0
+	var chunkHashes []string
+	for {
+		if err := ctx.Err(); err != nil {
+			return fi, err
+		}
+
+		readCount, readErr := io.ReadFull(r, buffer)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return fi, fmt.Errorf("failed to read the data: %v", readErr)
+		}
+		if readCount > 0 {
+			chunk := buffer[:readCount]
+			hasher.Write(chunk)
+			cryptoBytes, err := c.encryptChunk(remoteFilepath, chunk)
+			if err != nil {
+				return fi, fmt.Errorf("Failed to encrypt chunk before sending to the server: %w", err)
+			}
+			chunkHash := hashChunk(chunk)
+			err = c.putChunk(ctx, fi.FileID, versionID, chunkCount, chunkHash, cryptoBytes)
+			if err != nil {
+				return fi, err
+			}
+			chunkHashes = append(chunkHashes, chunkHash)
+			chunkCount++
+			c.Printf("%s >>> %d\n", remoteFilepath, chunkCount)
+		}
+
+		// a short read means the end of the data was reached
+		if readErr != nil {
+			break
+		}
+	}
+
+	if modTime.IsZero() {
+		modTime = time.Now().Add(c.ClockSkew)
+	}
+	fi.CurrentVersion.LastMod = modTime.UTC().Unix()
+	fi.CurrentVersion.ChunkCount = chunkCount
+	fi.CurrentVersion.FileHash = base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+	merkleRoot, err := filefreezer.MerkleRoot(chunkHashes)
+	if err != nil {
+		return fi, err
+	}
+	fi.CurrentVersion.MerkleRoot = merkleRoot
+	err = c.UpdateFileVersion(fi.FileID, versionID, fi.CurrentVersion.LastMod, chunkCount, fi.CurrentVersion.FileHash, merkleRoot)
+	return fi, err
+}
+
+// DownloadWriter downloads the current version of the file remoteFilepath,
+// decrypting each chunk and writing it to w, so that the data never needs to
+// be written to a local file. The number of bytes written is returned. The
+// data is verified against the file hash once it has all been written and an
+// error is returned if it doesn't match.
+func (c *Client) DownloadWriter(ctx context.Context, remoteFilepath string, w io.Writer) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	remote, err := c.GetFileInfoByFilename(remoteFilepath)
+	if err != nil {
+		return 0, err
+	}
+	if remote.IsDir {
+		return 0, fmt.Errorf("%s is a directory on the server", remoteFilepath)
+	}
+	return c.downloadVersion(ctx, remoteFilepath, remote, w)
+}
+
+// downloadVersion downloads the current version of the remote file, named
+// remoteFilepath, into w and verifies it against the file hash.
+func (c *Client) downloadVersion(ctx context.Context, remoteFilepath string, remote filefreezer.FileInfo, w io.Writer) (int64, error) {
+	var written int64
+	hasher := sha1.New()
+	version := remote.CurrentVersion
+
+	// the chunk hashes are needed to look up the chunks in the cache
+	var chunkHashes map[int]string
+	if c.Cache != nil {
+		var err error
+		chunkHashes, err = c.getChunkHashes(remote.FileID, version.VersionID)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	for i := 0; i < version.ChunkCount; i++ {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+
+		chunk, cached := c.cachedChunk(chunkHashes[i])
+		if !cached {
+			var err error
+			chunk, err = c.downloadChunk(ctx, remote.FileID, version.VersionID, i, chunkHashes[i])
+			if err != nil {
+				return written, err
+			}
+		}
+		hasher.Write(chunk)
+
+		n, err := w.Write(chunk)
+		written += int64(n)
+		if err != nil {
+			return written, fmt.Errorf("Failed to write the #%d chunk of %s: %w", i, remoteFilepath, err)
+		}
+		c.Printf("%s <<< %d / %d\n", remoteFilepath, i+1, version.ChunkCount)
+	}
+
+	hash := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+	if hash != version.FileHash {
+		return written, fmt.Errorf("the downloaded data for %s is wrong: %w", remoteFilepath, filefreezer.ErrHashMismatch)
+	}
+	return written, nil
+}
+
+// DownloadRange downloads length bytes of the current version of the file
+// remoteFilepath starting at offset and writes them to w. Only the chunks
+// that hold the range are downloaded and decrypted, so a few bytes of a
+// huge file can be read quickly. A negative length reads to the end of the
+// file and a range that goes past the end is cut short there. The file hash
+// can't be checked against part of a file, so each chunk is checked against
+// its own hash instead. The number of bytes written is returned.
+func (c *Client) DownloadRange(ctx context.Context, remoteFilepath string, offset int64, length int64, w io.Writer) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("the range of %s can't start at a negative offset", remoteFilepath)
+	}
+
+	remote, err := c.GetFileInfoByFilename(remoteFilepath)
+	if err != nil {
+		return 0, err
+	}
+	if remote.IsDir {
+		return 0, fmt.Errorf("%s is a directory on the server", remoteFilepath)
+	}
+	version := remote.CurrentVersion
+
+	chunkSize := c.ServerCapabilities.ChunkSize
+	first := int(offset / chunkSize)
+	last := version.ChunkCount - 1
+	if length >= 0 {
+		if length == 0 {
+			return 0, nil
+		}
+		if end := int((offset + length - 1) / chunkSize); end < last {
+			last = end
+		}
+	}
+	if first >= version.ChunkCount {
+		return 0, fmt.Errorf("the range starting at byte %d is past the end of %s", offset, remoteFilepath)
+	}
+
+	chunkHashes, err := c.getChunkHashes(remote.FileID, version.VersionID)
+	if err != nil {
+		return 0, err
+	}
+
+	var written int64
+	remaining := length
+	for i := first; i <= last; i++ {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+
+		chunk, cached := c.cachedChunk(chunkHashes[i])
+		if !cached {
+			chunk, err = c.downloadChunk(ctx, remote.FileID, version.VersionID, i, chunkHashes[i])
+			if err != nil {
+				return written, err
+			}
+			if hashChunk(chunk) != chunkHashes[i] {
+				return written, fmt.Errorf("the downloaded data of the #%d chunk of %s is wrong: %w", i, remoteFilepath, filefreezer.ErrHashMismatch)
+			}
+		}
+
+		// trim the chunk down to the part inside the range
+		if i == first {
+			skip := offset - int64(i)*chunkSize
+			if skip >= int64(len(chunk)) {
+				return 0, fmt.Errorf("the range starting at byte %d is past the end of %s", offset, remoteFilepath)
+			}
+			chunk = chunk[skip:]
+		}
+		if remaining >= 0 && int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+
+		n, err := w.Write(chunk)
+		written += int64(n)
+		if err != nil {
+			return written, fmt.Errorf("Failed to write the #%d chunk of %s: %w", i, remoteFilepath, err)
+		}
+		if remaining >= 0 {
+			remaining -= int64(n)
+		}
+		c.Printf("%s <<< %d / %d\n", remoteFilepath, i-first+1, last-first+1)
+	}
+	return written, nil
+}
@@ -0,0 +1,938 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tbogdala/filefreezer"
+)
+
+// SyncStatus enumeration used to indicate the findings of the SyncFile and
+// SyncDirectory functions.
+const (
+	SyncStatusMissing             = 1 // chunks missing
+	SyncStatusLocalNewer          = 2 // local file newer
+	SyncStatusRemoteNewer         = 3 // remote file newer
+	SyncStatusSame                = 4 // local and remote files are the same
+	SyncStatusUnsupportedFileType = 5 // returned when sync encouters device files or socket files, etc...
+)
+
+const (
+	// SyncCurrentVersion is the value to pass to SyncFile to sync the current version
+	// of the file and not a particular version number.
+	SyncCurrentVersion = 0
+
+	// SyncPartialSuffix is added to the name of a local file while it's being
+	// downloaded; the file only replaces the local file once it's verified.
+	SyncPartialSuffix = ".freezer-part"
+
+	// SyncQuarantineSuffix is added to the name of a downloaded file that
+	// doesn't match the remote file hash. The file is kept for inspection
+	// and the local file is left alone.
+	SyncQuarantineSuffix = ".freezer-quarantine"
+)
+
+// maxRevisionRetries is how many times a file is synced again when another
+// client changes it on the server in the middle of its sync.
+const maxRevisionRetries = 3
+
+// SyncDirectory will take a localDir and recursively walk the filesystem calling SyncFile
+// for each file encountered. remoteDir can be specified to prefix the remote filepath
+// for each file. A report of every file synced is returned and upon error a non-nil
+// error value is returned along with the report of the files synced so far.
+// If SyncStateFile is set, the progress is recorded in it so that a sync that
+// is interrupted resumes where it stopped the next time. The paths listed in
+// the IgnoreFileName file in the root of localDir are skipped, both locally
+// and on the server.
+func (c *Client) SyncDirectory(localDir string, remoteDir string) (*SyncReport, error) {
+	start := time.Now()
+	c.forgetKnownDirs()
+	var state *syncState
+	if c.SyncStateFile != "" {
+		var err error
+		state, err = openSyncState(c.SyncStateFile, c.HostURI, localDir, remoteDir)
+		if err != nil {
+			return &SyncReport{Duration: time.Since(start)}, err
+		}
+	}
+
+	report, err := c.syncDirectory(localDir, remoteDir, state)
+	if saveErr := c.Revisions.Save(); saveErr != nil {
+		c.Log.Warnf("%v", saveErr)
+	}
+	if state != nil {
+		// the state file is only removed once everything has been synced
+		closeErr := state.close(err == nil)
+		if err == nil && closeErr != nil {
+			err = fmt.Errorf("Failed to remove the sync state file %s: %w", c.SyncStateFile, closeErr)
+		}
+	}
+	report.Duration = time.Since(start)
+	return report, err
+}
+
+// syncDirectory does the work for SyncDirectory, skipping the files that
+// state says have already been synced.
+func (c *Client) syncDirectory(localDir string, remoteDir string, state *syncState) (*SyncReport, error) {
+	report := new(SyncReport)
+
+	// make a map of filenames that have been processed locally so that the
+	// loop that processes remote files can skip local files that have already
+	// been sync'd.
+	alreadyProccessed := make(map[string]bool)
+
+	// files are synced by a pool of workers so that directories of many
+	// small files aren't limited by the round trips of each one; lock
+	// guards the report and alreadyProccessed while they run
+	var lock sync.Mutex
+	pool := newSyncPool(c.SyncWorkers)
+	syncOne := func(localFileName, remoteFileName string) error {
+		var fileReport FileReport
+		var err error
+		if state.isDone(localFileName) {
+			c.Printf("%s --- already synced\n", remoteFileName)
+			fileReport = FileReport{LocalFilename: localFileName, RemoteFilepath: remoteFileName,
+				Status: SyncStatusSame, Action: actionForStatus(SyncStatusSame)}
+		} else {
+			fileReport, err = c.syncFileState(localFileName, remoteFileName, SyncCurrentVersion, state)
+			if err == nil {
+				err = state.markDone(localFileName)
+			}
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		report.Files = append(report.Files, fileReport)
+
+		// the files that couldn't be uploaded to the primary are synced
+		// again next time while the rest of the files are read from the
+		// mirrors now
+		if errors.Is(err, ErrPrimaryUnavailable) {
+			c.Printf("%s --- queued for the primary server\n", remoteFileName)
+			return nil
+		}
+		return err
+	}
+
+	ignore, err := readIgnoreFile(localDir)
+	if err != nil {
+		return report, err
+	}
+	rootRemoteDir := remoteDir
+	keptDirs := make(map[string]bool)
+
+	// get all of the remote files
+	remoteFileHashes, err := c.GetAllFileHashes()
+	if err != nil {
+		return report, fmt.Errorf("Failed to a list of remote file hashes: %w", err)
+	}
+
+	// the removed files are propagated first so that they aren't synced back
+	if c.SyncDeletes {
+		deletions, err := c.planSyncDeletes(localDir, remoteDir, remoteFileHashes, ignore)
+		if err != nil {
+			return report, err
+		}
+		deleted := make(map[int]bool)
+		for _, d := range deletions {
+			fileReport := c.syncDelete(d)
+			report.Files = append(report.Files, fileReport)
+			if fileReport.Err != nil {
+				return report, fileReport.Err
+			}
+			if d.Remote {
+				deleted[d.fileID] = true
+			} else if fileReport.Action == SyncActionSkipped {
+				keptDirs[c.foldName(d.LocalFilename)] = true
+			}
+		}
+		remaining := remoteFileHashes[:0]
+		for _, fi := range remoteFileHashes {
+			if !deleted[fi.FileID] {
+				remaining = append(remaining, fi)
+			}
+		}
+		remoteFileHashes = remaining
+	}
+
+	var processDir func(localDir string, remoteDir string) error
+	processDir = func(localDir string, remoteDir string) error {
+		// silently return if the directory does not exist
+		if _, err := os.Stat(localDir); os.IsNotExist(err) {
+			return nil
+		}
+
+		// get all of the local files
+		localFileInfos, err := ioutil.ReadDir(localDir)
+		if err != nil {
+			return fmt.Errorf("Failed to get a list of local file names: %w", err)
+		}
+
+		// sync all of the local files
+		var localFileInfo os.FileInfo
+		for _, localFileInfo = range localFileInfos {
+			localFileName := localDir + string(filepath.Separator) + localFileInfo.Name()
+			remoteFileName := remoteDir + "/" + localFileInfo.Name()
+
+			// skip the files left behind by downloads and the excluded ones
+			if strings.HasSuffix(localFileName, SyncPartialSuffix) || strings.HasSuffix(localFileName, SyncQuarantineSuffix) {
+				continue
+			}
+			if c.excluded(localFileInfo.Name()) || c.isStateFile(localFileName) ||
+				ignore.Match(remoteFileName[len(rootRemoteDir):], localFileInfo.IsDir()) {
+				continue
+			}
+
+			// the directories removed on the server that were kept for the
+			// files in them that aren't synced aren't uploaded again
+			if keptDirs[c.foldName(localFileName)] {
+				continue
+			}
+
+			// attempt the local file sync operation; directories are synced
+			// before their contents so that they are registered with their own
+			// permissions instead of being created implicitly
+			syncLocal := func() error {
+				err := syncOne(localFileName, remoteFileName)
+				if err != nil {
+					return fmt.Errorf("Failed to sync local file (%s) with the remote file (%s): %w", localFileName, remoteFileName, err)
+				}
+
+				// on success, keep processing
+				lock.Lock()
+				alreadyProccessed[c.foldName(localFileName)] = true
+				lock.Unlock()
+				return nil
+			}
+			if !localFileInfo.IsDir() {
+				err := pool.run(syncLocal)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			err := syncLocal()
+			if err != nil {
+				return err
+			}
+
+			// process directories by recursively looking into them for local files
+			// and other directories
+			err = processDir(localFileName, remoteFileName)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// start recursively processing at the local directory specified and
+	// wait for the files still being synced before looking at the remote ones
+	err = processDir(localDir, remoteDir)
+	if poolErr := pool.wait(); err == nil {
+		err = poolErr
+	}
+	if err != nil {
+		return report, err
+	}
+
+	// sync all of the remote files in order of their names so that the
+	// directories are created with their permissions before their contents
+	var remoteFileNames []string
+	remoteDirs := make(map[string]bool)
+	for _, remoteFileHash := range remoteFileHashes {
+		remoteFileName, err := c.DecryptString(remoteFileHash.FileName)
+		if err != nil {
+			return report, fmt.Errorf("Failed to decrypt remote file name for file id %d: %w", remoteFileHash.FileID, err)
+		}
+
+		// skip the remote file if we don't start with the right prefix or
+		// it's excluded
+		if !strings.HasPrefix(remoteFileName, remoteDir) || c.excludedPath(remoteFileName[len(remoteDir):]) ||
+			ignore.Match(remoteFileName[len(remoteDir):], remoteFileHash.IsDir) {
+			continue
+		}
+		remoteFileNames = append(remoteFileNames, remoteFileName)
+		remoteDirs[remoteFileName] = remoteFileHash.IsDir
+	}
+	sort.Strings(remoteFileNames)
+
+	for _, remoteFileName := range remoteFileNames {
+		// build the local file path; remote names always use forward slashes
+		localFileName := localDir + filepath.FromSlash(remoteFileName[len(remoteDir):])
+
+		// have we already processed it?
+		_, processed := alreadyProccessed[c.foldName(localFileName)]
+		if processed {
+			continue
+		}
+
+		dirIndex := strings.LastIndexAny(localFileName, `/`+string(filepath.Separator))
+		if dirIndex > 0 {
+			// ensure the directory exists already; only directories that
+			// were never registered on the server get default permissions
+			dirToCreate := localFileName[:dirIndex]
+			err = os.MkdirAll(dirToCreate, 0777)
+			if err != nil {
+				err = fmt.Errorf("Failed to create the local directory for %s: %w", localDir, err)
+				break
+			}
+		}
+
+		// attempt the remote file sync; like above, directories are synced
+		// right away so that they exist before their contents are
+		syncRemote := func() error {
+			err := syncOne(localFileName, remoteFileName)
+			if err != nil {
+				return fmt.Errorf("Failed to sync remote file (%s) with the local file (%s): %w", remoteFileName, localFileName, err)
+			}
+			return nil
+		}
+		if remoteDirs[remoteFileName] {
+			err = syncRemote()
+		} else {
+			err = pool.run(syncRemote)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if poolErr := pool.wait(); err == nil {
+		err = poolErr
+	}
+	if err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+// DefaultSyncWorkers is the number of files SyncDirectory syncs at the same
+// time unless the client is told otherwise.
+const DefaultSyncWorkers = 4
+
+// syncPool runs functions on a bounded number of goroutines and keeps the
+// first error any of them returns.
+type syncPool struct {
+	sem  chan struct{}
+	wg   sync.WaitGroup
+	lock sync.Mutex
+	err  error
+}
+
+func newSyncPool(workers int) *syncPool {
+	if workers < 1 {
+		workers = 1
+	}
+	return &syncPool{sem: make(chan struct{}, workers)}
+}
+
+// run waits for a free worker and runs f on it. Once a function has failed
+// nothing else is run and its error is returned instead.
+func (p *syncPool) run(f func() error) error {
+	p.sem <- struct{}{}
+	if err := p.firstError(); err != nil {
+		<-p.sem
+		return err
+	}
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			<-p.sem
+			p.wg.Done()
+		}()
+		if err := f(); err != nil {
+			p.lock.Lock()
+			if p.err == nil {
+				p.err = err
+			}
+			p.lock.Unlock()
+		}
+	}()
+	return nil
+}
+
+// wait waits for the running functions to finish and returns the first
+// error any of them returned.
+func (p *syncPool) wait() error {
+	p.wg.Wait()
+	return p.firstError()
+}
+
+func (p *syncPool) firstError() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.err
+}
+
+// SyncFile will synchronize the localFilename which is identified as remoteFilepath on the server.
+// A versionNum can also be specified (or left at <=0 for current version) to pick a particular version to sync.
+// A report is returned with a sync status enumeration value indicating if chunks were missing or whether or not
+// the local or remote version were considered newer, the action taken and the amount of data transferred.
+// A non-nil error value is returned on error and is also set in the report.
+func (c *Client) SyncFile(localFilename string, remoteFilepath string, versionNum int) (FileReport, error) {
+	report, err := c.syncFileState(localFilename, remoteFilepath, versionNum, nil)
+	if saveErr := c.Revisions.Save(); saveErr != nil {
+		c.Log.Warnf("%v", saveErr)
+	}
+	return report, err
+}
+
+// syncFileState works like SyncFile but also records the progress of the
+// transfers in state, if it isn't nil, and resumes the ones it has recorded.
+func (c *Client) syncFileState(localFilename string, remoteFilepath string, versionNum int, state *syncState) (FileReport, error) {
+	start := time.Now()
+	var report FileReport
+	var status int
+	var err error
+	for attempt := 0; ; attempt++ {
+		report = FileReport{LocalFilename: localFilename, RemoteFilepath: remoteFilepath, state: state}
+		status, err = c.syncFile(&report, versionNum)
+
+		// another client changed the file after it was compared with the
+		// local file, so compare them again
+		if attempt < maxRevisionRetries && errors.Is(err, filefreezer.ErrRevisionMismatch) {
+			c.Printf("%s changed on the server during the sync; syncing it again\n", remoteFilepath)
+			continue
+		}
+		break
+	}
+	report.Status = status
+	if err == nil && c.SyncAttributes && report.fileID != 0 {
+		err = c.syncAttributes(&report)
+	}
+	report.Duration = time.Since(start)
+	if err != nil {
+		report.Action = SyncActionFailed
+		if errors.Is(err, ErrPrimaryUnavailable) {
+			report.Action = SyncActionQueued
+		}
+		report.Err = err
+		return report, err
+	}
+	if report.synced.FileID != 0 {
+		c.Revisions.set(c.HostURI, localFilename, report.synced)
+	}
+	report.Action = actionForStatus(status)
+	return report, nil
+}
+
+// syncFile does the work for SyncFile and adds the chunks transferred and
+// conflicts found to the report as it goes.
+func (c *Client) syncFile(r *FileReport, versionNum int) (status int, e error) {
+	localFilename, remoteFilepath := r.LocalFilename, r.RemoteFilepath
+
+	// make sure that we're not attempting to sync a symlink, device, named pipe or socket
+	localFileStat, localFileStatErr := os.Stat(localFilename)
+	if localFileStatErr == nil {
+		// only check local files that exist
+		localMode := localFileStat.Mode()
+		if (localMode&os.ModeCharDevice) != 0 ||
+			(localMode&os.ModeDevice) != 0 ||
+			(localMode&os.ModeNamedPipe) != 0 ||
+			(localMode&os.ModeSocket) != 0 ||
+			(localMode&os.ModeSymlink) != 0 {
+			return SyncStatusUnsupportedFileType, nil
+		}
+	}
+
+	// get the file information for the filename, which provides
+	// all of the information necessary to determine what to sync.
+	remote, err := c.GetFileInfoByFilename(remoteFilepath)
+	r.fileID = remote.FileID
+
+	// if the file is not registered with the storage server, then upload it ...
+	// futher checking will be unnecessary.
+	if err != nil {
+		localStats, err := filefreezer.CalcFileHashInfo(c.ServerCapabilities.ChunkSize, localFilename)
+		if err != nil {
+			return SyncStatusMissing, fmt.Errorf("Failed to calculate the file hash data for file %s to upload as %s: %w", localFilename, remoteFilepath, err)
+		}
+		localStats.LastMod = c.serverLastMod(localStats.LastMod)
+		err = c.syncUploadNew(r, localStats.IsDir,
+			localStats.Permissions, localStats.LastMod, localStats.ChunkCount, localStats.HashString, localStats.MerkleRoot)
+		if err != nil {
+			return SyncStatusMissing, fmt.Errorf("Failed to upload the file to the server %s: %w", c.HostURI, err)
+		}
+		return SyncStatusLocalNewer, nil
+	}
+
+	// we got a valid response so the file is registered on the server;
+	// pull all of the versions for this file so that we can target the
+	// correct VersionID for a given versionNum.
+	var syncVersion *filefreezer.FileVersionInfo
+	if versionNum != SyncCurrentVersion {
+		versions, err := c.GetFileVersions(remoteFilepath)
+		if err != nil {
+			return 0, fmt.Errorf("Couldn't get all of the file version for %s: %w", remoteFilepath, err)
+		}
+		for _, v := range versions {
+			if v.VersionNumber == versionNum {
+				syncVersion = &v
+				break
+			}
+		}
+	}
+
+	// if we were not looking for the current version or the version number
+	// specified was not found in the list of file versions, then set the
+	// versionID to sync against to the current version ID for the file.
+	if syncVersion == nil {
+		syncVersion = &remote.CurrentVersion
+	}
+
+	if os.IsNotExist(localFileStatErr) {
+		// if it is a local file that doesn't exist then download the file from the
+		// server if it is registered there.
+		if !remote.IsDir {
+			err = c.syncDownload(r, remote.FileID, syncVersion.VersionID, syncVersion.ChunkCount, syncVersion.FileHash)
+			if syncVersion.VersionID == remote.CurrentVersion.VersionID {
+				r.synced = syncRevision{remote.FileID, syncVersion.VersionID, syncVersion.FileHash}
+			}
+			return SyncStatusRemoteNewer, err
+		}
+
+		// if its a local directory that doesn't exist, then just create the directory
+		err = os.MkdirAll(localFilename, os.ModeDir|os.FileMode(syncVersion.Permissions))
+		if err != nil {
+			return SyncStatusRemoteNewer, err
+		}
+
+		c.Printf("%s <== directory created\n", remoteFilepath)
+		return SyncStatusRemoteNewer, nil
+	}
+
+	// an upload that was interrupted only needs the chunks the server doesn't
+	// have yet, as long as the local file hasn't changed since it started
+	if upload, found := r.state.upload(localFilename); found && upload.FileID == remote.FileID &&
+		upload.VersionID == remote.CurrentVersion.VersionID && syncVersion.VersionID == upload.VersionID {
+		remoteMissingChunks, err := c.GetMissingChunksForFile(remote.FileID)
+		if err != nil {
+			return SyncStatusMissing, err
+		}
+		err = c.syncUploadMissing(r, remote.FileID, upload.VersionID, remote.CurrentVersion.ChunkCount, remoteMissingChunks)
+		return SyncStatusLocalNewer, err
+	}
+
+	// At this point the it is registered on the server and the local file exists,
+	// so it is time to calculate hash information and do comparisons ...
+
+	// calculate some of the local file information
+	localStats, err := filefreezer.CalcFileHashInfo(c.ServerCapabilities.ChunkSize, localFilename)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to calculate the local file hash data for %s: %w", localFilename, err)
+	}
+
+	// the modification times are compared by the server's clock since the
+	// remote ones may come from clients whose clocks disagree with this one
+	localStats.LastMod = c.serverLastMod(localStats.LastMod)
+
+	// if this is a directory we're syncing, the above scenarios cover registering
+	// it with the server and creating it locally.
+	// NOTE: at this point, lastmod and permissions are not synced between
+	// remote and local filesystems because there's no way to determine
+	// which is authoritative.
+	if localStats.IsDir {
+		return SyncStatusSame, nil
+	}
+
+	// handle a special case here for when a particular version is requested that
+	// is not the current version. in this case we will compare file hashes and
+	// download the remote version of the file if the hashes are not equal
+	if syncVersion.VersionID != remote.CurrentVersion.VersionID {
+		if localStats.HashString != syncVersion.FileHash {
+			err = c.syncDownload(r, remote.FileID, syncVersion.VersionID, syncVersion.ChunkCount, syncVersion.FileHash)
+			return SyncStatusRemoteNewer, err
+		}
+	}
+
+	// pull the list of missing chunks for the file
+	remoteMissingChunks, err := c.GetMissingChunksForFile(remote.FileID)
+	if err != nil {
+		return SyncStatusSame, err
+	}
+
+	// lets prove that we don't need to do anything for some cases
+	// NOTE: a lastMod difference here doesn't trigger a difference if other metrics check out the same
+	// NOTE: a difference in permissions also doesn't trigger a difference
+	if localStats.HashString == remote.CurrentVersion.FileHash &&
+		len(remoteMissingChunks) == 0 &&
+		localStats.ChunkCount == remote.CurrentVersion.ChunkCount {
+		different := false
+		if c.ExtraStrict {
+			// now we get a chunk list for the file
+			remoteChunks, err := c.GetFileChunks(remote.FileID, remote.CurrentVersion.VersionID)
+			if err != nil {
+				return 0, fmt.Errorf("Failed to get the file chunk list for the file name given (%s): %w", remoteFilepath, err)
+			}
+
+			// sanity check
+			remoteChunkCount := len(remoteChunks)
+			if remote.CurrentVersion.MerkleRoot != "" {
+				// the Merkle root of the local chunks was calculated along with the
+				// file hash, so the remote hashes can be compared without reading
+				// the local file again; the remote chunk list also has to match
+				// the root recorded when the version was uploaded
+				remoteRoot, err := chunksMerkleRoot(remoteChunks, remote.CurrentVersion.ChunkCount)
+				different = err != nil || remoteRoot != remote.CurrentVersion.MerkleRoot || remoteRoot != localStats.MerkleRoot
+			} else if localStats.ChunkCount == remoteChunkCount {
+				// check the local chunks against remote hashes
+				err = forEachChunk(int(c.ServerCapabilities.ChunkSize), localFilename, localStats.ChunkCount, func(i int, b []byte) (bool, error) {
+					// do the hashes match?
+					if strings.Compare(hashChunk(b), remoteChunks[i].ChunkHash) != 0 {
+						// FIXME: At this point we have a chunk difference and it should be left to
+						// the client as to which source to trust for the correct file, local or remote.
+						different = true
+						return false, nil
+					}
+					return true, nil
+				})
+				if err != nil {
+					return 0, fmt.Errorf("Failed to check the local file (%s) against the remote hashes: %w", localFilename, err)
+				}
+			}
+		}
+
+		// after whole-file hashs and all chunk hashs match, we can feel safe in saying they're not different
+		if !different {
+			c.Printf("%s --- unchanged\n", remoteFilepath)
+			r.synced = syncRevision{remote.FileID, remote.CurrentVersion.VersionID, localStats.HashString}
+			return SyncStatusSame, nil
+		}
+		r.Conflict = true
+	}
+
+	// when the revision of the remote file and the hash both sides had at
+	// the last sync are known, whichever side changed since then is newer
+	// no matter what the modification times say. if both changed, the local
+	// file is uploaded as the newer version so that neither change is lost;
+	// the remote one stays in the file's versions.
+	if base, found := c.Revisions.get(c.HostURI, localFilename); found && base.FileID == remote.FileID && !r.Conflict {
+		localChanged := localStats.HashString != base.Hash
+		remoteChanged := remote.CurrentVersion.VersionID != base.Revision
+		if remoteChanged && !localChanged {
+			e := c.syncDownload(r, remote.FileID, remote.CurrentVersion.VersionID, remote.CurrentVersion.ChunkCount, remote.CurrentVersion.FileHash)
+			r.synced = syncRevision{remote.FileID, remote.CurrentVersion.VersionID, remote.CurrentVersion.FileHash}
+			return SyncStatusRemoteNewer, e
+		}
+		if localChanged {
+			r.Conflict = remoteChanged
+			e := c.syncUploadNewer(r, remote.FileID, remote.CurrentVersion.VersionID, localStats.IsDir,
+				localStats.Permissions, localStats.LastMod, localStats.ChunkCount, localStats.HashString, localStats.MerkleRoot)
+			return SyncStatusLocalNewer, e
+		}
+	}
+
+	// at this point we have a file difference. we'll use the local file as the source of truth
+	// if it's lastMod is newer than the remote file.
+	if localStats.LastMod > remote.CurrentVersion.LastMod {
+		e := c.syncUploadNewer(r, remote.FileID, remote.CurrentVersion.VersionID, localStats.IsDir,
+			localStats.Permissions, localStats.LastMod, localStats.ChunkCount, localStats.HashString, localStats.MerkleRoot)
+		return SyncStatusLocalNewer, e
+	}
+
+	if localStats.LastMod < remote.CurrentVersion.LastMod {
+		e := c.syncDownload(r, remote.FileID, remote.CurrentVersion.VersionID, remote.CurrentVersion.ChunkCount, remote.CurrentVersion.FileHash)
+		r.synced = syncRevision{remote.FileID, remote.CurrentVersion.VersionID, remote.CurrentVersion.FileHash}
+		return SyncStatusRemoteNewer, e
+	}
+
+	// there's been a difference detected in the files, but the mod times were the same, so
+	// we attempt to upload any missing chunks.
+	if len(remoteMissingChunks) > 0 {
+		e := c.syncUploadMissing(r, remote.FileID, remote.CurrentVersion.VersionID, localStats.ChunkCount, remoteMissingChunks)
+		if localStats.HashString == remote.CurrentVersion.FileHash {
+			r.synced = syncRevision{remote.FileID, remote.CurrentVersion.VersionID, localStats.HashString}
+		}
+		return SyncStatusMissing, e
+	}
+
+	// if we've got this far, we have a local and remote file with the same lastmod
+	// but differing hashes. for this case we'll upload the local file as a newer version.
+	if localStats.HashString != remote.CurrentVersion.FileHash &&
+		localStats.LastMod == remote.CurrentVersion.LastMod {
+		r.Conflict = true
+		e := c.syncUploadNewer(r, remote.FileID, remote.CurrentVersion.VersionID, localStats.IsDir,
+			localStats.Permissions, localStats.LastMod, localStats.ChunkCount, localStats.HashString, localStats.MerkleRoot)
+		return SyncStatusLocalNewer, e
+	}
+
+	// we checked to make sure it was the same above, but we found it different -- however, no steps to
+	// resolve this were taken, so through an error.
+	return 0, fmt.Errorf("found differences between local (%s) and remote (%s) versions, "+
+		"but this was not reconcilled; lastmod equality (%v); hash equality (%v)",
+		localFilename, remoteFilepath,
+		localStats.LastMod == remote.CurrentVersion.LastMod,
+		localStats.HashString == remote.CurrentVersion.FileHash)
+}
+
+func (c *Client) syncUploadMissing(r *FileReport, remoteID int, remoteVersionID int, localChunkCount int, missingChunks []int) error {
+	missing := make(map[int]bool, len(missingChunks))
+	for _, chunkNum := range missingChunks {
+		missing[chunkNum] = true
+	}
+
+	// upload each chunk the server doesn't have
+	err := forEachChunk(int(c.ServerCapabilities.ChunkSize), r.LocalFilename, localChunkCount, func(i int, b []byte) (bool, error) {
+		if !missing[i] {
+			return true, nil
+		}
+		err := c.putFileChunk(r.LocalFilename, remoteID, remoteVersionID, i, b)
+		if err != nil {
+			return false, err
+		}
+
+		c.Printf("%s +++ %d / %d\n", r.RemoteFilepath, i+1, localChunkCount)
+		r.Chunks++
+		r.Bytes += int64(len(b))
+
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to upload the local file chunk for %s: %w", r.LocalFilename, err)
+	}
+
+	return nil
+}
+
+func (c *Client) syncUploadNewer(r *FileReport, remoteFileID int, remoteRevision int, isDir bool, localPermissions uint32, localLastMod int64, localChunkCount int, localHash string, localMerkleRoot string) error {
+	// tag a new version for the file as long as no other client has changed
+	// it since it was compared with the local file
+	fi, err := c.AddFileVersionAtRevision(remoteFileID, remoteRevision, localPermissions, localLastMod, localChunkCount, localHash, localMerkleRoot)
+	if err != nil {
+		return err
+	}
+	r.synced = syncRevision{fi.FileID, fi.CurrentVersion.VersionID, localHash}
+
+	// if we're uploading a newer version for a directory we can just
+	// stop here because there are no chunks to send.
+	if isDir {
+		return nil
+	}
+	if c.copyIdenticalChunks(r, fi.FileID, fi.CurrentVersion.VersionID, localChunkCount) {
+		return nil
+	}
+	err = r.state.startUpload(r.LocalFilename, fi.FileID, fi.CurrentVersion.VersionID)
+	if err != nil {
+		return err
+	}
+
+	// upload each chunk
+	err = forEachChunk(int(c.ServerCapabilities.ChunkSize), r.LocalFilename, localChunkCount, func(i int, b []byte) (bool, error) {
+		err := c.putFileChunk(r.LocalFilename, fi.FileID, fi.CurrentVersion.VersionID, i, b)
+		if err != nil {
+			return false, err
+		}
+
+		c.Printf("%s >>> %d / %d\n", r.RemoteFilepath, i+1, localChunkCount)
+		r.Chunks++
+		r.Bytes += int64(len(b))
+
+		return true, nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("Failed to upload the local file chunk for %s: %w", r.LocalFilename, err)
+	}
+
+	return nil
+}
+
+func (c *Client) syncUploadNew(r *FileReport, isDir bool, localPermissions uint32, localLastMod int64, localChunkCount int, localHash string, localMerkleRoot string) error {
+	// establish a new file on the remote freezer
+	fi, err := c.PutFile(r.RemoteFilepath, isDir, localPermissions, localLastMod, localChunkCount, localHash, localMerkleRoot)
+	if err != nil {
+		return err
+	}
+	r.fileID = fi.FileID
+	r.synced = syncRevision{fi.FileID, fi.CurrentVersion.VersionID, localHash}
+
+	// if we're uploading a new directory, stop here because there are no
+	// chunks to sync.
+	if isDir == true {
+		c.Printf("%s ==> directory created\n", r.RemoteFilepath)
+		return nil
+	}
+	if c.copyIdenticalChunks(r, fi.FileID, fi.CurrentVersion.VersionID, localChunkCount) {
+		return nil
+	}
+	err = r.state.startUpload(r.LocalFilename, fi.FileID, fi.CurrentVersion.VersionID)
+	if err != nil {
+		return err
+	}
+
+	// upload each chunk
+	err = forEachChunk(int(c.ServerCapabilities.ChunkSize), r.LocalFilename, localChunkCount, func(i int, b []byte) (bool, error) {
+		err := c.putFileChunk(r.LocalFilename, fi.FileID, fi.CurrentVersion.VersionID, i, b)
+		if err != nil {
+			return false, err
+		}
+
+		c.Printf("%s >>> %d / %d\n", r.RemoteFilepath, i+1, localChunkCount)
+		r.Chunks++
+		r.Bytes += int64(len(b))
+
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to upload the local file chunk for %s: %w", r.LocalFilename, err)
+	}
+
+	c.Printf("%s ==> uploaded\n", r.RemoteFilepath)
+	return nil
+}
+
+// copyIdenticalChunks has the server copy the chunks of the new file version
+// from an identical file the user already has and returns true if all of
+// them were copied, in which case nothing needs to be uploaded. Any failure
+// just means the chunks are uploaded as usual.
+func (c *Client) copyIdenticalChunks(r *FileReport, fileID int, versionID int, chunkCount int) bool {
+	if chunkCount == 0 {
+		return false
+	}
+	copied, err := c.CopyIdenticalChunks(fileID, versionID)
+	if err != nil {
+		c.Log.Debugf("Not copying the chunks of an identical file for %s: %v", r.RemoteFilepath, err)
+		return false
+	}
+	if copied != chunkCount {
+		return false
+	}
+	r.CopiedChunks = copied
+	c.Printf("%s ==> copied from an identical file\n", r.RemoteFilepath)
+	return true
+}
+
+// syncDownload downloads the file version into a partial file next to the
+// local file and checks it against fileHash before it replaces the local
+// file. A partial file that doesn't match is quarantined under the local
+// file name with SyncQuarantineSuffix and filefreezer.ErrHashMismatch is
+// returned.
+func (c *Client) syncDownload(r *FileReport, remoteID int, remoteVersionID int, chunkCount int, fileHash string) error {
+	partialFilename := r.LocalFilename + SyncPartialSuffix
+	err := c.syncDownloadChunks(r, partialFilename, remoteID, remoteVersionID, chunkCount, fileHash)
+	if errors.Is(err, filefreezer.ErrHashMismatch) {
+		quarantineFilename := r.LocalFilename + SyncQuarantineSuffix
+		if renameErr := os.Rename(partialFilename, quarantineFilename); renameErr != nil {
+			return fmt.Errorf("Failed to quarantine the download of %s: %v (%w)", r.RemoteFilepath, renameErr, err)
+		}
+		c.Printf("%s !!! quarantined as %s\n", r.RemoteFilepath, quarantineFilename)
+		return fmt.Errorf("The download of %s was quarantined as %s: %w", r.RemoteFilepath, quarantineFilename, err)
+	}
+	if err != nil {
+		// the partial file is kept to be resumed if the progress is recorded
+		if r.state == nil {
+			os.Remove(partialFilename)
+		}
+		return err
+	}
+
+	err = os.Rename(partialFilename, r.LocalFilename)
+	if err != nil {
+		os.Remove(partialFilename)
+		return fmt.Errorf("Failed to replace the local file %s with the download: %w", r.LocalFilename, err)
+	}
+
+	c.Printf("%s <== downloaded\n", r.RemoteFilepath)
+	return nil
+}
+
+// syncDownloadChunks writes the chunks of the file version to the local file
+// named filename and verifies the written data against fileHash.
+func (c *Client) syncDownloadChunks(r *FileReport, filename string, remoteID int, remoteVersionID int, chunkCount int, fileHash string) error {
+	// continue an interrupted download from the first chunk it didn't write
+	first, hasher := r.state.resumeDownload(r.LocalFilename, filename, remoteID, remoteVersionID, c.ServerCapabilities.ChunkSize)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if first > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+		c.Printf("%s <<< resuming at %d / %d\n", r.RemoteFilepath, first+1, chunkCount)
+	}
+	localFile, err := os.OpenFile(filename, flags, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("Failed to open local file (%s) for writing: %w", filename, err)
+	}
+	defer localFile.Close()
+
+	// the chunk hashes are needed to look up the chunks in the cache and
+	// to ask peers on the LAN for them
+	var chunkHashes map[int]string
+	if c.hasPeers() || c.Cache != nil {
+		chunkHashes, err = c.getChunkHashes(remoteID, remoteVersionID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// download each chunk and write it out to the file
+	for i := first; i < chunkCount; i++ {
+		hash := chunkHashes[i]
+		chunk, cached := c.cachedChunk(hash)
+		fromPeer := false
+		if !cached && hash != "" && c.hasPeers() {
+			chunk, fromPeer = c.getPeerChunk(hash)
+		}
+		if !cached && !fromPeer {
+			chunk, err = c.downloadChunk(context.Background(), remoteID, remoteVersionID, i, hash)
+			if err != nil {
+				return err
+			}
+		}
+
+		hasher.Write(chunk)
+		_, err = localFile.Write(chunk)
+		if err != nil {
+			return fmt.Errorf("Failed to write to the #%d chunk to the local file %s: %w", i, filename, err)
+		}
+		err = r.state.downloadedChunk(r.LocalFilename, remoteID, remoteVersionID, i+1)
+		if err != nil {
+			return err
+		}
+
+		if cached {
+			c.Printf("%s <<< %d / %d (cached)\n", r.RemoteFilepath, i+1, chunkCount)
+			r.CachedChunks++
+			continue
+		}
+		c.Printf("%s <<< %d / %d\n", r.RemoteFilepath, i+1, chunkCount)
+		r.Chunks++
+		if fromPeer {
+			r.PeerChunks++
+		}
+		r.Bytes += int64(len(chunk))
+	}
+
+	// the file hash covers the whole file, so this also catches chunks
+	// that are missing, out of order or from the wrong version
+	hash := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+	if hash != fileHash {
+		return fmt.Errorf("the downloaded data for %s is wrong: %w", r.RemoteFilepath, filefreezer.ErrHashMismatch)
+	}
+
+	return localFile.Close()
+}
+
+// getChunkHashes returns the hashes of the chunks of the file version
+// identified by fileID and versionID by chunk number.
+func (c *Client) getChunkHashes(fileID int, versionID int) (map[int]string, error) {
+	chunks, err := c.GetFileChunks(fileID, versionID)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[int]string, len(chunks))
+	for _, chunk := range chunks {
+		hashes[chunk.ChunkNumber] = chunk.ChunkHash
+	}
+	return hashes, nil
+}
@@ -0,0 +1,225 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tbogdala/filefreezer"
+)
+
+// SyncDeletion is a file or directory that a sync with SyncDeletes set
+// removes because it was removed on the other side since the last sync.
+type SyncDeletion struct {
+	LocalFilename  string
+	RemoteFilepath string
+	IsDir          bool
+
+	// Remote is true if the remote file is removed because the local one
+	// was, and false if the local file is removed because the remote one
+	// was.
+	Remote bool
+
+	// the remote file and the revision it's removed at
+	fileID   int
+	revision int
+}
+
+// String describes the deletion on one line.
+func (d SyncDeletion) String() string {
+	if d.Remote {
+		return fmt.Sprintf("%s --- removed from the server", d.RemoteFilepath)
+	}
+	return fmt.Sprintf("%s --- removed locally", d.LocalFilename)
+}
+
+// PlanSyncDeletes returns the files and directories that SyncDirectory
+// would remove when syncing localDir with remoteDir with SyncDeletes set,
+// without removing anything. Nothing is removed unless Revisions is set.
+func (c *Client) PlanSyncDeletes(localDir string, remoteDir string) ([]SyncDeletion, error) {
+	ignore, err := readIgnoreFile(localDir)
+	if err != nil {
+		return nil, err
+	}
+	remoteFileHashes, err := c.GetAllFileHashes()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get a list of remote file hashes: %w", err)
+	}
+	return c.planSyncDeletes(localDir, remoteDir, remoteFileHashes, ignore)
+}
+
+// planSyncDeletes works out the deletions for PlanSyncDeletes from the list
+// of remote files. A file only counts as removed on one side if Revisions
+// says it was synced before and the other side hasn't changed since, so a
+// file that's new on one side is synced as usual and a change always wins
+// over a removal. A directory is only removed along with everything in it.
+func (c *Client) planSyncDeletes(localDir string, remoteDir string, remoteFileHashes []filefreezer.FileInfo,
+	ignore *filefreezer.IgnoreRules) ([]SyncDeletion, error) {
+	if c.Revisions == nil {
+		return nil, nil
+	}
+
+	// the remote files that were removed locally
+	var deletions []SyncDeletion
+	remoteNames := make(map[string]bool)
+	var remoteEntries []SyncDeletion
+	for _, fi := range remoteFileHashes {
+		remoteFileName, err := c.DecryptString(fi.FileName)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decrypt remote file name for file id %d: %w", fi.FileID, err)
+		}
+		if !strings.HasPrefix(remoteFileName, remoteDir+"/") || c.excludedPath(remoteFileName[len(remoteDir):]) ||
+			ignore.Match(remoteFileName[len(remoteDir):], fi.IsDir) {
+			continue
+		}
+		localFileName := localDir + filepath.FromSlash(remoteFileName[len(remoteDir):])
+		remoteNames[c.foldName(remoteFileName)] = true
+		entry := SyncDeletion{LocalFilename: localFileName, RemoteFilepath: remoteFileName, IsDir: fi.IsDir,
+			Remote: true, fileID: fi.FileID, revision: fi.CurrentVersion.VersionID}
+		remoteEntries = append(remoteEntries, entry)
+	}
+	removed := make(map[string]bool)
+	for _, entry := range remoteEntries {
+		if _, err := os.Lstat(entry.LocalFilename); !os.IsNotExist(err) {
+			continue
+		}
+		base, found := c.Revisions.get(c.HostURI, entry.LocalFilename)
+		if found && base.FileID == entry.fileID && base.Revision == entry.revision {
+			removed[entry.RemoteFilepath] = true
+		}
+	}
+	for _, entry := range remoteEntries {
+		if removedEntry(remoteEntries, entry, removed) {
+			deletions = append(deletions, entry)
+		}
+	}
+
+	// the local files that were removed on the server
+	var localEntries []SyncDeletion
+	err := filepath.Walk(localDir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == localDir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if path == localDir {
+			return nil
+		}
+		rel, err := filepath.Rel(localDir, path)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(path, SyncPartialSuffix) || strings.HasSuffix(path, SyncQuarantineSuffix) ||
+			c.excluded(info.Name()) || c.isStateFile(path) || ignore.Match(filepath.ToSlash(rel), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		remoteFileName := remoteDir + "/" + filepath.ToSlash(rel)
+		if !remoteNames[c.foldName(remoteFileName)] {
+			localEntries = append(localEntries, SyncDeletion{LocalFilename: path, RemoteFilepath: remoteFileName, IsDir: info.IsDir()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to walk the local directory %s: %w", localDir, err)
+	}
+	removed = make(map[string]bool)
+	for _, entry := range localEntries {
+		base, found := c.Revisions.get(c.HostURI, entry.LocalFilename)
+		if !found {
+			continue
+		}
+		if !entry.IsDir {
+			localStats, err := filefreezer.CalcFileHashInfo(c.ServerCapabilities.ChunkSize, entry.LocalFilename)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to hash the local file %s: %w", entry.LocalFilename, err)
+			}
+			if localStats.HashString != base.Hash {
+				continue
+			}
+		}
+		removed[entry.RemoteFilepath] = true
+	}
+	for _, entry := range localEntries {
+		if removedEntry(localEntries, entry, removed) {
+			deletions = append(deletions, entry)
+		}
+	}
+
+	// the contents of directories are removed before the directories
+	sort.Slice(deletions, func(i, j int) bool {
+		return deletions[i].RemoteFilepath > deletions[j].RemoteFilepath
+	})
+	return deletions, nil
+}
+
+// removedEntry returns true if the entry is removed. A directory is only
+// removed along with everything inside it, and it's also removed if it had
+// no revision recorded, like a directory created by a download, as long as
+// something inside it was removed.
+func removedEntry(entries []SyncDeletion, entry SyncDeletion, removed map[string]bool) bool {
+	if !entry.IsDir {
+		return removed[entry.RemoteFilepath]
+	}
+	some := false
+	for _, inside := range entries {
+		if !strings.HasPrefix(inside.RemoteFilepath, entry.RemoteFilepath+"/") {
+			continue
+		}
+		if !removed[inside.RemoteFilepath] {
+			return false
+		}
+		some = true
+	}
+	return removed[entry.RemoteFilepath] || some
+}
+
+// syncDelete removes the file or directory of the deletion and forgets the
+// revision it was synced at. A remote file isn't removed if another client
+// changed it after the deletion was planned. A local directory that still
+// holds files that aren't synced, like ignored or excluded ones, is kept and
+// reported as skipped.
+func (c *Client) syncDelete(d SyncDeletion) FileReport {
+	report := FileReport{LocalFilename: d.LocalFilename, RemoteFilepath: d.RemoteFilepath, Action: SyncActionDeleted}
+	var err error
+	if d.Remote {
+		target := fmt.Sprintf("%s/api/file/%d", c.HostURI, d.fileID)
+		_, err = c.runAuthRequestIfMatch(context.Background(), target, "DELETE", c.AuthToken, nil, d.revision)
+	} else {
+		err = os.Remove(d.LocalFilename)
+		if err != nil && d.IsDir {
+			if entries, readErr := ioutil.ReadDir(d.LocalFilename); readErr == nil && len(entries) > 0 {
+				// its revision is kept, or recorded if it was created by a
+				// download, so that the next sync keeps it as well instead
+				// of taking it for a new directory
+				if _, found := c.Revisions.get(c.HostURI, d.LocalFilename); !found {
+					c.Revisions.set(c.HostURI, d.LocalFilename, syncRevision{})
+				}
+				report.Action = SyncActionSkipped
+				c.Printf("%s --- kept locally, it still holds files that aren't synced\n", d.LocalFilename)
+				return report
+			}
+		}
+	}
+	if err != nil {
+		report.Action = SyncActionFailed
+		report.Err = fmt.Errorf("Failed to remove %s: %w", d.RemoteFilepath, err)
+		return report
+	}
+	if d.Remote && d.IsDir {
+		c.forgetKnownDirs()
+	}
+	c.Revisions.forget(c.HostURI, d.LocalFilename)
+	c.Printf("%s\n", d.String())
+	return report
+}
@@ -0,0 +1,269 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The kinds of records written to a sync state file.
+const (
+	syncStateBegin    = "begin"    // the directories being synced
+	syncStateDone     = "done"     // a file that finished syncing
+	syncStateUpload   = "upload"   // a file version registered for an upload
+	syncStateDownload = "download" // a chunk written to a partial download
+)
+
+// syncStateRecord is one line of a sync state file.
+type syncStateRecord struct {
+	Op        string
+	Local     string `json:",omitempty"`
+	Remote    string `json:",omitempty"`
+	Host      string `json:",omitempty"`
+	IsDir     bool   `json:",omitempty"`
+	Size      int64  `json:",omitempty"`
+	ModTime   int64  `json:",omitempty"`
+	FileID    int    `json:",omitempty"`
+	VersionID int    `json:",omitempty"`
+	Chunks    int    `json:",omitempty"`
+}
+
+// syncState is the progress of a SyncDirectory call kept in
+// Client.SyncStateFile. Each change is appended to the file as a line of
+// JSON so that recording the progress of a huge tree stays cheap, and a
+// line cut short by a crash is dropped when the file is loaded again. The
+// server knows which chunks of an upload it already has, so only the file
+// version of an upload is recorded; downloads record every chunk written.
+type syncState struct {
+	lock      sync.Mutex
+	f         *os.File
+	enc       *json.Encoder
+	done      map[string]syncStateRecord
+	uploads   map[string]syncStateRecord
+	downloads map[string]syncStateRecord
+}
+
+// openSyncState opens the sync state file for syncing localDir with
+// remoteDir on hostURI and loads the progress recorded in it. A state file
+// left by a sync of other directories is started over.
+func openSyncState(filename string, hostURI string, localDir string, remoteDir string) (*syncState, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open the sync state file %s: %w", filename, err)
+	}
+	s := &syncState{
+		f:         f,
+		done:      make(map[string]syncStateRecord),
+		uploads:   make(map[string]syncStateRecord),
+		downloads: make(map[string]syncStateRecord),
+	}
+
+	begin := syncStateRecord{Op: syncStateBegin, Local: localDir, Remote: remoteDir, Host: hostURI}
+	valid, err := s.load(begin)
+	if err == nil {
+		_, err = f.Seek(valid, io.SeekStart)
+	}
+	if err == nil {
+		err = f.Truncate(valid)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Failed to read the sync state file %s: %w", filename, err)
+	}
+
+	s.enc = json.NewEncoder(f)
+	if valid == 0 {
+		if err = s.enc.Encode(begin); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("Failed to write the sync state file %s: %w", filename, err)
+		}
+	}
+	return s, nil
+}
+
+// load replays the records of the state file and returns the length of the
+// part of the file that can be kept, which is zero if it wasn't written for
+// the sync described by begin.
+func (s *syncState) load(begin syncStateRecord) (int64, error) {
+	r := bufio.NewReader(s.f)
+	var valid int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// an unterminated line is the record being written when the
+			// sync was interrupted
+			return valid, nil
+		} else if err != nil {
+			return 0, err
+		}
+
+		var rec syncStateRecord
+		if json.Unmarshal(line, &rec) != nil {
+			return valid, nil
+		}
+		if valid == 0 && rec != begin {
+			return 0, nil
+		}
+		s.apply(rec)
+		valid += int64(len(line))
+	}
+}
+
+// apply adds the record to the progress held in memory.
+func (s *syncState) apply(rec syncStateRecord) {
+	switch rec.Op {
+	case syncStateDone:
+		s.done[rec.Local] = rec
+		delete(s.uploads, rec.Local)
+		delete(s.downloads, rec.Local)
+	case syncStateUpload:
+		s.uploads[rec.Local] = rec
+	case syncStateDownload:
+		s.downloads[rec.Local] = rec
+	}
+}
+
+// write records the change both in memory and in the state file.
+func (s *syncState) write(rec syncStateRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.apply(rec)
+	if err := s.enc.Encode(rec); err != nil {
+		return fmt.Errorf("Failed to write the sync state file %s: %w", s.f.Name(), err)
+	}
+	return nil
+}
+
+// close closes the state file and removes it if the sync finished.
+func (s *syncState) close(finished bool) error {
+	err := s.f.Close()
+	if finished {
+		return os.Remove(s.f.Name())
+	}
+	return err
+}
+
+// isSameFile returns true if the local file still has the size and
+// modification time recorded for it.
+func isSameFile(rec syncStateRecord, localFilename string) bool {
+	info, err := os.Stat(localFilename)
+	if err != nil || info.IsDir() != rec.IsDir {
+		return false
+	}
+	return rec.IsDir || (info.Size() == rec.Size && info.ModTime().UnixNano() == rec.ModTime)
+}
+
+// isDone returns true if the local file finished syncing and hasn't changed
+// since then.
+func (s *syncState) isDone(localFilename string) bool {
+	if s == nil {
+		return false
+	}
+	s.lock.Lock()
+	rec, found := s.done[localFilename]
+	s.lock.Unlock()
+	return found && isSameFile(rec, localFilename)
+}
+
+// markDone records that the local file finished syncing.
+func (s *syncState) markDone(localFilename string) error {
+	if s == nil {
+		return nil
+	}
+	rec := syncStateRecord{Op: syncStateDone, Local: localFilename}
+	info, err := os.Stat(localFilename)
+	if err != nil {
+		// files that couldn't be synced, such as sockets, have nothing
+		// to resume
+		return nil
+	}
+	rec.IsDir, rec.Size, rec.ModTime = info.IsDir(), info.Size(), info.ModTime().UnixNano()
+	return s.write(rec)
+}
+
+// startUpload records the remote file version the local file is being
+// uploaded as.
+func (s *syncState) startUpload(localFilename string, fileID int, versionID int) error {
+	if s == nil {
+		return nil
+	}
+	info, err := os.Stat(localFilename)
+	if err != nil {
+		return err
+	}
+	return s.write(syncStateRecord{Op: syncStateUpload, Local: localFilename, Size: info.Size(),
+		ModTime: info.ModTime().UnixNano(), FileID: fileID, VersionID: versionID})
+}
+
+// upload returns the version of the remote file an interrupted upload of the
+// local file registered, if the local file hasn't changed since then.
+func (s *syncState) upload(localFilename string) (syncStateRecord, bool) {
+	if s == nil {
+		return syncStateRecord{}, false
+	}
+	s.lock.Lock()
+	rec, found := s.uploads[localFilename]
+	s.lock.Unlock()
+	return rec, found && isSameFile(rec, localFilename)
+}
+
+// downloadedChunk records that the chunks of the file version up to chunks
+// have been written to the partial download of the local file.
+func (s *syncState) downloadedChunk(localFilename string, fileID int, versionID int, chunks int) error {
+	if s == nil {
+		return nil
+	}
+	return s.write(syncStateRecord{Op: syncStateDownload, Local: localFilename, FileID: fileID, VersionID: versionID, Chunks: chunks})
+}
+
+// resumeDownload prepares the partial download of the file version for the
+// local file to be continued and returns the number of chunks already in it
+// along with a hash of their data. Zero chunks are returned if there's no
+// usable partial download, in which case it has to be started over.
+func (s *syncState) resumeDownload(localFilename string, partialFilename string, fileID int, versionID int, chunkSize int64) (int, hash.Hash) {
+	hasher := sha1.New()
+	if s == nil {
+		return 0, hasher
+	}
+	s.lock.Lock()
+	rec, found := s.downloads[localFilename]
+	s.lock.Unlock()
+	if !found || rec.FileID != fileID || rec.VersionID != versionID {
+		return 0, hasher
+	}
+
+	// every chunk but the last is a full chunk, so the chunks written are
+	// at the start of the partial file; anything after them was being
+	// written when the download stopped
+	f, err := os.OpenFile(partialFilename, os.O_RDWR, 0)
+	if err != nil {
+		return 0, hasher
+	}
+	defer f.Close()
+	length := int64(rec.Chunks) * chunkSize
+	n, err := io.Copy(hasher, io.LimitReader(f, length))
+	if err != nil || n != length || f.Truncate(length) != nil {
+		return 0, sha1.New()
+	}
+	return rec.Chunks, hasher
+}
+
+// isStateFile returns true if the local file is the sync state file, which
+// is never synced itself.
+func (c *Client) isStateFile(localFilename string) bool {
+	if c.SyncStateFile == "" {
+		return false
+	}
+	a, errA := filepath.Abs(localFilename)
+	b, errB := filepath.Abs(c.SyncStateFile)
+	return errA == nil && errB == nil && a == b
+}
@@ -0,0 +1,211 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// tagKey returns the key used to derive tag tokens, or nil if the client has
+// no crypto key to derive it from.
+func (c *Client) tagKey() []byte {
+	if len(c.CryptoKey) == 0 {
+		return nil
+	}
+	mac := hmac.New(sha256.New, c.CryptoKey)
+	mac.Write([]byte("filefreezer tags"))
+	return mac.Sum(nil)
+}
+
+// normalizeTag returns the form of the tag that is stored; tags are trimmed
+// and matched without regard to case.
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// tagToken returns the token the server uses to match the normalized tag.
+func (c *Client) tagToken(tag string) (string, error) {
+	key := c.tagKey()
+	if key == nil {
+		return "", fmt.Errorf("a crypto key is needed to tag files")
+	}
+	return searchToken(key, tag), nil
+}
+
+// AddFileTags adds the tags to the file with the filename. The tags are
+// encrypted before they are sent along with tokens that let the server find
+// the files with a tag without learning what it is.
+func (c *Client) AddFileTags(filename string, tags ...string) error {
+	fi, err := c.GetFileInfoByFilename(filename)
+	if err != nil {
+		return err
+	}
+
+	err = c.addFileTagsByID(fi.FileID, tags)
+	if err != nil {
+		return fmt.Errorf("Failed to tag the file %s: %w", filename, err)
+	}
+
+	c.Printf("Tagged file: %s\n", filename)
+
+	return nil
+}
+
+func (c *Client) addFileTagsByID(fileID int, tags []string) error {
+	var putReq models.FileTagsRequest
+	for _, tag := range tags {
+		tag = normalizeTag(tag)
+		if tag == "" {
+			return fmt.Errorf("tags can't be empty")
+		}
+		var ft filefreezer.FileTag
+		var err error
+		ft.Token, err = c.tagToken(tag)
+		if err != nil {
+			return err
+		}
+		ft.Tag, err = c.EncryptString(tag)
+		if err != nil {
+			return fmt.Errorf("Could not encrypt the tag before uploading: %w", err)
+		}
+		putReq.Tags = append(putReq.Tags, ft)
+	}
+
+	target := fmt.Sprintf("%s/api/file/%d/tags", c.HostURI, fileID)
+	_, err := c.RunAuthRequest(target, "PUT", c.AuthToken, putReq)
+	return err
+}
+
+// RemoveFileTags removes the tags from the file with the filename. Tags the
+// file doesn't have are ignored.
+func (c *Client) RemoveFileTags(filename string, tags ...string) error {
+	fi, err := c.GetFileInfoByFilename(filename)
+	if err != nil {
+		return err
+	}
+
+	var tokens []string
+	for _, tag := range tags {
+		token, err := c.tagToken(normalizeTag(tag))
+		if err != nil {
+			return err
+		}
+		tokens = append(tokens, token)
+	}
+
+	err = c.removeFileTagTokens(fi.FileID, tokens)
+	if err != nil {
+		return fmt.Errorf("Failed to remove the tags from the file %s: %w", filename, err)
+	}
+
+	c.Printf("Removed tags from file: %s\n", filename)
+
+	return nil
+}
+
+func (c *Client) removeFileTagTokens(fileID int, tokens []string) error {
+	query := url.Values{}
+	for _, token := range tokens {
+		query.Add("token", token)
+	}
+
+	target := fmt.Sprintf("%s/api/file/%d/tags?%s", c.HostURI, fileID, query.Encode())
+	_, err := c.RunAuthRequest(target, "DELETE", c.AuthToken, nil)
+	return err
+}
+
+// GetFileTags returns the decrypted tags of the file with the filename in
+// sorted order.
+func (c *Client) GetFileTags(filename string) ([]string, error) {
+	fi, err := c.GetFileInfoByFilename(filename)
+	if err != nil {
+		return nil, err
+	}
+	return c.getFileTagsByID(fi.FileID, filename)
+}
+
+// getFileTagsByID returns the decrypted tags of the file id, named filename,
+// in sorted order.
+func (c *Client) getFileTagsByID(fileID int, filename string) ([]string, error) {
+	target := fmt.Sprintf("%s/api/file/%d/tags", c.HostURI, fileID)
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the tags of the file %s: %w", filename, err)
+	}
+
+	var r models.FileTagsResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	tags := make([]string, 0, len(r.Tags))
+	for _, ft := range r.Tags {
+		tag, err := c.DecryptString(ft.Tag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt one of the tags: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// GetTags returns the decrypted tags used on the user's files mapped to the
+// number of files that have each tag.
+func (c *Client) GetTags() (map[string]int, error) {
+	target := fmt.Sprintf("%s/api/tags", c.HostURI)
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the tags: %w", err)
+	}
+
+	var r models.TagsGetResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	tags := make(map[string]int, len(r.Tags))
+	for _, ti := range r.Tags {
+		tag, err := c.DecryptString(ti.Tag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt one of the tags: %w", err)
+		}
+		tags[tag] += ti.FileCount
+	}
+	return tags, nil
+}
+
+// GetFilesByTag returns the files that have the tag. The file names are
+// still encrypted.
+func (c *Client) GetFilesByTag(tag string) ([]filefreezer.FileInfo, error) {
+	token, err := c.tagToken(normalizeTag(tag))
+	if err != nil {
+		return nil, err
+	}
+
+	target := fmt.Sprintf("%s/api/tags/%s/files", c.HostURI, token)
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the files tagged %s: %w", tag, err)
+	}
+
+	var r models.TaggedFilesGetResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	return r.Files, nil
+}
@@ -0,0 +1,381 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// AdminTransferFiles gives the files of the user named from to the user
+// named to, such as when an employee leaves. An empty path transfers all of
+// the user's files; otherwise the file named path, or the files in the
+// directory path and its subdirectories, are transferred. Finding the files
+// by path needs the crypto password of the user the files are taken from,
+// which is checked against the user's crypto hash. If the new owner has a
+// different crypto password they have to run Rekey before the files can be
+// used. The authenticated user must have administrator access.
+func (c *Client) AdminTransferFiles(from string, to string, path string, fromCryptoPass string) (*models.AdminTransferResponse, error) {
+	req := models.AdminTransferRequest{To: to, All: path == ""}
+	if path != "" {
+		var err error
+		req.FileIDs, err = c.adminFindUserFiles(from, path, fromCryptoPass)
+		if err != nil {
+			return nil, err
+		}
+		if len(req.FileIDs) == 0 {
+			return nil, fmt.Errorf("could not find the file: %s", path)
+		}
+	}
+
+	target := fmt.Sprintf("%s/api/admin/users/%s/transfer", c.HostURI, url.PathEscape(from))
+	body, err := c.RunAuthRequest(target, "POST", c.AuthToken, req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to transfer the files of the user %s: %w", from, err)
+	}
+
+	var r models.AdminTransferResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	c.Printf("Transferred %d files (%d bytes) from %s to %s\n", r.Files, r.Bytes, from, to)
+	if r.Rekey {
+		c.Printf("The files have to be re-keyed by %s before they can be used\n", to)
+	}
+	return &r, nil
+}
+
+// adminFindUserFiles returns the ids of the files of the user named username
+// that are named path or are in the directory path. The names are listed
+// with a read-only impersonation token and decrypted with the user's crypto
+// password.
+func (c *Client) adminFindUserFiles(username string, path string, cryptoPass string) ([]int, error) {
+	imp, err := c.adminImpersonate(username, 0, "finding the files to transfer")
+	if err != nil {
+		return nil, err
+	}
+
+	var userCipher ChunkCipher = PassthroughCipher{}
+	if len(imp.CryptoHash) > 0 {
+		key, err := filefreezer.VerifyCryptoPassword(cryptoPass, string(imp.CryptoHash))
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			return nil, fmt.Errorf("the cryptography password supplied for %s is invalid", username)
+		}
+		userCipher, err = NewAESGCMCipher(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	target := fmt.Sprintf("%s/api/files", c.HostURI)
+	body, err := c.RunAuthRequest(target, "GET", imp.Token, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the files of the user %s: %w", username, err)
+	}
+	var allFiles models.AllFilesGetResponse
+	err = json.Unmarshal(body, &allFiles)
+	if err != nil {
+		return nil, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	path = strings.TrimRight(path, "/")
+	var fileIDs []int
+	for _, fi := range allFiles.Files {
+		name, err := decryptStringWith(userCipher, fi.FileName)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decrypt remote file name for file id %d: %w", fi.FileID, err)
+		}
+		if name == path || strings.HasPrefix(name, path+"/") {
+			fileIDs = append(fileIDs, fi.FileID)
+		}
+	}
+	return fileIDs, nil
+}
+
+// Rekey re-encrypts the files transferred to the user from a user with a
+// different crypto password with the client's crypto key. oldCryptoPass is
+// the crypto password of the user the files came from. The chunks of every
+// version are downloaded, decrypted and uploaded again along with the note,
+// tags, attributes and name of the file, so the files can't be used until
+// they are re-keyed. A re-key that was interrupted can be run again. The
+// number of files re-keyed is returned.
+func (c *Client) Rekey(ctx context.Context, oldCryptoPass string) (int, error) {
+	target := fmt.Sprintf("%s/api/rekey", c.HostURI)
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get the files to re-key: %w", err)
+	}
+	var r models.RekeyGetResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return 0, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+	if len(r.Files) == 0 {
+		return 0, nil
+	}
+
+	// the names of the files that don't need re-keying can't be taken
+	pending := make(map[int]bool)
+	for _, rf := range r.Files {
+		pending[rf.FileID] = true
+	}
+	allFileInfos, err := c.GetAllFileHashes()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get the file list: %w", err)
+	}
+	taken := make(map[string]bool)
+	filesByID := make(map[int]filefreezer.FileInfo)
+	for _, fi := range allFileInfos {
+		if pending[fi.FileID] {
+			filesByID[fi.FileID] = fi
+			continue
+		}
+		name, err := c.DecryptString(fi.FileName)
+		if err != nil {
+			return 0, fmt.Errorf("failed to decrypt one of the file names: %w", err)
+		}
+		taken[c.foldName(name)] = true
+	}
+
+	// the old key is derived once for each crypto hash the files came with
+	ciphers := make(map[string]ChunkCipher)
+	rekeyed := 0
+	for _, rf := range r.Files {
+		fi, found := filesByID[rf.FileID]
+		if !found {
+			continue
+		}
+		oldCipher, found := ciphers[string(rf.CryptoHash)]
+		if !found {
+			oldCipher = PassthroughCipher{}
+			if len(rf.CryptoHash) > 0 {
+				key, err := filefreezer.VerifyCryptoPassword(oldCryptoPass, string(rf.CryptoHash))
+				if err != nil {
+					return rekeyed, err
+				}
+				if key == nil {
+					return rekeyed, fmt.Errorf("the old cryptography password is invalid for file id %d", rf.FileID)
+				}
+				oldCipher, err = NewAESGCMCipher(key)
+				if err != nil {
+					return rekeyed, err
+				}
+			}
+			ciphers[string(rf.CryptoHash)] = oldCipher
+		}
+
+		name, err := decryptStringWith(oldCipher, fi.FileName)
+		if err != nil {
+			return rekeyed, fmt.Errorf("Failed to decrypt remote file name for file id %d: %w", fi.FileID, err)
+		}
+		if taken[c.foldName(name)] {
+			return rekeyed, fmt.Errorf("the transferred file id %d is named %s, which is taken by another file; rename or remove that file first: %w",
+				fi.FileID, name, filefreezer.ErrFileExists)
+		}
+
+		err = c.rekeyFile(ctx, fi, name, oldCipher)
+		if err != nil {
+			return rekeyed, fmt.Errorf("Failed to re-key the file %s: %w", name, err)
+		}
+		taken[c.foldName(name)] = true
+		rekeyed++
+		c.Printf("Re-keyed file: %s\n", name)
+	}
+
+	return rekeyed, nil
+}
+
+// rekeyFile re-encrypts the chunks and metadata of the file with the
+// client's key and then gives it its re-encrypted name, which finishes the
+// re-key on the server. Data already re-encrypted by an earlier attempt is
+// left as is.
+func (c *Client) rekeyFile(ctx context.Context, fi filefreezer.FileInfo, name string, oldCipher ChunkCipher) error {
+	versions, err := c.getFileVersionsByID(fi.FileID)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		chunks, err := c.GetFileChunks(fi.FileID, v.VersionID)
+		if err != nil {
+			return err
+		}
+		for _, chunk := range chunks {
+			data, err := c.getChunk(ctx, fi.FileID, v.VersionID, chunk.ChunkNumber)
+			if err != nil {
+				return err
+			}
+			plain, done, err := c.rekeyDecrypt(oldCipher, data)
+			if err != nil || hashChunk(plain) != chunk.ChunkHash {
+				return fmt.Errorf("failed to decrypt the chunk #%d of version %d: %v", chunk.ChunkNumber, v.VersionNumber, err)
+			}
+			if done {
+				continue
+			}
+			err = c.RepairChunk(ctx, fi.FileID, v.VersionID, chunk.ChunkNumber, nil, plain)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// the note and attributes are single values that are simply replaced
+	var noteResp models.FileNoteResponse
+	err = c.getRekeyJSON(fmt.Sprintf("%s/api/file/%d/note", c.HostURI, fi.FileID), &noteResp)
+	if err != nil {
+		return err
+	}
+	if noteResp.Note != "" {
+		note, done, err := c.rekeyDecryptString(oldCipher, noteResp.Note)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt the note: %w", err)
+		}
+		if !done {
+			err = c.setFileNoteByID(fi.FileID, note)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var attrsResp models.FileAttributesResponse
+	err = c.getRekeyJSON(fmt.Sprintf("%s/api/file/%d/attributes", c.HostURI, fi.FileID), &attrsResp)
+	if err != nil {
+		return err
+	}
+	if attrsResp.Attributes != "" {
+		plain, done, err := c.rekeyDecryptString(oldCipher, attrsResp.Attributes)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt the file attributes: %w", err)
+		}
+		if !done {
+			var attrs FileAttributes
+			err = json.Unmarshal([]byte(plain), &attrs)
+			if err != nil {
+				return fmt.Errorf("failed to decode the file attributes: %w", err)
+			}
+			err = c.setFileAttributesByID(fi.FileID, attrs)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// the tags are added again with new tokens before the old ones are
+	// removed so that none are lost if the re-key is interrupted
+	var tagsResp models.FileTagsResponse
+	err = c.getRekeyJSON(fmt.Sprintf("%s/api/file/%d/tags", c.HostURI, fi.FileID), &tagsResp)
+	if err != nil {
+		return err
+	}
+	var tags, oldTokens []string
+	for _, ft := range tagsResp.Tags {
+		tag, done, err := c.rekeyDecryptString(oldCipher, ft.Tag)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt one of the tags: %w", err)
+		}
+		if !done {
+			tags = append(tags, tag)
+			oldTokens = append(oldTokens, ft.Token)
+		}
+	}
+	if len(tags) > 0 {
+		err = c.addFileTagsByID(fi.FileID, tags)
+		if err != nil {
+			return err
+		}
+		err = c.removeFileTagTokens(fi.FileID, oldTokens)
+		if err != nil {
+			return err
+		}
+	}
+
+	// renaming the file finishes the re-key
+	var putReq models.RekeyPutRequest
+	putReq.FileName, err = c.EncryptString(name)
+	if err != nil {
+		return fmt.Errorf("Could not encrypt the file name before uploading: %w", err)
+	}
+	putReq.NameKey = c.putNameKey(name)
+	target := fmt.Sprintf("%s/api/rekey/%d", c.HostURI, fi.FileID)
+	_, err = c.RunAuthRequest(target, "PUT", c.AuthToken, putReq)
+	if err != nil {
+		return err
+	}
+
+	// the search tokens were removed along with the old name
+	if c.searchKey() != nil {
+		var indexReq models.SearchIndexPutRequest
+		indexReq.Files = []models.SearchIndexEntry{{FileID: fi.FileID, Tokens: c.SearchTokens(name)}}
+		target = fmt.Sprintf("%s/api/search/index", c.HostURI)
+		_, err = c.RunAuthRequest(target, "PUT", c.AuthToken, indexReq)
+		if err != nil {
+			return fmt.Errorf("Failed to update the search index: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// getRekeyJSON gets the JSON object at target into v.
+func (c *Client) getRekeyJSON(target string, v interface{}) error {
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		return fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+	return nil
+}
+
+// rekeyDecrypt decrypts data of a file being re-keyed. The client's cipher
+// is tried first since an interrupted re-key leaves some of the data
+// re-encrypted already, in which case done is true; otherwise the data is
+// decrypted with oldCipher.
+func (c *Client) rekeyDecrypt(oldCipher ChunkCipher, sealed []byte) (plain []byte, done bool, err error) {
+	plain, err = c.decryptChunk(sealed)
+	if err == nil {
+		return plain, true, nil
+	}
+	plain, err = openChunk(oldCipher, sealed)
+	return plain, false, err
+}
+
+// rekeyDecryptString is rekeyDecrypt for the base64 encoded strings made by
+// EncryptString.
+func (c *Client) rekeyDecryptString(oldCipher ChunkCipher, encoded string) (string, bool, error) {
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false, err
+	}
+	plain, done, err := c.rekeyDecrypt(oldCipher, decoded)
+	return string(plain), done, err
+}
+
+// decryptStringWith decrypts the base64 encoded string made by EncryptString
+// with chunkCipher instead of the client's cipher.
+func decryptStringWith(chunkCipher ChunkCipher, encoded string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	decrypted, err := chunkCipher.Decrypt(decoded)
+	if err != nil {
+		return "", err
+	}
+	return string(decrypted), nil
+}
@@ -0,0 +1,255 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how requests that fail because of a network error or
+// a temporarily unavailable server get retried. Only requests that are safe
+// to repeat are retried, so creating files and versions is never retried.
+type RetryPolicy struct {
+	// MaxRetries is how many times a failed request is retried; zero
+	// disables retries.
+	MaxRetries int
+
+	// Backoff is the delay before the first retry. It doubles for every
+	// retry after that.
+	Backoff time.Duration
+
+	// MaxBackoff caps the delay between retries; zero leaves it uncapped.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is a retry policy suitable for interactive use.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 3,
+	Backoff:    500 * time.Millisecond,
+	MaxBackoff: 10 * time.Second,
+}
+
+// DefaultKeepAlive is the interval of the TCP keepalive probes that New sets
+// Client.KeepAlive to. It's well below the idle timeouts of common NAT
+// gateways and proxies.
+const DefaultKeepAlive = 30 * time.Second
+
+// idleConnTimeout is how long an unused connection is kept for the next
+// request, which is shorter than the idle timeouts of common proxies so
+// that a connection they closed isn't reused.
+const idleConnTimeout = 50 * time.Second
+
+// transportSettings are the settings of a Client that its transport is
+// made with.
+type transportSettings struct {
+	tlsCrt, tlsKey, caCert string
+	insecureSkipVerify     bool
+	keepAlive              time.Duration
+}
+
+// maxRetryAfter is the longest delay that a server's Retry-After header can
+// make a retry wait for.
+const maxRetryAfter = time.Minute
+
+// retryAfter returns the delay the server asked for with the Retry-After
+// header of the response, given in seconds, or 0 if it didn't ask for one.
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	delay := time.Duration(seconds) * time.Second
+	if delay > maxRetryAfter {
+		delay = maxRetryAfter
+	}
+	return delay
+}
+
+// isIdempotent returns true if a request with the HTTP method can be sent
+// again without changing the result.
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// shouldRetry returns true if the response or error from a request means
+// the server may succeed if the request is sent again.
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// do sends the request made by newRequest with client, retrying it according
+// to the retry policy if retry is true. A new request is made for every
+// attempt so that the body can be sent again. A retry waits at least as
+// long as the server asked for with Retry-After, such as when it limits the
+// requests per minute.
+func (c *Client) do(ctx context.Context, client *http.Client, retry bool, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	delay := c.Retry.Backoff
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if !retry || attempt >= c.Retry.MaxRetries || ctx.Err() != nil || !shouldRetry(resp, err) {
+			return resp, err
+		}
+
+		// drain the failed response so the connection can be reused
+		wait := delay
+		if after := retryAfter(resp); after > wait {
+			wait = after
+		}
+		reason := fmt.Sprintf("%v", err)
+		if resp != nil {
+			reason = resp.Status
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		c.Log.Infof("Retrying %s %s in %v (attempt %d of %d): %s", req.Method, req.URL, wait, attempt+1, c.Retry.MaxRetries, reason)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+		if c.Retry.MaxBackoff > 0 && delay > c.Retry.MaxBackoff {
+			delay = c.Retry.MaxBackoff
+		}
+	}
+}
+
+// getHTTPClient returns the http Client object to make requests with. This is
+// HTTPClient if it's set; otherwise a new client is configured with the
+// timeout and the shared transport.
+func (c *Client) getHTTPClient() (*http.Client, error) {
+	if c.HTTPClient != nil {
+		return c.HTTPClient, nil
+	}
+
+	transport, err := c.getTransport()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Timeout: c.Timeout, Transport: transport}, nil
+}
+
+// getTransport returns the transport shared by the requests, making a new one
+// if the TLS or keepalive settings changed since the last one was made. Its
+// connections send TCP keepalive probes every KeepAlive so that connections
+// waiting on a long request or in the pool aren't dropped silently.
+func (c *Client) getTransport() (*http.Transport, error) {
+	settings := transportSettings{
+		tlsCrt:             c.TLSCrt,
+		tlsKey:             c.TLSKey,
+		caCert:             c.CACert,
+		insecureSkipVerify: c.InsecureSkipVerify,
+		keepAlive:          c.KeepAlive,
+	}
+	c.transportLock.Lock()
+	defer c.transportLock.Unlock()
+	if c.transport != nil && c.transportSettings == settings {
+		return c.transport, nil
+	}
+
+	tlsConfig, err := c.getTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: c.KeepAlive}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       idleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	if c.transport != nil {
+		c.transport.CloseIdleConnections()
+	}
+	c.transport = transport
+	c.transportSettings = settings
+	return transport, nil
+}
+
+// getTLSConfig returns the TLS configuration for the TLS settings or nil if
+// none are set and the defaults should be used.
+func (c *Client) getTLSConfig() (*tls.Config, error) {
+	useKeyPair := c.TLSCrt != "" && c.TLSKey != ""
+	if !useKeyPair && c.CACert == "" && !c.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if useKeyPair {
+		cert, err := tls.LoadX509KeyPair(c.TLSCrt, c.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load cert: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+
+		// the certificate is trusted so that it can be self-signed
+		tlsConfig.RootCAs = x509.NewCertPool()
+		err = appendCertFile(tlsConfig.RootCAs, c.TLSCrt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.CACert != "" {
+		// trust the CA in addition to the system roots
+		if tlsConfig.RootCAs == nil {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			tlsConfig.RootCAs = pool
+		}
+		err := appendCertFile(tlsConfig.RootCAs, c.CACert)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// appendCertFile adds the PEM encoded certificates in the file to the pool.
+func appendCertFile(pool *x509.CertPool, certPath string) error {
+	pemData, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return fmt.Errorf("Failed to load the certificate file %s: %w", certPath, err)
+	}
+	ok := pool.AppendCertsFromPEM(pemData)
+	if !ok {
+		return fmt.Errorf("couldn't load PEM data for HTTPS client from %s", certPath)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// GetTrash returns the files in the user's trash, oldest first, along with
+// how long the server keeps them there. The file names are still encrypted.
+func (c *Client) GetTrash() ([]filefreezer.TrashedFile, time.Duration, error) {
+	target := fmt.Sprintf("%s/api/trash", c.HostURI)
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to get the trash: %w", err)
+	}
+
+	var r models.TrashGetResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	return r.Files, r.Retention, nil
+}
+
+// RestoreFile moves the file with the filename out of the trash. If the file
+// was removed more than once, the most recently removed one is restored.
+func (c *Client) RestoreFile(filename string) error {
+	trash, _, err := c.GetTrash()
+	if err != nil {
+		return err
+	}
+
+	// the trash is ordered oldest first so search from the end
+	for i := len(trash) - 1; i >= 0; i-- {
+		plaintextFilename, err := c.DecryptString(trash[i].FileName)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt one of the file names: %w", err)
+		}
+		if c.sameName(plaintextFilename, filename) {
+			return c.RestoreFileByID(trash[i].FileID)
+		}
+	}
+
+	return fmt.Errorf("the file %s is not in the trash", filename)
+}
+
+// RestoreFileByID moves the file with the file id out of the trash.
+func (c *Client) RestoreFileByID(fileID int) error {
+	target := fmt.Sprintf("%s/api/trash/%d/restore", c.HostURI, fileID)
+	_, err := c.RunAuthRequest(target, "POST", c.AuthToken, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to restore the file by file ID (%d): %w", fileID, err)
+	}
+
+	c.Printf("Restored file by ID: %d\n", fileID)
+
+	return nil
+}
+
+// EmptyTrash removes every file in the trash for good and returns the
+// number of files removed.
+func (c *Client) EmptyTrash() (int, error) {
+	target := fmt.Sprintf("%s/api/trash", c.HostURI)
+	body, err := c.RunAuthRequest(target, "DELETE", c.AuthToken, nil)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to empty the trash: %w", err)
+	}
+
+	var r models.TrashEmptyResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return 0, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	return r.Removed, nil
+}
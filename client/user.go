@@ -0,0 +1,100 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// GetUserStats returns a UserStats object for the authenticated user.
+// A non-nil error value is returned on failure.
+func (c *Client) GetUserStats() (stats filefreezer.UserStats, e error) {
+	// get the file id for the filename provided
+	target := fmt.Sprintf("%s/api/user/stats", c.HostURI)
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		e = fmt.Errorf("Failed to get the user stats: %w", err)
+		return
+	}
+	var r models.UserStatsGetResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		e = fmt.Errorf("Failed to get the user stats: %w", err)
+		return
+	}
+
+	c.Printf("Quota:     %v\n", r.Stats.Quota)
+	c.Printf("Allocated: %v\n", r.Stats.Allocated)
+	c.Printf("Logical:   %v\n", r.Stats.Logical)
+	c.Printf("Revision:  %v\n", r.Stats.Revision)
+	if r.QuotaWarning != nil {
+		c.Printf("Warning:   %s\n", r.QuotaWarning.Message)
+	}
+	c.Printf("Transfer:  %v bytes up and %v bytes down in %s\n", r.Transfer.BytesIn, r.Transfer.BytesOut, r.Transfer.Month)
+	if r.Transfer.Limit > 0 {
+		c.Printf("Limit:     %v bytes a month\n", r.Transfer.Limit)
+	}
+
+	stats = r.Stats
+	return
+}
+
+// GetAllFileHashes returns a slice of FileInfo objects for all files registered
+// to the authenticated user. A non-nil error value is returned on failure.
+func (c *Client) GetAllFileHashes() ([]filefreezer.FileInfo, error) {
+	target := fmt.Sprintf("%s/api/files", c.HostURI)
+	body, err := c.RunAuthRequest(target, "GET", c.AuthToken, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var allFiles models.AllFilesGetResponse
+	err = json.Unmarshal(body, &allFiles)
+	if err != nil {
+		return nil, fmt.Errorf("Poorly formatted response to %s: %w", target, err)
+	}
+
+	return allFiles.Files, nil
+}
+
+// SetCryptoHashForPassword sets the hash of the hash of the plaintext password on
+// the server for the authenticated user. This can then
+// be used to ensure the plaintext password entered by a user is the correct one
+// to decrypt the files without actually storing the crypto key (the hashed plaintext
+// password) on the server. A non-nil error value is returned on failure.
+func (c *Client) SetCryptoHashForPassword(cryptoPassword string) error {
+	// first we derive the crypto password bytes that are derived from the password text
+	_, _, combinedHashString, err := filefreezer.GenCryptoPasswordHash(cryptoPassword, true, "")
+	if err != nil {
+		return fmt.Errorf("Failed to generate the cryptography key from the password: %w", err)
+	}
+
+	var putReq models.UserCryptoHashUpdateRequest
+	putReq.CryptoHash = []byte(combinedHashString)
+
+	// get the file id for the filename provided
+	target := fmt.Sprintf("%s/api/user/cryptohash", c.HostURI)
+	body, err := c.RunAuthRequest(target, "PUT", c.AuthToken, putReq)
+	if err != nil {
+		return fmt.Errorf("http request to set the user's cryptohash failed: %w", err)
+	}
+
+	var r models.UserCryptoHashUpdateResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return fmt.Errorf("Failed to set the user's cryptography password hash: %w", err)
+	}
+
+	if r.Status != true {
+		return fmt.Errorf("an unknown error occurred while updating the cryptography password")
+	}
+
+	c.CryptoHash = putReq.CryptoHash
+	c.Println("Hash of cryptography password updated successfully.")
+	return nil
+}
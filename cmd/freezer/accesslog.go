@@ -0,0 +1,139 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/tbogdala/filefreezer"
+)
+
+// accessLogEntry is the information recorded for every API request.
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote"`
+	User       string    `json:"user"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Protocol   string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMS float64   `json:"duration_ms"`
+	RequestID  string    `json:"request_id"`
+}
+
+// accessLog writes one line per API request either in the Common Log Format
+// (with the request duration and id appended) or as a JSON object.
+type accessLog struct {
+	sync.Mutex
+	out     io.Writer
+	closer  io.Closer
+	useJSON bool
+}
+
+// newAccessLog creates an access log writing to the file at path. A path
+// of "-" writes to stdout.
+func newAccessLog(path string, useJSON bool) (*accessLog, error) {
+	l := new(accessLog)
+	l.useJSON = useJSON
+	if path == "-" {
+		l.out = os.Stdout
+		return l, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the access log file %s: %v", path, err)
+	}
+	l.out = f
+	l.closer = f
+	return l, nil
+}
+
+// Close closes the underlying file if one was opened.
+func (l *accessLog) Close() error {
+	if l.closer != nil {
+		return l.closer.Close()
+	}
+	return nil
+}
+
+// write formats the entry and writes it to the log output.
+func (l *accessLog) write(entry *accessLogEntry) {
+	var line []byte
+	if l.useJSON {
+		line, _ = json.Marshal(entry)
+	} else {
+		user := entry.User
+		if user == "" {
+			user = "-"
+		}
+		requestID := entry.RequestID
+		if requestID == "" {
+			requestID = "-"
+		}
+		line = []byte(fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d %.3f %s",
+			entry.RemoteAddr, user, entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			entry.Method, entry.Path, entry.Protocol, entry.Status, entry.Bytes, entry.DurationMS, requestID))
+	}
+	line = append(line, '\n')
+
+	l.Lock()
+	l.out.Write(line)
+	l.Unlock()
+}
+
+// accessLogMiddleware returns echo middleware that records every request
+// in the access log after the handler has run.
+func accessLogMiddleware(l *accessLog) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			start := time.Now()
+
+			// run the handler and let the error handler write the response
+			// for failures so that the status code is known.
+			if err = next(c); err != nil {
+				c.Error(err)
+			}
+
+			req := c.Request()
+			res := c.Response()
+			entry := &accessLogEntry{
+				Time:       start,
+				RemoteAddr: c.RealIP(),
+				Method:     req.Method,
+				Path:       req.URL.RequestURI(),
+				Protocol:   req.Proto,
+				Status:     res.Status,
+				Bytes:      res.Size,
+				DurationMS: float64(time.Since(start)) / float64(time.Millisecond),
+				RequestID:  requestID(c),
+			}
+			if entry.Status == 0 {
+				entry.Status = http.StatusOK
+			}
+
+			// the JWT middleware has stored the token for restricted routes
+			// and webdavAuth the user of the WebDAV share
+			if token, ok := c.Get(jwtContextName).(*jwt.Token); ok {
+				if claims, ok := token.Claims.(*jwtCustomClaims); ok {
+					entry.User = claims.Username
+				}
+			} else if user, ok := c.Get(webdavUserContextName).(*filefreezer.User); ok {
+				entry.User = user.Name
+			}
+
+			l.write(entry)
+			return
+		}
+	}
+}
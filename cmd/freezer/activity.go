@@ -0,0 +1,69 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+const (
+	// defaultActivityLogSize is the number of recent events kept in memory
+	// for the admin dashboard.
+	defaultActivityLogSize = 100
+)
+
+// activityLog is a fixed size, in-memory ring buffer of recent server events.
+type activityLog struct {
+	sync.Mutex
+	entries []models.ActivityEntry
+	next    int
+	full    bool
+}
+
+// newActivityLog creates a new activityLog that keeps up to size entries.
+func newActivityLog(size int) *activityLog {
+	a := new(activityLog)
+	a.entries = make([]models.ActivityEntry, size)
+	return a
+}
+
+// record adds a new event to the log, overwriting the oldest event if full.
+func (a *activityLog) record(userID int, username string, action string, detailFormat string, v ...interface{}) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.entries[a.next] = models.ActivityEntry{
+		Time:     time.Now().Unix(),
+		UserID:   userID,
+		UserName: username,
+		Action:   action,
+		Detail:   fmt.Sprintf(detailFormat, v...),
+	}
+	a.next = (a.next + 1) % len(a.entries)
+	if a.next == 0 {
+		a.full = true
+	}
+}
+
+// recent returns a copy of the logged events with the newest event first.
+func (a *activityLog) recent() []models.ActivityEntry {
+	a.Lock()
+	defer a.Unlock()
+
+	count := a.next
+	if a.full {
+		count = len(a.entries)
+	}
+
+	result := make([]models.ActivityEntry, 0, count)
+	for i := 1; i <= count; i++ {
+		idx := (a.next - i + len(a.entries)) % len(a.entries)
+		result = append(result, a.entries[idx])
+	}
+	return result
+}
@@ -0,0 +1,888 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+const (
+	// defaultUsageHistoryDays is the number of days of usage history returned
+	// by the usage report when the days query parameter isn't supplied.
+	defaultUsageHistoryDays = 30
+
+	// defaultAdminUsersLimit is the number of users returned by the user
+	// listing when the limit query parameter isn't supplied.
+	defaultAdminUsersLimit = 100
+
+	// maxAdminUsersLimit is the most users returned by one user listing.
+	maxAdminUsersLimit = 1000
+
+	// defaultLargestFiles is the number of each user's largest files in the
+	// storage overview when the top query parameter isn't supplied.
+	defaultLargestFiles = 10
+
+	// maxLargestFiles is the most of each user's largest files in the
+	// storage overview.
+	maxLargestFiles = 100
+)
+
+// requireAdmin is middleware that only lets the request through if the
+// authenticated user has administrator access. It must be used after
+// the JWT middleware.
+func requireAdmin(state *serverState) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			jwtToken := c.Get(jwtContextName).(*jwt.Token)
+			claims := jwtToken.Claims.(*jwtCustomClaims)
+
+			// impersonation tokens never grant administrator access, even
+			// when the impersonated user is an administrator
+			if claims.Subject == impersonationSubject {
+				return apiError(c, http.StatusForbidden, "Administrator access is required.")
+			}
+
+			// the admin flag is checked against storage on every request so
+			// that revoking access takes effect immediately.
+			user, err := state.Storage.GetUserByID(claims.UserID)
+			if err != nil || !user.IsAdmin || user.Status == filefreezer.UserStatusSuspended {
+				return apiError(c, http.StatusForbidden, "Administrator access is required.")
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// requireActiveUser returns the middleware rejecting the requests of users
+// that have been suspended so that a suspension takes effect immediately
+// instead of when the user's token expires.
+func requireActiveUser(state *serverState) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			claims := c.Get(jwtContextName).(*jwt.Token).Claims.(*jwtCustomClaims)
+			user, err := state.Storage.GetUserByID(claims.UserID)
+			if err != nil {
+				return apiError(c, http.StatusUnauthorized, "Could not find user in the database.")
+			}
+			if user.Status == filefreezer.UserStatusSuspended {
+				return apiError(c, http.StatusForbidden, "The account is suspended.")
+			}
+
+			// a namespace is suspended along with its account
+			if claims.OwnerID != 0 {
+				owner, err := state.Storage.GetUserByID(claims.OwnerID)
+				if err != nil {
+					return apiError(c, http.StatusUnauthorized, "Could not find user in the database.")
+				}
+				if owner.Status == filefreezer.UserStatusSuspended {
+					return apiError(c, http.StatusForbidden, "The account is suspended.")
+				}
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// handleGetAdminPage serves the embedded admin dashboard web page. The page
+// itself contains no data; it logs in through the API and then pulls the
+// dashboard information from /api/admin/dashboard and pages through the
+// users with /api/admin/users.
+func handleGetAdminPage(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.HTML(http.StatusOK, adminDashboardHTML)
+	}
+}
+
+// handleGetAdminDashboard returns a JSON object with all of the users and
+// their usage, recent server activity and server health information.
+func handleGetAdminDashboard(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		users, err := state.Storage.GetAllUserSummaries()
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to get the user summaries: "+err.Error())
+		}
+
+		var resp models.AdminDashboardResponse
+		resp.Users = users
+		for _, u := range users {
+			resp.TotalQuota += u.Quota
+			resp.TotalAllocated += u.Allocated
+		}
+		resp.Activity = state.Activity.recent()
+
+		// gather the server health information
+		var memStats runtime.MemStats
+		runtime.ReadMemStats(&memStats)
+		resp.Health.Uptime = int64(time.Since(state.StartTime) / time.Second)
+		resp.Health.Goroutines = runtime.NumGoroutine()
+		resp.Health.HeapAlloc = memStats.HeapAlloc
+		resp.Health.ChunkSize = state.Storage.ChunkSize
+		resp.Health.DBVersion, err = state.Storage.GetDBVersion()
+		if err != nil {
+			resp.Health.DBStatus = err.Error()
+		} else {
+			resp.Health.DBStatus = "ok"
+		}
+
+		return c.JSON(http.StatusOK, &resp)
+	}
+}
+
+// handleGetAdminUsage returns a JSON object with the current usage of every
+// user as well as the daily usage snapshots for the number of days specified
+// by the optional days query parameter.
+func handleGetAdminUsage(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		days := defaultUsageHistoryDays
+		if daysParam := c.QueryParam("days"); daysParam != "" {
+			var err error
+			days, err = strconv.Atoi(daysParam)
+			if err != nil || days < 1 {
+				return apiError(c, http.StatusBadRequest, "A valid positive integer was not used for the days parameter.")
+			}
+		}
+
+		users, err := state.Storage.GetAllUserSummaries()
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to get the user summaries: "+err.Error())
+		}
+
+		since := time.Now().AddDate(0, 0, -(days - 1))
+		snapshots, err := state.Storage.GetUsageSnapshots(since)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to get the usage snapshots: "+err.Error())
+		}
+
+		// group the snapshots by user
+		history := make(map[int][]filefreezer.UsageSnapshot)
+		for _, snap := range snapshots {
+			history[snap.UserID] = append(history[snap.UserID], snap)
+		}
+
+		resp := models.AdminUsageResponse{
+			Since: filefreezer.UsageSnapshotDay(since),
+			Users: make([]models.UserUsage, 0, len(users)),
+		}
+		for _, u := range users {
+			userHistory := history[u.ID]
+			if userHistory == nil {
+				userHistory = []filefreezer.UsageSnapshot{}
+			}
+			resp.Users = append(resp.Users, models.UserUsage{
+				UserID:       u.ID,
+				Name:         u.Name,
+				Quota:        u.Quota,
+				Allocated:    u.Allocated,
+				FileCount:    u.FileCount,
+				VersionCount: u.VersionCount,
+				History:      userHistory,
+			})
+		}
+
+		return c.JSON(http.StatusOK, &resp)
+	}
+}
+
+// usageExportColumns are the header of the CSV usage export.
+var usageExportColumns = []string{"UserID", "Name", "From", "To", "Days", "AverageAllocated", "PeakAllocated",
+	"Allocated", "FileCount", "VersionCount", "BytesIn", "BytesOut"}
+
+// handleGetAdminUsageExport returns the storage and transfer usage of every
+// user over a range of days for billing. The from and to query parameters
+// are days formatted as YYYY-MM-DD in UTC and default to the current month
+// so far. The format query parameter is json (the default) or csv.
+func handleGetAdminUsageExport(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		now := time.Now().UTC()
+		from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		to := now
+		var err error
+		if fromParam := c.QueryParam("from"); fromParam != "" {
+			from, err = time.Parse("2006-01-02", fromParam)
+			if err != nil {
+				return apiError(c, http.StatusBadRequest, "A valid YYYY-MM-DD day was not used for the from parameter.")
+			}
+		}
+		if toParam := c.QueryParam("to"); toParam != "" {
+			to, err = time.Parse("2006-01-02", toParam)
+			if err != nil {
+				return apiError(c, http.StatusBadRequest, "A valid YYYY-MM-DD day was not used for the to parameter.")
+			}
+		}
+		if from.After(to) {
+			return apiError(c, http.StatusBadRequest, "The from day must not be after the to day.")
+		}
+		format := c.QueryParam("format")
+		if format == "" {
+			format = "json"
+		}
+		if format != "json" && format != "csv" {
+			return apiError(c, http.StatusBadRequest, "The usage export format must be json or csv.")
+		}
+
+		reports, err := state.Storage.GetUsageReport(from, to)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to get the usage report: "+err.Error())
+		}
+
+		if format == "json" {
+			return c.JSON(http.StatusOK, &models.AdminUsageExportResponse{
+				From:  filefreezer.UsageSnapshotDay(from),
+				To:    filefreezer.UsageSnapshotDay(to),
+				Users: reports,
+			})
+		}
+
+		var buffer bytes.Buffer
+		w := csv.NewWriter(&buffer)
+		w.Write(usageExportColumns)
+		for _, r := range reports {
+			w.Write([]string{strconv.Itoa(r.UserID), r.Name, r.From, r.To, strconv.Itoa(r.Days),
+				strconv.FormatInt(r.AverageAllocated, 10), strconv.FormatInt(r.PeakAllocated, 10),
+				strconv.FormatInt(r.Allocated, 10), strconv.Itoa(r.FileCount), strconv.Itoa(r.VersionCount),
+				strconv.FormatInt(r.BytesIn, 10), strconv.FormatInt(r.BytesOut, 10)})
+		}
+		w.Flush()
+		if err = w.Error(); err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to write the usage export: "+err.Error())
+		}
+
+		filename := fmt.Sprintf("usage-%s-%s.csv", filefreezer.UsageSnapshotDay(from), filefreezer.UsageSnapshotDay(to))
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`, filename))
+		return c.Blob(http.StatusOK, "text/csv", buffer.Bytes())
+	}
+}
+
+// recordTransfer adds the uploaded and downloaded chunk bytes to the user's
+// transfer usage. Failures are logged since they shouldn't fail the request
+// being handled.
+func (state *serverState) recordTransfer(userID int, bytesIn int64, bytesOut int64) {
+	err := state.Storage.RecordTransfer(userID, bytesIn, bytesOut)
+	if err != nil {
+		state.Log.Errorf("Failed to record the transfer usage of user %d: %v", userID, err)
+	}
+}
+
+// handleGetAdminStorage returns a JSON object with the storage used by each
+// user and their largest files so that capacity can be planned. Files are
+// only identified by id and size; their names, which may be encrypted, are
+// never included. The optional top query parameter sets how many of each
+// user's largest files are returned.
+func handleGetAdminStorage(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		top := defaultLargestFiles
+		if topParam := c.QueryParam("top"); topParam != "" {
+			var err error
+			top, err = strconv.Atoi(topParam)
+			if err != nil || top < 0 || top > maxLargestFiles {
+				return apiError(c, http.StatusBadRequest, fmt.Sprintf("The top parameter must be between 0 and %d.", maxLargestFiles))
+			}
+		}
+
+		users, err := state.Storage.GetAllUserSummaries()
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to get the user summaries: "+err.Error())
+		}
+		largest, err := state.Storage.GetLargestFiles(top)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to get the largest files: "+err.Error())
+		}
+		dbSize, err := state.Storage.GetDatabaseSize()
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to get the database size: "+err.Error())
+		}
+
+		// group the largest files by user
+		files := make(map[int][]filefreezer.FileSize)
+		for _, f := range largest {
+			files[f.UserID] = append(files[f.UserID], f)
+		}
+
+		resp := models.AdminStorageResponse{
+			DatabaseSize: dbSize,
+			Users:        make([]models.UserStorage, 0, len(users)),
+		}
+		for _, u := range users {
+			userFiles := files[u.ID]
+			if userFiles == nil {
+				userFiles = []filefreezer.FileSize{}
+			}
+			resp.TotalAllocated += int64(u.Allocated)
+			resp.TotalFiles += u.FileCount
+			resp.TotalVersions += u.VersionCount
+			resp.Users = append(resp.Users, models.UserStorage{
+				UserID:       u.ID,
+				Name:         u.Name,
+				Quota:        u.Quota,
+				Allocated:    u.Allocated,
+				FileCount:    u.FileCount,
+				VersionCount: u.VersionCount,
+				LargestFiles: userFiles,
+			})
+		}
+
+		return c.JSON(http.StatusOK, &resp)
+	}
+}
+
+// handlePostAdminReload reloads the server configuration file and the TLS
+// certificates without restarting the server.
+func handlePostAdminReload(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		reloaded, err := state.reload()
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to reload the configuration: "+err.Error())
+		}
+		if reloaded == nil {
+			reloaded = []string{}
+		}
+
+		return c.JSON(http.StatusOK, &models.AdminReloadResponse{
+			Reloaded: reloaded,
+		})
+	}
+}
+
+// handlePostAdminVacuum rebuilds the database so that the space freed by
+// removed chunks is returned to the file system and returns the size of the
+// database before and after.
+func handlePostAdminVacuum(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims := c.Get(jwtContextName).(*jwt.Token).Claims.(*jwtCustomClaims)
+
+		before, after, err := state.Storage.Vacuum()
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to vacuum the database: "+err.Error())
+		}
+		state.Activity.record(claims.UserID, claims.Username, "database vacuumed", "%d bytes reclaimed", before-after)
+
+		return c.JSON(http.StatusOK, &models.AdminVacuumResponse{
+			SizeBefore: before,
+			SizeAfter:  after,
+		})
+	}
+}
+
+// handleGetAdminJobs returns the schedules of the maintenance jobs and how
+// their last runs on this server instance went.
+func handleGetAdminJobs(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, &models.AdminJobsResponse{
+			Jobs: state.Jobs.status(),
+		})
+	}
+}
+
+// adminUserParam returns the username in the name parameter of the URI.
+func adminUserParam(c echo.Context) string {
+	name := c.Param("name")
+	if unescaped, err := url.PathUnescape(name); err == nil {
+		name = unescaped
+	}
+	return name
+}
+
+// handleGetAdminUsers returns a JSON object with the information, usage
+// statistics and last login time of a page of users. The optional offset
+// and limit query parameters select the page.
+func handleGetAdminUsers(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		offset := 0
+		if offsetParam := c.QueryParam("offset"); offsetParam != "" {
+			var err error
+			offset, err = strconv.Atoi(offsetParam)
+			if err != nil || offset < 0 {
+				return apiError(c, http.StatusBadRequest, "A valid non-negative integer was not used for the offset parameter.")
+			}
+		}
+		limit := defaultAdminUsersLimit
+		if limitParam := c.QueryParam("limit"); limitParam != "" {
+			var err error
+			limit, err = strconv.Atoi(limitParam)
+			if err != nil || limit < 1 {
+				return apiError(c, http.StatusBadRequest, "A valid positive integer was not used for the limit parameter.")
+			}
+			if limit > maxAdminUsersLimit {
+				limit = maxAdminUsersLimit
+			}
+		}
+
+		users, total, err := state.Storage.GetUserSummaries(offset, limit)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to get the user summaries: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.AdminUsersGetResponse{
+			Users:  users,
+			Offset: offset,
+			Limit:  limit,
+			Total:  total,
+		})
+	}
+}
+
+// handleGetAdminUser returns a JSON object with the information, usage
+// statistics and last login time of the user named in the URI.
+func handleGetAdminUser(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := state.Storage.GetUser(adminUserParam(c))
+		if err != nil {
+			return apiError(c, http.StatusNotFound, "Failed to find the user.")
+		}
+		summary, err := state.Storage.GetUserSummary(user.ID)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to get the user summary: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.AdminUserGetResponse{
+			User: *summary,
+		})
+	}
+}
+
+// handlePostAdminUser adds a new user with the name, login password and
+// quota in the request, optionally with administrator access.
+func handlePostAdminUser(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// deserialize the JSON object that should be in the request body
+		var req models.AdminUserAddRequest
+		err := c.Bind(&req)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+		if req.Name == "" || req.Password == "" {
+			return apiError(c, http.StatusBadRequest, "Both the name and password must be supplied in the request.")
+		}
+		quota, err := state.QuotaPlans.resolve(req.Quota, req.Tier)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "Failed to choose the quota: "+err.Error())
+		}
+
+		free, err := state.Storage.IsUsernameFree(req.Name)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to check the username: "+err.Error())
+		}
+		if !free {
+			return apiError(c, http.StatusConflict, "The username is already taken.")
+		}
+
+		salt, saltedHash, err := filefreezer.GenLoginPasswordHash(req.Password)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to generate a password hash: "+err.Error())
+		}
+		user, err := state.Storage.AddUser(req.Name, salt, saltedHash, quota)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to create the user: "+err.Error())
+		}
+		if req.IsAdmin {
+			err = state.Storage.SetUserAdmin(user.ID, true)
+			if err != nil {
+				return apiError(c, http.StatusInternalServerError, "Failed to grant the user administrator access: "+err.Error())
+			}
+		}
+
+		state.Activity.record(claims.UserID, claims.Username, "user added", "user %s (id %d)", user.Name, user.ID)
+		state.Webhooks.send(webhookEventUserCreated, user.ID, user.Name, map[string]interface{}{
+			"quota": quota,
+			"admin": req.IsAdmin,
+		})
+
+		return c.JSON(http.StatusOK, &models.AdminUserAddResponse{
+			UserID: user.ID,
+		})
+	}
+}
+
+// handlePostAdminUserStatus changes the account status of the user in the
+// name parameter of the URI to status. Suspended users can't log in or use
+// the API but their files are kept until they're reactivated.
+func handlePostAdminUserStatus(state *serverState, status string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims := c.Get(jwtContextName).(*jwt.Token).Claims.(*jwtCustomClaims)
+
+		user, err := state.Storage.GetUser(adminUserParam(c))
+		if err != nil {
+			return apiError(c, http.StatusNotFound, "Failed to find the user.")
+		}
+		if user.ID == claims.UserID {
+			return apiError(c, http.StatusBadRequest, "Administrators can't change the status of their own account.")
+		}
+
+		err = state.Storage.SetUserStatus(user.ID, status)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to change the user's status: "+err.Error())
+		}
+
+		event := webhookEventUserSuspended
+		action := "user suspended"
+		if status == filefreezer.UserStatusActive {
+			event = webhookEventUserReactivated
+			action = "user reactivated"
+		}
+		state.Activity.record(claims.UserID, claims.Username, action, "user %s (id %d)", user.Name, user.ID)
+		state.Webhooks.send(event, user.ID, user.Name, nil)
+
+		return c.JSON(http.StatusOK, &models.AdminUserStatusResponse{
+			Status: status,
+		})
+	}
+}
+
+// handleGetAdminQuotaTiers returns the default quota for new users and the
+// quota tiers that can be assigned to users.
+func handleGetAdminQuotaTiers(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		defaultQuota, tiers := state.QuotaPlans.get()
+		return c.JSON(http.StatusOK, &models.AdminQuotaTiersResponse{
+			DefaultQuota: defaultQuota,
+			Tiers:        tiers,
+		})
+	}
+}
+
+// handlePostAdminUsersImport creates all of the users in the request at once
+// so that either every user is created or none are. Random passwords are
+// generated for the users without one and returned in the response.
+func handlePostAdminUsersImport(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims := c.Get(jwtContextName).(*jwt.Token).Claims.(*jwtCustomClaims)
+
+		var req models.AdminUsersImportRequest
+		err := c.Bind(&req)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+		if len(req.Users) == 0 {
+			return apiError(c, http.StatusBadRequest, "No users were supplied in the request.")
+		}
+
+		names := make(map[string]bool)
+		newUsers := make([]filefreezer.NewUser, len(req.Users))
+		imported := make([]models.AdminUserImported, len(req.Users))
+		for i, u := range req.Users {
+			if u.Name == "" {
+				return apiError(c, http.StatusBadRequest, fmt.Sprintf("The name of user %d must be supplied.", i+1))
+			}
+			quota, err := state.QuotaPlans.resolve(u.Quota, u.Tier)
+			if err != nil {
+				return apiError(c, http.StatusBadRequest, fmt.Sprintf("Failed to choose the quota for the user %s: %v", u.Name, err))
+			}
+			if names[u.Name] {
+				return apiError(c, http.StatusBadRequest, fmt.Sprintf("The user %s is in the request more than once.", u.Name))
+			}
+			names[u.Name] = true
+
+			free, err := state.Storage.IsUsernameFree(u.Name)
+			if err != nil {
+				return apiError(c, http.StatusInternalServerError, "Failed to check the username: "+err.Error())
+			}
+			if !free {
+				return apiError(c, http.StatusConflict, fmt.Sprintf("The username %s is already taken.", u.Name))
+			}
+
+			password := u.Password
+			if password == "" {
+				password, err = filefreezer.GenRandomPassword()
+				if err != nil {
+					return apiError(c, http.StatusInternalServerError, "Failed to generate a password: "+err.Error())
+				}
+				imported[i].Password = password
+			}
+			salt, saltedHash, err := filefreezer.GenLoginPasswordHash(password)
+			if err != nil {
+				return apiError(c, http.StatusInternalServerError, "Failed to generate a password hash: "+err.Error())
+			}
+			newUsers[i] = filefreezer.NewUser{Name: u.Name, Salt: salt, SaltedHash: saltedHash, Quota: quota}
+		}
+
+		users, err := state.Storage.AddUsers(newUsers)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to create the users: "+err.Error())
+		}
+		for i, user := range users {
+			imported[i].Name = user.Name
+			imported[i].UserID = user.ID
+			state.Activity.record(claims.UserID, claims.Username, "user added", "user %s (id %d)", user.Name, user.ID)
+			state.Webhooks.send(webhookEventUserCreated, user.ID, user.Name, map[string]interface{}{
+				"quota": newUsers[i].Quota,
+				"admin": false,
+			})
+		}
+
+		return c.JSON(http.StatusOK, &models.AdminUsersImportResponse{
+			Users: imported,
+		})
+	}
+}
+
+// handlePutAdminUser changes the quota, name, login password or
+// administrator access of the user named in the URI.
+func handlePutAdminUser(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// deserialize the JSON object that should be in the request body
+		var req models.AdminUserModRequest
+		err := c.Bind(&req)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+		if req.Quota < 0 {
+			return apiError(c, http.StatusBadRequest, "A negative quota was supplied in the request.")
+		}
+
+		user, err := state.Storage.GetUser(adminUserParam(c))
+		if err != nil {
+			return apiError(c, http.StatusNotFound, "Failed to find the user.")
+		}
+		stats, err := state.Storage.GetUserStats(user.ID)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to get the user stats: "+err.Error())
+		}
+
+		if req.Name != "" && req.Name != user.Name {
+			free, err := state.Storage.IsUsernameFree(req.Name)
+			if err != nil {
+				return apiError(c, http.StatusInternalServerError, "Failed to check the username: "+err.Error())
+			}
+			if !free {
+				return apiError(c, http.StatusConflict, "The new username is already taken.")
+			}
+			user.Name = req.Name
+		}
+		if req.Password != "" {
+			user.Salt, user.SaltedHash, err = filefreezer.GenLoginPasswordHash(req.Password)
+			if err != nil {
+				return apiError(c, http.StatusInternalServerError, "Failed to generate a password hash: "+err.Error())
+			}
+		}
+		if req.Tier != "" {
+			stats.Quota, err = state.QuotaPlans.resolve(req.Quota, req.Tier)
+			if err != nil {
+				return apiError(c, http.StatusBadRequest, "Failed to choose the quota: "+err.Error())
+			}
+		} else if req.Quota > 0 {
+			stats.Quota = req.Quota
+		}
+
+		// the crypto hash is only ever changed by the user
+		err = state.Storage.UpdateUser(user.ID, user.Name, user.Salt, user.SaltedHash, user.CryptoHash, stats.Quota)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to modify the user: "+err.Error())
+		}
+		if req.IsAdmin != nil {
+			err = state.Storage.SetUserAdmin(user.ID, *req.IsAdmin)
+			if err != nil {
+				return apiError(c, http.StatusInternalServerError, "Failed to change the user's administrator access: "+err.Error())
+			}
+		}
+		state.Activity.record(claims.UserID, claims.Username, "user modified", "user %s (id %d)", user.Name, user.ID)
+		state.checkQuota(user.ID, user.Name)
+
+		return c.JSON(http.StatusOK, &models.AdminUserModResponse{
+			Status: true,
+		})
+	}
+}
+
+// handleDeleteAdminUser removes the user named in the URI along with all of
+// the user's files.
+func handleDeleteAdminUser(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		user, err := state.Storage.GetUser(adminUserParam(c))
+		if err != nil {
+			return apiError(c, http.StatusNotFound, "Failed to find the user.")
+		}
+		if user.ID == claims.UserID {
+			return apiError(c, http.StatusBadRequest, "Administrators can't remove their own account.")
+		}
+
+		err = state.Storage.RemoveUser(user.Name)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to remove the user: "+err.Error())
+		}
+		state.Activity.record(claims.UserID, claims.Username, "user removed", "user %s (id %d)", user.Name, user.ID)
+		state.Webhooks.send(webhookEventUserRemoved, user.ID, user.Name, nil)
+
+		return c.JSON(http.StatusOK, &models.AdminUserRmResponse{
+			Status: true,
+		})
+	}
+}
+
+// adminDashboardHTML is the self-contained admin dashboard page.
+const adminDashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Filefreezer Admin</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+th { background: #eee; }
+.error { color: #b00; }
+#dashboard { display: none; }
+</style>
+</head>
+<body>
+<h1>Filefreezer Admin</h1>
+<form id="login">
+  <input id="user" placeholder="Username">
+  <input id="password" type="password" placeholder="Password">
+  <button type="submit">Log in</button>
+  <span id="loginError" class="error"></span>
+</form>
+<div id="dashboard">
+  <h2>Server Health</h2>
+  <table id="health"></table>
+  <h2>Users</h2>
+  <table id="users"></table>
+  <p>
+    <button id="prevUsers">Previous</button>
+    <span id="userPage"></span>
+    <button id="nextUsers">Next</button>
+  </p>
+  <h2>Recent Activity</h2>
+  <table id="activity"></table>
+</div>
+<script>
+var token = null;
+var userOffset = 0;
+var userLimit = 50;
+
+function esc(s) {
+  var d = document.createElement("div");
+  d.textContent = String(s);
+  return d.innerHTML;
+}
+
+function bytes(n) {
+  var units = ["B", "KB", "MB", "GB", "TB"];
+  var i = 0;
+  while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+  return n.toFixed(i == 0 ? 0 : 1) + " " + units[i];
+}
+
+function row(cells, tag) {
+  tag = tag || "td";
+  return "<tr>" + cells.map(function(c) { return "<" + tag + ">" + esc(c) + "</" + tag + ">"; }).join("") + "</tr>";
+}
+
+function render(d) {
+  var h = d.Health;
+  document.getElementById("health").innerHTML =
+    row(["Uptime", h.Uptime + " s"]) + row(["Database", h.DBStatus + " (version " + h.DBVersion + ")"]) +
+    row(["Goroutines", h.Goroutines]) + row(["Heap", bytes(h.HeapAlloc)]) + row(["Chunk size", bytes(h.ChunkSize)]) +
+    row(["Total allocated", bytes(d.TotalAllocated) + " of " + bytes(d.TotalQuota)]);
+
+  var activity = row(["Time", "User", "Action", "Detail"], "th");
+  (d.Activity || []).forEach(function(a) {
+    activity += row([new Date(a.Time * 1000).toLocaleString(), a.UserName, a.Action, a.Detail]);
+  });
+  document.getElementById("activity").innerHTML = activity;
+}
+
+function renderUsers(d) {
+  var users = row(["ID", "Name", "Admin", "Status", "Quota", "Allocated", "Used", "Files", "Revision", "Last login"], "th");
+  (d.Users || []).forEach(function(u) {
+    var used = u.Quota > 0 ? (100 * u.Allocated / u.Quota).toFixed(1) + "%" : "-";
+    var lastLogin = u.LastLogin > 0 ? new Date(u.LastLogin * 1000).toLocaleString() : "never";
+    users += row([u.ID, u.Name, u.IsAdmin ? "yes" : "", u.Status, bytes(u.Quota), bytes(u.Allocated), used, u.FileCount, u.Revision, lastLogin]);
+  });
+  document.getElementById("users").innerHTML = users;
+  var last = Math.min(d.Offset + d.Users.length, d.Total);
+  document.getElementById("userPage").textContent = (d.Total > 0 ? d.Offset + 1 : 0) + " to " + last + " of " + d.Total;
+  document.getElementById("prevUsers").disabled = d.Offset == 0;
+  document.getElementById("nextUsers").disabled = last >= d.Total;
+}
+
+function errorMessage(xhr) {
+  try {
+    return JSON.parse(xhr.responseText).message;
+  } catch (e) {
+    return xhr.responseText;
+  }
+}
+
+function get(path, onData) {
+  var xhr = new XMLHttpRequest();
+  xhr.open("GET", path);
+  xhr.setRequestHeader("Authorization", "Bearer " + token);
+  xhr.onload = function() {
+    if (xhr.status == 200) {
+      onData(JSON.parse(xhr.responseText));
+    } else {
+      token = null;
+      document.getElementById("dashboard").style.display = "none";
+      document.getElementById("login").style.display = "block";
+      document.getElementById("loginError").textContent = errorMessage(xhr);
+    }
+  };
+  xhr.send();
+}
+
+function refresh() {
+  if (!token) { return; }
+  get("api/admin/dashboard", render);
+  get("api/admin/users?offset=" + userOffset + "&limit=" + userLimit, renderUsers);
+}
+
+document.getElementById("prevUsers").onclick = function() {
+  userOffset = Math.max(0, userOffset - userLimit);
+  refresh();
+};
+
+document.getElementById("nextUsers").onclick = function() {
+  userOffset += userLimit;
+  refresh();
+};
+
+document.getElementById("login").onsubmit = function(e) {
+  e.preventDefault();
+  var xhr = new XMLHttpRequest();
+  xhr.open("POST", "api/users/login");
+  xhr.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+  xhr.onload = function() {
+    if (xhr.status != 200) {
+      document.getElementById("loginError").textContent = errorMessage(xhr);
+      return;
+    }
+    token = JSON.parse(xhr.responseText).Token;
+    document.getElementById("loginError").textContent = "";
+    document.getElementById("login").style.display = "none";
+    document.getElementById("dashboard").style.display = "block";
+    refresh();
+  };
+  xhr.send("user=" + encodeURIComponent(document.getElementById("user").value) +
+    "&password=" + encodeURIComponent(document.getElementById("password").value));
+};
+
+setInterval(refresh, 30000);
+</script>
+</body>
+</html>
+`
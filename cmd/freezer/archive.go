@@ -0,0 +1,114 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/tbogdala/filefreezer"
+)
+
+// archiveContentTypes are the content types sent for each archive format.
+var archiveContentTypes = map[string]string{
+	filefreezer.ArchiveTarGz: "application/gzip",
+	filefreezer.ArchiveZip:   "application/zip",
+}
+
+// handleGetDirArchive handles GET /api/dir/archive?path=...&format=tar.gz|zip
+// by streaming the current version of every file in the directory and its
+// subdirectories as a single archive. The server can only read the names and
+// data of accounts without a crypto password, so encrypted accounts have to
+// export on the client side with 'freezer export' instead.
+func handleGetDirArchive(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		format := c.QueryParam("format")
+		if format == "" {
+			format = filefreezer.ArchiveTarGz
+		}
+		contentType, supported := archiveContentTypes[format]
+		if !supported {
+			return apiError(c, http.StatusBadRequest, "The archive format must be tar.gz or zip.")
+		}
+
+		user, err := state.Storage.GetUserByID(claims.UserID)
+		if err != nil {
+			return apiError(c, http.StatusNotFound, "Failed to get the user.")
+		}
+		if len(user.CryptoHash) > 0 {
+			return apiError(c, http.StatusForbidden, "The server can't read encrypted files; use 'freezer export' to create the archive on the client.")
+		}
+
+		// find the files in the directory
+		dir := davPath(c.QueryParam("path"))
+		fs := &davFileSystem{store: state.Storage, userID: claims.UserID}
+		files, err := fs.files()
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to get files for the user.")
+		}
+		info, err := fs.stat(files, dir)
+		if err != nil || !info.isDir {
+			return apiError(c, http.StatusNotFound, "The path is not a directory.")
+		}
+		prefix := dir
+		if prefix != "/" {
+			prefix += "/"
+		}
+		var names []string
+		for name, fi := range files {
+			// versions still being uploaded don't have all of their chunks
+			if strings.HasPrefix(name, prefix) && fi.CurrentVersion.LastMod != webdavPlaceholderLastMod {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		archiveName := path.Base(dir)
+		if dir == "/" {
+			archiveName = "freezer"
+		}
+		c.Response().Header().Set(echo.HeaderContentType, contentType)
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.%s"`, archiveName, format))
+		c.Response().WriteHeader(http.StatusOK)
+
+		// the status has been sent, so an error can only cut the archive short
+		archive, _ := filefreezer.NewArchiveWriter(c.Response(), format)
+		for _, name := range names {
+			err = addArchiveFile(fs, archive, name, name[len(prefix):], files[name])
+			if err != nil {
+				state.Log.Errorf("Failed to add %s to the archive for user %d: %v", name, claims.UserID, err)
+				return nil
+			}
+		}
+		if err = archive.Close(); err != nil {
+			state.Log.Errorf("Failed to finish the archive for user %d: %v", claims.UserID, err)
+		}
+		return nil
+	}
+}
+
+// addArchiveFile adds the stored file or directory to the archive as archiveName.
+func addArchiveFile(fs *davFileSystem, archive filefreezer.ArchiveWriter, name string, archiveName string, fi filefreezer.FileInfo) error {
+	modTime := time.Unix(fi.CurrentVersion.LastMod, 0)
+	mode := os.FileMode(fi.CurrentVersion.Permissions)
+	if fi.IsDir {
+		return archive.AddDir(archiveName, mode, modTime)
+	}
+
+	info, err := fs.fileInfo(name, fi)
+	if err != nil {
+		return err
+	}
+	return archive.AddFile(archiveName, info.size, mode, modTime, &davReadFile{fs: fs, info: info})
+}
@@ -0,0 +1,69 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// handleGetFileAttributes returns the encrypted platform attributes stored
+// for a file, which are empty if none were stored.
+func handleGetFileAttributes(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		attributes, err := state.Storage.GetFileAttributes(claims.UserID, int(fileID))
+		if err != nil {
+			return storageError(c, err, http.StatusNotFound, "Failed to get the attributes of the file: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.FileAttributesResponse{Attributes: attributes})
+	}
+}
+
+// handlePutFileAttributes stores the platform attributes of a file or
+// removes them if the attributes in the request are empty.
+func handlePutFileAttributes(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		// deserialize the JSON object that should be in the request body
+		var req models.FileAttributesPutRequest
+		err = c.Bind(&req)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+		if len(req.Attributes) > filefreezer.MaxAttributesLength {
+			return apiError(c, http.StatusBadRequest, "attributes must be at most "+strconv.Itoa(filefreezer.MaxAttributesLength)+" bytes")
+		}
+
+		err = state.Storage.SetFileAttributes(claims.UserID, int(fileID), req.Attributes)
+		if err != nil {
+			return storageError(c, err, http.StatusNotFound, "Failed to set the attributes of the file: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.FileAttributesResponse{Attributes: req.Attributes})
+	}
+}
@@ -0,0 +1,528 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/client"
+	"github.com/tbogdala/filefreezer/client/cloudimport"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+const (
+	// backupFilePrefix and backupFileSuffix surround the time stamp in the
+	// names of the database snapshots; only the files named like this are
+	// rotated out of the backup directory.
+	backupFilePrefix = "freezer-backup-"
+	backupFileSuffix = ".db"
+
+	// backupChecksumSuffix is added to the name of a snapshot for the file
+	// holding its SHA-256 checksum, in the format of sha256sum.
+	backupChecksumSuffix = ".sha256"
+
+	// backupTimeFormat is the time stamp in the snapshot names. It sorts
+	// in the order the snapshots were taken.
+	backupTimeFormat = "20060102-150405.000000"
+
+	// defaultBackupKeep is the number of snapshots kept in the backup
+	// directory if no number is given.
+	defaultBackupKeep = 7
+)
+
+// backupTarget is somewhere the database snapshots are copied to after
+// they are taken.
+type backupTarget interface {
+	// upload copies the snapshot file at localPath to the target as name.
+	upload(ctx context.Context, name string, localPath string) error
+
+	// String describes the target without its credentials.
+	String() string
+}
+
+// parseBackupTarget returns the backup target for the URL given on the
+// command line. An s3://bucket/prefix URL uploads to an S3 bucket with the
+// credentials in the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables; the region and the endpoint of an
+// S3 compatible service can be given with the region and endpoint query
+// parameters. An http(s)://user:password@host/dir URL uploads to a directory
+// on another freezer server, encrypted with cryptoPass.
+func parseBackupTarget(target string, cryptoPass string) (backupTarget, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup target %q: %v", target, err)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid backup target %q: expected s3://bucket/prefix", target)
+		}
+		return &s3BackupTarget{
+			prefix: strings.TrimLeft(u.Path, "/"),
+			s3:     newS3Client(u),
+		}, nil
+
+	case "http", "https":
+		password, _ := u.User.Password()
+		if u.User.Username() == "" || password == "" {
+			return nil, fmt.Errorf("invalid backup target %q: expected a user name and password", u.Redacted())
+		}
+		if cryptoPass == "" {
+			return nil, fmt.Errorf("the backup target %s needs a crypto password to encrypt the backups with", u.Redacted())
+		}
+		return &freezerBackupTarget{
+			host:       u.Scheme + "://" + u.Host,
+			username:   u.User.Username(),
+			password:   password,
+			cryptoPass: cryptoPass,
+			dir:        path.Clean("/" + u.Path),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("invalid backup target %q: expected an s3:// or https:// URL", u.Redacted())
+}
+
+// newS3Client returns the client for the bucket of an s3://bucket/prefix URL
+// with the credentials in the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables and the region and endpoint given
+// by the region and endpoint query parameters. The region defaults to the
+// AWS_REGION environment variable.
+func newS3Client(u *url.URL) *cloudimport.S3 {
+	region := u.Query().Get("region")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	return &cloudimport.S3{
+		Bucket:       u.Host,
+		Region:       region,
+		Endpoint:     u.Query().Get("endpoint"),
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// s3BackupTarget uploads the snapshots to an S3 bucket under a key prefix.
+type s3BackupTarget struct {
+	s3     *cloudimport.S3
+	prefix string
+}
+
+func (t *s3BackupTarget) upload(ctx context.Context, name string, localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return t.s3.Put(ctx, path.Join(t.prefix, name), f, info.Size())
+}
+
+func (t *s3BackupTarget) String() string {
+	return "s3://" + path.Join(t.s3.Bucket, t.prefix)
+}
+
+// freezerBackupTarget uploads the snapshots to a directory on another
+// freezer server, encrypted like any other client upload.
+type freezerBackupTarget struct {
+	host       string
+	username   string
+	password   string
+	cryptoPass string
+	dir        string
+}
+
+func (t *freezerBackupTarget) upload(ctx context.Context, name string, localPath string) error {
+	c := client.New()
+	err := c.Login(t.host, t.username, t.password)
+	if err != nil {
+		return fmt.Errorf("failed to log in to %s: %v", t.host, err)
+	}
+	if len(c.CryptoHash) == 0 {
+		err = c.SetCryptoHashForPassword(t.cryptoPass)
+		if err != nil {
+			return fmt.Errorf("failed to set the crypto password on %s: %v", t.host, err)
+		}
+	}
+	c.CryptoKey, err = filefreezer.VerifyCryptoPassword(t.cryptoPass, string(c.CryptoHash))
+	if err != nil || c.CryptoKey == nil {
+		return fmt.Errorf("the crypto password isn't the one of the account on %s", t.host)
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = c.UploadReaderModTime(ctx, path.Join(t.dir, name), f, info.ModTime())
+	return err
+}
+
+func (t *freezerBackupTarget) String() string {
+	return t.username + "@" + t.host + t.dir
+}
+
+// backupDatabase takes a snapshot of the database in the backup directory,
+// removes the oldest snapshots beyond the number to keep and uploads the
+// new snapshot to the backup target if there is one.
+func (state *serverState) backupDatabase() (string, error) {
+	name := backupFilePrefix + time.Now().UTC().Format(backupTimeFormat) + backupFileSuffix
+	snapshotPath := filepath.Join(state.BackupDir, name)
+
+	// the snapshot is written under a temporary name so that a failed
+	// backup never looks like a complete one
+	partialPath := snapshotPath + ".partial"
+	os.Remove(partialPath)
+	size, err := state.Storage.Backup(partialPath)
+	if err != nil {
+		os.Remove(partialPath)
+		return "", fmt.Errorf("failed to back up the database: %v", err)
+	}
+	err = os.Rename(partialPath, snapshotPath)
+	if err != nil {
+		os.Remove(partialPath)
+		return "", fmt.Errorf("failed to move the database backup into place: %v", err)
+	}
+	err = writeBackupChecksum(snapshotPath)
+	if err != nil {
+		return "", err
+	}
+	state.Activity.record(filefreezer.NoUserID, "", "database backed up", "%s, %d bytes", name, size)
+
+	removed, err := rotateBackups(state.BackupDir, state.BackupKeep)
+	if err != nil {
+		return "", err
+	}
+
+	result := fmt.Sprintf("backed up %d bytes to %s; %d old backups removed", size, name, removed)
+	if state.BackupTarget != nil {
+		for _, upload := range []string{name, name + backupChecksumSuffix} {
+			err = state.BackupTarget.upload(context.Background(), upload, filepath.Join(state.BackupDir, upload))
+			if err != nil {
+				return "", fmt.Errorf("failed to upload the database backup to %s: %v", state.BackupTarget, err)
+			}
+		}
+		result += "; uploaded to " + state.BackupTarget.String()
+	}
+	return result, nil
+}
+
+// rotateBackups removes the oldest database snapshots in dir, along with
+// their checksum files, so that at most keep of them are left and returns how
+// many were removed.
+func rotateBackups(dir string, keep int) (int, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list the database backups: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, backupFilePrefix) && strings.HasSuffix(name, backupFileSuffix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	removed := 0
+	for len(names)-removed > keep {
+		err = os.Remove(filepath.Join(dir, names[removed]))
+		if err != nil {
+			return removed, fmt.Errorf("failed to remove an old database backup: %v", err)
+		}
+		err = os.Remove(filepath.Join(dir, names[removed]+backupChecksumSuffix))
+		if err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("failed to remove the checksum of an old database backup: %v", err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// handlePostAdminBackup snapshots the live database with the online backup
+// of its provider, without stopping the server, and returns the snapshot
+// with its checksum in the models.HeaderBackupChecksum header. The snapshot
+// is taken in a temporary directory that is removed once it has been sent.
+func handlePostAdminBackup(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims := c.Get(jwtContextName).(*jwt.Token).Claims.(*jwtCustomClaims)
+
+		tempDir, err := ioutil.TempDir("", "freezer-backup")
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to create a directory for the database backup: "+err.Error())
+		}
+		defer os.RemoveAll(tempDir)
+
+		name := backupFilePrefix + time.Now().UTC().Format(backupTimeFormat) + backupFileSuffix
+		snapshotPath := filepath.Join(tempDir, name)
+		_, err = state.Storage.Backup(snapshotPath)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to back up the database: "+err.Error())
+		}
+		sum, err := hashBackup(snapshotPath)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to calculate the checksum of the database backup: "+err.Error())
+		}
+		f, err := os.Open(snapshotPath)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to open the database backup: "+err.Error())
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to open the database backup: "+err.Error())
+		}
+		state.Activity.record(claims.UserID, claims.Username, "database backed up", "%s, %d bytes, downloaded", name, info.Size())
+
+		c.Response().Header().Set(echo.HeaderContentType, echo.MIMEOctetStream)
+		c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(info.Size(), 10))
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`, name))
+		c.Response().Header().Set(models.HeaderBackupChecksum, sum)
+		c.Response().WriteHeader(http.StatusOK)
+
+		// the status has been sent, so an error can only cut the backup
+		// short, which the client catches with the checksum
+		_, err = io.Copy(c.Response(), f)
+		if err != nil {
+			state.Log.Errorf("Failed to send the database backup %s: %v", name, err)
+		}
+		return nil
+	}
+}
+
+// saveAdminBackup downloads a snapshot of the server database taken while
+// it keeps running and saves it to dest, or to a file in dest named by the
+// server if dest is a directory, with its checksum next to it so that
+// dbrestore can check it. The snapshot is written under a temporary name
+// until it's complete. The path it was saved to and its size are returned.
+func saveAdminBackup(c *client.Client, dest string) (string, int64, error) {
+	destDir := filepath.Dir(filepath.Clean(dest))
+	info, err := os.Stat(dest)
+	isDir := err == nil && info.IsDir()
+	if isDir {
+		destDir = dest
+	}
+	partial, err := ioutil.TempFile(destDir, ".freezer-backup-*.partial")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create the backup file: %v", err)
+	}
+	defer os.Remove(partial.Name())
+
+	name, size, err := c.AdminBackup(context.Background(), partial)
+	if closeErr := partial.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to write the backup file: %v", closeErr)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	snapshotPath := dest
+	if isDir {
+		if name == "" || name != filepath.Base(name) {
+			name = backupFilePrefix + time.Now().UTC().Format(backupTimeFormat) + backupFileSuffix
+		}
+		snapshotPath = filepath.Join(dest, name)
+	}
+	err = os.Rename(partial.Name(), snapshotPath)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to move the backup into place: %v", err)
+	}
+	err = writeBackupChecksum(snapshotPath)
+	if err != nil {
+		// a snapshot without its checksum can't be restored with dbrestore
+		os.Remove(snapshotPath)
+		return "", 0, err
+	}
+	return snapshotPath, size, nil
+}
+
+// hashBackup returns the SHA-256 checksum of the file at path as hex.
+func hashBackup(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// writeBackupChecksum writes the checksum of the snapshot at snapshotPath
+// next to it so that the snapshot can be checked before it's restored, by
+// dbrestore or by sha256sum -c.
+func writeBackupChecksum(snapshotPath string) error {
+	sum, err := hashBackup(snapshotPath)
+	if err != nil {
+		return fmt.Errorf("failed to calculate the checksum of the database backup: %v", err)
+	}
+	line := fmt.Sprintf("%s  %s\n", sum, filepath.Base(snapshotPath))
+	err = ioutil.WriteFile(snapshotPath+backupChecksumSuffix, []byte(line), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write the checksum of the database backup: %v", err)
+	}
+	return nil
+}
+
+// verifyBackupChecksum checks the snapshot at snapshotPath against the
+// checksum written next to it when it was taken.
+func verifyBackupChecksum(snapshotPath string) error {
+	checksumPath := snapshotPath + backupChecksumSuffix
+	line, err := ioutil.ReadFile(checksumPath)
+	if err != nil {
+		return fmt.Errorf("failed to read the checksum of the backup from %s: %v", checksumPath, err)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return fmt.Errorf("the checksum file %s is empty", checksumPath)
+	}
+	sum, err := hashBackup(snapshotPath)
+	if err != nil {
+		return fmt.Errorf("failed to calculate the checksum of the backup: %v", err)
+	}
+	if !strings.EqualFold(fields[0], sum) {
+		return fmt.Errorf("the backup %s doesn't match its checksum; it may be damaged or incomplete", snapshotPath)
+	}
+	return nil
+}
+
+// databaseFilePath returns the path of the database file named by the --db
+// flag, which may be a sqlite URI like the default file:freezer.db.
+func databaseFilePath(path string) string {
+	filePath := strings.TrimPrefix(path, "file:")
+	if i := strings.Index(filePath, "?"); i >= 0 {
+		filePath = filePath[:i]
+	}
+	return filePath
+}
+
+// restoreDatabase restores the snapshot at snapshotPath as a new database at
+// dbPath. The snapshot is checked against its checksum, unless skipChecksum
+// is set, and with the SQLite integrity check; its tables are then upgraded
+// and the fsck repairs are run on it. The restored database is only moved to
+// dbPath once it passed every check, so a server can't be started on a
+// database that is half restored. The problems repaired by fsck are returned.
+func restoreDatabase(snapshotPath string, dbPath string, skipChecksum bool) ([]filefreezer.FsckProblem, error) {
+	if _, ok := filefreezer.ProviderFor(dbPath).(filefreezer.SQLiteProvider); !ok {
+		return nil, fmt.Errorf("snapshots can only be restored to a sqlite database; restore PostgreSQL and MySQL databases with their own tools")
+	}
+	dbFilePath := databaseFilePath(dbPath)
+	if _, err := os.Stat(dbFilePath); err == nil {
+		return nil, fmt.Errorf("a database already exists at %s; move it out of the way to restore a backup in its place", dbFilePath)
+	}
+	if !skipChecksum {
+		err := verifyBackupChecksum(snapshotPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// restore into a copy next to the database so that the checks never
+	// change the snapshot and the rename at the end is atomic
+	restoringPath := dbFilePath + ".restoring"
+	os.Remove(restoringPath)
+	err := copyBackup(snapshotPath, restoringPath)
+	if err != nil {
+		os.Remove(restoringPath)
+		return nil, fmt.Errorf("failed to copy the backup: %v", err)
+	}
+	problems, err := checkRestoredDatabase(restoringPath)
+	if err != nil {
+		os.Remove(restoringPath)
+		return nil, err
+	}
+
+	err = os.Rename(restoringPath, dbFilePath)
+	if err != nil {
+		os.Remove(restoringPath)
+		return nil, fmt.Errorf("failed to move the restored database into place: %v", err)
+	}
+	return problems, nil
+}
+
+// checkRestoredDatabase runs the integrity check, table upgrades and fsck
+// repairs on the database restored at path.
+func checkRestoredDatabase(path string) ([]filefreezer.FsckProblem, error) {
+	store, err := filefreezer.NewStorage(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the restored database: %v", err)
+	}
+	defer store.Close()
+
+	damage, err := store.IntegrityCheck()
+	if err != nil {
+		return nil, err
+	}
+	if len(damage) > 0 {
+		return nil, fmt.Errorf("the backup is damaged: %s", strings.Join(damage, "; "))
+	}
+
+	version, err := store.GetDBVersion()
+	if err != nil {
+		return nil, fmt.Errorf("the backup isn't a freezer database: %v", err)
+	}
+	if version > filefreezer.CurrentDBVersion {
+		return nil, fmt.Errorf("the backup has schema version %d, which is newer than this build supports (%d)", version, filefreezer.CurrentDBVersion)
+	}
+	err = store.CreateTables()
+	if err != nil {
+		return nil, fmt.Errorf("failed to upgrade the tables of the restored database: %v", err)
+	}
+
+	problems, err := store.Fsck(true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check the restored database: %v", err)
+	}
+	return problems, nil
+}
+
+// copyBackup copies the file at src to a new file at dst.
+func copyBackup(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,119 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/client/cloudimport"
+)
+
+// s3ChunkRequestTimeout limits how long reading or writing one chunk in the
+// bucket may take.
+const s3ChunkRequestTimeout = 2 * time.Minute
+
+// s3ChunkStore is a filefreezer.ChunkStore that keeps the chunks as objects
+// in an S3 bucket, or a bucket of an S3 compatible service like MinIO, under
+// a key prefix. The chunks are encrypted by the clients before they are
+// uploaded, so the bucket only ever holds encrypted data.
+type s3ChunkStore struct {
+	s3 *cloudimport.S3
+}
+
+// parseChunkBucket returns the chunk store for the s3://bucket/prefix URL
+// given with --chunkbucket. The credentials, region and endpoint are given
+// the same way as for a backup target.
+func parseChunkBucket(target string) (*s3ChunkStore, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chunk bucket %q: %v", target, err)
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("invalid chunk bucket %q: expected s3://bucket/prefix", target)
+	}
+
+	s3 := newS3Client(u)
+	s3.Prefix = strings.Trim(u.Path, "/")
+	if s3.Prefix != "" {
+		s3.Prefix += "/"
+	}
+	return &s3ChunkStore{s3: s3}, nil
+}
+
+// objectKey returns the key of the object holding the chunk with the key,
+// sharded by its first bytes like the files of a chunk directory.
+func (cs *s3ChunkStore) objectKey(key string) string {
+	return cs.s3.Prefix + path.Join(key[:2], key[2:4], key)
+}
+
+// Put uploads the chunk data. Data that is already in the bucket is uploaded
+// again, which is as cheap as checking for it and refreshes its last
+// modified time so that a sweep running now keeps it.
+func (cs *s3ChunkStore) Put(data []byte) (string, error) {
+	key := filefreezer.ChunkStoreKey(data)
+	ctx, cancel := context.WithTimeout(context.Background(), s3ChunkRequestTimeout)
+	defer cancel()
+	err := cs.s3.Put(ctx, cs.objectKey(key), bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("failed to upload the chunk to the bucket: %v", err)
+	}
+	return key, nil
+}
+
+// Get downloads the data of the chunk with the key.
+func (cs *s3ChunkStore) Get(key string) ([]byte, error) {
+	if !filefreezer.IsChunkStoreKey(key) {
+		return nil, fmt.Errorf("invalid chunk store key %q", key)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3ChunkRequestTimeout)
+	defer cancel()
+	body, err := cs.s3.Open(ctx, cloudimport.Entry{ID: cs.objectKey(key)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download the chunk from the bucket: %v", err)
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download the chunk from the bucket: %v", err)
+	}
+	return data, nil
+}
+
+// Sweep removes the chunk objects under the prefix whose key isn't in
+// referenced if they were last modified before the time given. Uploads are
+// never left half written, so there is nothing else to clean up.
+func (cs *s3ChunkStore) Sweep(referenced map[string]bool, before time.Time) (int, int64, error) {
+	var removed int
+	var freed int64
+	ctx := context.Background()
+	err := cs.s3.Walk(ctx, func(e cloudimport.Entry) error {
+		key := path.Base(e.Path)
+		if !filefreezer.IsChunkStoreKey(key) || referenced[key] || !e.ModTime.Before(before) {
+			return nil
+		}
+		err := cs.s3.Delete(ctx, e.ID)
+		if err != nil {
+			return err
+		}
+		removed++
+		freed += e.Size
+		return nil
+	})
+	if err != nil {
+		return removed, freed, fmt.Errorf("failed to sweep the chunk bucket %s: %v", cs, err)
+	}
+	return removed, freed, nil
+}
+
+func (cs *s3ChunkStore) String() string {
+	return "s3://" + path.Join(cs.s3.Bucket, cs.s3.Prefix)
+}
@@ -0,0 +1,56 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// jwtSecretName is the name of the shared secret used to sign JWT
+	// tokens when a secret isn't given on the command line.
+	jwtSecretName = "jwt"
+
+	// jwtSecretSize is the size in bytes of the generated JWT secret.
+	jwtSecretSize = 32
+)
+
+// newInstanceID returns a name for this server process that is unique among
+// the instances sharing a database. It identifies the holder of job locks.
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano())
+}
+
+// runExclusive runs job only if this instance holds the advisory lock for
+// the named job, taking the lock if it's free. The lock is held for ttl and
+// renewed on every call, so ttl should be longer than the interval between
+// calls for the instance running the job to keep it. Background jobs use
+// this so that only one of the instances sharing a database runs them.
+func (state *serverState) runExclusive(name string, ttl time.Duration, job func()) {
+	acquired, err := state.Storage.AcquireJobLock(name, state.InstanceID, ttl)
+	if err != nil {
+		state.Log.Errorf("Failed to acquire the lock for the %s job: %v", name, err)
+		return
+	}
+	if !acquired {
+		state.Log.Debugf("Skipping the %s job; another instance holds the lock.", name)
+		return
+	}
+	job()
+}
+
+// releaseJob releases the advisory lock for the named job if this instance
+// holds it so that another instance can take over the job right away.
+func (state *serverState) releaseJob(name string) {
+	err := state.Storage.ReleaseJobLock(name, state.InstanceID)
+	if err != nil {
+		state.Log.Errorf("Failed to release the lock for the %s job: %v", name, err)
+	}
+}
@@ -4,71 +4,19 @@
 package command
 
 import (
-	"fmt"
-
-	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+	"github.com/tbogdala/filefreezer/client"
 )
 
-// State tracks the state of the freezer commands during execution.
+// State tracks the state of the freezer commands during execution. The
+// commands that talk to a server go through the embedded Client.
 type State struct {
-	// the host URI used for calls
-	HostURI string
-
-	// the authentication token returned after logging in
-	AuthToken string
-
-	// the stored crypto hash for the client that is used
-	// to verify the client-entered plaintext password.
-	CryptoHash []byte
-
-	// the key used to encrypt/decrypt file chunks and names
-	// and is derived from a plaintext password.
-	CryptoKey []byte
-
-	// the capabilities returned by the authenticated server
-	ServerCapabilities models.ServerCapabilities
-
-	// an overridable Println implementation that defaults to using
-	// the fmt package version from the stdlib.
-	Println func(v ...interface{})
-
-	// an overridable Printf implementation that defaults to using
-	// the fmt package version from the stdlib.
-	Printf func(format string, v ...interface{})
-
-	// the HTTPS TLS public crt file
-	TLSCrt string
-
-	// the HTTPS TLS private key file
-	TLSKey string
-
-	// extra strict file checking during sync operations
-	ExtraStrict bool
+	*client.Client
 }
 
-// NewState creates a new State object.
+// NewState creates a new State object that prints its progress.
 func NewState() *State {
 	s := new(State)
+	s.Client = client.New()
 	s.SetQuiet(false)
 	return s
 }
-
-func defaultPrintln(v ...interface{}) {
-	fmt.Println(v...)
-}
-
-func defaultPrintf(format string, v ...interface{}) {
-	fmt.Printf(format, v...)
-}
-
-// SetQuiet will alter the Printf and Println functions to either
-// write or suppress output depending on the quiet flag.
-func (s *State) SetQuiet(quiet bool) {
-	if quiet {
-		s.Printf = func(format string, v ...interface{}) {}
-		s.Println = func(v ...interface{}) {}
-	} else {
-		s.Println = defaultPrintln
-		s.Printf = defaultPrintf
-	}
-}
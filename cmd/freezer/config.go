@@ -0,0 +1,171 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/tbogdala/filefreezer/cmd/freezer/logging"
+)
+
+// serverConfig holds the server settings that can be changed while the
+// server is running by reloading the configuration file. Settings that
+// are left out of the file keep their current values.
+type serverConfig struct {
+	// LogLevel is the minimum level of log messages to write
+	// (debug, info, warn, error).
+	LogLevel string
+
+	// QuotaThresholds are the percentages of a user's quota that trigger
+	// a quota notification.
+	QuotaThresholds []int
+
+	// DefaultQuota is the quota in bytes of new users that aren't given a
+	// quota or quota tier.
+	DefaultQuota int
+
+	// QuotaTiers maps the names of the quota tiers that can be assigned to
+	// users to their quota in bytes. They replace all of the current tiers.
+	QuotaTiers map[string]int
+}
+
+// loadServerConfig reads the JSON configuration file at path.
+func loadServerConfig(path string) (*serverConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the config file %s: %v", path, err)
+	}
+
+	config := new(serverConfig)
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the config file %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// certReloader serves the TLS certificate for the server and allows the
+// certificate files to be read again without restarting the listener.
+type certReloader struct {
+	sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+}
+
+// newCertReloader creates a certReloader and loads the certificate files.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := new(certReloader)
+	r.certFile = certFile
+	r.keyFile = keyFile
+	err := r.reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload reads the certificate files again. The current certificate is kept
+// if the files can't be loaded.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load the TLS key pair (%s, %s): %v", r.certFile, r.keyFile, err)
+	}
+
+	r.Lock()
+	r.cert = &cert
+	r.Unlock()
+	return nil
+}
+
+// GetCertificate returns the current certificate and is meant to be used
+// as the GetCertificate callback in tls.Config.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.cert, nil
+}
+
+// applyConfig changes the running server to use the configuration settings
+// and returns the names of the settings that were applied.
+func (state *serverState) applyConfig(config *serverConfig) ([]string, error) {
+	var applied []string
+
+	// validate everything before changing anything so that a bad
+	// config file doesn't leave the server half updated
+	var level logging.Level
+	if config.LogLevel != "" {
+		var err error
+		level, err = logging.ParseLevel(config.LogLevel)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range config.QuotaThresholds {
+		if t < 1 {
+			return nil, fmt.Errorf("invalid quota threshold percentage: %d", t)
+		}
+	}
+	if config.DefaultQuota < 0 {
+		return nil, fmt.Errorf("invalid default quota: %d", config.DefaultQuota)
+	}
+	for name, quota := range config.QuotaTiers {
+		if name == "" || quota < 1 {
+			return nil, fmt.Errorf("invalid quota tier %q: %d", name, quota)
+		}
+	}
+
+	if config.LogLevel != "" {
+		logger.SetLevel(level)
+		applied = append(applied, "LogLevel")
+	}
+	if len(config.QuotaThresholds) > 0 {
+		state.Quota.setThresholds(config.QuotaThresholds)
+		applied = append(applied, "QuotaThresholds")
+	}
+	if config.DefaultQuota > 0 {
+		state.QuotaPlans.set(config.DefaultQuota, nil)
+		applied = append(applied, "DefaultQuota")
+	}
+	if config.QuotaTiers != nil {
+		state.QuotaPlans.set(0, config.QuotaTiers)
+		applied = append(applied, "QuotaTiers")
+	}
+
+	return applied, nil
+}
+
+// reload reads the configuration file, if one was given, and the TLS
+// certificates again and applies them to the running server. Active
+// connections and transfers are not interrupted. The names of the settings
+// that were reloaded are returned.
+func (state *serverState) reload() ([]string, error) {
+	var reloaded []string
+	if state.ConfigPath != "" {
+		config, err := loadServerConfig(state.ConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		reloaded, err = state.applyConfig(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if state.Certs != nil {
+		err := state.Certs.reload()
+		if err != nil {
+			return reloaded, err
+		}
+		reloaded = append(reloaded, "TLSCertificates")
+	}
+
+	state.Log.Infof("Configuration reloaded: %v", reloaded)
+	return reloaded, nil
+}
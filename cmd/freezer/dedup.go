@@ -0,0 +1,51 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// handlePostChunkCopy fills in the chunks of the file version given in the
+// parameters from another of the user's file versions with the same hash,
+// if there is one, and returns the number of chunks copied.
+func handlePostChunkCopy(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+		versionID, err := strconv.ParseInt(c.Param("versionID"), 10, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the version id in the URI.")
+		}
+
+		copied, err := state.Storage.CopyIdenticalChunks(claims.UserID, int(fileID), int(versionID))
+		state.StorageCap.check(claims.UserID, claims.Username, err)
+		if err != nil {
+			return storageError(c, err, http.StatusInternalServerError, "Failed to copy the chunks of an identical file: "+err.Error())
+		}
+		if copied > 0 {
+			state.checkQuota(claims.UserID, claims.Username)
+			if state.Webhooks != nil {
+				state.Webhooks.send(webhookEventFileUploaded, claims.UserID, claims.Username, map[string]interface{}{
+					"fileID":    fileID,
+					"versionID": versionID,
+				})
+			}
+		}
+
+		return c.JSON(http.StatusOK, &models.FileChunksCopyResponse{ChunksCopied: copied})
+	}
+}
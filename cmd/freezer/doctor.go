@@ -0,0 +1,214 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/client"
+	"github.com/tbogdala/filefreezer/cmd/freezer/command"
+)
+
+const (
+	// doctorCertExpiryWarning is how far ahead of a TLS certificate expiring
+	// the doctor command starts warning about it.
+	doctorCertExpiryWarning = 30 * 24 * time.Hour
+)
+
+// The possible results of a doctor check.
+const (
+	doctorOK   = "OK"
+	doctorWarn = "WARN"
+	doctorFail = "FAIL"
+	doctorSkip = "SKIP"
+)
+
+// doctor runs the self-test checks and prints the results with a hint on
+// how to fix each problem found.
+type doctor struct {
+	cmdState *command.State
+	failures int
+	warnings int
+}
+
+// report prints the result of a check. The hint is only printed for
+// results other than OK.
+func (d *doctor) report(result string, check string, detail string, hint string) {
+	switch result {
+	case doctorFail:
+		d.failures++
+	case doctorWarn:
+		d.warnings++
+	}
+
+	d.cmdState.Printf("[%-4s] %s: %s\n", result, check, detail)
+	if hint != "" && result != doctorOK {
+		d.cmdState.Printf("       -> %s\n", hint)
+	}
+}
+
+// run performs all of the checks and returns true if none of them failed.
+func (d *doctor) run() bool {
+	d.checkDatabase()
+	d.checkTLS()
+	if d.checkServer() {
+		d.checkChunkRoundTrip()
+	}
+
+	d.cmdState.Printf("\n%d failure(s), %d warning(s)\n", d.failures, d.warnings)
+	return d.failures == 0
+}
+
+// checkDatabase verifies that the local database can be opened and has the
+// schema version that this build expects.
+func (d *doctor) checkDatabase() {
+	const check = "database"
+	path := *flagDatabasePath
+
+	// the path may be a sqlite URI, like the default file:freezer.db, so
+	// pull out the file path before making sure it exists
+	filePath := databaseFilePath(path)
+	_, isSQLite := filefreezer.ProviderFor(path).(filefreezer.SQLiteProvider)
+	if filePath != ":memory:" && isSQLite {
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			d.report(doctorSkip, check, fmt.Sprintf("no database found at %s", filePath),
+				"The database is created by 'freezer user add'; use --db if it lives elsewhere.")
+			return
+		}
+	}
+
+	// open the database directly instead of through openStorage so that
+	// the doctor never creates or upgrades tables
+	store, err := filefreezer.NewStorage(path)
+	if err != nil {
+		d.report(doctorFail, check, err.Error(), "Check the path given by --db and the file permissions.")
+		return
+	}
+	defer store.Close()
+
+	version, err := store.GetDBVersion()
+	switch {
+	case err != nil:
+		d.report(doctorFail, check, fmt.Sprintf("could not read the schema version: %v", err),
+			"The file may not be a freezer database or may be corrupt; restore it from a backup.")
+	case version < filefreezer.CurrentDBVersion:
+		d.report(doctorWarn, check, fmt.Sprintf("schema version %d is older than the current version %d", version, filefreezer.CurrentDBVersion),
+			"The schema is upgraded the next time 'freezer serve' or a 'freezer user' command opens the database.")
+	case version > filefreezer.CurrentDBVersion:
+		d.report(doctorFail, check, fmt.Sprintf("schema version %d is newer than this build supports (%d)", version, filefreezer.CurrentDBVersion),
+			"Upgrade freezer to a version that supports this database.")
+	default:
+		d.report(doctorOK, check, fmt.Sprintf("%s (schema version %d)", path, version), "")
+	}
+}
+
+// checkTLS validates the TLS certificate and key files if they were supplied.
+func (d *doctor) checkTLS() {
+	const check = "tls"
+	crt, key := *flagTLSCrt, *flagTLSKey
+	if crt == "" && key == "" {
+		d.report(doctorSkip, check, "no certificate configured", "Use --tlscert and --tlskey to check the HTTPS configuration.")
+		return
+	}
+	if crt == "" || key == "" {
+		d.report(doctorFail, check, "only one of the certificate and key files was given", "Both --tlscert and --tlskey must be set to use HTTPS.")
+		return
+	}
+
+	pair, err := tls.LoadX509KeyPair(crt, key)
+	if err != nil {
+		d.report(doctorFail, check, err.Error(), "Make sure the files are PEM encoded and that the key matches the certificate.")
+		return
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		d.report(doctorFail, check, fmt.Sprintf("could not parse the certificate: %v", err), "Regenerate the certificate.")
+		return
+	}
+
+	now := time.Now()
+	switch {
+	case now.Before(leaf.NotBefore):
+		d.report(doctorFail, check, fmt.Sprintf("the certificate is not valid until %v", leaf.NotBefore),
+			"Check the system clock or wait until the certificate becomes valid.")
+	case now.After(leaf.NotAfter):
+		d.report(doctorFail, check, fmt.Sprintf("the certificate expired on %v", leaf.NotAfter), "Renew the certificate.")
+	case leaf.NotAfter.Sub(now) < doctorCertExpiryWarning:
+		d.report(doctorWarn, check, fmt.Sprintf("the certificate expires soon on %v", leaf.NotAfter),
+			"Renew the certificate; a running server picks up new files on SIGHUP.")
+	default:
+		d.report(doctorOK, check, fmt.Sprintf("%s valid until %v", crt, leaf.NotAfter), "")
+	}
+}
+
+// checkServer verifies that the server can be reached and that the user can
+// authenticate. True is returned if the client is authenticated.
+func (d *doctor) checkServer() bool {
+	const check = "server"
+	if *flagHost == "" {
+		d.report(doctorSkip, check, "no host given", "Use -h to check the connection to a server.")
+		return false
+	}
+	host := interactiveGetHost()
+	if *flagUserName == "" || *flagUserPass == "" {
+		d.report(doctorSkip, check, "no credentials given", "Use -u and -p to check authentication against the server.")
+		return false
+	}
+
+	err := d.cmdState.Login(host, *flagUserName, *flagUserPass)
+	if err != nil {
+		hint := "Check that the server is running and that the host, port and http/https scheme are correct."
+		var httpErr *client.HTTPError
+		if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusUnauthorized {
+			hint = "Check the username and password; an administrator can reset them with 'freezer user mod'."
+		} else if strings.HasPrefix(host, "https://") && *flagTLSCrt == "" {
+			hint = "Use --tlscert and --tlskey so that the client trusts the server's certificate."
+		}
+		d.report(doctorFail, check, err.Error(), hint)
+		return false
+	}
+
+	d.report(doctorOK, check, fmt.Sprintf("authenticated to %s as %s (chunk size %d)", host, *flagUserName, d.cmdState.ServerCapabilities.ChunkSize), "")
+	if d.cmdState.QuotaWarning != nil {
+		d.report(doctorWarn, "quota", d.cmdState.QuotaWarning.Message, "Remove old file versions or ask an administrator for a larger quota.")
+	}
+	return true
+}
+
+// checkChunkRoundTrip uploads, downloads and removes a small temporary file.
+func (d *doctor) checkChunkRoundTrip() {
+	const check = "round trip"
+
+	// encrypt the round trip if a crypto password was given and the user
+	// has already setup their crypto password
+	if *flagCryptoPass != "" && len(d.cmdState.CryptoHash) > 0 {
+		err := initCrypto(d.cmdState)
+		if err != nil {
+			d.report(doctorFail, "crypto", err.Error(), "Check the crypto password given by -s.")
+			return
+		}
+	}
+
+	start := time.Now()
+	err := d.cmdState.ChunkRoundTrip()
+	if err != nil {
+		hint := "The server may be unable to write to its database."
+		if errors.Is(err, filefreezer.ErrStorageFull) {
+			hint = "The server's storage is full; ask an administrator to make room."
+		} else if errors.Is(err, filefreezer.ErrQuotaExceeded) {
+			hint = "The user is out of quota; remove old file versions or ask an administrator for a larger quota."
+		}
+		d.report(doctorFail, check, err.Error(), hint)
+		return
+	}
+	d.report(doctorOK, check, fmt.Sprintf("uploaded and downloaded a test chunk in %v", time.Since(start)), "")
+}
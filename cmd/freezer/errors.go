@@ -0,0 +1,138 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo"
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/logging"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// errorStatus returns the HTTP status code for the kind of error returned by
+// Storage or fallback if it isn't one of the known kinds. The client maps the
+// status codes back to the same errors.
+func errorStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, filefreezer.ErrNotOwner):
+		return http.StatusForbidden
+	case errors.Is(err, filefreezer.ErrQuotaExceeded), errors.Is(err, filefreezer.ErrStorageFull):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, filefreezer.ErrFileExists):
+		return http.StatusConflict
+	case errors.Is(err, filefreezer.ErrChunkTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, filefreezer.ErrChunkMismatch):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, filefreezer.ErrTransferLimit):
+		return models.StatusBandwidthLimitExceeded
+	case errors.Is(err, filefreezer.ErrRevisionMismatch):
+		return http.StatusPreconditionFailed
+	}
+	return fallback
+}
+
+// errorCode returns the models.ErrorCode value for err, which may be nil,
+// responded to with status. The client maps the codes back to the errors.
+func errorCode(err error, status int) string {
+	switch {
+	case err == nil:
+	case errors.Is(err, filefreezer.ErrNotOwner):
+		return models.ErrorCodeNotOwner
+	case errors.Is(err, filefreezer.ErrQuotaExceeded):
+		return models.ErrorCodeQuotaExceeded
+	case errors.Is(err, filefreezer.ErrStorageFull):
+		return models.ErrorCodeStorageFull
+	case errors.Is(err, filefreezer.ErrFileExists):
+		return models.ErrorCodeFileExists
+	case errors.Is(err, filefreezer.ErrChunkTooLarge):
+		return models.ErrorCodeChunkTooLarge
+	case errors.Is(err, filefreezer.ErrChunkMismatch):
+		return models.ErrorCodeChunkMismatch
+	case errors.Is(err, filefreezer.ErrTransferLimit):
+		return models.ErrorCodeTransferLimit
+	case errors.Is(err, filefreezer.ErrRevisionMismatch):
+		return models.ErrorCodeRevisionMismatch
+	}
+
+	switch status {
+	case http.StatusUnauthorized:
+		return models.ErrorCodeUnauthorized
+	case http.StatusForbidden:
+		return models.ErrorCodeForbidden
+	case http.StatusNotFound:
+		return models.ErrorCodeNotFound
+	case http.StatusMethodNotAllowed:
+		return models.ErrorCodeMethodNotAllowed
+	case http.StatusConflict:
+		return models.ErrorCodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return models.ErrorCodeTooLarge
+	case http.StatusTooManyRequests:
+		return models.ErrorCodeTooManyRequests
+	case http.StatusServiceUnavailable:
+		return models.ErrorCodeServiceUnavailable
+	}
+	if status >= 500 {
+		return models.ErrorCodeInternal
+	}
+	return models.ErrorCodeBadRequest
+}
+
+// apiError responds to an API request with an error body whose code is the
+// one for status.
+func apiError(c echo.Context, status int, message string) error {
+	return sendError(c, status, &models.ErrorResponse{Code: errorCode(nil, status), Message: message})
+}
+
+// storageError responds to an API request that failed with err with the
+// status and code for the kind of error, using fallback as the status if
+// it isn't one of the known kinds. err is included in the details.
+func storageError(c echo.Context, err error, fallback int, message string) error {
+	status := errorStatus(err, fallback)
+	return sendError(c, status, &models.ErrorResponse{
+		Code:    errorCode(err, status),
+		Message: message,
+		Details: map[string]string{"error": err.Error()},
+	})
+}
+
+// sendError writes the error body and keeps it in the context so that the
+// failure is logged with the request id.
+func sendError(c echo.Context, status int, errResp *models.ErrorResponse) error {
+	c.Set(errorResponseContextName, errResp)
+	return c.JSON(status, errResp)
+}
+
+// handleHTTPError responds to the errors returned by echo itself and its
+// middleware, such as unknown routes and missing tokens, with the same
+// error body as the handlers. Other errors are logged as internal errors.
+func handleHTTPError(state *serverState) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		if c.Response().Committed {
+			return
+		}
+		status := http.StatusInternalServerError
+		message := http.StatusText(status)
+		if he, ok := err.(*echo.HTTPError); ok {
+			status = he.Code
+			message = fmt.Sprintf("%v", he.Message)
+		} else {
+			state.Log.With(logging.Fields{"request_id": requestID(c)}).Errorf("Failed to handle %s %s: %v", c.Request().Method, c.Request().URL.Path, err)
+		}
+
+		if c.Request().Method == echo.HEAD {
+			err = c.NoContent(status)
+		} else {
+			err = apiError(c, status, message)
+		}
+		if err != nil {
+			state.Log.Errorf("Failed to send the error response: %v", err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/tbogdala/filefreezer/cmd/freezer/logging"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+const (
+	// impersonationSubject is the subject of impersonation tokens.
+	impersonationSubject = "impersonation"
+
+	// defaultImpersonationMinutes is how long an impersonation token is valid
+	// for when the request doesn't say.
+	defaultImpersonationMinutes = 15
+
+	// maxImpersonationMinutes is the longest an impersonation token can be
+	// valid for.
+	maxImpersonationMinutes = 60
+)
+
+// handlePostAdminImpersonate issues a short-lived token that authenticates as
+// the user in the name parameter of the URI so that an administrator can see
+// the API the way the user does without knowing the user's password. The
+// token is read-only, can't be used for the admin API and every request made
+// with it is logged.
+func handlePostAdminImpersonate(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims := c.Get(jwtContextName).(*jwt.Token).Claims.(*jwtCustomClaims)
+
+		var req models.AdminImpersonateRequest
+		err := c.Bind(&req)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+		if req.Minutes == 0 {
+			req.Minutes = defaultImpersonationMinutes
+		}
+		if req.Minutes < 0 || req.Minutes > maxImpersonationMinutes {
+			return apiError(c, http.StatusBadRequest, "The token lifetime must be between 1 and 60 minutes.")
+		}
+		if req.Reason == "" {
+			return apiError(c, http.StatusBadRequest, "A reason for impersonating the user must be supplied.")
+		}
+
+		user, err := state.Storage.GetUser(adminUserParam(c))
+		if err != nil {
+			return apiError(c, http.StatusNotFound, "Failed to find the user: "+err.Error())
+		}
+
+		expiresAt := time.Now().Add(time.Minute * time.Duration(req.Minutes)).Unix()
+		impersonationClaims := &jwtCustomClaims{
+			Username:       user.Name,
+			UserID:         user.ID,
+			ImpersonatorID: claims.UserID,
+			Impersonator:   claims.Username,
+			StandardClaims: jwt.StandardClaims{
+				Subject:   impersonationSubject,
+				ExpiresAt: expiresAt,
+			},
+		}
+		t, err := jwt.NewWithClaims(jwt.SigningMethodHS256, impersonationClaims).SignedString(state.JWTSecretBytes)
+		if err != nil {
+			return err
+		}
+
+		state.Log.With(logging.Fields{"admin": claims.Username, "user": user.Name}).Infof("Impersonation token issued for %d minutes: %s", req.Minutes, req.Reason)
+		state.Activity.record(claims.UserID, claims.Username, "user impersonated", "user %s (id %d) for %d minutes: %s", user.Name, user.ID, req.Minutes, req.Reason)
+		state.Webhooks.send(webhookEventUserImpersonated, user.ID, user.Name, map[string]interface{}{
+			"Impersonator": claims.Username,
+			"Minutes":      req.Minutes,
+			"Reason":       req.Reason,
+		})
+
+		return c.JSON(http.StatusOK, &models.AdminImpersonateResponse{
+			Token:      t,
+			UserID:     user.ID,
+			ExpiresAt:  expiresAt,
+			CryptoHash: user.CryptoHash,
+		})
+	}
+}
+
+// impersonationMiddleware logs every request made with an impersonation token
+// and rejects the requests that would change anything.
+func impersonationMiddleware(state *serverState) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			claims := c.Get(jwtContextName).(*jwt.Token).Claims.(*jwtCustomClaims)
+			if claims.Subject != impersonationSubject {
+				return next(c)
+			}
+
+			req := c.Request()
+			state.Log.With(logging.Fields{"admin": claims.Impersonator, "user": claims.Username}).Infof("Impersonated request: %s %s", req.Method, req.URL.Path)
+			if req.Method != http.MethodGet && req.Method != http.MethodHead {
+				return apiError(c, http.StatusForbidden, "Impersonation tokens are read-only.")
+			}
+
+			return next(c)
+		}
+	}
+}
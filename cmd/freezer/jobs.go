@@ -0,0 +1,405 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/logging"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// The names of the scheduled maintenance jobs. They also name the job locks
+// that make sure only one of the instances sharing a database runs each job.
+const (
+	// usageSnapshotJob records the usage snapshot for the current day.
+	usageSnapshotJob = "usage-snapshot"
+
+	// vacuumJob vacuums the database.
+	vacuumJob = "vacuum"
+
+	// gcJob removes the data that doesn't belong to anything and fixes the
+	// user allocations, the same as fsck --repair.
+	gcJob = "gc"
+
+	// scrubJob checks the stored file versions for missing or damaged chunks.
+	scrubJob = "scrub"
+
+	// retentionJob removes the file versions beyond the number to keep.
+	retentionJob = "retention"
+
+	// backupJob takes a snapshot of the database and uploads it to the
+	// backup target.
+	backupJob = "backup"
+
+	// trashJob removes the files that have been in the trash longer than
+	// the trash retention period and the chunks kept for the journal longer
+	// than theirs.
+	trashJob = "trash"
+
+	// expiryJob removes the files whose expiry time has passed.
+	expiryJob = "expiry"
+)
+
+// jobScheduleOff is the schedule of a job that doesn't run.
+const jobScheduleOff = "off"
+
+// defaultJobSchedules are the schedules of the jobs that aren't given one.
+// Only the usage snapshots, the trash and the file expiry run unless they are
+// turned on; the trash job does nothing while the trash is off.
+var defaultJobSchedules = map[string]string{
+	usageSnapshotJob: "@hourly",
+	vacuumJob:        jobScheduleOff,
+	gcJob:            jobScheduleOff,
+	scrubJob:         jobScheduleOff,
+	retentionJob:     jobScheduleOff,
+	backupJob:        jobScheduleOff,
+	trashJob:         "@hourly",
+	expiryJob:        "@hourly",
+}
+
+// jobOrder is the order the jobs are listed in.
+var jobOrder = []string{usageSnapshotJob, vacuumJob, gcJob, scrubJob, retentionJob, backupJob, trashJob, expiryJob}
+
+// parseJobSchedule returns how often a job runs for the schedule given in the
+// style of cron's descriptors: @hourly, @daily, @weekly or @every followed by
+// a duration such as @every 6h. A zero interval is returned for "off". Jobs
+// run on the interval counted from when the server starts.
+func parseJobSchedule(schedule string) (time.Duration, error) {
+	schedule = strings.TrimSpace(schedule)
+	switch schedule {
+	case jobScheduleOff:
+		return 0, nil
+	case "@hourly":
+		return time.Hour, nil
+	case "@daily", "@midnight":
+		return 24 * time.Hour, nil
+	case "@weekly":
+		return 7 * 24 * time.Hour, nil
+	}
+
+	if strings.HasPrefix(schedule, "@every ") {
+		interval, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(schedule, "@every ")))
+		if err != nil {
+			return 0, fmt.Errorf("invalid job schedule %q: %v", schedule, err)
+		}
+		if interval < time.Second {
+			return 0, fmt.Errorf("invalid job schedule %q: jobs can't run more than once a second", schedule)
+		}
+		return interval, nil
+	}
+
+	return 0, fmt.Errorf("invalid job schedule %q: expected @hourly, @daily, @weekly, @every <duration> or off", schedule)
+}
+
+// parseJobSchedules parses the job schedules given as name=schedule
+// (e.g. gc=@daily) on the command line.
+func parseJobSchedules(specs []string) (map[string]string, error) {
+	schedules := make(map[string]string)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid job schedule %q: expected name=schedule", spec)
+		}
+		name := strings.TrimSpace(parts[0])
+		if _, known := defaultJobSchedules[name]; !known {
+			return nil, fmt.Errorf("invalid job schedule %q: unknown job %s", spec, name)
+		}
+		_, err := parseJobSchedule(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		schedules[name] = strings.TrimSpace(parts[1])
+	}
+	return schedules, nil
+}
+
+// scheduledJob is a maintenance job run by the jobScheduler along with the
+// status of its runs on this instance.
+type scheduledJob struct {
+	name     string
+	schedule string
+	interval time.Duration
+
+	// runAtStart runs the job when the scheduler starts instead of waiting
+	// for the first interval to pass.
+	runAtStart bool
+
+	// run does the work of the job and returns a short description of
+	// what it did.
+	run func() (string, error)
+
+	// the status of the job; guarded by the scheduler's lock
+	running      bool
+	runs         int
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastResult   string
+	lastError    string
+	nextRun      time.Time
+}
+
+// jobScheduler runs the server's maintenance jobs on their schedules and
+// keeps track of how their last runs went.
+type jobScheduler struct {
+	sync.Mutex
+	state *serverState
+	log   *logging.Logger
+	jobs  []*scheduledJob
+}
+
+// newJobScheduler creates the scheduler for the maintenance jobs of the
+// server using the schedules given by job name; the jobs that aren't in
+// schedules use their default schedule. The retention job needs the
+// server's KeepVersions to be set and the backup job needs its BackupDir.
+func newJobScheduler(state *serverState, schedules map[string]string) (*jobScheduler, error) {
+	js := &jobScheduler{
+		state: state,
+		log:   state.Log.Component("jobs"),
+	}
+	runs := map[string]func() (string, error){
+		usageSnapshotJob: state.snapshotUsage,
+		vacuumJob:        state.vacuumDatabase,
+		gcJob:            state.collectGarbage,
+		scrubJob:         state.scrubStorage,
+		retentionJob:     state.enforceRetention,
+		backupJob:        state.backupDatabase,
+		trashJob:         state.expireTrash,
+		expiryJob:        state.expireFiles,
+	}
+
+	for _, name := range jobOrder {
+		schedule, found := schedules[name]
+		if !found {
+			schedule = defaultJobSchedules[name]
+		}
+		interval, err := parseJobSchedule(schedule)
+		if err != nil {
+			return nil, err
+		}
+		if name == retentionJob && interval > 0 && state.KeepVersions < 1 {
+			return nil, fmt.Errorf("the %s job needs the number of file versions to keep", retentionJob)
+		}
+		if name == backupJob && interval > 0 && state.BackupDir == "" {
+			return nil, fmt.Errorf("the %s job needs a directory to keep the backups in", backupJob)
+		}
+
+		js.jobs = append(js.jobs, &scheduledJob{
+			name:       name,
+			schedule:   schedule,
+			interval:   interval,
+			runAtStart: name == usageSnapshotJob,
+			run:        runs[name],
+		})
+	}
+
+	return js, nil
+}
+
+// start runs every job that isn't turned off on its schedule until the stop
+// channel is closed.
+func (js *jobScheduler) start(stop chan struct{}) {
+	for _, job := range js.jobs {
+		if job.interval > 0 {
+			go js.loop(job, stop)
+		}
+	}
+}
+
+// loop runs the job every interval until the stop channel is closed. Only
+// the instance holding the job's lock runs it.
+func (js *jobScheduler) loop(job *scheduledJob, stop chan struct{}) {
+	if job.runAtStart {
+		js.execute(job)
+	}
+
+	ticker := time.NewTicker(job.interval)
+	defer ticker.Stop()
+	js.setNextRun(job)
+	for {
+		select {
+		case <-ticker.C:
+			js.execute(job)
+			js.setNextRun(job)
+		case <-stop:
+			js.state.releaseJob(job.name)
+			return
+		}
+	}
+}
+
+// setNextRun records when the job runs next.
+func (js *jobScheduler) setNextRun(job *scheduledJob) {
+	js.Lock()
+	job.nextRun = time.Now().Add(job.interval)
+	js.Unlock()
+}
+
+// execute runs the job once if this instance holds its lock and records how
+// the run went.
+func (js *jobScheduler) execute(job *scheduledJob) {
+	jobLog := js.log.With(logging.Fields{"job": job.name})
+	js.state.runExclusive(job.name, 2*job.interval, func() {
+		js.Lock()
+		job.running = true
+		js.Unlock()
+
+		start := time.Now()
+		result, err := job.run()
+		duration := time.Since(start)
+
+		js.Lock()
+		job.running = false
+		job.runs++
+		job.lastRun = start
+		job.lastDuration = duration
+		job.lastResult = result
+		job.lastError = ""
+		if err != nil {
+			job.lastError = err.Error()
+		}
+		js.Unlock()
+
+		if err != nil {
+			jobLog.Errorf("The job failed after %v: %v", duration, err)
+			return
+		}
+		jobLog.Infof("The job finished in %v: %s", duration, result)
+	})
+}
+
+// status returns the schedule and the last run of each job on this instance.
+func (js *jobScheduler) status() []models.AdminJob {
+	js.Lock()
+	defer js.Unlock()
+
+	jobs := make([]models.AdminJob, 0, len(js.jobs))
+	for _, job := range js.jobs {
+		aj := models.AdminJob{
+			Name:         job.name,
+			Schedule:     job.schedule,
+			Running:      job.running,
+			Runs:         job.runs,
+			LastDuration: int64(job.lastDuration / time.Millisecond),
+			LastResult:   job.lastResult,
+			LastError:    job.lastError,
+		}
+		if !job.lastRun.IsZero() {
+			aj.LastRun = job.lastRun.Unix()
+		}
+		if !job.nextRun.IsZero() {
+			aj.NextRun = job.nextRun.Unix()
+		}
+		jobs = append(jobs, aj)
+	}
+	return jobs
+}
+
+// snapshotUsage records the usage snapshot for the current day.
+func (state *serverState) snapshotUsage() (string, error) {
+	err := state.Storage.TakeUsageSnapshot(time.Now())
+	if err != nil {
+		return "", fmt.Errorf("failed to record the usage snapshot: %v", err)
+	}
+	return "usage snapshot recorded", nil
+}
+
+// vacuumDatabase vacuums the database so that the space of removed chunks
+// is returned to the file system.
+func (state *serverState) vacuumDatabase() (string, error) {
+	before, after, err := state.Storage.Vacuum()
+	if err != nil {
+		return "", fmt.Errorf("failed to vacuum the database: %v", err)
+	}
+	state.Activity.record(filefreezer.NoUserID, "", "database vacuumed", "%d bytes reclaimed", before-after)
+	return fmt.Sprintf("vacuumed the database from %d to %d bytes", before, after), nil
+}
+
+// collectGarbage removes the files, versions and chunks that don't belong to
+// anything and fixes the other inconsistencies found by fsck. The files of
+// removed chunks are then swept from the chunk directory.
+func (state *serverState) collectGarbage() (string, error) {
+	problems, err := state.Storage.Fsck(true)
+	if err != nil {
+		return "", fmt.Errorf("failed to repair the database: %v", err)
+	}
+	for _, p := range problems {
+		state.Log.Warnf("Repaired: %s", p)
+	}
+	if len(problems) > 0 {
+		state.Activity.record(filefreezer.NoUserID, "", "database repaired", "%d problems repaired", len(problems))
+	}
+	if state.Storage.ChunkStore == nil {
+		return fmt.Sprintf("%d problems repaired", len(problems)), nil
+	}
+
+	removed, freed, err := state.Storage.SweepChunkStore()
+	if err != nil {
+		return "", err
+	}
+	if removed > 0 {
+		state.Activity.record(filefreezer.NoUserID, "", "stored chunks swept", "%d chunks (%d bytes) removed", removed, freed)
+	}
+	return fmt.Sprintf("%d problems repaired; %d stored chunks (%d bytes) removed", len(problems), removed, freed), nil
+}
+
+// scrubStorage checks the stored file versions for missing or damaged chunks
+// and logs the ones it finds. Nothing is changed since only the user's client
+// can upload the chunks again.
+func (state *serverState) scrubStorage() (string, error) {
+	problems, err := state.Storage.Scrub()
+	if err != nil {
+		return "", fmt.Errorf("failed to scrub the database: %v", err)
+	}
+	for _, p := range problems {
+		state.Log.Warnf("Scrub found: %s", p)
+	}
+	return fmt.Sprintf("%d problems found", len(problems)), nil
+}
+
+// enforceRetention removes the oldest versions of the files that have more
+// than the server's KeepVersions versions.
+func (state *serverState) enforceRetention() (string, error) {
+	removed, err := state.Storage.EnforceRetention(state.KeepVersions)
+	if err != nil {
+		return "", fmt.Errorf("failed to remove the old file versions: %v", err)
+	}
+	if removed > 0 {
+		state.Activity.record(filefreezer.NoUserID, "", "versions expired", "%d file versions removed", removed)
+	}
+	return fmt.Sprintf("%d file versions removed", removed), nil
+}
+
+// expireTrash removes the files that have been in the trash longer than the
+// trash retention period and prunes the chunks kept for the journal.
+func (state *serverState) expireTrash() (string, error) {
+	removed, err := state.Storage.ExpireTrash(time.Now())
+	if err != nil {
+		return "", fmt.Errorf("failed to remove the expired files in the trash: %v", err)
+	}
+	if removed > 0 {
+		state.Activity.record(filefreezer.NoUserID, "", "trash expired", "%d files removed", removed)
+	}
+	pruned, err := state.Storage.PruneJournalChunks(time.Now())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d files removed from the trash; %d journal chunks pruned", removed, pruned), nil
+}
+
+// expireFiles removes the files whose expiry time has passed.
+func (state *serverState) expireFiles() (string, error) {
+	removed, err := state.Storage.ExpireFiles(time.Now())
+	if err != nil {
+		return "", fmt.Errorf("failed to remove the expired files: %v", err)
+	}
+	if removed > 0 {
+		state.Activity.record(filefreezer.NoUserID, "", "files expired", "%d files removed", removed)
+	}
+	return fmt.Sprintf("%d expired files removed", removed), nil
+}
@@ -0,0 +1,216 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/tbogdala/filefreezer"
+)
+
+// rateWindow is the length of the window that requests are counted in for
+// the requests per minute limit.
+const rateWindow = time.Minute
+
+// uploadRetryAfter is how many seconds a client is told to wait before
+// trying an upload that was refused for the concurrent upload limit again.
+const uploadRetryAfter = 1
+
+// unlimitedBodyPrefixes are the paths whose request bodies aren't limited by
+// the maximum body size: chunk uploads, which are limited to the chunk size
+// by their handlers, and restic blobs, which are stored as files.
+var unlimitedBodyPrefixes = []string{"/api/chunk/", resticPrefix + "/"}
+
+// requestWindowCount is the number of requests a user made in the window
+// that started at start.
+type requestWindowCount struct {
+	start time.Time
+	count int
+}
+
+// requestLimits protects a shared server from a single client by limiting
+// the chunk uploads each user has in progress, the size of the API request
+// bodies and the requests each user makes per minute. A limit of 0 disables
+// it. Users are counted by account so that the namespaces of an account
+// share its limits.
+type requestLimits struct {
+	sync.Mutex
+
+	// MaxUploads is the number of chunk uploads each user can have in
+	// progress at once.
+	MaxUploads int
+
+	// MaxBodySize is the maximum size in bytes of the body of API requests
+	// other than chunk uploads.
+	MaxBodySize int64
+
+	// RequestsPerMinute is the number of API requests each user can make
+	// in a minute.
+	RequestsPerMinute int
+
+	uploads  map[int]int
+	requests map[int]*requestWindowCount
+}
+
+// newRequestLimits returns the request limits with the given settings.
+func newRequestLimits(maxUploads int, maxBodySize int64, requestsPerMinute int) (*requestLimits, error) {
+	if maxUploads < 0 || maxBodySize < 0 || requestsPerMinute < 0 {
+		return nil, fmt.Errorf("the request limits can't be negative")
+	}
+	l := new(requestLimits)
+	l.MaxUploads = maxUploads
+	l.MaxBodySize = maxBodySize
+	l.RequestsPerMinute = requestsPerMinute
+	l.uploads = make(map[int]int)
+	l.requests = make(map[int]*requestWindowCount)
+	return l, nil
+}
+
+// allowRequest counts a request of the user and returns true if it's within
+// the requests per minute limit. If it isn't, the time until the user can
+// make requests again is returned as well.
+func (l *requestLimits) allowRequest(userID int, now time.Time) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	if l.RequestsPerMinute <= 0 {
+		return true, 0
+	}
+
+	// there's one window per user, so it's reused instead of pruned
+	w, found := l.requests[userID]
+	if !found {
+		w = new(requestWindowCount)
+		l.requests[userID] = w
+	}
+	if now.Sub(w.start) >= rateWindow {
+		w.start = now
+		w.count = 0
+	}
+	if w.count >= l.RequestsPerMinute {
+		return false, w.start.Add(rateWindow).Sub(now)
+	}
+	w.count++
+	return true, 0
+}
+
+// startUpload counts an upload of the user as in progress and returns true
+// if it's within the concurrent upload limit. Uploads that were allowed have
+// to be ended with endUpload.
+func (l *requestLimits) startUpload(userID int) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.MaxUploads > 0 && l.uploads[userID] >= l.MaxUploads {
+		return false
+	}
+	l.uploads[userID]++
+	return true
+}
+
+// endUpload counts an upload of the user as done.
+func (l *requestLimits) endUpload(userID int) {
+	l.Lock()
+	defer l.Unlock()
+	l.uploads[userID]--
+	if l.uploads[userID] <= 0 {
+		delete(l.uploads, userID)
+	}
+}
+
+// maxBodySize returns the maximum body size of API requests; 0 if there's
+// no limit.
+func (l *requestLimits) maxBodySize() int64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.MaxBodySize
+}
+
+// limitedUserID returns the id of the account the limits of a request are
+// counted against.
+func limitedUserID(c echo.Context) int {
+	if user, ok := c.Get(webdavUserContextName).(*filefreezer.User); ok {
+		return user.ID
+	}
+	claims := c.Get(jwtContextName).(*jwt.Token).Claims.(*jwtCustomClaims)
+	if claims.OwnerID != 0 {
+		return claims.OwnerID
+	}
+	return claims.UserID
+}
+
+// tooManyRequests responds to a request refused by the limits, telling the
+// client how long to wait before sending it again.
+func tooManyRequests(c echo.Context, retryAfter time.Duration, message string) error {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	return apiError(c, http.StatusTooManyRequests, message)
+}
+
+// limitBodySize returns echo middleware that refuses API requests whose
+// body is larger than the maximum body size, except for the chunk uploads
+// and restic blobs.
+func limitBodySize(state *serverState) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			maxSize := state.Limits.maxBodySize()
+			if maxSize <= 0 {
+				return next(c)
+			}
+			req := c.Request()
+			for _, prefix := range unlimitedBodyPrefixes {
+				if strings.HasPrefix(req.URL.Path, prefix) {
+					return next(c)
+				}
+			}
+
+			// bodies without a length are cut off at the limit, which
+			// fails their parsing
+			if req.ContentLength > maxSize {
+				return apiError(c, http.StatusRequestEntityTooLarge,
+					fmt.Sprintf("The request body is larger than the server's limit of %d bytes.", maxSize))
+			}
+			req.Body = http.MaxBytesReader(c.Response(), req.Body, maxSize)
+			return next(c)
+		}
+	}
+}
+
+// limitRequestRate returns echo middleware for authenticated routes that
+// refuses the requests of users who made more than the requests per minute.
+func limitRequestRate(state *serverState) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			allowed, retryAfter := state.Limits.allowRequest(limitedUserID(c), time.Now())
+			if !allowed {
+				return tooManyRequests(c, retryAfter, "Too many requests; the server's limit of requests per minute was reached.")
+			}
+			return next(c)
+		}
+	}
+}
+
+// limitUploads returns echo middleware for the chunk upload routes that
+// refuses the uploads of users who have the maximum number of uploads in
+// progress.
+func limitUploads(state *serverState) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			userID := limitedUserID(c)
+			if !state.Limits.startUpload(userID) {
+				return tooManyRequests(c, uploadRetryAfter*time.Second, "Too many uploads in progress; the server's limit of concurrent uploads was reached.")
+			}
+			defer state.Limits.endUpload(userID)
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message. Messages below the level
+// set on a Logger are discarded.
+type Level int
+
+// The supported log levels in increasing order of severity.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String returns the lowercase name of the log level.
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
+// ParseLevel converts a level name such as "info" or "warn" into a Level.
+// An error is returned if the name is not recognized.
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level: %s", name)
+}
+
+// Fields is a set of key/value pairs that get attached to every
+// message written by a Logger.
+type Fields map[string]interface{}
+
+// sink is the shared output destination for a Logger and all of the
+// child loggers derived from it.
+type sink struct {
+	sync.Mutex
+	out     io.Writer
+	level   Level
+	useJSON bool
+}
+
+// Logger writes leveled messages in either a human readable text format
+// or as one JSON object per line so that they can be consumed by log
+// aggregation tools.
+type Logger struct {
+	sink   *sink
+	fields Fields
+}
+
+// New creates a new Logger that writes messages at or above level to out.
+// If useJSON is true each message is written as a JSON object.
+func New(out io.Writer, level Level, useJSON bool) *Logger {
+	l := new(Logger)
+	l.sink = &sink{out: out, level: level, useJSON: useJSON}
+	l.fields = Fields{}
+	return l
+}
+
+// With returns a child logger that includes the supplied fields in every
+// message in addition to the fields of the parent. The child shares the
+// output, level and format of the parent.
+func (l *Logger) With(fields Fields) *Logger {
+	child := new(Logger)
+	child.sink = l.sink
+	child.fields = make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		child.fields[k] = v
+	}
+	for k, v := range fields {
+		child.fields[k] = v
+	}
+	return child
+}
+
+// Component returns a child logger tagged with the component name.
+func (l *Logger) Component(name string) *Logger {
+	return l.With(Fields{"component": name})
+}
+
+// SetLevel changes the minimum level of messages that get written. The
+// change applies to this logger and every logger sharing its output.
+func (l *Logger) SetLevel(level Level) {
+	l.sink.Lock()
+	l.sink.level = level
+	l.sink.Unlock()
+}
+
+// Level returns the current minimum level of messages that get written.
+func (l *Logger) Level() Level {
+	l.sink.Lock()
+	defer l.sink.Unlock()
+	return l.sink.level
+}
+
+// SetOutput changes the writer that messages get written to.
+func (l *Logger) SetOutput(out io.Writer) {
+	l.sink.Lock()
+	l.sink.out = out
+	l.sink.Unlock()
+}
+
+// SetJSON toggles the JSON output format.
+func (l *Logger) SetJSON(useJSON bool) {
+	l.sink.Lock()
+	l.sink.useJSON = useJSON
+	l.sink.Unlock()
+}
+
+// Debugf writes a debug level message.
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.write(LevelDebug, fmt.Sprintf(format, v...))
+}
+
+// Infof writes an info level message.
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.write(LevelInfo, fmt.Sprintf(format, v...))
+}
+
+// Warnf writes a warning level message.
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.write(LevelWarn, fmt.Sprintf(format, v...))
+}
+
+// Errorf writes an error level message.
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.write(LevelError, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) write(level Level, msg string) {
+	l.sink.Lock()
+	defer l.sink.Unlock()
+
+	if level < l.sink.level || l.sink.out == nil {
+		return
+	}
+
+	msg = strings.TrimRight(msg, "\n")
+	now := time.Now().UTC().Format(time.RFC3339)
+	var buf bytes.Buffer
+	if l.sink.useJSON {
+		entry := make(map[string]interface{}, len(l.fields)+3)
+		for k, v := range l.fields {
+			// error values don't serialize to anything useful so
+			// they're converted to their string form
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			entry[k] = v
+		}
+		entry["time"] = now
+		entry["level"] = level.String()
+		entry["msg"] = msg
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			encoded, _ = json.Marshal(map[string]interface{}{
+				"time":  now,
+				"level": level.String(),
+				"msg":   msg,
+			})
+		}
+		buf.Write(encoded)
+	} else {
+		buf.WriteString(fmt.Sprintf("%s %-5s", now, strings.ToUpper(level.String())))
+		if component, ok := l.fields["component"]; ok {
+			buf.WriteString(fmt.Sprintf(" [%v]", component))
+		}
+		buf.WriteString(" ")
+		buf.WriteString(msg)
+
+		// write out the remaining fields in a stable order
+		keys := make([]string, 0, len(l.fields))
+		for k := range l.fields {
+			if k != "component" {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			buf.WriteString(fmt.Sprintf(" %s=%v", k, l.fields[k]))
+		}
+	}
+	buf.WriteByte('\n')
+
+	l.sink.out.Write(buf.Bytes())
+}
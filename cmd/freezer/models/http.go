@@ -3,12 +3,71 @@
 
 package models
 
-import "github.com/tbogdala/filefreezer"
+import (
+	"time"
+
+	"github.com/tbogdala/filefreezer"
+)
+
+// StatusBandwidthLimitExceeded is the non-standard status code the server
+// responds with when a user's monthly transfer limit has been reached. It's
+// used instead of 429 Too Many Requests, which the client retries.
+const StatusBandwidthLimitExceeded = 509
+
+// HeaderRequestID is the header the server returns the id of every request
+// in, which its logs include so that a failed request can be found in them.
+// A request id sent by the client or a proxy in the header is used instead
+// of a new one.
+const HeaderRequestID = "X-Request-ID"
+
+// HeaderBackupChecksum is the header the /api/admin/backup POST handler
+// returns the SHA-256 checksum of the database snapshot in, as hex, so that
+// the download can be checked before it's kept.
+const HeaderBackupChecksum = "X-Freezer-Checksum"
+
+// ErrorResponse is the JSON body of every error response of the API.
+// Clients should tell errors apart by Code, which stays the same across
+// versions of the server, while Message is meant for people and may change.
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	// Details has more information about some errors, such as the error
+	// returned by the server's storage under "error".
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// The codes of ErrorResponse. Errors that have a filefreezer error, such
+// as a full quota, get its code; the others get the code for their status.
+const (
+	ErrorCodeBadRequest         = "bad_request"         // 400 and other client errors
+	ErrorCodeUnauthorized       = "unauthorized"        // 401: the login or token was refused
+	ErrorCodeForbidden          = "forbidden"           // 403: the user isn't allowed to do this
+	ErrorCodeNotOwner           = "not_owner"           // filefreezer.ErrNotOwner
+	ErrorCodeNotFound           = "not_found"           // 404
+	ErrorCodeMethodNotAllowed   = "method_not_allowed"  // 405
+	ErrorCodeConflict           = "conflict"            // 409, such as a username that's taken
+	ErrorCodeFileExists         = "file_exists"         // filefreezer.ErrFileExists
+	ErrorCodeRevisionMismatch   = "revision_mismatch"   // filefreezer.ErrRevisionMismatch
+	ErrorCodeTooLarge           = "too_large"           // 413
+	ErrorCodeChunkTooLarge      = "chunk_too_large"     // filefreezer.ErrChunkTooLarge
+	ErrorCodeChunkMismatch      = "chunk_mismatch"      // filefreezer.ErrChunkMismatch
+	ErrorCodeTooManyRequests    = "too_many_requests"   // 429
+	ErrorCodeQuotaExceeded      = "quota_exceeded"      // filefreezer.ErrQuotaExceeded
+	ErrorCodeStorageFull        = "storage_full"        // filefreezer.ErrStorageFull
+	ErrorCodeTransferLimit      = "transfer_limit"      // filefreezer.ErrTransferLimit
+	ErrorCodeServiceUnavailable = "service_unavailable" // 503
+	ErrorCodeInternal           = "internal"            // 500 and other server errors
+)
 
 // ServerCapabilities gets returned to the user to describe the features
 // that the server has to the client.
 type ServerCapabilities struct {
 	ChunkSize int64
+
+	// DeniedNames are the file name patterns the server never accepts.
+	// The server can't read encrypted names so clients refuse them.
+	DeniedNames []string
 }
 
 // UserLoginResponse is the JSON serializable response given by the
@@ -17,6 +76,35 @@ type UserLoginResponse struct {
 	Token        string
 	CryptoHash   []byte
 	Capabilities ServerCapabilities
+
+	// QuotaWarning is set if the user has crossed one of the server's
+	// quota thresholds; nil otherwise.
+	QuotaWarning *QuotaWarning
+
+	// CaseInsensitive is true if the account treats remote paths
+	// case-insensitively, in which case clients send a name key with each
+	// new file.
+	CaseInsensitive bool
+
+	// ServerTime is the server's clock when it answered, which clients
+	// compare with their own clock to detect clock skew.
+	ServerTime time.Time
+}
+
+// QuotaWarning describes how much of the user's quota has been used once
+// one of the server's quota thresholds has been crossed or the allocation
+// has gone over the quota.
+type QuotaWarning struct {
+	Threshold int
+	Quota     int
+	Allocated int
+	Message   string
+
+	// HardQuota is the limit uploads may go up to until GraceEnds once the
+	// allocation is over the quota; both are zero while it's within the
+	// quota.
+	HardQuota int
+	GraceEnds time.Time
 }
 
 // UserCryptoHashUpdateRequest is the JSON serializable request sent to the
@@ -31,10 +119,37 @@ type UserCryptoHashUpdateResponse struct {
 	Status bool
 }
 
+// UserCaseInsensitiveRequest is the JSON serializable request sent to the
+// /api/user/caseinsensitive PUT handler. NameKeys must hold the name key of
+// every file when turning case-insensitive paths on.
+type UserCaseInsensitiveRequest struct {
+	Enabled  bool
+	NameKeys []FileNameKey
+}
+
+// FileNameKey is the name key of a single file.
+type FileNameKey struct {
+	FileID  int
+	NameKey string
+}
+
+// UserCaseInsensitiveResponse is the JSON serializable response given by
+// the /api/user/caseinsensitive PUT handler.
+type UserCaseInsensitiveResponse struct {
+	Success bool
+}
+
 // UserStatsGetResponse is the JSON serializable response given by the
 // /api/user/stats GET handler.
 type UserStatsGetResponse struct {
 	Stats filefreezer.UserStats
+
+	// QuotaWarning is set if the user has crossed one of the server's
+	// quota thresholds or is over the quota; nil otherwise.
+	QuotaWarning *QuotaWarning
+
+	// Transfer is the user's transfer usage for the current month.
+	Transfer filefreezer.TransferStats
 }
 
 // AllFilesGetResponse is the JSON serializable response given by the
@@ -51,12 +166,16 @@ type FileGetResponse struct {
 }
 
 // NewFileVersionRequest is the JSON serializable request object sent to the
-// /api/file/{fileid}/version POST handler.
+// /api/file/{fileid}/version POST handler. MerkleRoot is optional.
 type NewFileVersionRequest struct {
 	Permissions uint32
 	LastMod     int64
 	ChunkCount  int
 	FileHash    string
+	MerkleRoot  string
+
+	// Device identifies the client uploading the version; optional.
+	Device string
 }
 
 // NewFileVersionResponse is the  JSON serializable response given by the
@@ -66,10 +185,29 @@ type NewFileVersionResponse struct {
 	Status bool
 }
 
+// FileVersionUpdateRequest is the JSON serializable request object sent to the
+// /api/file/{fileid}/version/{versionid} PUT handler. MerkleRoot is optional.
+type FileVersionUpdateRequest struct {
+	LastMod    int64
+	ChunkCount int
+	FileHash   string
+	MerkleRoot string
+}
+
+// FileVersionUpdateResponse is the JSON serializable response given by the
+// /api/file/{fileid}/version/{versionid} PUT handler.
+type FileVersionUpdateResponse struct {
+	Status bool
+}
+
 // FileGetAllVersionsResponse is the  JSON serializable response given by the
 // /api/file/{fileid}/versions GET handler.
 type FileGetAllVersionsResponse struct {
 	Versions []filefreezer.FileVersionInfo
+
+	// StoredSizes maps the version ids to the number of bytes stored in
+	// the chunks of each version, which is the encrypted size of the data.
+	StoredSizes map[int]int64 `json:",omitempty"`
 }
 
 // FileDeleteVersionsRequest is the JSON serializable request object sent to the
@@ -103,6 +241,12 @@ type FileChunksGetResponse struct {
 	Chunks []filefreezer.FileChunk
 }
 
+// FileChunksCopyResponse is the JSON serializable response given by the
+// /api/chunk/{fileid}/{versionID}/copy POST handler.
+type FileChunksCopyResponse struct {
+	ChunksCopied int
+}
+
 // FilePutResponse is the JSON serializable response given by the
 // /api/files PUT handlder.
 type FilePutResponse struct {
@@ -110,7 +254,7 @@ type FilePutResponse struct {
 }
 
 // FilePutRequest is the JSON serializable request object sent to the
-// /api/files PUT handlder.
+// /api/files PUT handlder. MerkleRoot is optional.
 type FilePutRequest struct {
 	FileName    string
 	IsDir       bool
@@ -118,6 +262,22 @@ type FilePutRequest struct {
 	LastMod     int64
 	ChunkCount  int
 	FileHash    string
+	MerkleRoot  string
+
+	// ExpiresAt is the unix time after which the server removes the file;
+	// zero if it doesn't expire.
+	ExpiresAt int64
+
+	// SearchTokens are the client derived tokens used to find the file
+	// with the /api/search handler.
+	SearchTokens []string
+
+	// Device identifies the client adding the file; optional.
+	Device string
+
+	// NameKey is the client derived key that is compared instead of the
+	// name when the account treats paths case-insensitively.
+	NameKey string
 }
 
 // FileDeleteRequest is the JSON serializable request object sent to the
@@ -131,3 +291,482 @@ type FileDeleteRequest struct {
 type FileDeleteResponse struct {
 	Success bool
 }
+
+// FileExpiryPutRequest is the JSON serializable request object sent to the
+// /api/file/{id}/expiry PUT handler. An ExpiresAt of zero means the file
+// doesn't expire.
+type FileExpiryPutRequest struct {
+	ExpiresAt int64
+}
+
+// FileExpiryPutResponse is the JSON serializable response object from the
+// /api/file/{id}/expiry PUT handler.
+type FileExpiryPutResponse struct {
+	Success bool
+}
+
+// TrashGetResponse is the JSON serializable response given by the
+// /api/trash GET handler. Retention is zero if removed files don't go to
+// the trash.
+type TrashGetResponse struct {
+	Files     []filefreezer.TrashedFile
+	Retention time.Duration
+}
+
+// TrashRestoreResponse is the JSON serializable response given by the
+// /api/trash/{id}/restore POST handler.
+type TrashRestoreResponse struct {
+	Success bool
+}
+
+// TrashEmptyResponse is the JSON serializable response given by the
+// /api/trash DELETE handler.
+type TrashEmptyResponse struct {
+	Removed int
+}
+
+// FileNotePutRequest is the JSON serializable request object sent to the
+// /api/file/{fileid}/note PUT handler. An empty Note removes the note.
+type FileNotePutRequest struct {
+	Note string
+}
+
+// FileNoteResponse is the JSON serializable response given by the
+// /api/file/{fileid}/note GET and PUT handlers.
+type FileNoteResponse struct {
+	Note string
+}
+
+// FileAttributesPutRequest is the JSON serializable request object sent to
+// the /api/file/{fileid}/attributes PUT handler. Empty Attributes remove the
+// attributes of the file.
+type FileAttributesPutRequest struct {
+	Attributes string
+}
+
+// FileAttributesResponse is the JSON serializable response given by the
+// /api/file/{fileid}/attributes GET and PUT handlers.
+type FileAttributesResponse struct {
+	Attributes string
+}
+
+// FileTagsRequest is the JSON serializable request object sent to the
+// /api/file/{fileid}/tags PUT handler to add tags to a file.
+type FileTagsRequest struct {
+	Tags []filefreezer.FileTag
+}
+
+// FileTagsResponse is the JSON serializable response given by the
+// /api/file/{fileid}/tags handlers with the tags the file has.
+type FileTagsResponse struct {
+	Tags []filefreezer.FileTag
+}
+
+// TagsGetResponse is the JSON serializable response given by the /api/tags
+// GET handler with the tags used on the user's files.
+type TagsGetResponse struct {
+	Tags []filefreezer.TagInfo
+}
+
+// TaggedFilesGetResponse is the JSON serializable response given by the
+// /api/tags/{token}/files GET handler.
+type TaggedFilesGetResponse struct {
+	Files []filefreezer.FileInfo
+}
+
+// FileStarResponse is the JSON serializable response given by the
+// /api/file/{fileid}/star PUT and DELETE handlers.
+type FileStarResponse struct {
+	Success bool
+}
+
+// StarredFilesGetResponse is the JSON serializable response given by the
+// /api/starred GET handler.
+type StarredFilesGetResponse struct {
+	Files []filefreezer.FileInfo
+}
+
+// NamespacesGetResponse is the JSON serializable response given by the
+// /api/namespaces GET handler with the namespaces of the account.
+type NamespacesGetResponse struct {
+	Namespaces []filefreezer.Namespace
+}
+
+// NamespaceAddRequest is the JSON serializable request object sent to the
+// /api/namespaces POST handler to add a namespace to the account.
+type NamespaceAddRequest struct {
+	Name string
+}
+
+// NamespaceAddResponse is the JSON serializable response given by the
+// /api/namespaces POST handler.
+type NamespaceAddResponse struct {
+	Namespace filefreezer.Namespace
+}
+
+// NamespaceRmResponse is the JSON serializable response given by the
+// /api/namespace/{name} DELETE handler.
+type NamespaceRmResponse struct {
+	Status bool
+}
+
+// SearchGetResponse is the JSON serializable response given by the
+// /api/search GET handler with the files matching all of the search tokens.
+type SearchGetResponse struct {
+	Files []filefreezer.FileInfo
+}
+
+// SearchIndexEntry is the search tokens for a single file.
+type SearchIndexEntry struct {
+	FileID int
+	Tokens []string
+}
+
+// SearchIndexPutRequest is the JSON serializable request object sent to the
+// /api/search/index PUT handler to replace the search tokens of the files.
+type SearchIndexPutRequest struct {
+	Files []SearchIndexEntry
+}
+
+// SearchIndexPutResponse is the JSON serializable response given by the
+// /api/search/index PUT handler.
+type SearchIndexPutResponse struct {
+	Indexed int
+}
+
+// ActivityEntry describes a single recent event on the server such as a
+// login or a file being added.
+type ActivityEntry struct {
+	Time     int64
+	UserID   int
+	UserName string
+	Action   string
+	Detail   string
+}
+
+// ServerHealth describes the current health of the running server.
+type ServerHealth struct {
+	Uptime     int64
+	DBVersion  int
+	DBStatus   string
+	Goroutines int
+	HeapAlloc  uint64
+	ChunkSize  int64
+}
+
+// AdminDashboardResponse is the JSON serializable response given by the
+// /api/admin/dashboard GET handler.
+type AdminDashboardResponse struct {
+	Users          []filefreezer.UserSummary
+	TotalQuota     int
+	TotalAllocated int
+	Activity       []ActivityEntry
+	Health         ServerHealth
+}
+
+// UserUsage is the current usage and the recorded daily usage history
+// for a single user.
+type UserUsage struct {
+	UserID       int
+	Name         string
+	Quota        int
+	Allocated    int
+	FileCount    int
+	VersionCount int
+	History      []filefreezer.UsageSnapshot
+}
+
+// AdminUsageResponse is the JSON serializable response given by the
+// /api/admin/usage GET handler.
+type AdminUsageResponse struct {
+	Since string
+	Users []UserUsage
+}
+
+// AdminUsageExportResponse is the JSON serializable response given by the
+// /api/admin/usage/export GET handler for the json format. From and To are
+// the first and last day of the export.
+type AdminUsageExportResponse struct {
+	From  string
+	To    string
+	Users []filefreezer.UsageReport
+}
+
+// UserStorage is the storage used by a single user along with the files
+// taking up the most space. Only the size of the files is included, never
+// their names or contents.
+type UserStorage struct {
+	UserID       int
+	Name         string
+	Quota        int
+	Allocated    int
+	FileCount    int
+	VersionCount int
+	LargestFiles []filefreezer.FileSize
+}
+
+// AdminStorageResponse is the JSON serializable response given by the
+// /api/admin/storage GET handler. DatabaseSize is the size of the database
+// in bytes, including space freed by removed files.
+type AdminStorageResponse struct {
+	TotalAllocated int64
+	TotalFiles     int
+	TotalVersions  int
+	DatabaseSize   int64
+	Users          []UserStorage
+}
+
+// AdminReloadResponse is the JSON serializable response given by the
+// /api/admin/reload POST handler. Reloaded lists the settings that were
+// reloaded.
+type AdminReloadResponse struct {
+	Reloaded []string
+}
+
+// AdminUserImport is one of the users to create in an
+// AdminUsersImportRequest. A random password is generated for the user if
+// Password is empty. The quota is chosen like for an AdminUserAddRequest.
+type AdminUserImport struct {
+	Name     string
+	Password string
+	Quota    int
+	Tier     string
+}
+
+// AdminUsersImportRequest is the JSON serializable request body for the
+// /api/admin/users/import POST handler.
+type AdminUsersImportRequest struct {
+	Users []AdminUserImport
+}
+
+// AdminUserImported is one of the users created by an
+// AdminUsersImportRequest. Password is only set if it was generated.
+type AdminUserImported struct {
+	Name     string
+	UserID   int
+	Password string
+}
+
+// AdminUsersImportResponse is the JSON serializable response given by the
+// /api/admin/users/import POST handler. The users are in the same order as
+// in the request.
+type AdminUsersImportResponse struct {
+	Users []AdminUserImported
+}
+
+// AdminUserStatusResponse is the JSON serializable response given by the
+// /api/admin/users/{name}/suspend and /api/admin/users/{name}/reactivate POST
+// handlers with the user's new account status.
+type AdminUserStatusResponse struct {
+	Status string
+}
+
+// AdminQuotaTiersResponse is the JSON serializable response given by the
+// /api/admin/tiers GET handler. Tiers maps the tier names to their quota
+// in bytes.
+type AdminQuotaTiersResponse struct {
+	DefaultQuota int
+	Tiers        map[string]int
+}
+
+// AdminImpersonateRequest is the JSON serializable request body for the
+// /api/admin/users/:name/impersonate POST handler. Minutes is how long the
+// token is valid for and Reason is recorded in the audit trail.
+type AdminImpersonateRequest struct {
+	Minutes int
+	Reason  string
+}
+
+// AdminImpersonateResponse is the JSON serializable response given by the
+// /api/admin/users/:name/impersonate POST handler. Token authenticates as
+// the user until ExpiresAt (seconds since 1/1/1970). CryptoHash is the
+// user's, so that the user's crypto password can be checked and used to
+// decrypt the file names.
+type AdminImpersonateResponse struct {
+	Token      string
+	UserID     int
+	ExpiresAt  int64
+	CryptoHash []byte
+}
+
+// AdminVacuumResponse is the JSON serializable response given by the
+// /api/admin/vacuum POST handler. The sizes of the database are in bytes.
+type AdminVacuumResponse struct {
+	SizeBefore int64
+	SizeAfter  int64
+}
+
+// AdminJob describes a scheduled maintenance job and its last run on the
+// server instance that answered. The times are in seconds since 1/1/1970
+// and are zero if the job hasn't run or isn't scheduled; LastDuration is in
+// milliseconds.
+type AdminJob struct {
+	Name         string
+	Schedule     string
+	Running      bool
+	Runs         int
+	LastRun      int64
+	LastDuration int64
+	LastResult   string
+	LastError    string
+	NextRun      int64
+}
+
+// AdminJobsResponse is the JSON serializable response given by the
+// /api/admin/jobs GET handler.
+type AdminJobsResponse struct {
+	Jobs []AdminJob
+}
+
+// WebhookEvent is the JSON serializable payload POSTed to the webhook URLs
+// for server events. Data holds the event specific details.
+type WebhookEvent struct {
+	Event    string
+	Time     int64
+	UserID   int
+	UserName string
+	Data     map[string]interface{} `json:",omitempty"`
+}
+
+// PeerTokenRequest is the JSON serializable request object sent to the
+// /api/peer/token POST handler. Audience is the host and port of the peer
+// the token will be presented to; only that peer accepts the token.
+type PeerTokenRequest struct {
+	Audience string
+}
+
+// PeerTokenResponse is the JSON serializable response given by the
+// /api/peer/token POST handler. The token lets the client download chunks
+// from the other client of the same user named by the requested audience
+// over the LAN until ExpiresAt.
+// AccountTag identifies the user's clients in LAN announcements without
+// revealing the user.
+type PeerTokenResponse struct {
+	Token      string
+	ExpiresAt  int64
+	AccountTag string
+}
+
+// PeerVerifyRequest is the JSON serializable request object sent to the
+// /api/peer/verify POST handler.
+type PeerVerifyRequest struct {
+	Token string
+}
+
+// PeerVerifyResponse is the JSON serializable response given by the
+// /api/peer/verify POST handler for a token of the authenticated user.
+// Audience is the host and port of the peer the token was issued for.
+type PeerVerifyResponse struct {
+	ExpiresAt int64
+	Audience  string
+}
+
+// AdminUsersGetResponse is the JSON serializable response given by the
+// /api/admin/users GET handler. Users holds at most Limit users starting
+// after the first Offset users, and Total is the number of users on the
+// server.
+type AdminUsersGetResponse struct {
+	Users  []filefreezer.UserSummary
+	Offset int
+	Limit  int
+	Total  int
+}
+
+// AdminUserGetResponse is the JSON serializable response given by the
+// /api/admin/users/{name} GET handler.
+type AdminUserGetResponse struct {
+	User filefreezer.UserSummary
+}
+
+// AdminUserAddRequest is the JSON serializable request object sent to the
+// /api/admin/users POST handler. The user gets the quota of the named Tier
+// if one is given or the server's default quota if Quota is zero.
+type AdminUserAddRequest struct {
+	Name     string
+	Password string
+	Quota    int
+	Tier     string
+	IsAdmin  bool
+}
+
+// AdminUserAddResponse is the JSON serializable response given by the
+// /api/admin/users POST handler.
+type AdminUserAddResponse struct {
+	UserID int
+}
+
+// AdminUserModRequest is the JSON serializable request object sent to the
+// /api/admin/users/{name} PUT handler. Only the fields that are set get
+// changed; IsAdmin is left alone if it's nil. Tier sets the quota to the
+// quota of the named tier.
+type AdminUserModRequest struct {
+	Quota    int
+	Tier     string
+	Name     string
+	Password string
+	IsAdmin  *bool
+}
+
+// AdminUserModResponse is the JSON serializable response given by the
+// /api/admin/users/{name} PUT handler.
+type AdminUserModResponse struct {
+	Status bool
+}
+
+// AdminUserRmResponse is the JSON serializable response given by the
+// /api/admin/users/{name} DELETE handler.
+type AdminUserRmResponse struct {
+	Status bool
+}
+
+// AdminNamespaceQuotaRequest is the JSON serializable request object sent to
+// the /api/admin/users/{name}/namespaces/{namespace} PUT handler to give the
+// namespace a separate quota; zero makes it share the account's quota again.
+type AdminNamespaceQuotaRequest struct {
+	Quota int
+}
+
+// AdminNamespaceQuotaResponse is the JSON serializable response given by the
+// /api/admin/users/{name}/namespaces/{namespace} PUT handler.
+type AdminNamespaceQuotaResponse struct {
+	Status bool
+}
+
+// AdminTransferRequest is the JSON serializable request object sent to the
+// /api/admin/users/{name}/transfer POST handler to give the files with the
+// FileIDs, or All of the files, of the user to the user named To.
+type AdminTransferRequest struct {
+	To      string
+	FileIDs []int
+	All     bool
+}
+
+// AdminTransferResponse is the JSON serializable response given by the
+// /api/admin/users/{name}/transfer POST handler. Rekey is true if the new
+// owner has to re-key the files because the users have different crypto
+// passwords.
+type AdminTransferResponse struct {
+	Files int
+	Bytes int64
+	Rekey bool
+}
+
+// RekeyGetResponse is the JSON serializable response given by the
+// /api/rekey GET handler with the files that still have to be re-keyed.
+type RekeyGetResponse struct {
+	Files []filefreezer.RekeyFile
+}
+
+// RekeyPutRequest is the JSON serializable request object sent to the
+// /api/rekey/{fileid} PUT handler once the file has been re-encrypted.
+// FileName is the file name encrypted with the new owner's key.
+type RekeyPutRequest struct {
+	FileName string
+	NameKey  string
+}
+
+// RekeyPutResponse is the JSON serializable response given by the
+// /api/rekey/{fileid} PUT handler.
+type RekeyPutResponse struct {
+	Status bool
+}
@@ -0,0 +1,133 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// requireAccount rejects the tokens issued for a namespace, since namespaces
+// are only managed by the account itself.
+func requireAccount() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			claims := c.Get(jwtContextName).(*jwt.Token).Claims.(*jwtCustomClaims)
+			if claims.Namespace != "" {
+				return apiError(c, http.StatusForbidden, "Namespaces can only be managed when logged in to the account itself.")
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// handleGetNamespaces returns the namespaces of the account.
+func handleGetNamespaces(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		namespaces, err := state.Storage.GetNamespaces(claims.UserID)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to get the namespaces: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.NamespacesGetResponse{Namespaces: namespaces})
+	}
+}
+
+// handlePostNamespace adds a namespace to the account.
+func handlePostNamespace(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// deserialize the JSON object that should be in the request body
+		var req models.NamespaceAddRequest
+		err := c.Bind(&req)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+
+		ns, err := state.Storage.AddNamespace(claims.UserID, req.Name)
+		if err != nil {
+			return apiError(c, http.StatusConflict, "Failed to add the namespace: "+err.Error())
+		}
+		state.Activity.record(claims.UserID, claims.Username, "namespace added", "namespace %s", ns.Name)
+
+		return c.JSON(http.StatusOK, &models.NamespaceAddResponse{Namespace: *ns})
+	}
+}
+
+// handleDeleteNamespace removes a namespace of the account along with all of
+// its files.
+func handleDeleteNamespace(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		name := c.Param("name")
+		if unescaped, err := url.PathUnescape(name); err == nil {
+			name = unescaped
+		}
+		_, err := state.Storage.GetNamespace(claims.UserID, name)
+		if err != nil {
+			return apiError(c, http.StatusNotFound, "Failed to find the namespace.")
+		}
+
+		err = state.Storage.RemoveNamespace(claims.UserID, name)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to remove the namespace: "+err.Error())
+		}
+		state.Activity.record(claims.UserID, claims.Username, "namespace removed", "namespace %s", name)
+
+		return c.JSON(http.StatusOK, &models.NamespaceRmResponse{Status: true})
+	}
+}
+
+// handlePutAdminNamespaceQuota gives a namespace of a user a separate quota,
+// or makes it share the quota of the account again if the quota is zero.
+func handlePutAdminNamespaceQuota(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// deserialize the JSON object that should be in the request body
+		var req models.AdminNamespaceQuotaRequest
+		err := c.Bind(&req)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+		if req.Quota < 0 {
+			return apiError(c, http.StatusBadRequest, "A negative quota was supplied in the request.")
+		}
+
+		user, err := state.Storage.GetUser(adminUserParam(c))
+		if err != nil {
+			return apiError(c, http.StatusNotFound, "Failed to find the user.")
+		}
+		name := c.Param("namespace")
+		if unescaped, err := url.PathUnescape(name); err == nil {
+			name = unescaped
+		}
+		_, err = state.Storage.GetNamespace(user.ID, name)
+		if err != nil {
+			return apiError(c, http.StatusNotFound, "Failed to find the namespace.")
+		}
+
+		err = state.Storage.SetNamespaceQuota(user.ID, name, req.Quota)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to set the quota of the namespace: "+err.Error())
+		}
+		state.Activity.record(claims.UserID, claims.Username, "namespace quota set", "namespace %s of user %s to %d", name, user.Name, req.Quota)
+
+		return c.JSON(http.StatusOK, &models.AdminNamespaceQuotaResponse{Status: true})
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/client"
+)
+
+// The sync events that the notifications of the sync daemon are sent for.
+const (
+	syncEventCompleted = "completed" // a sync changed files
+	syncEventConflict  = "conflict"  // a sync found files changed on both sides
+	syncEventQuota     = "quota"     // a sync hit the storage quota or a server limit
+	syncEventFailed    = "failed"    // a sync failed for another reason
+)
+
+// syncNotification is a sync event to notify the user of.
+type syncNotification struct {
+	Event   string
+	Message string
+}
+
+// syncNotifications returns the notifications for a sync of localDir that
+// finished with the report and error. Syncs that didn't change anything
+// don't notify the user.
+func syncNotifications(localDir string, report *client.SyncReport, err error) []syncNotification {
+	var notes []syncNotification
+
+	changed, conflicts := 0, 0
+	var conflictFiles []string
+	quotaErr := err != nil && errors.Is(err, filefreezer.ErrQuotaExceeded)
+	for _, f := range report.Files {
+		if f.Action == client.SyncActionUploaded || f.Action == client.SyncActionDownloaded {
+			changed++
+		}
+		if f.Conflict {
+			conflicts++
+			conflictFiles = append(conflictFiles, f.RemoteFilepath)
+		}
+		if f.Err != nil && errors.Is(f.Err, filefreezer.ErrQuotaExceeded) {
+			quotaErr = true
+		}
+	}
+
+	if changed > 0 && err == nil {
+		notes = append(notes, syncNotification{syncEventCompleted,
+			fmt.Sprintf("Synced %s: %s", localDir, report.Summary())})
+	}
+	if conflicts > 0 {
+		notes = append(notes, syncNotification{syncEventConflict,
+			fmt.Sprintf("%d files in %s changed on both sides; the local copies were kept: %s",
+				conflicts, localDir, strings.Join(conflictFiles, ", "))})
+	}
+	if quotaErr {
+		notes = append(notes, syncNotification{syncEventQuota,
+			fmt.Sprintf("The storage quota was reached while syncing %s; remove old versions or ask for a larger quota.", localDir)})
+	} else if err != nil {
+		notes = append(notes, syncNotification{syncEventFailed,
+			fmt.Sprintf("Failed to sync %s: %v", localDir, err)})
+	}
+	return notes
+}
+
+// syncNotifier sends the notifications of the sync daemon to a hook
+// command, to the desktop, or to both.
+type syncNotifier struct {
+	// hook is the command run for each notification with the
+	// FREEZER_SYNC_EVENT, FREEZER_SYNC_DIR and FREEZER_SYNC_MESSAGE
+	// environment variables set; it's not run if empty.
+	hook string
+
+	// desktop shows the notifications with the desktop's notification
+	// service if it's set.
+	desktop bool
+}
+
+// notify sends the notification about the sync of localDir, logging the
+// failures since they shouldn't stop the daemon.
+func (n *syncNotifier) notify(localDir string, note syncNotification) {
+	if n.hook != "" {
+		cmd := exec.Command(n.hook)
+		cmd.Env = append(os.Environ(),
+			"FREEZER_SYNC_EVENT="+note.Event,
+			"FREEZER_SYNC_DIR="+localDir,
+			"FREEZER_SYNC_MESSAGE="+note.Message,
+		)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			logger.Errorf("Sync notification hook %s failed: %v: %s", n.hook, err, strings.TrimSpace(string(output)))
+		}
+	}
+
+	if n.desktop {
+		cmd := desktopNotifyCommand("freezer: sync "+note.Event, note.Message)
+		if cmd == nil {
+			logger.Warnf("Desktop notifications are not supported on %s.", runtime.GOOS)
+			n.desktop = false
+			return
+		}
+		if output, err := cmd.CombinedOutput(); err != nil {
+			logger.Errorf("Failed to show the desktop notification: %v: %s", err, strings.TrimSpace(string(output)))
+		}
+	}
+}
+
+// desktopNotifyCommand returns the command that shows a notification with
+// the title and message on this platform, or nil if there isn't one.
+func desktopNotifyCommand(title string, message string) *exec.Cmd {
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", appleScriptString(message), appleScriptString(title))
+		return exec.Command("osascript", "-e", script)
+	case "linux", "freebsd", "openbsd", "netbsd":
+		return exec.Command("notify-send", title, message)
+	}
+	return nil
+}
+
+// appleScriptString quotes s as an AppleScript string literal.
+func appleScriptString(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
@@ -0,0 +1,131 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+const (
+	// peerTokenLifetime is how long a peer token is valid for.
+	peerTokenLifetime = time.Minute * 15
+
+	// peerTokenSubject is the subject of peer tokens.
+	peerTokenSubject = "peer"
+)
+
+// peerSigningKey returns the key peer tokens are signed with. It's derived
+// from the JWT secret but differs from it so that a peer token, which is
+// handed to other clients on the LAN, can't be used to call the API.
+func peerSigningKey(state *serverState) []byte {
+	mac := hmac.New(sha256.New, state.JWTSecretBytes)
+	mac.Write([]byte("filefreezer peer token"))
+	return mac.Sum(nil)
+}
+
+// peerAccountTag returns the tag the clients of a user announce themselves
+// with on the LAN. It's the same for every client of the user but doesn't
+// reveal who the user is.
+func peerAccountTag(state *serverState, userID int) string {
+	mac := hmac.New(sha256.New, peerSigningKey(state))
+	fmt.Fprintf(mac, "account %d", userID)
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// handlePostPeerToken handles POST /api/peer/token by issuing a token the
+// authenticated client hands to another client of the same user on the
+// LAN when it downloads chunks from it. The token is bound to the host and
+// port of that client, so a host that answers the announcements of the
+// user's clients can't replay the tokens sent to it to the real clients.
+// A request without a body gets a token without an audience, which no
+// client accepts but which carries the account tag.
+func handlePostPeerToken(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		var req models.PeerTokenRequest
+		if c.Request().ContentLength != 0 {
+			err := c.Bind(&req)
+			if err != nil {
+				return c.String(http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+			}
+		}
+
+		expiresAt := time.Now().Add(peerTokenLifetime).Unix()
+		peerClaims := &jwtCustomClaims{
+			Username: claims.Username,
+			UserID:   claims.UserID,
+			StandardClaims: jwt.StandardClaims{
+				Subject:   peerTokenSubject,
+				Audience:  req.Audience,
+				ExpiresAt: expiresAt,
+			},
+		}
+		t, err := jwt.NewWithClaims(jwt.SigningMethodHS256, peerClaims).SignedString(peerSigningKey(state))
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, &models.PeerTokenResponse{
+			Token:      t,
+			ExpiresAt:  expiresAt,
+			AccountTag: peerAccountTag(state, claims.UserID),
+		})
+	}
+}
+
+// handlePostPeerVerify handles POST /api/peer/verify which a client serving
+// chunks on the LAN uses to check that the peer token presented to it is
+// valid and was issued to the same user. The audience of the token is
+// returned for the client to check that the token was issued for it.
+func handlePostPeerVerify(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		var req models.PeerVerifyRequest
+		err := c.Bind(&req)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+
+		peerClaims, err := parsePeerToken(state, req.Token)
+		if err != nil {
+			return c.String(http.StatusForbidden, "The peer token is not valid.")
+		}
+		if peerClaims.UserID != claims.UserID {
+			return c.String(http.StatusForbidden, "The peer token belongs to another user.")
+		}
+
+		return c.JSON(http.StatusOK, &models.PeerVerifyResponse{ExpiresAt: peerClaims.ExpiresAt, Audience: peerClaims.Audience})
+	}
+}
+
+// parsePeerToken validates a peer token and returns its claims.
+func parsePeerToken(state *serverState, token string) (*jwtCustomClaims, error) {
+	claims := &jwtCustomClaims{}
+	parsed, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		return peerSigningKey(state), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !parsed.Valid || claims.Subject != peerTokenSubject {
+		return nil, fmt.Errorf("invalid peer token")
+	}
+	return claims, nil
+}
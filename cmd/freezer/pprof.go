@@ -0,0 +1,29 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/labstack/echo"
+)
+
+// initPprofRoutes exposes the net/http/pprof handlers under /debug/pprof so
+// that a live server can be profiled. The routes require the JWT of a user
+// with administrator access.
+func initPprofRoutes(state *serverState, e *echo.Echo, jwtMiddleware echo.MiddlewareFunc) {
+	debug := e.Group("/debug/pprof", jwtMiddleware, requireAdmin(state))
+
+	// the index also serves the named profiles such as heap and goroutine
+	index := echo.WrapHandler(http.HandlerFunc(pprof.Index))
+	debug.GET("/", index)
+	debug.GET("/:profile", index)
+
+	debug.GET("/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+	debug.GET("/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+	debug.GET("/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	debug.POST("/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	debug.GET("/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+}
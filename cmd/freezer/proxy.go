@@ -0,0 +1,146 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// forwardedHeaders are the request headers set by reverse proxies that
+// echo uses to determine the client address and scheme.
+var forwardedHeaders = []string{
+	echo.HeaderXForwardedFor,
+	echo.HeaderXRealIP,
+	echo.HeaderXForwardedProto,
+	echo.HeaderXForwardedProtocol,
+	echo.HeaderXForwardedSsl,
+	echo.HeaderXUrlScheme,
+}
+
+// parseTrustedProxies parses the IP addresses and CIDR ranges of the trusted
+// reverse proxies.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range proxies {
+		p = strings.TrimSpace(p)
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address: %s", p)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			p = fmt.Sprintf("%s/%d", p, bits)
+		}
+
+		_, ipNet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range: %s", p)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// normalizeURLPrefix makes sure a URL path prefix starts with a slash and
+// doesn't end with one. An empty or root prefix returns an empty string.
+func normalizeURLPrefix(prefix string) string {
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// isTrustedProxy returns true if the ip is in one of the trusted ranges.
+func isTrustedProxy(ip net.IP, trusted []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyMiddleware returns echo middleware, meant to be used with Echo.Pre,
+// that makes the server work behind a reverse proxy.
+//
+// The URL prefix, if any, is removed from the request path so that the
+// routes match when the server is exposed under a path like /freezer/.
+// Requests that don't have the prefix are left alone so that proxies which
+// strip the prefix themselves also work.
+//
+// The forwarded headers are only honored if the request comes from one of
+// the trusted proxies, in which case the client address from X-Forwarded-For
+// replaces the remote address. The headers are removed from all other
+// requests so that clients can't spoof their address or scheme.
+func proxyMiddleware(prefix string, trusted []*net.IPNet) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+
+			if prefix != "" {
+				path := req.URL.Path
+				if path == prefix || strings.HasPrefix(path, prefix+"/") {
+					path = strings.TrimPrefix(path, prefix)
+					if path == "" {
+						path = "/"
+					}
+					req.URL.Path = path
+					req.URL.RawPath = ""
+				}
+			}
+
+			remoteHost, _, err := net.SplitHostPort(req.RemoteAddr)
+			if err != nil {
+				remoteHost = req.RemoteAddr
+			}
+			if !isTrustedProxy(net.ParseIP(remoteHost), trusted) {
+				for _, h := range forwardedHeaders {
+					req.Header.Del(h)
+				}
+				return next(c)
+			}
+
+			// walk the forwarded addresses from the closest hop back to the
+			// first one that isn't a trusted proxy, which is the client
+			client := ""
+			var hops []string
+			for _, xff := range req.Header[echo.HeaderXForwardedFor] {
+				hops = append(hops, strings.Split(xff, ",")...)
+			}
+			for i := len(hops) - 1; i >= 0; i-- {
+				hop := strings.TrimSpace(hops[i])
+				if net.ParseIP(hop) == nil {
+					break
+				}
+				client = hop
+				if !isTrustedProxy(net.ParseIP(hop), trusted) {
+					break
+				}
+			}
+			if client == "" {
+				client = strings.TrimSpace(req.Header.Get(echo.HeaderXRealIP))
+			}
+			if net.ParseIP(client) != nil {
+				req.RemoteAddr = net.JoinHostPort(client, "0")
+			}
+
+			// the remote address is now the client so echo's RealIP
+			// shouldn't look at the headers again
+			req.Header.Del(echo.HeaderXForwardedFor)
+			req.Header.Del(echo.HeaderXRealIP)
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/logging"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// defaultUserQuota is the quota in bytes of new users when the server isn't
+// given a default quota.
+const defaultUserQuota = 1000000000
+
+// defaultQuotaThresholds are the percentages of a user's quota that trigger
+// a quota notification when no thresholds are configured.
+var defaultQuotaThresholds = []int{80, 95, 100}
+
+// parseQuotaThresholds parses a comma separated list of percentages such as
+// "80,95,100" and returns them sorted in ascending order. An empty string
+// returns the default thresholds.
+func parseQuotaThresholds(list string) ([]int, error) {
+	if strings.TrimSpace(list) == "" {
+		return defaultQuotaThresholds, nil
+	}
+
+	var thresholds []int
+	for _, field := range strings.Split(list, ",") {
+		percent, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || percent < 1 {
+			return nil, fmt.Errorf("invalid quota threshold percentage: %q", field)
+		}
+		thresholds = append(thresholds, percent)
+	}
+	sort.Ints(thresholds)
+	return thresholds, nil
+}
+
+// parseQuotaTiers parses quota tiers given as name=bytes, such as
+// "basic=1000000000", into a map of the tier names to their quota.
+func parseQuotaTiers(list []string) (map[string]int, error) {
+	tiers := make(map[string]int)
+	for _, tier := range list {
+		parts := strings.SplitN(tier, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid quota tier (expected name=bytes): %q", tier)
+		}
+		quota, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || quota < 1 {
+			return nil, fmt.Errorf("invalid quota for the tier %s: %q", parts[0], parts[1])
+		}
+		tiers[strings.TrimSpace(parts[0])] = quota
+	}
+	return tiers, nil
+}
+
+// quotaPlans holds the quota given to new users that aren't given one and
+// the named quota tiers that can be assigned to users instead of a size in
+// bytes. Assigning a tier copies its quota to the user.
+type quotaPlans struct {
+	sync.RWMutex
+	defaultQuota int
+	tiers        map[string]int
+}
+
+// newQuotaPlans creates a quotaPlans with the default quota and tiers.
+func newQuotaPlans(defaultQuota int, tiers map[string]int) *quotaPlans {
+	p := new(quotaPlans)
+	p.set(defaultQuota, tiers)
+	return p
+}
+
+// set replaces the default quota if it's positive and the tiers if they
+// aren't nil.
+func (p *quotaPlans) set(defaultQuota int, tiers map[string]int) {
+	p.Lock()
+	defer p.Unlock()
+	if defaultQuota > 0 {
+		p.defaultQuota = defaultQuota
+	}
+	if tiers != nil {
+		p.tiers = make(map[string]int, len(tiers))
+		for name, quota := range tiers {
+			p.tiers[name] = quota
+		}
+	}
+}
+
+// resolve returns the quota in bytes of the tier if one is named, the quota
+// if it's positive or the default quota otherwise.
+func (p *quotaPlans) resolve(quota int, tier string) (int, error) {
+	p.RLock()
+	defer p.RUnlock()
+	if tier != "" {
+		if quota != 0 {
+			return 0, fmt.Errorf("only one of a quota and a quota tier can be supplied")
+		}
+		tierQuota, ok := p.tiers[tier]
+		if !ok {
+			return 0, fmt.Errorf("the quota tier %s doesn't exist", tier)
+		}
+		return tierQuota, nil
+	}
+	if quota < 0 {
+		return 0, fmt.Errorf("a negative quota was supplied")
+	}
+	if quota == 0 {
+		return p.defaultQuota, nil
+	}
+	return quota, nil
+}
+
+// get returns the default quota and a copy of the tiers.
+func (p *quotaPlans) get() (int, map[string]int) {
+	p.RLock()
+	defer p.RUnlock()
+	tiers := make(map[string]int, len(p.tiers))
+	for name, quota := range p.tiers {
+		tiers[name] = quota
+	}
+	return p.defaultQuota, tiers
+}
+
+// quotaEvent describes a user crossing one of the quota thresholds.
+type quotaEvent struct {
+	Time      time.Time
+	UserID    int
+	Username  string
+	Threshold int
+	Quota     int
+	Allocated int
+}
+
+// quotaMonitor tracks the highest quota threshold each user has crossed so
+// that a notification is only emitted once per crossing. If a user drops back
+// below a threshold, crossing it again emits a new notification. The crossed
+// thresholds are kept in the database so that server instances sharing it
+// don't notify about the same crossing more than once.
+type quotaMonitor struct {
+	sync.Mutex
+	thresholds []int
+	store      *filefreezer.Storage
+	hook       string
+	log        *logging.Logger
+	activity   *activityLog
+	webhooks   *webhookDispatcher
+}
+
+// newQuotaMonitor creates a quotaMonitor for the thresholds. If hook is not
+// empty, it is run as a command for every notification with the event
+// details passed in FREEZER_QUOTA_* environment variables. Notifications
+// are also sent to the webhooks if they're configured.
+func newQuotaMonitor(thresholds []int, hook string, store *filefreezer.Storage, log *logging.Logger, activity *activityLog, webhooks *webhookDispatcher) *quotaMonitor {
+	m := new(quotaMonitor)
+	m.thresholds = thresholds
+	m.store = store
+	m.hook = hook
+	m.log = log
+	m.activity = activity
+	m.webhooks = webhooks
+	return m
+}
+
+// setThresholds replaces the thresholds used for notifications. The
+// thresholds are sorted in ascending order.
+func (m *quotaMonitor) setThresholds(thresholds []int) {
+	sorted := make([]int, len(thresholds))
+	copy(sorted, thresholds)
+	sort.Ints(sorted)
+
+	m.Lock()
+	m.thresholds = sorted
+	m.Unlock()
+}
+
+// threshold returns the highest threshold that the allocation has reached
+// or zero if it is below all of them. The monitor must be locked.
+func (m *quotaMonitor) threshold(quota, allocated int) int {
+	if quota <= 0 {
+		return 0
+	}
+	percent := float64(allocated) * 100.0 / float64(quota)
+	highest := 0
+	for _, t := range m.thresholds {
+		if percent >= float64(t) {
+			highest = t
+		}
+	}
+	return highest
+}
+
+// check compares the user's usage against the thresholds and emits a
+// notification if a higher threshold than before has been crossed. A
+// warning is returned if the user is at or above any threshold; nil
+// otherwise.
+func (m *quotaMonitor) check(userID int, username string, quota, allocated int) *models.QuotaWarning {
+	m.Lock()
+	threshold := m.threshold(quota, allocated)
+	m.Unlock()
+
+	// a failure to record the crossing skips the notification rather than
+	// risk sending it again on every request
+	previous, err := m.store.SwapQuotaNotice(userID, threshold)
+	if err != nil {
+		m.log.Errorf("Failed to record the quota threshold for user %s: %v", username, err)
+		previous = threshold
+	}
+
+	if threshold > previous {
+		m.notify(quotaEvent{
+			Time:      time.Now(),
+			UserID:    userID,
+			Username:  username,
+			Threshold: threshold,
+			Quota:     quota,
+			Allocated: allocated,
+		})
+	}
+
+	if threshold == 0 {
+		return nil
+	}
+	return &models.QuotaWarning{
+		Threshold: threshold,
+		Quota:     quota,
+		Allocated: allocated,
+		Message:   fmt.Sprintf("%d%% of the storage quota has been used (%d of %d bytes).", allocated*100/quota, allocated, quota),
+	}
+}
+
+// notify logs the event, records it in the activity log, sends it to the
+// webhooks and runs the hook command, if one is set, in the background.
+func (m *quotaMonitor) notify(ev quotaEvent) {
+	m.log.Warnf("User %s has crossed %d%% of their quota (%d of %d bytes).", ev.Username, ev.Threshold, ev.Allocated, ev.Quota)
+	if m.activity != nil {
+		m.activity.record(ev.UserID, ev.Username, "quota threshold", "%d%% (%d of %d bytes)", ev.Threshold, ev.Allocated, ev.Quota)
+	}
+
+	webhookEvent := webhookEventQuotaWarning
+	if ev.Threshold >= 100 {
+		webhookEvent = webhookEventQuotaExceed
+	}
+	m.webhooks.send(webhookEvent, ev.UserID, ev.Username, map[string]interface{}{
+		"threshold": ev.Threshold,
+		"quota":     ev.Quota,
+		"allocated": ev.Allocated,
+	})
+
+	if m.hook == "" {
+		return
+	}
+	go func() {
+		cmd := exec.Command(m.hook)
+		cmd.Env = append(os.Environ(),
+			fmt.Sprintf("FREEZER_QUOTA_USER=%s", ev.Username),
+			fmt.Sprintf("FREEZER_QUOTA_USERID=%d", ev.UserID),
+			fmt.Sprintf("FREEZER_QUOTA_THRESHOLD=%d", ev.Threshold),
+			fmt.Sprintf("FREEZER_QUOTA_QUOTA=%d", ev.Quota),
+			fmt.Sprintf("FREEZER_QUOTA_ALLOCATED=%d", ev.Allocated),
+			fmt.Sprintf("FREEZER_QUOTA_TIME=%s", ev.Time.UTC().Format(time.RFC3339)),
+		)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			m.log.Errorf("Quota notification hook %s failed: %v: %s", m.hook, err, strings.TrimSpace(string(output)))
+		}
+	}()
+}
+
+// checkQuota looks up the user's current usage and checks it against the
+// quota thresholds. Failures to read the usage are logged and treated as
+// no warning since they shouldn't fail the request being handled.
+func (state *serverState) checkQuota(userID int, username string) *models.QuotaWarning {
+	stats, err := state.Storage.GetQuotaStats(userID)
+	if err != nil {
+		state.Log.Errorf("Failed to get the user stats for the quota check of user %s: %v", username, err)
+		return nil
+	}
+	return state.quotaWarning(userID, username, stats)
+}
+
+// quotaWarning checks the user's usage against the quota thresholds and
+// adds the hard limit and the end of the grace period to the warning if the
+// allocation is over the quota, which the quota then acts as a soft limit for.
+func (state *serverState) quotaWarning(userID int, username string, stats *filefreezer.UserStats) *models.QuotaWarning {
+	warning := state.Quota.check(userID, username, stats.Quota, stats.Allocated)
+	if stats.OverQuotaSince.IsZero() {
+		return warning
+	}
+
+	if warning == nil {
+		warning = &models.QuotaWarning{Quota: stats.Quota, Allocated: stats.Allocated}
+	}
+	warning.HardQuota = state.Storage.HardQuota(stats.Quota)
+	warning.GraceEnds = stats.OverQuotaSince.Add(state.Storage.QuotaGracePeriod)
+	var grace string
+	if time.Now().Before(warning.GraceEnds) {
+		grace = fmt.Sprintf("The quota is exceeded; uploads are allowed up to %d bytes until %s.", warning.HardQuota, warning.GraceEnds.UTC().Format(time.RFC3339))
+	} else {
+		grace = fmt.Sprintf("The quota is exceeded and the grace period ended at %s; uploads are refused until files are removed.", warning.GraceEnds.UTC().Format(time.RFC3339))
+	}
+	warning.Message = strings.TrimSpace(warning.Message + " " + grace)
+	return warning
+}
@@ -0,0 +1,238 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tbogdala/filefreezer/client"
+)
+
+// The outcomes of a file in a result report besides the sync actions.
+const (
+	resultOutcomeVerified = "verified" // scrub found the file intact
+	resultOutcomeDamaged  = "damaged"  // scrub found problems and they weren't repaired
+	resultOutcomeRepaired = "repaired" // scrub repaired the problems it found
+)
+
+// resultReport is the machine-readable result of a sync, syncdir or scrub
+// command written with --report for automated backup pipelines.
+type resultReport struct {
+	Command  string
+	Target   string
+	Started  time.Time
+	Duration float64 // seconds
+	Success  bool
+
+	// Error is the error that stopped the command; empty if it finished.
+	Error string `json:",omitempty"`
+
+	Files []resultFile
+}
+
+// resultFile is the outcome of one file in a resultReport.
+type resultFile struct {
+	RemoteFilepath string
+	LocalFilename  string  `json:",omitempty"`
+	Outcome        string  // a client.SyncAction value or one of the resultOutcome values
+	Chunks         int     `json:",omitempty"`
+	Bytes          int64   `json:",omitempty"`
+	Duration       float64 `json:",omitempty"` // seconds
+	Conflict       bool    `json:",omitempty"`
+	Error          string  `json:",omitempty"`
+
+	// Problems are the problems scrub found with the file.
+	Problems []string `json:",omitempty"`
+}
+
+// failed returns true if the file's outcome should fail the command. Files
+// queued for an unavailable primary server fail it too since they weren't
+// backed up.
+func (f *resultFile) failed() bool {
+	return f.Outcome == client.SyncActionFailed || f.Outcome == client.SyncActionQueued || f.Outcome == resultOutcomeDamaged
+}
+
+// newSyncResultReport builds the result report of a sync or syncdir command
+// from its sync report and error. Unchanged files are included so that the
+// report lists every file that was checked.
+func newSyncResultReport(command string, target string, started time.Time, report *client.SyncReport, err error) *resultReport {
+	r := &resultReport{
+		Command:  command,
+		Target:   target,
+		Started:  started,
+		Duration: time.Since(started).Seconds(),
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if report != nil {
+		for _, f := range report.Files {
+			rf := resultFile{
+				RemoteFilepath: f.RemoteFilepath,
+				LocalFilename:  f.LocalFilename,
+				Outcome:        f.Action,
+				Chunks:         f.Chunks,
+				Bytes:          f.Bytes,
+				Duration:       f.Duration.Seconds(),
+				Conflict:       f.Conflict,
+			}
+			if f.Err != nil {
+				rf.Error = f.Err.Error()
+			}
+			r.Files = append(r.Files, rf)
+		}
+	}
+	r.Success = r.countFailures() == 0 && err == nil
+	return r
+}
+
+// newScrubResultReport builds the result report of a scrub command from
+// its scrub report and error. The damaged files whose file id is in
+// repaired were repaired from a local copy; repairErrs has the errors of
+// the damaged files that failed to be repaired.
+func newScrubResultReport(target string, started time.Time, report *client.ScrubReport, repaired map[int]bool, repairErrs map[int]error, err error) *resultReport {
+	r := &resultReport{
+		Command:  "scrub",
+		Target:   target,
+		Started:  started,
+		Duration: time.Since(started).Seconds(),
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if report != nil {
+		for _, f := range report.Files {
+			rf := resultFile{
+				RemoteFilepath: f.RemoteFilepath,
+				Outcome:        resultOutcomeVerified,
+				Chunks:         f.ChunksChecked,
+				Problems:       f.Problems,
+			}
+			if f.NeedsUpload() {
+				if repaired[f.FileID] {
+					rf.Outcome = resultOutcomeRepaired
+				} else {
+					rf.Outcome = resultOutcomeDamaged
+					if repairErr := repairErrs[f.FileID]; repairErr != nil {
+						rf.Error = repairErr.Error()
+					}
+				}
+			}
+			r.Files = append(r.Files, rf)
+		}
+	}
+	r.Success = r.countFailures() == 0 && err == nil
+	return r
+}
+
+// countFailures returns the number of files whose outcome fails the command.
+func (r *resultReport) countFailures() int {
+	count := 0
+	for _, f := range r.Files {
+		if f.failed() {
+			count++
+		}
+	}
+	return count
+}
+
+// junitTestSuites is the root element of a JUnit XML report, which CI
+// systems show as a test run with one test case per file.
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+	SystemErr string          `xml:"system-err,omitempty"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junit converts the report to the JUnit XML format. The error that
+// stopped the command, if any, is counted as an error of the suite.
+func (r *resultReport) junit() *junitTestSuites {
+	suite := junitTestSuite{
+		Name:      fmt.Sprintf("freezer %s %s", r.Command, r.Target),
+		Tests:     len(r.Files),
+		Time:      fmt.Sprintf("%.3f", r.Duration),
+		Timestamp: r.Started.UTC().Format("2006-01-02T15:04:05"),
+	}
+	if r.Error != "" {
+		suite.Errors = 1
+		suite.SystemErr = r.Error
+	}
+	for _, f := range r.Files {
+		tc := junitTestCase{
+			ClassName: "freezer." + r.Command,
+			Name:      f.RemoteFilepath,
+			Time:      fmt.Sprintf("%.3f", f.Duration),
+			SystemOut: f.Outcome,
+		}
+		switch {
+		case f.failed():
+			message := f.Error
+			if message == "" {
+				message = strings.Join(f.Problems, "; ")
+			}
+			tc.Failure = &junitMessage{Message: message, Text: strings.Join(f.Problems, "\n")}
+			suite.Failures++
+		case f.Outcome == client.SyncActionSkipped:
+			tc.Skipped = &junitMessage{Message: "the local file type can't be synced"}
+			suite.Skipped++
+		}
+		if f.Conflict {
+			tc.SystemOut += " (conflict; local copy kept)"
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+	return &junitTestSuites{Suites: []junitTestSuite{suite}}
+}
+
+// write writes the report to filename as JUnit XML if the file name ends
+// in .xml or as JSON otherwise.
+func (r *resultReport) write(filename string) error {
+	var data []byte
+	var err error
+	if strings.EqualFold(filepath.Ext(filename), ".xml") {
+		data, err = xml.MarshalIndent(r.junit(), "", "  ")
+		data = append([]byte(xml.Header), data...)
+	} else {
+		data, err = json.MarshalIndent(r, "", "  ")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to serialize the report: %v", err)
+	}
+	err = ioutil.WriteFile(filename, append(data, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write the report file %s: %v", filename, err)
+	}
+	return nil
+}
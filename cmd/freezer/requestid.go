@@ -0,0 +1,125 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/tbogdala/filefreezer/cmd/freezer/logging"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+const (
+	// requestIDContextName is the name the request id is stored under in
+	// the echo context.
+	requestIDContextName = "RequestID"
+
+	// errorResponseContextName is the name apiError and storageError store
+	// the error body under so that the failure can be logged with the
+	// request id.
+	errorResponseContextName = "ErrorResponse"
+
+	// maxRequestIDLength is the longest request id accepted from a client.
+	maxRequestIDLength = 64
+)
+
+// newRequestID returns a random request id of 16 hex digits.
+func newRequestID() string {
+	var id [8]byte
+	_, err := rand.Read(id[:])
+	if err != nil {
+		// the time still tells requests apart well enough for the logs
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// validRequestID returns true if a request id sent by a client or proxy can
+// be used, which keeps it from breaking up or forging lines of the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the id of the request, which is empty if the request
+// id middleware didn't run.
+func requestID(c echo.Context) string {
+	id, _ := c.Get(requestIDContextName).(string)
+	return id
+}
+
+// requestIDMiddleware returns echo middleware that gives every request an
+// id, returned in the models.HeaderRequestID header, and logs the requests
+// that fail with it. Internal errors are logged as errors, refused tokens
+// and missing files, which syncs run into all the time, only for debugging
+// and the other failures as warnings.
+func requestIDMiddleware(state *serverState) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			id := c.Request().Header.Get(models.HeaderRequestID)
+			if !validRequestID(id) {
+				id = newRequestID()
+			}
+			c.Set(requestIDContextName, id)
+			c.Response().Header().Set(models.HeaderRequestID, id)
+
+			// let the error handler write the response for failures so
+			// that the status code is known
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+
+			status := c.Response().Status
+			if status < http.StatusBadRequest {
+				return nil
+			}
+			fields := logging.Fields{"request_id": id, "status": status}
+			code := errorCode(nil, status)
+			message := http.StatusText(status)
+			if errResp, ok := c.Get(errorResponseContextName).(*models.ErrorResponse); ok {
+				code = errResp.Code
+				message = errResp.Message
+				if storageErr := errResp.Details["error"]; storageErr != "" {
+					message += ": " + storageErr
+				}
+			}
+			if token, ok := c.Get(jwtContextName).(*jwt.Token); ok {
+				if claims, ok := token.Claims.(*jwtCustomClaims); ok {
+					fields["user"] = claims.Username
+				}
+			}
+
+			fields["code"] = code
+
+			log := state.Log.With(fields)
+			req := c.Request()
+			switch code {
+			case models.ErrorCodeInternal:
+				log.Errorf("%s %s failed: %s", req.Method, req.URL.Path, message)
+			case models.ErrorCodeUnauthorized, models.ErrorCodeNotFound:
+				log.Debugf("%s %s failed: %s", req.Method, req.URL.Path, message)
+			default:
+				log.Warnf("%s %s failed: %s", req.Method, req.URL.Path, message)
+			}
+			return nil
+		}
+	}
+}
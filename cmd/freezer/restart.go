@@ -0,0 +1,164 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// listenFdEnv is the environment variable telling a restarted server
+	// which file descriptor holds the listener inherited from the old process.
+	listenFdEnv = "FREEZER_LISTEN_FD"
+
+	// readyFdEnv is the environment variable telling a restarted server
+	// which file descriptor to write to once it is serving requests.
+	readyFdEnv = "FREEZER_READY_FD"
+
+	// successorStartTimeout is how long the old process waits for the new
+	// one to report that it is ready before giving up on the restart.
+	successorStartTimeout = 30 * time.Second
+
+	// defaultDrainTimeout is how long in-progress requests have to finish
+	// during shutdown when a drain timeout isn't configured.
+	defaultDrainTimeout = 30 * time.Second
+)
+
+// inheritedListener returns the listener handed down by the previous server
+// process during a restart or nil if there isn't one.
+func inheritedListener() (net.Listener, error) {
+	fd, err := strconv.Atoi(os.Getenv(listenFdEnv))
+	if err != nil {
+		return nil, nil
+	}
+	os.Unsetenv(listenFdEnv)
+
+	f := os.NewFile(uintptr(fd), "inherited listener")
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use the inherited listener: %v", err)
+	}
+	f.Close()
+	return l, nil
+}
+
+// notifyParentReady tells the previous server process, if this process was
+// started by a restart, that it is now serving requests.
+func notifyParentReady() {
+	fd, err := strconv.Atoi(os.Getenv(readyFdEnv))
+	if err != nil {
+		return
+	}
+	os.Unsetenv(readyFdEnv)
+
+	f := os.NewFile(uintptr(fd), "ready pipe")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// handleRestarts starts a new server process that inherits the listener when
+// the restart signal is received. Once the new process is ready, the stop
+// channel is signaled so that this process stops accepting connections and
+// drains the in-progress requests. If the new process fails to start, this
+// process keeps serving.
+func (state *serverState) handleRestarts(listener net.Listener, stop chan os.Signal, stopJobs chan struct{}) {
+	restart := make(chan os.Signal, 1)
+	notifyRestartSignal(restart)
+	defer signal.Stop(restart)
+
+	for {
+		select {
+		case <-restart:
+			state.Log.Infof("Restarting the server ...")
+			pid, err := startSuccessor(listener)
+			if err != nil {
+				state.Log.Errorf("Failed to restart the server: %v", err)
+				continue
+			}
+			state.Log.Infof("New server process %d is ready; draining this one.", pid)
+			select {
+			case stop <- syscall.SIGTERM:
+			default:
+			}
+			return
+		case <-stopJobs:
+			return
+		}
+	}
+}
+
+// startSuccessor runs this executable again with the same arguments, passing
+// it the listener, and waits for it to report that it's ready. The process
+// ID of the new process is returned.
+func startSuccessor(listener net.Listener) (int, error) {
+	filer, ok := listener.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return 0, fmt.Errorf("the listener can't be shared with another process")
+	}
+	listenerFile, err := filer.File()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the listener file: %v", err)
+	}
+	defer listenerFile.Close()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, fmt.Errorf("failed to create the ready pipe: %v", err)
+	}
+	defer readyR.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("failed to find the server executable: %v", err)
+	}
+
+	// the extra files start at descriptor 3 in the new process
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{listenerFile, readyW}
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, listenFdEnv+"=") && !strings.HasPrefix(env, readyFdEnv+"=") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	cmd.Env = append(cmd.Env, listenFdEnv+"=3", readyFdEnv+"=4")
+
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start the new server process: %v", err)
+	}
+	go cmd.Wait()
+
+	// the read fails with EOF if the new process exits before it's ready
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := readyR.Read(b)
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+		if err != nil {
+			return 0, fmt.Errorf("the new server process exited before it was ready")
+		}
+	case <-time.After(successorStartTimeout):
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("the new server process was not ready after %v", successorStartTimeout)
+	}
+
+	return cmd.Process.Pid, nil
+}
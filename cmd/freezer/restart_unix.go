@@ -0,0 +1,19 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyRestartSignal relays SIGUSR2, which requests a graceful restart,
+// to the channel.
+func notifyRestartSignal(c chan os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
@@ -0,0 +1,16 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// notifyRestartSignal does nothing on Windows, which doesn't have a signal
+// for requesting a graceful restart.
+func notifyRestartSignal(c chan os.Signal) {
+}
@@ -0,0 +1,33 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// ifMatchRevision returns the file revision, which is the id of the file's
+// current version, in the If-Match header of the request. Zero is returned
+// if the header is missing or is "*", meaning that any revision matches.
+func ifMatchRevision(c echo.Context) (int, error) {
+	value := strings.TrimSpace(c.Request().Header.Get("If-Match"))
+	if value == "" || value == "*" {
+		return 0, nil
+	}
+	revision, err := strconv.Atoi(strings.Trim(value, `"`))
+	if err != nil || revision < 1 {
+		return 0, fmt.Errorf("the If-Match header must be a file revision, not %s", value)
+	}
+	return revision, nil
+}
+
+// setRevisionETag sets the ETag header of the response to the file revision
+// so that clients can send it back in If-Match.
+func setRevisionETag(c echo.Context, revision int) {
+	c.Response().Header().Set("ETag", `"`+strconv.Itoa(revision)+`"`)
+}
@@ -4,11 +4,13 @@
 package main
 
 import (
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"time"
 
 	"strconv"
+	"strings"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/labstack/echo"
@@ -27,21 +29,79 @@ const (
 type jwtCustomClaims struct {
 	Username string `json:"Username"`
 	UserID   int    `json:"UserID"`
+
+	// ImpersonatorID and Impersonator identify the administrator that an
+	// impersonation token was issued to; they're empty for other tokens.
+	ImpersonatorID int    `json:"ImpersonatorID,omitempty"`
+	Impersonator   string `json:"Impersonator,omitempty"`
+
+	// Namespace and OwnerID identify the namespace a token was issued for
+	// and the account it belongs to; UserID is then the user holding the
+	// files of the namespace. They're empty for the account's own tokens.
+	Namespace string `json:"Namespace,omitempty"`
+	OwnerID   int    `json:"OwnerID,omitempty"`
+
 	jwt.StandardClaims
 }
 
 // InitRoutes creates the routing multiplexer for the server
 func InitRoutes(state *serverState, e *echo.Echo) {
+	// respond to the errors of echo and its middleware like the handlers do
+	e.HTTPErrorHandler = handleHTTPError(state)
+
+	// strip the URL prefix and resolve the client address before routing
+	e.Pre(proxyMiddleware(state.URLPrefix, state.TrustedProxies))
+
+	// give every request an id to find it in the logs by
+	e.Pre(requestIDMiddleware(state))
+
+	// serve the WebDAV share, if enabled, before routing since the router
+	// doesn't handle the WebDAV methods
+	if state.EnableWebDAV {
+		e.Pre(webdavMiddleware(state))
+	}
+
+	// record every request if access logging is enabled
+	if state.AccessLog != nil {
+		e.Use(accessLogMiddleware(state.AccessLog))
+	}
+
+	// refuse request bodies over the size limit, if one is set
+	e.Use(limitBodySize(state))
+
+	// serve restic repositories, if enabled
+	if state.EnableRestic {
+		initResticRoutes(state, e)
+	}
+
 	// setup the user login handler
 	e.POST("/api/users/login", handleUsersLogin(state))
 
+	// serves the admin dashboard web page which pulls its data from the admin API
+	e.GET("/admin", handleGetAdminPage(state))
+
 	restricted := e.Group("/api")
 	jwtConfig := middleware.JWTConfig{
 		Claims:     &jwtCustomClaims{},
 		ContextKey: "JwtToken",
 		SigningKey: state.JWTSecretBytes,
 	}
-	restricted.Use(middleware.JWTWithConfig(jwtConfig))
+	jwtMiddleware := middleware.JWTWithConfig(jwtConfig)
+	restricted.Use(jwtMiddleware)
+
+	// reject the tokens of users that were suspended after logging in
+	restricted.Use(requireActiveUser(state))
+
+	// log and restrict the requests made with an admin's impersonation token
+	restricted.Use(impersonationMiddleware(state))
+
+	// refuse the requests of users over the requests per minute limit, if one is set
+	restricted.Use(limitRequestRate(state))
+
+	// admin only profiling endpoints, if enabled
+	if state.EnablePprof {
+		initPprofRoutes(state, e, jwtMiddleware)
+	}
 
 	// returns the authenticated users's current stats such as quota, allocation and revision counts
 	restricted.GET("/user/stats", handleGetUserStats(state))
@@ -49,15 +109,24 @@ func InitRoutes(state *serverState, e *echo.Echo) {
 	// updates the user's crypto hash used to verify the user-entered password client-side.
 	restricted.PUT("/user/cryptohash", handlePutUserCryptoHash(state))
 
+	// turns case-insensitive remote paths on or off for the user
+	restricted.PUT("/user/caseinsensitive", handlePutUserCaseInsensitive(state))
+
 	// returns all files and their whole-file hash
 	restricted.GET("/files", handleGetAllFiles(state))
 
 	// handles registering a file to a user
 	restricted.POST("/files", handlePutFile(state))
 
+	// streams the files in a directory of a plaintext account as a tar.gz or zip archive
+	restricted.GET("/dir/archive", handleGetDirArchive(state))
+
 	// handles registering a new file version for a given file id
 	restricted.POST("/file/:fileid/version", handleNewFileVersion(state))
 
+	// sets the last modified time, chunk count and file hash of a file version once its data has been streamed
+	restricted.PUT("/file/:fileid/version/:versionid", handlePutFileVersion(state))
+
 	// returns a file information response with missing chunk list
 	restricted.GET("/file/:fileid", handleGetFile(state))
 
@@ -70,14 +139,120 @@ func InitRoutes(state *serverState, e *echo.Echo) {
 	// deletes a file
 	restricted.DELETE("/file/:fileid", handleDeleteFile(state))
 
+	// sets or clears the time after which the server removes a file
+	restricted.PUT("/file/:fileid/expiry", handlePutFileExpiry(state))
+
+	// returns and sets the encrypted note attached to a file
+	restricted.GET("/file/:fileid/note", handleGetFileNote(state))
+	restricted.PUT("/file/:fileid/note", handlePutFileNote(state))
+
+	// returns and sets the encrypted platform attributes of a file
+	restricted.GET("/file/:fileid/attributes", handleGetFileAttributes(state))
+	restricted.PUT("/file/:fileid/attributes", handlePutFileAttributes(state))
+
+	// lists, restores and empties the files in the user's trash
+	restricted.GET("/trash", handleGetTrash(state))
+	restricted.POST("/trash/:fileid/restore", handlePostTrashRestore(state))
+	restricted.DELETE("/trash", handleDeleteTrash(state))
+
+	// lists, adds and removes the tags of a file
+	restricted.GET("/file/:fileid/tags", handleGetFileTags(state))
+	restricted.PUT("/file/:fileid/tags", handlePutFileTags(state))
+	restricted.DELETE("/file/:fileid/tags", handleDeleteFileTags(state))
+
+	// lists the tags used on the user's files and the files with a tag
+	restricted.GET("/tags", handleGetTags(state))
+	restricted.GET("/tags/:token/files", handleGetTaggedFiles(state))
+
+	// stars and unstars a file and lists the user's starred files
+	restricted.PUT("/file/:fileid/star", handleFileStar(state, true))
+	restricted.DELETE("/file/:fileid/star", handleFileStar(state, false))
+	restricted.GET("/starred", handleGetStarredFiles(state))
+
+	// finds files by their search tokens and replaces the search tokens of files
+	restricted.GET("/search", handleGetSearch(state))
+	restricted.PUT("/search/index", handlePutSearchIndex(state))
+
 	// put a file chunk
-	restricted.PUT("/chunk/:fileid/:versionID/:chunknumber/:chunkhash", handlePutFileChunk(state))
+	restricted.PUT("/chunk/:fileid/:versionID/:chunknumber/:chunkhash", handlePutFileChunk(state), limitUploads(state))
+
+	// lists, adds and removes the namespaces of the account
+	restricted.GET("/namespaces", handleGetNamespaces(state), requireAccount())
+	restricted.POST("/namespaces", handlePostNamespace(state), requireAccount())
+	restricted.DELETE("/namespace/:name", handleDeleteNamespace(state), requireAccount())
+
+	// lists the files transferred from another user that still have to be re-keyed and finishes re-keying one
+	restricted.GET("/rekey", handleGetRekey(state))
+	restricted.PUT("/rekey/:fileid", handlePutRekey(state))
+
+	// fills in the chunks of a new file version from an identical file the user already has
+	restricted.POST("/chunk/:fileid/:versionID/copy", handlePostChunkCopy(state))
+
+	// replaces a damaged or missing chunk of a file version with a known good chunk
+	restricted.PUT("/chunk/:fileid/:versionID/:chunknumber/:chunkhash/repair", handleRepairFileChunk(state), limitUploads(state))
 
 	// get a file chunk and returns the raw bytes of the encrypted chunk data
 	restricted.GET("/chunk/:fileid/:versionID/:chunknumber", handleGetFileChunk(state))
 
 	// get all known file chunks (except the chunks themselves)
 	restricted.GET("/chunk/:fileid/:versionID", handleGetFileChunks(state))
+
+	// issues a token for downloading chunks from the user's other clients on the LAN
+	restricted.POST("/peer/token", handlePostPeerToken(state))
+
+	// checks a peer token presented to one of the user's clients on the LAN
+	restricted.POST("/peer/verify", handlePostPeerVerify(state))
+
+	// admin only routes
+	admin := restricted.Group("/admin", requireAdmin(state))
+
+	// returns the users, usage, recent activity and health shown on the admin dashboard
+	admin.GET("/dashboard", handleGetAdminDashboard(state))
+
+	// returns per-user usage with the daily usage history
+	admin.GET("/usage", handleGetAdminUsage(state))
+
+	// exports per-user storage and transfer usage over a date range as JSON or CSV for billing
+	admin.GET("/usage/export", handleGetAdminUsageExport(state))
+
+	// returns the storage used by each user and their largest files by size only
+	admin.GET("/storage", handleGetAdminStorage(state))
+
+	// reloads the configuration file and TLS certificates
+	admin.POST("/reload", handlePostAdminReload(state))
+
+	// lists, adds, modifies and removes users
+	admin.GET("/users", handleGetAdminUsers(state))
+	admin.GET("/users/:name", handleGetAdminUser(state))
+	admin.POST("/users", handlePostAdminUser(state))
+	admin.POST("/users/import", handlePostAdminUsersImport(state))
+	admin.PUT("/users/:name", handlePutAdminUser(state))
+	admin.DELETE("/users/:name", handleDeleteAdminUser(state))
+
+	// suspends a user without removing their files and reactivates them
+	admin.POST("/users/:name/suspend", handlePostAdminUserStatus(state, filefreezer.UserStatusSuspended))
+	admin.POST("/users/:name/reactivate", handlePostAdminUserStatus(state, filefreezer.UserStatusActive))
+
+	// issues a short-lived, read-only token that authenticates as a user
+	admin.POST("/users/:name/impersonate", handlePostAdminImpersonate(state))
+
+	// gives a namespace of a user a separate quota or makes it share the account's again
+	admin.PUT("/users/:name/namespaces/:namespace", handlePutAdminNamespaceQuota(state))
+
+	// gives files of a user to another user, such as when an employee leaves
+	admin.POST("/users/:name/transfer", handlePostAdminTransfer(state))
+
+	// returns the default quota and the quota tiers that can be assigned to users
+	admin.GET("/tiers", handleGetAdminQuotaTiers(state))
+
+	// returns the space freed by removed chunks to the file system
+	admin.POST("/vacuum", handlePostAdminVacuum(state))
+
+	// snapshots the live database and returns the snapshot
+	admin.POST("/backup", handlePostAdminBackup(state))
+
+	// returns the schedules and last runs of the maintenance jobs
+	admin.GET("/jobs", handleGetAdminJobs(state))
 }
 
 // handleUsersLogin handles the incoming POST /api/users/login
@@ -86,33 +261,58 @@ func handleUsersLogin(state *serverState) echo.HandlerFunc {
 		username := c.FormValue("user")
 		password := c.FormValue("password")
 		if username == "" || password == "" {
-			return c.String(http.StatusBadRequest, "Both user and password were not supplied.")
+			return apiError(c, http.StatusBadRequest, "Both user and password were not supplied.")
 		}
 
 		// check the username and password
 		user, err := state.Storage.GetUser(username)
 		if err != nil {
-			return c.String(http.StatusUnauthorized, "Could not find user in the database.")
+			return apiError(c, http.StatusUnauthorized, "Could not find user in the database.")
 		}
 
 		verified := filefreezer.VerifyLoginPassword(password, user.Salt, user.SaltedHash)
 		if !verified {
-			return c.String(http.StatusUnauthorized, "Could not verify the user against the stored salted hash.")
+			return apiError(c, http.StatusUnauthorized, "Could not verify the user against the stored salted hash.")
 		}
 
 		if err != nil || user == nil {
-			return c.String(http.StatusUnauthorized, "Failed to log in with the data provided.")
+			return apiError(c, http.StatusUnauthorized, "Failed to log in with the data provided.")
+		}
+
+		if user.Status == filefreezer.UserStatusSuspended {
+			return apiError(c, http.StatusForbidden, "The account is suspended.")
 		}
 
 		// Set claims
 		claims := &jwtCustomClaims{
-			user.Name,
-			user.ID,
-			jwt.StandardClaims{
+			Username: user.Name,
+			UserID:   user.ID,
+			StandardClaims: jwt.StandardClaims{
 				ExpiresAt: time.Now().Add(time.Minute * 15).Unix(),
 			},
 		}
 
+		// logging in to a namespace issues a token for the user holding its
+		// files; the crypto password is the account's
+		filesUserID := user.ID
+		caseInsensitive := user.CaseInsensitive
+		if namespace := c.FormValue("namespace"); namespace != "" {
+			ns, err := state.Storage.GetNamespace(user.ID, namespace)
+			if err != nil {
+				return apiError(c, http.StatusNotFound, "Could not find the namespace for the user.")
+			}
+			nsUser, err := state.Storage.GetUserByID(ns.UserID)
+			if err != nil {
+				return apiError(c, http.StatusInternalServerError, "Failed to get the namespace from the database.")
+			}
+			claims.Username = nsUser.Name
+			claims.UserID = nsUser.ID
+			claims.Namespace = ns.Name
+			claims.OwnerID = user.ID
+			filesUserID = nsUser.ID
+			caseInsensitive = nsUser.CaseInsensitive
+		}
+
 		// generate the authentication token
 		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
@@ -121,12 +321,22 @@ func handleUsersLogin(state *serverState) echo.HandlerFunc {
 		if err != nil {
 			return err
 		}
+
+		err = state.Storage.SetUserLastLogin(user.ID, time.Now())
+		if err != nil {
+			state.Log.Warnf("Failed to record the login time for %s: %v", user.Name, err)
+		}
+		state.Activity.record(claims.UserID, claims.Username, "login", "")
 		return c.JSON(http.StatusOK, &models.UserLoginResponse{
 			Token:      t,
 			CryptoHash: user.CryptoHash,
 			Capabilities: models.ServerCapabilities{
-				ChunkSize: *flagServeChunkSize,
+				ChunkSize:   *flagServeChunkSize,
+				DeniedNames: state.DeniedNames,
 			},
+			QuotaWarning:    state.checkQuota(filesUserID, claims.Username),
+			CaseInsensitive: caseInsensitive,
+			ServerTime:      time.Now(),
 		})
 	}
 }
@@ -138,19 +348,23 @@ func handlePutUserCryptoHash(state *serverState) echo.HandlerFunc {
 		jwtToken := c.Get(jwtContextName).(*jwt.Token)
 		claims := jwtToken.Claims.(*jwtCustomClaims)
 		userID := claims.UserID
+		if claims.Namespace != "" {
+			return apiError(c, http.StatusForbidden, "The crypto password is shared by the namespaces of an account and can only be changed when logged in to the account itself.")
+		}
 
 		// deserialize the JSON object that should be in the request body
 		var req models.UserCryptoHashUpdateRequest
 		err := c.Bind(&req)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+			return apiError(c, http.StatusBadRequest, "Failed to read the request body: "+err.Error())
 		}
 
 		// set the new crypto hash for the user
 		err = state.Storage.UpdateUserCryptoHash(userID, req.CryptoHash)
 		if err != nil {
-			return c.String(http.StatusInternalServerError, "Failed to update the user's crypto hash information for the authenticated user.")
+			return apiError(c, http.StatusInternalServerError, "Failed to update the user's crypto hash information for the authenticated user.")
 		}
+		state.Activity.record(userID, claims.Username, "cryptohash updated", "")
 
 		return c.JSON(http.StatusOK, &models.UserCryptoHashUpdateResponse{
 			Status: true,
@@ -158,6 +372,34 @@ func handlePutUserCryptoHash(state *serverState) echo.HandlerFunc {
 	}
 }
 
+// handlePutUserCaseInsensitive turns case-insensitive remote paths on or
+// off for the authenticated user.
+func handlePutUserCaseInsensitive(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// deserialize the JSON object that should be in the request body
+		var req models.UserCaseInsensitiveRequest
+		err := c.Bind(&req)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+
+		nameKeys := make(map[int]string, len(req.NameKeys))
+		for _, nk := range req.NameKeys {
+			nameKeys[nk.FileID] = nk.NameKey
+		}
+		err = state.Storage.SetCaseInsensitive(claims.UserID, req.Enabled, nameKeys)
+		if err != nil {
+			return storageError(c, err, http.StatusBadRequest, "Failed to set the case sensitivity of the remote paths: "+err.Error())
+		}
+		state.Activity.record(claims.UserID, claims.Username, "case sensitivity updated", "case-insensitive %v", req.Enabled)
+
+		return c.JSON(http.StatusOK, &models.UserCaseInsensitiveResponse{Success: true})
+	}
+}
+
 // handleGetUserStats returns a JSON object with the authenticated user's current
 // stats susch as the quota, allocated byte count and current revision number.
 func handleGetUserStats(state *serverState) echo.HandlerFunc {
@@ -167,15 +409,23 @@ func handleGetUserStats(state *serverState) echo.HandlerFunc {
 
 		stats, err := state.Storage.GetUserStats(claims.UserID)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "Failed to get the user stats information for the authenticated user.")
+			return apiError(c, http.StatusBadRequest, "Failed to get the user stats information for the authenticated user.")
+		}
+		transfer, err := state.Storage.GetMonthlyTransfer(claims.UserID, time.Now())
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to get the transfer usage for the authenticated user.")
 		}
 
 		return c.JSON(http.StatusOK, &models.UserStatsGetResponse{
 			Stats: filefreezer.UserStats{
-				Quota:     stats.Quota,
-				Allocated: stats.Allocated,
-				Revision:  stats.Revision,
+				Quota:          stats.Quota,
+				Allocated:      stats.Allocated,
+				Logical:        stats.Logical,
+				Revision:       stats.Revision,
+				OverQuotaSince: stats.OverQuotaSince,
 			},
+			QuotaWarning: state.quotaWarning(claims.UserID, claims.Username, stats),
+			Transfer:     *transfer,
 		})
 	}
 }
@@ -190,7 +440,7 @@ func handleGetAllFiles(state *serverState) echo.HandlerFunc {
 		// pull down all the fileinfo objects for a user
 		allFileInfos, err := state.Storage.GetAllUserFileInfos(claims.UserID)
 		if err != nil {
-			return c.String(http.StatusNotFound, "Failed to get files for the user.")
+			return apiError(c, http.StatusNotFound, "Failed to get files for the user.")
 		}
 
 		return c.JSON(http.StatusOK, &models.AllFilesGetResponse{
@@ -208,27 +458,49 @@ func handleNewFileVersion(state *serverState) echo.HandlerFunc {
 		var req models.NewFileVersionRequest
 		err := c.Bind(&req)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+			return apiError(c, http.StatusBadRequest, "Failed to read the request body: "+err.Error())
 		}
 
 		// pull the file id from the URI matched by the mux
 		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
 		if err != nil {
-			return c.String(http.StatusBadGateway, "A valid integer was not used for the file id in the URI.")
+			return apiError(c, http.StatusBadGateway, "A valid integer was not used for the file id in the URI.")
+		}
+
+		// the new version can be made conditional on the revision it's based on
+		revision, err := ifMatchRevision(c)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, err.Error())
 		}
 
 		// pull down the fileinfo object for a file ID
 		fi, err := state.Storage.GetFileInfo(claims.UserID, int(fileID))
 		if err != nil {
-			return c.String(http.StatusNotFound, "Failed to get file for the user.")
+			return storageError(c, err, http.StatusNotFound, "Failed to get file for the user.")
 		}
 
 		// create new file version
-		fi, err = state.Storage.TagNewFileVersion(claims.UserID, int(fileID), req.Permissions, req.LastMod, req.ChunkCount, req.FileHash)
+		fi, err = state.Storage.TagNewFileVersionAtRevision(claims.UserID, int(fileID), revision, req.Permissions, req.LastMod, req.ChunkCount, req.FileHash)
 		if err != nil {
-			return c.String(http.StatusInternalServerError, "Failed to tag a new version of the file for the user: "+err.Error())
+			return storageError(c, err, http.StatusInternalServerError, "Failed to tag a new version of the file for the user: "+err.Error())
 		}
+		if req.MerkleRoot != "" {
+			err = state.Storage.SetFileVersionMerkleRoot(claims.UserID, fi.FileID, fi.CurrentVersion.VersionID, req.MerkleRoot)
+			if err != nil {
+				return storageError(c, err, http.StatusInternalServerError, "Failed to record the Merkle root of the file version: "+err.Error())
+			}
+			fi.CurrentVersion.MerkleRoot = req.MerkleRoot
+		}
+		if req.Device != "" {
+			err = state.Storage.SetFileVersionDevice(claims.UserID, fi.FileID, fi.CurrentVersion.VersionID, req.Device)
+			if err != nil {
+				return storageError(c, err, http.StatusBadRequest, "Failed to record the device of the file version: "+err.Error())
+			}
+			fi.CurrentVersion.Device = req.Device
+		}
+		state.Activity.record(claims.UserID, claims.Username, "version added", "file id %d, version %d", fi.FileID, fi.CurrentVersion.VersionNumber)
 
+		setRevisionETag(c, fi.CurrentVersion.VersionID)
 		return c.JSON(http.StatusOK, &models.NewFileVersionResponse{
 			FileInfo: *fi,
 			Status:   true,
@@ -236,25 +508,81 @@ func handleNewFileVersion(state *serverState) echo.HandlerFunc {
 	}
 }
 
+func handlePutFileVersion(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// deserialize the JSON object that should be in the request body
+		var req models.FileVersionUpdateRequest
+		err := c.Bind(&req)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+		if req.ChunkCount < 0 {
+			return apiError(c, http.StatusBadRequest, "A valid chunk count was not supplied.")
+		}
+		if len(req.FileHash) < 1 {
+			return apiError(c, http.StatusBadRequest, "A valid file hash was not supplied.")
+		}
+
+		// pull the file id and version id from the URI matched by the mux
+		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+		versionID, err := strconv.ParseInt(c.Param("versionid"), 10, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the version id in the URI.")
+		}
+
+		err = state.Storage.UpdateFileVersion(claims.UserID, int(fileID), int(versionID), req.LastMod, req.ChunkCount, req.FileHash)
+		if err != nil {
+			return storageError(c, err, http.StatusNotFound, "Failed to update the file version for the user: "+err.Error())
+		}
+		if req.MerkleRoot != "" {
+			err = state.Storage.SetFileVersionMerkleRoot(claims.UserID, int(fileID), int(versionID), req.MerkleRoot)
+			if err != nil {
+				return storageError(c, err, http.StatusInternalServerError, "Failed to record the Merkle root of the file version: "+err.Error())
+			}
+		}
+
+		return c.JSON(http.StatusOK, &models.FileVersionUpdateResponse{
+			Status: true,
+		})
+	}
+}
+
 func handleGetAllFileVersion(state *serverState) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		//jwtToken := c.Get(jwtContextName).(*jwt.Token)
-		//claims := jwtToken.Claims.(*jwtCustomClaims)
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
 
 		// pull the file id from the URI matched by the mux
 		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
 		}
 
 		// get all the versions associated with the file in storage
 		versions, err := state.Storage.GetFileVersions(int(fileID))
 		if err != nil {
-			return c.String(http.StatusNotFound, "Failed to get file versions for the user.")
+			return apiError(c, http.StatusNotFound, "Failed to get file versions for the user.")
+		}
+
+		// the sizes are only informational, so versions whose size can't be
+		// read are left out rather than failing the request
+		sizes := make(map[int]int64, len(versions))
+		for _, v := range versions {
+			size, err := state.Storage.GetFileVersionSize(claims.UserID, int(fileID), v.VersionID)
+			if err == nil {
+				sizes[v.VersionID] = size
+			}
 		}
 
 		return c.JSON(http.StatusOK, &models.FileGetAllVersionsResponse{
-			Versions: versions,
+			Versions:    versions,
+			StoredSizes: sizes,
 		})
 	}
 }
@@ -267,21 +595,28 @@ func handleDeleteFileVersions(state *serverState) echo.HandlerFunc {
 		// pull the file id from the URI matched by the mux
 		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
 		}
 
 		// deserialize the JSON object that should be in the request body
 		var req models.FileDeleteVersionsRequest
 		err = c.Bind(&req)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+			return apiError(c, http.StatusBadRequest, "Failed to read the request body: "+err.Error())
 		}
 
-		err = state.Storage.RemoveFileVersions(claims.UserID, int(fileID), req.MinVersion, req.MaxVersion)
+		revision, err := ifMatchRevision(c)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "Failed to remove file versions for the file: "+err.Error())
+			return apiError(c, http.StatusBadRequest, err.Error())
 		}
 
+		err = state.Storage.RemoveFileVersionsAtRevision(claims.UserID, int(fileID), revision, req.MinVersion, req.MaxVersion)
+		if err != nil {
+			return storageError(c, err, http.StatusBadRequest, "Failed to remove file versions for the file: "+err.Error())
+		}
+		state.Activity.record(claims.UserID, claims.Username, "versions removed", "file id %d, versions %d to %d", fileID, req.MinVersion, req.MaxVersion)
+		state.checkQuota(claims.UserID, claims.Username)
+
 		return c.JSON(http.StatusOK, &models.FileDeleteVersionsResponse{
 			Status: true,
 		})
@@ -298,21 +633,22 @@ func handleGetFile(state *serverState) echo.HandlerFunc {
 		// pull the file id from the URI matched by the mux
 		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
 		}
 
 		// pull down the fileinfo object for a file ID
 		fi, err := state.Storage.GetFileInfo(claims.UserID, int(fileID))
 		if err != nil {
-			return c.String(http.StatusNotFound, "Failed to get file for the user.")
+			return storageError(c, err, http.StatusNotFound, "Failed to get file for the user.")
 		}
 
 		// get all of the missing chunks
 		missingChunks, err := state.Storage.GetMissingChunkNumbersForFile(claims.UserID, fi.FileID)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "Failed to get the missing chunks for the file.")
+			return storageError(c, err, http.StatusBadRequest, "Failed to get the missing chunks for the file.")
 		}
 
+		setRevisionETag(c, fi.CurrentVersion.VersionID)
 		return c.JSON(http.StatusOK, &models.FileGetResponse{
 			FileInfo:      *fi,
 			MissingChunks: missingChunks,
@@ -331,37 +667,60 @@ func handlePutFileChunk(state *serverState) echo.HandlerFunc {
 		// pull the file id from the URI matched by the mux
 		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
 		}
 		versionID, err := strconv.ParseInt(c.Param("versionID"), 10, 64)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "A valid string was not used for the version id in the URI.")
+			return apiError(c, http.StatusBadRequest, "A valid string was not used for the version id in the URI.")
 		}
 		chunkNumber, err := strconv.ParseInt(c.Param("chunknumber"), 10, 64)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "A valid integer was not used for the chunk number in the URI.")
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the chunk number in the URI.")
 		}
 		chunkHash := c.Param("chunkhash")
 		if chunkHash == "" {
-			return c.String(http.StatusBadRequest, "A valid string was not used for the chunk hash.")
+			return apiError(c, http.StatusBadRequest, "A valid string was not used for the chunk hash.")
 		}
 
 		// get a byte limited reader, set to the maximum chunk size supported by Storage
 		// plus a little extra space for cryptography information
 		r := c.Request()
 		w := c.Response().Writer
-		bodyReader := http.MaxBytesReader(w, r.Body, state.Storage.ChunkSize+128)
+		bodyReader := http.MaxBytesReader(w, r.Body, state.Storage.ChunkSize+filefreezer.MaxChunkOverhead)
 		defer bodyReader.Close()
 		chunk, err := ioutil.ReadAll(bodyReader)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "Failed to read the chunk: "+err.Error())
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return storageError(c, filefreezer.ErrChunkTooLarge, http.StatusRequestEntityTooLarge, "Failed to read the chunk: "+filefreezer.ErrChunkTooLarge.Error())
+			}
+			return apiError(c, http.StatusBadRequest, "Failed to read the chunk: "+err.Error())
+		}
+
+		err = state.Storage.CheckTransferLimit(claims.UserID, int64(len(chunk)))
+		if err != nil {
+			return storageError(c, err, http.StatusInternalServerError, "Failed to add the chunk to storage: "+err.Error())
 		}
 
 		// AddFileChunk does verify that the user ID owns the fild ID so we don't need
 		// to replicate that work here, just add the chunk.
 		fc, err := state.Storage.AddFileChunk(claims.UserID, int(fileID), int(versionID), int(chunkNumber), chunkHash, chunk)
+		state.StorageCap.check(claims.UserID, claims.Username, err)
 		if err != nil || fc == nil {
-			return c.String(http.StatusInternalServerError, "Failed to add the chunk to storage: "+err.Error())
+			return storageError(c, err, http.StatusInternalServerError, "Failed to add the chunk to storage: "+err.Error())
+		}
+		state.recordTransfer(claims.UserID, int64(len(chunk)), 0)
+		state.checkQuota(claims.UserID, claims.Username)
+
+		// let the webhooks know once the last missing chunk of the file has been uploaded
+		if state.Webhooks != nil {
+			missingChunks, err := state.Storage.GetMissingChunkNumbersForFile(claims.UserID, int(fileID))
+			if err == nil && len(missingChunks) == 0 {
+				state.Webhooks.send(webhookEventFileUploaded, claims.UserID, claims.Username, map[string]interface{}{
+					"fileID":    fileID,
+					"versionID": versionID,
+				})
+			}
 		}
 
 		return c.JSON(http.StatusOK, &models.FileChunkPutResponse{
@@ -370,6 +729,73 @@ func handlePutFileChunk(state *serverState) echo.HandlerFunc {
 	}
 }
 
+// handleRepairFileChunk reads a chunk from the request body and replaces the chunk of the
+// file version given in the parameters with it. The chunk has to match the hashes recorded
+// for the file version; the optional proof query parameter is a comma separated Merkle proof
+// of the chunk hash. A Status boolean is returned to indicate the success of the operation.
+func handleRepairFileChunk(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+		versionID, err := strconv.ParseInt(c.Param("versionID"), 10, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "A valid string was not used for the version id in the URI.")
+		}
+		chunkNumber, err := strconv.ParseInt(c.Param("chunknumber"), 10, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the chunk number in the URI.")
+		}
+		chunkHash := c.Param("chunkhash")
+		if chunkHash == "" {
+			return apiError(c, http.StatusBadRequest, "A valid string was not used for the chunk hash.")
+		}
+		var proof []string
+		if c.QueryParams().Has("proof") {
+			proof = []string{}
+			if p := c.QueryParam("proof"); p != "" {
+				proof = strings.Split(p, ",")
+			}
+		}
+
+		r := c.Request()
+		w := c.Response().Writer
+		bodyReader := http.MaxBytesReader(w, r.Body, state.Storage.ChunkSize+filefreezer.MaxChunkOverhead)
+		defer bodyReader.Close()
+		chunk, err := ioutil.ReadAll(bodyReader)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return storageError(c, filefreezer.ErrChunkTooLarge, http.StatusRequestEntityTooLarge, "Failed to read the chunk: "+filefreezer.ErrChunkTooLarge.Error())
+			}
+			return apiError(c, http.StatusBadRequest, "Failed to read the chunk: "+err.Error())
+		}
+
+		err = state.Storage.CheckTransferLimit(claims.UserID, int64(len(chunk)))
+		if err != nil {
+			return storageError(c, err, http.StatusInternalServerError, "Failed to repair the chunk: "+err.Error())
+		}
+
+		_, err = state.Storage.RepairFileChunk(claims.UserID, int(fileID), int(versionID), int(chunkNumber), chunkHash, proof, chunk)
+		state.StorageCap.check(claims.UserID, claims.Username, err)
+		if err != nil {
+			return storageError(c, err, http.StatusInternalServerError, "Failed to repair the chunk: "+err.Error())
+		}
+		state.recordTransfer(claims.UserID, int64(len(chunk)), 0)
+		state.checkQuota(claims.UserID, claims.Username)
+		state.Activity.record(claims.UserID, claims.Username, "chunk repaired", "file id %d, version id %d, chunk %d", fileID, versionID, chunkNumber)
+
+		return c.JSON(http.StatusOK, &models.FileChunkPutResponse{
+			Status: true,
+		})
+	}
+}
+
 // handleGetFile returns a JSON object with all of the FileInfo data for the file in Storage
 // as well as a slice of missing chunks, if any.
 func handleGetFileChunks(state *serverState) echo.HandlerFunc {
@@ -380,16 +806,16 @@ func handleGetFileChunks(state *serverState) echo.HandlerFunc {
 		// pull the file id from the URI matched by the mux
 		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
 		}
 		versionID, err := strconv.ParseInt(c.Param("versionID"), 10, 64)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "A valid string was not used for the version id in the URI.")
+			return apiError(c, http.StatusBadRequest, "A valid string was not used for the version id in the URI.")
 		}
 
 		chunks, err := state.Storage.GetFileChunkInfos(claims.UserID, int(fileID), int(versionID))
 		if err != nil {
-			return c.String(http.StatusBadRequest, "Failed to get the chunk informations for the file id in the URI.")
+			return storageError(c, err, http.StatusBadRequest, "Failed to get the chunk informations for the file id in the URI.")
 		}
 
 		return c.JSON(http.StatusOK, &models.FileChunksGetResponse{
@@ -408,30 +834,35 @@ func handleGetFileChunk(state *serverState) echo.HandlerFunc {
 		// pull the file id from the URI matched by the mux
 		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
 		}
 		versionID, err := strconv.ParseInt(c.Param("versionID"), 10, 64)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "A valid string was not used for the version id in the URI.")
+			return apiError(c, http.StatusBadRequest, "A valid string was not used for the version id in the URI.")
 		}
 		chunkNumber, err := strconv.ParseInt(c.Param("chunknumber"), 10, 64)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "A valid integer was not used for the chunk number in the URI.")
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the chunk number in the URI.")
 		}
 
 		// get the file info first to ensure ownership
 		fi, err := state.Storage.GetFileInfo(claims.UserID, int(fileID))
 		if err != nil {
-			return c.String(http.StatusBadRequest, "Failed to get the file information for the file id in the URI.")
+			return storageError(c, err, http.StatusBadRequest, "Failed to get the file information for the file id in the URI.")
 		}
 		if fi.UserID != claims.UserID {
-			return c.String(http.StatusForbidden, "Access denied.")
+			return apiError(c, http.StatusForbidden, "Access denied.")
 		}
 
 		chunk, err := state.Storage.GetFileChunk(int(fileID), int(chunkNumber), int(versionID))
 		if err != nil {
-			return c.String(http.StatusBadRequest, "Failed to get the chunk information for the file id and chunk number in the URI.")
+			return apiError(c, http.StatusBadRequest, "Failed to get the chunk information for the file id and chunk number in the URI.")
 		}
+		err = state.Storage.CheckTransferLimit(claims.UserID, int64(len(chunk.Chunk)))
+		if err != nil {
+			return storageError(c, err, http.StatusInternalServerError, "Failed to get the chunk: "+err.Error())
+		}
+		state.recordTransfer(claims.UserID, 0, int64(len(chunk.Chunk)))
 
 		return c.Blob(http.StatusOK, "application/octet-stream", chunk.Chunk)
 	}
@@ -447,28 +878,77 @@ func handlePutFile(state *serverState) echo.HandlerFunc {
 		var req models.FilePutRequest
 		err := c.Bind(&req)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+			return apiError(c, http.StatusBadRequest, "Failed to read the request body: "+err.Error())
 		}
 
 		// sanity check some input
 		if len(req.FileName) < 1 {
-			return c.String(http.StatusBadRequest, "fileName must be supplied in the request")
+			return apiError(c, http.StatusBadRequest, "fileName must be supplied in the request")
 		}
 		if req.LastMod < 1 {
-			return c.String(http.StatusBadRequest, "lastMod time must be supplied in the request")
+			return apiError(c, http.StatusBadRequest, "lastMod time must be supplied in the request")
 		}
 		if req.ChunkCount < 0 {
-			return c.String(http.StatusBadRequest, "chunkCount must be supplied in the request")
+			return apiError(c, http.StatusBadRequest, "chunkCount must be supplied in the request")
 		}
 		if len(req.FileHash) < 1 && !req.IsDir {
-			return c.String(http.StatusBadRequest, "fileHash must be supplied in the request")
+			return apiError(c, http.StatusBadRequest, "fileHash must be supplied in the request")
+		}
+		if req.ExpiresAt != 0 && req.ExpiresAt <= time.Now().Unix() {
+			return apiError(c, http.StatusBadRequest, "expiresAt must be in the future")
+		}
+
+		// the name key only matters, and is only kept, if the account treats
+		// paths case-insensitively
+		nameKey := ""
+		if req.NameKey != "" {
+			user, err := state.Storage.GetUserByID(claims.UserID)
+			if err != nil {
+				return apiError(c, http.StatusInternalServerError, "Failed to get the user information for the authenticated user.")
+			}
+			if user.CaseInsensitive {
+				nameKey = req.NameKey
+			}
 		}
 
 		// register a new file in storage with the information
-		fi, err := state.Storage.AddFileInfo(claims.UserID, req.FileName, req.IsDir, req.Permissions, req.LastMod, req.ChunkCount, req.FileHash)
+		fi, err := state.Storage.AddFileInfoWithNameKey(claims.UserID, req.FileName, nameKey, req.IsDir, req.Permissions, req.LastMod, req.ChunkCount, req.FileHash)
 		if err != nil {
-			return c.String(http.StatusConflict, "Failed to put a new file in storage for the user. "+err.Error())
+			return storageError(c, err, http.StatusInternalServerError, "Failed to put a new file in storage for the user. "+err.Error())
+		}
+		if req.MerkleRoot != "" && !req.IsDir {
+			err = state.Storage.SetFileVersionMerkleRoot(claims.UserID, fi.FileID, fi.CurrentVersion.VersionID, req.MerkleRoot)
+			if err != nil {
+				return storageError(c, err, http.StatusInternalServerError, "Failed to record the Merkle root of the file version: "+err.Error())
+			}
+			fi.CurrentVersion.MerkleRoot = req.MerkleRoot
+		}
+		if req.Device != "" {
+			err = state.Storage.SetFileVersionDevice(claims.UserID, fi.FileID, fi.CurrentVersion.VersionID, req.Device)
+			if err != nil {
+				return storageError(c, err, http.StatusBadRequest, "Failed to record the device of the file: "+err.Error())
+			}
+			fi.Device = req.Device
+			fi.CurrentVersion.Device = req.Device
 		}
+		if req.ExpiresAt != 0 {
+			err = state.Storage.SetFileExpiry(claims.UserID, fi.FileID, req.ExpiresAt)
+			if err != nil {
+				return storageError(c, err, http.StatusInternalServerError, "Failed to set the expiry time of the file: "+err.Error())
+			}
+			fi.ExpiresAt = req.ExpiresAt
+		}
+		if len(req.SearchTokens) > 0 {
+			err = state.Storage.SetFileSearchTokens(claims.UserID, fi.FileID, req.SearchTokens)
+			if err != nil {
+				return storageError(c, err, http.StatusInternalServerError, "Failed to set the search tokens of the file: "+err.Error())
+			}
+		}
+		state.Activity.record(claims.UserID, claims.Username, "file added", "file id %d", fi.FileID)
+		state.Webhooks.send(webhookEventFileAdded, claims.UserID, claims.Username, map[string]interface{}{
+			"fileID": fi.FileID,
+			"isDir":  fi.IsDir,
+		})
 
 		return c.JSON(http.StatusOK, &models.FilePutResponse{
 			FileInfo: *fi,
@@ -484,15 +964,112 @@ func handleDeleteFile(state *serverState) echo.HandlerFunc {
 		// pull the file id from the URI matched by the mux
 		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		revision, err := ifMatchRevision(c)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, err.Error())
 		}
 
 		// delete a file from storage with the information
-		err = state.Storage.RemoveFile(claims.UserID, int(fileID))
+		err = state.Storage.RemoveFileAtRevision(claims.UserID, int(fileID), revision)
 		if err != nil {
-			return c.String(http.StatusConflict, "Failed to remove a file in storage for the user. "+err.Error())
+			return storageError(c, err, http.StatusInternalServerError, "Failed to remove a file in storage for the user. "+err.Error())
 		}
+		state.Activity.record(claims.UserID, claims.Username, "file removed", "file id %d", fileID)
+		state.Webhooks.send(webhookEventFileRemoved, claims.UserID, claims.Username, map[string]interface{}{
+			"fileID": fileID,
+		})
+		state.checkQuota(claims.UserID, claims.Username)
 
 		return c.JSON(http.StatusOK, &models.FileDeleteResponse{Success: true})
 	}
 }
+
+// handlePutFileExpiry sets or clears the time after which the server removes
+// a file.
+func handlePutFileExpiry(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		// deserialize the JSON object that should be in the request body
+		var req models.FileExpiryPutRequest
+		err = c.Bind(&req)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+		if req.ExpiresAt != 0 && req.ExpiresAt <= time.Now().Unix() {
+			return apiError(c, http.StatusBadRequest, "expiresAt must be in the future")
+		}
+
+		err = state.Storage.SetFileExpiry(claims.UserID, int(fileID), req.ExpiresAt)
+		if err != nil {
+			return storageError(c, err, http.StatusNotFound, "Failed to set the expiry time of the file: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.FileExpiryPutResponse{Success: true})
+	}
+}
+
+// handleGetFileNote returns the note attached to a file, which is empty if
+// the file has no note.
+func handleGetFileNote(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		note, err := state.Storage.GetFileNote(claims.UserID, int(fileID))
+		if err != nil {
+			return storageError(c, err, http.StatusNotFound, "Failed to get the note of the file: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.FileNoteResponse{Note: note})
+	}
+}
+
+// handlePutFileNote attaches a note to a file or removes it if the note in
+// the request is empty.
+func handlePutFileNote(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		// deserialize the JSON object that should be in the request body
+		var req models.FileNotePutRequest
+		err = c.Bind(&req)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+		if len(req.Note) > filefreezer.MaxNoteLength {
+			return apiError(c, http.StatusBadRequest, "note must be at most "+strconv.Itoa(filefreezer.MaxNoteLength)+" bytes")
+		}
+
+		err = state.Storage.SetFileNote(claims.UserID, int(fileID), req.Note)
+		if err != nil {
+			return storageError(c, err, http.StatusNotFound, "Failed to set the note of the file: "+err.Error())
+		}
+		state.Activity.record(claims.UserID, claims.Username, "note set", "file id %d", fileID)
+
+		return c.JSON(http.StatusOK, &models.FileNoteResponse{Note: req.Note})
+	}
+}
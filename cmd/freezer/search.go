@@ -0,0 +1,61 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"net/http"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// handleGetSearch returns the user's files that have all of the search
+// tokens given in the token query parameters.
+func handleGetSearch(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		tokens := c.QueryParams()["token"]
+		if len(tokens) == 0 {
+			return apiError(c, http.StatusBadRequest, "At least one token must be supplied in the query.")
+		}
+
+		files, err := state.Storage.SearchFiles(claims.UserID, tokens)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "Failed to search the files for the user. "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.SearchGetResponse{Files: files})
+	}
+}
+
+// handlePutSearchIndex replaces the search tokens of the files in the request.
+func handlePutSearchIndex(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// deserialize the JSON object that should be in the request body
+		var req models.SearchIndexPutRequest
+		err := c.Bind(&req)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+
+		index := make(map[int][]string, len(req.Files))
+		for _, f := range req.Files {
+			index[f.FileID] = f.Tokens
+		}
+		err = state.Storage.SetSearchIndex(claims.UserID, index)
+		if err != nil {
+			return storageError(c, err, http.StatusBadRequest, "Failed to update the search index. "+err.Error())
+		}
+		state.Activity.record(claims.UserID, claims.Username, "search index updated", "%d files", len(index))
+
+		return c.JSON(http.StatusOK, &models.SearchIndexPutResponse{Indexed: len(index)})
+	}
+}
@@ -5,9 +5,10 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
-	"log"
-	"math/rand"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -15,6 +16,7 @@ import (
 
 	"github.com/labstack/echo"
 	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/logging"
 )
 
 // serverState represents the server state and includes configuration flags.
@@ -22,8 +24,9 @@ type serverState struct {
 	// DatabasePath is the file path to the database used for storage
 	DatabasePath string
 
-	// DefaultQuota is the default quota size for a user
-	DefaultQuota int
+	// QuotaPlans holds the default quota for new users and the named
+	// quota tiers
+	QuotaPlans *quotaPlans
 
 	// Port is the port to listen to
 	Port int
@@ -31,9 +34,108 @@ type serverState struct {
 	// Storage is the filefreezer storage object used to keep data
 	Storage *filefreezer.Storage
 
-	// JWTSecretBytes is the slice used to authenticate JWT tokens for this
-	// server instance.
+	// JWTSecretBytes is the slice used to authenticate JWT tokens. It is
+	// shared by all of the server instances using the same database.
 	JWTSecretBytes []byte
+
+	// InstanceID identifies this server process among the instances sharing
+	// the database.
+	InstanceID string
+
+	// Log is the structured logger used for server messages
+	Log *logging.Logger
+
+	// AccessLog records every API request if access logging is enabled;
+	// nil otherwise.
+	AccessLog *accessLog
+
+	// Activity keeps the recent server events shown on the admin dashboard
+	Activity *activityLog
+
+	// Quota emits notifications when users cross the quota thresholds
+	Quota *quotaMonitor
+
+	// StorageCap alerts the administrators when the total allocation nears
+	// or reaches the storage cap
+	StorageCap *storageCapMonitor
+
+	// Limits are the limits on the uploads, request sizes and request
+	// rates of users that protect the server from a single client
+	Limits *requestLimits
+
+	// Webhooks delivers server events to the configured webhook URLs;
+	// nil if no webhooks are configured.
+	Webhooks *webhookDispatcher
+
+	// StartTime is the time the server state was created
+	StartTime time.Time
+
+	// ConfigPath is the path to the reloadable configuration file; empty
+	// if one wasn't specified.
+	ConfigPath string
+
+	// Certs serves the TLS certificate so that it can be reloaded; nil if
+	// the server isn't using TLS.
+	Certs *certReloader
+
+	// EnablePprof exposes the pprof profiling endpoints to administrators
+	EnablePprof bool
+
+	// EnableWebDAV serves the files of accounts without a crypto password
+	// over WebDAV
+	EnableWebDAV bool
+
+	// EnableRestic serves restic repositories for accounts without a
+	// crypto password with the restic REST backend protocol
+	EnableRestic bool
+
+	// SFTPAddr is the address to serve the files of accounts without a
+	// crypto password over SFTP on; empty if SFTP is disabled.
+	SFTPAddr string
+
+	// SFTPHostKeyPath is the PEM encoded SSH host key file used by the SFTP
+	// server; a temporary key is generated if it's empty.
+	SFTPHostKeyPath string
+
+	// KeepVersions is the number of versions of each file kept by the
+	// retention job; zero keeps every version.
+	KeepVersions int
+
+	// Jobs runs the scheduled maintenance jobs.
+	Jobs *jobScheduler
+
+	// BackupDir is the directory the backup job keeps the database
+	// snapshots in; empty if backups are disabled.
+	BackupDir string
+
+	// BackupKeep is the number of snapshots kept in BackupDir.
+	BackupKeep int
+
+	// BackupTarget is where the backup job uploads each snapshot; nil if
+	// the snapshots are only kept locally.
+	BackupTarget backupTarget
+
+	// DrainTimeout is how long in-progress requests have to finish when
+	// the server shuts down or restarts.
+	DrainTimeout time.Duration
+
+	// HeaderTimeout, ReadTimeout, WriteTimeout and IdleTimeout are the
+	// timeouts of the HTTP server's connections; see setTimeouts.
+	HeaderTimeout time.Duration
+	ReadTimeout   time.Duration
+	WriteTimeout  time.Duration
+	IdleTimeout   time.Duration
+
+	// URLPrefix is the URL path prefix the server is exposed under by a
+	// reverse proxy; empty if the server is at the root.
+	URLPrefix string
+
+	// TrustedProxies are the reverse proxies whose forwarded headers are
+	// honored.
+	TrustedProxies []*net.IPNet
+
+	// DeniedNames are the file name patterns that are never accepted.
+	DeniedNames []string
 }
 
 // newState does the setup for the initial state of the server
@@ -41,6 +143,47 @@ func newState() (*serverState, error) {
 	var err error
 	s := new(serverState)
 	s.DatabasePath = *flagDatabasePath
+	s.EnablePprof = *flagServePprof
+	s.EnableWebDAV = *flagServeWebDAV
+	s.EnableRestic = *flagServeRestic
+	s.SFTPAddr = *flagServeSFTP
+	s.SFTPHostKeyPath = *flagServeSFTPKey
+	s.KeepVersions = *flagServeKeepVers
+	s.BackupDir = *flagServeBackupDir
+	s.BackupKeep = *flagServeBackupKeep
+	if s.BackupKeep < 1 {
+		s.BackupKeep = defaultBackupKeep
+	}
+	if *flagServeBackupUpload != "" {
+		s.BackupTarget, err = parseBackupTarget(*flagServeBackupUpload, *flagServeBackupCrypto)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.DrainTimeout = *flagServeDrain
+	if s.DrainTimeout <= 0 {
+		s.DrainTimeout = defaultDrainTimeout
+	}
+	s.HeaderTimeout = *flagServeHdrTimeout
+	s.ReadTimeout = *flagServeReadTimeout
+	s.WriteTimeout = *flagServeWriteTimeout
+	s.IdleTimeout = *flagServeIdleTimeout
+	if s.HeaderTimeout < 0 || s.ReadTimeout < 0 || s.WriteTimeout < 0 || s.IdleTimeout < 0 {
+		return nil, fmt.Errorf("the server timeouts can't be negative")
+	}
+	s.URLPrefix = normalizeURLPrefix(*flagServePrefix)
+	s.TrustedProxies, err = parseTrustedProxies(*flagServeProxies)
+	if err != nil {
+		return nil, err
+	}
+	err = filefreezer.CheckNamePatterns(*flagServeDenyNames)
+	if err != nil {
+		return nil, err
+	}
+	s.DeniedNames = *flagServeDenyNames
+	s.Log = logger.Component("server")
+	s.Activity = newActivityLog(defaultActivityLogSize)
+	s.StartTime = time.Now()
 
 	// attempt to open the storage database
 	s.Storage, err = openStorage()
@@ -48,64 +191,284 @@ func newState() (*serverState, error) {
 		return nil, fmt.Errorf("Failed to open the database using the path specified (%s): %v", s.DatabasePath, err)
 	}
 
-	// generate a random passphrase for signing JWT if something wasn't specified
-	// on the command line as a flag; this will make the tokens only
-	// valid between the same running instance of the server
-	randomPassphrase := []byte(*flagCryptoPass)
-	if len(randomPassphrase) < 1 {
-		var randoms [32]byte
-		_, err = rand.Read(randoms[:])
+	// use the crypto password for signing JWT if one was specified on the
+	// command line; otherwise use the secret stored in the database so that
+	// tokens are valid on every server instance sharing the database
+	s.InstanceID = newInstanceID()
+	s.JWTSecretBytes = []byte(*flagCryptoPass)
+	if len(s.JWTSecretBytes) < 1 {
+		s.JWTSecretBytes, err = s.Storage.GetSharedSecret(jwtSecretName, jwtSecretSize)
+		if err != nil {
+			s.Storage.Close()
+			return nil, fmt.Errorf("A crypto password was not supplied and the shared JWT secret could not be loaded: %v", err)
+		}
+		s.Log.Infof("JWT secret loaded from the database.")
+	}
+
+	// setup the access log if one was requested
+	if *flagServeAccessLog != "" {
+		s.AccessLog, err = newAccessLog(*flagServeAccessLog, *flagLogJSON)
 		if err != nil {
-			return nil, fmt.Errorf("A crypto passrandomPassphraseword was not supplied and random generation failed: %v", err)
+			s.Storage.Close()
+			return nil, err
 		}
-		fmtPrintln("JWT random passphrase generated.")
+		s.Log.Infof("Access log enabled: %s", *flagServeAccessLog)
 	}
-	s.JWTSecretBytes = randomPassphrase
 
-	fmtPrintf("Database opened: %s\n", s.DatabasePath)
+	// setup the quota threshold notifications
+	thresholds, err := parseQuotaThresholds(*flagServeQuotaWarn)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	tiers, err := parseQuotaTiers(*flagServeTiers)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	defaultQuota := *flagServeDefQuota
+	if defaultQuota <= 0 {
+		defaultQuota = defaultUserQuota
+	}
+	if *flagServeQuotaHard < 100 {
+		s.close()
+		return nil, fmt.Errorf("the hard quota percentage must be at least 100")
+	}
+	s.Storage.HardQuotaPercent = *flagServeQuotaHard
+	s.Storage.QuotaGracePeriod = *flagServeQuotaGrace
+	s.Storage.MaxFiles = *flagServeMaxFiles
+	s.Storage.MaxVersions = *flagServeMaxVersions
+	s.Storage.MaxFileSize = *flagServeMaxFileSize
+	s.QuotaPlans = newQuotaPlans(defaultQuota, tiers)
+	s.Webhooks = newWebhooksFromFlags()
+	s.Quota = newQuotaMonitor(thresholds, *flagServeQuotaHook, s.Storage, s.Log.Component("quota"), s.Activity, s.Webhooks)
+	if *flagServeStorageCap < 0 || *flagServeCapWarn < 1 || *flagServeCapWarn > 100 {
+		s.close()
+		return nil, fmt.Errorf("the storage cap can't be negative and its warning percentage must be between 1 and 100")
+	}
+	s.Storage.StorageCap = *flagServeStorageCap
+	s.Storage.TransferLimit = *flagServeTransfer
+	if *flagServeTrash < 0 {
+		s.close()
+		return nil, fmt.Errorf("the trash retention period can't be negative")
+	}
+	s.Storage.TrashRetention = *flagServeTrash
+	if *flagServeJrnlChunks < 0 {
+		s.close()
+		return nil, fmt.Errorf("the retention period of the journal chunks can't be negative")
+	}
+	s.Storage.JournalChunkRetention = *flagServeJrnlChunks
+	if *flagServeChunkDir != "" && *flagServeChunkBucket != "" {
+		s.close()
+		return nil, fmt.Errorf("only one of --chunkdir and --chunkbucket can be given")
+	}
+	if *flagServeChunkDir != "" {
+		s.Storage.ChunkStore, err = filefreezer.NewDirChunkStore(*flagServeChunkDir)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		s.Log.Infof("Keeping new chunks in the chunk directory %s.", *flagServeChunkDir)
+	}
+	if *flagServeChunkBucket != "" {
+		bucket, err := parseChunkBucket(*flagServeChunkBucket)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		s.Storage.ChunkStore = bucket
+		s.Log.Infof("Keeping new chunks in the chunk bucket %s.", bucket)
+	}
+	s.Limits, err = newRequestLimits(*flagServeMaxUploads, *flagServeMaxBody, *flagServeRateLimit)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	s.StorageCap = newStorageCapMonitor(*flagServeCapWarn, s.Storage, s.Log.Component("storage"), s.Activity, s.Webhooks)
+
+	// setup the maintenance job schedules; the older --vacuum flag
+	// schedules the vacuum and a backup directory schedules daily backups
+	// if they aren't scheduled otherwise
+	schedules, err := parseJobSchedules(*flagServeSchedule)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	if _, found := schedules[vacuumJob]; !found && *flagServeVacuum > 0 {
+		schedules[vacuumJob] = "@every " + flagServeVacuum.String()
+	}
+	if _, found := schedules[backupJob]; !found && s.BackupDir != "" {
+		schedules[backupJob] = "@daily"
+	}
+	s.Jobs, err = newJobScheduler(s, schedules)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+
+	// the config file settings take precedence over the flags
+	s.ConfigPath = *flagServeConfig
+	if s.ConfigPath != "" {
+		config, err := loadServerConfig(s.ConfigPath)
+		if err == nil {
+			_, err = s.applyConfig(config)
+		}
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+
+	// load the TLS certificates through the reloader if HTTPS is used
+	if len(*flagTLSCrt) > 0 && len(*flagTLSKey) > 0 {
+		s.Certs, err = newCertReloader(*flagTLSCrt, *flagTLSKey)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+
+	s.Log.Infof("Database opened: %s", s.DatabasePath)
 	return s, nil
 }
 
 // close will close any state connections used by the server
 func (state *serverState) close() {
 	state.Storage.Close()
+	if state.AccessLog != nil {
+		state.AccessLog.Close()
+	}
+	state.Webhooks.Close()
+}
+
+// setTimeouts sets the connection timeouts of an HTTP server. The header
+// timeout and idle timeout close the connections of clients that stall
+// before sending a request, such as slow-loris attacks, while the read and
+// write timeouts, which limit whole requests and responses, are off by
+// default so that long uploads over WebDAV and long archive downloads aren't
+// cut off. Chunk uploads stay short however large the file is.
+func (state *serverState) setTimeouts(server *http.Server) {
+	server.ReadHeaderTimeout = state.HeaderTimeout
+	server.ReadTimeout = state.ReadTimeout
+	server.WriteTimeout = state.WriteTimeout
+	server.IdleTimeout = state.IdleTimeout
 }
 
 func (state *serverState) serve(readyCh chan bool) (quitCh chan bool) {
 	e := echo.New()
+	e.HideBanner = true
+	state.setTimeouts(e.Server)
+	state.setTimeouts(e.TLSServer)
 	InitRoutes(state, e)
 
+	// start the background jobs which get stopped when the server shuts down
+	stopJobs := make(chan struct{})
+	state.Jobs.start(stopJobs)
+
+	// the SFTP server also stops when the server shuts down
+	if state.SFTPAddr != "" {
+		if err := state.startSFTP(stopJobs); err != nil {
+			state.Log.Errorf("Failed to start the SFTP server: %v", err)
+		}
+	}
+
 	// attempt to listen to the interrupt signal to signal the stop
 	// chan in a goroutine to call server shutdown.
 	// NOTE: doesn't appear to work on windows
-	stop := make(chan os.Signal)
+	stop := make(chan os.Signal, 1)
 	quitCh = make(chan bool)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	// reload the configuration on SIGHUP until the server shuts down
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				if _, err := state.reload(); err != nil {
+					state.Log.Errorf("Failed to reload the configuration: %v", err)
+				}
+			case <-stopJobs:
+				signal.Stop(hup)
+				return
+			}
+		}
+	}()
+
 	go func() {
 		<-stop
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		close(stopJobs)
+
+		// in-progress requests get up to the drain timeout to finish
+		ctx, cancel := context.WithTimeout(context.Background(), state.DrainTimeout)
 		defer cancel()
-		fmtPrintln("Shutting down server...")
+		state.Log.Infof("Shutting down server...")
 		if err := e.Shutdown(ctx); err != nil {
 			state.close()
-			log.Fatalf("could not shutdown: %v", err)
+			state.Log.Errorf("could not shutdown: %v", err)
+			os.Exit(1)
 		}
 
 		// pass the message on the quit channel that the server was stopped
 		quitCh <- true
 	}()
 
+	// use the socket inherited from the previous process during a restart
+	// or passed by systemd for socket activation; otherwise listen on the
+	// address. The listener is kept so that it can be handed to the next
+	// process on a restart.
+	listenAddr := *argServeListenAddr
+	listener, err := inheritedListener()
+	if err != nil {
+		state.Log.Errorf("%v", err)
+	}
+	if listener != nil {
+		listenAddr = listener.Addr().String() + " (inherited socket)"
+	} else {
+		listener, err = systemdListener()
+		if err != nil {
+			state.Log.Errorf("%v", err)
+		}
+		if listener != nil {
+			listenAddr = listener.Addr().String() + " (systemd socket)"
+		}
+	}
+	if listener == nil {
+		listener, err = net.Listen("tcp", *argServeListenAddr)
+		if err != nil {
+			state.Log.Errorf("Failed to listen on %s: %v", *argServeListenAddr, err)
+		}
+	}
+
+	// start a new process with the same arguments on SIGUSR2 and hand it
+	// the listener; this process then drains and exits
+	if listener != nil {
+		go state.handleRestarts(listener, stop, stopJobs)
+	}
+
 	// create the HTTP server
 	go func() {
-		if len(*flagTLSCrt) < 1 || len(*flagTLSKey) < 1 {
-			fmtPrintf("Starting http server on %s ...", *argServeListenAddr)
+		if state.Certs == nil {
+			state.Log.Infof("Starting http server on %s ...", listenAddr)
+			e.Listener = listener
 			if err := e.Start(*argServeListenAddr); err != nil {
-				fmtPrintln("Shutting down the server ...")
+				state.Log.Infof("Shutting down the server: %v", err)
 			}
 		} else {
-			fmtPrintf("Starting https server on %s ...", *argServeListenAddr)
-			if err := e.StartTLS(*argServeListenAddr, *flagTLSCrt, *flagTLSKey); err != nil {
-				fmtPrintln("Shutting down the server ...")
+			// the certificate is served through the reloader so that
+			// new certificates can be picked up without a restart
+			state.Log.Infof("Starting https server on %s ...", listenAddr)
+			e.TLSServer.Addr = *argServeListenAddr
+			e.TLSServer.TLSConfig = &tls.Config{
+				GetCertificate: state.Certs.GetCertificate,
+				NextProtos:     []string{"h2"},
+			}
+			if listener != nil {
+				e.TLSListener = tls.NewListener(listener, e.TLSServer.TLSConfig)
+			}
+			if err := e.StartServer(e.TLSServer); err != nil {
+				state.Log.Infof("Shutting down the server: %v", err)
 			}
 		}
 	}()
@@ -114,6 +477,7 @@ func (state *serverState) serve(readyCh chan bool) (quitCh chan bool) {
 	if readyCh != nil {
 		readyCh <- true
 	}
+	notifyParentReady()
 
 	return quitCh
 }
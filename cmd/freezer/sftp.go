@@ -0,0 +1,298 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"github.com/tbogdala/filefreezer"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpUserIDExtension is the SSH permissions extension that carries the
+// authenticated user's ID from the password check to the SFTP session.
+const sftpUserIDExtension = "freezer-user-id"
+
+// startSFTP listens on the SFTP address and serves the files of accounts
+// without a crypto password over SFTP until stop is closed. Users log in
+// with their freezer username and password.
+func (state *serverState) startSFTP(stop chan struct{}) error {
+	hostKey, err := loadSFTPHostKey(state.SFTPHostKeyPath)
+	if err != nil {
+		return err
+	}
+	if state.SFTPHostKeyPath == "" {
+		state.Log.Warnf("No SFTP host key was specified; a temporary one was generated and clients will see it change on every restart.")
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			user, err := state.Storage.GetUser(conn.User())
+			if err != nil || !filefreezer.VerifyLoginPassword(string(password), user.Salt, user.SaltedHash) {
+				return nil, fmt.Errorf("could not verify the user %s", conn.User())
+			}
+			if user.Status == filefreezer.UserStatusSuspended {
+				return nil, fmt.Errorf("the account %s is suspended", conn.User())
+			}
+			if len(user.CryptoHash) > 0 {
+				return nil, fmt.Errorf("SFTP is only available for accounts without a crypto password")
+			}
+			return &ssh.Permissions{
+				Extensions: map[string]string{sftpUserIDExtension: strconv.Itoa(user.ID)},
+			}, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", state.SFTPAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for SFTP on %s: %v", state.SFTPAddr, err)
+	}
+	go func() {
+		<-stop
+		listener.Close()
+	}()
+
+	state.Log.Infof("Starting sftp server on %s ...", state.SFTPAddr)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go state.serveSFTPConn(conn, config)
+		}
+	}()
+	return nil
+}
+
+// loadSFTPHostKey loads the SSH host key from the PEM file at keyPath or
+// generates a temporary key if keyPath is empty.
+func loadSFTPHostKey(keyPath string) (ssh.Signer, error) {
+	if keyPath == "" {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate the SFTP host key: %v", err)
+		}
+		return ssh.NewSignerFromKey(key)
+	}
+
+	pemBytes, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the SFTP host key %s: %v", keyPath, err)
+	}
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the SFTP host key %s: %v", keyPath, err)
+	}
+	return signer, nil
+}
+
+// serveSFTPConn performs the SSH handshake on the connection and serves the
+// sftp subsystem on every session channel the client opens.
+func (state *serverState) serveSFTPConn(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		state.Log.Debugf("SFTP handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	userID, _ := strconv.Atoi(sshConn.Permissions.Extensions[sftpUserIDExtension])
+	fs := &davFileSystem{store: state.Storage, userID: userID, device: "sftp", deniedNames: state.DeniedNames}
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			state.Log.Debugf("Failed to accept the SFTP channel for %s: %v", sshConn.User(), err)
+			continue
+		}
+		go state.serveSFTPSession(fs, sshConn.User(), channel, channelRequests)
+	}
+}
+
+// serveSFTPSession starts the SFTP server once the client requests the
+// sftp subsystem. Shells and commands are refused.
+func (state *serverState) serveSFTPSession(fs *davFileSystem, username string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		// the subsystem name is an SSH string: a length followed by the bytes
+		isSFTP := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(isSFTP, nil)
+		if !isSFTP {
+			continue
+		}
+
+		go ssh.DiscardRequests(requests)
+		handler := &sftpHandler{fs: fs}
+		server := sftp.NewRequestServer(channel, sftp.Handlers{
+			FileGet:  handler,
+			FilePut:  handler,
+			FileCmd:  handler,
+			FileList: handler,
+		})
+		if err := server.Serve(); err != nil && err != io.EOF {
+			state.Log.Debugf("SFTP session for %s ended: %v", username, err)
+		}
+		server.Close()
+		return
+	}
+}
+
+// sftpHandler maps SFTP requests onto a user's files in Storage. It shares
+// the file system used by the WebDAV share, so files are named and stored
+// the same way.
+type sftpHandler struct {
+	fs *davFileSystem
+}
+
+// Fileread opens a file for reading.
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, err := h.fs.OpenFile(r.Context(), r.Filepath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	file, ok := f.(*davReadFile)
+	if !ok {
+		return nil, os.ErrInvalid
+	}
+	return &sftpReader{file: file}, nil
+}
+
+// Filewrite opens a file for writing. The written data replaces the file as
+// a new version when the file is closed.
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	f, err := h.fs.OpenFile(r.Context(), r.Filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return f.(*davWriteFile), nil
+}
+
+// Filecmd handles the requests that change files and directories. Setting
+// attributes is accepted but ignored; links aren't supported.
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	ctx := r.Context()
+	switch r.Method {
+	case "Setstat":
+		return nil
+	case "Rename":
+		return h.fs.Rename(ctx, r.Filepath, r.Target)
+	case "Mkdir":
+		return h.fs.Mkdir(ctx, r.Filepath, 0755)
+	case "Remove":
+		info, err := h.fs.Stat(ctx, r.Filepath)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.ErrInvalid
+		}
+		return h.fs.RemoveAll(ctx, r.Filepath)
+	case "Rmdir":
+		return h.rmdir(r)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// rmdir removes an empty directory.
+func (h *sftpHandler) rmdir(r *sftp.Request) error {
+	name := davPath(r.Filepath)
+	files, err := h.fs.files()
+	if err != nil {
+		return err
+	}
+	info, err := h.fs.stat(files, name)
+	if err != nil {
+		return err
+	}
+	if !info.isDir {
+		return os.ErrInvalid
+	}
+	for other := range files {
+		if strings.HasPrefix(other, name+"/") {
+			return fmt.Errorf("the directory %s is not empty", name)
+		}
+	}
+	return h.fs.RemoveAll(r.Context(), name)
+}
+
+// Filelist handles directory listings and stat requests.
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	ctx := r.Context()
+	switch r.Method {
+	case "List":
+		f, err := h.fs.OpenFile(ctx, r.Filepath, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		infos, err := f.Readdir(0)
+		if err != nil {
+			return nil, err
+		}
+		return sftpLister(infos), nil
+	case "Stat":
+		info, err := h.fs.Stat(ctx, r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return sftpLister{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// sftpLister implements sftp.ListerAt for a list of file information.
+type sftpLister []os.FileInfo
+
+// ListAt copies the file information starting at offset into ls.
+func (l sftpLister) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sftpReader implements io.ReaderAt for a file opened for reading. SFTP
+// clients can read at any offset and the server may handle the reads
+// concurrently, so they're serialized around the file's offset.
+type sftpReader struct {
+	lock sync.Mutex
+	file *davReadFile
+}
+
+// ReadAt reads len(p) bytes at the offset unless the file ends first.
+func (r *sftpReader) ReadAt(p []byte, offset int64) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, err := r.file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r.file, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -10,6 +10,7 @@ import (
 	"testing"
 
 	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/client"
 	"github.com/tbogdala/filefreezer/cmd/freezer/command"
 )
 
@@ -25,10 +26,10 @@ func setupBenchmarkState(b *testing.B) *command.State {
 	userQuota := int(1e9)
 
 	// attempt to get the authentication token set in the command state
-	err := cmdState.Authenticate(testHost, username, password)
+	err := cmdState.Login(testHost, username, password)
 	if err != nil {
 		cmdState.AddUser(state.Storage, username, password, userQuota)
-		err := cmdState.Authenticate(testHost, username, password)
+		err := cmdState.Login(testHost, username, password)
 		if err != nil {
 			b.Fatalf("Failed to authenticate as the test user: %v", err)
 		}
@@ -70,7 +71,7 @@ func doBenchBasicFileSyncUp(testFileSize int, b *testing.B) {
 	// loop: sync a file
 	for n := 0; n < b.N; n++ {
 		destFilename := fmt.Sprintf("bench_data_%08d.dat", n)
-		_, _, err := cmdState.SyncFile(testFilename, destFilename, command.SyncCurrentVersion)
+		_, err := cmdState.SyncFile(testFilename, destFilename, client.SyncCurrentVersion)
 		if err != nil {
 			b.Fatalf("Failed to at the file %s: %v", testFilename, err)
 		}
@@ -101,7 +102,7 @@ func doBenchBasicFileSyncDown(testFileSize int, b *testing.B) {
 	}
 
 	// sync the test file to the server
-	_, _, err = cmdState.SyncFile(testFilename, testFilename, command.SyncCurrentVersion)
+	_, err = cmdState.SyncFile(testFilename, testFilename, client.SyncCurrentVersion)
 	//_, err = cmdState.addFile(testFilename, testFilename, false, permissions, lastMod, chunkCount, hashString)
 	if err != nil {
 		b.Fatalf("Failed to at the file %s: %v", testFilename, err)
@@ -118,11 +119,12 @@ func doBenchBasicFileSyncDown(testFileSize int, b *testing.B) {
 	// loop: sync a file
 	for n := 0; n < b.N; n++ {
 		localFilename := fmt.Sprintf("bench_data_local_%08d.dat", n)
-		status, changeCount, err := cmdState.SyncFile(localFilename, testFilename, command.SyncCurrentVersion)
+		report, err := cmdState.SyncFile(localFilename, testFilename, client.SyncCurrentVersion)
+		status, changeCount := report.Status, report.Chunks
 		if err != nil {
 			b.Fatalf("Failed to sync the file %s from the server: %v", localFilename, err)
 		}
-		if status != command.SyncStatusRemoteNewer {
+		if status != client.SyncStatusRemoteNewer {
 			b.Fatal("Benchmark sync should find the remote file newer.")
 		}
 		if changeCount != fileStats.ChunkCount {
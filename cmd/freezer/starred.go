@@ -0,0 +1,51 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// handleFileStar returns a handler that stars a file if starred is true or
+// unstars it otherwise.
+func handleFileStar(state *serverState, starred bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		err = state.Storage.SetFileStarred(claims.UserID, int(fileID), starred)
+		if err != nil {
+			return storageError(c, err, http.StatusNotFound, "Failed to set the starred flag of the file: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.FileStarResponse{Success: true})
+	}
+}
+
+// handleGetStarredFiles returns the user's starred files.
+func handleGetStarredFiles(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		files, err := state.Storage.GetStarredFiles(claims.UserID)
+		if err != nil {
+			return storageError(c, err, http.StatusInternalServerError, "Failed to get the starred files: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.StarredFilesGetResponse{Files: files})
+	}
+}
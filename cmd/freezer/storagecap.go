@@ -0,0 +1,106 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/logging"
+)
+
+// defaultStorageCapWarn is the percentage of the storage cap that triggers
+// the storage warning when --storagecapwarn isn't given.
+const defaultStorageCapWarn = 90
+
+// The alert levels of the storageCapMonitor.
+const (
+	storageCapOK = iota
+	storageCapWarning
+	storageCapFull
+)
+
+// storageCapMonitor alerts the administrators when the total allocation of
+// all users approaches the server's storage cap and when chunk writes start
+// getting refused because the cap has been reached. Each level is only
+// alerted once; the alerts are rearmed when the total allocation drops back
+// below the warning percentage.
+type storageCapMonitor struct {
+	sync.Mutex
+	warnPercent int
+	level       int
+	store       *filefreezer.Storage
+	log         *logging.Logger
+	activity    *activityLog
+	webhooks    *webhookDispatcher
+}
+
+// newStorageCapMonitor creates a storageCapMonitor that warns once the total
+// allocation reaches warnPercent of the storage cap.
+func newStorageCapMonitor(warnPercent int, store *filefreezer.Storage, log *logging.Logger, activity *activityLog, webhooks *webhookDispatcher) *storageCapMonitor {
+	m := new(storageCapMonitor)
+	m.warnPercent = warnPercent
+	m.store = store
+	m.log = log
+	m.activity = activity
+	m.webhooks = webhooks
+	return m
+}
+
+// check is called with the result of a chunk write by the user and alerts
+// the administrators if the write was refused by the storage cap or if it
+// took the total allocation past the warning percentage.
+func (m *storageCapMonitor) check(userID int, username string, writeErr error) {
+	if m == nil || m.store.StorageCap <= 0 {
+		return
+	}
+	if writeErr != nil && !errors.Is(writeErr, filefreezer.ErrStorageFull) {
+		return
+	}
+
+	level := storageCapFull
+	var total int64
+	if writeErr == nil {
+		var err error
+		total, err = m.store.GetTotalAllocated()
+		if err != nil {
+			m.log.Errorf("Failed to get the total allocation for the storage cap check: %v", err)
+			return
+		}
+		level = storageCapOK
+		if total*100 >= m.store.StorageCap*int64(m.warnPercent) {
+			level = storageCapWarning
+		}
+	}
+
+	m.Lock()
+	previous := m.level
+	if level > previous || level == storageCapOK {
+		m.level = level
+	}
+	m.Unlock()
+	if level <= previous {
+		return
+	}
+
+	if level == storageCapFull {
+		m.log.Errorf("The storage cap of %d bytes has been reached; chunk writes are being refused.", m.store.StorageCap)
+		if m.activity != nil {
+			m.activity.record(userID, username, "storage full", "a chunk write was refused by the storage cap of %d bytes", m.store.StorageCap)
+		}
+		m.webhooks.send(webhookEventStorageFull, userID, username, map[string]interface{}{
+			"storageCap": m.store.StorageCap,
+		})
+		return
+	}
+	m.log.Warnf("The total allocation of %d bytes has reached %d%% of the storage cap of %d bytes.", total, m.warnPercent, m.store.StorageCap)
+	if m.activity != nil {
+		m.activity.record(userID, username, "storage warning", "%d of %d bytes allocated", total, m.store.StorageCap)
+	}
+	m.webhooks.send(webhookEventStorageWarning, userID, username, map[string]interface{}{
+		"storageCap": m.store.StorageCap,
+		"allocated":  total,
+	})
+}
@@ -0,0 +1,47 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+const (
+	// systemdListenFdsStart is the first file descriptor passed by systemd
+	// for socket activation; 0 through 2 are stdin, stdout and stderr.
+	systemdListenFdsStart = 3
+)
+
+// systemdListener returns the listener passed to the process by systemd
+// socket activation or nil if the process wasn't socket activated. Only the
+// first socket is used if more than one was passed. The LISTEN_* variables
+// are removed from the environment so that child processes don't try to
+// use the socket too.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(uintptr(systemdListenFdsStart), "LISTEN_FD_3")
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use the socket passed by systemd: %v", err)
+	}
+
+	// FileListener dups the descriptor so the original can be closed
+	f.Close()
+	return l, nil
+}
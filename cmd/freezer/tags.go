@@ -0,0 +1,134 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// handleGetFileTags returns the tags of a file.
+func handleGetFileTags(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		tags, err := state.Storage.GetFileTags(claims.UserID, int(fileID))
+		if err != nil {
+			return storageError(c, err, http.StatusNotFound, "Failed to get the tags of the file: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.FileTagsResponse{Tags: tags})
+	}
+}
+
+// handlePutFileTags adds the tags in the request to a file and returns all
+// of the tags the file has.
+func handlePutFileTags(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		// deserialize the JSON object that should be in the request body
+		var req models.FileTagsRequest
+		err = c.Bind(&req)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+		if len(req.Tags) == 0 {
+			return apiError(c, http.StatusBadRequest, "At least one tag must be supplied in the request.")
+		}
+
+		err = state.Storage.AddFileTags(claims.UserID, int(fileID), req.Tags)
+		if err != nil {
+			return storageError(c, err, http.StatusBadRequest, "Failed to add the tags to the file: "+err.Error())
+		}
+		state.Activity.record(claims.UserID, claims.Username, "tags added", "file id %d, %d tags", fileID, len(req.Tags))
+
+		tags, err := state.Storage.GetFileTags(claims.UserID, int(fileID))
+		if err != nil {
+			return storageError(c, err, http.StatusInternalServerError, "Failed to get the tags of the file: "+err.Error())
+		}
+		return c.JSON(http.StatusOK, &models.FileTagsResponse{Tags: tags})
+	}
+}
+
+// handleDeleteFileTags removes the tags with the token query parameters from
+// a file and returns the tags the file has left.
+func handleDeleteFileTags(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		tokens := c.QueryParams()["token"]
+		if len(tokens) == 0 {
+			return apiError(c, http.StatusBadRequest, "At least one token must be supplied in the query.")
+		}
+
+		err = state.Storage.RemoveFileTags(claims.UserID, int(fileID), tokens)
+		if err != nil {
+			return storageError(c, err, http.StatusNotFound, "Failed to remove the tags from the file: "+err.Error())
+		}
+		state.Activity.record(claims.UserID, claims.Username, "tags removed", "file id %d, %d tags", fileID, len(tokens))
+
+		tags, err := state.Storage.GetFileTags(claims.UserID, int(fileID))
+		if err != nil {
+			return storageError(c, err, http.StatusInternalServerError, "Failed to get the tags of the file: "+err.Error())
+		}
+		return c.JSON(http.StatusOK, &models.FileTagsResponse{Tags: tags})
+	}
+}
+
+// handleGetTags returns the tags used on the user's files.
+func handleGetTags(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		tags, err := state.Storage.GetUserTags(claims.UserID)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to get the tags for the user.")
+		}
+
+		return c.JSON(http.StatusOK, &models.TagsGetResponse{Tags: tags})
+	}
+}
+
+// handleGetTaggedFiles returns the user's files with the tag token in the URI.
+func handleGetTaggedFiles(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		files, err := state.Storage.GetFilesByTag(claims.UserID, c.Param("token"))
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to get the tagged files for the user.")
+		}
+
+		return c.JSON(http.StatusOK, &models.TaggedFilesGetResponse{Files: files})
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tbogdala/filefreezer/cmd/freezer/command"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// sessionMinLifetime is how long a cached token has to stay valid for to be
+// used; tokens closer to expiring are replaced by logging in again so that
+// a command doesn't fail half way through.
+const sessionMinLifetime = time.Minute
+
+// cachedSession is the state of a client after logging in that the token
+// cache keeps so that the next commands can skip logging in. The crypto key
+// is never cached, only the hash the crypto password is checked against.
+type cachedSession struct {
+	Token           string
+	ExpiresAt       int64
+	CryptoHash      []byte
+	Capabilities    models.ServerCapabilities
+	CaseInsensitive bool
+	ClockSkew       time.Duration
+}
+
+// sessionCacheKey is the key of the session the command logged in with,
+// which is saved to the token cache again when the command finishes; empty
+// if the command didn't log in as a user.
+var sessionCacheKey string
+
+// defaultTokenCacheFile returns the path of the token cache in the user's
+// cache directory, or an empty string if there isn't one.
+func defaultTokenCacheFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "freezer", "tokens.json")
+}
+
+// sessionKey returns the key of the session of username in the namespace
+// on host in the token cache.
+func sessionKey(host string, username string, namespace string) string {
+	return host + " " + username + " " + namespace
+}
+
+// tokenExpiry returns the expiry time in unix seconds of a JWT without
+// verifying it, which only the server can do.
+func tokenExpiry(token string) (int64, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("the token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode the token claims: %v", err)
+	}
+	var claims struct {
+		ExpiresAt int64 `json:"exp"`
+	}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse the token claims: %v", err)
+	}
+	if claims.ExpiresAt == 0 {
+		return 0, fmt.Errorf("the token doesn't expire")
+	}
+	return claims.ExpiresAt, nil
+}
+
+// readTokenCache reads the sessions in the token cache, leaving out the
+// ones that expired. A missing cache has no sessions.
+func readTokenCache(filename string) (map[string]cachedSession, error) {
+	sessions := make(map[string]cachedSession)
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return sessions, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read the token cache %s: %v", filename, err)
+	}
+	err = json.Unmarshal(data, &sessions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the token cache %s: %v", filename, err)
+	}
+	now := time.Now().Unix()
+	for key, s := range sessions {
+		if s.ExpiresAt <= now {
+			delete(sessions, key)
+		}
+	}
+	return sessions, nil
+}
+
+// writeTokenCache replaces the token cache with the sessions. The cache is
+// only readable by the user since the tokens authenticate as them.
+func writeTokenCache(filename string, sessions map[string]cachedSession) error {
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return fmt.Errorf("failed to serialize the token cache: %v", err)
+	}
+	err = os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create the directory of the token cache %s: %v", filename, err)
+	}
+	tempFilename := filename + ".tmp"
+	err = ioutil.WriteFile(tempFilename, data, 0600)
+	if err == nil {
+		err = os.Rename(tempFilename, filename)
+	}
+	if err != nil {
+		os.Remove(tempFilename)
+		return fmt.Errorf("failed to write the token cache %s: %v", filename, err)
+	}
+	return nil
+}
+
+// resumeCachedSession sets up the client with the session cached under key
+// if there is one that stays valid for at least sessionMinLifetime. True is
+// returned if it did.
+func resumeCachedSession(cmdState *command.State, filename string, host string, key string) bool {
+	if filename == "" {
+		return false
+	}
+	sessions, err := readTokenCache(filename)
+	if err != nil {
+		logger.Warnf("Logging in again: %v", err)
+		return false
+	}
+	s, found := sessions[key]
+	if !found || time.Unix(s.ExpiresAt, 0).Before(time.Now().Add(sessionMinLifetime)) {
+		return false
+	}
+
+	cmdState.HostURI = host
+	cmdState.AuthToken = s.Token
+	cmdState.CryptoHash = s.CryptoHash
+	cmdState.ServerCapabilities = s.Capabilities
+	cmdState.CaseInsensitive = s.CaseInsensitive
+	cmdState.ClockSkew = s.ClockSkew
+	return true
+}
+
+// cacheSession saves the session of the client in the token cache under
+// key, which keeps any change the command made to it, such as setting the
+// crypto password. Failing to cache the session only means logging in
+// again next time, so it's just logged.
+func cacheSession(cmdState *command.State, filename string, key string) {
+	if filename == "" || key == "" || cmdState.AuthToken == "" {
+		return
+	}
+	expiresAt, err := tokenExpiry(cmdState.AuthToken)
+	if err != nil {
+		logger.Warnf("Not caching the login token: %v", err)
+		return
+	}
+	sessions, err := readTokenCache(filename)
+	if err != nil {
+		sessions = make(map[string]cachedSession)
+	}
+	sessions[key] = cachedSession{
+		Token:           cmdState.AuthToken,
+		ExpiresAt:       expiresAt,
+		CryptoHash:      cmdState.CryptoHash,
+		Capabilities:    cmdState.ServerCapabilities,
+		CaseInsensitive: cmdState.CaseInsensitive,
+		ClockSkew:       cmdState.ClockSkew,
+	}
+	err = writeTokenCache(filename, sessions)
+	if err != nil {
+		logger.Warnf("Not caching the login token: %v", err)
+	}
+}
+
+// forgetSessions removes the sessions of username on host, in every
+// namespace, from the token cache. An empty username removes the sessions
+// of every user of the host. The number of sessions removed is returned.
+func forgetSessions(filename string, host string, username string) (int, error) {
+	sessions, err := readTokenCache(filename)
+	if err != nil {
+		return 0, err
+	}
+	prefix := host + " "
+	if username != "" {
+		prefix += username + " "
+	}
+	removed := 0
+	for key := range sessions {
+		if strings.HasPrefix(key, prefix) {
+			delete(sessions, key)
+			removed++
+		}
+	}
+	return removed, writeTokenCache(filename, sessions)
+}
@@ -0,0 +1,124 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// handlePostAdminTransfer gives files of the user in the name parameter of
+// the URI to another user, such as when an employee leaves. Either the file
+// ids or all of the user's files are transferred. If the users have
+// different crypto passwords the new owner has to re-key the files.
+func handlePostAdminTransfer(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims := c.Get(jwtContextName).(*jwt.Token).Claims.(*jwtCustomClaims)
+
+		// deserialize the JSON object that should be in the request body
+		var req models.AdminTransferRequest
+		err := c.Bind(&req)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+		if req.All == (len(req.FileIDs) > 0) {
+			return apiError(c, http.StatusBadRequest, "Either file ids or all of the files must be transferred.")
+		}
+
+		from, err := state.Storage.GetUser(adminUserParam(c))
+		if err != nil {
+			return apiError(c, http.StatusNotFound, "Failed to find the user.")
+		}
+		to, err := state.Storage.GetUser(req.To)
+		if err != nil {
+			return apiError(c, http.StatusNotFound, "Failed to find the user to transfer the files to.")
+		}
+		if len(from.CryptoHash) > 0 && len(to.CryptoHash) == 0 {
+			return apiError(c, http.StatusConflict, "The user to transfer the files to needs a crypto password to re-key the encrypted files.")
+		}
+
+		fileIDs := req.FileIDs
+		if req.All {
+			files, err := state.Storage.GetAllUserFileInfos(from.ID)
+			if err != nil {
+				return apiError(c, http.StatusInternalServerError, "Failed to get the files of the user: "+err.Error())
+			}
+			for _, fi := range files {
+				fileIDs = append(fileIDs, fi.FileID)
+			}
+		}
+
+		transferred, err := state.Storage.TransferFiles(from.ID, to.ID, fileIDs)
+		if err != nil {
+			return storageError(c, err, http.StatusBadRequest, "Failed to transfer the files: "+err.Error())
+		}
+		state.Activity.record(claims.UserID, claims.Username, "files transferred", "%d files (%d bytes) from user %s to user %s",
+			len(fileIDs), transferred, from.Name, to.Name)
+
+		return c.JSON(http.StatusOK, &models.AdminTransferResponse{
+			Files: len(fileIDs),
+			Bytes: transferred,
+			Rekey: !bytes.Equal(from.CryptoHash, to.CryptoHash),
+		})
+	}
+}
+
+// handleGetRekey returns the files of the user that were transferred from a
+// user with a different crypto password and still have to be re-keyed.
+func handleGetRekey(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		files, err := state.Storage.GetRekeyFiles(claims.UserID)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to get the files to re-key: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.RekeyGetResponse{Files: files})
+	}
+}
+
+// handlePutRekey finishes re-keying a transferred file once its chunks and
+// metadata have been re-encrypted, giving it the re-encrypted name.
+func handlePutRekey(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		// deserialize the JSON object that should be in the request body
+		var req models.RekeyPutRequest
+		err = c.Bind(&req)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+		if req.FileName == "" {
+			return apiError(c, http.StatusBadRequest, "A file name must be supplied.")
+		}
+		if len(req.NameKey) > filefreezer.MaxNameKeyLength {
+			return apiError(c, http.StatusBadRequest, "name key must be at most "+strconv.Itoa(filefreezer.MaxNameKeyLength)+" bytes")
+		}
+
+		err = state.Storage.RekeyFile(claims.UserID, int(fileID), req.FileName, req.NameKey)
+		if err != nil {
+			return storageError(c, err, http.StatusNotFound, "Failed to re-key the file: "+err.Error())
+		}
+		state.Activity.record(claims.UserID, claims.Username, "file re-keyed", "file id %d", fileID)
+
+		return c.JSON(http.StatusOK, &models.RekeyPutResponse{Status: true})
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// handleGetTrash returns the files in the user's trash.
+func handleGetTrash(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		files, err := state.Storage.GetTrash(claims.UserID)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to get the trash for the user.")
+		}
+
+		return c.JSON(http.StatusOK, &models.TrashGetResponse{
+			Files:     files,
+			Retention: state.Storage.TrashRetention,
+		})
+	}
+}
+
+// handlePostTrashRestore moves a file out of the user's trash.
+func handlePostTrashRestore(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		err = state.Storage.RestoreFile(claims.UserID, int(fileID))
+		if err != nil {
+			return storageError(c, err, http.StatusNotFound, "Failed to restore the file from the trash. "+err.Error())
+		}
+		state.Activity.record(claims.UserID, claims.Username, "file restored", "file id %d", fileID)
+
+		return c.JSON(http.StatusOK, &models.TrashRestoreResponse{Success: true})
+	}
+}
+
+// handleDeleteTrash removes every file in the user's trash for good.
+func handleDeleteTrash(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		removed, err := state.Storage.EmptyTrash(claims.UserID)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, "Failed to empty the trash for the user. "+err.Error())
+		}
+		state.Activity.record(claims.UserID, claims.Username, "trash emptied", "%d files removed", removed)
+		state.checkQuota(claims.UserID, claims.Username)
+
+		return c.JSON(http.StatusOK, &models.TrashEmptyResponse{Removed: removed})
+	}
+}
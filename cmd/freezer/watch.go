@@ -0,0 +1,151 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/command"
+)
+
+// dirWatcher reports the changes made to the files of a local directory and
+// its subdirectories. fsnotify only watches single directories, so every
+// subdirectory is watched on its own and the ones created later are added
+// as they appear.
+type dirWatcher struct {
+	watcher  *fsnotify.Watcher
+	excludes []string
+}
+
+// newDirWatcher starts watching localDir and its subdirectories, leaving out
+// the files and directories whose names match one of the excludes.
+func newDirWatcher(localDir string, excludes []string) (*dirWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the file system watcher: %v", err)
+	}
+	w := &dirWatcher{watcher: watcher, excludes: excludes}
+	err = w.add(localDir)
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// add watches the directory and all of the subdirectories in it.
+func (w *dirWatcher) add(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// a directory removed while it's walked is no longer watched
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != dir && filefreezer.MatchName(info.Name(), w.excludes) {
+			return filepath.SkipDir
+		}
+		err = w.watcher.Add(path)
+		if err != nil {
+			return fmt.Errorf("failed to watch %s: %v", path, err)
+		}
+		return nil
+	})
+}
+
+// run calls changed once the files stop changing for the debounce period,
+// so that a burst of writes, such as an editor saving a file or a large
+// file being copied in, leads to a single call. Changes to the permissions
+// or times of files alone are ignored since syncs set them on the files
+// they download. It returns once stop is closed.
+func (w *dirWatcher) run(debounce time.Duration, changed func(), stop <-chan struct{}) {
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod || filefreezer.MatchName(filepath.Base(event.Name), w.excludes) {
+				continue
+			}
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err = w.add(event.Name); err != nil {
+						logger.Warnf("Not watching the new directory %s: %v", event.Name, err)
+					}
+				}
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(debounce)
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			// events may have been lost, so sync everything to be sure
+			logger.Warnf("The file system watcher failed: %v", err)
+			changed()
+
+		case <-timer.C:
+			changed()
+		}
+	}
+}
+
+// Close stops watching the directories.
+func (w *dirWatcher) Close() error {
+	return w.watcher.Close()
+}
+
+// runWatch syncs localDir with remoteDir right away and then again whenever
+// its files change, once they've stopped changing for the debounce period,
+// until it's interrupted. The whole directory is also synced every interval
+// to pick up the changes made on the server by other clients and any the
+// watcher missed. The notifier reports the syncs that need attention. The
+// client logs in again before each sync to renew its authentication token.
+func runWatch(cmdState *command.State, localDir string, remoteDir string, debounce time.Duration, interval time.Duration, notifier *syncNotifier, username string, password string) {
+	watcher, err := newDirWatcher(localDir, cmdState.Excludes)
+	if err != nil {
+		logger.Errorf("Failed to watch %s: %v", localDir, err)
+		return
+	}
+	defer watcher.Close()
+
+	daemon := startSyncDaemon(cmdState, localDir, remoteDir, interval, notifier, username, password)
+	defer daemon.Close()
+	cmdState.Printf("Watching %s for changes.\n", localDir)
+
+	// the files a sync downloads are changes too, which leads to one more
+	// sync that finds nothing left to do
+	stop := make(chan struct{})
+	go watcher.run(debounce, daemon.Trigger, stop)
+	defer close(stop)
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	<-interrupted
+}
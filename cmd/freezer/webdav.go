@@ -0,0 +1,927 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo"
+	"github.com/tbogdala/filefreezer"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	// webdavPrefix is the URL path the WebDAV share is served under.
+	webdavPrefix = "/dav"
+
+	// webdavRealm is the realm sent to WebDAV clients for basic auth.
+	webdavRealm = "freezer"
+
+	// webdavUserContextName is the key of the user authenticated by
+	// webdavAuth in the echo context.
+	webdavUserContextName = "WebDAVUser"
+
+	// webdavPlaceholderLastMod is the last modified time a file version
+	// written over WebDAV has until all of its chunks are stored, which
+	// keeps sync clients from downloading a partially written version.
+	webdavPlaceholderLastMod = 1
+)
+
+// webdavMethods are the HTTP methods accepted on the WebDAV share.
+var webdavMethods = map[string]bool{
+	"OPTIONS":   true,
+	"PROPFIND":  true,
+	"GET":       true,
+	"HEAD":      true,
+	"PUT":       true,
+	"MKCOL":     true,
+	"MOVE":      true,
+	"DELETE":    true,
+	"PROPPATCH": true,
+	"LOCK":      true,
+	"UNLOCK":    true,
+}
+
+// davLockSystem is a webdav.LockSystem for the files of a user that keeps
+// the locks in the database, so that a lock taken through one server
+// instance is honored by every instance sharing the database. Locks are held
+// on paths, so every user has their own to keep users with the same file
+// names from locking each other out.
+type davLockSystem struct {
+	store  *filefreezer.Storage
+	userID int
+}
+
+// davLockExpiry returns when a lock created or refreshed at now times out.
+func davLockExpiry(now time.Time, duration time.Duration) time.Time {
+	if duration < 0 {
+		return time.Time{}
+	}
+	return now.Add(duration)
+}
+
+// davLockDetails returns the webdav.LockDetails of a stored lock.
+func davLockDetails(l *filefreezer.DAVLock, duration time.Duration) webdav.LockDetails {
+	return webdav.LockDetails{Root: l.Root, Duration: duration, OwnerXML: l.OwnerXML, ZeroDepth: l.ZeroDepth}
+}
+
+// Confirm confirms that the conditions hold the locks needed to write the
+// resources name0 and name1, either of which may be empty: each resource
+// must be covered by the lock of one of the condition tokens.
+func (ls *davLockSystem) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	locks, err := ls.store.GetDAVLocks(ls.userID, now)
+	if err != nil {
+		return nil, err
+	}
+	covered := func(name string) bool {
+		name = davPath(name)
+		for _, c := range conditions {
+			for i := range locks {
+				if locks[i].Token == c.Token && locks[i].Covers(name) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if (name0 != "" && !covered(name0)) || (name1 != "" && !covered(name1)) {
+		return nil, webdav.ErrConfirmationFailed
+	}
+	return func() {}, nil
+}
+
+// Create creates a lock.
+func (ls *davLockSystem) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	lock := filefreezer.DAVLock{
+		Root:      davPath(details.Root),
+		ZeroDepth: details.ZeroDepth,
+		OwnerXML:  details.OwnerXML,
+		Expires:   davLockExpiry(now, details.Duration),
+	}
+	token, err := ls.store.CreateDAVLock(ls.userID, lock, now)
+	if err == filefreezer.ErrDAVLocked {
+		return "", webdav.ErrLocked
+	}
+	return token, err
+}
+
+// Refresh extends the timeout of a lock.
+func (ls *davLockSystem) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	lock, err := ls.store.RefreshDAVLock(ls.userID, token, davLockExpiry(now, duration), now)
+	if err == filefreezer.ErrNoDAVLock {
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	} else if err != nil {
+		return webdav.LockDetails{}, err
+	}
+	return davLockDetails(lock, duration), nil
+}
+
+// Unlock releases a lock.
+func (ls *davLockSystem) Unlock(now time.Time, token string) error {
+	err := ls.store.RemoveDAVLock(ls.userID, token, now)
+	if err == filefreezer.ErrNoDAVLock {
+		return webdav.ErrNoSuchLock
+	}
+	return err
+}
+
+// locksOn returns the active locks covering the resource name, which are
+// the locks on the resource itself and the infinite depth locks on the
+// directories it's in.
+func (ls *davLockSystem) locksOn(now time.Time, name string) ([]filefreezer.DAVLock, error) {
+	all, err := ls.store.GetDAVLocks(ls.userID, now)
+	if err != nil {
+		return nil, err
+	}
+	var locks []filefreezer.DAVLock
+	for i := range all {
+		if all[i].Covers(name) {
+			locks = append(locks, all[i])
+		}
+	}
+	return locks, nil
+}
+
+// davLockDiscoveryName is the name of the property listing a resource's locks.
+var davLockDiscoveryName = xml.Name{Space: "DAV:", Local: "lockdiscovery"}
+
+// davMicrosoftNamespace holds the properties Windows sets on uploaded files,
+// such as Win32LastModifiedTime.
+const davMicrosoftNamespace = "urn:schemas-microsoft-com:"
+
+// deadProps returns the lockdiscovery property of the resource name.
+func (fs *davFileSystem) deadProps(name string) (map[xml.Name]webdav.Property, error) {
+	var inner bytes.Buffer
+	if fs.locks != nil {
+		now := time.Now()
+		locks, err := fs.locks.locksOn(now, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range locks {
+			depth, timeout := "infinity", "Infinite"
+			if l.ZeroDepth {
+				depth = "0"
+			}
+			if !l.Expires.IsZero() {
+				timeout = fmt.Sprintf("Second-%d", int64(l.Expires.Sub(now)/time.Second))
+			}
+			root := (&url.URL{Path: webdavPrefix + l.Root}).EscapedPath()
+			fmt.Fprintf(&inner, `<D:activelock xmlns:D="DAV:"><D:locktype><D:write/></D:locktype>`+
+				`<D:lockscope><D:exclusive/></D:lockscope><D:depth>%s</D:depth>`, depth)
+			if l.OwnerXML != "" {
+				fmt.Fprintf(&inner, `<D:owner>%s</D:owner>`, l.OwnerXML)
+			}
+			fmt.Fprintf(&inner, `<D:timeout>%s</D:timeout><D:locktoken><D:href>%s</D:href></D:locktoken>`+
+				`<D:lockroot><D:href>%s</D:href></D:lockroot></D:activelock>`, timeout, html.EscapeString(l.Token), root)
+		}
+	}
+	return map[xml.Name]webdav.Property{
+		davLockDiscoveryName: {XMLName: davLockDiscoveryName, InnerXML: inner.Bytes()},
+	}, nil
+}
+
+// patchProps answers a PROPPATCH. Properties aren't stored, but the ones
+// Windows sets on uploaded files are accepted so that Explorer doesn't
+// report the uploads as failed. If any other property is patched, none
+// of the patches are applied.
+func (fs *davFileSystem) patchProps(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	accepted := webdav.Propstat{Status: http.StatusOK}
+	forbidden := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			if p.XMLName.Space == davMicrosoftNamespace {
+				accepted.Props = append(accepted.Props, webdav.Property{XMLName: p.XMLName})
+			} else {
+				forbidden.Props = append(forbidden.Props, webdav.Property{XMLName: p.XMLName})
+			}
+		}
+	}
+	if len(forbidden.Props) == 0 {
+		return []webdav.Propstat{accepted}, nil
+	}
+	if len(accepted.Props) == 0 {
+		return []webdav.Propstat{forbidden}, nil
+	}
+	accepted.Status = webdav.StatusFailedDependency
+	return []webdav.Propstat{forbidden, accepted}, nil
+}
+
+// webdavMiddleware returns echo middleware, meant to be used with Echo.Pre,
+// that serves the files of the authenticated user over WebDAV under
+// webdavPrefix. It runs before routing because the echo router doesn't
+// route WebDAV methods such as PROPFIND and MKCOL, so the middleware of the
+// routed requests is applied to the share here: requests are written to the
+// access log, count towards the requests per minute of their user and are
+// limited to the maximum body size, except for the files uploaded with PUT,
+// which count towards the concurrent uploads instead. Clients authenticate
+// with HTTP basic auth. Only accounts without a crypto password are served
+// because the server can't decrypt the names or data of the others.
+// Locks taken by clients are kept in the database, so they are shared by
+// the server instances using it and survive restarts.
+func webdavMiddleware(state *serverState) echo.MiddlewareFunc {
+	share := handleWebDAV(state)
+	uploads := limitUploads(state)(share)
+	authed := webdavAuth(state)(func(c echo.Context) error {
+		if c.Request().Method == "PUT" {
+			return uploads(c)
+		}
+		return share(c)
+	})
+	bodies := limitBodySize(state)(authed)
+	serve := func(c echo.Context) error {
+		req := c.Request()
+		if !webdavMethods[req.Method] {
+			return c.String(http.StatusMethodNotAllowed, "The method is not supported on the WebDAV share.")
+		}
+		if req.Method == "PUT" {
+			return authed(c)
+		}
+		return bodies(c)
+	}
+	if state.AccessLog != nil {
+		serve = accessLogMiddleware(state.AccessLog)(serve)
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			path := c.Request().URL.Path
+			if path != webdavPrefix && !strings.HasPrefix(path, webdavPrefix+"/") {
+				return next(c)
+			}
+			return serve(c)
+		}
+	}
+}
+
+// webdavAuth returns the middleware authenticating WebDAV clients with HTTP
+// basic auth. A request counts towards the requests per minute of the user
+// it names before the password is checked, so that guessing the password of
+// an account is limited like the account's other requests.
+func webdavAuth(state *serverState) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if username, _, ok := req.BasicAuth(); ok {
+				if named, err := state.Storage.GetUser(username); err == nil {
+					allowed, retryAfter := state.Limits.allowRequest(named.ID, time.Now())
+					if !allowed {
+						return tooManyRequests(c, retryAfter, "Too many requests; the server's limit of requests per minute was reached.")
+					}
+				}
+			}
+
+			user := basicAuthUser(state, req)
+			if user == nil {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="`+webdavRealm+`"`)
+				return c.String(http.StatusUnauthorized, "Could not verify the user.")
+			}
+			if len(user.CryptoHash) > 0 {
+				return c.String(http.StatusForbidden, "WebDAV is only available for accounts without a crypto password.")
+			}
+			c.Set(webdavUserContextName, user)
+			return next(c)
+		}
+	}
+}
+
+// handleWebDAV serves the WebDAV request of the user authenticated by
+// webdavAuth.
+func handleWebDAV(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user := c.Get(webdavUserContextName).(*filefreezer.User)
+		userLocks := &davLockSystem{store: state.Storage, userID: user.ID}
+		handler := &webdav.Handler{
+			Prefix:     webdavPrefix,
+			FileSystem: &davFileSystem{store: state.Storage, userID: user.ID, locks: userLocks, device: "webdav", deniedNames: state.DeniedNames},
+			LockSystem: userLocks,
+			Logger: func(r *http.Request, err error) {
+				if err != nil {
+					state.Log.Debugf("WebDAV %s %s for %s failed: %v", r.Method, r.URL.Path, user.Name, err)
+				}
+			},
+		}
+		handler.ServeHTTP(c.Response(), c.Request())
+		return nil
+	}
+}
+
+// basicAuthUser returns the user whose name and login password were sent
+// with HTTP basic auth, or nil if they weren't sent, don't match or the user
+// is suspended.
+func basicAuthUser(state *serverState, req *http.Request) *filefreezer.User {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return nil
+	}
+	user, err := state.Storage.GetUser(username)
+	if err != nil || !filefreezer.VerifyLoginPassword(password, user.Salt, user.SaltedHash) {
+		return nil
+	}
+	if user.Status == filefreezer.UserStatusSuspended {
+		return nil
+	}
+	return user
+}
+
+// davFileSystem implements webdav.FileSystem on top of a user's files in
+// Storage. File names are stored base64 encoded and file data is stored
+// as-is, which is how the client stores them with client.PassthroughCipher.
+// Directories exist either as directory entries or implicitly as the
+// parents of other files.
+type davFileSystem struct {
+	store  *filefreezer.Storage
+	userID int
+
+	// locks are the user's WebDAV locks, reported in lock discovery; nil
+	// when the files aren't served over WebDAV
+	locks *davLockSystem
+
+	// device is recorded as the device that uploaded the files and
+	// versions written through the file system
+	device string
+
+	// deniedNames are the file name patterns that can't be written
+	deniedNames []string
+}
+
+// davPath cleans a file name into the absolute form used by WebDAV so that
+// names stored with and without a leading slash are treated the same.
+func davPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// davEncodeName returns the stored form of a WebDAV path.
+func davEncodeName(name string) string {
+	return base64.StdEncoding.EncodeToString([]byte(name))
+}
+
+// davHashChunk returns the hash string that identifies a chunk of data.
+func davHashChunk(chunk []byte) string {
+	hasher := sha1.New()
+	hasher.Write(chunk)
+	return base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+}
+
+// davSubPath returns the part of the WebDAV path below its first depth
+// elements, starting with a slash, or an empty string if there's nothing
+// below them.
+func davSubPath(name string, depth int) string {
+	parts := strings.SplitN(strings.TrimPrefix(name, "/"), "/", depth+1)
+	if len(parts) <= depth {
+		return ""
+	}
+	return "/" + parts[depth]
+}
+
+// files returns the user's files keyed by their WebDAV path in NFC form so
+// that names sent in other normalization forms find them. Files whose names
+// aren't readable text are left out.
+func (fs *davFileSystem) files() (map[string]filefreezer.FileInfo, error) {
+	infos, err := fs.store.GetAllUserFileInfos(fs.userID)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]filefreezer.FileInfo, len(infos))
+	for _, fi := range infos {
+		plain, err := base64.StdEncoding.DecodeString(fi.FileName)
+		if err != nil || !utf8.Valid(plain) {
+			continue
+		}
+		files[filefreezer.NormalizeName(davPath(string(plain)))] = fi
+	}
+	return files, nil
+}
+
+// stat returns the file information for name using the files map.
+func (fs *davFileSystem) stat(files map[string]filefreezer.FileInfo, name string) (*davFileInfo, error) {
+	if name == "/" {
+		return &davFileInfo{name: "/", isDir: true}, nil
+	}
+	key := filefreezer.NormalizeName(name)
+	if fi, found := files[key]; found {
+		return fs.fileInfo(name, fi)
+	}
+
+	// a directory exists implicitly if any file is inside of it
+	for other := range files {
+		if strings.HasPrefix(other, key+"/") {
+			return &davFileInfo{name: name, isDir: true}, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// fileInfo builds the file information for a stored file.
+func (fs *davFileSystem) fileInfo(name string, fi filefreezer.FileInfo) (*davFileInfo, error) {
+	info := &davFileInfo{
+		name:    name,
+		isDir:   fi.IsDir,
+		mode:    os.FileMode(fi.CurrentVersion.Permissions).Perm(),
+		modTime: time.Unix(fi.CurrentVersion.LastMod, 0),
+		file:    fi,
+	}
+	if !fi.IsDir {
+		size, err := fs.store.GetFileVersionSize(fs.userID, fi.FileID, fi.CurrentVersion.VersionID)
+		if err != nil {
+			return nil, err
+		}
+		info.size = size
+	}
+	return info, nil
+}
+
+// denied returns true if the server never accepts files with the base name
+// of the path.
+func (fs *davFileSystem) denied(name string) bool {
+	return filefreezer.MatchName(path.Base(name), fs.deniedNames)
+}
+
+// nameKey returns the name key of a new file, which is empty unless the user
+// treats paths case-insensitively. WebDAV names are stored unencrypted so the
+// folded name is the key, the same as for clients without a crypto key.
+func (fs *davFileSystem) nameKey(name string) (string, error) {
+	user, err := fs.store.GetUserByID(fs.userID)
+	if err != nil {
+		return "", err
+	}
+	if !user.CaseInsensitive {
+		return "", nil
+	}
+	return filefreezer.FoldName(name), nil
+}
+
+// setNameKey gives a renamed file the name key for its new name.
+func (fs *davFileSystem) setNameKey(fileID int, name string) error {
+	nameKey, err := fs.nameKey(name)
+	if err != nil || nameKey == "" {
+		return err
+	}
+	return fs.store.SetFileNameKey(fs.userID, fileID, nameKey)
+}
+
+// Stat returns the file information for the file or directory.
+func (fs *davFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	files, err := fs.files()
+	if err != nil {
+		return nil, err
+	}
+	return fs.stat(files, davPath(name))
+}
+
+// Mkdir adds a directory entry. The parent directory must exist.
+func (fs *davFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = davPath(name)
+	if fs.denied(name) {
+		return os.ErrPermission
+	}
+	files, err := fs.files()
+	if err != nil {
+		return err
+	}
+	if _, err := fs.stat(files, name); err == nil {
+		return os.ErrExist
+	}
+	parent, err := fs.stat(files, path.Dir(name))
+	if err != nil {
+		return err
+	}
+	if !parent.isDir {
+		return os.ErrInvalid
+	}
+
+	nameKey, err := fs.nameKey(name)
+	if err != nil {
+		return err
+	}
+	fi, err := fs.store.AddFileInfoWithNameKey(fs.userID, davEncodeName(name), nameKey, true, uint32(os.ModeDir|perm.Perm()), time.Now().Unix(), 0, "")
+	if errors.Is(err, filefreezer.ErrFileExists) {
+		return os.ErrExist
+	} else if err != nil || fs.device == "" {
+		return err
+	}
+	return fs.store.SetFileVersionDevice(fs.userID, fi.FileID, fi.CurrentVersion.VersionID, fs.device)
+}
+
+// RemoveAll removes the file or the directory and everything in it.
+func (fs *davFileSystem) RemoveAll(ctx context.Context, name string) error {
+	name = davPath(name)
+	if name == "/" {
+		return os.ErrPermission
+	}
+	files, err := fs.files()
+	if err != nil {
+		return err
+	}
+	key := filefreezer.NormalizeName(name)
+	for other, fi := range files {
+		if other == key || strings.HasPrefix(other, key+"/") {
+			err = fs.store.RemoveFile(fs.userID, fi.FileID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Rename moves the file or the directory and everything in it to newName.
+func (fs *davFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, newName = davPath(oldName), davPath(newName)
+	oldKey := filefreezer.NormalizeName(oldName)
+	if oldName == "/" || newName == "/" || strings.HasPrefix(filefreezer.NormalizeName(newName), oldKey+"/") {
+		return os.ErrInvalid
+	}
+	if fs.denied(newName) {
+		return os.ErrPermission
+	}
+	files, err := fs.files()
+	if err != nil {
+		return err
+	}
+	if _, err := fs.stat(files, oldName); err != nil {
+		return err
+	}
+	parent, err := fs.stat(files, path.Dir(newName))
+	if err != nil {
+		return err
+	}
+	if !parent.isDir {
+		return os.ErrInvalid
+	}
+
+	// the files inside of a directory keep the form their names were
+	// stored in
+	depth := strings.Count(oldKey, "/")
+	for other, fi := range files {
+		if other == oldKey || strings.HasPrefix(other, oldKey+"/") {
+			plain, _ := base64.StdEncoding.DecodeString(fi.FileName)
+			renamed := newName + davSubPath(davPath(string(plain)), depth)
+			err = fs.store.RenameFile(fs.userID, fi.FileID, davEncodeName(renamed))
+			if err == nil {
+				err = fs.setNameKey(fi.FileID, renamed)
+			}
+			if errors.Is(err, filefreezer.ErrFileExists) {
+				return os.ErrExist
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// OpenFile opens a file or directory for reading or a file for writing.
+// Written data is stored as a new version of the file when it's closed.
+func (fs *davFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = davPath(name)
+	files, err := fs.files()
+	if err != nil {
+		return nil, err
+	}
+	info, statErr := fs.stat(files, name)
+
+	// files are only written as whole new versions, so opening an existing
+	// file for writing without truncating it, as PROPPATCH does, opens it
+	// for reading
+	if flag&os.O_TRUNC != 0 || (flag&os.O_CREATE != 0 && statErr != nil) {
+		if statErr == nil && info.isDir {
+			return nil, os.ErrInvalid
+		}
+		if fs.denied(name) {
+			return nil, os.ErrPermission
+		}
+		if statErr != nil && flag&os.O_CREATE == 0 {
+			return nil, statErr
+		}
+		parent, err := fs.stat(files, path.Dir(name))
+		if err != nil {
+			return nil, err
+		}
+		if !parent.isDir {
+			return nil, os.ErrInvalid
+		}
+
+		tmp, err := ioutil.TempFile("", "freezer-dav-")
+		if err != nil {
+			return nil, err
+		}
+		f := &davWriteFile{fs: fs, name: name, perm: perm.Perm(), tmp: tmp}
+		if statErr == nil {
+			f.existing = &info.file
+		}
+		return f, nil
+	}
+
+	if statErr != nil {
+		return nil, statErr
+	}
+	if info.isDir {
+		return &davDirFile{fs: fs, info: info, files: files}, nil
+	}
+	return &davReadFile{fs: fs, info: info}, nil
+}
+
+// davFileInfo implements os.FileInfo for files and directories on the share.
+type davFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	isDir   bool
+
+	// file is the stored file; empty for implicit directories
+	file filefreezer.FileInfo
+}
+
+func (i *davFileInfo) Name() string       { return path.Base(i.name) }
+func (i *davFileInfo) Size() int64        { return i.size }
+func (i *davFileInfo) ModTime() time.Time { return i.modTime }
+func (i *davFileInfo) IsDir() bool        { return i.isDir }
+func (i *davFileInfo) Sys() interface{}   { return nil }
+
+func (i *davFileInfo) Mode() os.FileMode {
+	if i.isDir {
+		return os.ModeDir | 0755
+	}
+	if i.mode == 0 {
+		return 0644
+	}
+	return i.mode
+}
+
+// davDirFile is an open directory on the share.
+type davDirFile struct {
+	fs    *davFileSystem
+	info  *davFileInfo
+	files map[string]filefreezer.FileInfo
+	read  bool
+}
+
+func (d *davDirFile) Close() error                                 { return nil }
+func (d *davDirFile) Read(p []byte) (int, error)                   { return 0, os.ErrInvalid }
+func (d *davDirFile) Write(p []byte) (int, error)                  { return 0, os.ErrInvalid }
+func (d *davDirFile) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (d *davDirFile) Stat() (os.FileInfo, error)                   { return d.info, nil }
+
+// DeadProps returns the lock discovery of the directory.
+func (d *davDirFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return d.fs.deadProps(d.info.name)
+}
+
+// Patch answers a PROPPATCH on the directory.
+func (d *davDirFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return d.fs.patchProps(patches)
+}
+
+// Readdir returns the files and directories directly inside the directory,
+// including directories that only exist implicitly.
+func (d *davDirFile) Readdir(count int) ([]os.FileInfo, error) {
+	if d.read {
+		if count > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	d.read = true
+
+	prefix := d.info.name
+	if prefix != "/" {
+		prefix += "/"
+	}
+	children := make(map[string]*davFileInfo)
+	for other, fi := range d.files {
+		if !strings.HasPrefix(other, prefix) {
+			continue
+		}
+		rest := other[len(prefix):]
+		if i := strings.Index(rest, "/"); i >= 0 {
+			// a file deeper down implies the child directory
+			childName := prefix + rest[:i]
+			if _, found := children[childName]; !found {
+				children[childName] = &davFileInfo{name: childName, isDir: true}
+			}
+			continue
+		}
+		info, err := d.fs.fileInfo(other, fi)
+		if err != nil {
+			return nil, err
+		}
+		children[other] = info
+	}
+
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		infos = append(infos, children[name])
+	}
+	return infos, nil
+}
+
+// davReadFile is a file on the share opened for reading. Chunks are loaded
+// from storage as they're read, so the whole file is never in memory.
+type davReadFile struct {
+	fs     *davFileSystem
+	info   *davFileInfo
+	offset int64
+
+	// the most recently loaded chunk
+	chunkNum  int
+	chunkData []byte
+}
+
+func (f *davReadFile) Close() error                             { return nil }
+func (f *davReadFile) Write(p []byte) (int, error)              { return 0, os.ErrInvalid }
+func (f *davReadFile) Stat() (os.FileInfo, error)               { return f.info, nil }
+func (f *davReadFile) Readdir(count int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+
+// DeadProps returns the lock discovery of the file.
+func (f *davReadFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return f.fs.deadProps(f.info.name)
+}
+
+// Patch answers a PROPPATCH on the file.
+func (f *davReadFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return f.fs.patchProps(patches)
+}
+
+// Seek sets the offset for the next Read.
+func (f *davReadFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return f.offset, os.ErrInvalid
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Read reads from the chunk holding the current offset. Every chunk but the
+// last one holds the server's chunk size of data.
+func (f *davReadFile) Read(p []byte) (int, error) {
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+
+	chunkSize := f.fs.store.ChunkSize
+	chunkNum := int(f.offset / chunkSize)
+	if f.chunkData == nil || f.chunkNum != chunkNum {
+		chunk, err := f.fs.store.GetFileChunk(f.info.file.FileID, chunkNum, f.info.file.CurrentVersion.VersionID)
+		if err != nil {
+			return 0, err
+		}
+		err = f.fs.store.CheckTransferLimit(f.fs.userID, int64(len(chunk.Chunk)))
+		if err != nil {
+			return 0, err
+		}
+		// transfer accounting is best effort and doesn't fail the read
+		_ = f.fs.store.RecordTransfer(f.fs.userID, 0, int64(len(chunk.Chunk)))
+		f.chunkNum = chunkNum
+		f.chunkData = chunk.Chunk
+	}
+
+	start := f.offset - int64(chunkNum)*chunkSize
+	if start >= int64(len(f.chunkData)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, f.chunkData[start:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+// davWriteFile is a file on the share opened for writing. The data is
+// spooled to a temporary file and stored when the file is closed.
+type davWriteFile struct {
+	fs       *davFileSystem
+	name     string
+	perm     os.FileMode
+	tmp      *os.File
+	existing *filefreezer.FileInfo
+}
+
+func (f *davWriteFile) Read(p []byte) (int, error)  { return f.tmp.Read(p) }
+func (f *davWriteFile) Write(p []byte) (int, error) { return f.tmp.Write(p) }
+func (f *davWriteFile) Seek(offset int64, whence int) (int64, error) {
+	return f.tmp.Seek(offset, whence)
+}
+func (f *davWriteFile) Readdir(count int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+
+// WriteAt writes at the offset, which lets SFTP clients write out of order.
+func (f *davWriteFile) WriteAt(p []byte, offset int64) (int, error) {
+	return f.tmp.WriteAt(p, offset)
+}
+
+// Stat returns the file information for the data written so far.
+func (f *davWriteFile) Stat() (os.FileInfo, error) {
+	tmpInfo, err := f.tmp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &davFileInfo{name: f.name, size: tmpInfo.Size(), mode: f.perm, modTime: tmpInfo.ModTime()}, nil
+}
+
+// discard throws away the written data without storing it.
+func (f *davWriteFile) discard() {
+	f.tmp.Close()
+	os.Remove(f.tmp.Name())
+}
+
+// Close stores the written data as a new file or a new version of the
+// existing file. A new file is removed again if its data can't be stored.
+func (f *davWriteFile) Close() error {
+	defer os.Remove(f.tmp.Name())
+	defer f.tmp.Close()
+
+	store := f.fs.store
+	stats, err := filefreezer.CalcFileHashInfo(store.ChunkSize, f.tmp.Name())
+	if err != nil {
+		return err
+	}
+
+	// register the version with a placeholder modification time until
+	// all of the chunks are stored
+	perms := uint32(f.perm)
+	var fi *filefreezer.FileInfo
+	if f.existing != nil {
+		fi, err = store.TagNewFileVersion(f.fs.userID, f.existing.FileID, perms, webdavPlaceholderLastMod, stats.ChunkCount, stats.HashString)
+	} else {
+		var nameKey string
+		nameKey, err = f.fs.nameKey(f.name)
+		if err == nil {
+			fi, err = store.AddFileInfoWithNameKey(f.fs.userID, davEncodeName(f.name), nameKey, false, perms, webdavPlaceholderLastMod, stats.ChunkCount, stats.HashString)
+		}
+	}
+	if errors.Is(err, filefreezer.ErrFileExists) {
+		return os.ErrExist
+	} else if err != nil {
+		return err
+	}
+
+	err = f.storeChunks(fi, stats.ChunkCount)
+	if err == nil {
+		err = store.UpdateFileVersion(f.fs.userID, fi.FileID, fi.CurrentVersion.VersionID, time.Now().Unix(), stats.ChunkCount, stats.HashString)
+	}
+	if err == nil {
+		err = store.SetFileVersionMerkleRoot(f.fs.userID, fi.FileID, fi.CurrentVersion.VersionID, stats.MerkleRoot)
+	}
+	if err == nil && f.fs.device != "" {
+		err = store.SetFileVersionDevice(f.fs.userID, fi.FileID, fi.CurrentVersion.VersionID, f.fs.device)
+	}
+	if err != nil && f.existing == nil {
+		store.RemoveFile(f.fs.userID, fi.FileID)
+	}
+	return err
+}
+
+// storeChunks adds the chunks of the temporary file to the file version.
+func (f *davWriteFile) storeChunks(fi *filefreezer.FileInfo, chunkCount int) error {
+	_, err := f.tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	buffer := make([]byte, f.fs.store.ChunkSize)
+	for i := 0; i < chunkCount; i++ {
+		n, err := io.ReadFull(f.tmp, buffer)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("failed to read chunk %d of the written data: %v", i, err)
+		}
+		chunk := buffer[:n]
+		err = f.fs.store.CheckTransferLimit(f.fs.userID, int64(n))
+		if err != nil {
+			return err
+		}
+		_, err = f.fs.store.AddFileChunk(f.fs.userID, fi.FileID, fi.CurrentVersion.VersionID, i, davHashChunk(chunk), chunk)
+		if err != nil {
+			return err
+		}
+		_ = f.fs.store.RecordTransfer(f.fs.userID, int64(n), 0)
+	}
+	return nil
+}
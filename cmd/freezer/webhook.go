@@ -0,0 +1,190 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tbogdala/filefreezer/cmd/freezer/logging"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// The events sent to the webhook URLs.
+const (
+	webhookEventUserCreated      = "user.created"
+	webhookEventUserRemoved      = "user.removed"
+	webhookEventUserImpersonated = "user.impersonated"
+	webhookEventUserSuspended    = "user.suspended"
+	webhookEventUserReactivated  = "user.reactivated"
+	webhookEventFileAdded        = "file.added"
+	webhookEventFileUploaded     = "file.uploaded"
+	webhookEventFileRemoved      = "file.removed"
+	webhookEventQuotaWarning     = "quota.warning"
+	webhookEventQuotaExceed      = "quota.exceeded"
+	webhookEventStorageWarning   = "storage.warning"
+	webhookEventStorageFull      = "storage.full"
+)
+
+const (
+	// webhookSignatureHeader is the header holding the hex encoded
+	// HMAC-SHA256 signature of the payload using the webhook secret.
+	webhookSignatureHeader = "X-Freezer-Signature"
+
+	// webhookEventHeader is the header holding the event name.
+	webhookEventHeader = "X-Freezer-Event"
+
+	// webhookQueueSize is the number of events that can be waiting to be
+	// delivered before new events get dropped.
+	webhookQueueSize = 256
+
+	// webhookAttempts is the number of times delivery is attempted for
+	// each URL before giving up on the event.
+	webhookAttempts = 3
+
+	// webhookTimeout is the timeout for a single delivery attempt.
+	webhookTimeout = 10 * time.Second
+)
+
+// webhookDispatcher delivers server events as signed JSON payloads to all of
+// the configured webhook URLs. Events are queued and sent from a background
+// goroutine so that request handlers never wait on the webhook receivers.
+//
+// All methods are safe to call on a nil dispatcher, which does nothing, so
+// that callers don't need to check whether webhooks are configured.
+type webhookDispatcher struct {
+	urls   []string
+	secret []byte
+	client *http.Client
+	log    *logging.Logger
+	queue  chan *models.WebhookEvent
+	wg     sync.WaitGroup
+
+	closeOnce sync.Once
+}
+
+// newWebhookDispatcher creates a dispatcher for the URLs and starts the
+// delivery goroutine. If secret is not empty every payload is signed with it.
+// Nil is returned if no URLs are supplied.
+func newWebhookDispatcher(urls []string, secret string, log *logging.Logger) *webhookDispatcher {
+	if len(urls) == 0 {
+		return nil
+	}
+
+	d := new(webhookDispatcher)
+	d.urls = urls
+	d.secret = []byte(secret)
+	d.client = &http.Client{Timeout: webhookTimeout}
+	d.log = log
+	d.queue = make(chan *models.WebhookEvent, webhookQueueSize)
+
+	d.wg.Add(1)
+	go d.run()
+	return d
+}
+
+// send queues the event for delivery. If the queue is full the event is
+// dropped and a warning is logged.
+func (d *webhookDispatcher) send(event string, userID int, username string, data map[string]interface{}) {
+	if d == nil {
+		return
+	}
+
+	ev := &models.WebhookEvent{
+		Event:    event,
+		Time:     time.Now().Unix(),
+		UserID:   userID,
+		UserName: username,
+		Data:     data,
+	}
+	select {
+	case d.queue <- ev:
+	default:
+		d.log.Warnf("Webhook queue is full; dropping the %s event.", event)
+	}
+}
+
+// Close stops accepting events and waits for the queued events to be
+// delivered.
+func (d *webhookDispatcher) Close() {
+	if d == nil {
+		return
+	}
+	d.closeOnce.Do(func() {
+		close(d.queue)
+	})
+	d.wg.Wait()
+}
+
+// run delivers the queued events until the queue is closed.
+func (d *webhookDispatcher) run() {
+	defer d.wg.Done()
+	for ev := range d.queue {
+		payload, err := json.Marshal(ev)
+		if err != nil {
+			d.log.Errorf("Failed to serialize the %s webhook event: %v", ev.Event, err)
+			continue
+		}
+		for _, url := range d.urls {
+			err = d.deliver(url, ev.Event, payload)
+			if err != nil {
+				d.log.Errorf("Failed to deliver the %s webhook event to %s: %v", ev.Event, url, err)
+			}
+		}
+	}
+}
+
+// deliver posts the payload to the url, retrying with a short backoff if
+// the receiver fails or doesn't respond with a 2xx status code.
+func (d *webhookDispatcher) deliver(url string, event string, payload []byte) error {
+	var err error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * time.Second)
+		}
+
+		var req *http.Request
+		req, err = http.NewRequest("POST", url, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(webhookEventHeader, event)
+		if len(d.secret) > 0 {
+			req.Header.Set(webhookSignatureHeader, "sha256="+signWebhookPayload(d.secret, payload))
+		}
+
+		var resp *http.Response
+		resp, err = d.client.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("receiver responded with status %s", resp.Status)
+	}
+	return err
+}
+
+// signWebhookPayload returns the hex encoded HMAC-SHA256 of the payload.
+func signWebhookPayload(secret []byte, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newWebhooksFromFlags creates the webhook dispatcher configured by the
+// command line flags or nil if no webhook URLs were given.
+func newWebhooksFromFlags() *webhookDispatcher {
+	return newWebhookDispatcher(*flagWebhooks, *flagWebhookSecret, logger.Component("webhook"))
+}
@@ -0,0 +1,222 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	createWebDAVLocksTable = `CREATE TABLE IF NOT EXISTS WebDAVLocks (
+        Token       TEXT PRIMARY KEY    NOT NULL,
+        UserID      INTEGER             NOT NULL,
+        Root        TEXT                NOT NULL,
+        ZeroDepth   INTEGER             NOT NULL,
+        OwnerXML    TEXT                NOT NULL,
+        Expires     INTEGER             NOT NULL
+	);`
+
+	// holdUserRow takes the write lock on the user's row so that concurrent
+	// transactions creating locks for the same user run one after the other
+	holdUserRow = `UPDATE Users SET Status = Status WHERE UserID = ?;`
+
+	addDAVLock            = `INSERT INTO WebDAVLocks (Token, UserID, Root, ZeroDepth, OwnerXML, Expires) VALUES (?, ?, ?, ?, ?, ?);`
+	getDAVLocks           = `SELECT Token, Root, ZeroDepth, OwnerXML, Expires FROM WebDAVLocks WHERE UserID = ? AND (Expires = 0 OR Expires > ?) ORDER BY Token;`
+	getDAVLock            = `SELECT Root, ZeroDepth, OwnerXML, Expires FROM WebDAVLocks WHERE UserID = ? AND Token = ? AND (Expires = 0 OR Expires > ?);`
+	setDAVLockExpiry      = `UPDATE WebDAVLocks SET Expires = ? WHERE UserID = ? AND Token = ?;`
+	removeDAVLock         = `DELETE FROM WebDAVLocks WHERE UserID = ? AND Token = ? AND (Expires = 0 OR Expires > ?);`
+	removeExpiredDAVLocks = `DELETE FROM WebDAVLocks WHERE UserID = ? AND Expires <> 0 AND Expires <= ?;`
+)
+
+// DAVLock is a WebDAV write lock a user holds on one of their paths. Locks
+// are stored in the database so that every server instance sharing it
+// honors them.
+type DAVLock struct {
+	// Token identifies the lock to the client holding it.
+	Token string
+
+	// Root is the absolute, cleaned path of the locked resource.
+	Root string
+
+	// ZeroDepth is true if only Root is locked and false if everything
+	// under it is locked as well.
+	ZeroDepth bool
+
+	// OwnerXML is the owner sent by the client, returned in lock discovery.
+	OwnerXML string
+
+	// Expires is when the lock times out; the zero time if it never does.
+	Expires time.Time
+}
+
+// Covers returns true if the lock covers the resource name, which is the
+// case for the locked resource itself and, for infinite depth locks,
+// everything under it.
+func (l *DAVLock) Covers(name string) bool {
+	if l.Root == name {
+		return true
+	}
+	if l.ZeroDepth {
+		return false
+	}
+	return l.Root == "/" || strings.HasPrefix(name, l.Root+"/")
+}
+
+// davLockExpires returns the Expires column value for the expiry time.
+func davLockExpires(expires time.Time) int64 {
+	if expires.IsZero() {
+		return 0
+	}
+	return expires.UnixNano()
+}
+
+// davLockExpiry returns the expiry time stored in the Expires column.
+func davLockExpiry(expires int64) time.Time {
+	if expires == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, expires)
+}
+
+// scanDAVLocks reads the active locks returned by getDAVLocks.
+func scanDAVLocks(rows *sql.Rows) ([]DAVLock, error) {
+	defer rows.Close()
+	var locks []DAVLock
+	for rows.Next() {
+		var l DAVLock
+		var zeroDepth int
+		var expires int64
+		err := rows.Scan(&l.Token, &l.Root, &zeroDepth, &l.OwnerXML, &expires)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the WebDAV locks: %v", err)
+		}
+		l.ZeroDepth = zeroDepth != 0
+		l.Expires = davLockExpiry(expires)
+		locks = append(locks, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get the WebDAV locks: %v", err)
+	}
+	return locks, nil
+}
+
+// CreateDAVLock creates the lock for the user and returns its new token.
+// ErrDAVLocked is returned if an active lock of the user already covers the
+// lock's root or, for an infinite depth lock, anything under it.
+func (s *Storage) CreateDAVLock(userID int, lock DAVLock, now time.Time) (string, error) {
+	defer s.timeOperation("CreateDAVLock", userID)()
+
+	random := make([]byte, 16)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate the WebDAV lock token: %v", err)
+	}
+	lock.Token = "opaquelocktoken:" + hex.EncodeToString(random)
+
+	zeroDepth := 0
+	if lock.ZeroDepth {
+		zeroDepth = 1
+	}
+
+	err = s.transact(func(tx *sql.Tx) error {
+		_, err := tx.Exec(holdUserRow, userID)
+		if err != nil {
+			return fmt.Errorf("failed to hold the user while creating a WebDAV lock: %v", err)
+		}
+		_, err = tx.Exec(removeExpiredDAVLocks, userID, now.UnixNano())
+		if err != nil {
+			return fmt.Errorf("failed to remove the expired WebDAV locks: %v", err)
+		}
+
+		rows, err := tx.Query(getDAVLocks, userID, now.UnixNano())
+		if err != nil {
+			return fmt.Errorf("failed to get the WebDAV locks: %v", err)
+		}
+		active, err := scanDAVLocks(rows)
+		if err != nil {
+			return err
+		}
+		for _, l := range active {
+			if l.Covers(lock.Root) || lock.Covers(l.Root) {
+				return ErrDAVLocked
+			}
+		}
+
+		_, err = tx.Exec(addDAVLock, lock.Token, userID, lock.Root, zeroDepth, lock.OwnerXML, davLockExpires(lock.Expires))
+		if err != nil {
+			return fmt.Errorf("failed to add the WebDAV lock: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return lock.Token, nil
+}
+
+// RefreshDAVLock sets when the user's lock expires and returns the lock.
+// ErrNoDAVLock is returned if the user doesn't hold an active lock with the
+// token.
+func (s *Storage) RefreshDAVLock(userID int, token string, expires time.Time, now time.Time) (*DAVLock, error) {
+	defer s.timeOperation("RefreshDAVLock", userID)()
+
+	lock := DAVLock{Token: token}
+	err := s.transact(func(tx *sql.Tx) error {
+		var zeroDepth int
+		var oldExpires int64
+		err := tx.QueryRow(getDAVLock, userID, token, now.UnixNano()).Scan(&lock.Root, &zeroDepth, &lock.OwnerXML, &oldExpires)
+		if err == sql.ErrNoRows {
+			return ErrNoDAVLock
+		} else if err != nil {
+			return fmt.Errorf("failed to get the WebDAV lock: %v", err)
+		}
+		lock.ZeroDepth = zeroDepth != 0
+		lock.Expires = expires
+
+		_, err = tx.Exec(setDAVLockExpiry, davLockExpires(expires), userID, token)
+		if err != nil {
+			return fmt.Errorf("failed to refresh the WebDAV lock: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &lock, nil
+}
+
+// RemoveDAVLock releases the user's lock. ErrNoDAVLock is returned if the
+// user doesn't hold an active lock with the token.
+func (s *Storage) RemoveDAVLock(userID int, token string, now time.Time) error {
+	defer s.timeOperation("RemoveDAVLock", userID)()
+
+	res, err := s.db.Exec(removeDAVLock, userID, token, now.UnixNano())
+	if err != nil {
+		return fmt.Errorf("failed to remove the WebDAV lock: %v", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get the affected rows while removing the WebDAV lock: %v", err)
+	}
+	if affected == 0 {
+		return ErrNoDAVLock
+	}
+	return nil
+}
+
+// GetDAVLocks returns the active locks of the user ordered by token.
+func (s *Storage) GetDAVLocks(userID int, now time.Time) ([]DAVLock, error) {
+	defer s.timeOperation("GetDAVLocks", userID)()
+
+	rows, err := s.db.Query(getDAVLocks, userID, now.UnixNano())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the WebDAV locks: %v", err)
+	}
+	return scanDAVLocks(rows)
+}
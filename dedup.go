@@ -0,0 +1,120 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const (
+	getDedupTargetVersion = `SELECT ChunkCount, FileHash FROM FileVersion WHERE VersionID = ? AND FileID = ?;`
+	getVersionChunkCount  = `SELECT COUNT(*) FROM FileChunks WHERE FileID = ? AND VersionID = ?;`
+	findIdenticalVersion  = `SELECT FileVersion.FileID, FileVersion.VersionID FROM FileVersion
+					INNER JOIN FileInfo ON FileInfo.FileID = FileVersion.FileID
+					WHERE FileInfo.UserID = ? AND FileVersion.FileHash = ? AND FileVersion.ChunkCount = ? AND FileVersion.VersionID != ?
+					AND (SELECT COUNT(*) FROM FileChunks WHERE FileChunks.FileID = FileVersion.FileID AND FileChunks.VersionID = FileVersion.VersionID) = FileVersion.ChunkCount
+					ORDER BY FileVersion.VersionID DESC LIMIT 1;`
+	getVersionOwnDataSize = `SELECT IFNULL(SUM(ChunkSize), 0) FROM FileChunks WHERE FileID = ? AND VersionID = ? AND ChunkDataID = 0;`
+	copyVersionChunks     = `INSERT INTO FileChunks (FileID, VersionID, ChunkNum, ChunkHash, Chunk, ChunkSize, StoreKey, ChunkDataID)
+					SELECT ?, ?, ChunkNum, ChunkHash, Chunk, ChunkSize, StoreKey, ChunkDataID FROM FileChunks WHERE FileID = ? AND VersionID = ?;`
+)
+
+// CopyIdenticalChunks fills in the chunks of a file version that has none yet
+// by copying them from another version of the user's files with the same
+// whole-file hash and chunk count, so that a client uploading a file the user
+// already has doesn't have to send any of its data. Only versions that have
+// all of their chunks are copied from. The number of chunks copied is
+// returned, which is zero if there was no identical version to copy. The
+// copied chunks share the data of the chunks they're copied from, so only
+// the chunks that keep their own copy of their data count towards the
+// user's quota.
+func (s *Storage) CopyIdenticalChunks(userID int, fileID int, versionID int) (int, error) {
+	defer s.timeOperation("CopyIdenticalChunks", userID)()
+
+	var copied int
+	err := s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return ErrNotOwner
+		}
+
+		var chunkCount int
+		var fileHash string
+		err = tx.QueryRow(getDedupTargetVersion, versionID, fileID).Scan(&chunkCount, &fileHash)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("the version id %d was not found for the file id %d", versionID, fileID)
+		} else if err != nil {
+			return fmt.Errorf("failed to get the file version (%d) from the database: %v", versionID, err)
+		}
+		if chunkCount == 0 || fileHash == "" {
+			return nil
+		}
+
+		// only a version that doesn't have any chunks yet is filled in
+		var existing int
+		err = tx.QueryRow(getVersionChunkCount, fileID, versionID).Scan(&existing)
+		if err != nil {
+			return fmt.Errorf("failed to count the chunks of the file version (%d): %v", versionID, err)
+		}
+		if existing > 0 {
+			return nil
+		}
+
+		var sourceFileID, sourceVersionID int
+		err = tx.QueryRow(findIdenticalVersion, userID, fileHash, chunkCount, versionID).Scan(&sourceFileID, &sourceVersionID)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to look for an identical file version: %v", err)
+		}
+
+		// fail the transaction if there's not enough allocation space
+		var size, growth int64
+		err = tx.QueryRow(getVersionChunkSize, sourceFileID, sourceVersionID).Scan(&size)
+		if err != nil {
+			return fmt.Errorf("failed to get the size of the file version (%d): %v", sourceVersionID, err)
+		}
+		err = tx.QueryRow(getVersionOwnDataSize, sourceFileID, sourceVersionID).Scan(&growth)
+		if err != nil {
+			return fmt.Errorf("failed to get the size of the file version (%d): %v", sourceVersionID, err)
+		}
+		err = s.checkQuota(tx, userID, growth, size)
+		if err != nil {
+			return err
+		}
+		err = s.checkStorageCap(tx, growth)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(copyVersionChunks, fileID, versionID, sourceFileID, sourceVersionID)
+		if err != nil {
+			return fmt.Errorf("failed to copy the chunks of the file version (%d): %v", sourceVersionID, err)
+		}
+		ids, err := chunkDataIDs(tx, getChunkDataIDsOfVersion, sourceFileID, sourceVersionID)
+		if err != nil {
+			return err
+		}
+		err = countChunkDataRefs(tx, ids)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(updateUserStats, size, userID)
+		if err != nil {
+			return fmt.Errorf("failed to update the allocated bytes in the database after copying chunks: %v", err)
+		}
+		copied = chunkCount
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return copied, nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The kinds of errors that Storage and the client can return. They may be
+// wrapped with more detail, so check for them with errors.Is.
+var (
+	// ErrNotOwner is returned when a user accesses a file that belongs
+	// to another user.
+	ErrNotOwner = errors.New("user does not own the file id supplied")
+
+	// ErrQuotaExceeded is returned when storing a chunk would put the user
+	// over their quota.
+	ErrQuotaExceeded = errors.New("not enough free allocation space")
+
+	// ErrFileExists is returned when adding a file name that the user
+	// has already registered.
+	ErrFileExists = errors.New("the file already exists")
+
+	// ErrChunkTooLarge is returned when a chunk is larger than the chunk
+	// size plus MaxChunkOverhead.
+	ErrChunkTooLarge = errors.New("the chunk is larger than the maximum chunk size")
+
+	// ErrHashMismatch is returned when downloaded file data doesn't match
+	// the file hash recorded for the file version.
+	ErrHashMismatch = errors.New("the file data does not match the file hash")
+
+	// ErrChunkMismatch is returned when a chunk sent to repair a file version
+	// doesn't match the chunk hashes recorded for the version.
+	ErrChunkMismatch = errors.New("the chunk does not match the file version")
+
+	// ErrFileLimit is returned when adding a file or file version would put
+	// the user over the server's limit on the number of files or versions.
+	// The limits are a kind of quota, so it also matches ErrQuotaExceeded.
+	ErrFileLimit = fmt.Errorf("%w: too many files or file versions", ErrQuotaExceeded)
+
+	// ErrFileTooLarge is returned when a file version is larger than the
+	// server's maximum file size. Like ErrFileLimit, it also matches
+	// ErrQuotaExceeded.
+	ErrFileTooLarge = fmt.Errorf("%w: the file is larger than the maximum file size", ErrQuotaExceeded)
+
+	// ErrStorageFull is returned when storing a chunk would put the total
+	// allocation of all users over the server's storage cap. Unlike the
+	// user limits, it isn't a kind of quota; no user can store more until
+	// an administrator makes room.
+	ErrStorageFull = errors.New("the server's storage is full")
+
+	// ErrTransferLimit is returned when uploading or downloading a chunk
+	// would put the user over the server's monthly transfer limit.
+	ErrTransferLimit = errors.New("the monthly transfer limit has been reached")
+
+	// ErrRevisionMismatch is returned when a change to a file is made with
+	// the revision the client last saw, which is the id of the file's
+	// current version, and another client has changed the file since.
+	ErrRevisionMismatch = errors.New("the file has changed since the revision the change was based on")
+
+	// ErrDAVLocked is returned when a WebDAV lock can't be created because
+	// another lock already covers some of the files it would cover.
+	ErrDAVLocked = errors.New("the path is already locked")
+
+	// ErrNoDAVLock is returned when a WebDAV lock token doesn't match an
+	// active lock of the user.
+	ErrNoDAVLock = errors.New("no such lock")
+)
@@ -0,0 +1,161 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// MatchName returns true if the base file name matches any of the shell
+// patterns, which use the syntax of path.Match. Malformed patterns never
+// match; CheckNamePatterns reports them.
+func MatchName(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckNamePatterns returns an error for the first malformed pattern.
+func CheckNamePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid file name pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// IgnoreRules are the patterns of an ignore file, such as the .freezerignore
+// of a synced directory, in the syntax of .gitignore files: blank lines and
+// lines starting with # are skipped, a pattern starting with ! includes
+// again what an earlier pattern ignored, a pattern ending in / only matches
+// directories and a pattern with a / anywhere else is matched from the
+// directory of the ignore file instead of against names at any depth. *, ?
+// and [] match within a path element and ** matches any number of them.
+// The last pattern that matches a path decides whether it's ignored.
+type IgnoreRules struct {
+	rules []ignoreRule
+}
+
+// ignoreRule is one pattern of an ignore file.
+type ignoreRule struct {
+	elements []string // the path elements of the pattern
+	dirOnly  bool
+	negate   bool
+}
+
+// ParseIgnoreRules reads the patterns of an ignore file. An error is
+// returned for the first malformed pattern.
+func ParseIgnoreRules(r io.Reader) (*IgnoreRules, error) {
+	rules := new(IgnoreRules)
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, "\\") {
+			// a leading \ escapes a # or ! that starts the pattern
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			return nil, fmt.Errorf("invalid ignore pattern on line %d: the pattern is empty", lineNum)
+		}
+
+		if !anchored {
+			rule.elements = []string{"**"}
+		}
+		for _, element := range strings.Split(line, "/") {
+			if _, err := path.Match(element, ""); err != nil {
+				return nil, fmt.Errorf("invalid ignore pattern %q on line %d: %v", line, lineNum, err)
+			}
+			rule.elements = append(rule.elements, element)
+		}
+		rules.rules = append(rules.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the ignore patterns: %v", err)
+	}
+	return rules, nil
+}
+
+// Match returns true if the slash separated path, relative to the directory
+// of the ignore file, is ignored. isDir tells if the path is a directory.
+// Like with .gitignore files, the contents of an ignored directory are
+// ignored too and can't be included again. A nil IgnoreRules ignores
+// nothing.
+func (ir *IgnoreRules) Match(p string, isDir bool) bool {
+	p = strings.Trim(p, "/")
+	if ir == nil || p == "" {
+		return false
+	}
+	elements := strings.Split(p, "/")
+	for i := 1; i < len(elements); i++ {
+		if ir.matchElements(elements[:i], true) {
+			return true
+		}
+	}
+	return ir.matchElements(elements, isDir)
+}
+
+// matchElements returns true if the last of the rules that match the path
+// elements ignores them.
+func (ir *IgnoreRules) matchElements(elements []string, isDir bool) bool {
+	ignored := false
+	for _, rule := range ir.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if matchIgnoreElements(rule.elements, elements) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// matchIgnoreElements matches the path elements against the elements of a
+// pattern, where ** stands for any number of elements. A trailing **
+// matches at least one so that dir/** matches what's inside dir but not dir
+// itself.
+func matchIgnoreElements(pattern []string, elements []string) bool {
+	if len(pattern) == 0 {
+		return len(elements) == 0
+	}
+	if pattern[0] == "**" {
+		if len(pattern) == 1 {
+			return len(elements) > 0
+		}
+		for i := 0; i <= len(elements); i++ {
+			if matchIgnoreElements(pattern[1:], elements[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(elements) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(pattern[0], elements[0]); !matched {
+		return false
+	}
+	return matchIgnoreElements(pattern[1:], elements[1:])
+}
@@ -0,0 +1,86 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	setFileExpiresAt = `UPDATE FileInfo SET ExpiresAt = ? WHERE FileID = ?;`
+	getExpiredFiles  = `SELECT FileID, UserID FROM FileInfo WHERE ExpiresAt > 0 AND ExpiresAt <= ?;`
+)
+
+// SetFileExpiry sets the unix time after which the file is removed by
+// ExpireFiles. An expiresAt of zero means the file doesn't expire.
+func (s *Storage) SetFileExpiry(userID, fileID int, expiresAt int64) error {
+	defer s.timeOperation("SetFileExpiry", userID)()
+
+	if expiresAt < 0 {
+		return fmt.Errorf("the expiry time of a file can't be negative")
+	}
+
+	return s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return ErrNotOwner
+		}
+
+		_, err = tx.Exec(setFileExpiresAt, expiresAt, fileID)
+		if err != nil {
+			return fmt.Errorf("failed to set the expiry time of the file: %v", err)
+		}
+		return nil
+	})
+}
+
+// ExpireFiles removes the files of all users, including the ones in the
+// trash, whose expiry time has passed and returns the number of files
+// removed. Expired files skip the trash so that their space is reclaimed.
+func (s *Storage) ExpireFiles(now time.Time) (int, error) {
+	defer s.timeOperation("ExpireFiles", NoUserID)()
+
+	var removed int
+	err := s.transact(func(tx *sql.Tx) error {
+		rows, err := tx.Query(getExpiredFiles, now.Unix())
+		if err != nil {
+			return fmt.Errorf("failed to get the expired files from the database: %v", err)
+		}
+		type expired struct{ fileID, userID int }
+		var files []expired
+		for rows.Next() {
+			var f expired
+			err = rows.Scan(&f.fileID, &f.userID)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan the next row while processing the expired files: %v", err)
+			}
+			files = append(files, f)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to scan all of the expired files: %v", err)
+		}
+
+		for _, f := range files {
+			err = s.purgeFile(tx, f.userID, f.fileID)
+			if err != nil {
+				return err
+			}
+		}
+		removed = len(files)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
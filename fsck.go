@@ -0,0 +1,470 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// The kinds of inconsistencies found by Storage.Fsck.
+const (
+	// FsckOrphanFile is a file that belongs to a user that doesn't exist.
+	FsckOrphanFile = "orphan file"
+
+	// FsckOrphanVersion is a file version of a file that doesn't exist.
+	FsckOrphanVersion = "orphan version"
+
+	// FsckOrphanChunks are chunks of a file or file version that doesn't exist.
+	FsckOrphanChunks = "orphan chunks"
+
+	// FsckMissingCurrentVersion is a file whose current version doesn't exist.
+	FsckMissingCurrentVersion = "missing current version"
+
+	// FsckOrphanStats are the usage statistics of a user that doesn't exist.
+	FsckOrphanStats = "orphan stats"
+
+	// FsckMissingStats is a user without usage statistics.
+	FsckMissingStats = "missing stats"
+
+	// FsckWrongAllocation is a user whose allocated byte count doesn't
+	// match the size of the user's chunks.
+	FsckWrongAllocation = "wrong allocation"
+
+	// FsckMissingChunks is a file version without all of its chunks. Files
+	// that are still being uploaded have missing chunks too.
+	FsckMissingChunks = "missing chunks"
+
+	// FsckBadChunk is a chunk that has no data or hash or whose chunk number
+	// is outside of its file version.
+	FsckBadChunk = "bad chunk"
+
+	// FsckWrongRefCount is shared chunk data whose reference count doesn't
+	// match the number of chunks referring to it, or that no chunk refers
+	// to anymore.
+	FsckWrongRefCount = "wrong reference count"
+
+	// FsckWrongDeduplicated is a user whose count of the bytes saved by
+	// sharing chunk data doesn't match the chunks referring to the data.
+	FsckWrongDeduplicated = "wrong deduplicated bytes"
+)
+
+const (
+	fsckGetOrphanFiles = `SELECT FileID, UserID FROM FileInfo WHERE UserID NOT IN (SELECT UserID FROM Users);`
+	fsckRemoveFile     = `DELETE FROM FileVersion WHERE FileID = ?;
+		DELETE FROM FileInfo WHERE FileID = ?;`
+
+	fsckGetOrphanVersions = `SELECT VersionID, FileID FROM FileVersion WHERE FileID NOT IN (SELECT FileID FROM FileInfo);`
+	fsckRemoveVersion     = `DELETE FROM FileVersion WHERE VersionID = ?;`
+
+	fsckGetOrphanChunks = `SELECT FileChunks.FileID, FileChunks.VersionID, COUNT(*), SUM(FileChunks.ChunkSize) FROM FileChunks
+					LEFT JOIN FileVersion ON FileChunks.VersionID = FileVersion.VersionID AND FileChunks.FileID = FileVersion.FileID
+					WHERE FileVersion.VersionID IS NULL OR FileChunks.FileID NOT IN (SELECT FileID FROM FileInfo)
+					GROUP BY FileChunks.FileID, FileChunks.VersionID;`
+	fsckRemoveChunks = `DELETE FROM FileChunks WHERE FileID = ? AND VersionID = ?;`
+
+	fsckGetMissingCurrentVersions = `SELECT FileInfo.FileID, FileInfo.UserID FROM FileInfo
+					LEFT JOIN FileVersion ON FileInfo.CurrentVersionID = FileVersion.VersionID AND FileInfo.FileID = FileVersion.FileID
+					WHERE FileVersion.VersionID IS NULL;`
+	fsckGetLatestVersion = `SELECT VersionID FROM FileVersion WHERE FileID = ? ORDER BY VersionNum DESC LIMIT 1;`
+
+	fsckGetOrphanStats = `SELECT UserID FROM UserStats WHERE UserID NOT IN (SELECT UserID FROM Users);`
+	fsckRemoveStats    = `DELETE FROM UserStats WHERE UserID = ?;`
+
+	fsckGetMissingStats = `SELECT UserID FROM Users WHERE UserID NOT IN (SELECT UserID FROM UserStats);`
+
+	fsckGetAllocations = `SELECT UserStats.UserID, UserStats.Allocated,
+					IFNULL((SELECT SUM(FileChunks.ChunkSize) FROM FileChunks INNER JOIN FileInfo ON FileChunks.FileID = FileInfo.FileID
+						WHERE FileInfo.UserID = UserStats.UserID), 0)
+					FROM UserStats ORDER BY UserStats.UserID;`
+	fsckSetAllocation = `UPDATE UserStats SET Allocated = ? WHERE UserID = ?;`
+
+	fsckGetChunkDataRefs = `SELECT ChunkDataID, UserID, RefCount, Refs, UserRefs FROM (SELECT ChunkDataID, UserID, RefCount,
+						(SELECT COUNT(*) FROM FileChunks WHERE FileChunks.ChunkDataID = ChunkData.ChunkDataID) AS Refs,
+						(SELECT IFNULL(SUM(ChunkDataRefs.RefCount), 0) FROM ChunkDataRefs WHERE ChunkDataRefs.ChunkDataID = ChunkData.ChunkDataID) AS UserRefs
+						FROM ChunkData) AS Counted
+					WHERE RefCount <> Refs OR UserRefs <> Refs OR Refs = 0 ORDER BY ChunkDataID;`
+
+	fsckGetDeduplicated = `SELECT UserStats.UserID, UserStats.Deduplicated,
+					IFNULL((SELECT SUM((ChunkDataRefs.RefCount - 1) * ChunkData.ChunkSize) FROM ChunkDataRefs
+						INNER JOIN ChunkData ON ChunkDataRefs.ChunkDataID = ChunkData.ChunkDataID
+						WHERE ChunkDataRefs.UserID = UserStats.UserID), 0)
+					FROM UserStats ORDER BY UserStats.UserID;`
+	fsckSetDeduplicated = `UPDATE UserStats SET Deduplicated = ? WHERE UserID = ?;`
+
+	scrubGetMissingChunks = `SELECT FileVersion.FileID, FileInfo.UserID, FileVersion.VersionID, FileVersion.ChunkCount, COUNT(DISTINCT FileChunks.ChunkNum) FROM FileVersion
+					INNER JOIN FileInfo ON FileVersion.FileID = FileInfo.FileID
+					LEFT JOIN FileChunks ON FileChunks.VersionID = FileVersion.VersionID AND FileChunks.FileID = FileVersion.FileID
+						AND FileChunks.ChunkNum >= 0 AND FileChunks.ChunkNum < FileVersion.ChunkCount
+					WHERE FileInfo.IsDir = 0
+					GROUP BY FileVersion.VersionID
+					HAVING COUNT(DISTINCT FileChunks.ChunkNum) <> FileVersion.ChunkCount;`
+	scrubGetBadChunks = `SELECT FileChunks.FileID, FileInfo.UserID, FileChunks.VersionID, FileChunks.ChunkNum FROM FileChunks
+					INNER JOIN FileInfo ON FileChunks.FileID = FileInfo.FileID
+					INNER JOIN FileVersion ON FileChunks.VersionID = FileVersion.VersionID AND FileChunks.FileID = FileVersion.FileID
+					WHERE FileChunks.ChunkNum < 0 OR FileChunks.ChunkNum >= FileVersion.ChunkCount
+						OR FileChunks.ChunkSize = 0 OR FileChunks.ChunkHash = ''
+						OR (FileChunks.ChunkDataID <> 0 AND FileChunks.ChunkDataID NOT IN (SELECT ChunkDataID FROM ChunkData));`
+)
+
+// FsckProblem is an inconsistency between the tables of Storage found by
+// Fsck. The ids that don't apply to the kind of problem are zero.
+type FsckProblem struct {
+	Kind      string // one of the Fsck* constants
+	UserID    int
+	FileID    int
+	VersionID int
+	Detail    string
+}
+
+// String describes the problem on one line.
+func (p FsckProblem) String() string {
+	return fmt.Sprintf("%s (user %d, file %d, version %d): %s", p.Kind, p.UserID, p.FileID, p.VersionID, p.Detail)
+}
+
+// Fsck cross-checks the users, their usage statistics, files, file versions,
+// file chunks and shared chunk data and returns the inconsistencies it finds,
+// such as chunks without a file version or allocated byte counts that don't
+// match the size of a user's chunks. If repair is set, every problem is also
+// fixed: data that doesn't belong to anything is removed, files whose current
+// version is missing fall back to their latest remaining version (or are
+// removed if there isn't one), missing usage statistics are created with a
+// zero quota and the allocated byte counts, chunk data reference counts and
+// deduplicated byte counts are recalculated. The checks and repairs run in
+// one transaction so the report matches the state that was repaired.
+func (s *Storage) Fsck(repair bool) ([]FsckProblem, error) {
+	defer s.timeOperation("Fsck", NoUserID)()
+
+	var problems []FsckProblem
+	err := s.transact(func(tx *sql.Tx) error {
+		// the checks run in this order so that repairing a problem
+		// doesn't leave behind one that was already checked for
+		checks := []func(*sql.Tx, bool) ([]FsckProblem, error){
+			fsckOrphanFiles,
+			fsckMissingCurrentVersions,
+			fsckOrphanVersions,
+			fsckOrphanChunks,
+			fsckOrphanStats,
+			fsckMissingStats,
+			fsckAllocations,
+			fsckChunkDataRefs,
+			fsckDeduplicated,
+		}
+		for _, check := range checks {
+			found, err := check(tx, repair)
+			if err != nil {
+				return err
+			}
+			problems = append(problems, found...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return problems, nil
+}
+
+// fsckQueryIDs runs a query returning rows of integer ids and returns them.
+func fsckQueryIDs(tx *sql.Tx, query string, columns int) ([][]int64, error) {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result [][]int64
+	for rows.Next() {
+		row := make([]int64, columns)
+		dest := make([]interface{}, columns)
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// fsckOrphanFiles finds the files of users that don't exist and removes them
+// along with their versions and chunks when repairing.
+func fsckOrphanFiles(tx *sql.Tx, repair bool) ([]FsckProblem, error) {
+	rows, err := fsckQueryIDs(tx, fsckGetOrphanFiles, 2)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for orphan files: %v", err)
+	}
+
+	var problems []FsckProblem
+	for _, r := range rows {
+		problems = append(problems, FsckProblem{Kind: FsckOrphanFile, FileID: int(r[0]), UserID: int(r[1]),
+			Detail: "the file belongs to a user that doesn't exist"})
+		if repair {
+			err = fsckRemoveFileAndChunks(tx, r[0])
+			if err != nil {
+				return nil, fmt.Errorf("failed to remove the orphan file %d: %v", r[0], err)
+			}
+		}
+	}
+	return problems, nil
+}
+
+// fsckRemoveFileAndChunks removes the file with its versions and chunks and
+// releases the chunk data the chunks referred to.
+func fsckRemoveFileAndChunks(tx *sql.Tx, fileID int64) error {
+	_, err := execReleasingChunkData(tx, removeAllFileChunks, getChunkDataIDsOfFile, fileID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(fsckRemoveFile, fileID, fileID)
+	return err
+}
+
+// fsckMissingCurrentVersions finds the files whose current version doesn't
+// exist and points them at their latest version when repairing.
+func fsckMissingCurrentVersions(tx *sql.Tx, repair bool) ([]FsckProblem, error) {
+	rows, err := fsckQueryIDs(tx, fsckGetMissingCurrentVersions, 2)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for missing current versions: %v", err)
+	}
+
+	var problems []FsckProblem
+	for _, r := range rows {
+		problem := FsckProblem{Kind: FsckMissingCurrentVersion, FileID: int(r[0]), UserID: int(r[1]),
+			Detail: "the current version of the file doesn't exist"}
+		if repair {
+			var versionID int
+			err = tx.QueryRow(fsckGetLatestVersion, r[0]).Scan(&versionID)
+			switch {
+			case err == sql.ErrNoRows:
+				problem.Detail += "; the file has no versions left and was removed"
+				err = fsckRemoveFileAndChunks(tx, r[0])
+			case err == nil:
+				problem.Detail += fmt.Sprintf("; version %d is now the current version", versionID)
+				_, err = tx.Exec(setFileCurrentVersion, versionID, r[0])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to repair the current version of file %d: %v", r[0], err)
+			}
+		}
+		problems = append(problems, problem)
+	}
+	return problems, nil
+}
+
+// fsckOrphanVersions finds the versions of files that don't exist and
+// removes them when repairing.
+func fsckOrphanVersions(tx *sql.Tx, repair bool) ([]FsckProblem, error) {
+	rows, err := fsckQueryIDs(tx, fsckGetOrphanVersions, 2)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for orphan versions: %v", err)
+	}
+
+	var problems []FsckProblem
+	for _, r := range rows {
+		problems = append(problems, FsckProblem{Kind: FsckOrphanVersion, VersionID: int(r[0]), FileID: int(r[1]),
+			Detail: "the version belongs to a file that doesn't exist"})
+		if repair {
+			_, err = tx.Exec(fsckRemoveVersion, r[0])
+			if err != nil {
+				return nil, fmt.Errorf("failed to remove the orphan version %d: %v", r[0], err)
+			}
+		}
+	}
+	return problems, nil
+}
+
+// fsckOrphanChunks finds the chunks of files or file versions that don't exist and
+// removes them when repairing.
+func fsckOrphanChunks(tx *sql.Tx, repair bool) ([]FsckProblem, error) {
+	rows, err := fsckQueryIDs(tx, fsckGetOrphanChunks, 4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for orphan chunks: %v", err)
+	}
+
+	var problems []FsckProblem
+	for _, r := range rows {
+		problems = append(problems, FsckProblem{Kind: FsckOrphanChunks, FileID: int(r[0]), VersionID: int(r[1]),
+			Detail: fmt.Sprintf("%d chunks (%d bytes) belong to a file or file version that doesn't exist", r[2], r[3])})
+		if repair {
+			_, err = execReleasingChunkData(tx, fsckRemoveChunks, getChunkDataIDsOfVersion, r[0], r[1])
+			if err != nil {
+				return nil, fmt.Errorf("failed to remove the orphan chunks of file %d version %d: %v", r[0], r[1], err)
+			}
+		}
+	}
+	return problems, nil
+}
+
+// fsckOrphanStats finds the usage statistics of users that don't exist and
+// removes them when repairing.
+func fsckOrphanStats(tx *sql.Tx, repair bool) ([]FsckProblem, error) {
+	rows, err := fsckQueryIDs(tx, fsckGetOrphanStats, 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for orphan user stats: %v", err)
+	}
+
+	var problems []FsckProblem
+	for _, r := range rows {
+		problems = append(problems, FsckProblem{Kind: FsckOrphanStats, UserID: int(r[0]),
+			Detail: "the usage statistics belong to a user that doesn't exist"})
+		if repair {
+			_, err = tx.Exec(fsckRemoveStats, r[0])
+			if err != nil {
+				return nil, fmt.Errorf("failed to remove the orphan stats of user %d: %v", r[0], err)
+			}
+		}
+	}
+	return problems, nil
+}
+
+// fsckMissingStats finds the users without usage statistics and creates
+// them when repairing.
+func fsckMissingStats(tx *sql.Tx, repair bool) ([]FsckProblem, error) {
+	rows, err := fsckQueryIDs(tx, fsckGetMissingStats, 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for missing user stats: %v", err)
+	}
+
+	var problems []FsckProblem
+	for _, r := range rows {
+		problem := FsckProblem{Kind: FsckMissingStats, UserID: int(r[0]),
+			Detail: "the user has no usage statistics"}
+		if repair {
+			// the allocation gets recalculated by the next check
+			problem.Detail += "; they were created with a zero quota"
+			_, err = tx.Exec(setUserStats, r[0], 0, 0, 0)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create the stats of user %d: %v", r[0], err)
+			}
+		}
+		problems = append(problems, problem)
+	}
+	return problems, nil
+}
+
+// fsckAllocations compares the allocated byte count of every user with the
+// size of the user's chunks and corrects it when repairing.
+func fsckAllocations(tx *sql.Tx, repair bool) ([]FsckProblem, error) {
+	rows, err := fsckQueryIDs(tx, fsckGetAllocations, 3)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check the allocations: %v", err)
+	}
+
+	var problems []FsckProblem
+	for _, r := range rows {
+		if r[1] == r[2] {
+			continue
+		}
+		problems = append(problems, FsckProblem{Kind: FsckWrongAllocation, UserID: int(r[0]),
+			Detail: fmt.Sprintf("%d bytes are recorded as allocated but the chunks take %d bytes", r[1], r[2])})
+		if repair {
+			_, err = tx.Exec(fsckSetAllocation, r[2], r[0])
+			if err != nil {
+				return nil, fmt.Errorf("failed to set the allocation of user %d: %v", r[0], err)
+			}
+		}
+	}
+	return problems, nil
+}
+
+// fsckChunkDataRefs compares the reference count of the shared chunk data
+// with the chunks referring to it and counts them again when repairing,
+// which also removes the data no chunk refers to.
+func fsckChunkDataRefs(tx *sql.Tx, repair bool) ([]FsckProblem, error) {
+	rows, err := fsckQueryIDs(tx, fsckGetChunkDataRefs, 5)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check the chunk data reference counts: %v", err)
+	}
+
+	var problems []FsckProblem
+	for _, r := range rows {
+		problem := FsckProblem{Kind: FsckWrongRefCount, UserID: int(r[1]),
+			Detail: fmt.Sprintf("chunk data %d has a reference count of %d but %d chunks refer to it", r[0], r[2], r[3])}
+		if r[2] == r[3] && r[3] != 0 {
+			problem.Detail = fmt.Sprintf("chunk data %d has %d references counted by user but %d chunks refer to it", r[0], r[4], r[3])
+		}
+		if repair {
+			if r[3] == 0 {
+				problem.Detail += "; it was removed"
+			}
+			err = countChunkDataRefs(tx, []int64{r[0]})
+			if err != nil {
+				return nil, err
+			}
+		}
+		problems = append(problems, problem)
+	}
+	return problems, nil
+}
+
+// fsckDeduplicated compares the bytes every user saves by sharing chunk data
+// with the references of the user's chunks to the data and corrects them
+// when repairing.
+func fsckDeduplicated(tx *sql.Tx, repair bool) ([]FsckProblem, error) {
+	rows, err := fsckQueryIDs(tx, fsckGetDeduplicated, 3)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check the deduplicated bytes: %v", err)
+	}
+
+	var problems []FsckProblem
+	for _, r := range rows {
+		if r[1] == r[2] {
+			continue
+		}
+		problems = append(problems, FsckProblem{Kind: FsckWrongDeduplicated, UserID: int(r[0]),
+			Detail: fmt.Sprintf("%d bytes are recorded as deduplicated but the shared chunk data saves %d bytes", r[1], r[2])})
+		if repair {
+			_, err = tx.Exec(fsckSetDeduplicated, r[2], r[0])
+			if err != nil {
+				return nil, fmt.Errorf("failed to set the deduplicated bytes of user %d: %v", r[0], err)
+			}
+		}
+	}
+	return problems, nil
+}
+
+// Scrub reads through the file versions and chunks of every user and
+// returns the file versions that are missing chunks and the chunks that are
+// damaged. Chunks are hashed by clients before they are encrypted, so their
+// hashes can't be checked here; clients verify them on download. The files
+// of chunks kept in the ChunkStore are read to check that they're intact. Nothing
+// is changed since only the user's client can upload the chunks again.
+func (s *Storage) Scrub() ([]FsckProblem, error) {
+	defer s.timeOperation("Scrub", NoUserID)()
+
+	var problems []FsckProblem
+	err := s.transact(func(tx *sql.Tx) error {
+		rows, err := fsckQueryIDs(tx, scrubGetMissingChunks, 5)
+		if err != nil {
+			return fmt.Errorf("failed to check for missing chunks: %v", err)
+		}
+		for _, r := range rows {
+			problems = append(problems, FsckProblem{Kind: FsckMissingChunks, FileID: int(r[0]), UserID: int(r[1]), VersionID: int(r[2]),
+				Detail: fmt.Sprintf("the version has %d of its %d chunks", r[4], r[3])})
+		}
+
+		rows, err = fsckQueryIDs(tx, scrubGetBadChunks, 4)
+		if err != nil {
+			return fmt.Errorf("failed to check for bad chunks: %v", err)
+		}
+		for _, r := range rows {
+			problems = append(problems, FsckProblem{Kind: FsckBadChunk, FileID: int(r[0]), UserID: int(r[1]), VersionID: int(r[2]),
+				Detail: fmt.Sprintf("chunk %d is empty, has no hash, has lost its shared data or is outside of the version", r[3])})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	storeProblems, err := s.scrubChunkStore()
+	if err != nil {
+		return nil, err
+	}
+	return append(problems, storeProblems...), nil
+}
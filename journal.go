@@ -0,0 +1,678 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The kinds of metadata changes recorded in the journal.
+const (
+	// JournalFileAdded is a new file with its first version.
+	JournalFileAdded = "file added"
+
+	// JournalFileRemoved is a file removed with all of its versions.
+	JournalFileRemoved = "file removed"
+
+	// JournalFileRenamed is a file whose name changed.
+	JournalFileRenamed = "file renamed"
+
+	// JournalVersionsAdded is a new version that became the current version
+	// of a file.
+	JournalVersionsAdded = "versions added"
+
+	// JournalVersionsRemoved are old versions removed from a file.
+	JournalVersionsRemoved = "versions removed"
+
+	// JournalVersionUpdated is a version whose size, hash or Merkle root
+	// was filled in after it was added.
+	JournalVersionUpdated = "version updated"
+
+	// JournalFileTrashed is a file moved to the trash.
+	JournalFileTrashed = "file trashed"
+
+	// JournalFileRestored is a file restored from the trash.
+	JournalFileRestored = "file restored"
+
+	// JournalFileTransferred is a file that was given to another user.
+	JournalFileTransferred = "file transferred"
+)
+
+const (
+	createMetadataJournalTable = `CREATE TABLE IF NOT EXISTS MetadataJournal (
+        EntryID     INTEGER PRIMARY KEY AUTOINCREMENT,
+        Time        INTEGER             NOT NULL,
+        UserID      INTEGER             NOT NULL,
+        FileID      INTEGER             NOT NULL,
+        Action      TEXT                NOT NULL,
+        Details     TEXT                NOT NULL
+	);`
+
+	addJournalEntry       = `INSERT INTO MetadataJournal (Time, UserID, FileID, Action, Details) VALUES (?, ?, ?, ?, ?);`
+	copyJournalEntry      = `INSERT INTO MetadataJournal (EntryID, Time, UserID, FileID, Action, Details) VALUES (?, ?, ?, ?, ?, ?);`
+	selectJournalEntries  = `SELECT EntryID, Time, UserID, FileID, Action, Details FROM MetadataJournal`
+	getJournalSince       = selectJournalEntries + ` WHERE Time >= ? ORDER BY EntryID;`
+	getJournalAfterTime   = selectJournalEntries + ` WHERE Time > ? ORDER BY EntryID DESC;`
+	getJournalAfterEntry  = selectJournalEntries + ` WHERE EntryID > ? AND Time <= ? ORDER BY EntryID;`
+	getJournalEntryByID   = selectJournalEntries + ` WHERE EntryID = ?;`
+	getLastJournalEntryID = `SELECT IFNULL(MAX(EntryID), 0) FROM MetadataJournal;`
+
+	getVersionsInRangeForFile = `SELECT VersionID, VersionNum, Perms, LastMod, ChunkCount, FileHash, MerkleRoot, CreatedAt, Device FROM FileVersion
+					WHERE FileID = ? AND (VersionNum BETWEEN ? AND ?);`
+
+	journalAddFileInfo    = `INSERT INTO FileInfo (FileID, UserID, FileName, IsDir, CurrentVersionID, CreatedAt, Device) VALUES (?, ?, ?, ?, ?, ?, ?);`
+	journalAddFileVersion = `INSERT INTO FileVersion (VersionID, FileID, VersionNum, Perms, LastMod, ChunkCount, FileHash, MerkleRoot, CreatedAt, Device)
+					VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	journalSetFileVersion = `UPDATE FileVersion SET Perms = ?, LastMod = ?, ChunkCount = ?, FileHash = ?, MerkleRoot = ?, Device = ?
+					WHERE VersionID = ? AND FileID = ?;`
+	journalRemoveFileVersion = `DELETE FROM FileVersion WHERE VersionID = ? AND FileID = ?;`
+	journalRemoveChunks      = `DELETE FROM FileChunks WHERE FileID = ? AND VersionID = ?;`
+	journalHasFileVersion    = `SELECT COUNT(*) FROM FileVersion WHERE VersionID = ? AND FileID = ?;`
+	journalGetChunks         = `SELECT FileChunks.ChunkNum, FileChunks.ChunkHash, IFNULL(ChunkData.Chunk, FileChunks.Chunk), IFNULL(ChunkData.StoreKey, FileChunks.StoreKey) FROM FileChunks
+					LEFT JOIN ChunkData ON FileChunks.ChunkDataID = ChunkData.ChunkDataID
+					WHERE FileChunks.FileID = ? AND FileChunks.VersionID = ?;`
+	journalCopyChunk = `INSERT INTO FileChunks (FileID, VersionID, ChunkNum, ChunkHash, Chunk, ChunkSize, StoreKey) SELECT ?, ?, ?, ?, ?, ?, ?
+					WHERE NOT EXISTS (SELECT 1 FROM FileChunks WHERE FileID = ? AND VersionID = ? AND ChunkNum = ?);`
+	journalBumpRevision = `UPDATE UserStats SET Revision = Revision + 1 WHERE UserID = ?;`
+
+	// the chunks removed along with journaled versions, kept for
+	// JournalChunkRetention so that ReplayJournal can bring them back
+	createJournalChunksTable = `CREATE TABLE IF NOT EXISTS JournalChunks (
+        RemovedAt   INTEGER             NOT NULL,
+        FileID      INTEGER             NOT NULL,
+        VersionID   INTEGER             NOT NULL,
+        ChunkNum    INTEGER             NOT NULL,
+        ChunkHash   TEXT                NOT NULL,
+        Chunk       BLOB                NOT NULL,
+        ChunkSize   INTEGER             NOT NULL,
+        StoreKey    TEXT                NOT NULL DEFAULT ''
+	);`
+
+	keepJournalFileChunks = `INSERT INTO JournalChunks (RemovedAt, FileID, VersionID, ChunkNum, ChunkHash, Chunk, ChunkSize, StoreKey)
+					SELECT ?, FileChunks.FileID, FileChunks.VersionID, FileChunks.ChunkNum, FileChunks.ChunkHash, IFNULL(ChunkData.Chunk, FileChunks.Chunk),
+					FileChunks.ChunkSize, IFNULL(ChunkData.StoreKey, FileChunks.StoreKey) FROM FileChunks
+					LEFT JOIN ChunkData ON FileChunks.ChunkDataID = ChunkData.ChunkDataID
+					WHERE FileChunks.FileID = ?;`
+	keepJournalVersionChunks = `INSERT INTO JournalChunks (RemovedAt, FileID, VersionID, ChunkNum, ChunkHash, Chunk, ChunkSize, StoreKey)
+					SELECT ?, FileChunks.FileID, FileChunks.VersionID, FileChunks.ChunkNum, FileChunks.ChunkHash, IFNULL(ChunkData.Chunk, FileChunks.Chunk),
+					FileChunks.ChunkSize, IFNULL(ChunkData.StoreKey, FileChunks.StoreKey) FROM FileChunks
+					INNER JOIN FileVersion ON FileChunks.VersionID = FileVersion.VersionID
+					LEFT JOIN ChunkData ON FileChunks.ChunkDataID = ChunkData.ChunkDataID
+					WHERE FileChunks.FileID = ? AND (VersionNum BETWEEN ? AND ?);`
+	journalGetKeptChunks = `SELECT ChunkNum, ChunkHash, Chunk, StoreKey FROM JournalChunks
+					WHERE FileID = ? AND VersionID = ? ORDER BY RemovedAt DESC;`
+	pruneJournalChunks = `DELETE FROM JournalChunks WHERE RemovedAt < ?;`
+)
+
+// JournalEntry is one change to the file metadata of Storage as recorded in
+// the journal. Each entry holds the state that the change replaced as well
+// as the new state so that it can be undone. Only the metadata is recorded;
+// the chunks of removed versions are kept apart from the entries, and only
+// for Storage.JournalChunkRetention.
+type JournalEntry struct {
+	EntryID int       `json:"-"`
+	Time    time.Time `json:"-"`
+	UserID  int       `json:"-"`
+	FileID  int       `json:"-"`
+	Action  string    `json:"-"` // one of the Journal* constants
+
+	// FileName is the name of the file after the change and OldName is its
+	// name before a rename.
+	FileName string `json:",omitempty"`
+	OldName  string `json:",omitempty"`
+	IsDir    bool   `json:",omitempty"`
+
+	// OldUserID is the user that owned the file before a transfer.
+	OldUserID int `json:",omitempty"`
+
+	// Versions are the file versions added or removed, or the new state of
+	// an updated version; OldVersion is the state of an updated version
+	// before the change.
+	Versions   []FileVersionInfo `json:",omitempty"`
+	OldVersion *FileVersionInfo  `json:",omitempty"`
+
+	// CurrentVersionID is the current version of the file after the change
+	// and PreviousVersionID the one before it; zero if the file didn't exist.
+	CurrentVersionID  int `json:",omitempty"`
+	PreviousVersionID int `json:",omitempty"`
+}
+
+// String describes the entry on one line. File names are left out since
+// they are encrypted by the clients.
+func (e JournalEntry) String() string {
+	var detail string
+	switch e.Action {
+	case JournalFileAdded, JournalFileRemoved, JournalVersionsAdded, JournalVersionsRemoved:
+		nums := make([]int, len(e.Versions))
+		for i, v := range e.Versions {
+			nums[i] = v.VersionNumber
+		}
+		detail = fmt.Sprintf("versions %v", nums)
+	case JournalVersionUpdated:
+		if len(e.Versions) == 1 {
+			detail = fmt.Sprintf("version %d", e.Versions[0].VersionNumber)
+		}
+	}
+	return fmt.Sprintf("%d %s user %d file %d: %s %s", e.EntryID, e.Time.UTC().Format(time.RFC3339Nano), e.UserID, e.FileID, e.Action, detail)
+}
+
+// inverse returns the entry that undoes e.
+func (e JournalEntry) inverse() JournalEntry {
+	inv := e
+	inv.EntryID = 0
+	inv.Time = time.Time{}
+	inv.CurrentVersionID, inv.PreviousVersionID = e.PreviousVersionID, e.CurrentVersionID
+	switch e.Action {
+	case JournalFileAdded:
+		inv.Action = JournalFileRemoved
+	case JournalFileRemoved:
+		inv.Action = JournalFileAdded
+	case JournalFileRenamed:
+		inv.FileName, inv.OldName = e.OldName, e.FileName
+	case JournalFileTransferred:
+		inv.UserID, inv.OldUserID = e.OldUserID, e.UserID
+	case JournalVersionsAdded:
+		inv.Action = JournalVersionsRemoved
+	case JournalVersionsRemoved:
+		inv.Action = JournalVersionsAdded
+	case JournalFileTrashed:
+		inv.Action = JournalFileRestored
+	case JournalFileRestored:
+		inv.Action = JournalFileTrashed
+	case JournalVersionUpdated:
+		if e.OldVersion != nil && len(e.Versions) == 1 {
+			newVersion := e.Versions[0]
+			inv.Versions = []FileVersionInfo{*e.OldVersion}
+			inv.OldVersion = &newVersion
+		}
+	}
+	return inv
+}
+
+// journal appends an entry to the journal within the transaction that makes
+// the change. The entry's time is set to now if it isn't set already.
+func journal(tx *sql.Tx, e JournalEntry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	details, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode the journal entry: %v", err)
+	}
+	_, err = tx.Exec(addJournalEntry, e.Time.UnixNano(), e.UserID, e.FileID, e.Action, string(details))
+	if err != nil {
+		return fmt.Errorf("failed to add an entry to the metadata journal: %v", err)
+	}
+	return nil
+}
+
+// journalGetVersion returns the file version identified by versionID so
+// that its state can be journaled.
+func journalGetVersion(tx *sql.Tx, versionID int) (FileVersionInfo, error) {
+	v := FileVersionInfo{VersionID: versionID}
+	err := tx.QueryRow(getFileVersionByID, versionID).Scan(&v.VersionNumber, &v.Permissions, &v.LastMod, &v.ChunkCount, &v.FileHash, &v.MerkleRoot, &v.CreatedAt, &v.Device)
+	return v, err
+}
+
+// journalGetVersions returns the file versions selected by query so that
+// they can be journaled before they are removed.
+func journalGetVersions(tx *sql.Tx, query string, args ...interface{}) ([]FileVersionInfo, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []FileVersionInfo
+	for rows.Next() {
+		var v FileVersionInfo
+		err = rows.Scan(&v.VersionID, &v.VersionNumber, &v.Permissions, &v.LastMod, &v.ChunkCount, &v.FileHash, &v.MerkleRoot, &v.CreatedAt, &v.Device)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// scanJournalEntries reads the entries returned by one of the journal queries.
+func scanJournalEntries(rows *sql.Rows) ([]JournalEntry, error) {
+	defer rows.Close()
+
+	var entries []JournalEntry
+	for rows.Next() {
+		var e JournalEntry
+		var t int64
+		var details string
+		err := rows.Scan(&e.EntryID, &t, &e.UserID, &e.FileID, &e.Action, &details)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing the metadata journal: %v", err)
+		}
+		err = json.Unmarshal([]byte(details), &e)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode the metadata journal entry %d: %v", e.EntryID, err)
+		}
+		e.Time = time.Unix(0, t)
+		entries = append(entries, e)
+	}
+	err := rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the metadata journal: %v", err)
+	}
+	return entries, nil
+}
+
+// GetJournal returns the metadata journal entries recorded at or after
+// since, oldest first.
+func (s *Storage) GetJournal(since time.Time) ([]JournalEntry, error) {
+	defer s.timeOperation("GetJournal", NoUserID)()
+
+	rows, err := s.db.Query(getJournalSince, since.UnixNano())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the metadata journal: %v", err)
+	}
+	return scanJournalEntries(rows)
+}
+
+// RollbackJournal undoes every metadata change recorded after until, newest
+// first, so that the files and versions listed are the ones there were at
+// that time. This is meant for recovering from an accidental mass delete.
+// The undo of each change is recorded in the journal as well, so a rollback
+// can itself be rolled back. Since the journal doesn't keep chunks, the
+// versions brought back by undoing a removal have no chunks; clients upload
+// them again when they sync, or they can be recovered with ReplayJournal
+// from a backup. The allocated byte counts are recalculated and the
+// revision of every affected user is bumped so that clients notice the
+// change. The number of changes undone is returned.
+func (s *Storage) RollbackJournal(until time.Time) (int, error) {
+	defer s.timeOperation("RollbackJournal", NoUserID)()
+
+	undone := 0
+	err := s.transact(func(tx *sql.Tx) error {
+		rows, err := tx.Query(getJournalAfterTime, until.UnixNano())
+		if err != nil {
+			return fmt.Errorf("failed to get the metadata journal: %v", err)
+		}
+		entries, err := scanJournalEntries(rows)
+		if err != nil {
+			return err
+		}
+
+		users := make(map[int]bool)
+		for _, e := range entries {
+			inv := e.inverse()
+			err = applyJournalEntry(tx, inv)
+			if err != nil {
+				return fmt.Errorf("failed to undo the metadata journal entry %d: %v", e.EntryID, err)
+			}
+			err = journal(tx, inv)
+			if err != nil {
+				return err
+			}
+			users[e.UserID] = true
+			if e.OldUserID != 0 {
+				users[e.OldUserID] = true
+			}
+			undone++
+		}
+
+		return finishJournalChanges(tx, users)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return undone, nil
+}
+
+// ReplayJournal applies the metadata changes recorded in the journal of
+// source, up to and including until, that are missing from this storage.
+// This brings a database restored from a backup forward to a point in time
+// from the journal of the live database, such as the moment before an
+// accidental mass delete; the journal of this storage must be the start of
+// the journal of source. Chunks of the replayed versions that source still
+// has, or kept after removing them for its JournalChunkRetention, are copied
+// over. The allocated byte counts are recalculated and the
+// revision of every affected user is bumped so that clients notice the
+// change. The number of changes replayed is returned.
+func (s *Storage) ReplayJournal(source *Storage, until time.Time) (int, error) {
+	defer s.timeOperation("ReplayJournal", NoUserID)()
+
+	replayed := 0
+	err := s.transact(func(tx *sql.Tx) error {
+		var lastEntryID int
+		err := tx.QueryRow(getLastJournalEntryID).Scan(&lastEntryID)
+		if err != nil {
+			return fmt.Errorf("failed to get the last metadata journal entry: %v", err)
+		}
+
+		// the last entry here must be in the source journal too, or the
+		// changes in the source were made to a different set of files
+		if lastEntryID > 0 {
+			rows, err := tx.Query(getJournalEntryByID, lastEntryID)
+			if err != nil {
+				return fmt.Errorf("failed to get the last metadata journal entry: %v", err)
+			}
+			local, err := scanJournalEntries(rows)
+			if err != nil {
+				return err
+			}
+			rows, err = source.db.Query(getJournalEntryByID, lastEntryID)
+			if err != nil {
+				return fmt.Errorf("failed to get the metadata journal of the source: %v", err)
+			}
+			remote, err := scanJournalEntries(rows)
+			if err != nil {
+				return err
+			}
+			if len(local) != 1 || len(remote) != 1 || !local[0].Time.Equal(remote[0].Time) || local[0].Action != remote[0].Action || local[0].FileID != remote[0].FileID {
+				return fmt.Errorf("the metadata journal of the source doesn't continue the journal of this database")
+			}
+		}
+
+		rows, err := source.db.Query(getJournalAfterEntry, lastEntryID, until.UnixNano())
+		if err != nil {
+			return fmt.Errorf("failed to get the metadata journal of the source: %v", err)
+		}
+		entries, err := scanJournalEntries(rows)
+		if err != nil {
+			return err
+		}
+
+		type fileVersion struct{ fileID, versionID int }
+		var touched []fileVersion
+		users := make(map[int]bool)
+		for _, e := range entries {
+			err = applyJournalEntry(tx, e)
+			if err != nil {
+				return fmt.Errorf("failed to replay the metadata journal entry %d: %v", e.EntryID, err)
+			}
+			details, err := json.Marshal(e)
+			if err != nil {
+				return fmt.Errorf("failed to encode the journal entry: %v", err)
+			}
+			_, err = tx.Exec(copyJournalEntry, e.EntryID, e.Time.UnixNano(), e.UserID, e.FileID, e.Action, string(details))
+			if err != nil {
+				return fmt.Errorf("failed to copy the metadata journal entry %d: %v", e.EntryID, err)
+			}
+			if e.Action != JournalFileRemoved && e.Action != JournalVersionsRemoved {
+				for _, v := range e.Versions {
+					touched = append(touched, fileVersion{e.FileID, v.VersionID})
+				}
+			}
+			users[e.UserID] = true
+			if e.OldUserID != 0 {
+				users[e.OldUserID] = true
+			}
+			replayed++
+		}
+
+		// copy the chunks of the versions that are still there after the replay
+		for _, fv := range touched {
+			var count int
+			err = tx.QueryRow(journalHasFileVersion, fv.versionID, fv.fileID).Scan(&count)
+			if err != nil {
+				return fmt.Errorf("failed to look up the file version %d: %v", fv.versionID, err)
+			}
+			if count == 0 {
+				continue
+			}
+			err = s.copyJournalChunks(tx, source, fv.fileID, fv.versionID)
+			if err != nil {
+				return err
+			}
+		}
+
+		return finishJournalChanges(tx, users)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return replayed, nil
+}
+
+// applyJournalEntry makes the change described by e to the file metadata.
+// Chunks of removed versions are removed too; the allocated byte counts are
+// left to finishJournalChanges.
+func applyJournalEntry(tx *sql.Tx, e JournalEntry) error {
+	switch e.Action {
+	case JournalFileAdded:
+		// the file was created along with its earliest version
+		var first FileVersionInfo
+		for _, v := range e.Versions {
+			if first.VersionNumber == 0 || v.VersionNumber < first.VersionNumber {
+				first = v
+			}
+		}
+		_, err := tx.Exec(journalAddFileInfo, e.FileID, e.UserID, e.FileName, e.IsDir, e.CurrentVersionID, first.CreatedAt, first.Device)
+		if err != nil {
+			return fmt.Errorf("failed to add the file info: %v", err)
+		}
+		return journalAddVersions(tx, e)
+
+	case JournalFileRemoved:
+		_, err := execReleasingChunkData(tx, removeAllFileChunks, getChunkDataIDsOfFile, e.FileID)
+		if err != nil {
+			return fmt.Errorf("failed to remove the file chunks: %v", err)
+		}
+		_, err = tx.Exec(removeAllFileVersionsByFileID, e.FileID)
+		if err != nil {
+			return fmt.Errorf("failed to remove the file versions: %v", err)
+		}
+		_, err = tx.Exec(removeFileInfoByID, e.FileID)
+		if err != nil {
+			return fmt.Errorf("failed to remove the file info: %v", err)
+		}
+		return nil
+
+	case JournalFileRenamed:
+		_, err := tx.Exec(renameFileInfo, e.FileName, e.FileID)
+		if err != nil {
+			return fmt.Errorf("failed to rename the file: %v", err)
+		}
+		return nil
+
+	case JournalFileTransferred:
+		_, err := tx.Exec(transferFileInfo, e.UserID, e.FileID)
+		if err != nil {
+			return fmt.Errorf("failed to transfer the file: %v", err)
+		}
+		ids, err := chunkDataIDs(tx, getChunkDataIDsOfFile, e.FileID)
+		if err != nil {
+			return err
+		}
+		return countChunkDataRefs(tx, ids)
+
+	case JournalFileTrashed, JournalFileRestored:
+		var trashedAt int64
+		if e.Action == JournalFileTrashed {
+			trashedAt = e.Time.Unix()
+			if e.Time.IsZero() {
+				trashedAt = time.Now().Unix()
+			}
+		}
+		_, err := tx.Exec(setFileTrashedAt, trashedAt, e.FileID)
+		if err != nil {
+			return fmt.Errorf("failed to set when the file was trashed: %v", err)
+		}
+		return nil
+
+	case JournalVersionsAdded:
+		err := journalAddVersions(tx, e)
+		if err != nil {
+			return err
+		}
+		return journalSetCurrentVersion(tx, e)
+
+	case JournalVersionsRemoved:
+		for _, v := range e.Versions {
+			_, err := execReleasingChunkData(tx, journalRemoveChunks, getChunkDataIDsOfVersion, e.FileID, v.VersionID)
+			if err != nil {
+				return fmt.Errorf("failed to remove the chunks of the file version %d: %v", v.VersionID, err)
+			}
+			_, err = tx.Exec(journalRemoveFileVersion, v.VersionID, e.FileID)
+			if err != nil {
+				return fmt.Errorf("failed to remove the file version %d: %v", v.VersionID, err)
+			}
+		}
+		return journalSetCurrentVersion(tx, e)
+
+	case JournalVersionUpdated:
+		for _, v := range e.Versions {
+			_, err := tx.Exec(journalSetFileVersion, v.Permissions, v.LastMod, v.ChunkCount, v.FileHash, v.MerkleRoot, v.Device, v.VersionID, e.FileID)
+			if err != nil {
+				return fmt.Errorf("failed to update the file version %d: %v", v.VersionID, err)
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown metadata journal action %q", e.Action)
+}
+
+// journalAddVersions adds the versions of e with their original ids.
+func journalAddVersions(tx *sql.Tx, e JournalEntry) error {
+	for _, v := range e.Versions {
+		_, err := tx.Exec(journalAddFileVersion, v.VersionID, e.FileID, v.VersionNumber, v.Permissions, v.LastMod, v.ChunkCount, v.FileHash, v.MerkleRoot, v.CreatedAt, v.Device)
+		if err != nil {
+			return fmt.Errorf("failed to add the file version %d: %v", v.VersionID, err)
+		}
+	}
+	return nil
+}
+
+// journalSetCurrentVersion makes the current version of the file of e the
+// one it had after the change.
+func journalSetCurrentVersion(tx *sql.Tx, e JournalEntry) error {
+	if e.CurrentVersionID == 0 {
+		return nil
+	}
+	_, err := tx.Exec(setFileCurrentVersion, e.CurrentVersionID, e.FileID)
+	if err != nil {
+		return fmt.Errorf("failed to set the current file version: %v", err)
+	}
+	return nil
+}
+
+// copyJournalChunks copies the chunks of a file version from source that
+// the file version doesn't have here, taking the ones source removed from
+// the chunks it kept for the journal. The chunk data is read from the chunk
+// store of source and written to the one here if they have them.
+func (s *Storage) copyJournalChunks(tx *sql.Tx, source *Storage, fileID int, versionID int) error {
+	for _, query := range []string{journalGetChunks, journalGetKeptChunks} {
+		err := s.copyJournalChunksFrom(tx, source, query, fileID, versionID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyJournalChunksFrom copies the chunks of a file version that query
+// selects from source, newest first, unless the file version has them.
+func (s *Storage) copyJournalChunksFrom(tx *sql.Tx, source *Storage, query string, fileID int, versionID int) error {
+	rows, err := source.db.Query(query, fileID, versionID)
+	if err != nil {
+		return fmt.Errorf("failed to get the chunks of the file version %d from the source: %v", versionID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var chunkNum int
+		var chunkHash string
+		var chunk []byte
+		var storeKey string
+		err = rows.Scan(&chunkNum, &chunkHash, &chunk, &storeKey)
+		if err != nil {
+			return fmt.Errorf("failed to scan the next chunk of the file version %d from the source: %v", versionID, err)
+		}
+		chunk, err = source.loadChunk(chunk, storeKey)
+		if err != nil {
+			return fmt.Errorf("failed to read the chunk %d of the file version %d from the source: %v", chunkNum, versionID, err)
+		}
+		data, storeKey, err := s.storeChunk(chunk)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(journalCopyChunk, fileID, versionID, chunkNum, chunkHash, data, len(chunk), storeKey, fileID, versionID, chunkNum)
+		if err != nil {
+			return fmt.Errorf("failed to copy the chunk %d of the file version %d: %v", chunkNum, versionID, err)
+		}
+	}
+	return rows.Err()
+}
+
+// keepJournalChunks keeps a copy of the chunks that query selects, one of
+// the keepJournal*Chunks statements with args, before they are removed
+// along with journaled versions, if JournalChunkRetention is set.
+func (s *Storage) keepJournalChunks(tx *sql.Tx, query string, args ...interface{}) error {
+	if s.JournalChunkRetention <= 0 {
+		return nil
+	}
+	_, err := tx.Exec(query, append([]interface{}{time.Now().Unix()}, args...)...)
+	if err != nil {
+		return fmt.Errorf("failed to keep the removed chunks for the metadata journal: %v", err)
+	}
+	return nil
+}
+
+// PruneJournalChunks removes the chunks kept for the journal that were
+// removed longer than JournalChunkRetention ago, or all of them if it isn't
+// set, and returns how many were removed. The files of the chunks in the
+// ChunkStore are left to SweepChunkStore.
+func (s *Storage) PruneJournalChunks(now time.Time) (int, error) {
+	defer s.timeOperation("PruneJournalChunks", NoUserID)()
+
+	cutoff := now.Unix() + 1
+	if s.JournalChunkRetention > 0 {
+		cutoff = now.Add(-s.JournalChunkRetention).Unix()
+	}
+	res, err := s.db.Exec(pruneJournalChunks, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune the chunks kept for the metadata journal: %v", err)
+	}
+	pruned, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune the chunks kept for the metadata journal: %v", err)
+	}
+	return int(pruned), nil
+}
+
+// finishJournalChanges recalculates the allocated byte counts after chunks
+// were removed or copied by undoing or replaying the journal and bumps the
+// revision of the users whose files changed.
+func finishJournalChanges(tx *sql.Tx, users map[int]bool) error {
+	_, err := fsckAllocations(tx, true)
+	if err != nil {
+		return err
+	}
+	for userID := range users {
+		_, err = tx.Exec(journalBumpRevision, userID)
+		if err != nil {
+			return fmt.Errorf("failed to update the revision of user %d: %v", userID, err)
+		}
+	}
+	return nil
+}
+
+// journalVersionUpdate records the change of a file version from oldVersion
+// to its state now.
+func journalVersionUpdate(tx *sql.Tx, userID int, fileID int, oldVersion FileVersionInfo) error {
+	newVersion, err := journalGetVersion(tx, oldVersion.VersionID)
+	if err != nil {
+		return fmt.Errorf("failed to get the updated file version (%d) from the database: %v", oldVersion.VersionID, err)
+	}
+	var currentVersionID int
+	err = tx.QueryRow(getFileCurrentVersionID, fileID).Scan(&currentVersionID)
+	if err != nil {
+		return fmt.Errorf("failed to get the current version of the file: %v", err)
+	}
+	return journal(tx, JournalEntry{UserID: userID, FileID: fileID, Action: JournalVersionUpdated,
+		Versions: []FileVersionInfo{newVersion}, OldVersion: &oldVersion,
+		CurrentVersionID: currentVersionID, PreviousVersionID: currentVersionID})
+}
@@ -0,0 +1,261 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// ErrLegacyDatabase is returned by CreateTables for a database written
+// before files had versions, which has to be converted with
+// MigrateLegacyTables first.
+var ErrLegacyDatabase = fmt.Errorf("the database predates file versions; run freezer migrate-legacy to upgrade it")
+
+// legacyDBVersion is the database version the legacy tables are converted
+// to; the regular upgrades take them from there to CurrentDBVersion.
+const legacyDBVersion = 1
+
+const (
+	legacyGetColumns = `PRAGMA table_info(%s);`
+
+	legacyRenameFileInfo   = `ALTER TABLE FileInfo RENAME TO LegacyFileInfo;`
+	legacyRenameFileChunks = `ALTER TABLE FileChunks RENAME TO LegacyFileChunks;`
+	legacyAddCryptoHash    = `ALTER TABLE Users ADD COLUMN CryptoHash BLOB;`
+
+	// the file tables as they were at legacyDBVersion
+	legacyCreateFileInfoTable = `CREATE TABLE FileInfo (
+        FileID 	          INTEGER PRIMARY KEY  NOT NULL,
+        UserID 		      INTEGER              NOT NULL,
+        FileName	      TEXT                 NOT NULL,
+        IsDir             INTEGER              NOT NULL,
+        CurrentVersionID  INTEGER              NOT NULL
+      );`
+	legacyCreateFileVersionTable = `CREATE TABLE FileVersion (
+        VersionID   INTEGER PRIMARY KEY	NOT NULL,
+        FileID 	    INTEGER 			NOT NULL,
+        VersionNum 	INTEGER 			NOT NULL,
+        Perms       INTEGER             NOT NULL,
+        LastMod		INTEGER				NOT NULL,
+        ChunkCount  INTEGER				NOT NULL,
+        FileHash	TEXT				NOT NULL
+    );`
+	legacyCreateFileChunksTable = `CREATE TABLE FileChunks (
+        ChunkID     INTEGER PRIMARY KEY	NOT NULL,
+        FileID 		INTEGER             NOT NULL,
+        VersionID   INTEGER             NOT NULL,
+        ChunkNum	INTEGER 			NOT NULL,
+        ChunkHash	TEXT				NOT NULL,
+        Chunk		BLOB				NOT NULL
+	);`
+
+	// every legacy file becomes a file with one version whose id is the
+	// file id, and every chunk moves to the current version of its file;
+	// chunks of files that don't exist keep a version id of 0 for fsck
+	legacyDropFileVersion = `DROP TABLE IF EXISTS FileVersion;`
+	legacyCopyFiles       = `INSERT INTO FileInfo (FileID, UserID, FileName, IsDir, CurrentVersionID) SELECT FileID, UserID, FileName, IsDir, FileID FROM LegacyFileInfo;`
+	legacyCopyVersions    = `INSERT INTO FileVersion (VersionID, FileID, VersionNum, Perms, LastMod, ChunkCount, FileHash)
+					SELECT FileID, FileID, 1, Perms, LastMod, ChunkCount, FileHash FROM LegacyFileInfo;`
+	legacyCopyChunks = `INSERT INTO FileChunks (FileID, VersionID, ChunkNum, ChunkHash, Chunk)
+					SELECT LegacyFileChunks.FileID, IFNULL(FileInfo.CurrentVersionID, 0), ChunkNum, ChunkHash, Chunk
+					FROM LegacyFileChunks LEFT JOIN FileInfo ON LegacyFileChunks.FileID = FileInfo.FileID
+					ORDER BY LegacyFileChunks.FileID, ChunkNum;`
+	legacyCountFiles     = `SELECT COUNT(*) FROM FileInfo;`
+	legacyCountChunks    = `SELECT COUNT(*) FROM FileChunks;`
+	legacyDropFileInfo   = `DROP TABLE LegacyFileInfo;`
+	legacyDropChunks     = `DROP TABLE LegacyFileChunks;`
+	legacyClearDBVersion = `DELETE FROM AppData;`
+)
+
+// legacyFileInfoColumns are the columns a FileInfo table from before file
+// versions needs to be converted.
+var legacyFileInfoColumns = []string{"FileID", "UserID", "FileName", "IsDir", "Perms", "LastMod", "ChunkCount", "FileHash"}
+
+// LegacyMigration counts what MigrateLegacyTables converted.
+type LegacyMigration struct {
+	Files  int
+	Chunks int
+}
+
+// tableColumns returns the set of column names of a table, which is empty if
+// the table doesn't exist.
+func tableColumns(q interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}, table string) (map[string]bool, error) {
+	rows, err := q.Query(fmt.Sprintf(legacyGetColumns, table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the columns of the %s table: %v", table, err)
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		err = rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the columns of the %s table: %v", table, err)
+		}
+		columns[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get the columns of the %s table: %v", table, err)
+	}
+	return columns, nil
+}
+
+// IsLegacyDatabase returns true if the database was written before files had
+// versions: its FileInfo table has no CurrentVersionID column or its
+// FileChunks table has no VersionID column. A database without tables
+// isn't a legacy one, and neither is a PostgreSQL or MySQL database since
+// those were only supported after files had versions.
+func (s *Storage) IsLegacyDatabase() (bool, error) {
+	defer s.timeOperation("IsLegacyDatabase", NoUserID)()
+
+	if _, ok := s.provider.(SQLiteProvider); !ok {
+		return false, nil
+	}
+
+	fileColumns, err := tableColumns(s.db, "FileInfo")
+	if err != nil {
+		return false, err
+	}
+	chunkColumns, err := tableColumns(s.db, "FileChunks")
+	if err != nil {
+		return false, err
+	}
+	return (len(fileColumns) > 0 && !fileColumns["CurrentVersionID"]) ||
+		(len(chunkColumns) > 0 && !chunkColumns["VersionID"]), nil
+}
+
+// MigrateLegacyTables converts the tables of a database written before files
+// had versions to the layout of the first versioned database within one
+// transaction. Each file becomes a file with a single version holding its
+// permissions, modification time and hash, and its chunks are moved to that
+// version; users, quotas and allocations are kept as they are. CreateTables
+// then upgrades the tables to CurrentDBVersion. Nothing is done for a
+// database that isn't a legacy one.
+func (s *Storage) MigrateLegacyTables() (LegacyMigration, error) {
+	defer s.timeOperation("MigrateLegacyTables", NoUserID)()
+
+	var counts LegacyMigration
+	legacy, err := s.IsLegacyDatabase()
+	if err != nil || !legacy {
+		return counts, err
+	}
+
+	err = s.transact(func(tx *sql.Tx) error {
+		userColumns, err := tableColumns(tx, "Users")
+		if err != nil {
+			return err
+		}
+		if len(userColumns) > 0 && !userColumns["CryptoHash"] {
+			_, err = tx.Exec(legacyAddCryptoHash)
+			if err != nil {
+				return fmt.Errorf("failed to add the CryptoHash column to the Users table: %v", err)
+			}
+		}
+
+		// files without versions are converted to files with one version
+		// while files that already have them only need their chunks moved
+		fileColumns, err := tableColumns(tx, "FileInfo")
+		if err != nil {
+			return err
+		}
+		if !fileColumns["CurrentVersionID"] {
+			var missing []string
+			for _, column := range legacyFileInfoColumns {
+				if !fileColumns[column] {
+					missing = append(missing, column)
+				}
+			}
+			if len(missing) > 0 {
+				return fmt.Errorf("failed to recognize the legacy FileInfo table; it has no %s column", strings.Join(missing, ", "))
+			}
+
+			_, err = tx.Exec(legacyRenameFileInfo)
+			if err != nil {
+				return fmt.Errorf("failed to rename the legacy FileInfo table: %v", err)
+			}
+			_, err = tx.Exec(legacyCreateFileInfoTable)
+			if err != nil {
+				return fmt.Errorf("failed to create the FILEINFO table: %v", err)
+			}
+
+			// a FileVersion table next to the legacy files can only be the
+			// empty one made by opening the database with a newer server
+			_, err = tx.Exec(legacyDropFileVersion)
+			if err != nil {
+				return fmt.Errorf("failed to remove the empty FILEVERSION table: %v", err)
+			}
+			_, err = tx.Exec(legacyCreateFileVersionTable)
+			if err != nil {
+				return fmt.Errorf("failed to create the FILEVERSION table: %v", err)
+			}
+			_, err = tx.Exec(legacyCopyFiles)
+			if err != nil {
+				return fmt.Errorf("failed to copy the legacy files: %v", err)
+			}
+			_, err = tx.Exec(legacyCopyVersions)
+			if err != nil {
+				return fmt.Errorf("failed to create the versions of the legacy files: %v", err)
+			}
+			_, err = tx.Exec(legacyDropFileInfo)
+			if err != nil {
+				return fmt.Errorf("failed to remove the legacy FileInfo table: %v", err)
+			}
+		}
+
+		chunkColumns, err := tableColumns(tx, "FileChunks")
+		if err != nil {
+			return err
+		}
+		if len(chunkColumns) > 0 && !chunkColumns["VersionID"] {
+			_, err = tx.Exec(legacyRenameFileChunks)
+			if err != nil {
+				return fmt.Errorf("failed to rename the legacy FileChunks table: %v", err)
+			}
+			_, err = tx.Exec(legacyCreateFileChunksTable)
+			if err != nil {
+				return fmt.Errorf("failed to create the FILECHUNKS table: %v", err)
+			}
+			_, err = tx.Exec(legacyCopyChunks)
+			if err != nil {
+				return fmt.Errorf("failed to copy the legacy file chunks: %v", err)
+			}
+			_, err = tx.Exec(legacyDropChunks)
+			if err != nil {
+				return fmt.Errorf("failed to remove the legacy FileChunks table: %v", err)
+			}
+		}
+
+		// the regular upgrades take the tables from here
+		_, err = tx.Exec(createAppDataTable)
+		if err != nil {
+			return fmt.Errorf("failed to create the APPDATA table: %v", err)
+		}
+		_, err = tx.Exec(legacyClearDBVersion)
+		if err == nil {
+			_, err = tx.Exec(setAppDBVersion, legacyDBVersion)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set the DBVersion in the AppData table: %v", err)
+		}
+
+		err = tx.QueryRow(legacyCountFiles).Scan(&counts.Files)
+		if err == nil {
+			err = tx.QueryRow(legacyCountChunks).Scan(&counts.Chunks)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to count the migrated files: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return LegacyMigration{}, err
+	}
+	return counts, nil
+}
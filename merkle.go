@@ -0,0 +1,140 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+)
+
+// The prefixes hashed in front of the leaves and the inner nodes of the
+// Merkle tree so that a leaf can never be mistaken for an inner node.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// MerkleRoot returns the root of the Merkle tree built over the chunk hashes
+// of a file version, given in chunk order as returned by the chunk listing.
+// Every leaf is the SHA-1 of a chunk hash and every inner node is the SHA-1
+// of its two children; a node without a sibling is carried up a level as is.
+// Checking the hashes of a file version's chunk listing against the version's
+// Merkle root lets a client trust the hash of any chunk it downloads without
+// downloading the rest of the file. A version without chunks has the hash of
+// no data as its root.
+func MerkleRoot(chunkHashes []string) (string, error) {
+	if len(chunkHashes) == 0 {
+		hash := sha1.Sum(nil)
+		return base64.URLEncoding.EncodeToString(hash[:]), nil
+	}
+
+	level := make([][]byte, len(chunkHashes))
+	for i, chunkHash := range chunkHashes {
+		decoded, err := base64.URLEncoding.DecodeString(chunkHash)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode the hash of chunk %d: %v", i, err)
+		}
+		level[i] = merkleHash(merkleLeafPrefix, decoded)
+	}
+
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, merkleHash(merkleNodePrefix, level[i], level[i+1]))
+		}
+		level = next
+	}
+
+	return base64.URLEncoding.EncodeToString(level[0]), nil
+}
+
+// MerkleProof returns the hashes needed to verify the hash of the chunk
+// numbered index against the MerkleRoot of chunkHashes without the rest of the
+// chunk hashes: the sibling of each node on the path from the chunk's leaf to
+// the root, from the bottom up. Levels where the node has no sibling have no
+// hash in the proof.
+func MerkleProof(chunkHashes []string, index int) ([]string, error) {
+	if index < 0 || index >= len(chunkHashes) {
+		return nil, fmt.Errorf("chunk %d is outside of the %d chunk hashes", index, len(chunkHashes))
+	}
+
+	level := make([][]byte, len(chunkHashes))
+	for i, chunkHash := range chunkHashes {
+		decoded, err := base64.URLEncoding.DecodeString(chunkHash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode the hash of chunk %d: %v", i, err)
+		}
+		level[i] = merkleHash(merkleLeafPrefix, decoded)
+	}
+
+	var proof []string
+	for len(level) > 1 {
+		if sibling := index ^ 1; sibling < len(level) {
+			proof = append(proof, base64.URLEncoding.EncodeToString(level[sibling]))
+		}
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, merkleHash(merkleNodePrefix, level[i], level[i+1]))
+		}
+		level = next
+		index /= 2
+	}
+
+	return proof, nil
+}
+
+// VerifyMerkleProof returns true if chunkHash is the hash of the chunk numbered
+// index in a file version with chunkCount chunks and the given Merkle root,
+// using a proof from MerkleProof.
+func VerifyMerkleProof(root string, chunkCount int, index int, chunkHash string, proof []string) bool {
+	if index < 0 || index >= chunkCount {
+		return false
+	}
+	decoded, err := base64.URLEncoding.DecodeString(chunkHash)
+	if err != nil {
+		return false
+	}
+
+	hash := merkleHash(merkleLeafPrefix, decoded)
+	for count := chunkCount; count > 1; count = (count + 1) / 2 {
+		sibling := index ^ 1
+		if sibling < count {
+			if len(proof) == 0 {
+				return false
+			}
+			siblingHash, err := base64.URLEncoding.DecodeString(proof[0])
+			if err != nil {
+				return false
+			}
+			proof = proof[1:]
+			if sibling < index {
+				hash = merkleHash(merkleNodePrefix, siblingHash, hash)
+			} else {
+				hash = merkleHash(merkleNodePrefix, hash, siblingHash)
+			}
+		}
+		index /= 2
+	}
+
+	return len(proof) == 0 && base64.URLEncoding.EncodeToString(hash) == root
+}
+
+// merkleHash returns the SHA-1 of the prefix followed by the parts.
+func merkleHash(prefix byte, parts ...[]byte) []byte {
+	hasher := sha1.New()
+	hasher.Write([]byte{prefix})
+	for _, p := range parts {
+		hasher.Write(p)
+	}
+	return hasher.Sum(nil)
+}
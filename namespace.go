@@ -0,0 +1,295 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	createNamespacesTable = `CREATE TABLE IF NOT EXISTS Namespaces (
+        UserID      INTEGER PRIMARY KEY NOT NULL,
+        OwnerID     INTEGER             NOT NULL,
+        Name        TEXT                NOT NULL,
+        SharedQuota INTEGER             NOT NULL DEFAULT 1,
+        UNIQUE (OwnerID, Name)
+	);`
+
+	addNamespaceUser = `INSERT INTO Users (Name, Salt, Password, CryptoHash, CaseInsensitive) VALUES (?, '', X'', ?, ?);`
+	addNamespace     = `INSERT INTO Namespaces (UserID, OwnerID, Name) VALUES (?, ?, ?);`
+	isNamespaceUser  = `SELECT COUNT(*) FROM Namespaces WHERE UserID = ?;`
+	selectNamespaces = `SELECT Namespaces.UserID, Namespaces.Name, Namespaces.SharedQuota, UserStats.Quota, UserStats.Allocated - UserStats.Deduplicated
+					FROM Namespaces INNER JOIN UserStats ON UserStats.UserID = Namespaces.UserID`
+	getNamespaces        = selectNamespaces + ` WHERE Namespaces.OwnerID = ? ORDER BY Namespaces.Name;`
+	getNamespace         = selectNamespaces + ` WHERE Namespaces.OwnerID = ? AND Namespaces.Name = ?;`
+	setNamespaceQuota    = `UPDATE Namespaces SET SharedQuota = ? WHERE UserID = ?;`
+	setNamespacesCrypto  = `UPDATE Users SET CryptoHash = ? WHERE UserID IN (SELECT UserID FROM Namespaces WHERE OwnerID = ?);`
+	renameNamespaceUsers = `UPDATE Users SET Name = ? || '/' || (SELECT Name FROM Namespaces WHERE Namespaces.UserID = Users.UserID)
+					WHERE UserID IN (SELECT UserID FROM Namespaces WHERE OwnerID = ?);`
+	getNamespaceUserIDs    = `SELECT UserID FROM Namespaces WHERE OwnerID = ?;`
+	getNamespaceQuotaOwner = `SELECT OwnerID FROM Namespaces WHERE UserID = ? AND SharedQuota = 1;`
+)
+
+// MaxNamespaceLength is the longest name a namespace can have.
+const MaxNamespaceLength = 64
+
+// Namespace is a separate top-level tree of files within an account, such as
+// one for each machine backed up to it. The files of a namespace are stored
+// under a user of their own, so its listings, revision and allocation are
+// separate from the account's and file names never collide with the other
+// namespaces. The namespace user can't log in by itself; the account's
+// login is used with the namespace's name.
+type Namespace struct {
+	// UserID is the user the files of the namespace are stored under.
+	UserID int
+	Name   string
+
+	// SharedQuota is true if the allocation of the namespace counts towards
+	// the quota of the account, which is the default. Otherwise the
+	// namespace has a separate Quota of its own.
+	SharedQuota bool
+	Quota       int
+	Allocated   int
+}
+
+// ValidNamespaceName returns an error if name can't be used for a namespace.
+// Names are made of letters, digits, '-', '_' and '.' so that they can't be
+// mistaken for a path.
+func ValidNamespaceName(name string) error {
+	if name == "" || len(name) > MaxNamespaceLength {
+		return fmt.Errorf("a namespace name must be 1 to %d characters long", MaxNamespaceLength)
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("%s is not a valid namespace name", name)
+	}
+	for _, r := range name {
+		valid := r == '-' || r == '_' || r == '.' ||
+			(r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+		if !valid {
+			return fmt.Errorf("a namespace name may only contain letters, digits, '-', '_' and '.'")
+		}
+	}
+	return nil
+}
+
+// AddNamespace creates the namespace for the account of ownerID. The new
+// namespace shares the account's quota and crypto password and starts with
+// the account's case sensitivity.
+func (s *Storage) AddNamespace(ownerID int, name string) (*Namespace, error) {
+	defer s.timeOperation("AddNamespace", ownerID)()
+
+	err := ValidNamespaceName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	ns := &Namespace{Name: name, SharedQuota: true}
+	err = s.transact(func(tx *sql.Tx) error {
+		// namespaces don't nest
+		var count int
+		err := tx.QueryRow(isNamespaceUser, ownerID).Scan(&count)
+		if err != nil {
+			return fmt.Errorf("failed to look up the namespaces of the user: %v", err)
+		}
+		if count > 0 {
+			return fmt.Errorf("a namespace can't have namespaces of its own")
+		}
+
+		var owner User
+		err = tx.QueryRow(getUserByID, ownerID).Scan(&owner.Name, &owner.Salt, &owner.SaltedHash,
+			&owner.CryptoHash, &owner.IsAdmin, &owner.Status, &owner.CaseInsensitive)
+		if err != nil {
+			return fmt.Errorf("failed to get the user (%d) from the database: %v", ownerID, err)
+		}
+
+		res, err := tx.Exec(addNamespaceUser, namespaceUserName(owner.Name, name), owner.CryptoHash, owner.CaseInsensitive)
+		if err != nil {
+			return fmt.Errorf("failed to add the namespace %s; it may already exist: %v", name, err)
+		}
+		insertedID, err := res.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("failed to get the id of the namespace just added: %v", err)
+		}
+		ns.UserID = int(insertedID)
+
+		_, err = tx.Exec(setUserStats, ns.UserID, 0, 0, 0)
+		if err != nil {
+			return fmt.Errorf("failed to set the namespace's stats in the database: %v", err)
+		}
+		_, err = tx.Exec(addNamespace, ns.UserID, ownerID, name)
+		if err != nil {
+			return fmt.Errorf("failed to add the namespace %s: %v", name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ns, nil
+}
+
+// scanNamespace reads a row selected with selectNamespaces.
+func scanNamespace(row interface {
+	Scan(dest ...interface{}) error
+}) (Namespace, error) {
+	var ns Namespace
+	err := row.Scan(&ns.UserID, &ns.Name, &ns.SharedQuota, &ns.Quota, &ns.Allocated)
+	return ns, err
+}
+
+// GetNamespaces returns the namespaces of the account of ownerID sorted by
+// name. The Quota of a namespace that shares the account's quota is zero.
+func (s *Storage) GetNamespaces(ownerID int) ([]Namespace, error) {
+	defer s.timeOperation("GetNamespaces", ownerID)()
+
+	rows, err := s.db.Query(getNamespaces, ownerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the namespaces of the user: %v", err)
+	}
+	defer rows.Close()
+
+	namespaces := []Namespace{}
+	for rows.Next() {
+		ns, err := scanNamespace(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next namespace: %v", err)
+		}
+		namespaces = append(namespaces, ns)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get the namespaces of the user: %v", err)
+	}
+
+	return namespaces, nil
+}
+
+// GetNamespace returns the namespace of the account of ownerID by name.
+func (s *Storage) GetNamespace(ownerID int, name string) (*Namespace, error) {
+	defer s.timeOperation("GetNamespace", ownerID)()
+
+	ns, err := scanNamespace(s.db.QueryRow(getNamespace, ownerID, name))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("the namespace %s does not exist", name)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get the namespace %s: %v", name, err)
+	}
+
+	return &ns, nil
+}
+
+// SetNamespaceQuota gives the namespace a separate quota of its own, or makes
+// it share the account's quota again if quota is zero.
+func (s *Storage) SetNamespaceQuota(ownerID int, name string, quota int) error {
+	defer s.timeOperation("SetNamespaceQuota", ownerID)()
+
+	if quota < 0 {
+		return fmt.Errorf("the quota of a namespace can't be negative")
+	}
+	ns, err := s.GetNamespace(ownerID, name)
+	if err != nil {
+		return err
+	}
+
+	return s.transact(func(tx *sql.Tx) error {
+		_, err := tx.Exec(setNamespaceQuota, quota == 0, ns.UserID)
+		if err != nil {
+			return fmt.Errorf("failed to set the quota of the namespace %s: %v", name, err)
+		}
+		_, err = tx.Exec(setUserQuota, quota, ns.UserID)
+		if err != nil {
+			return fmt.Errorf("failed to set the quota of the namespace %s: %v", name, err)
+		}
+		return nil
+	})
+}
+
+// RemoveNamespace removes the namespace and all of its files.
+func (s *Storage) RemoveNamespace(ownerID int, name string) error {
+	defer s.timeOperation("RemoveNamespace", ownerID)()
+
+	ns, err := s.GetNamespace(ownerID, name)
+	if err != nil {
+		return err
+	}
+
+	err = s.removeUserID(ns.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to remove the namespace %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// GetQuotaStats returns the stats that the quota of the user is checked
+// against. For a namespace that shares the account's quota that's the quota
+// of the account and the allocation of the account and all such namespaces
+// together; otherwise it's the same as GetUserStats.
+func (s *Storage) GetQuotaStats(userID int) (*UserStats, error) {
+	defer s.timeOperation("GetQuotaStats", userID)()
+
+	stats, err := s.GetUserStats(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var quotaUserID int
+	var quota, allocated, logical, overQuotaSince int64
+	err = s.transact(func(tx *sql.Tx) error {
+		quotaUserID, err = getQuotaUserID(tx, userID)
+		if err != nil {
+			return err
+		}
+		return tx.QueryRow(getUserQuotaState, quotaUserID).Scan(&quota, &allocated, &logical, &overQuotaSince)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the user quota from the database: %v", err)
+	}
+
+	stats.Quota, stats.Allocated, stats.Logical, stats.OverQuotaSince = int(quota), int(allocated), int(logical), time.Time{}
+	if overQuotaSince != 0 && stats.Allocated > stats.Quota {
+		stats.OverQuotaSince = time.Unix(0, overQuotaSince)
+	}
+	return stats, nil
+}
+
+// getQuotaUserID returns the user whose quota the allocation of userID
+// counts towards, which is the account for a namespace sharing its quota.
+func getQuotaUserID(tx *sql.Tx, userID int) (int, error) {
+	var ownerID int
+	err := tx.QueryRow(getNamespaceQuotaOwner, userID).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		return userID, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to look up the namespace of the user: %v", err)
+	}
+	return ownerID, nil
+}
+
+// namespaceUserIDs returns the users holding the namespaces of ownerID.
+func (s *Storage) namespaceUserIDs(ownerID int) ([]int, error) {
+	rows, err := s.db.Query(getNamespaceUserIDs, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// namespaceUserName returns the name of the user holding the namespace of
+// the account named owner.
+func namespaceUserName(owner string, namespace string) string {
+	return owner + "/" + namespace
+}
@@ -0,0 +1,86 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const (
+	createFileNotesTable = `CREATE TABLE IF NOT EXISTS FileNotes (
+        FileID      INTEGER PRIMARY KEY NOT NULL,
+        Note        TEXT                NOT NULL
+	);`
+
+	getFileNote    = `SELECT Note FROM FileNotes WHERE FileID = ?;`
+	setFileNote    = `INSERT OR REPLACE INTO FileNotes (FileID, Note) VALUES (?, ?);`
+	removeFileNote = `DELETE FROM FileNotes WHERE FileID = ?;`
+)
+
+// MaxNoteLength is the longest note, as stored, that can be attached to a
+// file. Notes are encrypted by the client so this includes the overhead.
+const MaxNoteLength = 64 * 1024
+
+// SetFileNote attaches the note to the file, replacing any note it already
+// had. An empty note removes the note from the file. The server stores the
+// note as given; clients encrypt it first.
+func (s *Storage) SetFileNote(userID, fileID int, note string) error {
+	defer s.timeOperation("SetFileNote", userID)()
+
+	if len(note) > MaxNoteLength {
+		return fmt.Errorf("a note can be at most %d bytes", MaxNoteLength)
+	}
+
+	return s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return ErrNotOwner
+		}
+
+		if note == "" {
+			_, err = tx.Exec(removeFileNote, fileID)
+		} else {
+			_, err = tx.Exec(setFileNote, fileID, note)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set the note of the file: %v", err)
+		}
+		return nil
+	})
+}
+
+// GetFileNote returns the note attached to the file or an empty string if
+// the file doesn't have one.
+func (s *Storage) GetFileNote(userID, fileID int) (string, error) {
+	defer s.timeOperation("GetFileNote", userID)()
+
+	var note string
+	err := s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return ErrNotOwner
+		}
+
+		err = tx.QueryRow(getFileNote, fileID).Scan(&note)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to get the note of the file: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return note, nil
+}
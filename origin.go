@@ -0,0 +1,65 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const (
+	setFileVersionDevice = `UPDATE FileVersion SET Device = ? WHERE VersionID = ? AND FileID = ?;`
+	setFileInfoDevice    = `UPDATE FileInfo SET Device = ? WHERE FileID = ?
+					AND (SELECT VersionNum FROM FileVersion WHERE VersionID = ?) = 1;`
+)
+
+// MaxDeviceLength is the longest device identifier that is recorded for a
+// file version.
+const MaxDeviceLength = 128
+
+// SetFileVersionDevice records the identifier of the device, such as the
+// host name of the client, that uploaded the file version identified by
+// fileID and versionID. The device of the first version of a file is also
+// recorded as the device that created the file.
+func (s *Storage) SetFileVersionDevice(userID int, fileID int, versionID int, device string) error {
+	defer s.timeOperation("SetFileVersionDevice", userID)()
+
+	if len(device) > MaxDeviceLength {
+		return fmt.Errorf("the device identifier can be at most %d bytes", MaxDeviceLength)
+	}
+
+	return s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return ErrNotOwner
+		}
+
+		oldVersion, err := journalGetVersion(tx, versionID)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to get the file version (%d) from the database: %v", versionID, err)
+		}
+
+		res, err := tx.Exec(setFileVersionDevice, device, versionID, fileID)
+		if err != nil {
+			return fmt.Errorf("failed to set the device of the file version (%d) for the file id (%d) in the database: %v", versionID, fileID, err)
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to set the device of the file version in the database: %v", err)
+		} else if affected != 1 {
+			return fmt.Errorf("failed to set the device of the file version in the database; the version id %d was not found for the file id %d", versionID, fileID)
+		}
+
+		_, err = tx.Exec(setFileInfoDevice, device, fileID, versionID)
+		if err != nil {
+			return fmt.Errorf("failed to set the device of the file id (%d) in the database: %v", fileID, err)
+		}
+		return journalVersionUpdate(tx, userID, fileID, oldVersion)
+	})
+}
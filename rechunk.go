@@ -0,0 +1,234 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+)
+
+// The outcomes of converting a file version with Storage.Rechunk.
+const (
+	// RechunkConverted is a file version whose chunks were split or joined
+	// into chunks of the new size.
+	RechunkConverted = "converted"
+
+	// RechunkCurrent is a file version that already has chunks of the new
+	// size, such as one converted by an earlier run.
+	RechunkCurrent = "current"
+
+	// RechunkEncrypted is a file version of a user with a crypto password.
+	// Its chunks are encrypted by the client one at a time, so the server
+	// can't split or join them and they keep their size.
+	RechunkEncrypted = "encrypted"
+
+	// RechunkIncomplete is a file version that doesn't have all of its
+	// chunks, such as one that is still being uploaded.
+	RechunkIncomplete = "incomplete"
+)
+
+const (
+	rechunkGetVersions = `SELECT FileVersion.FileID, FileVersion.VersionID, FileInfo.UserID, FileVersion.ChunkCount,
+					IFNULL(LENGTH(Users.CryptoHash), 0) > 0 FROM FileVersion
+					INNER JOIN FileInfo ON FileVersion.FileID = FileInfo.FileID
+					INNER JOIN Users ON FileInfo.UserID = Users.UserID
+					WHERE FileInfo.IsDir = 0 ORDER BY FileVersion.VersionID;`
+	rechunkGetChunks    = `SELECT ChunkID, ChunkNum, ChunkSize FROM FileChunks WHERE FileID = ? AND VersionID = ? ORDER BY ChunkNum;`
+	rechunkGetChunkData = `SELECT IFNULL(ChunkData.Chunk, FileChunks.Chunk), IFNULL(ChunkData.StoreKey, FileChunks.StoreKey) FROM FileChunks
+					LEFT JOIN ChunkData ON FileChunks.ChunkDataID = ChunkData.ChunkDataID
+					WHERE FileChunks.ChunkID = ?;`
+	rechunkRemoveChunks = `DELETE FROM FileChunks WHERE FileID = ? AND VersionID = ? AND ChunkNum >= 0;`
+	rechunkNumberChunks = `UPDATE FileChunks SET ChunkNum = -ChunkNum - 1 WHERE FileID = ? AND VersionID = ? AND ChunkNum < 0;`
+	rechunkSetVersion   = `UPDATE FileVersion SET ChunkCount = ?, MerkleRoot = ? WHERE VersionID = ? AND FileID = ?;`
+)
+
+// RechunkVersion is the outcome of converting one file version with
+// Storage.Rechunk.
+type RechunkVersion struct {
+	UserID    int
+	FileID    int
+	VersionID int
+	Outcome   string // one of the Rechunk* constants
+}
+
+// rechunkChunk is the location and size of a stored chunk.
+type rechunkChunk struct {
+	chunkID  int
+	chunkNum int
+	length   int64
+}
+
+// Rechunk converts the stored file versions to chunks of chunkSize bytes so
+// that the server can be started with a different chunk size without the
+// clients uploading their files again. Each version is converted in its own
+// transaction, reading one stored chunk at a time, and versions that already
+// have chunks of the new size are left alone, so an interrupted run picks up
+// where it stopped when it's run again. The chunk hashes and Merkle roots are
+// recalculated; the file hashes and allocations don't change. progress, if
+// not nil, is called with the outcome of every version, and the number of
+// versions with each outcome is returned.
+func (s *Storage) Rechunk(chunkSize int64, progress func(RechunkVersion)) (map[string]int, error) {
+	defer s.timeOperation("Rechunk", NoUserID)()
+
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("the chunk size must be greater than zero")
+	}
+
+	// the list of versions is read first so that none of them is seen again
+	// after it's converted
+	type versionToConvert struct {
+		RechunkVersion
+		chunkCount int
+		encrypted  bool
+	}
+	var versions []versionToConvert
+	rows, err := s.db.Query(rechunkGetVersions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the file versions: %v", err)
+	}
+	for rows.Next() {
+		var v versionToConvert
+		err = rows.Scan(&v.FileID, &v.VersionID, &v.UserID, &v.chunkCount, &v.encrypted)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan the next row while processing the file versions: %v", err)
+		}
+		versions = append(versions, v)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan all of the file versions: %v", err)
+	}
+
+	counts := make(map[string]int)
+	for _, v := range versions {
+		err = s.transact(func(tx *sql.Tx) error {
+			var err error
+			v.Outcome, err = s.rechunkVersion(tx, v.UserID, v.FileID, v.VersionID, v.chunkCount, v.encrypted, chunkSize)
+			return err
+		})
+		if err != nil {
+			return counts, fmt.Errorf("failed to convert the version %d of the file id %d: %v", v.VersionID, v.FileID, err)
+		}
+		counts[v.Outcome]++
+		if progress != nil {
+			progress(v.RechunkVersion)
+		}
+	}
+	return counts, nil
+}
+
+// rechunkVersion converts the chunks of one file version to chunkSize bytes
+// and returns the outcome. The new chunks are added with negative chunk
+// numbers while the old ones are read and only take their place once all of
+// them have been added.
+func (s *Storage) rechunkVersion(tx *sql.Tx, userID, fileID, versionID, chunkCount int, encrypted bool, chunkSize int64) (string, error) {
+	var chunks []rechunkChunk
+	rows, err := tx.Query(rechunkGetChunks, fileID, versionID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the chunks of the file version: %v", err)
+	}
+	for rows.Next() {
+		var c rechunkChunk
+		err = rows.Scan(&c.chunkID, &c.chunkNum, &c.length)
+		if err != nil {
+			rows.Close()
+			return "", fmt.Errorf("failed to scan the next row while processing the chunks: %v", err)
+		}
+		chunks = append(chunks, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return "", fmt.Errorf("failed to scan all of the chunks: %v", err)
+	}
+
+	if len(chunks) != chunkCount {
+		return RechunkIncomplete, nil
+	}
+	current := true
+	for i, c := range chunks {
+		if c.chunkNum != i {
+			return RechunkIncomplete, nil
+		}
+		last := i == len(chunks)-1
+		if (!last && c.length != chunkSize) || (last && (c.length == 0 || c.length > chunkSize)) {
+			current = false
+		}
+	}
+	if encrypted {
+		return RechunkEncrypted, nil
+	}
+	if current {
+		return RechunkCurrent, nil
+	}
+
+	// split the data of the old chunks into new ones as it's read
+	var hashes []string
+	var pending []byte
+	addChunk := func(data []byte) error {
+		hasher := sha1.New()
+		hasher.Write(data)
+		chunkHash := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+		_, err := s.putSharedChunk(tx, userID, fileID, versionID, -len(hashes)-1, chunkHash, data, nil, "", false)
+		if err != nil {
+			return fmt.Errorf("failed to add a new chunk: %v", err)
+		}
+		hashes = append(hashes, chunkHash)
+		return nil
+	}
+	for _, c := range chunks {
+		var data []byte
+		var storeKey string
+		err = tx.QueryRow(rechunkGetChunkData, c.chunkID).Scan(&data, &storeKey)
+		if err == nil {
+			data, err = s.loadChunk(data, storeKey)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read the chunk %d: %v", c.chunkNum, err)
+		}
+		pending = append(pending, data...)
+		for int64(len(pending)) >= chunkSize {
+			if err = addChunk(pending[:chunkSize]); err != nil {
+				return "", err
+			}
+			pending = pending[chunkSize:]
+		}
+
+		// keep only the data left over for the next chunk
+		pending = append([]byte(nil), pending...)
+	}
+	if len(pending) > 0 {
+		if err = addChunk(pending); err != nil {
+			return "", err
+		}
+	}
+
+	_, err = execReleasingChunkData(tx, rechunkRemoveChunks, getChunkDataIDsOfVersion, fileID, versionID)
+	if err != nil {
+		return "", fmt.Errorf("failed to remove the old chunks: %v", err)
+	}
+	_, err = tx.Exec(rechunkNumberChunks, fileID, versionID)
+	if err != nil {
+		return "", fmt.Errorf("failed to number the new chunks: %v", err)
+	}
+	merkleRoot, err := MerkleRoot(hashes)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(rechunkSetVersion, len(hashes), merkleRoot, versionID, fileID)
+	if err != nil {
+		return "", fmt.Errorf("failed to update the file version: %v", err)
+	}
+
+	// the conversion isn't journaled since rolling back its new chunk count
+	// without the old chunks would break the file; the revision still
+	// changes so that clients see the new chunk listing
+	_, err = tx.Exec(journalBumpRevision, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to update the revision of the user: %v", err)
+	}
+	return RechunkConverted, nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+const (
+	createFileSearchTokensTable = `CREATE TABLE IF NOT EXISTS FileSearchTokens (
+        FileID      INTEGER             NOT NULL,
+        Token       TEXT                NOT NULL,
+        PRIMARY KEY (Token, FileID)
+	);`
+
+	addFileSearchToken     = `INSERT OR IGNORE INTO FileSearchTokens (FileID, Token) VALUES (?, ?);`
+	removeFileSearchTokens = `DELETE FROM FileSearchTokens WHERE FileID = ?;`
+	searchUserFiles        = selectFileInfos + `
+					WHERE UserID = ? AND TrashedAt = 0 AND FileID IN (
+						SELECT FileID FROM FileSearchTokens WHERE Token IN (%s)
+						GROUP BY FileID HAVING COUNT(DISTINCT Token) = ?
+					) ORDER BY FileID;`
+)
+
+// MaxSearchTokens is the most search tokens that can be stored for a file or
+// used in a single search.
+const MaxSearchTokens = 256
+
+// SetFileSearchTokens replaces the search tokens of the file. The tokens are
+// opaque to the server; clients derive them from the plaintext file name with
+// a key the server doesn't have so that the server can match a search against
+// them without learning the names.
+func (s *Storage) SetFileSearchTokens(userID, fileID int, tokens []string) error {
+	defer s.timeOperation("SetFileSearchTokens", userID)()
+
+	return s.transact(func(tx *sql.Tx) error {
+		return setFileSearchTokens(tx, userID, fileID, tokens)
+	})
+}
+
+// SetSearchIndex replaces the search tokens of each of the files in index,
+// which maps file ids to their tokens, in a single transaction.
+func (s *Storage) SetSearchIndex(userID int, index map[int][]string) error {
+	defer s.timeOperation("SetSearchIndex", userID)()
+
+	return s.transact(func(tx *sql.Tx) error {
+		for fileID, tokens := range index {
+			err := setFileSearchTokens(tx, userID, fileID, tokens)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// setFileSearchTokens replaces the search tokens of the file after checking
+// that the user owns it.
+func setFileSearchTokens(tx *sql.Tx, userID, fileID int, tokens []string) error {
+	if len(tokens) > MaxSearchTokens {
+		return fmt.Errorf("a file can have at most %d search tokens", MaxSearchTokens)
+	}
+
+	// check to make sure the user owns the file id
+	var owningUserID int
+	err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+	if err != nil {
+		return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+	}
+	if owningUserID != userID {
+		return ErrNotOwner
+	}
+
+	_, err = tx.Exec(removeFileSearchTokens, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to remove the search tokens of the file: %v", err)
+	}
+	for _, token := range tokens {
+		if token == "" {
+			continue
+		}
+		_, err = tx.Exec(addFileSearchToken, fileID, token)
+		if err != nil {
+			return fmt.Errorf("failed to add a search token for the file: %v", err)
+		}
+	}
+	return nil
+}
+
+// SearchFiles returns the user's files, not counting the ones in the trash,
+// that have all of the search tokens. Files that were never given search
+// tokens are never returned.
+func (s *Storage) SearchFiles(userID int, tokens []string) ([]FileInfo, error) {
+	defer s.timeOperation("SearchFiles", userID)()
+
+	// drop the duplicate tokens so that they can be counted
+	unique := make(map[string]bool, len(tokens))
+	args := []interface{}{userID}
+	for _, token := range tokens {
+		if token != "" && !unique[token] {
+			unique[token] = true
+			args = append(args, token)
+		}
+	}
+	if len(unique) == 0 {
+		return nil, fmt.Errorf("at least one search token must be supplied")
+	}
+	if len(unique) > MaxSearchTokens {
+		return nil, fmt.Errorf("a search can use at most %d search tokens", MaxSearchTokens)
+	}
+	args = append(args, len(unique))
+	query := fmt.Sprintf(searchUserFiles, strings.TrimSuffix(strings.Repeat("?, ", len(unique)), ", "))
+
+	var result []FileInfo
+	err := s.transact(func(tx *sql.Tx) error {
+		var err error
+		result, err = queryUserFileInfos(tx, userID, query, args...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -31,11 +31,12 @@ type FileStats struct {
 	LastMod     int64
 	Permissions uint32
 	HashString  string
+	MerkleRoot  string
 	IsDir       bool
 }
 
-// CalcFileHashInfo takes the file name and calculates the number of chunks, last modified time
-// and hash string for the file. An error is returned on failure.
+// CalcFileHashInfo takes the file name and calculates the number of chunks, last modified time,
+// hash string and Merkle root of the chunk hashes for the file. An error is returned on failure.
 func CalcFileHashInfo(maxChunkSize int64, filename string) (stats FileStats, e error) {
 	fileInfo, err := os.Stat(filename)
 	if err != nil {
@@ -70,9 +71,28 @@ func CalcFileHashInfo(maxChunkSize int64, filename string) (stats FileStats, e e
 	hash := hasher.Sum(nil)
 	stats.HashString = base64.URLEncoding.EncodeToString(hash)
 
+	// hash each chunk the same way the client does when uploading it
+	chunkHashes := make([]string, 0, stats.ChunkCount)
+	dataSize := int64(len(fileBytes))
+	for start := int64(0); start < dataSize; start += maxChunkSize {
+		end := start + maxChunkSize
+		if end > dataSize {
+			end = dataSize
+		}
+		chunkHash := sha1.Sum(fileBytes[start:end])
+		chunkHashes = append(chunkHashes, base64.URLEncoding.EncodeToString(chunkHash[:]))
+	}
+	stats.MerkleRoot, e = MerkleRoot(chunkHashes)
+
 	return
 }
 
+// GenRandomPassword returns a random login password for accounts created
+// without one, such as users created in bulk by an administrator.
+func GenRandomPassword() (string, error) {
+	return getSalt(12)
+}
+
 // GenLoginPasswordHash takes the user password, generates a new random salt,
 // then generates a hash from the salted password combination.
 func GenLoginPasswordHash(unsaltedPassword string) (salt string, saltedhash []byte, err error) {
@@ -0,0 +1,55 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const (
+	setFileStarred  = `UPDATE FileInfo SET Starred = ? WHERE FileID = ?;`
+	getStarredFiles = selectFileInfos + ` WHERE UserID = ? AND TrashedAt = 0 AND Starred = 1 ORDER BY FileID;`
+)
+
+// SetFileStarred marks the file as one of the user's favorites, or clears
+// the mark if starred is false.
+func (s *Storage) SetFileStarred(userID, fileID int, starred bool) error {
+	defer s.timeOperation("SetFileStarred", userID)()
+
+	return s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return ErrNotOwner
+		}
+
+		_, err = tx.Exec(setFileStarred, starred, fileID)
+		if err != nil {
+			return fmt.Errorf("failed to set the starred flag of the file: %v", err)
+		}
+		return nil
+	})
+}
+
+// GetStarredFiles returns the user's starred files, not counting the ones in
+// the trash.
+func (s *Storage) GetStarredFiles(userID int) ([]FileInfo, error) {
+	defer s.timeOperation("GetStarredFiles", userID)()
+
+	var result []FileInfo
+	err := s.transact(func(tx *sql.Tx) error {
+		var err error
+		result, err = queryUserFileInfos(tx, userID, getStarredFiles, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
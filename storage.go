@@ -4,18 +4,18 @@
 package filefreezer
 
 import (
+	"crypto/rand"
 	"database/sql"
 	"fmt"
 	"sort"
-
-	// import the sqlite3 driver for use with database/sql
-	_ "github.com/mattn/go-sqlite3"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	// CurrentDBVersion is set to the current database version and is used
 	// by filefreezer to detect when the database tables need to get updated.
-	CurrentDBVersion = 1
+	CurrentDBVersion = 14
 )
 
 const (
@@ -28,14 +28,20 @@ const (
         Name		TEXT	UNIQUE		NOT NULL ON CONFLICT ABORT,
 		Salt		TEXT				NOT NULL,
 		Password	BLOB				NOT NULL,
-		CryptoHash  BLOB                
+		CryptoHash  BLOB,
+		IsAdmin		INTEGER				NOT NULL DEFAULT 0,
+		LastLogin	INTEGER				NOT NULL DEFAULT 0,
+		Status		TEXT				NOT NULL DEFAULT 'active',
+		CaseInsensitive	INTEGER			NOT NULL DEFAULT 0
     );`
 
 	createUserStatsTable = `CREATE TABLE IF NOT EXISTS UserStats (
         UserID 		INTEGER PRIMARY KEY	NOT NULL,
         Quota		INTEGER				NOT NULL,
         Allocated	INTEGER				NOT NULL,
-        Revision	INTEGER				NOT NULL
+        Revision	INTEGER				NOT NULL,
+        OverQuotaSince	INTEGER			NOT NULL DEFAULT 0,
+        Deduplicated	INTEGER			NOT NULL DEFAULT 0
     );`
 
 	createFileInfoTable = `CREATE TABLE IF NOT EXISTS FileInfo (
@@ -43,7 +49,13 @@ const (
         UserID 		      INTEGER              NOT NULL,
         FileName	      TEXT                 NOT NULL,
         IsDir             INTEGER              NOT NULL,
-        CurrentVersionID  INTEGER              NOT NULL
+        CurrentVersionID  INTEGER              NOT NULL,
+        TrashedAt         INTEGER              NOT NULL DEFAULT 0,
+        ExpiresAt         INTEGER              NOT NULL DEFAULT 0,
+        CreatedAt         INTEGER              NOT NULL DEFAULT 0,
+        Device            TEXT                 NOT NULL DEFAULT '',
+        Starred           INTEGER              NOT NULL DEFAULT 0,
+        NameKey           TEXT                 NOT NULL DEFAULT ''
       );`
 
 	createFileVersionTable = `CREATE TABLE IF NOT EXISTS FileVersion (
@@ -53,7 +65,10 @@ const (
         Perms       INTEGER             NOT NULL,
         LastMod		INTEGER				NOT NULL,
         ChunkCount  INTEGER				NOT NULL,
-        FileHash	TEXT				NOT NULL
+        FileHash	TEXT				NOT NULL,
+        MerkleRoot	TEXT				NOT NULL DEFAULT '',
+        CreatedAt   INTEGER             NOT NULL DEFAULT 0,
+        Device      TEXT                NOT NULL DEFAULT ''
     );`
 
 	createFileChunksTable = `CREATE TABLE IF NOT EXISTS FileChunks (
@@ -62,41 +77,131 @@ const (
         VersionID   INTEGER             NOT NULL,
         ChunkNum	INTEGER 			NOT NULL,
         ChunkHash	TEXT				NOT NULL,
-        Chunk		BLOB				NOT NULL
+        Chunk		BLOB				NOT NULL,
+        ChunkSize	INTEGER				NOT NULL DEFAULT 0,
+        StoreKey	TEXT				NOT NULL DEFAULT '',
+        ChunkDataID INTEGER             NOT NULL DEFAULT 0
+	);`
+
+	createUsageSnapshotsTable = `CREATE TABLE IF NOT EXISTS UsageSnapshots (
+        Day         TEXT                NOT NULL,
+        UserID      INTEGER             NOT NULL,
+        Allocated   INTEGER             NOT NULL,
+        FileCount   INTEGER             NOT NULL,
+        VersionCount INTEGER            NOT NULL,
+        PRIMARY KEY (Day, UserID)
+	);`
+
+	createSharedSecretsTable = `CREATE TABLE IF NOT EXISTS SharedSecrets (
+        Name        TEXT PRIMARY KEY    NOT NULL,
+        Secret      BLOB                NOT NULL
+	);`
+
+	createJobLocksTable = `CREATE TABLE IF NOT EXISTS JobLocks (
+        Name        TEXT PRIMARY KEY    NOT NULL,
+        Owner       TEXT                NOT NULL,
+        Expires     INTEGER             NOT NULL
+	);`
+
+	createQuotaNoticesTable = `CREATE TABLE IF NOT EXISTS QuotaNotices (
+        UserID      INTEGER PRIMARY KEY NOT NULL,
+        Threshold   INTEGER             NOT NULL
 	);`
 
-	getAppDBVersion = `SELECT DBVersion FROM AppData;`
-	setAppDBVersion = `INSERT OR REPLACE INTO AppData (DBVersion) VALUES (?);`
+	getAppDBVersion    = `SELECT DBVersion FROM AppData;`
+	setAppDBVersion    = `INSERT OR REPLACE INTO AppData (DBVersion) VALUES (?);`
+	updateAppDBVersion = `UPDATE AppData SET DBVersion = ?;`
 
 	lookupUserByName  = `SELECT Name FROM Users WHERE Name = ?;`
 	addUser           = `INSERT INTO Users (Name, Salt, Password) VALUES (?, ?, ?);`
-	getUser           = `SELECT UserID, Salt, Password, CryptoHash FROM Users  WHERE Name = ?;`
+	getUser           = `SELECT UserID, Salt, Password, CryptoHash, IsAdmin, Status, CaseInsensitive FROM Users  WHERE Name = ?;`
+	getUserByID       = `SELECT Name, Salt, Password, CryptoHash, IsAdmin, Status, CaseInsensitive FROM Users  WHERE UserID = ?;`
 	setUserCryptoHash = `UPDATE Users SET CryptoHash = (?) WHERE UserID = ?;`
+	setUserAdmin      = `UPDATE Users SET IsAdmin = ? WHERE UserID = ?;`
 	updateUser        = `UPDATE Users SET Name = ?, Salt = ?, Password = ?, CryptoHash = ? WHERE UserID = ?;`
+	setUserLastLogin  = `UPDATE Users SET LastLogin = ? WHERE UserID = ?;`
+	setUserStatus     = `UPDATE Users SET Status = ? WHERE UserID = ?;`
+
+	selectUserSummaries = `SELECT Users.UserID, Users.Name, Users.IsAdmin, Users.Status, Users.LastLogin, UserStats.Quota, UserStats.Allocated - UserStats.Deduplicated, UserStats.Revision,
+					(SELECT COUNT(*) FROM FileInfo WHERE FileInfo.UserID = Users.UserID),
+					(SELECT COUNT(*) FROM FileVersion INNER JOIN FileInfo ON FileVersion.FileID = FileInfo.FileID
+						WHERE FileInfo.UserID = Users.UserID)
+					FROM Users INNER JOIN UserStats ON Users.UserID = UserStats.UserID`
+	getAllUserSummaries  = selectUserSummaries + ` ORDER BY Users.UserID;`
+	getUserSummariesPage = selectUserSummaries + ` ORDER BY Users.UserID LIMIT ? OFFSET ?;`
+	getUserSummary       = selectUserSummaries + ` WHERE Users.UserID = ?;`
+	countUserSummaries   = `SELECT COUNT(*) FROM Users INNER JOIN UserStats ON Users.UserID = UserStats.UserID;`
+
+	getFileSizes = `SELECT FileInfo.UserID, FileInfo.FileID, SUM(FileChunks.ChunkSize), COUNT(DISTINCT FileChunks.VersionID)
+					FROM FileInfo INNER JOIN FileChunks ON FileChunks.FileID = FileInfo.FileID
+					GROUP BY FileInfo.FileID ORDER BY FileInfo.UserID, 3 DESC, FileInfo.FileID;`
+
+	setUsageSnapshot  = `INSERT OR REPLACE INTO UsageSnapshots (Day, UserID, Allocated, FileCount, VersionCount) VALUES (?, ?, ?, ?, ?);`
+	getUsageSnapshots = `SELECT Day, UserID, Allocated, FileCount, VersionCount FROM UsageSnapshots WHERE Day >= ? ORDER BY UserID, Day;`
+
+	addSharedSecret = `INSERT OR IGNORE INTO SharedSecrets (Name, Secret) VALUES (?, ?);`
+	getSharedSecret = `SELECT Secret FROM SharedSecrets WHERE Name = ?;`
+
+	addJobLock    = `INSERT OR IGNORE INTO JobLocks (Name, Owner, Expires) VALUES (?, '', 0);`
+	takeJobLock   = `UPDATE JobLocks SET Owner = ?, Expires = ? WHERE Name = ? AND (Owner = ? OR Expires < ?);`
+	removeJobLock = `UPDATE JobLocks SET Owner = '', Expires = 0 WHERE Name = ? AND Owner = ?;`
+
+	getQuotaNotice = `SELECT Threshold FROM QuotaNotices WHERE UserID = ?;`
+	setQuotaNotice = `INSERT OR REPLACE INTO QuotaNotices (UserID, Threshold) VALUES (?, ?);`
 
 	setUserStats    = `INSERT OR REPLACE INTO UserStats (UserID, Quota, Allocated, Revision) VALUES (?, ?, ?, ?);`
-	getUserStats    = `SELECT Quota, Allocated, Revision FROM UserStats WHERE UserID = ?;`
+	getUserStats    = `SELECT Quota, Allocated - Deduplicated, Allocated, Revision, OverQuotaSince FROM UserStats WHERE UserID = ?;`
 	updateUserStats = `UPDATE UserStats SET Allocated = Allocated + (?), Revision = Revision + 1 WHERE UserID = ?;`
 	setUserQuota    = `UPDATE UserStats SET Quota = (?) WHERE UserID = ?;`
 
-	addFileInfo = `INSERT INTO FileInfo (UserID, FileName, IsDir, CurrentVersionID) SELECT ?, ?, ?, ?
-                        WHERE NOT EXISTS (SELECT 1 FROM FileInfo WHERE UserID = ? AND FileName = ?);`
-	getFileInfo           = `SELECT UserID, FileName, IsDir, CurrentVersionID FROM FileInfo WHERE FileID = ?;`
-	getFileInfoByName     = `SELECT FileID, IsDir, CurrentVersionID FROM FileInfo WHERE FileName = ? AND UserID = ?;`
-	getFileInfoOwner      = `SELECT UserID  FROM FileInfo WHERE FileID = ?;`
-	getAllUserFiles       = `SELECT FileID, FileName, IsDir, CurrentVersionID FROM FileInfo WHERE UserID = ?;`
-	removeFileInfoByID    = `DELETE FROM FileInfo WHERE FileID = ?;`
-	setFileCurrentVersion = `UPDATE FileInfo SET CurrentVersionID = ? WHERE FileID = ?;`
-
-	addFileVersion                = `INSERT INTO FileVersion (FileID, VersionNum, Perms, LastMod, ChunkCount, FileHash) VALUES (?, ?, ?, ?, ?, ?);`
-	getFileVersionByID            = `SELECT VersionNum, Perms, LastMod, ChunkCount, FileHash FROM FileVersion WHERE VersionID = ?;`
+	getTotalAllocated     = `SELECT IFNULL(SUM(Allocated - Deduplicated), 0) FROM UserStats;`
+	getUserFileCount      = `SELECT COUNT(*) FROM FileInfo WHERE UserID = ? AND IsDir = 0;`
+	getUserVersionCount   = `SELECT COUNT(*) FROM FileVersion INNER JOIN FileInfo ON FileVersion.FileID = FileInfo.FileID WHERE FileInfo.UserID = ? AND FileInfo.IsDir = 0;`
+	setUserOverQuotaSince = `UPDATE UserStats SET OverQuotaSince = ? WHERE UserID = ?;`
+
+	// getUserQuotaState counts the allocation, stored and logical, of the
+	// namespaces sharing the user's quota along with the user's own
+	getUserQuotaState = `SELECT Quota, (SELECT SUM(Shared.Allocated - Shared.Deduplicated) FROM UserStats AS Shared WHERE ` + quotaSharers + `),
+					(SELECT SUM(Shared.Allocated) FROM UserStats AS Shared WHERE ` + quotaSharers + `),
+					OverQuotaSince FROM UserStats WHERE UserID = ?;`
+	quotaSharers = `(Shared.UserID = UserStats.UserID
+					OR Shared.UserID IN (SELECT UserID FROM Namespaces WHERE OwnerID = UserStats.UserID AND SharedQuota = 1))`
+
+	// selectFileInfos selects the columns scanned by queryUserFileInfos
+	selectFileInfos = `SELECT FileInfo.FileID, FileInfo.FileName, FileInfo.IsDir, FileInfo.CurrentVersionID,
+					FileInfo.ExpiresAt, FileInfo.CreatedAt, FileInfo.Device, FileInfo.Starred FROM FileInfo`
+
+	// files in the trash are left out of the queries that look up files
+	// so that they can only be restored or removed for good
+	addFileInfo = `INSERT INTO FileInfo (UserID, FileName, IsDir, CurrentVersionID, CreatedAt) SELECT ?, ?, ?, ?, ?
+                        WHERE NOT EXISTS (SELECT 1 FROM FileInfo WHERE UserID = ? AND FileName = ? AND TrashedAt = 0);`
+	getFileInfo             = `SELECT UserID, FileName, IsDir, CurrentVersionID FROM FileInfo WHERE FileID = ? AND TrashedAt = 0;`
+	getFileInfoByName       = `SELECT FileID, IsDir, CurrentVersionID FROM FileInfo WHERE FileName = ? AND UserID = ? AND TrashedAt = 0;`
+	getFileInfoOwner        = `SELECT UserID  FROM FileInfo WHERE FileID = ? AND TrashedAt = 0;`
+	getFileCurrentVersionID = `SELECT CurrentVersionID FROM FileInfo WHERE FileID = ?;`
+	getAllUserFiles         = selectFileInfos + ` WHERE UserID = ? AND TrashedAt = 0;`
+	getFileDetails          = `SELECT ExpiresAt, CreatedAt, Device, Starred FROM FileInfo WHERE FileID = ?;`
+	removeFileInfoByID      = `DELETE FROM FileInfo WHERE FileID = ?;`
+	setFileCurrentVersion   = `UPDATE FileInfo SET CurrentVersionID = ? WHERE FileID = ?;`
+	renameFileInfo          = `UPDATE FileInfo SET FileName = ? WHERE FileID = ?;`
+
+	addFileVersion                = `INSERT INTO FileVersion (FileID, VersionNum, Perms, LastMod, ChunkCount, FileHash, CreatedAt) VALUES (?, ?, ?, ?, ?, ?, ?);`
+	updateFileVersion             = `UPDATE FileVersion SET LastMod = ?, ChunkCount = ?, FileHash = ?, MerkleRoot = '' WHERE VersionID = ? AND FileID = ?;`
+	setFileVersionMerkleRoot      = `UPDATE FileVersion SET MerkleRoot = ? WHERE VersionID = ? AND FileID = ?;`
+	getFileVersionByID            = `SELECT VersionNum, Perms, LastMod, ChunkCount, FileHash, MerkleRoot, CreatedAt, Device FROM FileVersion WHERE VersionID = ?;`
+	getFileVersionChunkCount      = `SELECT ChunkCount, MerkleRoot FROM FileVersion WHERE VersionID = ? AND FileID = ?;`
 	removeAllFileVersionsByFileID = `DELETE FROM FileVersion WHERE FileID = ?;`
 	removeFileVersionsByFileID    = `DELETE FROM FileVersion WHERE FileID = ? AND (VersionNum BETWEEN ? AND ?);`
-	getVersionsForFile            = `SELECT VersionID, VersionNum, Perms, LastMod, ChunkCount, FileHash FROM FileVersion WHERE FileID = ?;`
+	getVersionsForFile            = `SELECT VersionID, VersionNum, Perms, LastMod, ChunkCount, FileHash, MerkleRoot, CreatedAt, Device FROM FileVersion WHERE FileID = ?;`
 	getVersionsCountForFile       = `SELECT COUNT(*) AS COUNT FROM FileVersion WHERE FileID = ? AND (VersionNum BETWEEN ? AND ?);`
-	getFileVersionsTotalChunkSize = `SELECT SUM(LENGTH(Chunk)) FROM FileChunks 
+	getFileVersionsTotalChunkSize = `SELECT IFNULL(SUM(ChunkSize), 0) FROM FileChunks 
 					INNER JOIN FileVersion on FileChunks.VersionID = FileVersion.VersionID
 					WHERE FileChunks.FileID = ? AND (VersionNum BETWEEN ? AND ?);`
+	getRetentionCutoffs = `SELECT FileInfo.FileID, FileInfo.UserID,
+					(SELECT VersionNum FROM FileVersion WHERE FileVersion.FileID = FileInfo.FileID ORDER BY VersionNum DESC LIMIT 1 OFFSET ?),
+					IFNULL((SELECT VersionNum FROM FileVersion WHERE FileVersion.VersionID = FileInfo.CurrentVersionID), 0)
+					FROM FileInfo WHERE FileInfo.IsDir = 0 AND FileInfo.TrashedAt = 0
+					AND (SELECT COUNT(*) FROM FileVersion WHERE FileVersion.FileID = FileInfo.FileID) > ?;`
 	removeAllFileVersionChunks = `DELETE FROM FileChunks
 					WHERE ChunkID in (
 						SELECT ChunkID FROM FileChunks
@@ -104,21 +209,98 @@ const (
 						WHERE FileChunks.FileID = ? AND (VersionNum BETWEEN ? AND ?)
 					);`
 
-	getAllFileChunksByID  = `SELECT ChunkNum, ChunkHash FROM FileChunks WHERE FileID = ? AND VersionID = ?;`
-	addFileChunk          = `INSERT OR REPLACE INTO FileChunks (FileID, VersionID, ChunkNum, ChunkHash, Chunk) VALUES (?, ?, ?, ?, ?);`
-	removeAllFileChunks   = `DELETE FROM FileChunks WHERE FileID = ?;`
-	removeFileChunk       = `DELETE FROM FileChunks WHERE FileID = ? AND VersionID = ? AND ChunkNum = ?;`
-	getFileChunk          = `SELECT ChunkHash, Chunk FROM FileChunks WHERE FileID = ? AND VersionID = ? AND ChunkNum = ?;`
-	getFileTotalChunkSize = `SELECT SUM(LENGTH(Chunk)) FROM FileChunks WHERE FileID = ?;`
+	getAllFileChunksByID = `SELECT ChunkNum, ChunkHash FROM FileChunks WHERE FileID = ? AND VersionID = ?;`
+	addFileChunk         = `INSERT OR REPLACE INTO FileChunks (FileID, VersionID, ChunkNum, ChunkHash, Chunk, ChunkSize, StoreKey, ChunkDataID) VALUES (?, ?, ?, ?, ?, ?, ?, ?);`
+	removeAllFileChunks  = `DELETE FROM FileChunks WHERE FileID = ?;`
+	removeFileChunk      = `DELETE FROM FileChunks WHERE FileID = ? AND VersionID = ? AND ChunkNum = ?;`
+	getFileChunk         = `SELECT FileChunks.ChunkHash, IFNULL(ChunkData.Chunk, FileChunks.Chunk), IFNULL(ChunkData.StoreKey, FileChunks.StoreKey) FROM FileChunks
+					LEFT JOIN ChunkData ON FileChunks.ChunkDataID = ChunkData.ChunkDataID
+					WHERE FileChunks.FileID = ? AND FileChunks.VersionID = ? AND FileChunks.ChunkNum = ?;`
+	getFileChunkLength    = `SELECT ChunkHash, ChunkSize FROM FileChunks WHERE FileID = ? AND VersionID = ? AND ChunkNum = ?;`
+	getFileTotalChunkSize = `SELECT SUM(ChunkSize) FROM FileChunks WHERE FileID = ?;`
+	getVersionChunkSize   = `SELECT IFNULL(SUM(ChunkSize), 0) FROM FileChunks WHERE FileID = ? AND VersionID = ?;`
 	getNumberOfFileChunks = `SELECT COUNT(*) AS COUNT FROM FileChunks WHERE FileID = ?;`
 
 	removeUser = `DELETE FROM FileChunks WHERE FileID IN (SELECT FileID FROM FileInfo WHERE UserID = ?);
 		DELETE FROM FileVersion WHERE FileID IN (SELECT FileID FROM FileInfo WHERE UserID = ?);
+		DELETE FROM FileSearchTokens WHERE FileID IN (SELECT FileID FROM FileInfo WHERE UserID = ?);
+		DELETE FROM FileNotes WHERE FileID IN (SELECT FileID FROM FileInfo WHERE UserID = ?);
+		DELETE FROM FileTags WHERE FileID IN (SELECT FileID FROM FileInfo WHERE UserID = ?);
+		DELETE FROM FileAttributes WHERE FileID IN (SELECT FileID FROM FileInfo WHERE UserID = ?);
+		DELETE FROM RekeyFiles WHERE FileID IN (SELECT FileID FROM FileInfo WHERE UserID = ?);
 		DELETE FROM FileInfo WHERE UserID = ?;
         DELETE FROM UserStats WHERE UserID = ?;
+        DELETE FROM QuotaNotices WHERE UserID = ?;
+        DELETE FROM Namespaces WHERE UserID = ?;
+        DELETE FROM WebDAVLocks WHERE UserID = ?;
         DELETE FROM Users WHERE UserID = ?;`
 )
 
+// dbUpgrades maps a database version number to the statements that will
+// upgrade the tables from that version to the next one.
+var dbUpgrades = map[int][]string{
+	1: {
+		`ALTER TABLE Users ADD COLUMN IsAdmin INTEGER NOT NULL DEFAULT 0;`,
+	},
+	2: {
+		`ALTER TABLE Users ADD COLUMN LastLogin INTEGER NOT NULL DEFAULT 0;`,
+	},
+	3: {
+		`ALTER TABLE Users ADD COLUMN Status TEXT NOT NULL DEFAULT 'active';`,
+	},
+	4: {
+		`ALTER TABLE FileVersion ADD COLUMN MerkleRoot TEXT NOT NULL DEFAULT '';`,
+	},
+	5: {
+		`ALTER TABLE UserStats ADD COLUMN OverQuotaSince INTEGER NOT NULL DEFAULT 0;`,
+	},
+	6: {
+		`ALTER TABLE FileInfo ADD COLUMN TrashedAt INTEGER NOT NULL DEFAULT 0;`,
+	},
+	7: {
+		`ALTER TABLE FileInfo ADD COLUMN ExpiresAt INTEGER NOT NULL DEFAULT 0;`,
+	},
+	8: {
+		`ALTER TABLE FileInfo ADD COLUMN CreatedAt INTEGER NOT NULL DEFAULT 0;`,
+		`ALTER TABLE FileInfo ADD COLUMN Device TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE FileVersion ADD COLUMN CreatedAt INTEGER NOT NULL DEFAULT 0;`,
+		`ALTER TABLE FileVersion ADD COLUMN Device TEXT NOT NULL DEFAULT '';`,
+	},
+	9: {
+		`ALTER TABLE FileInfo ADD COLUMN Starred INTEGER NOT NULL DEFAULT 0;`,
+	},
+	10: {
+		`ALTER TABLE Users ADD COLUMN CaseInsensitive INTEGER NOT NULL DEFAULT 0;`,
+		`ALTER TABLE FileInfo ADD COLUMN NameKey TEXT NOT NULL DEFAULT '';`,
+	},
+	11: {
+		`ALTER TABLE FileChunks ADD COLUMN ChunkSize INTEGER NOT NULL DEFAULT 0;`,
+		`ALTER TABLE FileChunks ADD COLUMN StoreKey TEXT NOT NULL DEFAULT '';`,
+		`UPDATE FileChunks SET ChunkSize = LENGTH(Chunk);`,
+	},
+	12: {
+		`ALTER TABLE FileChunks ADD COLUMN ChunkDataID INTEGER NOT NULL DEFAULT 0;`,
+	},
+	13: {
+		`ALTER TABLE UserStats ADD COLUMN Deduplicated INTEGER NOT NULL DEFAULT 0;`,
+		`INSERT INTO ChunkDataRefs (ChunkDataID, UserID, RefCount)
+			SELECT FileChunks.ChunkDataID, FileInfo.UserID, COUNT(*) FROM FileChunks INNER JOIN FileInfo ON FileChunks.FileID = FileInfo.FileID
+			WHERE FileChunks.ChunkDataID <> 0 GROUP BY FileChunks.ChunkDataID, FileInfo.UserID;`,
+		`UPDATE UserStats SET Deduplicated = (SELECT IFNULL(SUM((ChunkDataRefs.RefCount - 1) * ChunkData.ChunkSize), 0) FROM ChunkDataRefs
+			INNER JOIN ChunkData ON ChunkDataRefs.ChunkDataID = ChunkData.ChunkDataID WHERE ChunkDataRefs.UserID = UserStats.UserID);`,
+	},
+}
+
+// The account statuses of a user.
+const (
+	// UserStatusActive is the status of a user that can log in.
+	UserStatusActive = "active"
+
+	// UserStatusSuspended is the status of a user that an administrator has
+	// suspended. The user can't log in but their files are kept.
+	UserStatusSuspended = "suspended"
+)
+
 // FileInfo contains the information stored about a given file for a particular user.
 type FileInfo struct {
 	UserID         int
@@ -126,6 +308,19 @@ type FileInfo struct {
 	FileName       string
 	IsDir          bool
 	CurrentVersion FileVersionInfo
+
+	// ExpiresAt is the unix time the file is removed at; zero if the file
+	// doesn't expire.
+	ExpiresAt int64
+
+	// CreatedAt is the unix time the file was added to the server and
+	// Device identifies the client that added it; both are empty for files
+	// added before they were tracked.
+	CreatedAt int64
+	Device    string
+
+	// Starred is true if the user marked the file as a favorite.
+	Starred bool
 }
 
 // FileVersionInfo contains the version-specific information for a given file.
@@ -136,6 +331,17 @@ type FileVersionInfo struct {
 	LastMod       int64
 	ChunkCount    int
 	FileHash      string
+
+	// MerkleRoot is the root of the Merkle tree over the chunk hashes of
+	// the version as computed by MerkleRoot; empty if the client that
+	// uploaded the version didn't record one.
+	MerkleRoot string
+
+	// CreatedAt is the unix time the version was added to the server, as
+	// opposed to LastMod which comes from the client's file system, and
+	// Device identifies the client that uploaded it; empty if unknown.
+	CreatedAt int64
+	Device    string
 }
 
 // FileChunk contains the information stored about a given file chunk.
@@ -155,13 +361,75 @@ type User struct {
 	Salt       string
 	SaltedHash []byte
 	CryptoHash []byte // a bcrypt hash used to verify the bcrypt hash of the crypto password
+	IsAdmin    bool
+	Status     string // one of the UserStatus* constants
+
+	// CaseInsensitive is true if the user's files must have distinct name
+	// keys, so that names differing only by case refer to the same file.
+	CaseInsensitive bool
+}
+
+// NewUser is the information needed to create a user with AddUsers.
+type NewUser struct {
+	Name       string
+	Salt       string
+	SaltedHash []byte
+	Quota      int
 }
 
 // UserStats contains the user specific state information to track data usage.
 type UserStats struct {
-	Quota     int
+	Quota int
+
+	// Allocated is the number of bytes stored for the user, which is what
+	// counts towards the quota. Chunks sharing their data with other chunks
+	// of the user only count once.
 	Allocated int
-	Revision  int
+
+	// Logical is the size of all of the user's chunks, counting every chunk
+	// in full even when it shares its data.
+	Logical int
+
+	Revision int
+
+	// OverQuotaSince is when the user's allocation went over the quota and
+	// the grace period started; zero if the allocation is within the quota.
+	OverQuotaSince time.Time
+}
+
+// UserSummary combines the basic user information with the usage statistics
+// and is used for administrative overviews of all users.
+type UserSummary struct {
+	ID           int
+	Name         string
+	IsAdmin      bool
+	Status       string // one of the UserStatus* constants
+	Quota        int
+	Allocated    int
+	Revision     int
+	FileCount    int
+	VersionCount int
+	LastLogin    int64 // unix time of the last login; zero if the user never logged in
+}
+
+// UsageSnapshot is the recorded usage for a user on a given day and is
+// used to report storage growth over time.
+type UsageSnapshot struct {
+	Day          string // formatted as YYYY-MM-DD in UTC
+	UserID       int
+	Allocated    int
+	FileCount    int
+	VersionCount int
+}
+
+// FileSize is the number of bytes a file takes up in storage across all of
+// its versions. It deliberately leaves out the file name so that it can be
+// shown to administrators without revealing anything about the contents.
+type FileSize struct {
+	UserID       int
+	FileID       int
+	Size         int64
+	VersionCount int // the number of versions with chunks in storage
 }
 
 // Storage is the backend data model for the file storage logic.
@@ -169,42 +437,128 @@ type Storage struct {
 	// ChunkSize is the number of bytes the chunk can maximally be
 	ChunkSize int64
 
+	// SlowQueryThreshold is the duration a storage operation can take before
+	// it gets reported to SlowQueryLog. Zero disables the reporting.
+	SlowQueryThreshold time.Duration
+
+	// SlowQueryLog is called for every storage operation that takes longer
+	// than SlowQueryThreshold; nil disables the reporting.
+	SlowQueryLog SlowQueryFunc
+
+	// HardQuotaPercent is the percentage of a user's quota that the user's
+	// allocation may grow to for QuotaGracePeriod after it first goes over
+	// the quota, which then acts as a soft limit. At 100 or below the quota
+	// is a hard limit.
+	HardQuotaPercent int
+
+	// QuotaGracePeriod is how long a user's allocation may stay over the
+	// quota, up to the hard limit, before uploads are refused.
+	QuotaGracePeriod time.Duration
+
+	// MaxFiles and MaxVersions limit the number of files and the total
+	// number of file versions each user can have. Directories don't count
+	// since clients create the missing parents of the files they put.
+	// Zero means no limit.
+	MaxFiles    int
+	MaxVersions int
+
+	// MaxFileSize limits the size in bytes of a single file version, as
+	// counted in whole chunks. Zero means no limit.
+	MaxFileSize int64
+
+	// StorageCap limits the total bytes allocated by all users so that the
+	// host disk can't fill up completely. Zero means no limit.
+	StorageCap int64
+
+	// TransferLimit limits the chunk bytes each user can upload and
+	// download together in a calendar month. Zero means no limit.
+	TransferLimit int64
+
+	// TrashRetention is how long removed files are kept in the user's trash,
+	// where they can be restored, before they are removed for good. Zero
+	// means files are removed right away.
+	TrashRetention time.Duration
+
+	// JournalChunkRetention is how long the chunks of the versions removed
+	// for good are kept so that ReplayJournal can bring them back along
+	// with the versions. The kept chunks don't count towards the users'
+	// allocations. Zero doesn't keep them.
+	JournalChunkRetention time.Duration
+
+	// ChunkStore keeps the data of new chunks outside of the database, in
+	// a directory or an object storage bucket; nil keeps it in the
+	// database. Chunks added before it was set stay in the database and can
+	// still be read.
+	ChunkStore ChunkStore
+
 	// db is the database connection
 	db *sql.DB
+
+	// provider is the database engine of db
+	provider StorageProvider
 }
 
-// NewStorage creates a new Storage object using the sqlite3
-// driver at the path given.
+// SlowQueryFunc is the callback used to report storage operations that took
+// longer than the slow query threshold. The userID is NoUserID for operations
+// that aren't bound to a user.
+type SlowQueryFunc func(operation string, userID int, elapsed time.Duration)
+
+// MaxChunkOverhead is how many bytes a stored chunk may exceed the chunk size
+// by to leave room for the nonce and authentication tag added by encryption.
+const MaxChunkOverhead = 128
+
+// NoUserID is the user ID reported for storage operations that aren't
+// bound to a user.
+const NoUserID = -1
+
+// NewStorage creates a new Storage object for the database at the path
+// given, which is a PostgreSQL database for a postgres:// URL, a MySQL
+// database for a mysql:// or mariadb:// URL and a sqlite3 database file
+// otherwise.
 func NewStorage(dbPath string) (*Storage, error) {
-	db, err := sql.Open("sqlite3", dbPath)
-	if err != nil {
-		return nil, fmt.Errorf("could not open the database (%s): %v", dbPath, err)
-	}
+	return NewStorageWithProvider(ProviderFor(dbPath), dbPath)
+}
 
-	// make sure we can hit the database by pinging it; this
-	// will detect potential connection problems early.
-	err = db.Ping()
+// NewStorageWithProvider creates a new Storage object for the database at
+// dataSource kept by the provider.
+func NewStorageWithProvider(provider StorageProvider, dataSource string) (*Storage, error) {
+	db, err := provider.Open(dataSource)
 	if err != nil {
-		return nil, fmt.Errorf("could not ping the open database (%s): %v", dbPath, err)
+		return nil, err
 	}
 
-	// enable write-ahead logging for sqlite tx journaling
-	// (about 5x write perf increase for smaller writes for databases on the filesystem)
-	_, err = db.Exec("PRAGMA main.journal_mode=WAL;")
+	s := new(Storage)
+	s.db = db
+	s.provider = provider
+	s.ChunkSize = 1024 * 1024 * 4 // 4MB
+	return s, nil
+}
+
+// memoryStorageCount numbers the databases made by NewMemoryStorage so that
+// each one gets a unique name.
+var memoryStorageCount int64
+
+// NewMemoryStorage creates a new Storage object, with its tables created,
+// that is kept entirely in memory and never touches the filesystem. Each
+// call returns a separate, empty database which is discarded when the
+// Storage is closed, making it suitable for tests. The database is still a
+// sqlite3 one, so it needs cgo like NewStorage does.
+func NewMemoryStorage() (*Storage, error) {
+	n := atomic.AddInt64(&memoryStorageCount, 1)
+	s, err := NewStorageWithProvider(SQLiteProvider{}, fmt.Sprintf("file:freezermem%d?mode=memory&cache=shared", n))
 	if err != nil {
-		return nil, fmt.Errorf("Failed to set the journal_mode pragma: %v", err)
+		return nil, err
 	}
 
-	// enable NORMAL mode instead of the default FULL mode for fs sync
-	// (about 30x write perf increase for smaller writes for databases on the filesystem)
-	_, err = db.Exec("PRAGMA main.synchronous=NORMAL;")
+	// the database lives only as long as a connection to it is open,
+	// so keep one from being closed while it's idle
+	s.db.SetMaxIdleConns(1)
+
+	err = s.CreateTables()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to set the synchronous pragma: %v", err)
+		s.Close()
+		return nil, err
 	}
-
-	s := new(Storage)
-	s.db = db
-	s.ChunkSize = 1024 * 1024 * 4 // 4MB
 	return s, nil
 }
 
@@ -216,7 +570,18 @@ func (s *Storage) Close() {
 // CreateTables will create the tables needed in the database if they
 // don't already exist. If the tables already exist an error will be returned.
 func (s *Storage) CreateTables() error {
-	_, err := s.db.Exec(createAppDataTable)
+	defer s.timeOperation("CreateTables", NoUserID)()
+
+	// the tables of a database from before file versions have to be
+	// converted first or they'd be taken for the current ones
+	legacy, err := s.IsLegacyDatabase()
+	if err != nil {
+		return err
+	} else if legacy {
+		return ErrLegacyDatabase
+	}
+
+	_, err = s.db.Exec(createAppDataTable)
 	if err != nil {
 		return fmt.Errorf("failed to create the APPDATA table: %v", err)
 	}
@@ -246,8 +611,87 @@ func (s *Storage) CreateTables() error {
 		return fmt.Errorf("failed to create the FILECHUNKS table: %v", err)
 	}
 
+	_, err = s.db.Exec(createChunkDataTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the CHUNKDATA table: %v", err)
+	}
+
+	_, err = s.db.Exec(createChunkDataRefsTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the CHUNKDATAREFS table: %v", err)
+	}
+
+	_, err = s.db.Exec(createUsageSnapshotsTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the USAGESNAPSHOTS table: %v", err)
+	}
+
+	_, err = s.db.Exec(createSharedSecretsTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the SHAREDSECRETS table: %v", err)
+	}
+
+	_, err = s.db.Exec(createJobLocksTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the JOBLOCKS table: %v", err)
+	}
+
+	_, err = s.db.Exec(createQuotaNoticesTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the QUOTANOTICES table: %v", err)
+	}
+
+	_, err = s.db.Exec(createMetadataJournalTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the METADATAJOURNAL table: %v", err)
+	}
+
+	_, err = s.db.Exec(createJournalChunksTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the JOURNALCHUNKS table: %v", err)
+	}
+
+	_, err = s.db.Exec(createTransferUsageTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the TRANSFERUSAGE table: %v", err)
+	}
+
+	_, err = s.db.Exec(createFileSearchTokensTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the FILESEARCHTOKENS table: %v", err)
+	}
+
+	_, err = s.db.Exec(createFileNotesTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the FILENOTES table: %v", err)
+	}
+
+	_, err = s.db.Exec(createFileTagsTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the FILETAGS table: %v", err)
+	}
+
+	_, err = s.db.Exec(createFileAttributesTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the FILEATTRIBUTES table: %v", err)
+	}
+
+	_, err = s.db.Exec(createNamespacesTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the NAMESPACES table: %v", err)
+	}
+
+	_, err = s.db.Exec(createRekeyFilesTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the REKEYFILES table: %v", err)
+	}
+
+	_, err = s.db.Exec(createWebDAVLocksTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the WEBDAVLOCKS table: %v", err)
+	}
+
 	// do some initialization if necessary
-	// TODO: Update database tables if there's a version bump.
 	var dbVersion int
 	err = s.db.QueryRow(getAppDBVersion).Scan(&dbVersion)
 	if err == sql.ErrNoRows {
@@ -257,13 +701,41 @@ func (s *Storage) CreateTables() error {
 		}
 	} else if err != nil {
 		return fmt.Errorf("failed to get the DBVersion from the AppData table: %v", err)
+	} else if dbVersion < CurrentDBVersion {
+		err = s.upgradeTables(dbVersion)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// upgradeTables runs all of the upgrade statements needed to bring a database
+// at fromVersion up to CurrentDBVersion within one transaction.
+func (s *Storage) upgradeTables(fromVersion int) error {
+	return s.transact(func(tx *sql.Tx) error {
+		for v := fromVersion; v < CurrentDBVersion; v++ {
+			for _, stmt := range dbUpgrades[v] {
+				_, err := tx.Exec(stmt)
+				if err != nil {
+					return fmt.Errorf("failed to upgrade the database from version %d: %v", v, err)
+				}
+			}
+		}
+
+		_, err := tx.Exec(updateAppDBVersion, CurrentDBVersion)
+		if err != nil {
+			return fmt.Errorf("failed to update the DBVersion in the AppData table: %v", err)
+		}
+		return nil
+	})
+}
+
 // GetDBVersion will return the DB Version number for the opened database.
 func (s *Storage) GetDBVersion() (int, error) {
+	defer s.timeOperation("GetDBVersion", NoUserID)()
+
 	var dbVersion int
 	err := s.db.QueryRow(getAppDBVersion).Scan(&dbVersion)
 	if err != nil {
@@ -276,6 +748,8 @@ func (s *Storage) GetDBVersion() (int, error) {
 // IsUsernameFree will return true if there is not already a username with the
 // same text in the Users table.
 func (s *Storage) IsUsernameFree(username string) (bool, error) {
+	defer s.timeOperation("IsUsernameFree", NoUserID)()
+
 	// attempt to see if the username is already taken
 	rows, err := s.db.Query(lookupUserByName, username)
 	if err != nil {
@@ -307,6 +781,8 @@ func (s *Storage) IsUsernameFree(username string) (bool, error) {
 // This function returns a true bool value if a user was created and false if
 // the user was not created (e.g. username was already taken).
 func (s *Storage) AddUser(username string, salt string, saltedHash []byte, quota int) (*User, error) {
+	defer s.timeOperation("AddUser", NoUserID)()
+
 	// insert the user into the table ... username uniqueness is enforced
 	// as a sql ON CONFLICT ABORT which will fail the INSERT and return an err here.
 	res, err := s.db.Exec(addUser, username, salt, saltedHash)
@@ -344,12 +820,52 @@ func (s *Storage) AddUser(username string, salt string, saltedHash []byte, quota
 	return u, nil
 }
 
+// AddUsers creates all of the users in one transaction so that either every
+// user is created or, if any of them fails (e.g. a username is already
+// taken), none of them are. The created users are returned in the same order.
+func (s *Storage) AddUsers(users []NewUser) ([]*User, error) {
+	defer s.timeOperation("AddUsers", NoUserID)()
+
+	added := make([]*User, 0, len(users))
+	err := s.transact(func(tx *sql.Tx) error {
+		for _, nu := range users {
+			res, err := tx.Exec(addUser, nu.Name, nu.Salt, nu.SaltedHash)
+			if err != nil {
+				return fmt.Errorf("failed to insert the new user (%s): %v", nu.Name, err)
+			}
+			insertedID, err := res.LastInsertId()
+			if err != nil {
+				return fmt.Errorf("failed to get the id for the new user (%s): %v", nu.Name, err)
+			}
+			_, err = tx.Exec(setUserStats, insertedID, nu.Quota, 0, 0)
+			if err != nil {
+				return fmt.Errorf("failed to set the new user's (%s) stats in the database: %v", nu.Name, err)
+			}
+
+			u := new(User)
+			u.ID = int(insertedID)
+			u.Name = nu.Name
+			u.Salt = nu.Salt
+			u.SaltedHash = nu.SaltedHash
+			added = append(added, u)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return added, nil
+}
+
 // GetUser queries the Users table for a given username and returns the associated data.
 // If the query fails and error will be returned.
 func (s *Storage) GetUser(username string) (*User, error) {
+	defer s.timeOperation("GetUser", NoUserID)()
+
 	user := new(User)
 	user.Name = username
-	err := s.db.QueryRow(getUser, username).Scan(&user.ID, &user.Salt, &user.SaltedHash, &user.CryptoHash)
+	err := s.db.QueryRow(getUser, username).Scan(&user.ID, &user.Salt, &user.SaltedHash, &user.CryptoHash, &user.IsAdmin, &user.Status, &user.CaseInsensitive)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get the user information from the database: %v", err)
 	}
@@ -357,110 +873,575 @@ func (s *Storage) GetUser(username string) (*User, error) {
 	return user, nil
 }
 
-// RemoveUser removes user and all files and file chunks associated with the user.
-func (s *Storage) RemoveUser(username string) error {
-	// make sure we have a user to begin with
-	user, err := s.GetUser(username)
-	if err != nil {
-		return fmt.Errorf("Failed to find the user in the database: %v", err)
-	}
+// GetUserByID queries the Users table for a given user id and returns the associated data.
+// If the query fails and error will be returned.
+func (s *Storage) GetUserByID(userID int) (*User, error) {
+	defer s.timeOperation("GetUserByID", userID)()
 
-	_, err = s.db.Exec(removeUser, user.ID, user.ID, user.ID, user.ID, user.ID)
+	user := new(User)
+	user.ID = userID
+	err := s.db.QueryRow(getUserByID, userID).Scan(&user.Name, &user.Salt, &user.SaltedHash, &user.CryptoHash, &user.IsAdmin, &user.Status, &user.CaseInsensitive)
 	if err != nil {
-		return fmt.Errorf("failed to remove the user %s (id: %d): %v", user.Name, user.ID, err)
+		return nil, fmt.Errorf("failed to get the user information from the database: %v", err)
 	}
 
-	return nil
+	return user, nil
 }
 
-// UpdateUserCryptoHash changes the cryptoHash for a given userID.
-// This will fail if the userID doesn't exist.
-func (s *Storage) UpdateUserCryptoHash(userID int, cryptoHash []byte) error {
-	res, err := s.db.Exec(setUserCryptoHash, cryptoHash, userID)
-	if err != nil {
-		return fmt.Errorf("failed to update the user's cryptohash (%d): %v", userID, err)
-	}
+// GetAllUserSummaries returns the basic information and usage statistics
+// for every user in storage ordered by user id.
+func (s *Storage) GetAllUserSummaries() ([]UserSummary, error) {
+	defer s.timeOperation("GetAllUserSummaries", NoUserID)()
 
-	// make sure one row was affected
-	affected, err := res.RowsAffected()
-	if affected != 1 {
-		return fmt.Errorf("failed to update user's cryptohash in the database; no rows were affected")
-	} else if err != nil {
-		return fmt.Errorf("failed to update user's cryptohash in the database: %v", err)
+	rows, err := s.db.Query(getAllUserSummaries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the user summaries from the database: %v", err)
 	}
-
-	return nil
+	return scanUserSummaries(rows)
 }
 
-// UpdateUser changes the salt, saltedHash, cryptoHash and quota for a given userID.
-// This will fail if the userID doesn't exist.
-func (s *Storage) UpdateUser(userID int, name string, salt string, saltedHash []byte, cryptoHash []byte, quota int) error {
-	res, err := s.db.Exec(updateUser, name, salt, saltedHash, cryptoHash, userID)
+// GetUserSummaries returns the basic information and usage statistics for
+// at most limit users, ordered by user id, starting after the first offset
+// users. The total number of users is returned as well so that callers can
+// page through all of them.
+func (s *Storage) GetUserSummaries(offset int, limit int) ([]UserSummary, int, error) {
+	defer s.timeOperation("GetUserSummaries", NoUserID)()
+
+	var total int
+	err := s.db.QueryRow(countUserSummaries).Scan(&total)
 	if err != nil {
-		return fmt.Errorf("failed to update the user (%d): %v", userID, err)
+		return nil, 0, fmt.Errorf("failed to count the users in the database: %v", err)
 	}
 
-	// make sure one row was affected
-	affected, err := res.RowsAffected()
-	if affected != 1 {
-		return fmt.Errorf("failed to update user in the database; no rows were affected")
-	} else if err != nil {
-		return fmt.Errorf("failed to update user in the database: %v", err)
+	rows, err := s.db.Query(getUserSummariesPage, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get the user summaries from the database: %v", err)
 	}
-
-	// with the user added, the user stats row needs to get created with
-	// the quota and usage statistics
-	err = s.SetUserQuota(userID, quota)
+	result, err := scanUserSummaries(rows)
 	if err != nil {
-		return fmt.Errorf("failed to set the user's updated quota in the database: %v", err)
+		return nil, 0, err
 	}
 
-	return nil
+	return result, total, nil
 }
 
-// SetUserQuota sets the user quota for a user by user id.
-func (s *Storage) SetUserQuota(userID int, quota int) error {
-	res, err := s.db.Exec(setUserQuota, quota, userID)
+// GetUserSummary returns the basic information and usage statistics for
+// a given user id.
+func (s *Storage) GetUserSummary(userID int) (*UserSummary, error) {
+	defer s.timeOperation("GetUserSummary", userID)()
+
+	rows, err := s.db.Query(getUserSummary, userID)
 	if err != nil {
-		return fmt.Errorf("failed to set the user quota in the database: %v", err)
+		return nil, fmt.Errorf("failed to get the user summary from the database: %v", err)
+	}
+	result, err := scanUserSummaries(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(result) != 1 {
+		return nil, fmt.Errorf("failed to find the user summary for user id %d", userID)
 	}
 
-	// make sure one row was affected
-	affected, err := res.RowsAffected()
-	if affected != 1 {
-		return fmt.Errorf("failed to set the user stats in the database; no rows were affected")
-	} else if err != nil {
-		return fmt.Errorf("failed to set the user stats in the database: %v", err)
+	return &result[0], nil
+}
+
+// scanUserSummaries reads all of the user summaries from the rows of one of
+// the user summary queries and closes the rows.
+func scanUserSummaries(rows *sql.Rows) ([]UserSummary, error) {
+	defer rows.Close()
+
+	result := []UserSummary{}
+	for rows.Next() {
+		var us UserSummary
+		err := rows.Scan(&us.ID, &us.Name, &us.IsAdmin, &us.Status, &us.LastLogin, &us.Quota, &us.Allocated, &us.Revision, &us.FileCount, &us.VersionCount)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing user summaries: %v", err)
+		}
+		result = append(result, us)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan all of the user summaries: %v", err)
 	}
 
-	return nil
+	return result, nil
 }
 
-// SetUserStats sets the user information for a user by user id and is used to
-// do the first insertion of the user into the stats table.
-func (s *Storage) SetUserStats(userID int, quota int, allocated int, revision int) error {
-	res, err := s.db.Exec(setUserStats, userID, quota, allocated, revision)
+// GetLargestFiles returns the at most limit files of each user that take up
+// the most space in storage, largest first, grouped by user id. Files
+// without any chunks are left out.
+func (s *Storage) GetLargestFiles(limit int) ([]FileSize, error) {
+	defer s.timeOperation("GetLargestFiles", NoUserID)()
+
+	rows, err := s.db.Query(getFileSizes)
 	if err != nil {
-		return fmt.Errorf("failed to set the user stats in the database: %v", err)
+		return nil, fmt.Errorf("failed to get the file sizes from the database: %v", err)
 	}
+	defer rows.Close()
 
-	// make sure one row was affected
-	affected, err := res.RowsAffected()
-	if affected != 1 {
-		return fmt.Errorf("failed to set the user stats in the database; no rows were affected")
-	} else if err != nil {
-		return fmt.Errorf("failed to set the user stats in the database: %v", err)
+	result := []FileSize{}
+	userID, count := NoUserID, 0
+	for rows.Next() {
+		var fs FileSize
+		err := rows.Scan(&fs.UserID, &fs.FileID, &fs.Size, &fs.VersionCount)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing file sizes: %v", err)
+		}
+
+		// the rows are ordered by user and then size so only the first
+		// rows of each user are kept
+		if fs.UserID != userID {
+			userID, count = fs.UserID, 0
+		}
+		if count < limit {
+			result = append(result, fs)
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan all of the file sizes: %v", err)
 	}
 
-	return nil
+	return result, nil
 }
 
-// UpdateUserStats increments the user's revision by one and updates the allocated
-// byte counter with the new delta.
-func (s *Storage) UpdateUserStats(userID int, allocDelta int) error {
-	res, err := s.db.Exec(updateUserStats, allocDelta, userID)
+// SetUserLastLogin records t as the time the user last logged in.
+func (s *Storage) SetUserLastLogin(userID int, t time.Time) error {
+	defer s.timeOperation("SetUserLastLogin", userID)()
+
+	_, err := s.db.Exec(setUserLastLogin, t.Unix(), userID)
 	if err != nil {
-		return fmt.Errorf("failed to update the user stats in the database: %v", err)
+		return fmt.Errorf("failed to set the user's last login time (%d): %v", userID, err)
+	}
+	return nil
+}
+
+// UsageSnapshotDay returns the day string used to identify the usage snapshot
+// that the time t falls within.
+func UsageSnapshotDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// TakeUsageSnapshot records the current usage of every user as the snapshot
+// for the day that t falls within. Taking another snapshot on the same day
+// replaces the earlier one so the last snapshot of a day is what's kept.
+func (s *Storage) TakeUsageSnapshot(t time.Time) error {
+	defer s.timeOperation("TakeUsageSnapshot", NoUserID)()
+
+	summaries, err := s.GetAllUserSummaries()
+	if err != nil {
+		return err
+	}
+
+	day := UsageSnapshotDay(t)
+	return s.transact(func(tx *sql.Tx) error {
+		for _, us := range summaries {
+			_, err := tx.Exec(setUsageSnapshot, day, us.ID, us.Allocated, us.FileCount, us.VersionCount)
+			if err != nil {
+				return fmt.Errorf("failed to set the usage snapshot for user id %d: %v", us.ID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// GetUsageSnapshots returns all of the usage snapshots taken on or after the
+// day that since falls within, ordered by user id and then day.
+func (s *Storage) GetUsageSnapshots(since time.Time) ([]UsageSnapshot, error) {
+	defer s.timeOperation("GetUsageSnapshots", NoUserID)()
+
+	rows, err := s.db.Query(getUsageSnapshots, UsageSnapshotDay(since))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the usage snapshots from the database: %v", err)
+	}
+	defer rows.Close()
+
+	result := []UsageSnapshot{}
+	for rows.Next() {
+		var snap UsageSnapshot
+		err := rows.Scan(&snap.Day, &snap.UserID, &snap.Allocated, &snap.FileCount, &snap.VersionCount)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing usage snapshots: %v", err)
+		}
+		result = append(result, snap)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan all of the usage snapshots: %v", err)
+	}
+
+	return result, nil
+}
+
+// GetSharedSecret returns the secret stored under name. If there isn't one
+// yet, a random secret of size bytes is generated and stored first. Every
+// process using the same database gets the same secret, which lets multiple
+// server instances validate each other's tokens.
+func (s *Storage) GetSharedSecret(name string, size int) ([]byte, error) {
+	defer s.timeOperation("GetSharedSecret", NoUserID)()
+
+	generated := make([]byte, size)
+	_, err := rand.Read(generated)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate the shared secret %s: %v", name, err)
+	}
+
+	var secret []byte
+	err = s.transact(func(tx *sql.Tx) error {
+		// an existing secret is never replaced so that the first process
+		// to store one wins
+		_, err := tx.Exec(addSharedSecret, name, generated)
+		if err != nil {
+			return fmt.Errorf("failed to add the shared secret %s: %v", name, err)
+		}
+		err = tx.QueryRow(getSharedSecret, name).Scan(&secret)
+		if err != nil {
+			return fmt.Errorf("failed to get the shared secret %s: %v", name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// AcquireJobLock attempts to take the advisory lock for the named job on
+// behalf of owner for the ttl duration. True is returned if owner now holds
+// the lock, which is the case if nobody held it, the previous holder's lock
+// expired or owner already held it, in which case the lock is renewed.
+// Locks expire so that a job is picked up by another process if the owner
+// stops without releasing it.
+func (s *Storage) AcquireJobLock(name string, owner string, ttl time.Duration) (bool, error) {
+	defer s.timeOperation("AcquireJobLock", NoUserID)()
+
+	now := time.Now()
+	var acquired bool
+	err := s.transact(func(tx *sql.Tx) error {
+		_, err := tx.Exec(addJobLock, name)
+		if err != nil {
+			return fmt.Errorf("failed to add the job lock %s: %v", name, err)
+		}
+		res, err := tx.Exec(takeJobLock, owner, now.Add(ttl).UnixNano(), name, owner, now.UnixNano())
+		if err != nil {
+			return fmt.Errorf("failed to take the job lock %s: %v", name, err)
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get the affected rows while taking the job lock %s: %v", name, err)
+		}
+		acquired = affected == 1
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return acquired, nil
+}
+
+// ReleaseJobLock releases the advisory lock for the named job if owner holds
+// it so that another process can take it right away.
+func (s *Storage) ReleaseJobLock(name string, owner string) error {
+	defer s.timeOperation("ReleaseJobLock", NoUserID)()
+
+	_, err := s.db.Exec(removeJobLock, name, owner)
+	if err != nil {
+		return fmt.Errorf("failed to release the job lock %s: %v", name, err)
+	}
+	return nil
+}
+
+// GetDatabaseSize returns the size of the database in bytes, including the
+// free pages left behind by removed rows.
+func (s *Storage) GetDatabaseSize() (int64, error) {
+	defer s.timeOperation("GetDatabaseSize", NoUserID)()
+	return s.provider.DatabaseSize(s.db)
+}
+
+// Vacuum rebuilds the database so that the space freed by removed chunks is
+// returned to the file system. The size of the database in bytes before and
+// after the rebuild is returned. The database is locked while it's rebuilt,
+// which can take a while for large databases.
+func (s *Storage) Vacuum() (before int64, after int64, err error) {
+	defer s.timeOperation("Vacuum", NoUserID)()
+
+	before, err = s.GetDatabaseSize()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = s.provider.Vacuum(s.db)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	after, err = s.GetDatabaseSize()
+	if err != nil {
+		return 0, 0, err
+	}
+	return before, after, nil
+}
+
+// Analyze refreshes the statistics of the database's query planner, which
+// the removal of many rows leaves out of date. It's meant to be run after
+// large deletions, such as removing a user or expiring old file versions,
+// and after a Vacuum.
+func (s *Storage) Analyze() error {
+	defer s.timeOperation("Analyze", NoUserID)()
+	return s.provider.Analyze(s.db)
+}
+
+// IntegrityCheck runs the database's integrity check, the SQLite one for
+// SQLite databases, and returns the problems it reports, such as damaged
+// pages or indexes; the slice is empty if the database is intact.
+func (s *Storage) IntegrityCheck() ([]string, error) {
+	defer s.timeOperation("IntegrityCheck", NoUserID)()
+	return s.provider.IntegrityCheck(s.db)
+}
+
+// Backup writes a consistent snapshot of the database to a new SQLite
+// database file at destPath, using the SQLite online backup API for SQLite
+// databases. The database stays usable while the snapshot is taken; writes
+// made during the backup aren't included. The size of the snapshot in bytes
+// is returned.
+func (s *Storage) Backup(destPath string) (int64, error) {
+	defer s.timeOperation("Backup", NoUserID)()
+	return s.provider.Backup(s.db, destPath)
+}
+
+// SwapQuotaNotice records threshold as the highest quota threshold percentage
+// the user has been notified about and returns the previously recorded one,
+// or zero if there wasn't one. The swap is done in one transaction so that
+// only one process sharing the database sees a given crossing.
+func (s *Storage) SwapQuotaNotice(userID int, threshold int) (int, error) {
+	defer s.timeOperation("SwapQuotaNotice", userID)()
+
+	var previous int
+	err := s.transact(func(tx *sql.Tx) error {
+		err := tx.QueryRow(getQuotaNotice, userID).Scan(&previous)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to get the quota notice for user id %d: %v", userID, err)
+		}
+		if previous == threshold {
+			return nil
+		}
+		_, err = tx.Exec(setQuotaNotice, userID, threshold)
+		if err != nil {
+			return fmt.Errorf("failed to set the quota notice for user id %d: %v", userID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return previous, nil
+}
+
+// SetUserAdmin grants or revokes administrator access for a given userID.
+// This will fail if the userID doesn't exist.
+func (s *Storage) SetUserAdmin(userID int, isAdmin bool) error {
+	defer s.timeOperation("SetUserAdmin", userID)()
+
+	res, err := s.db.Exec(setUserAdmin, isAdmin, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update the user's admin flag (%d): %v", userID, err)
+	}
+
+	// make sure one row was affected
+	affected, err := res.RowsAffected()
+	if affected != 1 {
+		return fmt.Errorf("failed to update user's admin flag in the database; no rows were affected")
+	} else if err != nil {
+		return fmt.Errorf("failed to update user's admin flag in the database: %v", err)
+	}
+
+	return nil
+}
+
+// SetUserStatus changes the account status of the user to one of the
+// UserStatus* constants.
+func (s *Storage) SetUserStatus(userID int, status string) error {
+	defer s.timeOperation("SetUserStatus", userID)()
+
+	if status != UserStatusActive && status != UserStatusSuspended {
+		return fmt.Errorf("unknown user status: %s", status)
+	}
+
+	res, err := s.db.Exec(setUserStatus, status, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update the user's status (%d): %v", userID, err)
+	}
+
+	// make sure one row was affected
+	affected, err := res.RowsAffected()
+	if affected != 1 {
+		return fmt.Errorf("failed to update user's status in the database; no rows were affected")
+	} else if err != nil {
+		return fmt.Errorf("failed to update user's status in the database: %v", err)
+	}
+
+	return nil
+}
+
+// RemoveUser removes user and all files and file chunks associated with the user,
+// including the namespaces of the user.
+func (s *Storage) RemoveUser(username string) error {
+	defer s.timeOperation("RemoveUser", NoUserID)()
+
+	// make sure we have a user to begin with
+	user, err := s.GetUser(username)
+	if err != nil {
+		return fmt.Errorf("Failed to find the user in the database: %v", err)
+	}
+
+	namespaceIDs, err := s.namespaceUserIDs(user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get the namespaces of the user %s (id: %d): %v", user.Name, user.ID, err)
+	}
+	for _, id := range namespaceIDs {
+		err = s.removeUserID(id)
+		if err != nil {
+			return fmt.Errorf("failed to remove a namespace of the user %s (id: %d): %v", user.Name, user.ID, err)
+		}
+	}
+
+	err = s.removeUserID(user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to remove the user %s (id: %d): %v", user.Name, user.ID, err)
+	}
+
+	return nil
+}
+
+// removeUserID removes the user and all of the files of the user. The data
+// of the user's chunks is kept while chunks of files transferred to other
+// users still refer to it.
+func (s *Storage) removeUserID(id int) error {
+	return s.transact(func(tx *sql.Tx) error {
+		ids, err := chunkDataIDs(tx, getChunkDataIDsOfUser, id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(removeUser, id, id, id, id, id, id, id, id, id, id, id, id, id)
+		if err != nil {
+			return err
+		}
+		return countChunkDataRefs(tx, ids)
+	})
+}
+
+// UpdateUserCryptoHash changes the cryptoHash for a given userID.
+// This will fail if the userID doesn't exist.
+func (s *Storage) UpdateUserCryptoHash(userID int, cryptoHash []byte) error {
+	defer s.timeOperation("UpdateUserCryptoHash", userID)()
+
+	res, err := s.db.Exec(setUserCryptoHash, cryptoHash, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update the user's cryptohash (%d): %v", userID, err)
+	}
+
+	// make sure one row was affected
+	affected, err := res.RowsAffected()
+	if affected != 1 {
+		return fmt.Errorf("failed to update user's cryptohash in the database; no rows were affected")
+	} else if err != nil {
+		return fmt.Errorf("failed to update user's cryptohash in the database: %v", err)
+	}
+
+	// the namespaces of the user use the same crypto password
+	_, err = s.db.Exec(setNamespacesCrypto, cryptoHash, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update the cryptohash of the user's namespaces: %v", err)
+	}
+
+	return nil
+}
+
+// UpdateUser changes the salt, saltedHash, cryptoHash and quota for a given userID.
+// This will fail if the userID doesn't exist.
+func (s *Storage) UpdateUser(userID int, name string, salt string, saltedHash []byte, cryptoHash []byte, quota int) error {
+	defer s.timeOperation("UpdateUser", userID)()
+
+	res, err := s.db.Exec(updateUser, name, salt, saltedHash, cryptoHash, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update the user (%d): %v", userID, err)
+	}
+
+	// make sure one row was affected
+	affected, err := res.RowsAffected()
+	if affected != 1 {
+		return fmt.Errorf("failed to update user in the database; no rows were affected")
+	} else if err != nil {
+		return fmt.Errorf("failed to update user in the database: %v", err)
+	}
+
+	// keep the namespaces of the user named after it and using the same
+	// crypto password
+	_, err = s.db.Exec(renameNamespaceUsers, name, userID)
+	if err == nil {
+		_, err = s.db.Exec(setNamespacesCrypto, cryptoHash, userID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update the namespaces of the user: %v", err)
+	}
+
+	// with the user added, the user stats row needs to get created with
+	// the quota and usage statistics
+	err = s.SetUserQuota(userID, quota)
+	if err != nil {
+		return fmt.Errorf("failed to set the user's updated quota in the database: %v", err)
+	}
+
+	return nil
+}
+
+// SetUserQuota sets the user quota for a user by user id.
+func (s *Storage) SetUserQuota(userID int, quota int) error {
+	defer s.timeOperation("SetUserQuota", userID)()
+
+	res, err := s.db.Exec(setUserQuota, quota, userID)
+	if err != nil {
+		return fmt.Errorf("failed to set the user quota in the database: %v", err)
+	}
+
+	// make sure one row was affected
+	affected, err := res.RowsAffected()
+	if affected != 1 {
+		return fmt.Errorf("failed to set the user stats in the database; no rows were affected")
+	} else if err != nil {
+		return fmt.Errorf("failed to set the user stats in the database: %v", err)
+	}
+
+	return nil
+}
+
+// SetUserStats sets the user information for a user by user id and is used to
+// do the first insertion of the user into the stats table.
+func (s *Storage) SetUserStats(userID int, quota int, allocated int, revision int) error {
+	defer s.timeOperation("SetUserStats", userID)()
+
+	res, err := s.db.Exec(setUserStats, userID, quota, allocated, revision)
+	if err != nil {
+		return fmt.Errorf("failed to set the user stats in the database: %v", err)
+	}
+
+	// make sure one row was affected
+	affected, err := res.RowsAffected()
+	if affected != 1 {
+		return fmt.Errorf("failed to set the user stats in the database; no rows were affected")
+	} else if err != nil {
+		return fmt.Errorf("failed to set the user stats in the database: %v", err)
+	}
+
+	return nil
+}
+
+// UpdateUserStats increments the user's revision by one and updates the allocated
+// byte counter with the new delta.
+func (s *Storage) UpdateUserStats(userID int, allocDelta int) error {
+	defer s.timeOperation("UpdateUserStats", userID)()
+
+	res, err := s.db.Exec(updateUserStats, allocDelta, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update the user stats in the database: %v", err)
 	}
 
 	// make sure one row was affected
@@ -476,15 +1457,150 @@ func (s *Storage) UpdateUserStats(userID int, allocDelta int) error {
 
 // GetUserStats returns the user information for a user by user id.
 func (s *Storage) GetUserStats(userID int) (*UserStats, error) {
+	defer s.timeOperation("GetUserStats", userID)()
+
 	stats := new(UserStats)
-	err := s.db.QueryRow(getUserStats, userID).Scan(&stats.Quota, &stats.Allocated, &stats.Revision)
+	var overQuotaSince int64
+	err := s.db.QueryRow(getUserStats, userID).Scan(&stats.Quota, &stats.Allocated, &stats.Logical, &stats.Revision, &overQuotaSince)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get the user stats from the database: %v", err)
 	}
 
+	// the start of the grace period is only cleared by the next upload, so
+	// ignore it once the allocation is back within the quota
+	if overQuotaSince != 0 && stats.Allocated > stats.Quota {
+		stats.OverQuotaSince = time.Unix(0, overQuotaSince)
+	}
+
 	return stats, nil
 }
 
+// HardQuota returns the hard limit of the allocation for a user with the
+// quota given, which is the quota itself unless HardQuotaPercent raises it
+// and there is a QuotaGracePeriod.
+func (s *Storage) HardQuota(quota int) int {
+	if s.HardQuotaPercent <= 100 || s.QuotaGracePeriod <= 0 {
+		return quota
+	}
+	return int(int64(quota) * int64(s.HardQuotaPercent) / 100)
+}
+
+// checkFileSize fails with ErrFileTooLarge if chunkCount chunks can hold
+// more than the maximum file size.
+func (s *Storage) checkFileSize(chunkCount int) error {
+	if s.MaxFileSize > 0 && int64(chunkCount)*s.ChunkSize > s.MaxFileSize {
+		return fmt.Errorf("%w (%d chunks of %d bytes ; limit %d bytes)", ErrFileTooLarge, chunkCount, s.ChunkSize, s.MaxFileSize)
+	}
+	return nil
+}
+
+// checkFileLimits fails with ErrFileLimit if the user has more files or
+// file versions than the limits allow. It's called after adding a file or
+// version so that the transaction is rolled back if a limit is exceeded.
+func (s *Storage) checkFileLimits(tx *sql.Tx, userID int) error {
+	if s.MaxFiles > 0 {
+		var count int
+		err := tx.QueryRow(getUserFileCount, userID).Scan(&count)
+		if err != nil {
+			return fmt.Errorf("failed to count the user's files: %v", err)
+		}
+		if count > s.MaxFiles {
+			return fmt.Errorf("%w (files: %d ; limit %d)", ErrFileLimit, count-1, s.MaxFiles)
+		}
+	}
+	if s.MaxVersions > 0 {
+		var count int
+		err := tx.QueryRow(getUserVersionCount, userID).Scan(&count)
+		if err != nil {
+			return fmt.Errorf("failed to count the user's file versions: %v", err)
+		}
+		if count > s.MaxVersions {
+			return fmt.Errorf("%w (file versions: %d ; limit %d)", ErrFileLimit, count-1, s.MaxVersions)
+		}
+	}
+	return nil
+}
+
+// checkQuota fails with ErrQuotaExceeded if the allocation of the user can't
+// grow by growth bytes. Going over the quota starts the grace period, during
+// which the allocation may grow up to the hard limit; once it's over, only
+// getting back within the quota allows the allocation to grow again.
+func (s *Storage) checkQuota(tx *sql.Tx, userID int, growth int64, chunkLength int64) error {
+	// a namespace sharing the account's quota is checked against the
+	// account's quota and the allocation of the whole account
+	quotaUserID, err := getQuotaUserID(tx, userID)
+	if err != nil {
+		return err
+	}
+
+	var quota, allocated, logical, overQuotaSince int64
+	err = tx.QueryRow(getUserQuotaState, quotaUserID).Scan(&quota, &allocated, &logical, &overQuotaSince)
+	if err != nil {
+		return fmt.Errorf("failed to get the user quota from the database: %v", err)
+	}
+
+	// within the quota, which ends any grace period
+	if allocated+growth <= quota {
+		if overQuotaSince != 0 {
+			_, err = tx.Exec(setUserOverQuotaSince, 0, quotaUserID)
+			if err != nil {
+				return fmt.Errorf("failed to clear the start of the quota grace period: %v", err)
+			}
+		}
+		return nil
+	}
+
+	hardQuota := int64(s.HardQuota(int(quota)))
+	if allocated+growth > hardQuota {
+		return fmt.Errorf("%w (quota: %d ; current allocation %d ; chunk size %d)", ErrQuotaExceeded, quota, allocated, chunkLength)
+	}
+
+	// the grace period starts when the allocation first goes over the quota
+	now := time.Now()
+	if overQuotaSince == 0 || allocated <= quota {
+		_, err = tx.Exec(setUserOverQuotaSince, now.UnixNano(), quotaUserID)
+		if err != nil {
+			return fmt.Errorf("failed to record the start of the quota grace period: %v", err)
+		}
+		return nil
+	}
+	if now.Sub(time.Unix(0, overQuotaSince)) >= s.QuotaGracePeriod {
+		return fmt.Errorf("%w (quota: %d ; current allocation %d ; chunk size %d ; the grace period is over)", ErrQuotaExceeded, quota, allocated, chunkLength)
+	}
+	return nil
+}
+
+// checkStorageCap fails with ErrStorageFull if the total allocation of all
+// users can't grow by growth bytes without going over the storage cap.
+func (s *Storage) checkStorageCap(tx *sql.Tx, growth int64) error {
+	if s.StorageCap <= 0 {
+		return nil
+	}
+
+	var total int64
+	err := tx.QueryRow(getTotalAllocated).Scan(&total)
+	if err != nil {
+		return fmt.Errorf("failed to get the total allocation from the database: %v", err)
+	}
+	if total+growth > s.StorageCap {
+		return fmt.Errorf("%w (storage cap: %d ; total allocation %d ; growth %d)", ErrStorageFull, s.StorageCap, total, growth)
+	}
+	return nil
+}
+
+// GetTotalAllocated returns the total bytes allocated by all users, which
+// is what the storage cap limits.
+func (s *Storage) GetTotalAllocated() (int64, error) {
+	defer s.timeOperation("GetTotalAllocated", NoUserID)()
+
+	var total int64
+	err := s.db.QueryRow(getTotalAllocated).Scan(&total)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the total allocation from the database: %v", err)
+	}
+	return total, nil
+}
+
 // RemoveFileVersions will remove any file versions of the file specified by fileID
 // that are between the minVersion and maxVersion (inclusive). A non-nil error
 // value is returned on failure.
@@ -492,6 +1608,15 @@ func (s *Storage) GetUserStats(userID int) (*UserStats, error) {
 // NOTE: supplying a minVersion and maxVersion that does not include any valid
 // file versions will end up returning an error.
 func (s *Storage) RemoveFileVersions(userID, fileID, minVersion, maxVersion int) error {
+	return s.RemoveFileVersionsAtRevision(userID, fileID, 0, minVersion, maxVersion)
+}
+
+// RemoveFileVersionsAtRevision works like RemoveFileVersions but fails with
+// ErrRevisionMismatch if revision isn't zero and the file has changed since
+// that revision.
+func (s *Storage) RemoveFileVersionsAtRevision(userID, fileID, revision, minVersion, maxVersion int) error {
+	defer s.timeOperation("RemoveFileVersions", userID)()
+
 	err := s.transact(func(tx *sql.Tx) error {
 		// check to make sure the user owns the file id
 		var owningUserID int
@@ -500,7 +1625,11 @@ func (s *Storage) RemoveFileVersions(userID, fileID, minVersion, maxVersion int)
 			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
 		}
 		if owningUserID != userID {
-			return fmt.Errorf("user does not own the file id supplied")
+			return ErrNotOwner
+		}
+		err = checkFileRevision(tx, fileID, revision)
+		if err != nil {
+			return err
 		}
 
 		// make sure there are versions to remove
@@ -515,6 +1644,22 @@ func (s *Storage) RemoveFileVersions(userID, fileID, minVersion, maxVersion int)
 			return nil
 		}
 
+		// record the versions being removed in the journal
+		removed, err := journalGetVersions(tx, getVersionsInRangeForFile, fileID, minVersion, maxVersion)
+		if err != nil {
+			return fmt.Errorf("failed to get the file versions that are within range: %v", err)
+		}
+		var currentVersionID int
+		err = tx.QueryRow(getFileCurrentVersionID, fileID).Scan(&currentVersionID)
+		if err != nil {
+			return fmt.Errorf("failed to get the current version of the file: %v", err)
+		}
+		err = journal(tx, JournalEntry{UserID: userID, FileID: fileID, Action: JournalVersionsRemoved, Versions: removed,
+			CurrentVersionID: currentVersionID, PreviousVersionID: currentVersionID})
+		if err != nil {
+			return err
+		}
+
 		// get the total chunk size used by the file versions
 		var totalChunkSize int
 		err = tx.QueryRow(getFileVersionsTotalChunkSize, fileID, minVersion, maxVersion).Scan(&totalChunkSize)
@@ -523,7 +1668,11 @@ func (s *Storage) RemoveFileVersions(userID, fileID, minVersion, maxVersion int)
 		}
 
 		// remove all of the file chunks used by the file versions
-		_, err = tx.Exec(removeAllFileVersionChunks, fileID, minVersion, maxVersion)
+		err = s.keepJournalChunks(tx, keepJournalVersionChunks, fileID, minVersion, maxVersion)
+		if err != nil {
+			return err
+		}
+		_, err = execReleasingChunkData(tx, removeAllFileVersionChunks, getChunkDataIDsOfVersions, fileID, minVersion, maxVersion)
 		if err != nil {
 			return fmt.Errorf("failed to delete the file chunks associated with the file: %v", err)
 		}
@@ -559,9 +1708,79 @@ func (s *Storage) RemoveFileVersions(userID, fileID, minVersion, maxVersion int)
 	return err
 }
 
+// EnforceRetention removes the oldest versions of every file that has more
+// than keep versions so that only the newest keep versions remain. A file's
+// current version is never removed, even if newer versions exist. The number
+// of file versions removed is returned.
+func (s *Storage) EnforceRetention(keep int) (int, error) {
+	defer s.timeOperation("EnforceRetention", NoUserID)()
+
+	if keep < 1 {
+		return 0, fmt.Errorf("at least one version of each file must be kept")
+	}
+
+	type cutoff struct {
+		fileID, userID, maxVersion int
+	}
+	var cutoffs []cutoff
+	rows, err := s.db.Query(getRetentionCutoffs, keep, keep)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the files with too many versions from the database: %v", err)
+	}
+	for rows.Next() {
+		var c cutoff
+		var currentVersion int
+		err = rows.Scan(&c.fileID, &c.userID, &c.maxVersion, &currentVersion)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan the next row while processing file versions: %v", err)
+		}
+		if c.maxVersion >= currentVersion {
+			c.maxVersion = currentVersion - 1
+		}
+		cutoffs = append(cutoffs, c)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to scan all of the file versions: %v", err)
+	}
+
+	removed := 0
+	for _, c := range cutoffs {
+		var count int
+		err = s.db.QueryRow(getVersionsCountForFile, c.fileID, 0, c.maxVersion).Scan(&count)
+		if err != nil {
+			return removed, fmt.Errorf("failed to get the number of versions that are within range: %v", err)
+		}
+		if count < 1 {
+			continue
+		}
+
+		err = s.RemoveFileVersions(c.userID, c.fileID, 0, c.maxVersion)
+		if err != nil {
+			return removed, err
+		}
+		removed += count
+	}
+
+	return removed, nil
+}
+
 // RemoveFile removes a file listing and all of the associated chunks in storage.
-// Returns an error on failure
+// If the trash is turned on with TrashRetention, the file is moved to the
+// user's trash instead and is only removed for good once it expires or the
+// trash is emptied. Returns an error on failure
 func (s *Storage) RemoveFile(userID, fileID int) error {
+	return s.RemoveFileAtRevision(userID, fileID, 0)
+}
+
+// RemoveFileAtRevision works like RemoveFile but fails with
+// ErrRevisionMismatch if revision isn't zero and the file has changed since
+// that revision.
+func (s *Storage) RemoveFileAtRevision(userID, fileID, revision int) error {
+	defer s.timeOperation("RemoveFile", userID)()
+
 	err := s.transact(func(tx *sql.Tx) error {
 		// check to make sure the user owns the file id
 		var owningUserID int
@@ -570,71 +1789,153 @@ func (s *Storage) RemoveFile(userID, fileID int) error {
 			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
 		}
 		if owningUserID != userID {
-			return fmt.Errorf("user does not own the file id supplied")
+			return ErrNotOwner
 		}
-
-		// remove the file info
-		_, err = tx.Exec(removeFileInfoByID, fileID)
+		err = checkFileRevision(tx, fileID, revision)
 		if err != nil {
-			return fmt.Errorf("failed to remove a file info in the database: %v", err)
+			return err
 		}
 
-		// remove the file versions
-		_, err = tx.Exec(removeAllFileVersionsByFileID, fileID)
+		if s.TrashRetention > 0 {
+			return trashFile(tx, userID, fileID, time.Now())
+		}
+		return s.purgeFile(tx, userID, fileID)
+	})
+
+	return err
+}
+
+// checkFileRevision fails with ErrRevisionMismatch if revision isn't zero
+// and isn't the id of the current version of the file.
+func checkFileRevision(tx *sql.Tx, fileID, revision int) error {
+	if revision == 0 {
+		return nil
+	}
+	var currentVersionID int
+	err := tx.QueryRow(getFileCurrentVersionID, fileID).Scan(&currentVersionID)
+	if err != nil {
+		return fmt.Errorf("failed to get the current version of the file: %v", err)
+	}
+	if currentVersionID != revision {
+		return fmt.Errorf("%w (the file id %d is at revision %d, not %d)", ErrRevisionMismatch, fileID, currentVersionID, revision)
+	}
+	return nil
+}
+
+// purgeFile removes the file, which may be in the trash, with all of its
+// versions and chunks and records the removal in the journal.
+func (s *Storage) purgeFile(tx *sql.Tx, userID, fileID int) error {
+	// record the file and all of its versions in the journal
+	e := JournalEntry{UserID: userID, FileID: fileID, Action: JournalFileRemoved}
+	var owningUserID int
+	err := tx.QueryRow(getFileInfoIncludingTrash, fileID).Scan(&owningUserID, &e.FileName, &e.IsDir, &e.PreviousVersionID)
+	if err != nil {
+		return fmt.Errorf("failed to get the file info from the database: %v", err)
+	}
+	e.Versions, err = journalGetVersions(tx, getVersionsForFile, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to get the file versions from the database: %v", err)
+	}
+	err = journal(tx, e)
+	if err != nil {
+		return err
+	}
+
+	// remove the file info
+	_, err = tx.Exec(removeFileInfoByID, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to remove a file info in the database: %v", err)
+	}
+
+	// remove the file versions
+	_, err = tx.Exec(removeAllFileVersionsByFileID, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to remove the file versions in the database: %v", err)
+	}
+
+	// remove the search tokens for the file name
+	_, err = tx.Exec(removeFileSearchTokens, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to remove the search tokens of the file: %v", err)
+	}
+
+	// remove the note attached to the file
+	_, err = tx.Exec(removeFileNote, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to remove the note of the file: %v", err)
+	}
+
+	// remove the tags of the file
+	_, err = tx.Exec(removeFileTags, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to remove the tags of the file: %v", err)
+	}
+
+	// remove the platform attributes of the file
+	_, err = tx.Exec(removeFileAttributes, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to remove the attributes of the file: %v", err)
+	}
+
+	// forget that the file was waiting to be re-keyed
+	_, err = tx.Exec(removeRekeyFile, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to remove the re-key state of the file: %v", err)
+	}
+
+	// check to see if we have file chunks associated with this file -- which
+	// you will not have if the file is empty or the chunks have not been uploaded yet.
+	var totalChunkCount int
+	err = tx.QueryRow(getNumberOfFileChunks, fileID).Scan(&totalChunkCount)
+	if err != nil {
+		return fmt.Errorf("failed to get the chunk count for a file in the database: %v", err)
+	}
+
+	// get the total size for all chunks attached to the file id
+	var totalChunkSize int
+	if totalChunkCount > 0 {
+		err = tx.QueryRow(getFileTotalChunkSize, fileID).Scan(&totalChunkSize)
 		if err != nil {
-			return fmt.Errorf("failed to remove the file versions in the database: %v", err)
+			return fmt.Errorf("failed to get the chunk sizes for a file in the database: %v", err)
 		}
 
-		// check to see if we have file chunks associated with this file -- which
-		// you will not have if the file is empty or the chunks have not been uploaded yet.
-		var totalChunkCount int
-		err = tx.QueryRow(getNumberOfFileChunks, fileID).Scan(&totalChunkCount)
+		// remove all of the file chunks
+		err = s.keepJournalChunks(tx, keepJournalFileChunks, fileID)
+		if err != nil {
+			return err
+		}
+		_, err = execReleasingChunkData(tx, removeAllFileChunks, getChunkDataIDsOfFile, fileID)
 		if err != nil {
-			return fmt.Errorf("failed to get the chunk count for a file in the database: %v", err)
+			return fmt.Errorf("failed to delete the file chunks associated with the file: %v", err)
 		}
 
-		// get the total size for all chunks attached to the file id
-		var totalChunkSize int
-		if totalChunkCount > 0 {
-			err = tx.QueryRow(getFileTotalChunkSize, fileID).Scan(&totalChunkSize)
+		// update the allocation counts
+		if totalChunkSize > 0 {
+			res, err := tx.Exec(updateUserStats, -totalChunkSize, userID)
 			if err != nil {
-				return fmt.Errorf("failed to get the chunk sizes for a file in the database: %v", err)
+				return fmt.Errorf("failed to update the allocated bytes in the database after removing chunks: %v", err)
 			}
 
-			// remove all of the file chunks
-			_, err = tx.Exec(removeAllFileChunks, fileID)
-			if err != nil {
-				return fmt.Errorf("failed to delete the file chunks associated with the file: %v", err)
+			// make sure one row was affected with the UPDATE statement
+			affected, err := res.RowsAffected()
+			if affected != 1 {
+				return fmt.Errorf("failed to update the user info in the database after removing chunks; no rows were affected")
+			} else if err != nil {
+				return fmt.Errorf("failed to update the user info in the database after removing chunks: %v", err)
 			}
 
-			// update the allocation counts
-			if totalChunkSize > 0 {
-				res, err := tx.Exec(updateUserStats, -totalChunkSize, userID)
-				if err != nil {
-					return fmt.Errorf("failed to update the allocated bytes in the database after removing chunks: %v", err)
-				}
-
-				// make sure one row was affected with the UPDATE statement
-				affected, err := res.RowsAffected()
-				if affected != 1 {
-					return fmt.Errorf("failed to update the user info in the database after removing chunks; no rows were affected")
-				} else if err != nil {
-					return fmt.Errorf("failed to update the user info in the database after removing chunks: %v", err)
-				}
-
-				// if no rows were affected, that just means there were no chunks that
-				// needed to be deleted, so no need to check the result.
-			}
+			// if no rows were affected, that just means there were no chunks that
+			// needed to be deleted, so no need to check the result.
 		}
+	}
 
-		return nil
-	})
-
-	return err
+	return nil
 }
 
 // RemoveFileInfo removes a file listing in storage, returning an error on failure.
 func (s *Storage) RemoveFileInfo(fileID int) error {
+	defer s.timeOperation("RemoveFileInfo", NoUserID)()
+
 	res, err := s.db.Exec(removeFileInfoByID, fileID)
 	if err != nil {
 		return fmt.Errorf("failed to remove a file info in the database: %v", err)
@@ -655,13 +1956,28 @@ func (s *Storage) RemoveFileInfo(fileID int) error {
 // chunkCount parameter should be the number of chunks required for the size of the file. If the
 // file could not be added an error is returned, otherwise nil on success.
 func (s *Storage) AddFileInfo(userID int, filename string, isDir bool, permissions uint32, lastMod int64, chunkCount int, fileHash string) (*FileInfo, error) {
+	return s.AddFileInfoWithNameKey(userID, filename, "", isDir, permissions, lastMod, chunkCount, fileHash)
+}
+
+// AddFileInfoWithNameKey works like AddFileInfo but also sets the name key
+// of the new file, if nameKey isn't empty. ErrFileExists is returned if
+// another of the user's files has the same name key.
+func (s *Storage) AddFileInfoWithNameKey(userID int, filename string, nameKey string, isDir bool, permissions uint32, lastMod int64, chunkCount int, fileHash string) (*FileInfo, error) {
+	defer s.timeOperation("AddFileInfo", userID)()
+
+	err := s.checkFileSize(chunkCount)
+	if err != nil {
+		return nil, err
+	}
+
 	fi := new(FileInfo)
 
 	const newVersionNumber = 1
 
-	err := s.transact(func(tx *sql.Tx) error {
+	now := time.Now().Unix()
+	err = s.transact(func(tx *sql.Tx) error {
 		// attempt to first add to the FileInfo table
-		res, err := tx.Exec(addFileInfo, userID, filename, isDir, newVersionNumber, userID, filename)
+		res, err := tx.Exec(addFileInfo, userID, filename, isDir, newVersionNumber, now, userID, filename)
 		if err != nil {
 			return fmt.Errorf("failed to add a new file info in the database: %v", err)
 		}
@@ -670,7 +1986,7 @@ func (s *Storage) AddFileInfo(userID int, filename string, isDir bool, permissio
 		// and while an erro wasn't returned above, no rows will be affected.
 		affected, err := res.RowsAffected()
 		if affected != 1 {
-			return fmt.Errorf("failed to add a new file info in the database; no rows were affected (possible duplicate file)")
+			return fmt.Errorf("failed to add a new file info in the database: %w", ErrFileExists)
 		} else if err != nil {
 			return fmt.Errorf("failed to add a new file info in the database; error getting rows affected: %v", err)
 		}
@@ -681,7 +1997,7 @@ func (s *Storage) AddFileInfo(userID int, filename string, isDir bool, permissio
 		}
 
 		// now create a new FileVersion entry
-		res, err = tx.Exec(addFileVersion, newFileID, newVersionNumber, permissions, lastMod, chunkCount, fileHash)
+		res, err = tx.Exec(addFileVersion, newFileID, newVersionNumber, permissions, lastMod, chunkCount, fileHash, now)
 		if err != nil {
 			return fmt.Errorf("failed to add a new file version in the database: %v", err)
 		}
@@ -712,11 +2028,24 @@ func (s *Storage) AddFileInfo(userID int, filename string, isDir bool, permissio
 			return fmt.Errorf("failed to update the new file version in the database: %v", err)
 		}
 
+		if nameKey != "" {
+			err = setFileNameKey(tx, userID, int(newFileID), nameKey)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = s.checkFileLimits(tx, userID)
+		if err != nil {
+			return err
+		}
+
 		// generate a new UserFileInfo that contains the ID for the file just added to the database
 		fi.FileID = int(newFileID)
 		fi.UserID = userID
 		fi.FileName = filename
 		fi.IsDir = isDir
+		fi.CreatedAt = now
 
 		fi.CurrentVersion.VersionID = int(newVersionID)
 		fi.CurrentVersion.VersionNumber = newVersionNumber
@@ -724,8 +2053,10 @@ func (s *Storage) AddFileInfo(userID int, filename string, isDir bool, permissio
 		fi.CurrentVersion.LastMod = lastMod
 		fi.CurrentVersion.ChunkCount = chunkCount
 		fi.CurrentVersion.FileHash = fileHash
+		fi.CurrentVersion.CreatedAt = now
 
-		return nil
+		return journal(tx, JournalEntry{UserID: userID, FileID: fi.FileID, Action: JournalFileAdded, FileName: filename, IsDir: isDir,
+			Versions: []FileVersionInfo{fi.CurrentVersion}, CurrentVersionID: fi.CurrentVersion.VersionID})
 	})
 
 	// if the tx failed, then return here
@@ -739,50 +2070,58 @@ func (s *Storage) AddFileInfo(userID int, filename string, isDir bool, permissio
 // GetAllUserFileInfos returns a slice of UserFileInfo objects that describe all known
 // files in storage for a given user ID. If this query was unsuccessful and error is returned.
 func (s *Storage) GetAllUserFileInfos(userID int) ([]FileInfo, error) {
+	defer s.timeOperation("GetAllUserFileInfos", userID)()
+
 	var result []FileInfo
 	err := s.transact(func(tx *sql.Tx) error {
-		rows, err := tx.Query(getAllUserFiles, userID)
-		if err != nil {
-			return fmt.Errorf("failed to get all of the file infos from the database: %v", err)
-		}
-		defer rows.Close()
+		var err error
+		result, err = queryUserFileInfos(tx, userID, getAllUserFiles, userID)
+		return err
+	})
 
-		// iterate over the returned rows to create a new slice of file info objects
-		allFileInfos := []FileInfo{}
-		for rows.Next() {
-			var fi FileInfo
-			err := rows.Scan(&fi.FileID, &fi.FileName, &fi.IsDir, &fi.CurrentVersion.VersionID)
-			if err != nil {
-				return fmt.Errorf("failed to scan the next row while processing user file infos: %v", err)
-			}
-			fi.UserID = userID
-			allFileInfos = append(allFileInfos, fi)
-		}
-		if err := rows.Err(); err != nil {
-			return fmt.Errorf("failed to scan all of the search results for a user's file infos: %v", err)
-		}
+	// if the tx failed, then return here
+	if err != nil {
+		return nil, err
+	}
 
-		// an early Close() call on the result which should be harmless
-		rows.Close()
+	return result, nil
+}
 
-		// now that the base of the FileInfo slice is built, iterate over it and pull the current version data
-		result = make([]FileInfo, 0, len(allFileInfos))
-		for _, fi := range allFileInfos {
-			err = tx.QueryRow(getFileVersionByID, fi.CurrentVersion.VersionID).Scan(&fi.CurrentVersion.VersionNumber,
-				&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash)
-			if err != nil {
-				return fmt.Errorf("failed to get the current file version the database: %v", err)
-			}
+// queryUserFileInfos returns the files of the user selected by query, which
+// must select the columns of selectFileInfos, along with their current
+// versions.
+func queryUserFileInfos(tx *sql.Tx, userID int, query string, args ...interface{}) ([]FileInfo, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the file infos from the database: %v", err)
+	}
+	defer rows.Close()
 
-			result = append(result, fi)
+	// iterate over the returned rows to create a new slice of file info objects
+	result := []FileInfo{}
+	for rows.Next() {
+		var fi FileInfo
+		err := rows.Scan(&fi.FileID, &fi.FileName, &fi.IsDir, &fi.CurrentVersion.VersionID, &fi.ExpiresAt, &fi.CreatedAt, &fi.Device, &fi.Starred)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing user file infos: %v", err)
 		}
+		fi.UserID = userID
+		result = append(result, fi)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan all of the search results for a user's file infos: %v", err)
+	}
 
-		return nil
-	})
+	// an early Close() call on the result which should be harmless
+	rows.Close()
 
-	// if the tx failed, then return here
-	if err != nil {
-		return nil, err
+	// now that the base of the FileInfo slice is built, iterate over it and pull the current version data
+	for i := range result {
+		v := &result[i].CurrentVersion
+		err = tx.QueryRow(getFileVersionByID, v.VersionID).Scan(&v.VersionNumber, &v.Permissions, &v.LastMod, &v.ChunkCount, &v.FileHash, &v.MerkleRoot, &v.CreatedAt, &v.Device)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the current file version the database: %v", err)
+		}
 	}
 
 	return result, nil
@@ -791,6 +2130,8 @@ func (s *Storage) GetAllUserFileInfos(userID int) ([]FileInfo, error) {
 // GetFileInfo returns a UserFileInfo object that describes the file identified
 // by the fileID parameter. If this query was unsuccessful an error is returned.
 func (s *Storage) GetFileInfo(userID int, fileID int) (*FileInfo, error) {
+	defer s.timeOperation("GetFileInfo", userID)()
+
 	fi := new(FileInfo)
 	fi.FileID = fileID
 	err := s.transact(func(tx *sql.Tx) error {
@@ -801,7 +2142,7 @@ func (s *Storage) GetFileInfo(userID int, fileID int) (*FileInfo, error) {
 			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
 		}
 		if owningUserID != userID {
-			return fmt.Errorf("user does not own the file id supplied")
+			return ErrNotOwner
 		}
 
 		// pull the basic file information
@@ -809,10 +2150,15 @@ func (s *Storage) GetFileInfo(userID int, fileID int) (*FileInfo, error) {
 		if err != nil {
 			return fmt.Errorf("failed to get the current file info the database: %v", err)
 		}
+		err = tx.QueryRow(getFileDetails, fileID).Scan(&fi.ExpiresAt, &fi.CreatedAt, &fi.Device, &fi.Starred)
+		if err != nil {
+			return fmt.Errorf("failed to get the details of the file: %v", err)
+		}
 
 		// pull the current version data
 		err = tx.QueryRow(getFileVersionByID, fi.CurrentVersion.VersionID).Scan(&fi.CurrentVersion.VersionNumber,
-			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash)
+			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash, &fi.CurrentVersion.MerkleRoot,
+			&fi.CurrentVersion.CreatedAt, &fi.CurrentVersion.Device)
 		if err != nil {
 			return fmt.Errorf("failed to get the current file version the database: %v", err)
 		}
@@ -829,6 +2175,8 @@ func (s *Storage) GetFileInfo(userID int, fileID int) (*FileInfo, error) {
 // GetFileInfoByName returns a UserFileInfo object that describes the file identified
 // by the userID and filename parameters. If this query was unsuccessful an error is returned.
 func (s *Storage) GetFileInfoByName(userID int, filename string) (*FileInfo, error) {
+	defer s.timeOperation("GetFileInfoByName", userID)()
+
 	fi := new(FileInfo)
 
 	err := s.transact(func(tx *sql.Tx) error {
@@ -839,10 +2187,15 @@ func (s *Storage) GetFileInfoByName(userID int, filename string) (*FileInfo, err
 		}
 		fi.FileName = filename
 		fi.UserID = userID
+		err = tx.QueryRow(getFileDetails, fi.FileID).Scan(&fi.ExpiresAt, &fi.CreatedAt, &fi.Device, &fi.Starred)
+		if err != nil {
+			return fmt.Errorf("failed to get the details of the file: %v", err)
+		}
 
 		// pull the current version data
 		err = tx.QueryRow(getFileVersionByID, fi.CurrentVersion.VersionID).Scan(&fi.CurrentVersion.VersionNumber,
-			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash)
+			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash, &fi.CurrentVersion.MerkleRoot,
+			&fi.CurrentVersion.CreatedAt, &fi.CurrentVersion.Device)
 		if err != nil {
 			return fmt.Errorf("failed to get the current file version the database: %v", err)
 		}
@@ -859,6 +2212,8 @@ func (s *Storage) GetFileInfoByName(userID int, filename string) (*FileInfo, err
 // GetFileVersions will return a slice of FileVersionInfo that encompases all of the
 // versions registered for a given file ID.
 func (s *Storage) GetFileVersions(fileID int) ([]FileVersionInfo, error) {
+	defer s.timeOperation("GetFileVersions", NoUserID)()
+
 	// pull the current version data
 	rows, err := s.db.Query(getVersionsForFile, fileID)
 	if err != nil {
@@ -869,7 +2224,7 @@ func (s *Storage) GetFileVersions(fileID int) ([]FileVersionInfo, error) {
 	result := make([]FileVersionInfo, 0)
 	var vi FileVersionInfo
 	for rows.Next() {
-		err := rows.Scan(&vi.VersionID, &vi.VersionNumber, &vi.Permissions, &vi.LastMod, &vi.ChunkCount, &vi.FileHash)
+		err := rows.Scan(&vi.VersionID, &vi.VersionNumber, &vi.Permissions, &vi.LastMod, &vi.ChunkCount, &vi.FileHash, &vi.MerkleRoot, &vi.CreatedAt, &vi.Device)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan the next row while processing files versions for fileID %d: %v", fileID, err)
 		}
@@ -882,8 +2237,23 @@ func (s *Storage) GetFileVersions(fileID int) ([]FileVersionInfo, error) {
 // TagNewFileVersion creates a new version of a given file and returns the new version ID
 // as well as the incremented file-local version number.
 func (s *Storage) TagNewFileVersion(userID int, fileID int, permissions uint32, lastMod int64, chunkCount int, fileHash string) (*FileInfo, error) {
+	return s.TagNewFileVersionAtRevision(userID, fileID, 0, permissions, lastMod, chunkCount, fileHash)
+}
+
+// TagNewFileVersionAtRevision works like TagNewFileVersion but fails with
+// ErrRevisionMismatch if revision isn't zero and the file has changed since
+// that revision, so that two clients can't both base a new version on the
+// same one and silently replace each other's changes.
+func (s *Storage) TagNewFileVersionAtRevision(userID int, fileID int, revision int, permissions uint32, lastMod int64, chunkCount int, fileHash string) (*FileInfo, error) {
+	defer s.timeOperation("TagNewFileVersion", userID)()
+
+	err := s.checkFileSize(chunkCount)
+	if err != nil {
+		return nil, err
+	}
+
 	fi := new(FileInfo)
-	err := s.transact(func(tx *sql.Tx) error {
+	err = s.transact(func(tx *sql.Tx) error {
 		// check to make sure the user owns the file id
 		var owningUserID int
 		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
@@ -891,7 +2261,11 @@ func (s *Storage) TagNewFileVersion(userID int, fileID int, permissions uint32,
 			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
 		}
 		if owningUserID != userID {
-			return fmt.Errorf("user does not own the file id supplied")
+			return ErrNotOwner
+		}
+		err = checkFileRevision(tx, fileID, revision)
+		if err != nil {
+			return err
 		}
 
 		// get the file information
@@ -903,10 +2277,12 @@ func (s *Storage) TagNewFileVersion(userID int, fileID int, permissions uint32,
 
 		// pull the current version data to get the correct chunk count for the current version
 		err = tx.QueryRow(getFileVersionByID, fi.CurrentVersion.VersionID).Scan(&fi.CurrentVersion.VersionNumber,
-			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash)
+			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash, &fi.CurrentVersion.MerkleRoot,
+			&fi.CurrentVersion.CreatedAt, &fi.CurrentVersion.Device)
 		if err != nil {
 			return fmt.Errorf("failed to get the current file version the database: %v", err)
 		}
+		previousVersionID := fi.CurrentVersion.VersionID
 
 		// increment the file-local version number
 		fi.CurrentVersion.VersionNumber++
@@ -916,10 +2292,13 @@ func (s *Storage) TagNewFileVersion(userID int, fileID int, permissions uint32,
 		fi.CurrentVersion.LastMod = lastMod
 		fi.CurrentVersion.ChunkCount = chunkCount
 		fi.CurrentVersion.FileHash = fileHash
+		fi.CurrentVersion.MerkleRoot = ""
+		fi.CurrentVersion.CreatedAt = time.Now().Unix()
+		fi.CurrentVersion.Device = ""
 
 		// now create a new FileVersion entry
 		res, err := tx.Exec(addFileVersion, fi.FileID, fi.CurrentVersion.VersionNumber, fi.CurrentVersion.Permissions,
-			fi.CurrentVersion.LastMod, fi.CurrentVersion.ChunkCount, fi.CurrentVersion.FileHash)
+			fi.CurrentVersion.LastMod, fi.CurrentVersion.ChunkCount, fi.CurrentVersion.FileHash, fi.CurrentVersion.CreatedAt)
 		if err != nil {
 			return fmt.Errorf("failed to add a new file version in the database: %v", err)
 		}
@@ -952,7 +2331,13 @@ func (s *Storage) TagNewFileVersion(userID int, fileID int, permissions uint32,
 			return fmt.Errorf("failed to update the new file version in the database: %v", err)
 		}
 
-		return nil
+		err = s.checkFileLimits(tx, userID)
+		if err != nil {
+			return err
+		}
+
+		return journal(tx, JournalEntry{UserID: userID, FileID: fileID, Action: JournalVersionsAdded, Versions: []FileVersionInfo{fi.CurrentVersion},
+			CurrentVersionID: fi.CurrentVersion.VersionID, PreviousVersionID: previousVersionID})
 	})
 
 	if err != nil {
@@ -962,9 +2347,177 @@ func (s *Storage) TagNewFileVersion(userID int, fileID int, permissions uint32,
 	return fi, nil
 }
 
+// UpdateFileVersion sets the last modified time, chunk count and whole-file
+// hash of an existing file version. This lets a client register a version
+// before it knows the size and hash of the data, such as when streaming it,
+// and fill them in once all of the chunks have been uploaded.
+func (s *Storage) UpdateFileVersion(userID int, fileID int, versionID int, lastMod int64, chunkCount int, fileHash string) error {
+	defer s.timeOperation("UpdateFileVersion", userID)()
+
+	err := s.checkFileSize(chunkCount)
+	if err != nil {
+		return err
+	}
+
+	return s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return ErrNotOwner
+		}
+
+		oldVersion, err := journalGetVersion(tx, versionID)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to get the file version (%d) from the database: %v", versionID, err)
+		}
+
+		res, err := tx.Exec(updateFileVersion, lastMod, chunkCount, fileHash, versionID, fileID)
+		if err != nil {
+			return fmt.Errorf("failed to update the file version (%d) for the file id (%d) in the database: %v", versionID, fileID, err)
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to update the file version in the database: %v", err)
+		} else if affected != 1 {
+			return fmt.Errorf("failed to update the file version in the database; the version id %d was not found for the file id %d", versionID, fileID)
+		}
+		return journalVersionUpdate(tx, userID, fileID, oldVersion)
+	})
+}
+
+// SetFileVersionMerkleRoot records the Merkle root of the chunk hashes of
+// the file version identified by fileID and versionID. The root is computed
+// by the client from the data it uploads so that later downloads can check
+// the chunk listing against it.
+func (s *Storage) SetFileVersionMerkleRoot(userID int, fileID int, versionID int, merkleRoot string) error {
+	defer s.timeOperation("SetFileVersionMerkleRoot", userID)()
+
+	return s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return ErrNotOwner
+		}
+
+		oldVersion, err := journalGetVersion(tx, versionID)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to get the file version (%d) from the database: %v", versionID, err)
+		}
+
+		res, err := tx.Exec(setFileVersionMerkleRoot, merkleRoot, versionID, fileID)
+		if err != nil {
+			return fmt.Errorf("failed to set the Merkle root of the file version (%d) for the file id (%d) in the database: %v", versionID, fileID, err)
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to set the Merkle root of the file version in the database: %v", err)
+		} else if affected != 1 {
+			return fmt.Errorf("failed to set the Merkle root of the file version in the database; the version id %d was not found for the file id %d", versionID, fileID)
+		}
+		return journalVersionUpdate(tx, userID, fileID, oldVersion)
+	})
+}
+
+// GetFileVersionSize returns the total number of bytes stored in the chunks
+// of a file version.
+func (s *Storage) GetFileVersionSize(userID int, fileID int, versionID int) (int64, error) {
+	defer s.timeOperation("GetFileVersionSize", userID)()
+
+	var size int64
+	err := s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return ErrNotOwner
+		}
+
+		err = tx.QueryRow(getVersionChunkSize, fileID, versionID).Scan(&size)
+		if err != nil {
+			return fmt.Errorf("failed to get the size of the file version (%d) for the file id (%d): %v", versionID, fileID, err)
+		}
+		return nil
+	})
+	return size, err
+}
+
+// RenameFile changes the name of a file. ErrFileExists is returned if the
+// user already has a file with the new name.
+func (s *Storage) RenameFile(userID int, fileID int, newName string) error {
+	defer s.timeOperation("RenameFile", userID)()
+
+	return s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return ErrNotOwner
+		}
+
+		return renameFile(tx, userID, fileID, newName)
+	})
+}
+
+// renameFile renames the file of the user, which must own it, and records
+// the change in the journal. The search tokens and name key of the file are
+// cleared since they were made from the old name.
+func renameFile(tx *sql.Tx, userID int, fileID int, newName string) error {
+	// make sure the new name isn't taken
+	var existingID, existingVersion int
+	var existingIsDir bool
+	err := tx.QueryRow(getFileInfoByName, newName, userID).Scan(&existingID, &existingIsDir, &existingVersion)
+	if err == nil {
+		return fmt.Errorf("failed to rename the file id (%d): %w", fileID, ErrFileExists)
+	} else if err != sql.ErrNoRows {
+		return fmt.Errorf("failed to look up the new file name in the database: %v", err)
+	}
+
+	var owningUserID int
+	var oldName string
+	var isDir bool
+	var currentVersionID int
+	err = tx.QueryRow(getFileInfo, fileID).Scan(&owningUserID, &oldName, &isDir, &currentVersionID)
+	if err != nil {
+		return fmt.Errorf("failed to get the file info from the database: %v", err)
+	}
+
+	_, err = tx.Exec(renameFileInfo, newName, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to rename the file id (%d) in the database: %v", fileID, err)
+	}
+
+	// the search tokens and name key were made from the old name
+	_, err = tx.Exec(removeFileSearchTokens, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to remove the search tokens of the file: %v", err)
+	}
+	_, err = tx.Exec(updateFileNameKey, "", fileID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to remove the name key of the file: %v", err)
+	}
+	return journal(tx, JournalEntry{UserID: userID, FileID: fileID, Action: JournalFileRenamed, FileName: newName, OldName: oldName, IsDir: isDir,
+		CurrentVersionID: currentVersionID, PreviousVersionID: currentVersionID})
+}
+
 // GetFileChunkInfos returns a slice of FileChunks containing all of the chunk
 // information except for the chunk bytes themselves.
 func (s *Storage) GetFileChunkInfos(userID int, fileID int, versionID int) ([]FileChunk, error) {
+	defer s.timeOperation("GetFileChunkInfos", userID)()
+
 	var chunk FileChunk
 	knownChunks := []FileChunk{}
 	err := s.transact(func(tx *sql.Tx) error {
@@ -975,7 +2528,7 @@ func (s *Storage) GetFileChunkInfos(userID int, fileID int, versionID int) ([]Fi
 			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
 		}
 		if owningUserID != userID {
-			return fmt.Errorf("user does not own the file id supplied")
+			return ErrNotOwner
 		}
 
 		// get all of the file chunks for the file
@@ -1010,6 +2563,8 @@ func (s *Storage) GetFileChunkInfos(userID int, fileID int, versionID int) ([]Fi
 // GetMissingChunkNumbersForFile will return a slice of chunk numbers that have
 // not been added for a given file.
 func (s *Storage) GetMissingChunkNumbersForFile(userID int, fileID int) ([]int, error) {
+	defer s.timeOperation("GetMissingChunkNumbersForFile", userID)()
+
 	var fi FileInfo
 	knownChunks := []int{}
 	err := s.transact(func(tx *sql.Tx) error {
@@ -1020,7 +2575,7 @@ func (s *Storage) GetMissingChunkNumbersForFile(userID int, fileID int) ([]int,
 			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
 		}
 		if owningUserID != userID {
-			return fmt.Errorf("user does not own the file id supplied")
+			return ErrNotOwner
 		}
 
 		// get the file information
@@ -1032,7 +2587,8 @@ func (s *Storage) GetMissingChunkNumbersForFile(userID int, fileID int) ([]int,
 
 		// pull the current version data to get the correct chunk count for the current version
 		err = tx.QueryRow(getFileVersionByID, fi.CurrentVersion.VersionID).Scan(&fi.CurrentVersion.VersionNumber,
-			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash)
+			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash, &fi.CurrentVersion.MerkleRoot,
+			&fi.CurrentVersion.CreatedAt, &fi.CurrentVersion.Device)
 		if err != nil {
 			return fmt.Errorf("failed to get the current file version the database: %v", err)
 		}
@@ -1083,14 +2639,44 @@ func (s *Storage) GetMissingChunkNumbersForFile(userID int, fileID int) ([]int,
 // AddFileChunk adds a binary chunk to storage for a given file at a position in the file
 // determined by the chunkNumber passed in and identified by the chunkHash. The userID is used
 // to update the allocation count in the same transaction as well as verify ownership.
+// The data is kept once for each of the user's chunk hashes: a chunk with the hash of one
+// the user already has refers to its data instead of storing it again, so versions that
+// barely change only add their changed chunks. Only the data that is stored counts
+// towards the user's quota, so a chunk sharing its data is stored for free.
 func (s *Storage) AddFileChunk(userID int, fileID int, versionID int, chunkNumber int, chunkHash string, chunk []byte) (*FileChunk, error) {
+	defer s.timeOperation("AddFileChunk", userID)()
+
 	chunkLength := int64(len(chunk))
 
-	// the length of the chunk is no longer sanity checked because it may
-	// become larger with extra data needed for cryptography.
+	// the chunk may be a little larger than the chunk size because of the
+	// extra data needed for cryptography
+	if chunkLength > s.ChunkSize+MaxChunkOverhead {
+		return nil, fmt.Errorf("%w (chunk size %d ; maximum %d)", ErrChunkTooLarge, chunkLength, s.ChunkSize+MaxChunkOverhead)
+	}
+
+	// streamed uploads only set the chunk count after all of the chunks
+	// are uploaded, so the file size is checked for each chunk as well
+	err := s.checkFileSize(chunkNumber + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	// the data is only stored if the user doesn't have it yet, and it's
+	// written first; if the chunk isn't added, a file written to the chunk
+	// store is removed by the next sweep of the chunk store
+	var data []byte
+	var storeKey string
+	var growth int64
+	if !s.hasChunkData(userID, chunkHash, chunkLength) {
+		data, storeKey, err = s.storeChunk(chunk)
+		if err != nil {
+			return nil, err
+		}
+		growth = chunkLength
+	}
 
 	newChunk := new(FileChunk)
-	err := s.transact(func(tx *sql.Tx) error {
+	err = s.transact(func(tx *sql.Tx) error {
 		// check to make sure the user owns the file id
 		var owningUserID int
 		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
@@ -1098,23 +2684,21 @@ func (s *Storage) AddFileChunk(userID int, fileID int, versionID int, chunkNumbe
 			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
 		}
 		if owningUserID != userID {
-			return fmt.Errorf("user does not own the file id supplied")
+			return ErrNotOwner
 		}
 
-		// get the user's quota fand allocation count and test for a voliation
-		var quota, allocated, revision int64
-		err = tx.QueryRow(getUserStats, userID).Scan(&quota, &allocated, &revision)
+		// fail the transaction if there's not enough allocation space
+		err = s.checkQuota(tx, userID, growth, chunkLength)
 		if err != nil {
-			return fmt.Errorf("failed to get the user quota from the database before adding file chunk: %v", err)
+			return err
 		}
-
-		// fail the transaction if there's not enough allocation space
-		if (quota - allocated) < chunkLength {
-			return fmt.Errorf("not enough free allocation space (quota: %d ; current allocation %d ; chunk size %d)", quota, allocated, chunkLength)
+		err = s.checkStorageCap(tx, growth)
+		if err != nil {
+			return err
 		}
 
 		// now the that prechecks have succeeded, add the file
-		res, err := tx.Exec(addFileChunk, fileID, versionID, chunkNumber, chunkHash, chunk)
+		res, err := s.putSharedChunk(tx, userID, fileID, versionID, chunkNumber, chunkHash, chunk, data, storeKey, false)
 		if err != nil {
 			return fmt.Errorf("failed to add a new file chunk in the database: %v", err)
 		}
@@ -1154,12 +2738,154 @@ func (s *Storage) AddFileChunk(userID int, fileID int, versionID int, chunkNumbe
 	return newChunk, nil
 }
 
+// RepairFileChunk replaces the chunk of a file version identified by the
+// chunkNumber, or adds it if it's missing, with chunk data that is known to be
+// good. If the version has a Merkle root, chunkHash must be verified against it
+// by the proof from MerkleProof or, if no proof is given, by the chunk hashes of
+// the version with chunkHash in place of the chunk's hash. Otherwise chunkHash
+// must match the hash stored for the chunk, if any. ErrChunkMismatch is returned
+// if the chunk doesn't match the version. The user's allocation count is updated
+// by the difference in size between the old and the new chunk. Since the data of
+// chunks is shared, the repair fixes every chunk of the user with the same hash.
+func (s *Storage) RepairFileChunk(userID int, fileID int, versionID int, chunkNumber int, chunkHash string, proof []string, chunk []byte) (*FileChunk, error) {
+	defer s.timeOperation("RepairFileChunk", userID)()
+
+	chunkLength := int64(len(chunk))
+	if chunkLength > s.ChunkSize+MaxChunkOverhead {
+		return nil, fmt.Errorf("%w (chunk size %d ; maximum %d)", ErrChunkTooLarge, chunkLength, s.ChunkSize+MaxChunkOverhead)
+	}
+
+	data, storeKey, err := s.storeChunk(chunk)
+	if err != nil {
+		return nil, err
+	}
+
+	newChunk := new(FileChunk)
+	err = s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return ErrNotOwner
+		}
+
+		// the chunk has to be one of the chunks of the version
+		var chunkCount int
+		var merkleRoot string
+		err = tx.QueryRow(getFileVersionChunkCount, versionID, fileID).Scan(&chunkCount, &merkleRoot)
+		if err != nil {
+			return fmt.Errorf("failed to get the file version (%d) for the file id (%d): %v", versionID, fileID, err)
+		}
+		if chunkNumber < 0 || chunkNumber >= chunkCount {
+			return fmt.Errorf("%w (chunk %d of %d chunks)", ErrChunkMismatch, chunkNumber, chunkCount)
+		}
+
+		// get the size of the chunk being replaced, if there is one
+		var oldHash string
+		var oldLength int64
+		err = tx.QueryRow(getFileChunkLength, fileID, versionID, chunkNumber).Scan(&oldHash, &oldLength)
+		chunkExists := err == nil
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to get the existing chunk before repairing it: %v", err)
+		}
+
+		// check the chunk hash against what the version recorded
+		if merkleRoot != "" && proof != nil {
+			if !VerifyMerkleProof(merkleRoot, chunkCount, chunkNumber, chunkHash, proof) {
+				return fmt.Errorf("%w (chunk %d doesn't match the Merkle proof)", ErrChunkMismatch, chunkNumber)
+			}
+		} else if merkleRoot != "" {
+			hashes := make([]string, chunkCount)
+			rows, err := tx.Query(getAllFileChunksByID, fileID, versionID)
+			if err != nil {
+				return fmt.Errorf("failed to get the file chunks of the version from the database: %v", err)
+			}
+			for rows.Next() {
+				var num int
+				var hash string
+				if err := rows.Scan(&num, &hash); err != nil {
+					rows.Close()
+					return fmt.Errorf("failed to scan the next row while getting the file chunks: %v", err)
+				}
+				if num >= 0 && num < chunkCount {
+					hashes[num] = hash
+				}
+			}
+			rows.Close()
+			hashes[chunkNumber] = chunkHash
+
+			root, err := MerkleRoot(hashes)
+			if err != nil || root != merkleRoot {
+				return fmt.Errorf("%w (chunk %d doesn't match the Merkle root of the version)", ErrChunkMismatch, chunkNumber)
+			}
+		} else if chunkExists && oldHash != chunkHash {
+			return fmt.Errorf("%w (chunk %d doesn't match the stored hash)", ErrChunkMismatch, chunkNumber)
+		}
+
+		// fail the transaction if there's not enough allocation space for a larger chunk
+		growth := chunkLength - oldLength
+		if growth > 0 {
+			err = s.checkQuota(tx, userID, growth, chunkLength)
+			if err != nil {
+				return err
+			}
+			err = s.checkStorageCap(tx, growth)
+			if err != nil {
+				return err
+			}
+		}
+
+		// the repaired data replaces the data every chunk of the user with
+		// the same hash shares
+		res, err := s.putSharedChunk(tx, userID, fileID, versionID, chunkNumber, chunkHash, chunk, data, storeKey, true)
+		if err != nil {
+			return fmt.Errorf("failed to repair the file chunk in the database: %v", err)
+		}
+		affected, err := res.RowsAffected()
+		if affected != 1 {
+			return fmt.Errorf("failed to repair the file chunk in the database; no rows were affected")
+		} else if err != nil {
+			return fmt.Errorf("failed to repair the file chunk in the database: %v", err)
+		}
+
+		// update the allocation count
+		res, err = tx.Exec(updateUserStats, growth, userID)
+		if err != nil {
+			return fmt.Errorf("failed to update the allocated bytes in the database after repairing a chunk: %v", err)
+		}
+		affected, err = res.RowsAffected()
+		if affected != 1 {
+			return fmt.Errorf("failed to update the user info in the database after repairing a chunk; no rows were affected")
+		} else if err != nil {
+			return fmt.Errorf("failed to update the user info in the database after repairing a chunk: %v", err)
+		}
+
+		newChunk.FileID = fileID
+		newChunk.VersionID = versionID
+		newChunk.ChunkNumber = chunkNumber
+		newChunk.ChunkHash = chunkHash
+		newChunk.Chunk = chunk
+		return nil
+	})
+
+	// return the error, if any, from running the transaction
+	if err != nil {
+		return nil, err
+	}
+	return newChunk, nil
+}
+
 // RemoveFileChunk removes a chunk from storage identifed by the fileID and chunkNumber.
 // If the chunkNumber specified is out of range of the file's max chunk count, this will
 // simply have no effect. An bool indicating if the chunk was successfully removed is returned
 // as well as an error on failure. userID is required so that the allocation count can updated
 // in the same transaction as well as to verify ownership of the chunk.
 func (s *Storage) RemoveFileChunk(userID int, fileID int, versionID int, chunkNumber int) (bool, error) {
+	defer s.timeOperation("RemoveFileChunk", userID)()
+
 	err := s.transact(func(tx *sql.Tx) error {
 		// check to make sure the user owns the file id
 		var owningUserID int
@@ -1168,21 +2894,20 @@ func (s *Storage) RemoveFileChunk(userID int, fileID int, versionID int, chunkNu
 			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
 		}
 		if owningUserID != userID {
-			return fmt.Errorf("user does not own the file id supplied")
+			return ErrNotOwner
 		}
 
 		// get the existing chunk so that we can caluclate the chunk size in bytes to
 		// remove from the user's allocation count
 		var chunkHash string
-		var chunk []byte
-		err = tx.QueryRow(getFileChunk, fileID, versionID, chunkNumber).Scan(&chunkHash, &chunk)
+		var allocationCount int64
+		err = tx.QueryRow(getFileChunkLength, fileID, versionID, chunkNumber).Scan(&chunkHash, &allocationCount)
 		if err != nil {
 			return fmt.Errorf("failed to get the existing chunk before removal: %v", err)
 		}
-		allocationCount := len(chunk)
 
 		// remove the chunk from the table
-		res, err := tx.Exec(removeFileChunk, fileID, versionID, chunkNumber)
+		res, err := execReleasingChunkData(tx, removeFileChunk, getChunkDataIDsOfChunk, fileID, versionID, chunkNumber)
 		if err != nil {
 			return fmt.Errorf("failed to remove the file chunk in the database: %v", err)
 		}
@@ -1222,18 +2947,41 @@ func (s *Storage) RemoveFileChunk(userID int, fileID int, versionID int, chunkNu
 // GetFileChunk retrieves a file chunk from storage and returns it. An error value
 // is returned on failure.
 func (s *Storage) GetFileChunk(fileID int, chunkNumber int, versionID int) (fc *FileChunk, e error) {
+	defer s.timeOperation("GetFileChunk", NoUserID)()
+
 	fc = new(FileChunk)
 	fc.FileID = fileID
 	fc.VersionID = versionID
 	fc.ChunkNumber = chunkNumber
 
-	e = s.db.QueryRow(getFileChunk, fileID, versionID, chunkNumber).Scan(&fc.ChunkHash, &fc.Chunk)
+	var storeKey string
+	e = s.db.QueryRow(getFileChunk, fileID, versionID, chunkNumber).Scan(&fc.ChunkHash, &fc.Chunk, &storeKey)
+	if e == nil {
+		fc.Chunk, e = s.loadChunk(fc.Chunk, storeKey)
+	}
 	return
 }
 
 // transact takes a function parameter that will get executed within the context
 // of a database/sql.DB transaction. This transaction will Comit or Rollback
 // based on whether or not an error or panic was generated from this function.
+// timeOperation starts timing a storage operation. The returned function
+// should be deferred so that the operation gets reported to SlowQueryLog
+// if it took longer than SlowQueryThreshold.
+func (s *Storage) timeOperation(operation string, userID int) func() {
+	if s.SlowQueryLog == nil || s.SlowQueryThreshold <= 0 {
+		return func() {}
+	}
+
+	start := time.Now()
+	return func() {
+		elapsed := time.Since(start)
+		if elapsed >= s.SlowQueryThreshold {
+			s.SlowQueryLog(operation, userID, elapsed)
+		}
+	}
+}
+
 func (s *Storage) transact(transFoo func(*sql.Tx) error) (err error) {
 	// start the transaction
 	tx, err := s.db.Begin()
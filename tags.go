@@ -0,0 +1,203 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const (
+	createFileTagsTable = `CREATE TABLE IF NOT EXISTS FileTags (
+        FileID      INTEGER             NOT NULL,
+        Token       TEXT                NOT NULL,
+        Tag         TEXT                NOT NULL,
+        PRIMARY KEY (FileID, Token)
+	);`
+
+	addFileTag      = `INSERT OR REPLACE INTO FileTags (FileID, Token, Tag) VALUES (?, ?, ?);`
+	removeFileTag   = `DELETE FROM FileTags WHERE FileID = ? AND Token = ?;`
+	removeFileTags  = `DELETE FROM FileTags WHERE FileID = ?;`
+	getFileTags     = `SELECT Token, Tag FROM FileTags WHERE FileID = ? ORDER BY Token;`
+	getFileTagCount = `SELECT COUNT(*) FROM FileTags WHERE FileID = ?;`
+	getUserTags     = `SELECT FileTags.Token, MIN(FileTags.Tag), COUNT(*) FROM FileTags
+					INNER JOIN FileInfo ON FileTags.FileID = FileInfo.FileID
+					WHERE FileInfo.UserID = ? AND FileInfo.TrashedAt = 0
+					GROUP BY FileTags.Token ORDER BY FileTags.Token;`
+	getTaggedFiles = selectFileInfos + `
+					INNER JOIN FileTags ON FileTags.FileID = FileInfo.FileID
+					WHERE FileInfo.UserID = ? AND FileInfo.TrashedAt = 0 AND FileTags.Token = ? ORDER BY FileInfo.FileID;`
+)
+
+// MaxFileTags is the most tags a single file can have.
+const MaxFileTags = 64
+
+// MaxTagLength is the longest token or tag, as stored, that can be given to
+// a file.
+const MaxTagLength = 1024
+
+// FileTag is a tag on a file. Token is derived from the plaintext tag by the
+// client with a key the server doesn't have so that files can be filtered by
+// tag, and Tag is the encrypted tag for display.
+type FileTag struct {
+	Token string
+	Tag   string
+}
+
+// TagInfo is a tag used by a user along with the number of files that have
+// it.
+type TagInfo struct {
+	FileTag
+	FileCount int
+}
+
+// AddFileTags adds the tags to the file. Tags the file already has are
+// replaced, so the result is the same if a tag is added more than once.
+func (s *Storage) AddFileTags(userID, fileID int, tags []FileTag) error {
+	defer s.timeOperation("AddFileTags", userID)()
+
+	for _, t := range tags {
+		if t.Token == "" || t.Tag == "" {
+			return fmt.Errorf("both the token and the tag must be supplied")
+		}
+		if len(t.Token) > MaxTagLength || len(t.Tag) > MaxTagLength {
+			return fmt.Errorf("a tag can be at most %d bytes", MaxTagLength)
+		}
+	}
+
+	return s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return ErrNotOwner
+		}
+
+		for _, t := range tags {
+			_, err = tx.Exec(addFileTag, fileID, t.Token, t.Tag)
+			if err != nil {
+				return fmt.Errorf("failed to add a tag to the file: %v", err)
+			}
+		}
+
+		var count int
+		err = tx.QueryRow(getFileTagCount, fileID).Scan(&count)
+		if err != nil {
+			return fmt.Errorf("failed to count the tags of the file: %v", err)
+		}
+		if count > MaxFileTags {
+			return fmt.Errorf("a file can have at most %d tags", MaxFileTags)
+		}
+		return nil
+	})
+}
+
+// RemoveFileTags removes the tags with the tokens from the file. Tokens the
+// file doesn't have are ignored.
+func (s *Storage) RemoveFileTags(userID, fileID int, tokens []string) error {
+	defer s.timeOperation("RemoveFileTags", userID)()
+
+	return s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return ErrNotOwner
+		}
+
+		for _, token := range tokens {
+			_, err = tx.Exec(removeFileTag, fileID, token)
+			if err != nil {
+				return fmt.Errorf("failed to remove a tag from the file: %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+// GetFileTags returns the tags of the file.
+func (s *Storage) GetFileTags(userID, fileID int) ([]FileTag, error) {
+	defer s.timeOperation("GetFileTags", userID)()
+
+	result := []FileTag{}
+	err := s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return ErrNotOwner
+		}
+
+		rows, err := tx.Query(getFileTags, fileID)
+		if err != nil {
+			return fmt.Errorf("failed to get the tags of the file: %v", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var t FileTag
+			err = rows.Scan(&t.Token, &t.Tag)
+			if err != nil {
+				return fmt.Errorf("failed to scan the next row while processing the file tags: %v", err)
+			}
+			result = append(result, t)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetUserTags returns the tags used on the user's files, not counting the
+// files in the trash, along with the number of files that have each one.
+func (s *Storage) GetUserTags(userID int) ([]TagInfo, error) {
+	defer s.timeOperation("GetUserTags", userID)()
+
+	rows, err := s.db.Query(getUserTags, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the tags of the user: %v", err)
+	}
+	defer rows.Close()
+
+	result := []TagInfo{}
+	for rows.Next() {
+		var ti TagInfo
+		err = rows.Scan(&ti.Token, &ti.Tag, &ti.FileCount)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing the user's tags: %v", err)
+		}
+		result = append(result, ti)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan all of the user's tags: %v", err)
+	}
+	return result, nil
+}
+
+// GetFilesByTag returns the user's files, not counting the ones in the
+// trash, that have the tag with the token.
+func (s *Storage) GetFilesByTag(userID int, token string) ([]FileInfo, error) {
+	defer s.timeOperation("GetFilesByTag", userID)()
+
+	var result []FileInfo
+	err := s.transact(func(tx *sql.Tx) error {
+		var err error
+		result, err = queryUserFileInfos(tx, userID, getTaggedFiles, userID, token)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+)
+
+const (
+	createRekeyFilesTable = `CREATE TABLE IF NOT EXISTS RekeyFiles (
+        FileID      INTEGER PRIMARY KEY NOT NULL,
+        CryptoHash  BLOB                NOT NULL
+	);`
+
+	setRekeyFile    = `INSERT OR REPLACE INTO RekeyFiles (FileID, CryptoHash) VALUES (?, ?);`
+	getRekeyFile    = `SELECT CryptoHash FROM RekeyFiles WHERE FileID = ?;`
+	removeRekeyFile = `DELETE FROM RekeyFiles WHERE FileID = ?;`
+	getRekeyFiles   = `SELECT RekeyFiles.FileID, RekeyFiles.CryptoHash FROM RekeyFiles
+					INNER JOIN FileInfo ON FileInfo.FileID = RekeyFiles.FileID
+					WHERE FileInfo.UserID = ? AND FileInfo.TrashedAt = 0 ORDER BY RekeyFiles.FileID;`
+
+	transferFileInfo  = `UPDATE FileInfo SET UserID = ?, NameKey = '' WHERE FileID = ?;`
+	getFileAllocated  = `SELECT IFNULL(SUM(ChunkSize), 0) FROM FileChunks WHERE FileID = ?;`
+	getUserCryptoByID = `SELECT CryptoHash FROM Users WHERE UserID = ?;`
+)
+
+// RekeyFile is a file that was transferred from a user with a different
+// crypto password. Its name, chunks and metadata are still encrypted with
+// the key of the crypto hash it had before the transfer until the new owner
+// re-encrypts them with RekeyFile.
+type RekeyFile struct {
+	FileID     int
+	CryptoHash []byte
+}
+
+// TransferFiles gives the files of fromUserID to toUserID along with all
+// of their versions, chunks and metadata, such as when an employee leaves.
+// The allocation moves with the files and must fit within the quota of the
+// new owner, which is only charged once for chunk data that the chunks of
+// the files share with each other or with its own chunks. The server can't re-encrypt the files, so if the users have
+// different crypto passwords the files are recorded as needing to be
+// re-keyed by the new owner. The number of bytes transferred is returned.
+func (s *Storage) TransferFiles(fromUserID, toUserID int, fileIDs []int) (int64, error) {
+	defer s.timeOperation("TransferFiles", fromUserID)()
+
+	if fromUserID == toUserID {
+		return 0, fmt.Errorf("files can't be transferred to the user that owns them")
+	}
+
+	var transferred int64
+	err := s.transact(func(tx *sql.Tx) error {
+		var fromCryptoHash, toCryptoHash []byte
+		err := tx.QueryRow(getUserCryptoByID, fromUserID).Scan(&fromCryptoHash)
+		if err != nil {
+			return fmt.Errorf("failed to get the user (%d) from the database: %v", fromUserID, err)
+		}
+		err = tx.QueryRow(getUserCryptoByID, toUserID).Scan(&toCryptoHash)
+		if err != nil {
+			return fmt.Errorf("failed to get the user (%d) from the database: %v", toUserID, err)
+		}
+
+		for _, fileID := range fileIDs {
+			var owningUserID, currentVersionID int
+			var fileName string
+			var isDir bool
+			err = tx.QueryRow(getFileInfo, fileID).Scan(&owningUserID, &fileName, &isDir, &currentVersionID)
+			if err != nil {
+				return fmt.Errorf("failed to get the file info for file id %d from the database: %v", fileID, err)
+			}
+			if owningUserID != fromUserID {
+				return ErrNotOwner
+			}
+
+			// the new owner can't already have a file by that name
+			var existingID, existingVersion int
+			var existingIsDir bool
+			err = tx.QueryRow(getFileInfoByName, fileName, toUserID).Scan(&existingID, &existingIsDir, &existingVersion)
+			if err == nil {
+				return fmt.Errorf("failed to transfer the file id (%d): %w", fileID, ErrFileExists)
+			} else if err != sql.ErrNoRows {
+				return fmt.Errorf("failed to look up the file name in the database: %v", err)
+			}
+
+			var size int64
+			err = tx.QueryRow(getFileAllocated, fileID).Scan(&size)
+			if err != nil {
+				return fmt.Errorf("failed to get the chunk sizes for a file in the database: %v", err)
+			}
+			_, err = tx.Exec(transferFileInfo, toUserID, fileID)
+			if err != nil {
+				return fmt.Errorf("failed to transfer the file id (%d) in the database: %v", fileID, err)
+			}
+
+			// the search tokens were made with the old owner's key
+			_, err = tx.Exec(removeFileSearchTokens, fileID)
+			if err != nil {
+				return fmt.Errorf("failed to remove the search tokens of the file: %v", err)
+			}
+
+			// move the allocation, which also bumps the revision of both users
+			_, err = tx.Exec(updateUserStats, -size, fromUserID)
+			if err != nil {
+				return fmt.Errorf("failed to update the allocated bytes of the user (%d): %v", fromUserID, err)
+			}
+			_, err = tx.Exec(updateUserStats, size, toUserID)
+			if err != nil {
+				return fmt.Errorf("failed to update the allocated bytes of the user (%d): %v", toUserID, err)
+			}
+
+			// the data the chunks share is now shared by the new owner's chunks
+			ids, err := chunkDataIDs(tx, getChunkDataIDsOfFile, fileID)
+			if err != nil {
+				return err
+			}
+			err = countChunkDataRefs(tx, ids)
+			if err != nil {
+				return err
+			}
+
+			// the allocation is only known once the file has moved
+			err = s.checkQuota(tx, toUserID, 0, 0)
+			if err != nil {
+				return err
+			}
+
+			// a file that was never re-keyed is still encrypted with the key
+			// of an earlier owner
+			fileCryptoHash := fromCryptoHash
+			err = tx.QueryRow(getRekeyFile, fileID).Scan(&fileCryptoHash)
+			if err != nil && err != sql.ErrNoRows {
+				return fmt.Errorf("failed to get the re-key state of the file: %v", err)
+			}
+			if bytes.Equal(fileCryptoHash, toCryptoHash) {
+				_, err = tx.Exec(removeRekeyFile, fileID)
+			} else {
+				_, err = tx.Exec(setRekeyFile, fileID, fileCryptoHash)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to set the re-key state of the file: %v", err)
+			}
+
+			err = journal(tx, JournalEntry{UserID: toUserID, OldUserID: fromUserID, FileID: fileID, Action: JournalFileTransferred,
+				FileName: fileName, IsDir: isDir, CurrentVersionID: currentVersionID, PreviousVersionID: currentVersionID})
+			if err != nil {
+				return err
+			}
+			transferred += size
+		}
+
+		return s.checkFileLimits(tx, toUserID)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return transferred, nil
+}
+
+// GetRekeyFiles returns the files of the user that were transferred from a
+// user with a different crypto password and haven't been re-keyed yet.
+func (s *Storage) GetRekeyFiles(userID int) ([]RekeyFile, error) {
+	defer s.timeOperation("GetRekeyFiles", userID)()
+
+	rows, err := s.db.Query(getRekeyFiles, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the files to re-key: %v", err)
+	}
+	defer rows.Close()
+
+	files := []RekeyFile{}
+	for rows.Next() {
+		var rf RekeyFile
+		err = rows.Scan(&rf.FileID, &rf.CryptoHash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next file to re-key: %v", err)
+		}
+		files = append(files, rf)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get the files to re-key: %v", err)
+	}
+
+	return files, nil
+}
+
+// RekeyFile finishes re-keying a transferred file once the client has
+// re-encrypted its chunks and metadata with the key of the new owner. The
+// file gets the newName encrypted with that key and its nameKey, and is no
+// longer returned by GetRekeyFiles.
+func (s *Storage) RekeyFile(userID int, fileID int, newName string, nameKey string) error {
+	defer s.timeOperation("RekeyFile", userID)()
+
+	return s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return ErrNotOwner
+		}
+
+		var cryptoHash []byte
+		err = tx.QueryRow(getRekeyFile, fileID).Scan(&cryptoHash)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("the file id (%d) doesn't need to be re-keyed", fileID)
+		} else if err != nil {
+			return fmt.Errorf("failed to get the re-key state of the file: %v", err)
+		}
+
+		err = renameFile(tx, userID, fileID, newName)
+		if err != nil {
+			return err
+		}
+		err = setFileNameKey(tx, userID, fileID, nameKey)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(removeRekeyFile, fileID)
+		if err != nil {
+			return fmt.Errorf("failed to remove the re-key state of the file: %v", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,248 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	getFileInfoIncludingTrash = `SELECT UserID, FileName, IsDir, CurrentVersionID FROM FileInfo WHERE FileID = ?;`
+	getTrashedFileInfo        = `SELECT UserID, FileName, IsDir FROM FileInfo WHERE FileID = ? AND TrashedAt > 0;`
+	getUserTrash              = `SELECT FileID, FileName, IsDir, CurrentVersionID, TrashedAt FROM FileInfo
+					WHERE UserID = ? AND TrashedAt > 0 ORDER BY TrashedAt;`
+	getUserTrashIDs  = `SELECT FileID FROM FileInfo WHERE UserID = ? AND TrashedAt > 0;`
+	getExpiredTrash  = `SELECT FileID, UserID FROM FileInfo WHERE TrashedAt > 0 AND TrashedAt <= ?;`
+	setFileTrashedAt = `UPDATE FileInfo SET TrashedAt = ? WHERE FileID = ?;`
+)
+
+// TrashedFile is a file in a user's trash along with when it was trashed and
+// when it will be removed for good.
+type TrashedFile struct {
+	FileInfo
+	TrashedAt time.Time
+	ExpiresAt time.Time
+}
+
+// trashFile moves the file to the trash and records the change in the
+// journal. The file keeps its versions, chunks and allocation until it is
+// restored or removed from the trash.
+func trashFile(tx *sql.Tx, userID, fileID int, now time.Time) error {
+	e := JournalEntry{Time: now, UserID: userID, FileID: fileID, Action: JournalFileTrashed}
+	err := tx.QueryRow(getFileInfo, fileID).Scan(new(int), &e.FileName, &e.IsDir, &e.CurrentVersionID)
+	if err != nil {
+		return fmt.Errorf("failed to get the file info from the database: %v", err)
+	}
+	e.PreviousVersionID = e.CurrentVersionID
+	err = journal(tx, e)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(setFileTrashedAt, now.Unix(), fileID)
+	if err != nil {
+		return fmt.Errorf("failed to move the file to the trash: %v", err)
+	}
+
+	// bump the revision so that clients notice the file is gone
+	_, err = tx.Exec(updateUserStats, 0, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update the user's revision after trashing a file: %v", err)
+	}
+	return nil
+}
+
+// GetTrash returns the files in the user's trash, oldest first.
+func (s *Storage) GetTrash(userID int) ([]TrashedFile, error) {
+	defer s.timeOperation("GetTrash", userID)()
+
+	rows, err := s.db.Query(getUserTrash, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the trash from the database: %v", err)
+	}
+	defer rows.Close()
+
+	result := []TrashedFile{}
+	for rows.Next() {
+		var tf TrashedFile
+		var trashedAt int64
+		err := rows.Scan(&tf.FileID, &tf.FileName, &tf.IsDir, &tf.CurrentVersion.VersionID, &trashedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing the trash: %v", err)
+		}
+		tf.UserID = userID
+		tf.TrashedAt = time.Unix(trashedAt, 0)
+		tf.ExpiresAt = tf.TrashedAt.Add(s.TrashRetention)
+		result = append(result, tf)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan all of the trash: %v", err)
+	}
+	rows.Close()
+
+	for i := range result {
+		v := &result[i].CurrentVersion
+		err = s.db.QueryRow(getFileVersionByID, v.VersionID).Scan(&v.VersionNumber, &v.Permissions, &v.LastMod, &v.ChunkCount, &v.FileHash, &v.MerkleRoot, &v.CreatedAt, &v.Device)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the current file version of a trashed file: %v", err)
+		}
+	}
+
+	return result, nil
+}
+
+// RestoreFile moves the file out of the user's trash. ErrFileExists is
+// returned if the user has since added another file with the same name or
+// name key.
+func (s *Storage) RestoreFile(userID, fileID int) error {
+	defer s.timeOperation("RestoreFile", userID)()
+
+	return s.transact(func(tx *sql.Tx) error {
+		e := JournalEntry{UserID: userID, FileID: fileID, Action: JournalFileRestored}
+		var owningUserID int
+		err := tx.QueryRow(getTrashedFileInfo, fileID).Scan(&owningUserID, &e.FileName, &e.IsDir)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("file id %d is not in the trash", fileID)
+		} else if err != nil {
+			return fmt.Errorf("failed to get the trashed file info from the database: %v", err)
+		}
+		if owningUserID != userID {
+			return ErrNotOwner
+		}
+
+		var liveID, liveVersionID int
+		var liveIsDir bool
+		err = tx.QueryRow(getFileInfoByName, e.FileName, userID).Scan(&liveID, &liveIsDir, &liveVersionID)
+		if err == nil {
+			return fmt.Errorf("failed to restore the file: %w", ErrFileExists)
+		} else if err != sql.ErrNoRows {
+			return fmt.Errorf("failed to check for a file with the same name: %v", err)
+		}
+		var nameKey string
+		err = tx.QueryRow(getFileNameKey, fileID).Scan(&nameKey)
+		if err != nil {
+			return fmt.Errorf("failed to get the name key of the file: %v", err)
+		}
+		if nameKey != "" {
+			err = checkNameKeyFree(tx, userID, fileID, nameKey)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = tx.QueryRow(getFileCurrentVersionID, fileID).Scan(&e.CurrentVersionID)
+		if err != nil {
+			return fmt.Errorf("failed to get the current version of the file: %v", err)
+		}
+		e.PreviousVersionID = e.CurrentVersionID
+		err = journal(tx, e)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(setFileTrashedAt, 0, fileID)
+		if err != nil {
+			return fmt.Errorf("failed to restore the file from the trash: %v", err)
+		}
+		_, err = tx.Exec(updateUserStats, 0, userID)
+		if err != nil {
+			return fmt.Errorf("failed to update the user's revision after restoring a file: %v", err)
+		}
+		return nil
+	})
+}
+
+// EmptyTrash removes every file in the user's trash for good and returns
+// the number of files removed.
+func (s *Storage) EmptyTrash(userID int) (int, error) {
+	defer s.timeOperation("EmptyTrash", userID)()
+
+	var removed int
+	err := s.transact(func(tx *sql.Tx) error {
+		fileIDs, err := queryIDs(tx, getUserTrashIDs, userID)
+		if err != nil {
+			return fmt.Errorf("failed to get the trash from the database: %v", err)
+		}
+		for _, fileID := range fileIDs {
+			err = s.purgeFile(tx, userID, fileID)
+			if err != nil {
+				return err
+			}
+		}
+		removed = len(fileIDs)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// ExpireTrash removes the files of all users that have been in the trash
+// longer than TrashRetention and returns the number of files removed.
+func (s *Storage) ExpireTrash(now time.Time) (int, error) {
+	defer s.timeOperation("ExpireTrash", NoUserID)()
+
+	if s.TrashRetention <= 0 {
+		return 0, nil
+	}
+
+	var removed int
+	err := s.transact(func(tx *sql.Tx) error {
+		rows, err := tx.Query(getExpiredTrash, now.Add(-s.TrashRetention).Unix())
+		if err != nil {
+			return fmt.Errorf("failed to get the expired trash from the database: %v", err)
+		}
+		type expired struct{ fileID, userID int }
+		var files []expired
+		for rows.Next() {
+			var f expired
+			err = rows.Scan(&f.fileID, &f.userID)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan the next row while processing the expired trash: %v", err)
+			}
+			files = append(files, f)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to scan all of the expired trash: %v", err)
+		}
+
+		for _, f := range files {
+			err = s.purgeFile(tx, f.userID, f.fileID)
+			if err != nil {
+				return err
+			}
+		}
+		removed = len(files)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// queryIDs returns the single integer column of the rows selected by query.
+func queryIDs(tx *sql.Tx, query string, args ...interface{}) ([]int, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
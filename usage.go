@@ -0,0 +1,205 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	createTransferUsageTable = `CREATE TABLE IF NOT EXISTS TransferUsage (
+        Day         TEXT                NOT NULL,
+        UserID      INTEGER             NOT NULL,
+        BytesIn     INTEGER             NOT NULL,
+        BytesOut    INTEGER             NOT NULL,
+        PRIMARY KEY (Day, UserID)
+	);`
+
+	addTransferUsageDay = `INSERT OR IGNORE INTO TransferUsage (Day, UserID, BytesIn, BytesOut) VALUES (?, ?, 0, 0);`
+	addTransferUsage    = `UPDATE TransferUsage SET BytesIn = BytesIn + ?, BytesOut = BytesOut + ? WHERE Day = ? AND UserID = ?;`
+	getTransferUsage    = `SELECT Day, UserID, BytesIn, BytesOut FROM TransferUsage WHERE Day >= ? AND Day <= ? ORDER BY UserID, Day;`
+	getUserTransfer     = `SELECT IFNULL(SUM(BytesIn), 0), IFNULL(SUM(BytesOut), 0) FROM TransferUsage
+					WHERE UserID = ? AND Day >= ? AND Day <= ?;`
+
+	getUsageSnapshotsBetween = `SELECT Day, UserID, Allocated, FileCount, VersionCount FROM UsageSnapshots
+					WHERE Day >= ? AND Day <= ? ORDER BY UserID, Day;`
+)
+
+// UsageReport is the storage and transfer usage of a user over a range of
+// days, suitable for billing. The storage figures come from the daily usage
+// snapshots, so Days is the number of days in the range that had a snapshot.
+// Allocated, FileCount and VersionCount are from the last snapshot in the
+// range.
+type UsageReport struct {
+	UserID int
+	Name   string // empty if the user has since been removed
+	From   string // formatted as YYYY-MM-DD in UTC
+	To     string // formatted as YYYY-MM-DD in UTC
+
+	Days             int
+	AverageAllocated int64
+	PeakAllocated    int64
+	Allocated        int64
+	FileCount        int
+	VersionCount     int
+
+	// BytesIn and BytesOut are the chunk bytes the user uploaded and
+	// downloaded over the range
+	BytesIn  int64
+	BytesOut int64
+}
+
+// TransferStats are the chunk bytes a user has uploaded and downloaded in a
+// calendar month along with the server's monthly transfer limit.
+type TransferStats struct {
+	Month    string // formatted as YYYY-MM in UTC
+	BytesIn  int64
+	BytesOut int64
+	Limit    int64 // zero if there's no limit
+}
+
+// RecordTransfer adds the uploaded and downloaded bytes to the user's
+// transfer usage for the current day.
+func (s *Storage) RecordTransfer(userID int, bytesIn int64, bytesOut int64) error {
+	defer s.timeOperation("RecordTransfer", userID)()
+
+	day := UsageSnapshotDay(time.Now())
+	return s.transact(func(tx *sql.Tx) error {
+		_, err := tx.Exec(addTransferUsageDay, day, userID)
+		if err != nil {
+			return fmt.Errorf("failed to add the transfer usage day for user id %d: %v", userID, err)
+		}
+		_, err = tx.Exec(addTransferUsage, bytesIn, bytesOut, day, userID)
+		if err != nil {
+			return fmt.Errorf("failed to update the transfer usage for user id %d: %v", userID, err)
+		}
+		return nil
+	})
+}
+
+// GetMonthlyTransfer returns the transfer usage of the user for the calendar
+// month that t falls within.
+func (s *Storage) GetMonthlyTransfer(userID int, t time.Time) (*TransferStats, error) {
+	defer s.timeOperation("GetMonthlyTransfer", userID)()
+
+	stats := &TransferStats{Month: t.UTC().Format("2006-01"), Limit: s.TransferLimit}
+	err := s.db.QueryRow(getUserTransfer, userID, stats.Month+"-01", stats.Month+"-31").Scan(&stats.BytesIn, &stats.BytesOut)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the transfer usage for user id %d: %v", userID, err)
+	}
+	return stats, nil
+}
+
+// CheckTransferLimit fails with ErrTransferLimit if transferring size more
+// bytes this month would put the user over the monthly transfer limit.
+func (s *Storage) CheckTransferLimit(userID int, size int64) error {
+	if s.TransferLimit <= 0 {
+		return nil
+	}
+
+	stats, err := s.GetMonthlyTransfer(userID, time.Now())
+	if err != nil {
+		return err
+	}
+	if stats.BytesIn+stats.BytesOut+size > s.TransferLimit {
+		return fmt.Errorf("%w (limit %d ; transferred %d this month ; chunk size %d)", ErrTransferLimit, s.TransferLimit, stats.BytesIn+stats.BytesOut, size)
+	}
+	return nil
+}
+
+// GetUsageReport returns the storage and transfer usage of every user over
+// the days that from and to fall within, inclusive, ordered by user id.
+// Current users are always included; removed users are included if they
+// have usage recorded in the range.
+func (s *Storage) GetUsageReport(from time.Time, to time.Time) ([]UsageReport, error) {
+	defer s.timeOperation("GetUsageReport", NoUserID)()
+
+	fromDay := UsageSnapshotDay(from)
+	toDay := UsageSnapshotDay(to)
+	if fromDay > toDay {
+		return nil, fmt.Errorf("the start of the usage report range (%s) is after the end (%s)", fromDay, toDay)
+	}
+
+	summaries, err := s.GetAllUserSummaries()
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make(map[int]*UsageReport)
+	getReport := func(userID int) *UsageReport {
+		r, ok := reports[userID]
+		if !ok {
+			r = &UsageReport{UserID: userID, From: fromDay, To: toDay}
+			reports[userID] = r
+		}
+		return r
+	}
+	for _, us := range summaries {
+		getReport(us.ID).Name = us.Name
+	}
+
+	// the snapshots are ordered by day, so the last one seen for a user
+	// holds their usage at the end of the range
+	rows, err := s.db.Query(getUsageSnapshotsBetween, fromDay, toDay)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the usage snapshots from the database: %v", err)
+	}
+	defer rows.Close()
+	totals := make(map[int]int64)
+	for rows.Next() {
+		var snap UsageSnapshot
+		err := rows.Scan(&snap.Day, &snap.UserID, &snap.Allocated, &snap.FileCount, &snap.VersionCount)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing usage snapshots: %v", err)
+		}
+		r := getReport(snap.UserID)
+		r.Days++
+		r.Allocated = int64(snap.Allocated)
+		r.FileCount = snap.FileCount
+		r.VersionCount = snap.VersionCount
+		if r.Allocated > r.PeakAllocated {
+			r.PeakAllocated = r.Allocated
+		}
+		totals[snap.UserID] += r.Allocated
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan all of the usage snapshots: %v", err)
+	}
+	for userID, total := range totals {
+		r := reports[userID]
+		r.AverageAllocated = total / int64(r.Days)
+	}
+
+	transferRows, err := s.db.Query(getTransferUsage, fromDay, toDay)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the transfer usage from the database: %v", err)
+	}
+	defer transferRows.Close()
+	for transferRows.Next() {
+		var day string
+		var userID int
+		var bytesIn, bytesOut int64
+		err := transferRows.Scan(&day, &userID, &bytesIn, &bytesOut)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing transfer usage: %v", err)
+		}
+		r := getReport(userID)
+		r.BytesIn += bytesIn
+		r.BytesOut += bytesOut
+	}
+	if err := transferRows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan all of the transfer usage: %v", err)
+	}
+
+	result := make([]UsageReport, 0, len(reports))
+	for _, r := range reports {
+		result = append(result, *r)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].UserID < result[j].UserID })
+
+	return result, nil
+}